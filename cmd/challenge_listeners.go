@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/cert_manager"
+	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
+)
+
+const (
+	challengeHTTPReadHeaderTimeout = 10 * time.Second
+
+	// Names of challenge listeners, passed to new process by graceful restart as socket activated listeners.
+	challengesTLSALPNSystemdName = "challenges-tls-alpn"
+	challengesHTTPSystemdName    = "challenges-http"
+)
+
+// challengesConfig - listeners, which answer to acme challenges only, separate from serving listeners.
+type challengesConfig struct {
+	HTTPAddresses                 []string
+	TLSALPNAddresses              []string
+	DisableOnMainListeners        bool
+	DisableTLSALPNOnMainListeners bool
+}
+
+// getChallengeTypes return challenge types, which can be answered by configured listeners.
+// tls-alpn-01 answered by tls listeners and TLSALPNAddresses, http-01 - by tcp listeners and HTTPAddresses,
+// it need EnableHTTPValidation.
+func getChallengeTypes(config *configType) (tlsALPN, http01 bool, err error) {
+	challenges := config.Challenges
+	if len(challenges.HTTPAddresses) > 0 && !config.General.EnableHTTPValidation {
+		return false, false, xerrors.New("Challenges.HTTPAddresses require General.EnableHTTPValidation")
+	}
+
+	tlsALPN = len(challenges.TLSALPNAddresses) > 0 ||
+		!challenges.DisableOnMainListeners && !challenges.DisableTLSALPNOnMainListeners
+	http01 = len(challenges.HTTPAddresses) > 0 || !challenges.DisableOnMainListeners
+	for _, listener := range config.Listeners {
+		if listener.DisableChallenges {
+			continue
+		}
+		if !listener.DisableTLSALPNChallenge {
+			tlsALPN = tlsALPN || len(listener.TLSAddresses) > 0 || listener.SystemdTLSName != ""
+		}
+		http01 = http01 || len(listener.TCPAddresses) > 0 || listener.SystemdTCPName != ""
+	}
+	http01 = http01 && config.General.EnableHTTPValidation
+	if !tlsALPN && !config.General.EnableHTTPValidation {
+		return false, false, xerrors.New("no listeners for tls-alpn-01 challenges (only challenge type without " +
+			"General.EnableHTTPValidation): set Challenges.TLSALPNAddresses or enable tls-alpn-01 on any listener")
+	}
+	if !tlsALPN && !http01 {
+		return false, false, xerrors.New("no listeners for acme challenges: set Challenges.TLSALPNAddresses or " +
+			"Challenges.HTTPAddresses (with General.EnableHTTPValidation) or enable challenges on main listeners")
+	}
+	return tlsALPN, http01, nil
+}
+
+// startChallengeListeners start listeners of challenges, which configured by own addresses.
+// Listeners, inherited from previous process by graceful restart, used instead of bind the addresses.
+// It return the listeners for pass to next process. The listeners stopped when ctx canceled.
+func startChallengeListeners(ctx context.Context, config challengesConfig, certManager *cert_manager.Manager,
+	registry *prometheus.Registry) ([]handoffListener, error) {
+	logger := zc.L(ctx)
+
+	var res []handoffListener
+	if len(config.TLSALPNAddresses) > 0 {
+		listener := &tlslistener.ListenersHandler{
+			GetCertificate: certManager.GetCertificate,
+			NextProtos:     []string{},
+			ChallengesOnly: true,
+			Name:           "challenges",
+		}
+		listenConfig := tlslistener.Config{TLSAddresses: config.TLSALPNAddresses}
+		inherited := tlslistener.TakeSystemdListeners(ctx, challengesTLSALPNSystemdName)
+		if len(inherited) > 0 {
+			listenConfig.TLSAddresses = nil
+		}
+		err := listenConfig.Apply(ctx, listener)
+		if err != nil {
+			return nil, xerrors.Errorf("apply tls-alpn-01 challenges listener config: %w", err)
+		}
+		if len(inherited) > 0 {
+			logger.Info("Use inherited tls-alpn-01 challenges listeners", zap.Int("count", len(inherited)))
+			listener.ListenersForHandleTLS = inherited
+		}
+		err = listener.Start(ctx, listenerRegisterer(registry, listener.Name))
+		if err != nil {
+			return nil, xerrors.Errorf("start tls-alpn-01 challenges listener: %w", err)
+		}
+		logger.Info("Start tls-alpn-01 challenges listener", zap.Strings("addresses", config.TLSALPNAddresses))
+		res = append(res, handoffListener{
+			handler: listener,
+			config:  tlslistener.Config{SystemdTLSName: challengesTLSALPNSystemdName},
+		})
+
+		// tls-alpn-01 answered by handshake, connections after handshake don't served
+		go serveChallenges(ctx, listener, http.NotFoundHandler())
+	}
+
+	if len(config.HTTPAddresses) == 0 {
+		return res, nil
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !certManager.HandleHTTPValidation(w, r) {
+			http.NotFound(w, r)
+		}
+	})
+	listeners := tlslistener.TakeSystemdListeners(ctx, challengesHTTPSystemdName)
+	if len(listeners) > 0 {
+		logger.Info("Use inherited http-01 challenges listeners", zap.Int("count", len(listeners)))
+	} else {
+		for _, addr := range config.HTTPAddresses {
+			listener, err := net.Listen("tcp", addr)
+			log.DebugError(logger, err, "Start listen http-01 challenges", zap.String("address", addr))
+			if err != nil {
+				closeListeners(listeners)
+				return nil, xerrors.Errorf("listen http-01 challenges address %q: %w", addr, err)
+			}
+			listeners = append(listeners, listener)
+		}
+	}
+	for _, listener := range listeners {
+		logger.Info("Start http-01 challenges listener", zap.Stringer("address", listener.Addr()))
+		go serveChallenges(ctx, listener, handler)
+	}
+	// the handler doesn't started, it hold raw listeners for pass to next process and stop accept only
+	res = append(res, handoffListener{
+		handler: &tlslistener.ListenersHandler{Listeners: listeners},
+		config:  tlslistener.Config{SystemdTCPName: challengesHTTPSystemdName},
+	})
+	return res, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+}
+
+func serveChallenges(ctx context.Context, listener net.Listener, handler http.Handler) {
+	logger := zc.L(ctx)
+	defer log.HandlePanic(logger)
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: challengeHTTPReadHeaderTimeout,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		defer log.HandlePanic(logger)
+
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	err := server.Serve(listener)
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	log.DebugError(logger, err, "Challenges listener stopped")
+}
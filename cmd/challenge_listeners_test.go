@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/cert_manager"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
+)
+
+func TestGetChallengeTypes(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	tests := []struct {
+		name            string
+		config          configType
+		tlsALPN, http01 bool
+		err             bool
+	}{
+		{name: "default", config: configType{}, tlsALPN: true},
+		{name: "http", config: configType{General: configGeneral{EnableHTTPValidation: true}}, tlsALPN: true, http01: true},
+		{
+			name:   "http listener without http validation",
+			config: configType{Challenges: challengesConfig{HTTPAddresses: []string{":80"}}},
+			err:    true,
+		},
+		{
+			name: "http listener only",
+			config: configType{
+				General:    configGeneral{EnableHTTPValidation: true},
+				Challenges: challengesConfig{HTTPAddresses: []string{":80"}, DisableOnMainListeners: true},
+			},
+			http01: true,
+		},
+		{
+			name:    "tls-alpn listener only",
+			config:  configType{Challenges: challengesConfig{TLSALPNAddresses: []string{":443"}, DisableOnMainListeners: true}},
+			tlsALPN: true,
+		},
+		{
+			name: "additional listener",
+			config: configType{
+				Challenges: challengesConfig{DisableOnMainListeners: true},
+				Listeners:  []listenerConfig{{Config: tlslistener.Config{TLSAddresses: []string{":8443"}}}},
+			},
+			tlsALPN: true,
+		},
+		{
+			name: "no listeners",
+			config: configType{
+				General:    configGeneral{EnableHTTPValidation: true},
+				Challenges: challengesConfig{DisableOnMainListeners: true},
+				Listeners: []listenerConfig{
+					{Config: tlslistener.Config{TLSAddresses: []string{":8443"}}, DisableChallenges: true},
+				},
+			},
+			err: true,
+		},
+		{
+			name: "tls-alpn disabled on all listeners",
+			config: configType{
+				Challenges: challengesConfig{DisableTLSALPNOnMainListeners: true},
+				Listeners: []listenerConfig{
+					{Config: tlslistener.Config{TLSAddresses: []string{":8443"}}, DisableTLSALPNChallenge: true},
+				},
+			},
+			err: true,
+		},
+		{
+			name: "http only on main listeners",
+			config: configType{
+				General:    configGeneral{EnableHTTPValidation: true},
+				Challenges: challengesConfig{DisableTLSALPNOnMainListeners: true},
+			},
+			http01: true,
+		},
+		{
+			name: "tls-alpn on additional listener only",
+			config: configType{
+				Challenges: challengesConfig{DisableTLSALPNOnMainListeners: true},
+				Listeners: []listenerConfig{
+					{Name: "internal", Config: tlslistener.Config{TLSAddresses: []string{":8443"}}, DisableTLSALPNChallenge: true},
+					{Name: "public", Config: tlslistener.Config{TLSAddresses: []string{":443"}}},
+				},
+			},
+			tlsALPN: true,
+		},
+	}
+
+	for _, test := range tests {
+		tlsALPN, http01, err := getChallengeTypes(&test.config)
+		if test.err {
+			td.CmpError(err, test.name)
+			continue
+		}
+		td.CmpNoError(err, test.name)
+		td.Cmp(tlsALPN, test.tlsALPN, test.name)
+		td.Cmp(http01, test.http01, test.name)
+	}
+}
+
+func TestServeChallenges(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	ctx, cancel := context.WithCancel(ctx)
+	listener := th.NewLocalTcpListener(e)
+	done := make(chan struct{})
+	go func() {
+		serveChallenges(ctx, listener, http.NotFoundHandler())
+		close(done)
+	}()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/.well-known/acme-challenge/token")
+	e.CmpNoError(err)
+	_ = resp.Body.Close()
+	e.Cmp(resp.StatusCode, http.StatusNotFound)
+
+	cancel()
+	<-done
+}
+
+func TestStartChallengeListenersHandoff(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	listeners, err := startChallengeListeners(ctx, challengesConfig{HTTPAddresses: []string{"127.0.0.1:0"}},
+		&cert_manager.Manager{}, nil)
+	td.CmpNoError(err)
+	if !td.Len(listeners, 1) {
+		return
+	}
+	td.Cmp(listeners[0].config.SystemdTCPName, challengesHTTPSystemdName)
+	td.Len(listeners[0].handler.Listeners, 1)
+	td.CmpNoError(listeners[0].handler.StopAccept())
+}
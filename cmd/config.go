@@ -3,51 +3,175 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	_ "embed"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
+	"github.com/rekby/lets-proxy2/internal/acme_client_manager"
+	"github.com/rekby/lets-proxy2/internal/cert_manager"
 	"github.com/rekby/lets-proxy2/internal/config"
+	"github.com/rekby/lets-proxy2/internal/domain"
 	"github.com/rekby/lets-proxy2/internal/domain_checker"
+	"github.com/rekby/lets-proxy2/internal/events"
 	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/outbound_proxy"
 	"github.com/rekby/lets-proxy2/internal/profiler"
 	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/static_certs"
 	"github.com/rekby/lets-proxy2/internal/tlslistener"
 	zc "github.com/rekby/zapcontext"
 	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/xerrors"
+)
+
+var (
+	certGroupNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	listenerNameRegexp  = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+)
+
+const certSubjectValueMaxLen = 64
+
+// merge modes of arrays, defined in config file, with arrays from previously read files
+const (
+	mergeArraysReplace = "replace"
+	mergeArraysAppend  = "append"
 )
 
 //go:embed static/default-config.toml
 var defaultConfigContent []byte
 
 type configType struct {
-	General      configGeneral
-	Log          logConfig
-	Proxy        proxy.Config
-	CheckDomains domain_checker.Config
-	Listen       tlslistener.Config
+	General       configGeneral
+	Log           logConfig
+	Proxy         proxy.Config
+	ForwardProxy  proxy.ForwardProxyConfig
+	OutboundProxy outbound_proxy.Config
+	CheckDomains  domain_checker.Config
+	Listen        tlslistener.Config
 
 	Profiler profiler.Config
 	Metrics  config.Config
+	Events   events.Config
+
+	Managed     managedConfig
+	Challenges  challengesConfig
+	CertGroups  []certGroupConfig
+	Listeners   []listenerConfig
+	StaticCerts []static_certs.Files
+}
+
+// listenerConfig - additional listener with own tls settings and domains policy.
+// Connections of all listeners served by same proxy and certificate manager.
+type listenerConfig struct {
+	Name string
+	tlslistener.Config
+
+	// CheckDomains - additional restriction of domains for the listener, checked before common CheckDomains.
+	CheckDomains            domain_checker.Config
+	DisableChallenges       bool
+	DisableTLSALPNChallenge bool
+}
+
+// managedConfig - domains, which certificates issued at start and renewed proactively.
+// Other domains, allowed by CheckDomains, issued on demand by first handshake.
+type managedConfig struct {
+	Domains []string
+
+	// CheckInterval in seconds
+	CheckInterval int
+}
+
+type certGroupConfig struct {
+	Name    string
+	Domains []string
 }
 
 type configGeneral struct {
-	IssueTimeout            int
-	StorageDir              string
-	Subdomains              []string
-	AcmeServer              string
-	StoreJSONMetadata       bool
-	IncludeConfigs          []string
-	MaxConfigFilesRead      int
-	AllowRSACert            bool
-	AllowECDSACert          bool
-	AllowInsecureTLSChipers bool
-	MinTLSVersion           string
+	IssueTimeout                      int
+	StorageDir                        string
+	Subdomains                        []string
+	AutoIncludeApexAndWww             bool
+	AcmeEnabled                       bool
+	AcmeServer                        string
+	AcmeAccountEmail                  string
+	AcmeAcceptTOS                     bool
+	AcmeAccountImportFile             string
+	AcmeAccountExport                 bool
+	AcmeAccountProblemMode            string
+	AcmeRetryCount                    int
+	AcmeUserAgent                     string
+	AcmeHeaders                       []string
+	AcmeDialTimeout                   int
+	AcmeTLSHandshakeTimeout           int
+	AcmeResponseHeaderTimeout         int
+	AcmeRequestTimeout                int
+	AcmeValidationTimeout             int
+	ChallengeCleanupRetries           int
+	ChallengeCleanupRetryDelay        int
+	ChallengeMaxAge                   int
+	EnableHTTPValidation              bool
+	AllowIPCerts                      bool
+	AllowedIPs                        []string
+	HTTPValidationPreflight           bool
+	HTTPValidationPreflightCheckerURL string
+	HTTPValidationPreflightFallback   bool
+	PreferredChain                    string
+	ServeRootCert                     bool
+	ServedIntermediatesFile           string
+	DryRun                            bool
+	OCSPStapling                      bool
+	MustStaple                        bool
+	ClockSkewToleranceSeconds         int
+	ClockSkewWarningSeconds           int
+	CertOrganization                  []string
+	CertOrganizationalUnit            []string
+	OnDomainDenied                    string
+	StoreJSONMetadata                 bool
+	MaxCachedCerts                    int
+	ReuseKeyOnRenewal                 bool
+	PinCertKeys                       bool
+	KeyPoolSize                       int
+	KeyPoolKeyTypes                   []string
+	KeyPoolMaxKeyAgeMinutes           int
+	CacheGCRetentionDays              int
+	CacheGCIntervalHours              int
+	CacheGCDryRun                     bool
+	PersistAcmeOrders                 bool
+	WarmCacheOnStartup                bool
+	WarmCacheReissueExpired           bool
+	HandshakeCertConcurrency          int
+	HandshakeCertQueueSize            int
+	HandshakeCertQueueTimeoutSeconds  int
+	OnExpiredCert                     string
+	RenewalBackoffMinSeconds          int
+	RenewalBackoffMaxSeconds          int
+	RenewalFailingAfter               int
+	IncludeConfigs                    []string
+	MergeArrays                       string
+	MaxConfigFilesRead                int
+	AllowRSACert                      bool
+	AllowECDSACert                    bool
+	AllowInsecureTLSChipers           bool
+	MinTLSVersion                     string
+	RunAsUser                         string
+	RunAsGroup                        string
 }
 
 //nolint:maligned
@@ -63,6 +187,7 @@ type logConfig struct {
 	CompressRotated   bool
 	MaxDays           int
 	MaxCount          int
+	DebugDomains      []string
 }
 
 var (
@@ -74,11 +199,9 @@ func getConfig(ctx context.Context) *configType {
 	if _config == nil {
 		logger := zc.LNop(ctx).With(zap.String("config_file", *configFileP))
 		logger.Info("Read config")
-		_config = &configType{}
-		mergeConfigBytes(ctx, _config, defaultConfig(ctx), "default")
-		mergeConfigByTemplate(ctx, _config, *configFileP)
-		applyMoveConfigDetails(_config)
-		applyFlags(ctx, _config)
+		config, err := readConfig(ctx)
+		log.InfoFatal(logger, err, "Read config")
+		_config = config
 		logger.Info("Parse configs finished", zap.Int("readed_files", parsedConfigFiles),
 			zap.Int("max_read_files", _config.General.MaxConfigFilesRead))
 
@@ -89,6 +212,22 @@ func getConfig(ctx context.Context) *configType {
 	return _config
 }
 
+// readConfig read builtin default config and config files from start. It is used for reload config too,
+// so it return error instead of stop program.
+func readConfig(ctx context.Context) (*configType, error) {
+	parsedConfigFiles = 0
+	config := &configType{}
+	if err := mergeConfigBytes(ctx, config, defaultConfig(ctx), "default"); err != nil {
+		return nil, err
+	}
+	if err := mergeConfigByTemplate(ctx, config, *configFileP); err != nil {
+		return nil, err
+	}
+	applyMoveConfigDetails(config)
+	applyFlags(ctx, config)
+	return config, nil
+}
+
 // Apply command line flags to config
 func applyFlags(ctx context.Context, config *configType) {
 	if *testAcmeServerP {
@@ -103,6 +242,15 @@ func applyFlags(ctx context.Context, config *configType) {
 
 func applyMoveConfigDetails(cfg *configType) {
 	cfg.Listen.MinTLSVersion = cfg.General.MinTLSVersion
+	for i := range cfg.Listeners {
+		if cfg.Listeners[i].MinTLSVersion == "" {
+			cfg.Listeners[i].MinTLSVersion = cfg.General.MinTLSVersion
+		}
+		// resolver is global for domain checkers
+		if cfg.Listeners[i].CheckDomains.Resolver == "" {
+			cfg.Listeners[i].CheckDomains.Resolver = cfg.CheckDomains.Resolver
+		}
+	}
 }
 
 func defaultConfig(ctx context.Context) []byte {
@@ -111,25 +259,31 @@ func defaultConfig(ctx context.Context) []byte {
 	return configBytes
 }
 
-func mergeConfigByTemplate(ctx context.Context, c *configType, filepathTemplate string) {
+func mergeConfigByTemplate(ctx context.Context, c *configType, filepathTemplate string) error {
 	logger := zc.LNop(ctx).With(zap.String("config_file", filepathTemplate))
 	if !hasMeta(filepathTemplate) {
-		mergeConfigByFilepath(ctx, c, filepathTemplate)
-		return
+		return mergeConfigByFilepath(ctx, c, filepathTemplate)
 	}
 
 	filenames, err := filepath.Glob(filepathTemplate)
-	log.DebugFatal(logger, err, "Expand config file template",
+	log.DebugError(logger, err, "Expand config file template",
 		zap.String("filepathTemplate", filepathTemplate), zap.Strings("files", filenames))
+	if err != nil {
+		return xerrors.Errorf("expand config file template %q: %w", filepathTemplate, err)
+	}
 	for _, filename := range filenames {
-		mergeConfigByFilepath(ctx, c, filename)
+		if err = mergeConfigByFilepath(ctx, c, filename); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func mergeConfigByFilepath(ctx context.Context, c *configType, filename string) {
+func mergeConfigByFilepath(ctx context.Context, c *configType, filename string) error {
 	logger := zc.LNop(ctx).With(zap.String("config_file", filename))
 	if parsedConfigFiles > c.General.MaxConfigFilesRead {
-		logger.Fatal("Exceed max config files read count", zap.Int("MaxConfigFilesRead", c.General.MaxConfigFilesRead))
+		logger.Error("Exceed max config files read count", zap.Int("MaxConfigFilesRead", c.General.MaxConfigFilesRead))
+		return xerrors.Errorf("exceed max config files read count: %v", c.General.MaxConfigFilesRead)
 	}
 	parsedConfigFiles++
 
@@ -137,27 +291,21 @@ func mergeConfigByFilepath(ctx context.Context, c *configType, filename string)
 	if !filepath.IsAbs(filename) {
 		var filepathNew string
 		filepathNew, err = filepath.Abs(filename)
-		log.DebugFatal(logger, err, "Convert filepath to absolute",
+		log.DebugError(logger, err, "Convert filepath to absolute",
 			zap.String("old", filename), zap.String("new", filepathNew))
+		if err != nil {
+			return xerrors.Errorf("convert config filepath %q to absolute: %w", filename, err)
+		}
 		filename = filepathNew
 	}
 
 	content, err := ioutil.ReadFile(filename)
-	log.DebugFatal(logger, err, "Read filename")
-
-	dir, err := os.Getwd()
-	log.DebugFatal(logger, err, "Current workdir", zap.String("dir", dir))
-	fileDir := filepath.Dir(filename)
-	if dir != fileDir {
-		err = os.Chdir(fileDir)
-		log.DebugFatal(logger, err, "Chdir to config filename directory")
-		defer func() {
-			err = os.Chdir(dir)
-			log.DebugFatal(logger, err, "Restore workdir to", zap.String("dir", dir))
-		}()
+	log.DebugError(logger, err, "Read filename")
+	if err != nil {
+		return xerrors.Errorf("read config file: %w", err)
 	}
 
-	mergeConfigBytes(ctx, c, content, filename)
+	return mergeConfigBytes(ctx, c, content, filename)
 }
 
 // hasMeta reports whether path contains any of the magic characters
@@ -171,20 +319,421 @@ func hasMeta(path string) bool {
 	return strings.ContainsAny(path, magicChars)
 }
 
-func mergeConfigBytes(ctx context.Context, c *configType, content []byte, file string) {
-	// for prevent loop by existed included
-	c.General.IncludeConfigs = nil
-
-	meta, err := toml.Decode(string(content), c)
+// mergeConfigBytes merge content of config file to c and read included configs. Relative paths of included
+// configs resolved from directory of the file, if file is absolute path.
+func mergeConfigBytes(ctx context.Context, c *configType, content []byte, file string) error {
+	var fileConfig configType
+	meta, err := toml.Decode(string(content), &fileConfig)
 	if err == nil && len(meta.Undecoded()) > 0 {
 		err = fmt.Errorf("unknown fields: %v", meta.Undecoded())
 	}
-	log.InfoFatal(zc.L(ctx), err, "Parse config file", zap.String("config_file", file))
+	if err == nil {
+		err = mergeConfig(c, &fileConfig, meta)
+	}
+	log.InfoError(zc.L(ctx), err, "Parse config file", zap.String("config_file", file))
+	if err != nil {
+		return xerrors.Errorf("parse config file %q: %w", file, err)
+	}
+
+	for _, include := range fileConfig.General.IncludeConfigs {
+		if filepath.IsAbs(file) && !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(file), include)
+		}
+		if err = mergeConfigByTemplate(ctx, c, include); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeConfig copy values, defined in config file, to dst. Tables merged by keys, values override previous.
+// Arrays of tables ([[...]]) appended to previous items. Arrays of values replace previous or appended to it
+// by General.MergeArrays of the file.
+// IncludeConfigs and MergeArrays belong to the file and doesn't copy.
+func mergeConfig(dst, src *configType, meta toml.MetaData) error {
+	appendArrays := false
+	switch src.General.MergeArrays {
+	case "", mergeArraysReplace:
+		// pass
+	case mergeArraysAppend:
+		appendArrays = true
+	default:
+		return xerrors.Errorf("unknown General.MergeArrays value: %q", src.General.MergeArrays)
+	}
+
+	// values of arrays copied with the array, items of arrays of tables has own keys
+	arrays := make(map[string]bool)
+	for _, key := range meta.Keys() {
+		if keyType := meta.Type(key...); keyType == "Array" || keyType == "ArrayHash" {
+			arrays[key.String()] = true
+		}
+	}
+	isInArray := func(key toml.Key) bool {
+		for i := 1; i < len(key); i++ {
+			if arrays[key[:i].String()] {
+				return true
+			}
+		}
+		return false
+	}
+
+	copied := make(map[string]bool)
+	for _, key := range meta.Keys() {
+		keyType := meta.Type(key...)
+		if keyType == "Hash" || isInArray(key) || copied[key.String()] {
+			continue
+		}
+		copied[key.String()] = true
+		if strings.EqualFold(key.String(), "General.IncludeConfigs") || strings.EqualFold(key.String(), "General.MergeArrays") {
+			continue
+		}
+
+		dstField, srcField := configField(reflect.ValueOf(dst).Elem(), key), configField(reflect.ValueOf(src).Elem(), key)
+		if !dstField.IsValid() || !srcField.IsValid() {
+			return xerrors.Errorf("can't find config field for key: %q", key.String())
+		}
+		if srcField.Kind() == reflect.Slice && (keyType == "ArrayHash" || appendArrays) {
+			merged := reflect.MakeSlice(dstField.Type(), 0, dstField.Len()+srcField.Len())
+			merged = reflect.AppendSlice(merged, dstField)
+			dstField.Set(reflect.AppendSlice(merged, srcField))
+		} else {
+			dstField.Set(srcField)
+		}
+	}
+	return nil
+}
+
+// configField return field of struct by toml key, same as toml decoder: names are case-insensitive
+// and fields of embedded structs promoted
+func configField(v reflect.Value, key toml.Key) reflect.Value {
+	for _, name := range key {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}
+		}
+		field := v.FieldByName(name)
+		if !field.IsValid() {
+			field = v.FieldByNameFunc(func(fieldName string) bool {
+				return strings.EqualFold(fieldName, name)
+			})
+		}
+		v = field
+	}
+	return v
+}
+
+// getManagedDomains normalize managed domains and remove duplicates
+func getManagedDomains(config managedConfig) ([]domain.DomainName, error) {
+	res := make([]domain.DomainName, 0, len(config.Domains))
+	exist := make(map[domain.DomainName]bool, len(config.Domains))
+	for _, domainString := range config.Domains {
+		domainName, err := domain.NormalizeDomain(domainString)
+		if err != nil {
+			return nil, xerrors.Errorf("normalize managed domain %q: %w", domainString, err)
+		}
+		if exist[domainName] {
+			continue
+		}
+		exist[domainName] = true
+		res = append(res, domainName)
+	}
+	return res, nil
+}
+
+// getCertGroups normalize, sort and deduplicate domains of groups and check that every domain contained in one group only
+func getCertGroups(configs []certGroupConfig) ([]cert_manager.CertGroup, error) {
+	res := make([]cert_manager.CertGroup, 0, len(configs))
+	groupNames := make(map[string]bool, len(configs))
+	domainGroups := make(map[domain.DomainName]string)
+	for _, groupConfig := range configs {
+		if !certGroupNameRegexp.MatchString(groupConfig.Name) {
+			return nil, xerrors.Errorf("bad cert group name %q, allowed symbols: a-z, A-Z, 0-9, '_', '-'", groupConfig.Name)
+		}
+		if groupNames[groupConfig.Name] {
+			return nil, xerrors.Errorf("duplicate cert group name %q", groupConfig.Name)
+		}
+		groupNames[groupConfig.Name] = true
+
+		if len(groupConfig.Domains) == 0 {
+			return nil, xerrors.Errorf("cert group %q has no domains", groupConfig.Name)
+		}
+
+		group := cert_manager.CertGroup{Name: groupConfig.Name, Domains: make([]domain.DomainName, 0, len(groupConfig.Domains))}
+		for _, domainString := range groupConfig.Domains {
+			domainName, err := domain.NormalizeDomain(domainString)
+			if err != nil {
+				return nil, xerrors.Errorf("normalize domain %q of cert group %q: %w", domainString, groupConfig.Name, err)
+			}
+			if otherGroup, exist := domainGroups[domainName]; exist && otherGroup != groupConfig.Name {
+				return nil, xerrors.Errorf("domain %q contained in cert groups %q and %q", domainString, otherGroup, groupConfig.Name)
+			}
+			domainGroups[domainName] = groupConfig.Name
+			group.Domains = append(group.Domains, domainName)
+		}
+		// order of domains in config doesn't change certificate: same main domain and names of certificate request
+		group.Domains = domain.SortedUnique(group.Domains)
+		res = append(res, group)
+	}
+	return res, nil
+}
+
+// getServedIntermediates read intermediate certificates (pem) for serve after leaf certificate.
+// Empty filename - nil, chain from acme server used.
+func getServedIntermediates(filename string) ([][]byte, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, xerrors.Errorf("read served intermediates file: %w", err)
+	}
+
+	var res [][]byte
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, xerrors.Errorf("parse served intermediate certificate: %w", err)
+		}
+		res = append(res, block.Bytes)
+	}
+	if len(res) == 0 {
+		return nil, xerrors.Errorf("no certificates in served intermediates file %q", filename)
+	}
+	return res, nil
+}
+
+// getAcmeUserAgent return user agent for acme requests, default identify lets-proxy version
+func getAcmeUserAgent(general configGeneral) string {
+	if general.AcmeUserAgent != "" {
+		return general.AcmeUserAgent
+	}
+	return "lets-proxy2/" + VERSION
+}
+
+// getAcmeAccountProblemMode validate mode of handling of acme account problems
+func getAcmeAccountProblemMode(mode string) (string, error) {
+	switch mode {
+	case acme_client_manager.AccountProblemHalt, acme_client_manager.AccountProblemRegister:
+		return mode, nil
+	default:
+		return "", xerrors.Errorf("unknown acme account problem mode: %q", mode)
+	}
+}
+
+// getAcmeHeaders parse "Name:value" lines of additional headers for acme requests
+func getAcmeHeaders(lines []string) (http.Header, error) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	res := make(http.Header, len(lines))
+	for _, line := range lines {
+		lineParts := strings.SplitN(line, ":", 2)
+		if len(lineParts) != 2 {
+			return nil, xerrors.Errorf("can't split acme header line to name and value: %q", line)
+		}
+		name, value := strings.TrimSpace(lineParts[0]), strings.TrimSpace(lineParts[1])
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			return nil, xerrors.Errorf("bad acme header: %q", line)
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "Host", "Content-Type", "Content-Length", "User-Agent":
+			return nil, xerrors.Errorf("acme header %q can't be overridden, use AcmeUserAgent for user agent", name)
+		}
+		res.Add(name, value)
+	}
+	return res, nil
+}
+
+// checkOCSPConfig deny must-staple certificates without stapling: clients reject handshake without ocsp response.
+// getAllowedIPs return parsed ip addresses for certificates, it require http validation
+func getAllowedIPs(general configGeneral) ([]net.IP, error) {
+	if !general.AllowIPCerts {
+		return nil, nil
+	}
+	if !general.EnableHTTPValidation {
+		return nil, xerrors.New("AllowIPCerts require EnableHTTPValidation: certificates for ip addresses validated by http-01 only")
+	}
+	if len(general.AllowedIPs) == 0 {
+		return nil, xerrors.New("AllowIPCerts require AllowedIPs")
+	}
+	res := make([]net.IP, 0, len(general.AllowedIPs))
+	for _, s := range general.AllowedIPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, xerrors.Errorf("bad ip address in AllowedIPs: %q", s)
+		}
+		res = append(res, ip)
+	}
+	return res, nil
+}
+
+// checkAcmeDisabledConfig return error if config without acme has options, which need acme,
+// or has no certificates for serve.
+func checkAcmeDisabledConfig(config *configType) error {
+	if len(config.Managed.Domains) > 0 {
+		return xerrors.New("Managed.Domains require acme: certificates of managed domains issued by acme server")
+	}
+	if len(config.CertGroups) > 0 {
+		return xerrors.New("CertGroups require acme: certificates of groups issued by acme server")
+	}
+	if config.General.AcmeAccountImportFile != "" || config.General.AcmeAccountExport {
+		return xerrors.New("AcmeAccountImportFile and AcmeAccountExport require acme")
+	}
+	if len(config.Challenges.HTTPAddresses) > 0 || len(config.Challenges.TLSALPNAddresses) > 0 {
+		return xerrors.New("Challenges listeners require acme")
+	}
+	if len(config.StaticCerts) == 0 {
+		return xerrors.New("no certificates for serve: acme disabled and StaticCerts is empty")
+	}
+	return nil
+}
+
+func checkClockSkewConfig(general configGeneral) error {
+	if general.ClockSkewToleranceSeconds < 0 || general.ClockSkewWarningSeconds < 0 {
+		return xerrors.Errorf("clock skew settings must be non negative, got tolerance: %v, warning: %v",
+			general.ClockSkewToleranceSeconds, general.ClockSkewWarningSeconds)
+	}
+	return nil
+}
+
+func checkRenewalBackoffConfig(general configGeneral) error {
+	if general.RenewalBackoffMinSeconds < 0 || general.RenewalBackoffMaxSeconds < 0 || general.RenewalFailingAfter < 0 {
+		return xerrors.Errorf("renewal backoff settings must be non negative, got min: %v, max: %v, failing after: %v",
+			general.RenewalBackoffMinSeconds, general.RenewalBackoffMaxSeconds, general.RenewalFailingAfter)
+	}
+	if general.RenewalBackoffMaxSeconds > 0 && general.RenewalBackoffMaxSeconds < general.RenewalBackoffMinSeconds {
+		return xerrors.Errorf("RenewalBackoffMaxSeconds (%v) less than RenewalBackoffMinSeconds (%v)",
+			general.RenewalBackoffMaxSeconds, general.RenewalBackoffMinSeconds)
+	}
+	return nil
+}
+
+func checkCacheGCConfig(general configGeneral) error {
+	if general.CacheGCRetentionDays < 0 || general.CacheGCIntervalHours < 0 {
+		return xerrors.Errorf("cache gc settings must be non negative, got retention: %v, interval: %v",
+			general.CacheGCRetentionDays, general.CacheGCIntervalHours)
+	}
+	return nil
+}
+
+func checkOCSPConfig(general configGeneral) error {
+	if general.MustStaple && !general.OCSPStapling {
+		return xerrors.New("MustStaple require OCSPStapling: clients reject must-staple certificates without stapled ocsp response")
+	}
+	return nil
+}
+
+// getKeyPool return pool of pregenerated keys, nil if disabled. Key types must be allowed,
+// empty key types - all allowed types.
+func getKeyPool(general configGeneral) (*cert_manager.KeyPool, error) {
+	if general.KeyPoolSize == 0 {
+		return nil, nil
+	}
+
+	var keyTypes []cert_manager.KeyType
+	for _, s := range general.KeyPoolKeyTypes {
+		keyType := cert_manager.KeyType(strings.ToLower(strings.TrimSpace(s)))
+		if keyType == cert_manager.KeyRSA && !general.AllowRSACert || keyType == cert_manager.KeyECDSA && !general.AllowECDSACert {
+			return nil, xerrors.Errorf("key type %q of key pool isn't allowed", s)
+		}
+		keyTypes = append(keyTypes, keyType)
+	}
+	if len(general.KeyPoolKeyTypes) == 0 {
+		if general.AllowECDSACert {
+			keyTypes = append(keyTypes, cert_manager.KeyECDSA)
+		}
+		if general.AllowRSACert {
+			keyTypes = append(keyTypes, cert_manager.KeyRSA)
+		}
+	}
+	return cert_manager.NewKeyPool(general.KeyPoolSize, keyTypes, time.Duration(general.KeyPoolMaxKeyAgeMinutes)*time.Minute)
+}
+
+// getHandshakeLimit return limit of concurrent certificate operations of handshakes, nil if disabled.
+func getHandshakeLimit(general configGeneral) (*cert_manager.HandshakeLimit, error) {
+	if general.HandshakeCertConcurrency == 0 {
+		return nil, nil
+	}
+	if general.HandshakeCertConcurrency < 0 || general.HandshakeCertQueueSize < 0 || general.HandshakeCertQueueTimeoutSeconds < 0 {
+		return nil, xerrors.Errorf("negative handshake limits: concurrency %v, queue size %v, queue timeout %v",
+			general.HandshakeCertConcurrency, general.HandshakeCertQueueSize, general.HandshakeCertQueueTimeoutSeconds)
+	}
+	return &cert_manager.HandshakeLimit{
+		MaxConcurrent: general.HandshakeCertConcurrency,
+		MaxQueue:      general.HandshakeCertQueueSize,
+		MaxWait:       time.Duration(general.HandshakeCertQueueTimeoutSeconds) * time.Second,
+	}, nil
+}
+
+// getCertSubject return validated subject fields for certificate requests
+func getCertSubject(general configGeneral) (pkix.Name, error) {
+	for _, field := range []struct {
+		name   string
+		values []string
+	}{
+		{"CertOrganization", general.CertOrganization},
+		{"CertOrganizationalUnit", general.CertOrganizationalUnit},
+	} {
+		for _, value := range field.values {
+			if err := checkCertSubjectValue(value); err != nil {
+				return pkix.Name{}, xerrors.Errorf("bad value of %v %q: %w", field.name, value, err)
+			}
+		}
+	}
+	return pkix.Name{Organization: general.CertOrganization, OrganizationalUnit: general.CertOrganizationalUnit}, nil
+}
+
+func checkCertSubjectValue(value string) error {
+	if strings.TrimSpace(value) != value || value == "" {
+		return xerrors.New("value is empty or has leading/trailing spaces")
+	}
+	if !utf8.ValidString(value) {
+		return xerrors.New("value isn't valid utf-8")
+	}
+	// upper bound of organization and organizational unit names, rfc 5280
+	if utf8.RuneCountInString(value) > certSubjectValueMaxLen {
+		return xerrors.Errorf("value longer than %v chars", certSubjectValueMaxLen)
+	}
+	for _, r := range value {
+		if !unicode.IsPrint(r) {
+			return xerrors.Errorf("value has non printable char %q", r)
+		}
+	}
+	return nil
+}
+
+// getDomainDeniedCertificate return fallback certificate for denied domains or nil for abort handshake
+func getDomainDeniedCertificate(policy string) (*tls.Certificate, error) {
+	parsedPolicy, err := tlslistener.ParseDomainDeniedPolicy(policy)
+	if err != nil || parsedPolicy != tlslistener.DomainDeniedHTTPDeny {
+		return nil, err
+	}
+	return tlslistener.NewFallbackCertificate()
+}
+
+// checkListenersConfig check names of additional listeners: it used in metric names and logs.
+func checkListenersConfig(configs []listenerConfig) error {
+	names := make(map[string]bool, len(configs))
+	for _, listenerConfig := range configs {
+		if !listenerNameRegexp.MatchString(listenerConfig.Name) {
+			return xerrors.Errorf("bad listener name %q, allowed symbols: a-z, A-Z, 0-9, '_'", listenerConfig.Name)
+		}
+		if names[listenerConfig.Name] {
+			return xerrors.Errorf("duplicate listener name %q", listenerConfig.Name)
+		}
+		names[listenerConfig.Name] = true
 
-	if len(c.General.IncludeConfigs) > 0 {
-		includeConfigs := c.General.IncludeConfigs // need save because it will reset while merging
-		for _, file := range includeConfigs {
-			mergeConfigByTemplate(ctx, c, file)
+		if len(listenerConfig.TLSAddresses) == 0 && len(listenerConfig.TCPAddresses) == 0 && listenerConfig.SystemdTLSName == "" &&
+			listenerConfig.SystemdTCPName == "" {
+			return xerrors.Errorf("listener %q has no addresses", listenerConfig.Name)
 		}
 	}
+	return nil
 }
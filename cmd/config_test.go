@@ -1,14 +1,28 @@
 package main
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/rekby/lets-proxy2/internal/cert_manager"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/domain_checker"
+	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/static_certs"
 	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
 
+	"github.com/BurntSushi/toml"
 	"github.com/maxatome/go-testdeep"
 )
 
@@ -58,9 +72,435 @@ StorageDir = "storage2"
 	td.CmpDeeply(config.General.StorageDir, "storage2")
 }
 
+func TestReadConfigError(t *testing.T) {
+	e, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	tmpDir := th.TmpDir(e)
+	_ = ioutil.WriteFile(filepath.Join(tmpDir, "config.toml"), []byte(`
+[General]
+IncludeConfigs = ["configs/*.toml"]
+`), 0600)
+	_ = os.MkdirAll(filepath.Join(tmpDir, "configs"), 0700)
+	_ = ioutil.WriteFile(filepath.Join(tmpDir, "configs/bad.toml"), []byte(`
+[General]
+UnknownField = 1
+`), 0600)
+
+	oldConfigFile := *configFileP
+	defer func() { *configFileP = oldConfigFile }()
+
+	*configFileP = filepath.Join(tmpDir, "config.toml")
+	_, err := readConfig(ctx)
+	e.CmpError(err)
+
+	*configFileP = filepath.Join(tmpDir, "not-exist.toml")
+	_, err = readConfig(ctx)
+	e.CmpError(err)
+}
+
 func TestGetConfig(t *testing.T) {
 	e, ctx, cancel := th.NewEnv(t)
 	defer cancel()
 
 	e.NotNil(getConfig(ctx))
 }
+
+func TestGetCertGroups(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	res, err := getCertGroups([]certGroupConfig{
+		{Name: "first", Domains: []string{"Example.com", "www.example.com."}},
+		{Name: "second", Domains: []string{"example.org"}},
+	})
+	td.CmpNoError(err)
+	td.Cmp(res, []cert_manager.CertGroup{
+		{Name: "first", Domains: []domain.DomainName{"example.com", "www.example.com"}},
+		{Name: "second", Domains: []domain.DomainName{"example.org"}},
+	})
+
+	// reordered config and repeated names give same groups, so certificates aren't reissued
+	reordered, err := getCertGroups([]certGroupConfig{
+		{Name: "first", Domains: []string{"www.example.com", "example.com", "WWW.example.com"}},
+		{Name: "second", Domains: []string{"example.org", "example.org."}},
+	})
+	td.CmpNoError(err)
+	td.Cmp(reordered, res)
+
+	_, err = getCertGroups([]certGroupConfig{{Name: "first", Domains: []string{"example.com"}}, {Name: "second", Domains: []string{"EXAMPLE.com"}}})
+	td.CmpError(err, "domain in two groups")
+
+	_, err = getCertGroups([]certGroupConfig{{Name: "first", Domains: []string{"example.com"}}, {Name: "first", Domains: []string{"example.org"}}})
+	td.CmpError(err, "duplicate group name")
+
+	_, err = getCertGroups([]certGroupConfig{{Name: "../first", Domains: []string{"example.com"}}})
+	td.CmpError(err, "bad group name")
+
+	_, err = getCertGroups([]certGroupConfig{{Name: "first"}})
+	td.CmpError(err, "empty group")
+}
+
+func TestGetManagedDomains(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	res, err := getManagedDomains(managedConfig{Domains: []string{"Example.com", "www.example.com.", "example.com"}})
+	td.CmpNoError(err)
+	td.Cmp(res, []domain.DomainName{"example.com", "www.example.com"})
+
+	res, err = getManagedDomains(managedConfig{})
+	td.CmpNoError(err)
+	td.Cmp(res, testdeep.Empty())
+
+	_, err = getManagedDomains(managedConfig{Domains: []string{"bad domain"}})
+	td.CmpError(err)
+}
+
+func TestGetAllowedIPs(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	res, err := getAllowedIPs(configGeneral{AllowedIPs: []string{"1.2.3.4"}})
+	td.CmpNoError(err)
+	td.Nil(res)
+
+	res, err = getAllowedIPs(configGeneral{AllowIPCerts: true, EnableHTTPValidation: true, AllowedIPs: []string{"1.2.3.4", "2001:db8::1"}})
+	td.CmpNoError(err)
+	td.Cmp(res, []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("2001:db8::1")})
+
+	_, err = getAllowedIPs(configGeneral{AllowIPCerts: true, AllowedIPs: []string{"1.2.3.4"}})
+	td.CmpError(err, "without http validation")
+
+	_, err = getAllowedIPs(configGeneral{AllowIPCerts: true, EnableHTTPValidation: true})
+	td.CmpError(err, "empty list")
+
+	_, err = getAllowedIPs(configGeneral{AllowIPCerts: true, EnableHTTPValidation: true, AllowedIPs: []string{"example.com"}})
+	td.CmpError(err, "bad ip")
+}
+
+func TestGetServedIntermediates(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	res, err := getServedIntermediates("")
+	e.CmpNoError(err)
+	e.Nil(res)
+
+	dir := th.TmpDir(e)
+	certDer := testCertificateDer(t)
+
+	filename := filepath.Join(dir, "intermediates.pem")
+	content := append([]byte("comment\n"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})...)
+	content = append(content, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("skip")})...)
+	e.CmpNoError(os.WriteFile(filename, content, 0600))
+	res, err = getServedIntermediates(filename)
+	e.CmpNoError(err)
+	e.Cmp(res, [][]byte{certDer})
+
+	e.CmpNoError(os.WriteFile(filename, []byte("empty"), 0600))
+	_, err = getServedIntermediates(filename)
+	e.CmpError(err)
+
+	_, err = getServedIntermediates(filepath.Join(dir, "not-exist.pem"))
+	e.CmpError(err)
+}
+
+func testCertificateDer(t *testing.T) []byte {
+	return testcert.New(t, x509.Certificate{Subject: pkix.Name{CommonName: "Inter"}}, nil, nil).Certificate[0]
+}
+
+func TestListenersConfig(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	var config configType
+	mergeConfigBytes(ctx, &config, []byte(`
+[General]
+MinTLSVersion = "1.2"
+
+[CheckDomains]
+Resolver = "8.8.8.8:53"
+
+[[Listeners]]
+Name = "internal"
+TLSAddresses = ["127.0.0.1:8443"]
+MinTLSVersion = "1.0"
+DisableChallenges = true
+[Listeners.CheckDomains]
+WhiteList = "internal"
+
+[[Listeners]]
+Name = "second"
+TCPAddresses = ["127.0.0.1:8080"]
+`), "test")
+	applyMoveConfigDetails(&config)
+
+	e.Cmp(config.Listeners, []listenerConfig{
+		{
+			Name:              "internal",
+			Config:            tlslistener.Config{TLSAddresses: []string{"127.0.0.1:8443"}, MinTLSVersion: "1.0"},
+			CheckDomains:      domain_checker.Config{WhiteList: "internal", Resolver: "8.8.8.8:53"},
+			DisableChallenges: true,
+		},
+		{
+			Name:         "second",
+			Config:       tlslistener.Config{TCPAddresses: []string{"127.0.0.1:8080"}, MinTLSVersion: "1.2"},
+			CheckDomains: domain_checker.Config{Resolver: "8.8.8.8:53"},
+		},
+	})
+	e.CmpNoError(checkListenersConfig(config.Listeners))
+
+	e.CmpError(checkListenersConfig([]listenerConfig{{Name: "bad-name", Config: tlslistener.Config{TLSAddresses: []string{":1"}}}}))
+	e.CmpError(checkListenersConfig([]listenerConfig{{Name: "empty"}}))
+	e.CmpError(checkListenersConfig([]listenerConfig{
+		{Name: "first", Config: tlslistener.Config{TLSAddresses: []string{":1"}}},
+		{Name: "first", Config: tlslistener.Config{TLSAddresses: []string{":2"}}},
+	}))
+}
+
+func TestCheckOCSPConfig(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	e.CmpNoError(checkOCSPConfig(configGeneral{}))
+	e.CmpNoError(checkOCSPConfig(configGeneral{OCSPStapling: true}))
+	e.CmpNoError(checkOCSPConfig(configGeneral{OCSPStapling: true, MustStaple: true}))
+	e.CmpError(checkOCSPConfig(configGeneral{MustStaple: true}))
+}
+
+func TestCheckClockSkewConfig(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	e.CmpNoError(checkClockSkewConfig(configGeneral{}))
+	e.CmpNoError(checkClockSkewConfig(configGeneral{ClockSkewToleranceSeconds: 60, ClockSkewWarningSeconds: 10}))
+	e.CmpError(checkClockSkewConfig(configGeneral{ClockSkewToleranceSeconds: -1}))
+	e.CmpError(checkClockSkewConfig(configGeneral{ClockSkewWarningSeconds: -1}))
+}
+
+func TestCheckRenewalBackoffConfig(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	e.CmpNoError(checkRenewalBackoffConfig(configGeneral{}))
+	e.CmpNoError(checkRenewalBackoffConfig(configGeneral{RenewalBackoffMinSeconds: 600, RenewalBackoffMaxSeconds: 86400,
+		RenewalFailingAfter: 5}))
+	e.CmpNoError(checkRenewalBackoffConfig(configGeneral{RenewalBackoffMinSeconds: 600}))
+	e.CmpError(checkRenewalBackoffConfig(configGeneral{RenewalBackoffMinSeconds: -1}))
+	e.CmpError(checkRenewalBackoffConfig(configGeneral{RenewalFailingAfter: -1}))
+	e.CmpError(checkRenewalBackoffConfig(configGeneral{RenewalBackoffMinSeconds: 600, RenewalBackoffMaxSeconds: 60}))
+}
+
+func TestCheckCacheGCConfig(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	e.CmpNoError(checkCacheGCConfig(configGeneral{}))
+	e.CmpNoError(checkCacheGCConfig(configGeneral{CacheGCRetentionDays: 90, CacheGCIntervalHours: 24}))
+	e.CmpError(checkCacheGCConfig(configGeneral{CacheGCRetentionDays: -1}))
+	e.CmpError(checkCacheGCConfig(configGeneral{CacheGCIntervalHours: -1}))
+}
+
+func TestCheckAcmeDisabledConfig(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	staticCerts := []static_certs.Files{{CertFile: "a.crt", KeyFile: "a.key", Default: true}}
+	e.CmpNoError(checkAcmeDisabledConfig(&configType{StaticCerts: staticCerts}))
+	e.CmpError(checkAcmeDisabledConfig(&configType{}))
+	e.CmpError(checkAcmeDisabledConfig(&configType{StaticCerts: staticCerts, Managed: managedConfig{Domains: []string{"a.ru"}}}))
+	e.CmpError(checkAcmeDisabledConfig(&configType{StaticCerts: staticCerts, CertGroups: []certGroupConfig{{Name: "a"}}}))
+	e.CmpError(checkAcmeDisabledConfig(&configType{StaticCerts: staticCerts, General: configGeneral{AcmeAccountExport: true}}))
+	e.CmpError(checkAcmeDisabledConfig(&configType{StaticCerts: staticCerts, General: configGeneral{AcmeAccountImportFile: "a.json"}}))
+	e.CmpError(checkAcmeDisabledConfig(&configType{StaticCerts: staticCerts, Challenges: challengesConfig{HTTPAddresses: []string{":80"}}}))
+}
+
+func TestGetCertSubject(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	subject, err := getCertSubject(configGeneral{})
+	e.CmpNoError(err)
+	e.Cmp(subject, pkix.Name{})
+
+	subject, err = getCertSubject(configGeneral{CertOrganization: []string{"Org"}, CertOrganizationalUnit: []string{"Отдел", "Unit"}})
+	e.CmpNoError(err)
+	e.Cmp(subject, pkix.Name{Organization: []string{"Org"}, OrganizationalUnit: []string{"Отдел", "Unit"}})
+
+	for _, value := range []string{"", " Org", "Org\n", strings.Repeat("a", 65), "\xff"} {
+		_, err = getCertSubject(configGeneral{CertOrganization: []string{value}})
+		e.CmpError(err, value)
+		_, err = getCertSubject(configGeneral{CertOrganizationalUnit: []string{value}})
+		e.CmpError(err, value)
+	}
+}
+
+func TestGetKeyPool(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	pool, err := getKeyPool(configGeneral{AllowRSACert: true, AllowECDSACert: true})
+	e.CmpNoError(err)
+	e.Nil(pool)
+
+	pool, err = getKeyPool(configGeneral{KeyPoolSize: 2, KeyPoolMaxKeyAgeMinutes: 10, AllowRSACert: true, AllowECDSACert: true})
+	e.CmpNoError(err)
+	e.Cmp(pool.Size, 2)
+	e.Cmp(pool.KeyTypes, []cert_manager.KeyType{cert_manager.KeyECDSA, cert_manager.KeyRSA})
+	e.Cmp(pool.MaxAge, 10*time.Minute)
+
+	pool, err = getKeyPool(configGeneral{KeyPoolSize: 1, KeyPoolKeyTypes: []string{" RSA"}, AllowRSACert: true})
+	e.CmpNoError(err)
+	e.Cmp(pool.KeyTypes, []cert_manager.KeyType{cert_manager.KeyRSA})
+
+	_, err = getKeyPool(configGeneral{KeyPoolSize: 1, KeyPoolKeyTypes: []string{"rsa"}, AllowECDSACert: true})
+	e.CmpError(err)
+	_, err = getKeyPool(configGeneral{KeyPoolSize: 1, KeyPoolKeyTypes: []string{"bad"}, AllowRSACert: true})
+	e.CmpError(err)
+	_, err = getKeyPool(configGeneral{KeyPoolSize: -1, AllowRSACert: true})
+	e.CmpError(err)
+}
+
+func TestGetHandshakeLimit(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	limit, err := getHandshakeLimit(configGeneral{HandshakeCertQueueSize: 10})
+	e.CmpNoError(err)
+	e.Nil(limit)
+
+	limit, err = getHandshakeLimit(configGeneral{HandshakeCertConcurrency: 2, HandshakeCertQueueSize: 10,
+		HandshakeCertQueueTimeoutSeconds: 3})
+	e.CmpNoError(err)
+	e.Cmp(limit.MaxConcurrent, 2)
+	e.Cmp(limit.MaxQueue, 10)
+	e.Cmp(limit.MaxWait, 3*time.Second)
+
+	_, err = getHandshakeLimit(configGeneral{HandshakeCertConcurrency: -1})
+	e.CmpError(err)
+	_, err = getHandshakeLimit(configGeneral{HandshakeCertConcurrency: 1, HandshakeCertQueueTimeoutSeconds: -1})
+	e.CmpError(err)
+}
+
+func TestGetAcmeUserAgent(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	e.Cmp(getAcmeUserAgent(configGeneral{}), "lets-proxy2/"+VERSION)
+	e.Cmp(getAcmeUserAgent(configGeneral{AcmeUserAgent: "custom/1"}), "custom/1")
+}
+
+func TestGetAcmeHeaders(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	res, err := getAcmeHeaders(nil)
+	e.CmpNoError(err)
+	e.Nil(res)
+
+	res, err = getAcmeHeaders([]string{"Authorization: Bearer 1:2", "x-test:a", "X-Test:b"})
+	e.CmpNoError(err)
+	e.Cmp(res, http.Header{"Authorization": []string{"Bearer 1:2"}, "X-Test": []string{"a", "b"}})
+
+	for _, line := range []string{"Authorization", "bad name:1", "X-Test:a\nb", "user-agent:test", "Host:example.com"} {
+		_, err = getAcmeHeaders([]string{line})
+		e.CmpError(err, line)
+	}
+}
+
+func TestGetAcmeAccountProblemMode(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	for _, mode := range []string{"halt", "register"} {
+		res, err := getAcmeAccountProblemMode(mode)
+		e.CmpNoError(err)
+		e.Cmp(res, mode)
+	}
+	for _, mode := range []string{"", "Halt", "ignore"} {
+		_, err := getAcmeAccountProblemMode(mode)
+		e.CmpError(err, mode)
+	}
+}
+
+func TestGetDomainDeniedCertificate(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	for _, policy := range []string{"", "tls_fail"} {
+		cert, err := getDomainDeniedCertificate(policy)
+		e.CmpNoError(err)
+		e.Nil(cert)
+	}
+
+	cert, err := getDomainDeniedCertificate("http_deny")
+	e.CmpNoError(err)
+	e.NotNil(cert)
+
+	_, err = getDomainDeniedCertificate("bad")
+	e.CmpError(err)
+}
+
+func TestMergeConfigArrays(t *testing.T) {
+	e, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	tmpDir := th.TmpDir(e)
+
+	e.CmpNoError(os.WriteFile(filepath.Join(tmpDir, "config.toml"), []byte(`
+[General]
+Subdomains = ["www.", "m."]
+IncludeConfigs = ["sites/*.toml"]
+
+[Proxy]
+TargetMap = ["1.1.1.1:443-2.2.2.2:80"]
+ResponseCacheRoutes = ["*/static/"]
+
+[[CertGroups]]
+Name = "main"
+Domains = ["example.com"]
+`), 0600))
+	e.CmpNoError(os.MkdirAll(filepath.Join(tmpDir, "sites"), 0700))
+	e.CmpNoError(os.WriteFile(filepath.Join(tmpDir, "sites/a.toml"), []byte(`
+[General]
+MergeArrays = "append"
+
+[Proxy]
+TargetMap = ["1.1.1.2:443-2.2.2.3:80"]
+
+[[CertGroups]]
+Name = "a"
+Domains = ["a.com"]
+
+[[Proxy.RewriteRules]]
+Route = "a.com/"
+Host = "a.internal"
+`), 0600))
+	e.CmpNoError(os.WriteFile(filepath.Join(tmpDir, "sites/b.toml"), []byte(`
+[General]
+Subdomains = ["www."]
+
+[Proxy]
+ResponseCacheRoutes = ["b.com/"]
+RewriteRules = [{Route = "b.com/", Host = "b.internal"}]
+`), 0600))
+
+	var config configType
+	mergeConfigBytes(ctx, &config, defaultConfig(ctx), "")
+	mergeConfigByFilepath(ctx, &config, filepath.Join(tmpDir, "config.toml"))
+
+	e.Cmp(config.General.Subdomains, []string{"www."})
+	e.Cmp(config.General.MergeArrays, "") // belongs to file only
+	e.Nil(config.General.IncludeConfigs)
+	e.Cmp(config.General.IssueTimeout, 300)
+	e.Cmp(config.Proxy.DefaultTarget, ":80")
+	e.Cmp(config.Proxy.TargetMap, []string{"1.1.1.1:443-2.2.2.2:80", "1.1.1.2:443-2.2.2.3:80"})
+	e.Cmp(config.Proxy.ResponseCacheRoutes, []string{"b.com/"})
+	e.Cmp(config.CertGroups, []certGroupConfig{
+		{Name: "main", Domains: []string{"example.com"}},
+		{Name: "a", Domains: []string{"a.com"}},
+	})
+	// inline array of tables is array of values
+	e.Cmp(config.Proxy.RewriteRules, []proxy.RewriteRuleConfig{{Route: "b.com/", Host: "b.internal"}})
+
+	err := mergeConfig(&configType{}, &configType{General: configGeneral{MergeArrays: "bad"}}, toml.MetaData{})
+	e.CmpError(err)
+}
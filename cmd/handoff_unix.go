@@ -0,0 +1,224 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+const (
+	gracefulRestartDrainTimeout = time.Minute
+	gracefulRestartReadyTimeout = time.Minute
+
+	// envHandoffReadyFD - fd of pipe in child process, child write handoffReadyMessage to it
+	// after start serve inherited listeners.
+	envHandoffReadyFD   = "LETS_PROXY_HANDOFF_READY_FD"
+	handoffReadyMessage = "ready"
+)
+
+type handoffListener struct {
+	handler *tlslistener.ListenersHandler
+	config  tlslistener.Config
+}
+
+// startGracefulRestartHandler wait SIGUSR2 for graceful restart:
+// 1. Start new process of the program and pass it listeners by socket activation protocol.
+// 2. Wait while new process ready to serve, continue work in current process if it doesn't.
+// 3. Stop accept new connections in current process.
+// 4. Wait for finish active requests.
+// Returned function block while graceful restart in progress.
+func startGracefulRestartHandler(ctx context.Context, p *proxy.HTTPProxy, listeners []handoffListener) (wait func()) {
+	logger := zc.L(ctx).Named("graceful_restart")
+	var wg sync.WaitGroup
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		defer log.HandlePanic(logger)
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+			}
+
+			logger.Info("Receive signal for graceful restart")
+			childPID, ready, err := startChildProcess(listeners)
+			log.InfoError(logger, err, "Start new process with inherited listeners", zap.Int("child_pid", childPID))
+			if err != nil {
+				// continue work in current process
+				continue
+			}
+
+			err = waitChildReady(ready, gracefulRestartReadyTimeout)
+			log.InfoError(logger, err, "Wait new process ready", zap.Int("child_pid", childPID))
+			if err != nil {
+				// new process may hang with inherited listeners, stop it and continue work in current process
+				stopChildProcess(zc.WithLogger(ctx, logger), childPID)
+				continue
+			}
+
+			wg.Add(1)
+			drainCurrentProcess(zc.WithLogger(ctx, logger), p, listeners)
+			wg.Done()
+			return
+		}
+	}()
+
+	return wg.Wait
+}
+
+// startChildProcess start new process with inherited listeners.
+// ready is read end of pipe, which child process write handoffReadyMessage after start, caller must close it.
+func startChildProcess(listeners []handoffListener) (pid int, ready *os.File, err error) {
+	var fds []int
+	var names []string
+
+	defer func() {
+		tlslistener.CloseFDs(fds)
+	}()
+
+	for _, l := range listeners {
+		listenerFDs, listenerNames, err := l.handler.ListenerFDs(l.config.SystemdTLSName, l.config.SystemdTCPName)
+		if err != nil {
+			return 0, nil, err
+		}
+		fds = append(fds, listenerFDs...)
+		names = append(names, listenerNames...)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, nil, xerrors.Errorf("get executable path: %w", err)
+	}
+
+	workDir, err := os.Getwd()
+	if err != nil {
+		return 0, nil, xerrors.Errorf("get workdir: %w", err)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, nil, xerrors.Errorf("create ready pipe: %w", err)
+	}
+	defer func() {
+		_ = readyWriter.Close()
+	}()
+
+	files := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	for _, fd := range fds {
+		files = append(files, uintptr(fd))
+	}
+	// after listeners, LISTEN_FDS doesn't count it
+	readyFD := len(files)
+	files = append(files, readyWriter.Fd())
+
+	env := tlslistener.HandoffEnv(os.Environ(), names, os.Getpid())
+	env = append(env, envHandoffReadyFD+"="+strconv.Itoa(readyFD))
+
+	// syscall.ForkExec instead of os.StartProcess - for doesn't switch listeners to blocking mode
+	pid, err = syscall.ForkExec(executable, os.Args, &syscall.ProcAttr{
+		Dir:   workDir,
+		Env:   env,
+		Files: files,
+	})
+	if err != nil {
+		_ = ready.Close()
+		return 0, nil, xerrors.Errorf("start child process: %w", err)
+	}
+	return pid, ready, nil
+}
+
+// waitChildReady wait handoffReadyMessage from child process and close ready.
+// It return error if child process close pipe (exit) before the message or timeout.
+func waitChildReady(ready *os.File, timeout time.Duration) error {
+	defer func() {
+		_ = ready.Close()
+	}()
+
+	if err := ready.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return xerrors.Errorf("set ready pipe deadline: %w", err)
+	}
+
+	buf := make([]byte, len(handoffReadyMessage))
+	if _, err := io.ReadFull(ready, buf); err != nil {
+		return xerrors.Errorf("read ready message from child process: %w", err)
+	}
+	if string(buf) != handoffReadyMessage {
+		return xerrors.Errorf("unexpected ready message from child process: %q", buf)
+	}
+	return nil
+}
+
+// stopChildProcess terminate not ready child process and reap it in background.
+func stopChildProcess(ctx context.Context, pid int) {
+	logger := zc.L(ctx)
+
+	err := syscall.Kill(pid, syscall.SIGTERM)
+	log.DebugError(logger, err, "Stop not ready child process", zap.Int("child_pid", pid))
+
+	go func() {
+		defer log.HandlePanic(logger)
+
+		var status syscall.WaitStatus
+		_, err := syscall.Wait4(pid, &status, 0, nil)
+		log.DebugError(logger, err, "Child process finished", zap.Int("child_pid", pid),
+			zap.Int("exit_status", status.ExitStatus()))
+	}()
+}
+
+// notifyGracefulRestartReady notify parent process, that the process ready to serve inherited listeners.
+// It does nothing if the process doesn't started by graceful restart.
+func notifyGracefulRestartReady(ctx context.Context) {
+	fdString, ok := os.LookupEnv(envHandoffReadyFD)
+	if !ok {
+		return
+	}
+	// prevent inherit by child processes
+	_ = os.Unsetenv(envHandoffReadyFD)
+
+	logger := zc.L(ctx)
+	fd, err := strconv.Atoi(fdString)
+	if err != nil {
+		logger.Error("Bad graceful restart ready fd", zap.String("fd", fdString), zap.Error(err))
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "handoff-ready")
+	_, err = f.WriteString(handoffReadyMessage)
+	log.InfoError(logger, err, "Notify parent process about ready", zap.Int("parent_pid", os.Getppid()))
+	_ = f.Close()
+}
+
+func drainCurrentProcess(ctx context.Context, p *proxy.HTTPProxy, listeners []handoffListener) {
+	logger := zc.L(ctx)
+
+	for _, l := range listeners {
+		err := l.handler.StopAccept()
+		log.DebugInfo(logger, err, "Stop accept connections")
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), gracefulRestartDrainTimeout)
+	defer cancel()
+
+	logger.Info("Wait for finish active requests", zap.Duration("timeout", gracefulRestartDrainTimeout))
+	err := p.Shutdown(drainCtx)
+	log.InfoError(logger, err, "Active requests finished")
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+)
+
+func TestWaitChildReady(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	newPipe := func() (*os.File, *os.File) {
+		r, w, err := os.Pipe()
+		td.CmpNoError(err)
+		return r, w
+	}
+
+	// ready
+	r, w := newPipe()
+	_, err := w.WriteString(handoffReadyMessage)
+	td.CmpNoError(err)
+	td.CmpNoError(waitChildReady(r, time.Second))
+	_ = w.Close()
+
+	// child exit before ready
+	r, w = newPipe()
+	_ = w.Close()
+	td.CmpError(waitChildReady(r, time.Second))
+
+	// child hang
+	r, w = newPipe()
+	td.CmpError(waitChildReady(r, 10*time.Millisecond))
+	_ = w.Close()
+
+	// garbage
+	r, w = newPipe()
+	_, err = w.WriteString("error")
+	td.CmpNoError(err)
+	td.CmpError(waitChildReady(r, time.Second))
+	_ = w.Close()
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
+)
+
+type handoffListener struct {
+	handler *tlslistener.ListenersHandler
+	config  tlslistener.Config
+}
+
+// startGracefulRestartHandler doesn't supported on windows
+func startGracefulRestartHandler(_ context.Context, _ *proxy.HTTPProxy, _ []handoffListener) (wait func()) {
+	return func() {}
+}
+
+// notifyGracefulRestartReady doesn't supported on windows
+func notifyGracefulRestartReady(_ context.Context) {}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/acme_client_manager"
+)
+
+// buildInfo - answer of /info: version of the binary, commit and date from version control
+// (if binary built from repository), hash of effective config and uptime.
+type buildInfo struct {
+	Version       string `json:"version"`
+	Commit        string `json:"commit,omitempty"`
+	CommitDate    string `json:"commit_date,omitempty"`
+	Modified      bool   `json:"modified,omitempty"`
+	GoVersion     string `json:"go_version"`
+	OS            string `json:"os"`
+	Arch          string `json:"arch"`
+	ConfigHash    string `json:"config_hash"`
+	StartTime     string `json:"start_time"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+
+	AcmeAccounts []acme_client_manager.AccountStatus `json:"acme_accounts,omitempty"`
+}
+
+func getBuildInfo() buildInfo {
+	res := buildInfo{Version: VERSION, GoVersion: runtime.Version(), OS: runtime.GOOS, Arch: runtime.GOARCH}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return res
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			res.Commit = setting.Value
+		case "vcs.time":
+			res.CommitDate = setting.Value
+		case "vcs.modified":
+			res.Modified = setting.Value == "true"
+		}
+	}
+	return res
+}
+
+// configHash return sha256 of normalized config: merged config files with defaults, encoded to json
+// (fields in fixed order, maps with sorted keys).
+func configHash(config *configType) (string, error) {
+	content, err := json.Marshal(config)
+	if err != nil {
+		return "", xerrors.Errorf("marshal config: %w", err)
+	}
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// infoHandler serve build info, hash of effective config and uptime. Build info and config hash
+// computed once - when handler created and when effective config changed.
+type infoHandler struct {
+	startTime time.Time
+
+	// acmeAccounts return status of acme accounts, nil - without acme
+	acmeAccounts func() []acme_client_manager.AccountStatus
+
+	mu   sync.Mutex
+	info buildInfo
+}
+
+func newInfoHandler(config *configType, startTime time.Time) (*infoHandler, error) {
+	h := &infoHandler{startTime: startTime, info: getBuildInfo()}
+	h.info.StartTime = startTime.UTC().Format(time.RFC3339)
+	if err := h.setConfig(config); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// setConfig update hash of effective config, for example after reload part of config
+func (h *infoHandler) setConfig(config *configType) error {
+	hash, err := configHash(config)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.info.ConfigHash = hash
+	return nil
+}
+
+func (h *infoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.mu.Lock()
+	info := h.info
+	h.mu.Unlock()
+	info.UptimeSeconds = int64(time.Since(h.startTime) / time.Second)
+	if h.acmeAccounts != nil {
+		info.AcmeAccounts = h.acmeAccounts()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/acme_client_manager"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestConfigHash(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	config := &configType{}
+	e.CmpNoError(mergeConfigBytes(ctx, config, defaultConfig(ctx), "default"))
+	hash, err := configHash(config)
+	e.CmpNoError(err)
+	e.Cmp(hash, testdeep.Re("^[0-9a-f]{64}$"))
+
+	same := &configType{}
+	e.CmpNoError(mergeConfigBytes(ctx, same, defaultConfig(ctx), "default"))
+	sameHash, err := configHash(same)
+	e.CmpNoError(err)
+	e.Cmp(sameHash, hash)
+
+	same.Proxy.DefaultTarget = "127.0.0.2:80"
+	changedHash, err := configHash(same)
+	e.CmpNoError(err)
+	e.Not(changedHash, hash)
+}
+
+func TestInfoHandler(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	config := &configType{}
+	h, err := newInfoHandler(config, time.Now().Add(-time.Minute))
+	e.CmpNoError(err)
+	hash, _ := configHash(config)
+
+	get := func() buildInfo {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/info", nil))
+		e.Cmp(recorder.Code, http.StatusOK)
+		var info buildInfo
+		e.CmpNoError(json.Unmarshal(recorder.Body.Bytes(), &info))
+		return info
+	}
+
+	info := get()
+	e.Cmp(info.Version, VERSION)
+	e.Cmp(info.GoVersion, testdeep.NotEmpty())
+	e.Cmp(info.ConfigHash, hash)
+	e.Cmp(info.UptimeSeconds, testdeep.Between(int64(59), int64(70)))
+
+	e.Nil(info.AcmeAccounts)
+
+	accounts := []acme_client_manager.AccountStatus{{URI: "http://account", Status: acme_client_manager.AccountStatusProblem,
+		Problem: "deactivated"}}
+	h.acmeAccounts = func() []acme_client_manager.AccountStatus { return accounts }
+	e.Cmp(get().AcmeAccounts, accounts)
+
+	config.Proxy.DefaultTarget = "127.0.0.2:80"
+	e.CmpNoError(h.setConfig(config))
+	e.Not(get().ConfigHash, hash)
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/info", nil))
+	e.Cmp(recorder.Code, http.StatusMethodNotAllowed)
+}
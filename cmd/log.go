@@ -22,7 +22,8 @@ func (w logWriteSyncer) Sync() error {
 	return w.Logger.Close()
 }
 
-func initLogger(config logConfig) *zap.Logger {
+// initLogger create logger, debugDomains can be nil
+func initLogger(config logConfig, debugDomains *log.DebugDomains) *zap.Logger {
 	var writers []zapcore.WriteSyncer
 	if config.EnableLogToFile {
 		lr := &lumberjack.Logger{
@@ -65,7 +66,13 @@ func initLogger(config logConfig) *zap.Logger {
 
 	logLevel, errLogLevel := parseLogLevel(config.LogLevel)
 
-	core := zapcore.NewCore(encoder, zap.CombineWriteSyncers(writers...), logLevel)
+	var core zapcore.Core
+	if debugDomains == nil {
+		core = zapcore.NewCore(encoder, zap.CombineWriteSyncers(writers...), logLevel)
+	} else {
+		core = zapcore.NewCore(encoder, zap.CombineWriteSyncers(writers...), zapcore.DebugLevel)
+		core = log.NewDebugDomainsCore(core, logLevel, debugDomains)
+	}
 	logger := zap.New(core, getLogOptions(config)...)
 
 	log.InfoError(logger, errLogLevel, "Initialize log on level", zap.Stringer("level", logLevel))
@@ -53,7 +53,7 @@ func TestInitLogger(t *testing.T) {
 		File:            logFile,
 		LogLevel:        "warning",
 	}
-	logger := initLogger(config)
+	logger := initLogger(config, nil)
 	testError := "errorTest"
 	testInfo := "infoTest"
 	logger.Error(testError)
@@ -67,11 +67,11 @@ func TestInitLogger(t *testing.T) {
 
 	// DevelMode
 	config = logConfig{DeveloperMode: false, LogLevel: "info", EnableLogToStdErr: true}
-	logger = initLogger(config)
+	logger = initLogger(config, nil)
 	logger.DPanic(testError)
 
 	config = logConfig{DeveloperMode: true, LogLevel: "info"}
-	logger = initLogger(config)
+	logger = initLogger(config, nil)
 	e.CmpPanic(func() {
 		logger.DPanic(testError)
 	}, testError)
@@ -30,8 +30,11 @@ import (
 	_ "github.com/kardianos/minwinsvc"
 	"github.com/rekby/lets-proxy2/internal/acme_client_manager"
 	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
 	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/outbound_proxy"
 	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/static_certs"
 	"github.com/rekby/lets-proxy2/internal/tlslistener"
 	zc "github.com/rekby/zapcontext"
 	"go.uber.org/zap"
@@ -66,9 +69,14 @@ func version() string {
 	return fmt.Sprintf("Version: '%v', Os: '%v', Arch: '%v'", VERSION, runtime.GOOS, runtime.GOARCH)
 }
 
-func startMetrics(ctx context.Context, r prometheus.Gatherer, config config.Config, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
+// startMetrics return nil listener if metrics disabled
+// handlers - additional handlers by path, served on metrics listener with same access restrictions.
+// sensitiveHandlers - additional handlers by path, served with access restrictions for sensitive endpoints.
+// Handlers of path from both maps served with sensitive restrictions for mutating methods only.
+func startMetrics(ctx context.Context, r prometheus.Gatherer, config config.Config, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error),
+	handlers, sensitiveHandlers map[string]http.Handler) (*tlslistener.ListenersHandler, error) {
 	if !config.Enable {
-		return nil
+		return nil, nil
 	}
 
 	loggerLocal := zc.L(ctx).Named("startMetrics")
@@ -77,18 +85,33 @@ func startMetrics(ctx context.Context, r prometheus.Gatherer, config config.Conf
 	err := config.GetListenConfig().Apply(ctx, listener)
 	log.DebugFatal(loggerLocal, err, "Apply listen config")
 	if err != nil {
-		return xerrors.Errorf("apply config settings to metrics listener: %w", err)
+		return nil, xerrors.Errorf("apply config settings to metrics listener: %w", err)
 	}
 
 	err = listener.Start(zc.WithLogger(ctx, zc.L(ctx).Named("metrics_listener")), nil)
 	log.DebugFatal(loggerLocal, err, "start metrics listener")
 	if err != nil {
-		return xerrors.Errorf("start metrics listener: %w", err)
+		return nil, xerrors.Errorf("start metrics listener: %w", err)
 	}
 
 	m := metrics.New(zc.L(ctx).Named("metrics"), r)
+	mux := http.NewServeMux()
+	mux.Handle("/", m)
+	for path, handler := range handlers {
+		mux.Handle(path, handler)
+	}
 
-	secretMetric := secrethandler.New(zc.L(ctx).Named("metrics_secret"), config.GetSecretHandlerConfig(), m)
+	secretMetric := http.NewServeMux()
+	commonHandler := secrethandler.New(zc.L(ctx).Named("metrics_secret"), config.GetSecretHandlerConfig(), mux)
+	secretMetric.Handle("/", commonHandler)
+	for path, handler := range sensitiveHandlers {
+		var sensitiveHandler http.Handler = secrethandler.New(zc.L(ctx).Named("metrics_sensitive_secret"), config.GetSensitiveSecretHandlerConfig(), handler)
+		if _, ok := handlers[path]; ok {
+			// registered in both: reading by common restrictions, changes by sensitive
+			sensitiveHandler = mutatingMethodsHandler{safe: commonHandler, mutating: sensitiveHandler}
+		}
+		secretMetric.Handle(path, sensitiveHandler)
+	}
 	go func() {
 		defer log.HandlePanic(loggerLocal)
 
@@ -99,18 +122,21 @@ func startMetrics(ctx context.Context, r prometheus.Gatherer, config config.Conf
 		}
 		log.DebugDPanic(loggerLocal, effectiveError, "Handle metric stopped")
 	}()
-	return nil
+	return listener, nil
 }
 
 //nolint:funlen
 func startProgram(config *configType) {
-	logger := initLogger(config.Log)
+	startTime := time.Now()
+	debugDomains, errDebugDomains := log.NewDebugDomains(config.Log.DebugDomains)
+	logger := initLogger(config.Log, debugDomains)
 	ctx := zc.WithLogger(context.Background(), logger)
+	log.InfoFatal(logger, errDebugDomains, "Parse debug log domains", zap.Strings("domains", config.Log.DebugDomains))
 
 	logger.Info("StartAutoRenew program version", zap.String("version", version()))
 
 	var registry *prometheus.Registry
-	if config.Metrics.Enable {
+	if config.Metrics.Enable || config.Metrics.TextfilePath != "" {
 		registry = prometheus.NewRegistry()
 	}
 
@@ -118,54 +144,194 @@ func startProgram(config *configType) {
 	err := os.MkdirAll(config.General.StorageDir, defaultDirMode)
 	log.InfoFatal(logger, err, "Create storage dir", zap.String("dir", config.General.StorageDir))
 
+	outboundProxy, err := config.OutboundProxy.GetProxyFunc()
+	log.InfoFatal(logger, err, "Parse outbound proxy config", zap.Bool("use_environment", config.OutboundProxy.UseEnvironment),
+		zap.Bool("has_url", config.OutboundProxy.URL != ""))
+
 	storage := &cache.DiskCache{Dir: config.General.StorageDir}
-	clientManager := acme_client_manager.New(ctx, storage)
+	staticCerts, err := static_certs.Load(config.StaticCerts)
+	log.InfoFatal(logger, err, "Load static certificates", zap.Int("count", len(config.StaticCerts)))
+
+	var clientManager *acme_client_manager.AcmeManager
+	var certManager *cert_manager.Manager
+	var getCertificate static_certs.GetCertificateFunc
+	if config.General.AcmeEnabled {
+		clientManager, certManager = createCertManager(ctx, config, storage, registry, outboundProxy)
+		getCertificate = staticCerts.GetCertificate(certManager.GetCertificate)
+	} else {
+		err = checkAcmeDisabledConfig(config)
+		log.InfoFatal(logger, err, "Check config without acme")
+		logger.Info("Acme disabled, serve static certificates only", zap.Int("domains", staticCerts.Len()),
+			zap.Bool("default_certificate", staticCerts.Default != nil))
+		getCertificate = staticCerts.GetCertificate(nil)
+	}
 
-	clientManager.DirectoryURL = config.General.AcmeServer
-	logger.Info("Acme directory", zap.String("url", config.General.AcmeServer))
+	metricsHandlers := make(map[string]http.Handler)
+	metricsSensitiveHandlers := make(map[string]http.Handler)
+	debugDomainsHandler := debugDomains.Handler(logger.Named("debug_domains"))
+	metricsHandlers["/log/debug-domains"] = debugDomainsHandler
+	// change domains list by sensitive restrictions
+	metricsSensitiveHandlers["/log/debug-domains"] = debugDomainsHandler
+	info, err := newInfoHandler(config, startTime)
+	log.InfoFatal(logger, err, "Create info handler")
+	if clientManager != nil {
+		info.acmeAccounts = clientManager.AccountsStatus
+	}
+	metricsHandlers["/info"] = info
+	if certManager != nil {
+		metricsHandlers["/certs"] = certManager.CertsHandler()
+		metricsHandlers["/tlsa"] = certManager.TLSAHandler(logger.Named("tlsa"))
+		metricsSensitiveHandlers["/renew"] = certManager.RenewHandler(logger.Named("renew"))
+		metricsHandlers["/ocsp/"] = certManager.OCSPHandler(logger.Named("ocsp"))
+		if certManager.CacheGCRetention > 0 {
+			metricsSensitiveHandlers["/cache/gc"] = certManager.CacheGCHandler(logger.Named("cache_gc"))
+		}
+	}
+	eventsBus := config.Events.CreateBus(logger.Named("events"))
+	if eventsBus != nil {
+		if certManager != nil {
+			certManager.Events = eventsBus
+		}
+		metricsHandlers["/events"] = eventsBus
+	}
+	debugCapture, err := config.Proxy.GetDebugCapture(ctx)
+	log.InfoFatal(logger, err, "Create debug capture")
+	if debugCapture != nil {
+		metricsSensitiveHandlers["/debug-capture"] = debugCapture.Handler(logger.Named("debug_capture"))
+	}
+	if config.General.AcmeAccountExport {
+		if !config.Metrics.GetSensitiveSecretHandlerConfig().HasAuthentication() {
+			logger.Fatal("Acme accounts export contains private keys and need authentication, " +
+				"set authentication in Metrics or Metrics.SensitiveAuth section of config")
+		}
+		metricsSensitiveHandlers["/acme/account/export"] = clientManager.ExportHandler()
+	}
 
-	_, _, err = clientManager.GetClient(ctx)
-	log.InfoFatal(logger, err, "Get acme client")
+	tlsListener := &tlslistener.ListenersHandler{
+		GetCertificate:          getCertificate,
+		DisableChallenges:       config.Challenges.DisableOnMainListeners,
+		DisableTLSALPNChallenge: config.Challenges.DisableTLSALPNOnMainListeners,
+	}
+	if config.Metrics.Enable && config.Metrics.DomainStatsLimit > 0 {
+		tlsListener.DomainStats = tlslistener.NewDomainStats(config.Metrics.DomainStatsLimit)
+		metricsHandlers["/stats/domains"] = tlsListener.DomainStats
+	}
+	if config.Proxy.ReloadRoutes || config.Metrics.Enable && config.Metrics.TrackConnections {
+		// routes reload track connections for release connections, bound to old routes
+		tlsListener.Connections = tlslistener.NewConnections()
+	}
+	if config.Metrics.Enable && config.Metrics.TrackConnections {
+		connectionsHandler := tlsListener.Connections.Handler(logger.Named("connections"))
+		metricsHandlers["/connections"] = connectionsHandler
+		metricsHandlers["/connections/"] = connectionsHandler
+		// close connections by sensitive restrictions
+		metricsSensitiveHandlers["/connections"] = connectionsHandler
+		metricsSensitiveHandlers["/connections/"] = connectionsHandler
+	}
 
-	certManager := cert_manager.New(clientManager, storage, registry)
-	certManager.CertificateIssueTimeout = time.Duration(config.General.IssueTimeout) * time.Second
-	certManager.SaveJSONMeta = config.General.StoreJSONMetadata
+	tlslistener.ConfigureSystemdNames(ctx, systemdListenerNames(config)...)
 
-	certManager.AllowECDSACert = config.General.AllowECDSACert
-	certManager.AllowRSACert = config.General.AllowRSACert
-	certManager.AllowInsecureTLSChipers = config.General.AllowInsecureTLSChipers
+	// main listeners apply before metrics - for take unnamed socket activated listeners first
+	err = config.Listen.Apply(ctx, tlsListener)
+	log.DebugFatal(logger, err, "Config listeners")
 
-	for _, subdomain := range config.General.Subdomains {
-		subdomain = strings.TrimSpace(subdomain)
-		subdomain = strings.TrimSuffix(subdomain, ".") + "." // must ends with dot
-		certManager.AutoSubdomains = append(certManager.AutoSubdomains, subdomain)
-	}
+	additionalListeners, err := createAdditionalListeners(ctx, config.Listeners, getCertificate, tlsListener.DomainStats,
+		tlsListener.Connections)
+	log.InfoFatal(logger, err, "Config additional listeners", zap.Int("count", len(config.Listeners)))
 
-	certManager.DomainChecker, err = config.CheckDomains.CreateDomainChecker(ctx)
-	log.DebugFatal(logger, err, "Config domain checkers.")
+	domainDeniedCertificate, err := getDomainDeniedCertificate(config.General.OnDomainDenied)
+	log.InfoFatal(logger, err, "Get certificate for denied domains", zap.String("policy", config.General.OnDomainDenied))
+	for _, listener := range append([]*tlslistener.ListenersHandler{tlsListener}, additionalListeners...) {
+		listener.DomainDeniedCertificate = domainDeniedCertificate
+	}
 
-	err = startMetrics(ctx, registry, config.Metrics, certManager.GetCertificate)
+	metricsListener, err := startMetrics(ctx, registry, config.Metrics, getCertificate, metricsHandlers, metricsSensitiveHandlers)
 	log.InfoFatalCtx(ctx, err, "start metrics")
 
-	tlsListener := &tlslistener.ListenersHandler{
-		GetCertificate: certManager.GetCertificate,
+	var challengeListeners []handoffListener
+	if certManager != nil {
+		challengeListeners, err = startChallengeListeners(ctx, config.Challenges, certManager, registry)
+		log.InfoFatal(logger, err, "Start acme challenges listeners")
 	}
 
-	err = config.Listen.Apply(ctx, tlsListener)
-	log.DebugFatal(logger, err, "Config listeners")
+	err = dropPrivileges(ctx, config.General)
+	log.InfoFatal(logger, err, "Drop privileges")
 
 	err = tlsListener.Start(ctx, registry)
 	log.DebugFatal(logger, err, "StartAutoRenew tls listener")
 
+	var proxyListener interface {
+		net.Listener
+		GetConnectionContext(remoteAddr, localAddr string) (context.Context, error)
+	} = tlsListener
+	if len(additionalListeners) > 0 {
+		for _, listener := range additionalListeners {
+			err = listener.Start(ctx, listenerRegisterer(registry, listener.Name))
+			log.DebugFatal(logger, err, "Start additional listener", zap.String("name", listener.Name))
+		}
+		proxyListener = tlslistener.NewMultiListenersHandler(ctx, append([]*tlslistener.ListenersHandler{tlsListener}, additionalListeners...)...)
+	}
+
 	config.Proxy.EnableAccessLog = config.Log.EnableAccessLog
-	p := proxy.NewHTTPProxy(ctx, tlsListener)
+	p := proxy.NewHTTPProxy(ctx, proxyListener)
+	if certManager != nil && certManager.EnableHTTPValidation {
+		p.HandleHTTPValidation = certManager.HandleHTTPValidation
+	}
 	p.GetContext = func(req *http.Request) (i context.Context, e error) {
 		localAddr := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
-		return tlsListener.GetConnectionContext(req.RemoteAddr, localAddr.String())
+		return proxyListener.GetConnectionContext(req.RemoteAddr, localAddr.String())
 	}
 
 	err = config.Proxy.Apply(ctx, p)
 	log.InfoFatal(logger, err, "Apply proxy config")
+	p.DebugCapture = debugCapture
+	if eventsBus != nil && p.BackendDown != nil {
+		p.BackendDown.Events = eventsBus
+	}
+	if p.ResponseCache != nil {
+		p.ResponseCache.InitMetrics(registry)
+	}
+	if p.RequestCoalescing != nil {
+		p.RequestCoalescing.InitMetrics(registry)
+	}
+	if p.Retries != nil {
+		p.Retries.InitMetrics(registry)
+	}
+	if transport, ok := p.HTTPTransport.(proxy.Transport); ok {
+		if transport.Pool != nil {
+			transport.Pool.InitMetrics(registry)
+		}
+		transport.Proxy = outboundProxy
+		resolver, err := config.CheckDomains.CustomResolver(ctx)
+		log.InfoFatal(logger, err, "Create resolver for backends")
+		transport.Resolver = resolver
+		p.HTTPTransport = transport
+	}
+	if config.Metrics.TextfilePath != "" {
+		err = metrics.StartTextfile(ctx, logger.Named("metrics_textfile"), registry, config.Metrics.TextfilePath,
+			time.Duration(config.Metrics.TextfileIntervalSeconds)*time.Second)
+		log.InfoFatal(logger, err, "Start write metrics textfile", zap.String("path", config.Metrics.TextfilePath))
+	}
+	var routes *routesReloader
+	if director, ok := p.Director.(*proxy.ReloadableDirector); ok {
+		routes = &routesReloader{
+			director:    director,
+			connections: tlsListener.Connections,
+			gracePeriod: time.Duration(config.Proxy.ReloadRoutesGracePeriodSeconds) * time.Second,
+			readConfig:  readConfig,
+			onReload: func(reloaded *configType) {
+				err := info.setConfig(withReloadedRoutes(config, reloaded))
+				log.DebugError(logger, err, "Update effective config hash")
+			},
+		}
+	}
+	startReloadHandler(ctx, p.ErrorPages, append([]*tlslistener.ListenersHandler{tlsListener}, additionalListeners...), routes)
+
+	forwardProxy, err := config.ForwardProxy.CreateHandler(ctx)
+	log.InfoFatal(logger, err, "Create forward proxy")
+	if forwardProxy != nil {
+		p.ConnectHandler = forwardProxy
+	}
 
 	go func() {
 		defer log.HandlePanic(logger)
@@ -173,14 +339,260 @@ func startProgram(config *configType) {
 		<-ctx.Done()
 		err := p.Close()
 		log.DebugError(logger, err, "Stop proxy")
+		if certManager != nil {
+			err = certManager.Close()
+			log.DebugError(logger, err, "Stop certificate manager")
+		}
 	}()
 
+	handoffListeners := []handoffListener{{handler: tlsListener, config: config.Listen}}
+	for i, listener := range additionalListeners {
+		handoffListeners = append(handoffListeners, handoffListener{handler: listener, config: config.Listeners[i].Config})
+	}
+	if metricsListener != nil {
+		handoffListeners = append(handoffListeners, handoffListener{handler: metricsListener, config: config.Metrics.GetListenConfig()})
+	}
+	handoffListeners = append(handoffListeners, challengeListeners...)
+	waitGracefulRestart := startGracefulRestartHandler(ctx, p, handoffListeners)
+
+	// acme server validate challenges after create order, proxy will serve http-01 challenges at the time
+	if certManager != nil {
+		if certManager.KeyPool != nil {
+			certManager.KeyPool.Start(ctx)
+		}
+		certManager.StartManaged(ctx)
+		certManager.StartChallengeSweeper(ctx)
+		certManager.StartCacheGC(ctx)
+		certManager.StartClockSkewCheck(ctx, clientManager.HTTPClient, config.General.AcmeServer)
+	}
+
+	// listeners started and accept connections to kernel queue while p.Start begin serve
+	notifyGracefulRestartReady(ctx)
+
 	err = p.Start()
 	var effectiveError = err
 	if effectiveError == http.ErrServerClosed {
 		effectiveError = nil
 	}
 	log.DebugErrorCtx(ctx, effectiveError, "Handle request stopped")
+	waitGracefulRestart()
+}
+
+// createCertManager create acme client manager and certificate manager by config
+func createCertManager(ctx context.Context, config *configType, storage cache.Bytes, registry *prometheus.Registry,
+	outboundProxy outbound_proxy.ProxyFunc) (*acme_client_manager.AcmeManager, *cert_manager.Manager) {
+	logger := zc.L(ctx)
+
+	var err error
+	clientManager := acme_client_manager.New(ctx, storage)
+	clientManager.HTTPClient = outbound_proxy.NewHTTPClient(outboundProxy)
+
+	clientManager.DirectoryURL = config.General.AcmeServer
+	clientManager.AccountEmail = config.General.AcmeAccountEmail
+	clientManager.RetryCount = config.General.AcmeRetryCount
+	clientManager.AccountProblemMode, err = getAcmeAccountProblemMode(config.General.AcmeAccountProblemMode)
+	log.InfoFatal(logger, err, "Parse acme account problem mode")
+	clientManager.UserAgent = getAcmeUserAgent(config.General)
+	clientManager.Headers, err = getAcmeHeaders(config.General.AcmeHeaders)
+	log.InfoFatal(logger, err, "Parse acme headers")
+	clientManager.DialTimeout = time.Duration(config.General.AcmeDialTimeout) * time.Second
+	clientManager.TLSHandshakeTimeout = time.Duration(config.General.AcmeTLSHandshakeTimeout) * time.Second
+	clientManager.ResponseHeaderTimeout = time.Duration(config.General.AcmeResponseHeaderTimeout) * time.Second
+	clientManager.RequestTimeout = time.Duration(config.General.AcmeRequestTimeout) * time.Second
+	if !config.General.AcmeAcceptTOS {
+		clientManager.AgreeFunction = func(string) bool { return false }
+	}
+	logger.Info("Acme directory", zap.String("url", config.General.AcmeServer),
+		zap.String("account_email", config.General.AcmeAccountEmail), zap.Bool("accept_tos", config.General.AcmeAcceptTOS))
+
+	if config.General.AcmeAccountImportFile != "" {
+		importData, err := os.ReadFile(config.General.AcmeAccountImportFile)
+		log.InfoFatal(logger, err, "Read acme accounts import file", zap.String("file", config.General.AcmeAccountImportFile))
+		err = clientManager.Import(ctx, importData)
+		if xerrors.Is(err, acme_client_manager.ErrAccountsStored) {
+			logger.Info("Skip import acme accounts: accounts already stored", zap.String("file", config.General.AcmeAccountImportFile))
+		} else {
+			log.InfoFatal(logger, err, "Import acme accounts", zap.String("file", config.General.AcmeAccountImportFile))
+		}
+	}
+
+	if config.General.DryRun {
+		logger.Warn("Dry run mode: certificates will not be issued, self-signed placeholders served instead")
+	} else {
+		_, _, err = clientManager.GetClient(ctx)
+		log.InfoFatal(logger, err, "Get acme client")
+	}
+
+	certManager := cert_manager.New(clientManager, storage, registry)
+	certManager.CertificateIssueTimeout = time.Duration(config.General.IssueTimeout) * time.Second
+	certManager.ValidationTimeout = time.Duration(config.General.AcmeValidationTimeout) * time.Second
+	certManager.ChallengeCleanupRetries = config.General.ChallengeCleanupRetries
+	certManager.ChallengeCleanupRetryDelay = time.Duration(config.General.ChallengeCleanupRetryDelay) * time.Second
+	certManager.ChallengeMaxAge = time.Duration(config.General.ChallengeMaxAge) * time.Second
+	certManager.SaveJSONMeta = config.General.StoreJSONMetadata
+	certManager.PreferredChain = config.General.PreferredChain
+	certManager.ServeRootCert = config.General.ServeRootCert
+	certManager.DryRun = config.General.DryRun
+
+	err = checkOCSPConfig(config.General)
+	log.InfoFatal(logger, err, "Check ocsp config")
+	certManager.OCSPStapling = config.General.OCSPStapling
+	certManager.MustStaple = config.General.MustStaple
+	certManager.OCSPHTTPClient = clientManager.HTTPClient
+	err = checkClockSkewConfig(config.General)
+	log.InfoFatal(logger, err, "Check clock skew config")
+	certManager.ClockSkewTolerance = time.Duration(config.General.ClockSkewToleranceSeconds) * time.Second
+	certManager.ClockSkewWarning = time.Duration(config.General.ClockSkewWarningSeconds) * time.Second
+	certManager.CertSubject, err = getCertSubject(config.General)
+	log.InfoFatal(logger, err, "Check certificate subject config")
+	certManager.ServedIntermediates, err = getServedIntermediates(config.General.ServedIntermediatesFile)
+	log.InfoFatal(logger, err, "Read served intermediates", zap.String("file", config.General.ServedIntermediatesFile))
+
+	certManager.AllowECDSACert = config.General.AllowECDSACert
+	certManager.AllowRSACert = config.General.AllowRSACert
+	certManager.AllowInsecureTLSChipers = config.General.AllowInsecureTLSChipers
+
+	certManager.EnableTLSValidation, certManager.EnableHTTPValidation, err = getChallengeTypes(config)
+	log.InfoFatal(logger, err, "Get acme challenge types", zap.Bool("tls_alpn_01", certManager.EnableTLSValidation),
+		zap.Bool("http_01", certManager.EnableHTTPValidation))
+	certManager.AllowIPCerts = config.General.AllowIPCerts
+	certManager.AllowedIPs, err = getAllowedIPs(config.General)
+	log.InfoFatal(logger, err, "Get allowed ip addresses for certificates")
+	if config.General.EnableHTTPValidation && config.General.HTTPValidationPreflight {
+		certManager.HTTPPreflight = &cert_manager.HTTPPreflight{
+			ListenAddresses: httpValidationAddresses(config),
+			CheckerURL:      config.General.HTTPValidationPreflightCheckerURL,
+		}
+		certManager.HTTPPreflightFallback = config.General.HTTPValidationPreflightFallback
+	}
+
+	for _, subdomain := range config.General.Subdomains {
+		subdomain = strings.TrimSpace(subdomain)
+		subdomain = strings.TrimSuffix(subdomain, ".") + "." // must ends with dot
+		certManager.AutoSubdomains = append(certManager.AutoSubdomains, subdomain)
+	}
+
+	certManager.AutoIncludeApexAndWww = config.General.AutoIncludeApexAndWww
+
+	certManager.OnExpiredCert, err = cert_manager.ParseExpiredCertPolicy(config.General.OnExpiredCert)
+	log.InfoFatal(logger, err, "Parse OnExpiredCert", zap.String("value", config.General.OnExpiredCert))
+	err = checkRenewalBackoffConfig(config.General)
+	log.InfoFatal(logger, err, "Check renewal backoff config")
+	certManager.RenewalBackoffMin = time.Duration(config.General.RenewalBackoffMinSeconds) * time.Second
+	certManager.RenewalBackoffMax = time.Duration(config.General.RenewalBackoffMaxSeconds) * time.Second
+	certManager.RenewalFailingAfter = config.General.RenewalFailingAfter
+
+	certManager.MaxCachedCerts = config.General.MaxCachedCerts
+	certManager.ReuseKeyOnRenewal = config.General.ReuseKeyOnRenewal
+	certManager.PinKeys = config.General.PinCertKeys
+	err = checkCacheGCConfig(config.General)
+	log.InfoFatal(logger, err, "Check cache gc config")
+	certManager.CacheGCRetention = time.Duration(config.General.CacheGCRetentionDays) * 24 * time.Hour
+	certManager.CacheGCInterval = time.Duration(config.General.CacheGCIntervalHours) * time.Hour
+	certManager.CacheGCDryRun = config.General.CacheGCDryRun
+	certManager.PersistOrders = config.General.PersistAcmeOrders
+	certManager.KeyPool, err = getKeyPool(config.General)
+	log.InfoFatal(logger, err, "Create key pool", zap.Int("size", config.General.KeyPoolSize),
+		zap.Strings("key_types", config.General.KeyPoolKeyTypes))
+	certManager.KeyPool.InitMetrics(registry)
+	certManager.HandshakeLimit, err = getHandshakeLimit(config.General)
+	log.InfoFatal(logger, err, "Create handshake limit", zap.Int("concurrency", config.General.HandshakeCertConcurrency),
+		zap.Int("queue_size", config.General.HandshakeCertQueueSize))
+	certManager.HandshakeLimit.InitMetrics(registry)
+	if certManager.MaxCachedCerts > 0 {
+		err = certManager.LoadCachedCertsList(ctx)
+		log.InfoFatal(logger, err, "Load list of cached certificates")
+	}
+
+	certManager.CertGroups, err = getCertGroups(config.CertGroups)
+	log.InfoFatal(logger, err, "Parse cert groups", zap.Int("count", len(config.CertGroups)))
+
+	certManager.DomainChecker, err = config.CheckDomains.CreateDomainChecker(ctx)
+	log.DebugFatal(logger, err, "Config domain checkers.")
+
+	certManager.ManagedDomains, err = getManagedDomains(config.Managed)
+	log.InfoFatal(logger, err, "Get managed domains", domain.LogDomains(certManager.ManagedDomains))
+	certManager.ManagedCheckInterval = time.Duration(config.Managed.CheckInterval) * time.Second
+
+	if config.General.WarmCacheOnStartup {
+		_, err = certManager.WarmCache(ctx, config.General.WarmCacheReissueExpired)
+		log.InfoFatal(logger, err, "Warm certificates cache")
+	}
+	return clientManager, certManager
+}
+
+// createAdditionalListeners create and apply config to additional listeners, it must be started by caller.
+func createAdditionalListeners(ctx context.Context, configs []listenerConfig,
+	getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), domainStats *tlslistener.DomainStats,
+	connections *tlslistener.Connections,
+) ([]*tlslistener.ListenersHandler, error) {
+	if err := checkListenersConfig(configs); err != nil {
+		return nil, err
+	}
+
+	res := make([]*tlslistener.ListenersHandler, 0, len(configs))
+	for i := range configs {
+		listenerConfig := &configs[i]
+		listenerCtx := zc.WithLogger(ctx, zc.L(ctx).With(zap.String("listener", listenerConfig.Name)))
+
+		domainChecker, err := listenerConfig.CheckDomains.CreateDomainChecker(listenerCtx)
+		if err != nil {
+			return nil, xerrors.Errorf("create domain checker of listener %q: %w", listenerConfig.Name, err)
+		}
+
+		listener := &tlslistener.ListenersHandler{
+			GetCertificate:          getCertificate,
+			DomainStats:             domainStats,
+			Connections:             connections,
+			Name:                    listenerConfig.Name,
+			DomainChecker:           domainChecker,
+			DisableChallenges:       listenerConfig.DisableChallenges,
+			DisableTLSALPNChallenge: listenerConfig.DisableTLSALPNChallenge,
+		}
+		if err = listenerConfig.Apply(listenerCtx, listener); err != nil {
+			return nil, xerrors.Errorf("apply config of listener %q: %w", listenerConfig.Name, err)
+		}
+		res = append(res, listener)
+	}
+	return res, nil
+}
+
+// httpValidationAddresses return tcp addresses of listeners, which answer to acme challenges
+func httpValidationAddresses(config *configType) []string {
+	res := append([]string{}, config.Listen.TCPAddresses...)
+	for _, listenerConfig := range config.Listeners {
+		if !listenerConfig.DisableChallenges {
+			res = append(res, listenerConfig.TCPAddresses...)
+		}
+	}
+	return res
+}
+
+// systemdListenerNames return names of socket activated listeners from all listener sections.
+func systemdListenerNames(config *configType) []string {
+	res := []string{config.Listen.SystemdTLSName, config.Listen.SystemdTCPName}
+	for _, listenerConfig := range config.Listeners {
+		res = append(res, listenerConfig.SystemdTLSName, listenerConfig.SystemdTCPName)
+	}
+	if config.Metrics.Enable {
+		metricsConfig := config.Metrics.GetListenConfig()
+		res = append(res, metricsConfig.SystemdTLSName, metricsConfig.SystemdTCPName)
+	}
+	if len(config.Challenges.TLSALPNAddresses) > 0 {
+		res = append(res, challengesTLSALPNSystemdName)
+	}
+	if len(config.Challenges.HTTPAddresses) > 0 {
+		res = append(res, challengesHTTPSystemdName)
+	}
+	return res
+}
+
+// listenerRegisterer return registerer with metrics prefix of additional listener
+func listenerRegisterer(registry *prometheus.Registry, name string) prometheus.Registerer {
+	if registry == nil {
+		return nil
+	}
+	return prometheus.WrapRegistererWithPrefix("listener_"+name+"_", registry)
 }
 
 func startProfiler(ctx context.Context, config profiler.Config) {
@@ -191,16 +603,22 @@ func startProfiler(ctx context.Context, config profiler.Config) {
 		return
 	}
 
+	// bind before drop privileges
+	listener, err := net.Listen("tcp", config.BindAddress)
+	log.InfoError(logger, err, "Bind profiler", zap.String("bind_address", config.BindAddress))
+	if err != nil {
+		return
+	}
+
 	go func() {
 		defer log.HandlePanic(logger)
 
 		httpServer := http.Server{
-			Addr:    config.BindAddress,
 			Handler: profiler.New(logger.Named("profiler"), config),
 		}
 
-		logger.Info("Start profiler", zap.String("bind_address", httpServer.Addr))
-		err := httpServer.ListenAndServe()
+		logger.Info("Start profiler", zap.String("bind_address", config.BindAddress))
+		err := httpServer.Serve(listener)
 		var logLevel zapcore.Level
 		if err == http.ErrServerClosed {
 			logLevel = zapcore.InfoLevel
@@ -0,0 +1,19 @@
+package main
+
+import "net/http"
+
+// mutatingMethodsHandler pass requests with safe methods (GET, HEAD, OPTIONS) to safe handler
+// and requests, which change state (POST, DELETE, ...), to mutating handler.
+type mutatingMethodsHandler struct {
+	safe     http.Handler
+	mutating http.Handler
+}
+
+func (h mutatingMethodsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		h.safe.ServeHTTP(w, r)
+	default:
+		h.mutating.ServeHTTP(w, r)
+	}
+}
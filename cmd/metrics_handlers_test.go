@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+)
+
+func TestMutatingMethodsHandler(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	newHandler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		})
+	}
+	h := mutatingMethodsHandler{safe: newHandler("safe"), mutating: newHandler("mutating")}
+
+	for method, expected := range map[string]string{
+		http.MethodGet:     "safe",
+		http.MethodHead:    "safe",
+		http.MethodOptions: "safe",
+		http.MethodPost:    "mutating",
+		http.MethodDelete:  "mutating",
+		http.MethodPut:     "mutating",
+		"PURGE":            "mutating",
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/connections/1", nil))
+		td.Cmp(w.Body.String(), expected, method)
+	}
+}
@@ -0,0 +1,100 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// dropPrivileges switch process to configured user/group.
+// It must be called after all privileged listeners bound and before start serving.
+func dropPrivileges(ctx context.Context, config configGeneral) error {
+	logger := zc.L(ctx)
+
+	if config.RunAsUser == "" && config.RunAsGroup == "" {
+		logger.Debug("Drop privileges disabled")
+		return nil
+	}
+	if config.RunAsUser == "" {
+		// change of group only keep process with uid 0
+		return xerrors.Errorf("RunAsGroup %q require RunAsUser", config.RunAsGroup)
+	}
+
+	uid, gid, err := lookupUserGroup(config.RunAsUser, config.RunAsGroup)
+	if err != nil {
+		return xerrors.Errorf("lookup user and group for drop privileges: %w", err)
+	}
+	logger = logger.With(zap.String("user", config.RunAsUser), zap.Int("uid", uid),
+		zap.String("group", config.RunAsGroup), zap.Int("gid", gid))
+
+	if os.Geteuid() != 0 {
+		logger.Warn("Process run without root privileges, skip drop privileges")
+		return nil
+	}
+
+	if err = chownRecursive(config.StorageDir, uid, gid); err != nil {
+		return xerrors.Errorf("change owner of storage dir %q: %w", config.StorageDir, err)
+	}
+
+	if err = syscall.Setgroups([]int{gid}); err != nil {
+		return xerrors.Errorf("set supplementary groups: %w", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return xerrors.Errorf("set gid: %w", err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return xerrors.Errorf("set uid: %w", err)
+	}
+
+	logger.Info("Privileges dropped")
+	return nil
+}
+
+// lookupUserGroup return uid and gid for names. Uid is -1 if userName is empty.
+// Gid is primary group of the user if groupName is empty.
+func lookupUserGroup(userName, groupName string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, xerrors.Errorf("parse uid %q: %w", u.Uid, err)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return 0, 0, xerrors.Errorf("parse gid %q: %w", u.Gid, err)
+		}
+	}
+
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, xerrors.Errorf("parse gid %q: %w", g.Gid, err)
+		}
+	}
+
+	return uid, gid, nil
+}
+
+func chownRecursive(dir string, uid, gid int) error {
+	return filepath.Walk(dir, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
@@ -0,0 +1,43 @@
+//go:build !windows
+
+package main
+
+import (
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestLookupUserGroup(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	uid, gid, err := lookupUserGroup("", "")
+	td.CmpNoError(err)
+	td.CmpDeeply(uid, -1)
+	td.CmpDeeply(gid, -1)
+
+	uid, gid, err = lookupUserGroup("root", "")
+	td.CmpNoError(err)
+	td.CmpDeeply(uid, 0)
+	td.CmpDeeply(gid, 0)
+
+	uid, gid, err = lookupUserGroup("", "root")
+	td.CmpNoError(err)
+	td.CmpDeeply(uid, -1)
+	td.CmpDeeply(gid, 0)
+
+	_, _, err = lookupUserGroup("lets-proxy-not-existed-user", "")
+	td.CmpError(err)
+}
+
+func TestDropPrivilegesGroupWithoutUser(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	td.CmpNoError(dropPrivileges(ctx, configGeneral{}))
+	td.CmpError(dropPrivileges(ctx, configGeneral{RunAsGroup: "root"}))
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"context"
+
+	zc "github.com/rekby/zapcontext"
+)
+
+// dropPrivileges doesn't supported on windows
+func dropPrivileges(ctx context.Context, config configGeneral) error {
+	if config.RunAsUser != "" || config.RunAsGroup != "" {
+		zc.L(ctx).Warn("Drop privileges doesn't supported on windows, RunAsUser and RunAsGroup ignored")
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+)
+
+// routesReloader replace routes of proxy (with allowed methods of them) by routes from config files.
+// Requests use new routes immediately, connections bound to old routes released after grace period:
+// connections, which backend doesn't changed by new routes, migrated to new routes, other connections closed.
+type routesReloader struct {
+	director    *proxy.ReloadableDirector
+	connections *tlslistener.Connections
+	gracePeriod time.Duration
+	readConfig  func(ctx context.Context) (*configType, error)
+	onReload    func(config *configType) // called with read config after routes replaced, may be nil
+}
+
+func (r *routesReloader) reload(ctx context.Context) error {
+	config, err := r.readConfig(ctx)
+	if err != nil {
+		return err
+	}
+	director, err := config.Proxy.GetDirector(ctx)
+	if err != nil {
+		return err
+	}
+	allowedMethodsRules, err := config.Proxy.GetAllowedMethodsRules()
+	if err != nil {
+		return err
+	}
+
+	generation := r.director.Replace(director, allowedMethodsRules)
+	if r.onReload != nil {
+		r.onReload(config)
+	}
+	zc.L(ctx).Info("Routes reloaded", zap.Uint64("generation", generation), zap.Duration("grace_period", r.gracePeriod))
+	time.AfterFunc(r.gracePeriod, func() {
+		defer log.HandlePanic(zc.L(ctx))
+
+		if ctx.Err() == nil {
+			r.release(ctx, generation)
+		}
+	})
+	return nil
+}
+
+// withReloadedRoutes return copy of config with routes of reloaded config: only routes applied by reload,
+// other reloaded settings doesn't change running instance.
+func withReloadedRoutes(config, reloaded *configType) *configType {
+	res := *config
+	res.Proxy.DefaultTarget = reloaded.Proxy.DefaultTarget
+	res.Proxy.TargetMap = reloaded.Proxy.TargetMap
+	res.Proxy.Headers = reloaded.Proxy.Headers
+	res.Proxy.HTTPSBackend = reloaded.Proxy.HTTPSBackend
+	res.Proxy.RewriteRules = reloaded.Proxy.RewriteRules
+	return &res
+}
+
+// release migrate or close connections, bound to routes before generation.
+// Backend of connection compared with backend of current routes for host and path of last request
+// of the connection (server name if the host unknown).
+func (r *routesReloader) release(ctx context.Context, generation uint64) {
+	logger := zc.L(ctx)
+	migrated, closed := r.connections.ReleaseRouteGeneration(generation, func(info tlslistener.ConnectionInfo) bool {
+		if info.Backend == "" {
+			return true
+		}
+		host := info.RequestHost
+		if host == "" {
+			host = info.ServerName
+		}
+		backend, err := r.director.Backend(ctx, info.ID, host, info.RequestPath, info.RemoteAddr, info.LocalAddr)
+		log.DebugError(logger, err, "Get backend of connection by current routes", zap.String("connection_id", info.ID),
+			zap.String("old_backend", info.Backend), zap.String("backend", backend))
+		return err == nil && backend == info.Backend
+	})
+	logger.Info("Release connections of old routes", zap.Uint64("generation", generation),
+		zap.Int("migrated", migrated), zap.Int("closed", closed))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
+)
+
+func TestWithReloadedRoutes(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	config := &configType{}
+	config.Proxy.DefaultTarget = "127.0.0.1:80"
+	config.Proxy.ReadTimeoutSeconds = 10
+
+	reloaded := &configType{}
+	reloaded.Proxy.DefaultTarget = "127.0.0.2:80"
+	reloaded.Proxy.TargetMap = []string{"1.2.3.4:443-127.0.0.3:80"}
+	reloaded.Proxy.HTTPSBackend = true
+	reloaded.Proxy.ReadTimeoutSeconds = 20
+
+	res := withReloadedRoutes(config, reloaded)
+	td.Cmp(res.Proxy.DefaultTarget, "127.0.0.2:80")
+	td.Cmp(res.Proxy.TargetMap, reloaded.Proxy.TargetMap)
+	td.True(res.Proxy.HTTPSBackend)
+	td.Cmp(res.Proxy.ReadTimeoutSeconds, 10)
+	td.Cmp(config.Proxy.DefaultTarget, "127.0.0.1:80")
+}
+
+func TestRoutesReloader(t *testing.T) {
+	e, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	director := proxy.NewReloadableDirector(proxy.NewDirectorHost("127.0.0.1:80"), nil)
+	reloader := &routesReloader{
+		director:    director,
+		connections: tlslistener.NewConnections(),
+		readConfig: func(ctx context.Context) (*configType, error) {
+			config := &configType{}
+			config.Proxy.DefaultTarget = "127.0.0.2:80"
+			config.Proxy.RewriteRules = []proxy.RewriteRuleConfig{{Route: "*/", AllowedMethods: []string{"GET"}}}
+			return config, nil
+		},
+	}
+	var reloaded *configType
+	reloader.onReload = func(config *configType) { reloaded = config }
+	e.CmpNoError(reloader.reload(ctx))
+	e.Cmp(director.Generation(), uint64(2))
+	e.Cmp(reloaded.Proxy.DefaultTarget, "127.0.0.2:80")
+	e.Cmp(director.AllowedMethodsRules(), testdeep.Len(1))
+
+	backend, err := director.Backend(ctx, "conn-id", "example.com", "", "1.2.3.4:5678", "127.0.0.1:443")
+	e.CmpNoError(err)
+	e.Cmp(backend, "127.0.0.2:80")
+
+	reloader.readConfig = func(ctx context.Context) (*configType, error) {
+		config := &configType{}
+		config.Proxy.DefaultTarget = "bad target"
+		return config, nil
+	}
+	e.CmpError(reloader.reload(ctx))
+	e.Cmp(director.Generation(), uint64(2))
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+)
+
+// startReloadHandler reload error pages templates, tls session ticket keys and proxy routes (if routes not nil)
+// by SIGHUP
+func startReloadHandler(ctx context.Context, errorPages *proxy.ErrorPages, tlsListeners []*tlslistener.ListenersHandler,
+	routes *routesReloader) {
+	hasSessionTicketKeysFile := false
+	for _, tlsListener := range tlsListeners {
+		if tlsListener.SessionTicketKeysFile != "" {
+			hasSessionTicketKeysFile = true
+		}
+	}
+	if errorPages == nil && !hasSessionTicketKeysFile && routes == nil {
+		return
+	}
+
+	logger := zc.L(ctx).Named("reload")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		defer log.HandlePanic(logger)
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+			}
+
+			if routes != nil {
+				err := routes.reload(ctx)
+				log.InfoError(logger, err, "Reload routes")
+			}
+			if errorPages != nil {
+				err := errorPages.Reload()
+				log.InfoError(logger, err, "Reload error pages")
+			}
+			for _, tlsListener := range tlsListeners {
+				if tlsListener.SessionTicketKeysFile == "" {
+					continue
+				}
+				err := tlsListener.ReloadSessionTicketKeys()
+				log.InfoError(logger, err, "Reload session ticket keys", zap.String("listener", tlsListener.Name))
+			}
+		}
+	}()
+}
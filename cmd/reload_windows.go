@@ -0,0 +1,12 @@
+package main
+
+import (
+	"context"
+
+	"github.com/rekby/lets-proxy2/internal/proxy"
+	"github.com/rekby/lets-proxy2/internal/tlslistener"
+)
+
+// startReloadHandler doesn't supported on windows
+func startReloadHandler(_ context.Context, _ *proxy.ErrorPages, _ []*tlslistener.ListenersHandler, _ *routesReloader) {
+}
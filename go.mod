@@ -24,6 +24,7 @@ require (
 
 require (
 	github.com/letsencrypt/pebble/v2 v2.4.0
+	github.com/prometheus/common v0.34.0
 	github.com/rekby/fastuuid v0.9.0
 )
 
@@ -37,7 +38,6 @@ require (
 	github.com/letsencrypt/challtestsrv v1.2.1 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/prometheus/common v0.34.0 // indirect
 	github.com/prometheus/procfs v0.7.3 // indirect
 	github.com/valyala/fastrand v1.1.0 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
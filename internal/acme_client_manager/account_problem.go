@@ -0,0 +1,139 @@
+//nolint:golint
+package acme_client_manager
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+)
+
+// Modes of handling of account problems (account deactivated, key revoked or account removed by acme server)
+const (
+	AccountProblemHalt     = "halt"     // halt issue of certificates until operator fix account
+	AccountProblemRegister = "register" // register new account automatically
+)
+
+// accountReregisterInterval - new account registered automatically not more than once per the interval,
+// guard against loop of registrations. Next problem within the interval halt issue of certificates.
+const accountReregisterInterval = 24 * time.Hour
+
+const accountDoesNotExistProblemType = "urn:ietf:params:acme:error:accountDoesNotExist"
+const unauthorizedProblemType = "urn:ietf:params:acme:error:unauthorized"
+
+// Statuses of accounts in AccountStatus
+const (
+	AccountStatusValid    = "valid"
+	AccountStatusDisabled = "disabled" // temporary disabled, for example by too many orders
+	AccountStatusProblem  = "problem"  // account can't be used: deactivated, revoked or doesn't exist
+)
+
+// AccountStatus - state of acme account for admin info
+type AccountStatus struct {
+	URI     string `json:"uri"`
+	Status  string `json:"status"`
+	Problem string `json:"problem,omitempty"`
+}
+
+// IsAccountError return true if acme server rejected request because of account: account doesn't exist
+// or it isn't valid (deactivated, revoked). Such errors repeated for every request of the account.
+func IsAccountError(err error) bool {
+	if xerrors.Is(err, acme.ErrNoAccount) {
+		return true
+	}
+	var acmeErr *acme.Error
+	if !xerrors.As(err, &acmeErr) {
+		return false
+	}
+	if acmeErr.ProblemType == accountDoesNotExistProblemType {
+		return true
+	}
+	// unauthorized also used for failed challenges, account problems detected by detail:
+	// boulder answer 'Account is not valid, has status "deactivated"'
+	detail := strings.ToLower(acmeErr.Detail)
+	return acmeErr.ProblemType == unauthorizedProblemType &&
+		strings.Contains(detail, "account") && (strings.Contains(detail, "deactivated") || strings.Contains(detail, "revoked"))
+}
+
+// ReportAccountProblem mark account of the client as unusable after account error (see IsAccountError).
+// Depending on AccountProblemMode it halt issue of certificates or allow registration of new account by next
+// GetClient. It return true if issue can be retried with other account.
+func (m *AcmeManager) ReportAccountProblem(ctx context.Context, client *acme.Client, problem error) (retry bool) {
+	logger := zc.L(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	index := -1
+	for i := range m.accounts {
+		if m.accounts[i].client == client {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		logger.Warn("Account problem reported for unknown acme client", zap.Error(problem))
+		return false
+	}
+
+	acc := &m.accounts[index]
+	acc.enabled = false
+	acc.problem = problem
+	var accountURI string
+	if acc.account != nil {
+		accountURI = acc.account.URI
+	}
+	logger = logger.With(zap.String("account", accountURI), zap.NamedError("problem", problem))
+
+	if _, ok := m.nextEnabledClientIndex(); ok {
+		logger.Error("Acme account can't be used, continue with other account")
+		return true
+	}
+
+	now := time.Now()
+	switch {
+	case m.AccountProblemMode != AccountProblemRegister:
+		m.halted = problem
+		logger.Error("ACME ACCOUNT CAN'T BE USED, ISSUE OF CERTIFICATES HALTED. Check account at acme server " +
+			"or remove account state from storage (and restart) for register new account")
+	case !m.autoRegisterTime.IsZero() && now.Sub(m.autoRegisterTime) < accountReregisterInterval:
+		m.halted = problem
+		logger.Error("ACME ACCOUNT CAN'T BE USED, ISSUE OF CERTIFICATES HALTED: new account registered automatically "+
+			"short time ago, new registration blocked for prevent loop of registrations",
+			zap.Time("last_auto_register", m.autoRegisterTime), zap.Duration("interval", accountReregisterInterval))
+	default:
+		m.autoRegisterTime = now
+		logger.Error("Acme account can't be used, register new account")
+		return true
+	}
+	return false
+}
+
+// AccountsStatus return status of acme accounts
+func (m *AcmeManager) AccountsStatus() []AccountStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make([]AccountStatus, 0, len(m.accounts))
+	for _, acc := range m.accounts {
+		var status AccountStatus
+		if acc.account != nil {
+			status.URI = acc.account.URI
+		}
+		switch {
+		case acc.problem != nil:
+			status.Status = AccountStatusProblem
+			status.Problem = acc.problem.Error()
+		case acc.enabled:
+			status.Status = AccountStatusValid
+		default:
+			status.Status = AccountStatusDisabled
+		}
+		res = append(res, status)
+	}
+	return res
+}
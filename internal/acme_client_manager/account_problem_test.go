@@ -0,0 +1,108 @@
+//nolint:golint
+package acme_client_manager
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestIsAccountError(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	td.True(IsAccountError(acme.ErrNoAccount))
+	td.True(IsAccountError(xerrors.Errorf("order: %w", &acme.Error{ProblemType: accountDoesNotExistProblemType})))
+	td.True(IsAccountError(&acme.Error{StatusCode: http.StatusForbidden, ProblemType: unauthorizedProblemType,
+		Detail: `Unable to validate JWS :: Account is not valid, has status "deactivated"`}))
+	td.True(IsAccountError(&acme.Error{ProblemType: unauthorizedProblemType, Detail: "Account key revoked"}))
+
+	td.False(IsAccountError(nil))
+	td.False(IsAccountError(xerrors.New("test")))
+	td.False(IsAccountError(&acme.Error{ProblemType: unauthorizedProblemType, Detail: "Invalid response from http://example.com"}))
+	td.False(IsAccountError(&acme.Error{ProblemType: "urn:ietf:params:acme:error:rateLimited", Detail: "account"}))
+}
+
+func TestAcmeManager_ReportAccountProblem(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024) //nolint:gosec
+	e.CmpNoError(err)
+	newManager := func(mode string, clients ...*acme.Client) *AcmeManager {
+		m := New(ctx, cache.NewMemoryCache("test"))
+		m.AccountProblemMode = mode
+		m.stateLoaded = true
+		for i, client := range clients {
+			client.Key = key
+			m.accounts = append(m.accounts, clientAccount{client: client, enabled: true,
+				account: &acme.Account{URI: "http://account/" + string(rune('a'+i))}})
+		}
+		return m
+	}
+	problem := &acme.Error{ProblemType: accountDoesNotExistProblemType}
+
+	// other account used
+	first, second := &acme.Client{}, &acme.Client{}
+	m := newManager(AccountProblemHalt, first, second)
+	e.True(m.ReportAccountProblem(ctx, first, problem))
+	client, _, err := m.GetClient(ctx)
+	e.CmpNoError(err)
+	e.Cmp(client, testdeep.Shallow(second))
+	e.Cmp(m.AccountsStatus(), []AccountStatus{
+		{URI: "http://account/a", Status: AccountStatusProblem, Problem: problem.Error()},
+		{URI: "http://account/b", Status: AccountStatusValid},
+	})
+	m.accountEnableSelfSync(0)
+	e.False(m.accounts[0].enabled)
+
+	// unknown client
+	e.False(m.ReportAccountProblem(ctx, &acme.Client{}, problem))
+
+	// halt
+	e.False(m.ReportAccountProblem(ctx, second, problem))
+	_, _, err = m.GetClient(ctx)
+	e.CmpError(err)
+	e.True(xerrors.Is(err, problem))
+	e.Len(m.accounts, 2)
+
+	// register new account once per interval
+	first = &acme.Client{}
+	m = newManager(AccountProblemRegister, first)
+	e.True(m.ReportAccountProblem(ctx, first, problem))
+	e.Cmp(m.autoRegisterTime, testdeep.Between(time.Now().Add(-time.Minute), time.Now()))
+	e.Nil(m.halted)
+
+	m.accounts = append(m.accounts, clientAccount{client: &acme.Client{Key: key}, account: &acme.Account{URI: "http://account/new"}, enabled: true})
+	e.CmpNoError(m.saveState(ctx))
+	data, err := m.cache.Get(ctx, stateName(m.DirectoryURL))
+	e.CmpNoError(err)
+	var state acmeManagerState
+	_, err = state.Load(data)
+	e.CmpNoError(err)
+	e.Len(state.Accounts, 1)
+	e.Cmp(state.Accounts[0].AcmeAccount.URI, "http://account/new")
+	e.Cmp(state.AutoRegisterTime.Unix(), m.autoRegisterTime.Unix())
+
+	e.False(m.ReportAccountProblem(ctx, m.accounts[1].client, problem))
+	_, _, err = m.GetClient(ctx)
+	e.CmpError(err)
+
+	// guard restored from state
+	loaded := New(ctx, m.cache)
+	e.CmpNoError(loaded.loadFromCache(ctx))
+	e.Cmp(loaded.autoRegisterTime.Unix(), m.autoRegisterTime.Unix())
+	loaded.AccountProblemMode = AccountProblemRegister
+	loaded.stateLoaded = true
+	e.False(loaded.ReportAccountProblem(ctx, loaded.accounts[0].client, problem))
+	_ = loaded.Close()
+	_ = m.Close()
+}
@@ -9,7 +9,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,6 +32,9 @@ import (
 const rsaKeyLength = 2048
 const renewAccountInterval = time.Hour * 24
 const disableDuration = time.Hour
+const defaultRetryCount = 10
+const maxRetryDelay = 10 * time.Second
+const dialKeepAlive = 30 * time.Second
 
 var errClosed = xerrors.Errorf("acmeManager already closed")
 
@@ -38,11 +45,39 @@ type AcmeManager struct {
 	AgreeFunction        func(tosurl string) bool
 	RenewAccountInterval time.Duration
 
+	// AccountEmail use as contact of acme accounts. Empty - register accounts without contact.
+	AccountEmail string
+
+	// RetryCount is max count of retries for every acme request, failed by badNonce, 5xx or rate limit error.
+	// Fresh nonce fetched before retry after badNonce.
+	RetryCount int
+
+	// HTTPClient for requests to acme server, for example with outbound proxy.
+	HTTPClient *http.Client
+
+	// UserAgent prepended to User-Agent header of acme requests (acme library add own name and go version).
+	UserAgent string
+
+	// Headers added to every acme request, for example for auth gateway of internal CA.
+	Headers http.Header
+
+	// Timeouts of requests to acme server, 0 - timeout of HTTPClient.
+	// Dial, TLS handshake and response header timeouts applied if HTTPClient use *http.Transport.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	RequestTimeout        time.Duration
+
+	// AccountProblemMode - AccountProblemHalt or AccountProblemRegister, action when acme server reject account
+	// (see IsAccountError). Empty - AccountProblemHalt.
+	AccountProblemMode string
+
+	retryBaseDelay time.Duration
+
 	ctx                   context.Context
 	ctxCancel             context.CancelFunc
 	ctxAutorenewCompleted context.Context
 	cache                 cache.Bytes
-	httpClient            *http.Client
 
 	background       sync.WaitGroup
 	mu               sync.Mutex
@@ -50,12 +85,16 @@ type AcmeManager struct {
 	accounts         []clientAccount
 	stateLoaded      bool
 	closed           bool
+
+	halted           error     // problem of account, which halted issue of certificates
+	autoRegisterTime time.Time // last automatic registration of account after account problem
 }
 
 type clientAccount struct {
 	client  *acme.Client
 	account *acme.Account
 	enabled bool
+	problem error // account can't be used, never enabled again
 }
 
 func New(ctx context.Context, cache cache.Bytes) *AcmeManager {
@@ -66,7 +105,9 @@ func New(ctx context.Context, cache cache.Bytes) *AcmeManager {
 		cache:                cache,
 		AgreeFunction:        acme.AcceptTOS,
 		RenewAccountInterval: renewAccountInterval,
-		httpClient:           http.DefaultClient,
+		RetryCount:           defaultRetryCount,
+		retryBaseDelay:       time.Second,
+		HTTPClient:           http.DefaultClient,
 		lastAccountIndex:     -1,
 	}
 }
@@ -124,12 +165,23 @@ func (m *AcmeManager) GetClient(ctx context.Context) (_ *acme.Client, disableFun
 			return nil, nil, err
 		}
 		m.stateLoaded = true
+
+		if err == nil {
+			if err = m.updateAccountsContact(ctx); err != nil {
+				return nil, nil, err
+			}
+		}
 	}
 
 	if index, ok := m.nextEnabledClientIndex(); ok {
 		return m.accounts[index].client, createDisableFunc(index), nil
 	}
 
+	if m.halted != nil {
+		zc.L(ctx).Error("ACME ACCOUNT CAN'T BE USED, ISSUE OF CERTIFICATES HALTED", zap.NamedError("problem", m.halted))
+		return nil, nil, xerrors.Errorf("issue of certificates halted by problem of acme account: %w", m.halted)
+	}
+
 	acc, err := m.registerAccount(ctx)
 	m.accounts = append(m.accounts, acc)
 
@@ -206,11 +258,106 @@ func (m *AcmeManager) accountEnableSelfSync(index int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.accounts[index].enabled = true
+	if m.accounts[index].problem == nil {
+		m.accounts[index].enabled = true
+	}
 }
 
 func (m *AcmeManager) initClient() *acme.Client {
-	return &acme.Client{DirectoryURL: m.DirectoryURL, HTTPClient: m.httpClient}
+	httpClient := m.httpClientWithTimeouts()
+	if len(m.Headers) > 0 {
+		if httpClient == nil {
+			httpClient = http.DefaultClient
+		}
+		clientCopy := *httpClient
+		clientCopy.Transport = headersTransport{next: httpClient.Transport, headers: m.Headers}
+		httpClient = &clientCopy
+	}
+	return &acme.Client{DirectoryURL: m.DirectoryURL, HTTPClient: httpClient, UserAgent: m.UserAgent, RetryBackoff: m.retryBackoff}
+}
+
+// httpClientWithTimeouts return copy of HTTPClient with configured timeouts
+func (m *AcmeManager) httpClientWithTimeouts() *http.Client {
+	httpClient := m.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	if m.DialTimeout == 0 && m.TLSHandshakeTimeout == 0 && m.ResponseHeaderTimeout == 0 && m.RequestTimeout == 0 {
+		return m.HTTPClient
+	}
+
+	clientCopy := *httpClient
+	if m.RequestTimeout > 0 {
+		clientCopy.Timeout = m.RequestTimeout
+	}
+
+	transport, ok := clientCopy.Transport.(*http.Transport)
+	if clientCopy.Transport == nil {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if !ok {
+		return &clientCopy
+	}
+	transport = transport.Clone()
+	if m.DialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: m.DialTimeout, KeepAlive: dialKeepAlive}).DialContext
+	}
+	if m.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = m.TLSHandshakeTimeout
+	}
+	if m.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = m.ResponseHeaderTimeout
+	}
+	clientCopy.Transport = transport
+	return &clientCopy
+}
+
+// headersTransport add headers to requests
+type headersTransport struct {
+	next    http.RoundTripper
+	headers http.Header
+}
+
+func (t headersTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	// RoundTripper must not modify request
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		req.Header[name] = values
+	}
+	return next.RoundTrip(req)
+}
+
+// retryBackoff limit retries count for acme client.
+// acme client retry requests with badNonce error (with fresh nonce), 5xx and 429 statuses.
+func (m *AcmeManager) retryBackoff(n int, r *http.Request, resp *http.Response) time.Duration {
+	if n > m.RetryCount {
+		zc.L(m.ctx).Warn("Acme request failed, retries limit exceeded", zap.Int("retries", n-1),
+			zap.String("url", r.URL.String()))
+		return -1
+	}
+
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	const maxShift = 30
+	if n > maxShift {
+		n = maxShift
+	}
+	delay := m.retryBaseDelay << uint(n-1) //nolint:gosec
+	if delay > maxRetryDelay || delay <= 0 {
+		delay = maxRetryDelay
+	}
+	zc.L(m.ctx).Debug("Retry acme request", zap.Int("retry", n), zap.String("url", r.URL.String()),
+		zap.Int("status_code", resp.StatusCode), zap.Duration("delay", delay))
+	return delay
 }
 
 func (m *AcmeManager) loadFromCache(ctx context.Context) (err error) {
@@ -238,6 +385,7 @@ func (m *AcmeManager) loadFromCache(ctx context.Context) (err error) {
 	if len(state.Accounts) == 0 {
 		return xerrors.Errorf("no accounts in state")
 	}
+	m.autoRegisterTime = state.AutoRegisterTime
 
 	m.accounts = make([]clientAccount, 0, len(state.Accounts))
 	for index, stateAccount := range state.Accounts {
@@ -295,7 +443,7 @@ func (m *AcmeManager) registerAccount(ctx context.Context) (clientAccount, error
 	// create account
 	client := m.initClient()
 
-	account, err := createAcmeAccount(ctx, client, m.AgreeFunction)
+	account, err := createAcmeAccount(ctx, client, m.contact(), m.AgreeFunction)
 	log.InfoErrorCtx(ctx, err, "Create acme account")
 	if err != nil {
 		return clientAccount{}, err
@@ -313,8 +461,13 @@ func (m *AcmeManager) registerAccount(ctx context.Context) (clientAccount, error
 func (m *AcmeManager) saveState(ctx context.Context) error {
 	var state acmeManagerState
 	state.Accounts = make([]acmeAccountState, 0, len(m.accounts))
+	state.AutoRegisterTime = m.autoRegisterTime
 
 	for _, acc := range m.accounts {
+		// accounts with problems removed from state: new account registered instead
+		if acc.problem != nil {
+			continue
+		}
 		state.Accounts = append(state.Accounts, acmeAccountState{PrivateKey: acc.client.Key.(*rsa.PrivateKey), AcmeAccount: acc.account})
 	}
 
@@ -331,16 +484,94 @@ func (m *AcmeManager) saveState(ctx context.Context) error {
 	return nil
 }
 
+func (m *AcmeManager) contact() []string {
+	if m.AccountEmail == "" {
+		return nil
+	}
+	return []string{"mailto:" + m.AccountEmail}
+}
+
+// updateAccountsContact update contact of loaded accounts if it differ from configured.
+// Caller must hold m.mu.
+func (m *AcmeManager) updateAccountsContact(ctx context.Context) error {
+	updated, err := updateContact(ctx, m.accounts, m.contact())
+	if updated {
+		if saveErr := m.saveState(ctx); err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// updateContact update contact of accounts on acme server if it differ from contact.
+// It doesn't use m.mu: accounts must not be shared with other goroutines or caller must hold the lock.
+func updateContact(ctx context.Context, accounts []clientAccount, contact []string) (updated bool, _ error) {
+	for index := range accounts {
+		acc := accounts[index]
+		if acc.account == nil || len(acc.account.Contact) == 0 && len(contact) == 0 ||
+			reflect.DeepEqual(acc.account.Contact, contact) {
+			continue
+		}
+
+		newAccount := *acc.account
+		newAccount.Contact = contact
+		account, err := acc.client.UpdateReg(ctx, &newAccount)
+		log.InfoErrorCtx(ctx, err, "Update acme account contact", zap.Strings("contact", contact),
+			zap.String("account", acc.account.URI))
+		if err != nil {
+			return updated, xerrors.Errorf("update contact of acme account %q: %w", acc.account.URI, explainAcmeError(err))
+		}
+		accounts[index].account = account
+		updated = true
+	}
+	return updated, nil
+}
+
 // createAcmeAccount create account on acme server and store private key in client.Key
-func createAcmeAccount(ctx context.Context, client *acme.Client, agreeFunction func(tosurl string) bool) (*acme.Account, error) {
+func createAcmeAccount(ctx context.Context, client *acme.Client, contact []string, agreeFunction func(tosurl string) bool) (*acme.Account, error) {
 	key, err := rsa.GenerateKey(rand.Reader, rsaKeyLength)
 	log.InfoDPanicCtx(ctx, err, "Generate account key")
 
+	var declinedTOS string
+	prompt := func(tosURL string) bool {
+		if agreeFunction(tosURL) {
+			return true
+		}
+		declinedTOS = tosURL
+		return false
+	}
+
 	client.Key = key
-	account := &acme.Account{}
-	account, err = client.Register(ctx, account, agreeFunction)
-	log.InfoErrorCtx(ctx, err, "Register acme account")
-	return account, err
+	account := &acme.Account{Contact: contact}
+	account, err = client.Register(ctx, account, prompt)
+	log.InfoErrorCtx(ctx, err, "Register acme account", zap.Strings("contact", contact))
+	if err != nil && declinedTOS != "" {
+		return nil, xerrors.Errorf("acme server require accept terms of service %q, "+
+			"read it and set General.AcmeAcceptTOS = true in config: %w", declinedTOS, err)
+	}
+	if err != nil {
+		return nil, explainAcmeError(err)
+	}
+	return account, nil
+}
+
+// explainAcmeError add actionable description to acme errors about account contact
+func explainAcmeError(err error) error {
+	var acmeErr *acme.Error
+	if !xerrors.As(err, &acmeErr) {
+		return err
+	}
+
+	switch {
+	case strings.HasSuffix(acmeErr.ProblemType, ":invalidContact"),
+		strings.HasSuffix(acmeErr.ProblemType, ":unsupportedContact"):
+		return xerrors.Errorf("acme server reject account contact, check General.AcmeAccountEmail in config: %w", err)
+	case strings.HasSuffix(acmeErr.ProblemType, ":userActionRequired"):
+		return xerrors.Errorf("acme server require user action (for example accept new terms of service) "+
+			"see %q: %w", acmeErr.Detail, err)
+	default:
+		return err
+	}
 }
 
 func stateName(s string) string {
@@ -6,10 +6,15 @@ import (
 	"crypto/rsa"
 	"encoding/json"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/maxatome/go-testdeep"
 	zc "github.com/rekby/zapcontext"
 	"go.uber.org/zap"
+	"golang.org/x/xerrors"
 
 	"golang.org/x/crypto/acme"
 
@@ -33,7 +38,7 @@ func TestClientManagerCreateNew(t *testing.T) {
 
 	//register account
 	manager := New(ctx, c)
-	manager.httpClient = th.GetHttpClient()
+	manager.HTTPClient = th.GetHttpClient()
 	manager.DirectoryURL = th.Pebble(e).HTTPSDirectoryURL
 
 	c.PutMock.Return(nil)
@@ -229,3 +234,166 @@ func TestClientManagerStateMigration(t *testing.T) {
 		e.Cmp(state.Accounts[0].AcmeAccount.URI, "https://acme-v02.api.letsencrypt.org/acme/acct/485823100")
 	})
 }
+
+func TestExplainAcmeError(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	err := xerrors.New("test")
+	td.True(explainAcmeError(err) == err)
+
+	err = &acme.Error{ProblemType: "urn:ietf:params:acme:error:malformed"}
+	td.True(explainAcmeError(err) == err)
+
+	err = &acme.Error{ProblemType: "urn:ietf:params:acme:error:invalidContact"}
+	td.True(xerrors.Is(explainAcmeError(err), err))
+	td.Contains(explainAcmeError(err).Error(), "AcmeAccountEmail")
+
+	err = &acme.Error{ProblemType: "urn:ietf:params:acme:error:userActionRequired", Detail: "accept new tos"}
+	td.Contains(explainAcmeError(err).Error(), "accept new tos")
+}
+
+func TestAcmeManagerContact(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := &AcmeManager{}
+	td.Nil(m.contact())
+
+	m.AccountEmail = "admin@example.com"
+	td.CmpDeeply(m.contact(), []string{"mailto:admin@example.com"})
+}
+
+func TestAcmeManagerRetryBadNonce(t *testing.T) {
+	const accountURL = "https://acme.example/acct/1"
+
+	newManager := func(ctx context.Context, server *httptest.Server, retryCount int) *AcmeManager {
+		m := New(ctx, nil)
+		t.Cleanup(func() { _ = m.Close() })
+		m.DirectoryURL = server.URL + "/directory"
+		m.RetryCount = retryCount
+		m.retryBaseDelay = time.Millisecond
+		return m
+	}
+
+	t.Run("RecoverAfterBadNonce", func(t *testing.T) {
+		ctx, flush := th.TestContext(t)
+		defer flush()
+		td := testdeep.NewT(t)
+
+		m := newManager(ctx, newFakeAcmeServer(t, accountURL, 1), 3)
+		acc, err := m.registerAccount(ctx)
+		td.CmpNoError(err)
+		if err != nil {
+			return
+		}
+		td.Cmp(acc.account.URI, accountURL)
+	})
+
+	t.Run("RetryLimit", func(t *testing.T) {
+		ctx, flush := th.TestContext(t)
+		defer flush()
+		td := testdeep.NewT(t)
+
+		m := newManager(ctx, newFakeAcmeServer(t, accountURL, 3), 2)
+		_, err := m.registerAccount(ctx)
+		var acmeErr *acme.Error
+		td.True(xerrors.As(err, &acmeErr))
+		td.Cmp(acmeErr.ProblemType, "urn:ietf:params:acme:error:badNonce")
+	})
+}
+
+func TestAcmeManagerRetryBackoff(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+	td := testdeep.NewT(t)
+
+	m := New(ctx, nil)
+	defer func() { _ = m.Close() }()
+	m.RetryCount = 5
+
+	req := httptest.NewRequest(http.MethodPost, "https://acme.example/order", nil)
+	resp := &http.Response{StatusCode: http.StatusInternalServerError, Header: http.Header{}}
+
+	td.Cmp(m.retryBackoff(1, req, resp), time.Second)
+	td.Cmp(m.retryBackoff(2, req, resp), 2*time.Second)
+	td.Cmp(m.retryBackoff(5, req, resp), maxRetryDelay)
+	td.Lt(m.retryBackoff(6, req, resp), time.Duration(0))
+
+	resp.Header.Set("Retry-After", "3")
+	td.Cmp(m.retryBackoff(1, req, resp), 3*time.Second)
+}
+
+func TestAcmeManagerUserAgentAndHeaders(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	var gotHeader http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"newNonce": "http://acme.example/nonce", "newOrder": "http://acme.example/order"}`))
+	}))
+	defer server.Close()
+
+	m := New(ctx, nil)
+	defer func() { _ = m.Close() }()
+	m.DirectoryURL = server.URL
+	m.UserAgent = "lets-proxy2/test"
+	m.Headers = http.Header{"Authorization": []string{"Bearer 123"}}
+
+	_, err := m.initClient().Discover(ctx)
+	td.CmpNoError(err)
+	td.Cmp(gotHeader.Get("Authorization"), "Bearer 123")
+	td.HasPrefix(gotHeader.Get("User-Agent"), "lets-proxy2/test ")
+	td.True(m.HTTPClient == http.DefaultClient)
+	td.Nil(http.DefaultClient.Transport)
+
+	m.Headers = nil
+	_, err = m.initClient().Discover(ctx)
+	td.CmpNoError(err)
+	td.Cmp(gotHeader.Get("Authorization"), "")
+}
+
+func TestAcmeManagerTimeouts(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	m := New(ctx, nil)
+	defer func() { _ = m.Close() }()
+
+	td.True(m.httpClientWithTimeouts() == http.DefaultClient)
+
+	m.DialTimeout = time.Second
+	m.TLSHandshakeTimeout = 2 * time.Second
+	m.ResponseHeaderTimeout = 3 * time.Second
+	m.RequestTimeout = 4 * time.Second
+
+	client := m.httpClientWithTimeouts()
+	td.Cmp(client.Timeout, 4*time.Second)
+	transport := client.Transport.(*http.Transport)
+	td.NotNil(transport.DialContext)
+	td.Cmp(transport.TLSHandshakeTimeout, 2*time.Second)
+	td.Cmp(transport.ResponseHeaderTimeout, 3*time.Second)
+	td.Nil(http.DefaultClient.Transport)
+	td.Cmp(http.DefaultTransport.(*http.Transport).ResponseHeaderTimeout, time.Duration(0))
+
+	gotHeader := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader <- r.Header.Clone()
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	m.HTTPClient = server.Client()
+	m.ResponseHeaderTimeout = 10 * time.Millisecond
+	m.Headers = http.Header{"Authorization": []string{"Bearer 123"}}
+	_, err := m.initClient().HTTPClient.Get(server.URL)
+	td.CmpError(err)
+	var netErr interface{ Timeout() bool }
+	td.True(xerrors.As(err, &netErr) && netErr.Timeout())
+	td.Cmp((<-gotHeader).Get("Authorization"), "Bearer 123")
+	td.Cmp(server.Client().Transport.(*http.Transport).ResponseHeaderTimeout, time.Duration(0))
+}
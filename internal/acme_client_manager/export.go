@@ -0,0 +1,240 @@
+package acme_client_manager
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const exportFormatVersion = 1
+
+// ErrAccountsStored returned by Import if accounts state already stored: accounts imported before
+// or registered by the manager, import would replace them.
+var ErrAccountsStored = xerrors.New("acme accounts already stored")
+
+// AccountsExport is portable backup of acme accounts
+type AccountsExport struct {
+	Version      int
+	DirectoryURL string
+	Accounts     []AccountExport
+}
+
+type AccountExport struct {
+	AccountURL string
+	PrivateKey rsaPrivateJWK
+}
+
+// rsaPrivateJWK is private rsa key in JWK format (RFC 7517, RFC 7518 section 6.3)
+type rsaPrivateJWK struct {
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	D   string `json:"d"`
+	P   string `json:"p"`
+	Q   string `json:"q"`
+	Dp  string `json:"dp,omitempty"`
+	Dq  string `json:"dq,omitempty"`
+	Qi  string `json:"qi,omitempty"`
+}
+
+func newRSAPrivateJWK(key *rsa.PrivateKey) (rsaPrivateJWK, error) {
+	if len(key.Primes) != 2 {
+		return rsaPrivateJWK{}, xerrors.Errorf("export rsa key with %v primes unsupported", len(key.Primes))
+	}
+	key.Precompute()
+	return rsaPrivateJWK{
+		Kty: "RSA",
+		N:   encodeJWKInt(key.N),
+		E:   encodeJWKInt(big.NewInt(int64(key.E))),
+		D:   encodeJWKInt(key.D),
+		P:   encodeJWKInt(key.Primes[0]),
+		Q:   encodeJWKInt(key.Primes[1]),
+		Dp:  encodeJWKInt(key.Precomputed.Dp),
+		Dq:  encodeJWKInt(key.Precomputed.Dq),
+		Qi:  encodeJWKInt(key.Precomputed.Qinv),
+	}, nil
+}
+
+func (jwk rsaPrivateJWK) PrivateKey() (*rsa.PrivateKey, error) {
+	if jwk.Kty != "RSA" {
+		return nil, xerrors.Errorf("unsupported key type: %q", jwk.Kty)
+	}
+
+	var ints [5]*big.Int
+	for i, s := range []string{jwk.N, jwk.E, jwk.D, jwk.P, jwk.Q} {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, xerrors.Errorf("bad jwk field value %q: %w", s, err)
+		}
+		ints[i] = new(big.Int).SetBytes(b)
+	}
+	if !ints[1].IsInt64() {
+		return nil, xerrors.New("too big public exponent")
+	}
+
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: ints[0], E: int(ints[1].Int64())},
+		D:         ints[2],
+		Primes:    []*big.Int{ints[3], ints[4]},
+	}
+	if err := key.Validate(); err != nil {
+		return nil, xerrors.Errorf("validate private key: %w", err)
+	}
+	key.Precompute()
+	return key, nil
+}
+
+func encodeJWKInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// Export return backup of current acme accounts
+func (m *AcmeManager) Export() (AccountsExport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := AccountsExport{Version: exportFormatVersion, DirectoryURL: m.DirectoryURL}
+	for _, acc := range m.accounts {
+		if acc.account == nil || acc.account.URI == "" {
+			continue
+		}
+		key, ok := acc.client.Key.(*rsa.PrivateKey)
+		if !ok {
+			return AccountsExport{}, xerrors.Errorf("unexpected account key type: %T", acc.client.Key)
+		}
+		jwk, err := newRSAPrivateJWK(key)
+		if err != nil {
+			return AccountsExport{}, err
+		}
+		res.Accounts = append(res.Accounts, AccountExport{AccountURL: acc.account.URI, PrivateKey: jwk})
+	}
+
+	if len(res.Accounts) == 0 {
+		return AccountsExport{}, xerrors.New("no registered acme accounts")
+	}
+	return res, nil
+}
+
+// ExportHandler serve accounts backup as json.
+// It contains private keys - handler must be protected by authentication.
+func (m *AcmeManager) ExportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		logger := zc.L(m.ctx).With(zap.String("remote_address", r.RemoteAddr))
+		export, err := m.Export()
+		log.InfoError(logger, err, "Export acme accounts")
+		if err != nil {
+			http.Error(w, "Can't export acme accounts", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(export)
+		log.DebugError(logger, err, "Write acme accounts export")
+	})
+}
+
+// Import restore accounts from backup, created by Export, if accounts state doesn't stored yet
+// (else return ErrAccountsStored).
+// Every account checked by query to acme server: key must correspond to account url. If acme server
+// is unreachable - account imported without check, the error logged. Error answer of acme server fails import.
+// It must be called before first GetClient.
+func (m *AcmeManager) Import(ctx context.Context, data []byte) error {
+	var export AccountsExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return xerrors.Errorf("unmarshal acme accounts export: %w", err)
+	}
+	if export.Version != exportFormatVersion {
+		return xerrors.Errorf("unsupported acme accounts export version: %v", export.Version)
+	}
+	if export.DirectoryURL != "" && export.DirectoryURL != m.DirectoryURL {
+		return xerrors.Errorf("acme accounts exported for other acme server %q, current: %q", export.DirectoryURL, m.DirectoryURL)
+	}
+	if len(export.Accounts) == 0 {
+		return xerrors.New("no accounts in acme accounts export")
+	}
+
+	if m.cache != nil && !m.IgnoreCacheLoad {
+		_, err := m.cache.Get(ctx, stateName(m.DirectoryURL))
+		switch {
+		case err == nil:
+			return ErrAccountsStored
+		case err != cache.ErrCacheMiss:
+			return xerrors.Errorf("check stored acme accounts: %w", err)
+		}
+	}
+
+	accounts := make([]clientAccount, 0, len(export.Accounts))
+	for _, exportAccount := range export.Accounts {
+		key, err := exportAccount.PrivateKey.PrivateKey()
+		if err != nil {
+			return xerrors.Errorf("parse private key of acme account %q: %w", exportAccount.AccountURL, err)
+		}
+
+		client := m.initClient()
+		client.Key = key
+		account, err := client.GetReg(ctx, "")
+		log.InfoErrorCtx(ctx, err, "Verify imported acme account", zap.String("account", exportAccount.AccountURL))
+		var acmeErr *acme.Error
+		if xerrors.Is(err, acme.ErrNoAccount) || xerrors.As(err, &acmeErr) {
+			// acme server answered: key doesn't correspond to the account
+			return xerrors.Errorf("verify acme account %q: %w", exportAccount.AccountURL, explainAcmeError(err))
+		}
+		if err != nil {
+			// acme server can be unavailable while start, account checked by first use
+			zc.L(ctx).Error("Import acme account without verify", zap.String("account", exportAccount.AccountURL),
+				zap.Error(err))
+			account = &acme.Account{URI: exportAccount.AccountURL}
+		}
+		if account.URI != exportAccount.AccountURL {
+			return xerrors.Errorf("private key belong to acme account %q instead of %q", account.URI, exportAccount.AccountURL)
+		}
+		accounts = append(accounts, clientAccount{client: client, account: account, enabled: true})
+	}
+
+	// update contact before publish accounts: network requests must not hold m.mu
+	if _, err := updateContact(ctx, accounts, m.contact()); err != nil {
+		// contact updated after load of stored accounts on next start
+		log.InfoErrorCtx(ctx, err, "Update contact of imported acme accounts")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return xerrors.Errorf("import: %w", errClosed)
+	}
+	if m.stateLoaded || len(m.accounts) != 0 {
+		return xerrors.New("acme accounts import must be before use of acme manager")
+	}
+
+	m.accounts = accounts
+	m.stateLoaded = true
+	for index := range m.accounts {
+		m.background.Add(1)
+		// handlepanic inside accountRenewSelfSync
+		go func(index int) {
+			defer m.background.Done()
+			m.accountRenewSelfSync(index)
+		}(index)
+	}
+	return m.saveState(ctx)
+}
@@ -0,0 +1,260 @@
+package acme_client_manager
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+	"golang.org/x/crypto/acme"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+// newFakeAcmeServer return acme server, which answer for account requests with accountURL.
+// First badNonceCount account requests fail with badNonce error.
+func newFakeAcmeServer(t *testing.T, accountURL string, badNonceCount int) *httptest.Server {
+	var requests int64
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   server.URL + "/nonce",
+			"newAccount": server.URL + "/account",
+			"newOrder":   server.URL + "/order",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		if atomic.AddInt64(&requests, 1) <= int64(badNonceCount) {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"type":"urn:ietf:params:acme:error:badNonce","detail":"bad nonce"}`))
+			return
+		}
+		var jws struct{ Payload string }
+		_ = json.NewDecoder(r.Body).Decode(&jws)
+		payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+		w.Header().Set("Location", accountURL)
+		if !strings.Contains(string(payload), "onlyReturnExisting") {
+			w.WriteHeader(http.StatusCreated)
+		}
+		_, _ = w.Write([]byte(`{"status":"valid"}`))
+	})
+	return server
+}
+
+// newRejectAcmeServer answer by problem to every account request
+func newRejectAcmeServer(t *testing.T, problem string) *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   server.URL + "/nonce",
+			"newAccount": server.URL + "/account",
+			"newOrder":   server.URL + "/order",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"type":"urn:ietf:params:acme:error:` + problem + `"}`))
+	})
+	return server
+}
+
+func TestRSAPrivateJWK(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, rsaKeyLength)
+	td.CmpNoError(err)
+
+	jwk, err := newRSAPrivateJWK(key)
+	td.CmpNoError(err)
+	td.Cmp(jwk.Kty, "RSA")
+	td.Cmp(jwk.E, "AQAB")
+
+	parsedKey, err := jwk.PrivateKey()
+	td.CmpNoError(err)
+	td.True(parsedKey.Equal(key))
+
+	jwk.Kty = "EC"
+	_, err = jwk.PrivateKey()
+	td.CmpError(err)
+
+	jwk.Kty = "RSA"
+	jwk.D = "bad base64!"
+	_, err = jwk.PrivateKey()
+	td.CmpError(err)
+}
+
+func TestAcmeManagerExportImport(t *testing.T) {
+	const accountURL = "https://acme.example/acct/1"
+
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	mc := minimock.NewController(e)
+	defer mc.Finish()
+
+	server := newFakeAcmeServer(t, accountURL, 0)
+
+	key, _ := rsa.GenerateKey(rand.Reader, rsaKeyLength)
+	source := New(ctx, nil)
+	defer func() { _ = source.Close() }()
+	source.DirectoryURL = server.URL + "/directory"
+	source.accounts = []clientAccount{{
+		client:  &acme.Client{Key: key},
+		account: &acme.Account{URI: accountURL},
+		enabled: true,
+	}}
+
+	handler := source.ExportHandler()
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/acme/account/export", nil))
+	e.Cmp(resp.Code, http.StatusMethodNotAllowed)
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/acme/account/export", nil))
+	e.Cmp(resp.Code, http.StatusOK)
+	e.Cmp(resp.Header().Get("Content-Type"), "application/json")
+	exported := resp.Body.Bytes()
+
+	t.Run("Ok", func(t *testing.T) {
+		td := testdeep.NewT(t).FailureIsFatal()
+		c := NewBytesMock(mc)
+		c.GetMock.Return(nil, cache.ErrCacheMiss)
+		c.PutMock.Return(nil)
+
+		target := New(ctx, c)
+		defer func() { _ = target.Close() }()
+		target.HTTPClient = server.Client()
+		target.DirectoryURL = source.DirectoryURL
+
+		td.CmpNoError(target.Import(ctx, exported))
+		td.Len(target.accounts, 1)
+		td.Cmp(target.accounts[0].account.URI, accountURL)
+		td.True(target.accounts[0].client.Key.(*rsa.PrivateKey).Equal(key))
+
+		client, _, err := target.GetClient(ctx)
+		td.CmpNoError(err)
+		td.True(client == target.accounts[0].client)
+
+		td.CmpError(target.Import(ctx, exported)) // second import
+	})
+
+	t.Run("Stored", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		c := NewBytesMock(mc)
+		c.GetMock.Return([]byte("{}"), nil)
+
+		target := New(ctx, c)
+		defer func() { _ = target.Close() }()
+		target.DirectoryURL = source.DirectoryURL
+
+		td.Cmp(target.Import(ctx, exported), ErrAccountsStored)
+		td.Len(target.accounts, 0)
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		unavailable := httptest.NewServer(http.NotFoundHandler())
+		unavailable.Close()
+
+		target := New(ctx, nil)
+		defer func() { _ = target.Close() }()
+		target.DirectoryURL = unavailable.URL + "/directory"
+
+		var export AccountsExport
+		td.CmpNoError(json.Unmarshal(exported, &export))
+		export.DirectoryURL = target.DirectoryURL
+		data, _ := json.Marshal(export)
+
+		td.CmpNoError(target.Import(ctx, data))
+		td.Len(target.accounts, 1)
+		td.Cmp(target.accounts[0].account.URI, accountURL)
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		for _, problem := range []string{"accountDoesNotExist", "unauthorized"} {
+			td := testdeep.NewT(t)
+			rejectServer := newRejectAcmeServer(t, problem)
+
+			target := New(ctx, nil)
+			defer func() { _ = target.Close() }()
+			target.DirectoryURL = rejectServer.URL + "/directory"
+
+			var export AccountsExport
+			td.CmpNoError(json.Unmarshal(exported, &export))
+			export.DirectoryURL = target.DirectoryURL
+			data, _ := json.Marshal(export)
+
+			td.CmpError(target.Import(ctx, data), problem)
+			td.Len(target.accounts, 0, problem)
+		}
+	})
+
+	t.Run("OtherAccount", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		otherServer := newFakeAcmeServer(t, "https://acme.example/acct/2", 0)
+
+		target := New(ctx, nil)
+		defer func() { _ = target.Close() }()
+		target.DirectoryURL = source.DirectoryURL
+
+		var export AccountsExport
+		td.CmpNoError(json.Unmarshal(exported, &export))
+		export.DirectoryURL = otherServer.URL + "/directory"
+		target.DirectoryURL = export.DirectoryURL
+		data, _ := json.Marshal(export)
+
+		td.CmpError(target.Import(ctx, data))
+		td.Len(target.accounts, 0)
+	})
+
+	t.Run("OtherDirectory", func(t *testing.T) {
+		td := testdeep.NewT(t)
+		target := New(ctx, nil)
+		defer func() { _ = target.Close() }()
+		target.DirectoryURL = "https://other.example/directory"
+
+		td.CmpError(target.Import(ctx, exported))
+	})
+}
+
+func TestAcmeManagerExportEmpty(t *testing.T) {
+	td := testdeep.NewT(t)
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	m := New(ctx, nil)
+	defer func() { _ = m.Close() }()
+
+	_, err := m.Export()
+	td.CmpError(err)
+
+	resp := httptest.NewRecorder()
+	m.ExportHandler().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/acme/account/export", nil))
+	td.Cmp(resp.Code, http.StatusInternalServerError)
+}
@@ -3,6 +3,7 @@ package acme_client_manager
 import (
 	"crypto/rsa"
 	"encoding/json"
+	"time"
 
 	"golang.org/x/crypto/acme"
 	"golang.org/x/xerrors"
@@ -14,6 +15,9 @@ type acmeManagerState struct {
 	Accounts []acmeAccountState
 	Version  int
 
+	// AutoRegisterTime - last automatic registration of account after account problem, zero if never
+	AutoRegisterTime time.Time
+
 	PrivateKeyDeprecated  *rsa.PrivateKey `json:"PrivateKey,omitempty"`
 	AcmeAccountDeprecated *acme.Account   `json:"AcmeAccount,omitempty"`
 }
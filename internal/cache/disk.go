@@ -72,6 +72,26 @@ func (c *DiskCache) Delete(ctx context.Context, key string) error {
 	return err
 }
 
+// Keys return all stored keys. Keys with sanitized symbols returned in sanitized form.
+func (c *DiskCache) Keys(ctx context.Context) ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entries, err := ioutil.ReadDir(c.Dir)
+	zc.L(ctx).Debug("List disk cache keys", zap.String("dir", c.Dir), zap.Int("count", len(entries)), zap.Error(err))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			res = append(res, entry.Name())
+		}
+	}
+	return res, nil
+}
+
 func diskCacheSanitizeKey(k string) string {
 	const placeholder = "___"
 	k = strings.Replace(k, "/", placeholder, -1)
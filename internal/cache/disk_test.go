@@ -2,6 +2,7 @@ package cache
 
 import (
 	"bytes"
+	"path/filepath"
 	"testing"
 
 	"github.com/rekby/lets-proxy2/internal/th"
@@ -54,3 +55,23 @@ func TestDiskCache(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestDiskCache_Keys(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	c := &DiskCache{Dir: th.TmpDir(e)}
+	keys, err := c.Keys(ctx)
+	e.CmpNoError(err)
+	e.Len(keys, 0)
+
+	e.CmpNoError(c.Put(ctx, "a.rsa.cer", []byte("1")))
+	e.CmpNoError(c.Put(ctx, "b.lock", []byte("2")))
+	keys, err = c.Keys(ctx)
+	e.CmpNoError(err)
+	e.Cmp(keys, []string{"a.rsa.cer", "b.lock"})
+
+	c = &DiskCache{Dir: filepath.Join(th.TmpDir(e), "not-exist")}
+	_, err = c.Keys(ctx)
+	e.CmpError(err)
+}
@@ -22,6 +22,11 @@ type Bytes interface {
 	Delete(ctx context.Context, key string) error
 }
 
+// KeysLister is optional interface of Bytes cache for list all stored keys
+type KeysLister interface {
+	Keys(ctx context.Context) ([]string, error)
+}
+
 type Value interface {
 	// Get returns a certificate data for the specified key.
 	// If there's no such key, Get returns ErrCacheMiss.
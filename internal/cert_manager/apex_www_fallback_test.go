@@ -0,0 +1,190 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+	"golang.org/x/crypto/acme"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+// fakeIssueAcmeServer issue certificates for orders with single domain and reject orders with some domains
+// by failed dns validation.
+type fakeIssueAcmeServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	orders [][]acme.AuthzID
+	certs  map[int][]byte
+	issued [][]string // domains of issued certificates
+}
+
+func newFakeIssueAcmeServer(t *testing.T) *fakeIssueAcmeServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeIssueAcmeServer{certs: make(map[int][]byte)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		index := -1
+		if len(path) == 2 {
+			index, _ = strconv.Atoi(path[1])
+		}
+		switch path[0] {
+		case "directory":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"newNonce":   s.URL + "/nonce",
+				"newAccount": s.URL + "/account",
+				"newOrder":   s.URL + "/order",
+			})
+		case "nonce":
+		case "account":
+			w.Header().Set("Location", s.URL+"/account/1")
+			_, _ = w.Write([]byte(`{"status":"valid"}`))
+		case "order":
+			var order struct{ Identifiers []acme.AuthzID }
+			readJWSPayload(r, &order)
+			if len(order.Identifiers) > 1 {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"type":"urn:ietf:params:acme:error:dns","detail":"validation failed"}`))
+				return
+			}
+			s.mu.Lock()
+			s.orders = append(s.orders, order.Identifiers)
+			index = len(s.orders) - 1
+			s.mu.Unlock()
+			s.writeOrder(w, index, acme.StatusReady, http.StatusCreated)
+		case "finalize":
+			var finalize struct{ CSR string }
+			readJWSPayload(r, &finalize)
+			csrDer, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+			csr, err := x509.ParseCertificateRequest(csrDer)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			template := x509.Certificate{
+				SerialNumber: big.NewInt(int64(index + 1)),
+				DNSNames:     csr.DNSNames,
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, &template, &template, csr.PublicKey, caKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			s.mu.Lock()
+			s.certs[index] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+			s.issued = append(s.issued, csr.DNSNames)
+			s.mu.Unlock()
+			s.writeOrder(w, index, acme.StatusValid, http.StatusOK)
+		case "cert":
+			s.mu.Lock()
+			cert := s.certs[index]
+			s.mu.Unlock()
+			w.Header().Set("Content-Type", "application/pem-certificate-chain")
+			_, _ = w.Write(cert)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeIssueAcmeServer) writeOrder(w http.ResponseWriter, index int, status string, statusCode int) {
+	s.mu.Lock()
+	identifiers := s.orders[index]
+	s.mu.Unlock()
+
+	w.Header().Set("Location", s.URL+"/order-url/"+strconv.Itoa(index))
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      status,
+		"identifiers": identifiers,
+		"finalize":    s.URL + "/finalize/" + strconv.Itoa(index),
+		"certificate": s.URL + "/cert/" + strconv.Itoa(index),
+	})
+}
+
+func (s *fakeIssueAcmeServer) issuedDomains() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.issued...)
+}
+
+func readJWSPayload(r *http.Request, v interface{}) {
+	var jws struct{ Payload string }
+	_ = json.NewDecoder(r.Body).Decode(&jws)
+	data, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	_ = json.Unmarshal(data, v)
+}
+
+func TestManager_AutoIncludeApexAndWwwFallback(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(t)
+	defer mc.Finish()
+
+	server := newFakeIssueAcmeServer(t)
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	td.CmpNoError(err)
+	clientManager := NewAcmeClientManagerMock(mc)
+	clientManager.GetClientMock.Return(&acme.Client{Key: accountKey, DirectoryURL: server.URL + "/directory",
+		HTTPClient: server.Client()}, func() {}, nil)
+
+	m := New(clientManager, cache.NewMemoryCache("test"), nil)
+	m.AutoIncludeApexAndWww = true
+
+	get := func(serverName string) *tls.Certificate {
+		cert, err := m.getCertificate(ctx, domain.DomainName(serverName), KeyECDSA)
+		td.CmpNoError(err, serverName)
+		if cert == nil {
+			t.Fatalf("no certificate for %v", serverName)
+		}
+		td.Cmp(cert.Leaf.DNSNames, []string{serverName}, serverName)
+		return cert
+	}
+
+	// sibling failed validation: every name get own certificate once, names doesn't replace certificates of each other
+	for i := 0; i < 2; i++ {
+		get("test.ru")
+		get("www.test.ru")
+	}
+	td.Cmp(server.issuedDomains(), [][]string{{"test.ru"}, {"www.test.ru"}})
+
+	_, err = m.Cache.Get(ctx, "test.ru.ecdsa.cer")
+	td.CmpNoError(err)
+	_, err = m.Cache.Get(ctx, "www.test.ru.ecdsa.cer")
+	td.CmpNoError(err)
+
+	td.Cmp(needDomainFallbackReserve(time.Minute), 30*time.Second)
+	td.Cmp(needDomainFallbackReserve(10*time.Minute), time.Minute)
+}
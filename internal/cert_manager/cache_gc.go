@@ -0,0 +1,193 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strconv"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// CacheGCResult - report of garbage collection of cached certificates
+type CacheGCResult struct {
+	DryRun     bool     `json:"dry_run"`
+	Removed    []string `json:"removed"` // names of removed certificates (removable for dry run)
+	Count      int      `json:"count"`
+	BytesFreed int64    `json:"bytes_freed"` // size of removed cache entries (removable for dry run)
+}
+
+// CacheGC remove from cache certificates, which expired more than CacheGCRetention ago and weren't served
+// within CacheGCRetention. Served time isn't stored, so certificates without served time since start
+// considered as not served. Certificates of managed domains and locked certificates never removed,
+// certificates in renewal window aren't expired and never removed too. Cache must implement cache.KeysLister.
+// dryRun - report removable certificates without remove.
+func (m *Manager) CacheGC(ctx context.Context, now time.Time, dryRun bool) (CacheGCResult, error) {
+	res := CacheGCResult{DryRun: dryRun, Removed: []string{}}
+	if m.CacheGCRetention <= 0 {
+		return res, xerrors.New("cache garbage collection disabled")
+	}
+	lister, ok := m.Cache.(cache.KeysLister)
+	if !ok {
+		return res, xerrors.New("cache doesn't support list keys")
+	}
+	keys, err := lister.Keys(ctx)
+	if err != nil {
+		return res, xerrors.Errorf("list cache keys: %w", err)
+	}
+
+	logger := zc.L(ctx)
+	border := now.Add(-m.CacheGCRetention)
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+		cd, ok := certDescriptionFromCertStoreName(key)
+		if !ok || m.isManagedCert(cd) || !m.lastServedBefore(cd, border) {
+			continue
+		}
+
+		certBytes, err := m.Cache.Get(ctx, key)
+		if err != nil {
+			logger.Debug("Skip gc of certificate, can't read it", cd.ZapField(), zap.Error(err))
+			continue
+		}
+		expire, err := certExpireFromPEM(certBytes)
+		if err != nil {
+			logger.Warn("Skip gc of certificate, can't parse it", cd.ZapField(), zap.Error(err))
+			continue
+		}
+		if !expire.Before(border) {
+			continue
+		}
+		locked, err := isCertLocked(ctx, m.Cache, cd)
+		if err != nil || locked {
+			logger.Debug("Skip gc of certificate", cd.ZapField(), zap.Bool("locked", locked), zap.Error(err))
+			continue
+		}
+
+		size := m.certEntriesSize(ctx, cd)
+		if !dryRun {
+			err = m.evictCachedCert(ctx, cd)
+			log.InfoError(logger, err, "Remove unused certificate from cache", cd.ZapField(), zap.Time("expire", expire))
+			if err != nil {
+				continue
+			}
+		}
+		res.Removed = append(res.Removed, cd.String())
+		res.Count++
+		res.BytesFreed += size
+	}
+
+	logger.Info("Cache garbage collection finished", zap.Bool("dry_run", dryRun), zap.Int("count", res.Count),
+		zap.Int64("bytes_freed", res.BytesFreed))
+	return res, nil
+}
+
+// lastServedBefore return true if certificate wasn't served since the time or its served time unknown
+func (m *Manager) lastServedBefore(cd CertDescription, t time.Time) bool {
+	m.cachedCertsMu.Lock()
+	defer m.cachedCertsMu.Unlock()
+
+	info, ok := m.cachedCerts[cd.String()]
+	return !ok || info.lastServed.Before(t)
+}
+
+// certEntriesSize return size of cache entries, removed with certificate
+func (m *Manager) certEntriesSize(ctx context.Context, cd CertDescription) int64 {
+	keys := []string{cd.CertStoreName(), cd.KeyStoreName(), cd.MetaStoreName()}
+	if m.PinKeys {
+		keys = []string{cd.CertStoreName(), cd.MetaStoreName()}
+	}
+	var res int64
+	for _, key := range keys {
+		if data, err := m.Cache.Get(ctx, key); err == nil {
+			res += int64(len(data))
+		}
+	}
+	return res
+}
+
+// certExpireFromPEM return expire time of first certificate of pem chain
+func certExpireFromPEM(data []byte) (time.Time, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return time.Time{}, xerrors.New("no certificate in pem")
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, xerrors.Errorf("parse certificate: %w", err)
+		}
+		return cert.NotAfter, nil
+	}
+}
+
+// StartCacheGC run CacheGC every CacheGCInterval until ctx canceled, with CacheGCDryRun.
+// It do nothing if CacheGCRetention or CacheGCInterval is zero.
+func (m *Manager) StartCacheGC(ctx context.Context) {
+	if m.CacheGCRetention <= 0 || m.CacheGCInterval <= 0 {
+		return
+	}
+
+	go func() {
+		logger := zc.L(ctx).Named("cache_gc")
+		defer log.HandlePanic(logger)
+
+		ctx := zc.WithLogger(ctx, logger)
+		ticker := time.NewTicker(m.CacheGCInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, err := m.CacheGC(ctx, time.Now(), m.CacheGCDryRun)
+				log.DebugError(logger, err, "Scheduled cache garbage collection")
+			}
+		}
+	}()
+}
+
+// CacheGCHandler run garbage collection of cache by POST /cache/gc and return its result as json.
+// dry_run=true|false override CacheGCDryRun.
+func (m *Manager) CacheGCHandler(logger *zap.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dryRun := m.CacheGCDryRun
+		if s := r.URL.Query().Get("dry_run"); s != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(s); err != nil {
+				http.Error(w, "Bad dry_run", http.StatusBadRequest)
+				return
+			}
+		}
+
+		ctx := zc.WithLogger(r.Context(), logger)
+		res, err := m.CacheGC(ctx, time.Now(), dryRun)
+		log.InfoError(logger, err, "Cache garbage collection by admin request", zap.String("remote_address", r.RemoteAddr))
+		if err != nil {
+			http.Error(w, "Can't collect garbage of cache", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
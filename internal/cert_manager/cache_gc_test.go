@@ -0,0 +1,124 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
+)
+
+func testCertPEM(t *testing.T, notAfter time.Time, names ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	cert := testcert.New(t, x509.Certificate{
+		NotBefore: notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:  notAfter,
+		DNSNames:  names,
+	}, nil, nil)
+	return testcert.PEM(t, cert)
+}
+
+func TestManager_CacheGC(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	const day = 24 * time.Hour
+	now := time.Now()
+	storage := &cache.DiskCache{Dir: th.TmpDir(e)}
+	oldCert, _ := testCertPEM(t, now.Add(-60*day), "test.ru")
+	recentCert, _ := testCertPEM(t, now.Add(-10*day), "test.ru")
+	renewCert, _ := testCertPEM(t, now.Add(5*day), "test.ru")
+	for key, value := range map[string][]byte{
+		"old.ru.rsa.cer": oldCert, "old.ru.rsa.key": []byte("key"), "old.ru.rsa.json": []byte("{}"),
+		"recent.ru.rsa.cer":  recentCert,
+		"renew.ru.rsa.cer":   renewCert,
+		"served.ru.rsa.cer":  oldCert,
+		"managed.ru.rsa.cer": oldCert,
+		"locked.ru.rsa.cer":  oldCert, "locked.ru.lock": []byte{},
+		"bad.ru.rsa.cer": []byte("bad"),
+	} {
+		e.CmpNoError(storage.Put(ctx, key, value))
+	}
+	keysBefore, err := storage.Keys(ctx)
+	e.CmpNoError(err)
+	sort.Strings(keysBefore)
+
+	m := New(nil, storage, nil)
+	m.ManagedDomains = []domain.DomainName{"managed.ru"}
+	m.cachedCertUpdate(CertDescription{MainDomain: "served.ru", KeyType: KeyRSA}, nil, now.Add(-day), true)
+
+	_, err = m.CacheGC(ctx, now, false)
+	e.CmpError(err, "disabled")
+
+	m.CacheGCRetention = 30 * day
+	res, err := m.CacheGC(ctx, now, true)
+	e.CmpNoError(err)
+	e.Cmp(res, CacheGCResult{DryRun: true, Removed: []string{"old.ru.rsa"}, Count: 1,
+		BytesFreed: int64(len(oldCert) + len("key") + len("{}"))})
+	keys, err := storage.Keys(ctx)
+	e.CmpNoError(err)
+	sort.Strings(keys)
+	e.Cmp(keys, keysBefore)
+
+	m.PinKeys = true
+	res, err = m.CacheGC(ctx, now, false)
+	e.CmpNoError(err)
+	e.Cmp(res, CacheGCResult{Removed: []string{"old.ru.rsa"}, Count: 1, BytesFreed: int64(len(oldCert) + len("{}"))})
+	keys, err = storage.Keys(ctx)
+	e.CmpNoError(err)
+	e.Cmp(keys, testdeep.Bag("old.ru.rsa.key", "recent.ru.rsa.cer", "renew.ru.rsa.cer", "served.ru.rsa.cer",
+		"managed.ru.rsa.cer", "locked.ru.rsa.cer", "locked.ru.lock", "bad.ru.rsa.cer"))
+
+	// cache without list of keys
+	m.Cache = cache.NewMemoryCache("test")
+	_, err = m.CacheGC(ctx, now, false)
+	e.CmpError(err)
+}
+
+func TestManager_CacheGCHandler(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := &cache.DiskCache{Dir: th.TmpDir(e)}
+	oldCert, _ := testCertPEM(t, time.Now().Add(-60*24*time.Hour), "test.ru")
+	e.CmpNoError(storage.Put(ctx, "old.ru.rsa.cer", oldCert))
+	m := New(nil, storage, nil)
+	m.CacheGCRetention = 24 * time.Hour
+	m.CacheGCDryRun = true
+	handler := m.CacheGCHandler(zap.NewNop())
+
+	request := func(method, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/cache/gc"+query, nil))
+		return w
+	}
+
+	e.Cmp(request(http.MethodGet, "").Code, http.StatusMethodNotAllowed)
+	e.Cmp(request(http.MethodPost, "?dry_run=bad").Code, http.StatusBadRequest)
+
+	w := request(http.MethodPost, "")
+	e.Cmp(w.Code, http.StatusOK)
+	var res CacheGCResult
+	e.CmpNoError(json.Unmarshal(w.Body.Bytes(), &res))
+	e.Cmp(res.DryRun, true)
+	e.Cmp(res.Removed, []string{"old.ru.rsa"})
+
+	w = request(http.MethodPost, "?dry_run=false")
+	e.CmpNoError(json.Unmarshal(w.Body.Bytes(), &res))
+	e.Cmp(res.DryRun, false)
+	e.Cmp(res.Count, 1)
+	keys, err := storage.Keys(ctx)
+	e.CmpNoError(err)
+	e.Cmp(keys, testdeep.Len(0))
+}
@@ -0,0 +1,192 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/tls"
+	"sort"
+	"strings"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// certificate, served in last cachedCertInUseTime, is in use and never evicted
+const cachedCertInUseTime = time.Hour
+
+type cachedCertInfo struct {
+	cd         CertDescription
+	lastServed time.Time
+	expire     time.Time // zero if unknown
+}
+
+// LoadCachedCertsList read list of stored certificates from cache for limit its count by MaxCachedCerts.
+// Cache must implement cache.KeysLister.
+func (m *Manager) LoadCachedCertsList(ctx context.Context) error {
+	lister, ok := m.Cache.(cache.KeysLister)
+	if !ok {
+		return xerrors.New("cache doesn't support list keys")
+	}
+	keys, err := lister.Keys(ctx)
+	if err != nil {
+		return xerrors.Errorf("list cache keys: %w", err)
+	}
+
+	m.cachedCertsMu.Lock()
+	defer m.cachedCertsMu.Unlock()
+
+	if m.cachedCerts == nil {
+		m.cachedCerts = make(map[string]*cachedCertInfo)
+	}
+	for _, key := range keys {
+		cd, ok := certDescriptionFromCertStoreName(key)
+		if !ok {
+			continue
+		}
+		if _, exist := m.cachedCerts[cd.String()]; !exist {
+			m.cachedCerts[cd.String()] = &cachedCertInfo{cd: cd}
+		}
+	}
+	zc.L(ctx).Info("Load list of cached certificates", zap.Int("count", len(m.cachedCerts)))
+	return nil
+}
+
+// certDescriptionFromCertStoreName is reverse for CertDescription.CertStoreName.
+// Result usable for build store names only.
+func certDescriptionFromCertStoreName(key string) (CertDescription, bool) {
+	if !strings.HasSuffix(key, ".cer") {
+		return CertDescription{}, false
+	}
+	name := strings.TrimSuffix(key, ".cer")
+	for _, keyType := range []KeyType{KeyRSA, KeyECDSA} {
+		storeName := strings.TrimSuffix(name, "."+keyType.String())
+		if storeName == name || storeName == "" {
+			continue
+		}
+		if strings.HasPrefix(storeName, certGroupStorePrefix) {
+			return CertDescription{KeyType: keyType, Group: strings.TrimPrefix(storeName, certGroupStorePrefix)}, true
+		}
+		return CertDescription{MainDomain: storeName, KeyType: keyType}, true
+	}
+	return CertDescription{}, false
+}
+
+// cachedCertUpdate add certificate to list of cached certificates or update its info
+func (m *Manager) cachedCertUpdate(cd CertDescription, cert *tls.Certificate, now time.Time, served bool) {
+	m.cachedCertsMu.Lock()
+	defer m.cachedCertsMu.Unlock()
+
+	if m.cachedCerts == nil {
+		m.cachedCerts = make(map[string]*cachedCertInfo)
+	}
+	info, ok := m.cachedCerts[cd.String()]
+	if !ok {
+		info = &cachedCertInfo{cd: cd}
+		m.cachedCerts[cd.String()] = info
+	}
+	if served {
+		info.lastServed = now
+	}
+	if cert != nil && cert.Leaf != nil {
+		info.expire = cert.Leaf.NotAfter
+	}
+}
+
+func (m *Manager) cachedCertsCount() int {
+	m.cachedCertsMu.Lock()
+	defer m.cachedCertsMu.Unlock()
+
+	return len(m.cachedCerts)
+}
+
+// evictCachedCerts remove least recently served certificates from cache while its count more then MaxCachedCerts.
+// Certificates in use, locked certificates, certificates of managed domains and keep certificate never evicted.
+// Certificates within renewal window evicted only if no other candidates.
+func (m *Manager) evictCachedCerts(ctx context.Context, keep CertDescription, now time.Time) {
+	if m.MaxCachedCerts <= 0 {
+		return
+	}
+	logger := zc.L(ctx)
+
+	m.cachedCertsMu.Lock()
+	evictCount := len(m.cachedCerts) - m.MaxCachedCerts
+	var candidates []cachedCertInfo
+	if evictCount > 0 {
+		for key, info := range m.cachedCerts {
+			if key == keep.String() || now.Sub(info.lastServed) < cachedCertInUseTime || m.isManagedCert(info.cd) {
+				continue
+			}
+			candidates = append(candidates, *info)
+		}
+	}
+	m.cachedCertsMu.Unlock()
+
+	if evictCount <= 0 {
+		return
+	}
+
+	isInRenewWindow := func(info cachedCertInfo) bool {
+		return !info.expire.IsZero() && info.expire.Sub(now) < renewBeforeExpire
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		iRenew, jRenew := isInRenewWindow(candidates[i]), isInRenewWindow(candidates[j])
+		if iRenew != jRenew {
+			return jRenew
+		}
+		return candidates[i].lastServed.Before(candidates[j].lastServed)
+	})
+
+	for _, info := range candidates {
+		if evictCount <= 0 {
+			break
+		}
+		locked, err := isCertLocked(ctx, m.Cache, info.cd)
+		if err != nil || locked {
+			logger.Debug("Skip evict certificate", info.cd.ZapField(), zap.Bool("locked", locked), zap.Error(err))
+			continue
+		}
+		err = m.evictCachedCert(ctx, info.cd)
+		log.InfoError(logger, err, "Evict cached certificate", info.cd.ZapField(),
+			zap.Time("last_served", info.lastServed), zap.Int("max_cached_certs", m.MaxCachedCerts))
+		if err == nil {
+			evictCount--
+		}
+	}
+	if evictCount > 0 {
+		logger.Warn("Can't evict enough cached certificates, all of them in use or locked",
+			zap.Int("max_cached_certs", m.MaxCachedCerts), zap.Int("over_limit", evictCount))
+	}
+}
+
+func (m *Manager) evictCachedCert(ctx context.Context, cd CertDescription) error {
+	keys := []string{cd.CertStoreName(), cd.KeyStoreName(), cd.MetaStoreName()}
+	if m.PinKeys {
+		keys = []string{cd.CertStoreName(), cd.MetaStoreName()}
+	}
+	for _, key := range keys {
+		if err := m.Cache.Delete(ctx, key); err != nil {
+			return xerrors.Errorf("delete %q from cache: %w", key, err)
+		}
+	}
+
+	m.certStateMu.Lock()
+	err := m.certState.Delete(ctx, cd.String())
+	m.certStateMu.Unlock()
+	if err != nil {
+		return xerrors.Errorf("delete cert state: %w", err)
+	}
+
+	m.unstoredCertsMu.Lock()
+	delete(m.unstoredCerts, cd.String())
+	m.unstoredCertsMu.Unlock()
+
+	m.cachedCertsMu.Lock()
+	delete(m.cachedCerts, cd.String())
+	m.cachedCertsMu.Unlock()
+	return nil
+}
@@ -0,0 +1,110 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestCertDescriptionFromCertStoreName(t *testing.T) {
+	table := []struct {
+		key      string
+		ok       bool
+		expected CertDescription
+	}{
+		{"asd.ru.rsa.cer", true, CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA}},
+		{"asd.ru.ecdsa.cer", true, CertDescription{MainDomain: "asd.ru", KeyType: KeyECDSA}},
+		{"group_test.rsa.cer", true, CertDescription{Group: "test", KeyType: KeyRSA}},
+		{"asd.ru.rsa.key", false, CertDescription{}},
+		{"asd.ru.lock", false, CertDescription{}},
+		{"asd.ru.cer", false, CertDescription{}},
+		{".rsa.cer", false, CertDescription{}},
+	}
+
+	for _, test := range table {
+		td := testdeep.NewT(t)
+		cd, ok := certDescriptionFromCertStoreName(test.key)
+		td.Cmp(ok, test.ok, test.key)
+		td.Cmp(cd, test.expected, test.key)
+		if ok {
+			td.Cmp(cd.CertStoreName(), test.key)
+		}
+	}
+}
+
+func TestManager_EvictCachedCerts(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := &cache.DiskCache{Dir: th.TmpDir(e)}
+	for _, key := range []string{
+		"a.ru.rsa.cer", "a.ru.rsa.key", "a.ru.rsa.json",
+		"b.ru.rsa.cer", "b.ru.rsa.key",
+		"c.ru.rsa.cer", "c.ru.rsa.key",
+		"d.ru.rsa.cer", "d.ru.rsa.key", "d.ru.lock",
+		"group_g.ecdsa.cer", "group_g.ecdsa.key",
+		"e.ru.rsa.cer", "e.ru.rsa.key",
+	} {
+		e.CmpNoError(storage.Put(ctx, key, []byte{}))
+	}
+
+	m := New(nil, storage, nil)
+	m.MaxCachedCerts = 2
+	e.CmpNoError(m.LoadCachedCertsList(ctx))
+	e.Cmp(m.cachedCertsCount(), 6)
+
+	now := time.Now()
+	expireSoon := &tls.Certificate{Leaf: &x509.Certificate{NotAfter: now.Add(time.Hour)}}
+	m.cachedCertUpdate(CertDescription{MainDomain: "b.ru", KeyType: KeyRSA}, nil, now.Add(-2*time.Hour), true)
+	m.cachedCertUpdate(CertDescription{MainDomain: "c.ru", KeyType: KeyRSA}, nil, now.Add(-time.Minute), true)
+	m.cachedCertUpdate(CertDescription{Group: "g", KeyType: KeyECDSA}, expireSoon, now, false)
+
+	m.evictCachedCerts(ctx, CertDescription{MainDomain: "e.ru", KeyType: KeyRSA}, now)
+
+	// c.ru - in use, d.ru - locked, e.ru - keep
+	keys, err := storage.Keys(ctx)
+	e.CmpNoError(err)
+	sort.Strings(keys)
+	e.Cmp(keys, []string{
+		"c.ru.rsa.cer", "c.ru.rsa.key",
+		"d.ru.lock", "d.ru.rsa.cer", "d.ru.rsa.key",
+		"e.ru.rsa.cer", "e.ru.rsa.key",
+	})
+	e.Cmp(m.cachedCertsCount(), 3)
+}
+
+func TestManager_EvictCachedCertsRenewWindowLast(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := &cache.DiskCache{Dir: th.TmpDir(e)}
+	m := New(nil, storage, nil)
+
+	now := time.Now()
+	renewCD := CertDescription{MainDomain: "renew.ru", KeyType: KeyRSA}
+	oldCD := CertDescription{MainDomain: "old.ru", KeyType: KeyRSA}
+	keepCD := CertDescription{MainDomain: "keep.ru", KeyType: KeyRSA}
+	for _, cd := range []CertDescription{renewCD, oldCD, keepCD} {
+		e.CmpNoError(storage.Put(ctx, cd.CertStoreName(), []byte{}))
+	}
+
+	m.cachedCertUpdate(renewCD, &tls.Certificate{Leaf: &x509.Certificate{NotAfter: now.Add(time.Hour)}}, now.Add(-3*time.Hour), true)
+	m.cachedCertUpdate(oldCD, &tls.Certificate{Leaf: &x509.Certificate{NotAfter: now.Add(renewBeforeExpire * 2)}}, now.Add(-2*time.Hour), true)
+	m.cachedCertUpdate(keepCD, nil, now, false)
+
+	m.MaxCachedCerts = 2
+	m.evictCachedCerts(ctx, keepCD, now)
+
+	keys, err := storage.Keys(ctx)
+	e.CmpNoError(err)
+	sort.Strings(keys)
+	e.Cmp(keys, []string{keepCD.CertStoreName(), renewCD.CertStoreName()})
+}
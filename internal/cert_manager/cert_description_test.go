@@ -45,3 +45,23 @@ func TestCertDescription_ZapField(t *testing.T) {
 	cd := CertDescription{MainDomain: "asd.ru", KeyType: KeyRSA}
 	td.Cmp(cd.ZapField(), zap.Stringer("cert_name", cd))
 }
+
+func TestCertDescriptionFromGroup(t *testing.T) {
+	td := testdeep.NewT(t)
+	groups := []CertGroup{
+		{Name: "first", Domains: []domain.DomainName{"a.ru", "b.ru"}},
+		{Name: "second", Domains: []domain.DomainName{"c.ru", "d.ru"}},
+	}
+
+	cd, ok := CertDescriptionFromGroup("d.ru", KeyRSA, groups)
+	td.True(ok)
+	td.Cmp(cd.DomainNames(), []domain.DomainName{"c.ru", "d.ru"})
+	td.Cmp(cd.CertStoreName(), "group_second.rsa.cer")
+	td.Cmp(cd.KeyStoreName(), "group_second.rsa.key")
+	td.Cmp(cd.MetaStoreName(), "group_second.rsa.json")
+	td.Cmp(cd.LockName(), "group_second.lock")
+	td.Cmp(cd.String(), "group_second.rsa")
+
+	_, ok = CertDescriptionFromGroup("e.ru", KeyRSA, groups)
+	td.False(ok)
+}
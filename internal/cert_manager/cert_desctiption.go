@@ -9,17 +9,41 @@ import (
 	"go.uber.org/zap"
 )
 
+const certGroupStorePrefix = "group_"
+
 type CertDescription struct {
 	MainDomain string
 	KeyType    KeyType
 	Subdomains []string
+
+	// Group is name of certificates group, empty for certificates of single domain.
+	// Group certificate contains GroupDomains only and stored by group name.
+	Group        string
+	GroupDomains []domain.DomainName
+}
+
+// CertGroup is list of domains, which share one certificate
+type CertGroup struct {
+	Name    string
+	Domains []domain.DomainName
+}
+
+func (n CertDescription) storeName() string {
+	if n.Group != "" {
+		return certGroupStorePrefix + n.Group
+	}
+	return n.MainDomain
 }
 
 func (n CertDescription) CertStoreName() string {
-	return n.MainDomain + "." + n.KeyType.String() + ".cer"
+	return n.storeName() + "." + n.KeyType.String() + ".cer"
 }
 
 func (n CertDescription) DomainNames() []domain.DomainName {
+	if n.Group != "" {
+		return append([]domain.DomainName(nil), n.GroupDomains...)
+	}
+
 	domains := make([]domain.DomainName, 1, len(n.Subdomains)+1)
 	domains[0] = domain.DomainName(n.MainDomain)
 	for _, subdomain := range n.Subdomains {
@@ -29,19 +53,23 @@ func (n CertDescription) DomainNames() []domain.DomainName {
 }
 
 func (n CertDescription) KeyStoreName() string {
-	return n.MainDomain + "." + n.KeyType.String() + ".key"
+	return n.storeName() + "." + n.KeyType.String() + ".key"
 }
 
 func (n CertDescription) LockName() string {
-	return n.MainDomain + ".lock"
+	return n.storeName() + ".lock"
 }
 
 func (n CertDescription) MetaStoreName() string {
-	return n.MainDomain + "." + n.KeyType.String() + ".json"
+	return n.storeName() + "." + n.KeyType.String() + ".json"
+}
+
+func (n CertDescription) PendingOrderStoreName() string {
+	return n.storeName() + "." + n.KeyType.String() + ".order"
 }
 
 func (n CertDescription) String() string {
-	return n.MainDomain + "." + n.KeyType.String()
+	return n.storeName() + "." + n.KeyType.String()
 }
 
 func (n CertDescription) ZapField() zap.Field {
@@ -50,6 +78,9 @@ func (n CertDescription) ZapField() zap.Field {
 
 func CertDescriptionFromDomain(domain domain.DomainName, keyType KeyType, autoSubDomains []string) CertDescription {
 	mainDomain := domain.String()
+	if isIPName(mainDomain) {
+		return CertDescription{MainDomain: mainDomain, KeyType: keyType}
+	}
 	for _, subdomain := range autoSubDomains {
 		if strings.HasPrefix(mainDomain, subdomain) {
 			mainDomain = strings.TrimPrefix(mainDomain, subdomain)
@@ -62,3 +93,20 @@ func CertDescriptionFromDomain(domain domain.DomainName, keyType KeyType, autoSu
 		Subdomains: autoSubDomains,
 	}
 }
+
+// CertDescriptionFromGroup return description of group certificate if domain contained in one of groups
+func CertDescriptionFromGroup(needDomain domain.DomainName, keyType KeyType, groups []CertGroup) (CertDescription, bool) {
+	for _, group := range groups {
+		for _, groupDomain := range group.Domains {
+			if groupDomain == needDomain {
+				return CertDescription{
+					MainDomain:   group.Domains[0].String(),
+					KeyType:      keyType,
+					Group:        group.Name,
+					GroupDomains: group.Domains,
+				}, true
+			}
+		}
+	}
+	return CertDescription{}, false
+}
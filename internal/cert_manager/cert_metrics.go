@@ -0,0 +1,32 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var certExpireDesc = prometheus.NewDesc("cert_expire_timestamp_seconds",
+	"Expire time of known certificates in cache (unix timestamp)", []string{"cert", "key_type"}, nil)
+
+// certExpireCollector export expire time of certificates from list of cached certificates.
+// Certificates with unknown expire time (listed in cache, but not loaded yet) skipped.
+type certExpireCollector struct {
+	m *Manager
+}
+
+func (c certExpireCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- certExpireDesc
+}
+
+func (c certExpireCollector) Collect(metrics chan<- prometheus.Metric) {
+	c.m.cachedCertsMu.Lock()
+	defer c.m.cachedCertsMu.Unlock()
+
+	for _, info := range c.m.cachedCerts {
+		if info.expire.IsZero() {
+			continue
+		}
+		metrics <- prometheus.MustNewConstMetric(certExpireDesc, prometheus.GaugeValue,
+			float64(info.expire.Unix()), info.cd.storeName(), info.cd.KeyType.String())
+	}
+}
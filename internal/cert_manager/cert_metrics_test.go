@@ -0,0 +1,47 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCertExpireCollector(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := &Manager{}
+	r := prometheus.NewRegistry()
+	r.MustRegister(certExpireCollector{m: m})
+
+	expire := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := time.Now()
+	m.cachedCertUpdate(CertDescription{MainDomain: "example.com", KeyType: KeyRSA},
+		&tls.Certificate{Leaf: &x509.Certificate{NotAfter: expire}}, now, true)
+	m.cachedCertUpdate(CertDescription{Group: "sites", KeyType: KeyECDSA},
+		&tls.Certificate{Leaf: &x509.Certificate{NotAfter: expire.Add(time.Hour)}}, now, true)
+	// unknown expire
+	m.cachedCertUpdate(CertDescription{MainDomain: "unknown.com", KeyType: KeyRSA}, nil, now, false)
+
+	families, err := r.Gather()
+	td.CmpNoError(err)
+	td.Cmp(len(families), 1)
+	td.Cmp(families[0].GetName(), "cert_expire_timestamp_seconds")
+
+	values := map[string]float64{}
+	for _, metric := range families[0].GetMetric() {
+		labels := map[string]string{}
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		values[labels["cert"]+"."+labels["key_type"]] = metric.GetGauge().GetValue()
+	}
+	td.Cmp(values, map[string]float64{
+		"example.com.rsa":   float64(expire.Unix()),
+		"group_sites.ecdsa": float64(expire.Add(time.Hour).Unix()),
+	})
+}
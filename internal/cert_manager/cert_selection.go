@@ -0,0 +1,37 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// traceCertCandidate add certificate of description to trace of certificate selection, err - why it doesn't matched
+func traceCertCandidate(trace *log.CertSelection, cd CertDescription, needDomain domain.DomainName, source string, err error) {
+	if trace == nil {
+		return
+	}
+	specificity := log.CertSpecificityExact
+	if cd.Group != "" || cd.MainDomain != needDomain.String() {
+		specificity = log.CertSpecificityShared
+	}
+	candidate := log.CertCandidate{Key: cd.CertStoreName(), Source: source, Specificity: specificity, Matched: err == nil}
+	if err != nil {
+		candidate.Reason = err.Error()
+	}
+	trace.Add(candidate)
+}
+
+// traceWildcardCandidate add wildcard certificate for the domain to trace of certificate selection
+func traceWildcardCandidate(trace *log.CertSelection, needDomain domain.DomainName, keyType KeyType, matched bool) {
+	if trace == nil {
+		return
+	}
+	cd, _ := wildcardCertDescription(needDomain, keyType)
+	candidate := log.CertCandidate{Key: cd.CertStoreName(), Source: "cache", Specificity: log.CertSpecificityWildcard,
+		Matched: matched}
+	if !matched {
+		candidate.Reason = "no valid wildcard certificate"
+	}
+	trace.Add(candidate)
+}
@@ -0,0 +1,49 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+func TestTraceCertCandidate(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	var buf bytes.Buffer
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&buf),
+		zapcore.DebugLevel))
+
+	needDomain := domain.DomainName("www.example.com")
+	trace := log.NewCertSelection(logger)
+	traceCertCandidate(trace, CertDescriptionFromDomain(needDomain, KeyRSA, nil), needDomain, "local state",
+		errors.New("test"))
+	traceCertCandidate(trace, CertDescriptionFromDomain(needDomain, KeyRSA, []string{"www."}), needDomain, "cache", nil)
+	traceWildcardCandidate(trace, needDomain, KeyRSA, false)
+	trace.Log(logger, "")
+
+	var message struct {
+		Chosen     string
+		Candidates []map[string]interface{}
+	}
+	td.CmpNoError(json.Unmarshal(buf.Bytes(), &message))
+	td.Cmp(message.Chosen, "cache: example.com.rsa.cer")
+	td.Cmp(message.Candidates, []map[string]interface{}{
+		{"key": "www.example.com.rsa.cer", "source": "local state", "specificity": 3.0, "matched": false, "reason": "test"},
+		{"key": "example.com.rsa.cer", "source": "cache", "specificity": 2.0, "matched": true},
+		{"key": "*.example.com.rsa.cer", "source": "cache", "specificity": 1.0, "matched": false,
+			"reason": "no valid wildcard certificate"},
+	})
+
+	// without trace
+	traceCertCandidate(nil, CertDescriptionFromDomain(needDomain, KeyRSA, nil), needDomain, "cache", nil)
+	traceWildcardCandidate(nil, needDomain, KeyRSA, true)
+}
@@ -0,0 +1,156 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const (
+	defaultChallengeCleanupRetries    = 3
+	defaultChallengeCleanupRetryDelay = time.Second
+	challengeSweepInterval            = time.Minute
+)
+
+// challengeArtifact - state of challenge (token for http-01, certificate for tls-alpn-01),
+// which must be removed after validation.
+type challengeArtifact struct {
+	created time.Time
+	remove  func(ctx context.Context) error
+}
+
+type challengeArtifacts struct {
+	mu    sync.Mutex
+	items map[string]*challengeArtifact
+}
+
+// add register artifact, it replace previous artifact with same key
+func (a *challengeArtifacts) add(key string, artifact *challengeArtifact) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.items == nil {
+		a.items = make(map[string]*challengeArtifact)
+	}
+	a.items[key] = artifact
+}
+
+// remove unregister artifact if it wasn't replaced by newer artifact with same key
+func (a *challengeArtifacts) remove(key string, artifact *challengeArtifact) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.items[key] == artifact {
+		delete(a.items, key)
+	}
+}
+
+// olderThan return artifacts, created before the time
+func (a *challengeArtifacts) olderThan(t time.Time) map[string]*challengeArtifact {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res := make(map[string]*challengeArtifact)
+	for key, artifact := range a.items {
+		if artifact.created.Before(t) {
+			res[key] = artifact
+		}
+	}
+	return res
+}
+
+// trackChallenge register challenge artifact for sweep and return cleanup function, which remove
+// the artifact in background with retries.
+func (m *Manager) trackChallenge(ctx context.Context, key string, remove func(ctx context.Context) error) func() {
+	artifact := &challengeArtifact{created: time.Now(), remove: remove}
+	m.challengeArtifacts.add(key, artifact)
+
+	logger := zc.L(ctx).With(zap.String("challenge_key", key))
+	return func() {
+		// handlepanic: in cleanupChallenge
+		go m.cleanupChallenge(logger, key, artifact)
+	}
+}
+
+// cleanupChallenge remove challenge artifact, retry with exponential backoff if remove failed.
+// Artifact, which can't be removed, stay registered for sweeper.
+func (m *Manager) cleanupChallenge(logger *zap.Logger, key string, artifact *challengeArtifact) {
+	defer log.HandlePanic(logger)
+
+	// detach from request lifetime, but save log context
+	ctx := zc.WithLogger(context.Background(), logger)
+
+	retries := m.ChallengeCleanupRetries
+	if retries < 0 {
+		retries = 0
+	}
+	delay := m.ChallengeCleanupRetryDelay
+	if delay <= 0 {
+		delay = defaultChallengeCleanupRetryDelay
+	}
+
+	for attempt := 0; ; attempt++ {
+		removeCtx, cancel := context.WithTimeout(ctx, cleanupTimeout)
+		err := artifact.remove(removeCtx)
+		cancel()
+		if err == nil {
+			logger.Debug("Challenge cleaned up", zap.Int("attempt", attempt))
+			m.challengeArtifacts.remove(key, artifact)
+			return
+		}
+		if attempt >= retries {
+			logger.Error("Can't cleanup challenge, it will be removed by sweeper", zap.Error(err),
+				zap.Int("attempts", attempt+1))
+			return
+		}
+		logger.Warn("Cleanup challenge failed, retry", zap.Error(err), zap.Duration("retry_after", delay))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// StartChallengeSweeper remove challenge artifacts older than ChallengeMaxAge, which wasn't removed after
+// validation, every minute until ctx canceled. It do nothing if ChallengeMaxAge is zero.
+func (m *Manager) StartChallengeSweeper(ctx context.Context) {
+	if m.ChallengeMaxAge <= 0 {
+		return
+	}
+
+	go func() {
+		logger := zc.L(ctx).Named("challenge_sweeper")
+		defer log.HandlePanic(logger)
+
+		ctx := zc.WithLogger(ctx, logger)
+		ticker := time.NewTicker(challengeSweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.sweepChallenges(ctx, time.Now())
+			}
+		}
+	}()
+}
+
+func (m *Manager) sweepChallenges(ctx context.Context, now time.Time) {
+	logger := zc.L(ctx)
+	for key, artifact := range m.challengeArtifacts.olderThan(now.Add(-m.ChallengeMaxAge)) {
+		removeCtx, cancel := context.WithTimeout(ctx, cleanupTimeout)
+		err := artifact.remove(removeCtx)
+		cancel()
+		if err == nil {
+			m.challengeArtifacts.remove(key, artifact)
+		}
+		log.InfoError(logger, err, "Remove orphaned challenge", zap.String("challenge_key", key),
+			zap.Time("created", artifact.created))
+	}
+}
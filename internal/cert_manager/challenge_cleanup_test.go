@@ -0,0 +1,91 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	zc "github.com/rekby/zapcontext"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestManager_CleanupChallengeRetry(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	m := &Manager{ChallengeCleanupRetries: 3, ChallengeCleanupRetryDelay: time.Millisecond}
+
+	var calls int32
+	artifact := &challengeArtifact{created: time.Now(), remove: func(ctx context.Context) error {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return errors.New("test")
+		}
+		return nil
+	}}
+	m.challengeArtifacts.add("ok", artifact)
+	m.cleanupChallenge(zc.L(ctx), "ok", artifact)
+	td.CmpDeeply(atomic.LoadInt32(&calls), int32(3))
+	td.Len(m.challengeArtifacts.items, 0)
+
+	// failed cleanup stay for sweeper
+	atomic.StoreInt32(&calls, 0)
+	artifact = &challengeArtifact{created: time.Now(), remove: func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("test")
+	}}
+	m.challengeArtifacts.add("fail", artifact)
+	m.cleanupChallenge(zc.L(ctx), "fail", artifact)
+	td.CmpDeeply(atomic.LoadInt32(&calls), int32(4))
+	td.Len(m.challengeArtifacts.items, 1)
+}
+
+func TestManager_CleanupChallengeReplaced(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	m := &Manager{}
+	remove := func(ctx context.Context) error { return nil }
+	old := &challengeArtifact{created: time.Now(), remove: remove}
+	m.challengeArtifacts.add("key", old)
+	newer := &challengeArtifact{created: time.Now(), remove: remove}
+	m.challengeArtifacts.add("key", newer)
+
+	m.cleanupChallenge(zc.L(ctx), "key", old)
+	td.Cmp(m.challengeArtifacts.items, map[string]*challengeArtifact{"key": newer})
+}
+
+func TestManager_SweepChallenges(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	m := &Manager{ChallengeMaxAge: time.Hour}
+	now := time.Now()
+
+	var removed []string
+	artifact := func(name string, age time.Duration, err error) *challengeArtifact {
+		return &challengeArtifact{created: now.Add(-age), remove: func(ctx context.Context) error {
+			removed = append(removed, name)
+			return err
+		}}
+	}
+	failed := artifact("failed", 2*time.Hour, errors.New("test"))
+	m.challengeArtifacts.add("old", artifact("old", 2*time.Hour, nil))
+	m.challengeArtifacts.add("failed", failed)
+	m.challengeArtifacts.add("fresh", artifact("fresh", time.Minute, nil))
+
+	m.sweepChallenges(ctx, now)
+	td.Cmp(removed, testdeep.Bag("old", "failed"))
+	td.Cmp(m.challengeArtifacts.items, testdeep.Map(map[string]*challengeArtifact{"failed": failed},
+		testdeep.MapEntries{"fresh": testdeep.NotNil()}))
+}
@@ -0,0 +1,83 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const clockSkewCheckTimeout = 30 * time.Second
+
+// MeasureClockSkew return difference between time of server (by Date header of response) and local time.
+// Positive - local clock is behind of server clock. Precision is about one second: Date header has no fractions.
+func MeasureClockSkew(ctx context.Context, client *http.Client, url string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, xerrors.Errorf("create http request: %w", err)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, xerrors.Errorf("request server time: %w", err)
+	}
+	_ = resp.Body.Close()
+	finish := time.Now()
+
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, xerrors.Errorf("parse date header %q: %w", resp.Header.Get("Date"), err)
+	}
+
+	// server time truncated to second: middle of the second is the best estimate
+	serverTime = serverTime.Add(time.Second / 2)
+	localTime := start.Add(finish.Sub(start) / 2)
+	return serverTime.Sub(localTime), nil
+}
+
+// StartClockSkewCheck measure skew of local clock by acme server (url) in background, log warning
+// if it exceed ClockSkewWarning and expose it by metrics.
+func (m *Manager) StartClockSkewCheck(ctx context.Context, client *http.Client, url string) {
+	go func() {
+		logger := zc.L(ctx)
+		defer log.HandlePanic(logger)
+
+		ctx, cancel := context.WithTimeout(ctx, clockSkewCheckTimeout)
+		defer cancel()
+
+		skew, err := MeasureClockSkew(ctx, client, url)
+		if err != nil {
+			logger.Warn("Can't measure clock skew", zap.String("url", url), zap.Error(err))
+			return
+		}
+
+		level := zapcore.InfoLevel
+		if m.ClockSkewWarning > 0 && (skew > m.ClockSkewWarning || skew < -m.ClockSkewWarning) {
+			level = zapcore.WarnLevel
+		}
+		log.LevelParam(logger, level, "Clock skew with acme server", zap.Duration("skew", skew), zap.String("url", url),
+			zap.Duration("warning_threshold", m.ClockSkewWarning), zap.Duration("tolerance", m.ClockSkewTolerance))
+		if level == zapcore.WarnLevel && (skew > m.ClockSkewTolerance || skew < -m.ClockSkewTolerance) {
+			logger.Warn("CLOCK SKEW EXCEED TOLERANCE: valid certificates may be rejected as expired or not valid yet, " +
+				"synchronize system clock")
+		}
+		atomic.StoreInt64(&m.clockSkew, int64(skew))
+	}()
+}
+
+// ClockSkew return last measured skew of local clock, 0 if it not measured.
+func (m *Manager) ClockSkew() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.clockSkew))
+}
@@ -0,0 +1,102 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
+)
+
+func TestMeasureClockSkew(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	skew, err := MeasureClockSkew(ctx, server.Client(), server.URL)
+	e.CmpNoError(err)
+	e.Cmp(skew, testdeep.Between(time.Hour-2*time.Second, time.Hour+2*time.Second))
+
+	noDateServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Date"] = nil
+	}))
+	defer noDateServer.Close()
+
+	_, err = MeasureClockSkew(ctx, noDateServer.Client(), noDateServer.URL)
+	e.CmpError(err)
+}
+
+func TestManager_StartClockSkewCheck(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	var warnings []string
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.AddSync(ioutil.Discard), zapcore.DebugLevel), zap.Hooks(func(entry zapcore.Entry) error {
+		if entry.Level == zapcore.WarnLevel {
+			mu.Lock()
+			warnings = append(warnings, entry.Message)
+			mu.Unlock()
+		}
+		return nil
+	}))
+
+	m := New(nil, newCacheMock(e), nil)
+	m.ClockSkewWarning = time.Minute
+	m.ClockSkewTolerance = time.Minute
+	m.StartClockSkewCheck(zc.WithLogger(ctx, logger), server.Client(), server.URL)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for m.ClockSkew() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	e.Cmp(m.ClockSkew(), testdeep.Between(-time.Hour-2*time.Second, -time.Hour+2*time.Second))
+
+	mu.Lock()
+	defer mu.Unlock()
+	e.Cmp(warnings, testdeep.Len(2))
+}
+
+func TestValidCertTLSClockSkewTolerance(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	now := time.Now()
+	cert := testcert.New(t, x509.Certificate{
+		NotBefore: now.Add(time.Minute),
+		NotAfter:  now.Add(time.Hour),
+		DNSNames:  []string{"test.ru"},
+	}, nil, nil)
+	der, key := cert.Certificate[0], cert.PrivateKey
+
+	_, err := validCertDer(nil, [][]byte{der}, key, false, now, 0)
+	td.CmpError(err)
+	_, err = validCertDer(nil, [][]byte{der}, key, false, now, 2*time.Minute)
+	td.CmpNoError(err)
+
+	expiredNow := now.Add(time.Hour + time.Minute)
+	_, err = validCertDer(nil, [][]byte{der}, key, false, expiredNow, 0)
+	td.Cmp(err, errCertExpired)
+	_, err = validCertDer(nil, [][]byte{der}, key, false, expiredNow, 2*time.Minute)
+	td.CmpNoError(err)
+}
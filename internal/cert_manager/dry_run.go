@@ -0,0 +1,63 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+)
+
+// placeholder lifetime is same as of acme certificate and doesn't trigger renew
+const dryRunCertLifetime = 90 * 24 * time.Hour
+
+const dryRunCertOrganization = "lets-proxy dry run"
+
+// createDryRunCertificate return self-signed placeholder instead of issue certificate by acme server.
+// The placeholder served from memory only and never stored to cache.
+func (m *Manager) createDryRunCertificate(ctx context.Context, cd CertDescription, domainNames []domain.DomainName) (*tls.Certificate, error) {
+	zc.L(ctx).Info("Dry run: certificate would be issued, create self-signed placeholder",
+		zap.String("cert_description", cd.String()), domain.LogDomains(domainNames))
+
+	key, err := cd.KeyType.Generate()
+	if err != nil {
+		return nil, xerrors.Errorf("generate placeholder key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)) //nolint:gomnd
+	if err != nil {
+		return nil, xerrors.Errorf("generate placeholder serial: %w", err)
+	}
+
+	dnsNames, ips := splitIPNames(domainNames)
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domainNames[0].ASCII(), Organization: []string{dryRunCertOrganization}},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(dryRunCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, xerrors.Errorf("create placeholder certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, xerrors.Errorf("parse placeholder certificate: %w", err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,45 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+)
+
+func TestManager_DryRun(t *testing.T) {
+	td := testdeep.NewT(t)
+	c, cancel := createManager(t)
+	defer cancel()
+
+	c.manager.DryRun = true
+	c.manager.AutoSubdomains = []string{"www."}
+
+	// acme client manager and cache Put doesn't expected
+	c.certState.GetMock.Return(&certState{}, nil)
+	c.cache.GetMock.Return(nil, cache.ErrCacheMiss)
+	denied := map[string]bool{"www.test.ru": true, "denied.ru": true}
+	c.domainChecker.IsDomainAllowedMock.Set(func(ctx context.Context, domain string) (bool, error) {
+		return !denied[domain], nil
+	})
+
+	res, err := c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: "test.ru"})
+	td.CmpNoError(err)
+	td.Cmp(res.Leaf.DNSNames, []string{"test.ru"})
+	td.Cmp(res.Leaf.Subject.Organization, []string{dryRunCertOrganization})
+	td.False(isNeedRenew(res, res.Leaf.NotBefore.Add(dryRunCertLifetime/2)))
+
+	// certificate of the description without need domain isn't served, certificate issued again
+	delete(denied, "www.test.ru")
+	res, err = c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: "www.test.ru"})
+	td.CmpNoError(err)
+	td.Cmp(res.Leaf.DNSNames, testdeep.Bag("test.ru", "www.test.ru"))
+
+	res, err = c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: "denied.ru"})
+	td.Nil(res)
+	td.CmpError(err)
+}
@@ -0,0 +1,125 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/xerrors"
+)
+
+var errHandshakeQueueFull = xerrors.New("queue of certificate operations for handshakes is full")
+var errHandshakeQueueTimeout = xerrors.New("timeout of wait in queue of certificate operations for handshakes")
+
+// HandshakeLimit limit count of concurrent certificate operations of handshakes (read from cache and issue).
+// Excess operations wait in queue, operations over queue size or after max wait fail fast.
+// It protect from exhaustion of resources by spike of handshakes, independent of limits of acme server.
+type HandshakeLimit struct {
+	// MaxConcurrent - max count of concurrent operations.
+	MaxConcurrent int
+
+	// MaxQueue - max count of waiting operations, 0 - fail immediately if no free slots.
+	MaxQueue int
+
+	// MaxWait - max wait in queue, 0 - wait while context of handshake alive.
+	MaxWait time.Duration
+
+	slotsOnce sync.Once
+	slots     chan struct{}
+
+	queued   int64
+	rejected int64
+	waitTime prometheus.Histogram
+}
+
+// InitMetrics register queue depth, wait time and count of rejected operations
+func (l *HandshakeLimit) InitMetrics(r prometheus.Registerer) {
+	if l == nil || r == nil || reflect.ValueOf(r).IsNil() {
+		return
+	}
+
+	l.waitTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "handshake_cert_queue_wait_seconds",
+		Help:    "Wait time of certificate operations of handshakes in queue",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30},
+	})
+	r.MustRegister(
+		l.waitTime,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "handshake_cert_queue_depth", Help: "Count of certificate operations of handshakes, waiting in queue",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&l.queued))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "handshake_cert_in_progress", Help: "Count of running certificate operations of handshakes",
+		}, func() float64 {
+			return float64(len(l.getSlots()))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "handshake_cert_rejected", Help: "Count of certificate operations of handshakes, rejected by full queue or wait timeout",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&l.rejected))
+		}),
+	)
+}
+
+func (l *HandshakeLimit) getSlots() chan struct{} {
+	l.slotsOnce.Do(func() {
+		l.slots = make(chan struct{}, l.MaxConcurrent)
+	})
+	return l.slots
+}
+
+// acquire wait free slot for operation, release must be called after finish operation.
+// Nil limit allow all operations.
+func (l *HandshakeLimit) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil || l.MaxConcurrent <= 0 {
+		return func() {}, nil
+	}
+
+	slots := l.getSlots()
+	release = func() { <-slots }
+	select {
+	case slots <- struct{}{}:
+		l.observeWait(0)
+		return release, nil
+	default:
+	}
+
+	if atomic.AddInt64(&l.queued, 1) > int64(l.MaxQueue) {
+		atomic.AddInt64(&l.queued, -1)
+		atomic.AddInt64(&l.rejected, 1)
+		return nil, errHandshakeQueueFull
+	}
+	defer atomic.AddInt64(&l.queued, -1)
+
+	var timeout <-chan time.Time
+	if l.MaxWait > 0 {
+		timer := time.NewTimer(l.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	start := time.Now()
+	select {
+	case slots <- struct{}{}:
+		l.observeWait(time.Since(start))
+		return release, nil
+	case <-timeout:
+		atomic.AddInt64(&l.rejected, 1)
+		return nil, errHandshakeQueueTimeout
+	case <-ctx.Done():
+		atomic.AddInt64(&l.rejected, 1)
+		return nil, xerrors.Errorf("wait in queue of certificate operations for handshakes: %w", ctx.Err())
+	}
+}
+
+func (l *HandshakeLimit) observeWait(wait time.Duration) {
+	if l.waitTime != nil {
+		l.waitTime.Observe(wait.Seconds())
+	}
+}
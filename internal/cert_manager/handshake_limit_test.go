@@ -0,0 +1,87 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestHandshakeLimit_Nil(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	var limit *HandshakeLimit
+	release, err := limit.acquire(ctx)
+	td.CmpNoError(err)
+	release()
+	limit.InitMetrics(prometheus.NewRegistry())
+}
+
+func TestHandshakeLimit(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	limit := &HandshakeLimit{MaxConcurrent: 1, MaxQueue: 1, MaxWait: time.Minute}
+	limit.InitMetrics(prometheus.NewRegistry())
+
+	release, err := limit.acquire(ctx)
+	td.CmpNoError(err)
+
+	queuedDone := make(chan error, 1)
+	go func() {
+		queuedRelease, err := limit.acquire(ctx)
+		if err == nil {
+			queuedRelease()
+		}
+		queuedDone <- err
+	}()
+	for i := 0; i < 1000 && atomic.LoadInt64(&limit.queued) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	td.Cmp(atomic.LoadInt64(&limit.queued), int64(1))
+
+	// queue is full
+	_, err = limit.acquire(ctx)
+	td.Cmp(err, errHandshakeQueueFull)
+	td.Cmp(atomic.LoadInt64(&limit.rejected), int64(1))
+
+	release()
+	td.CmpNoError(<-queuedDone)
+	td.Cmp(atomic.LoadInt64(&limit.queued), int64(0))
+	td.Cmp(len(limit.slots), 0)
+}
+
+func TestHandshakeLimit_Timeout(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	limit := &HandshakeLimit{MaxConcurrent: 1, MaxQueue: 2, MaxWait: 10 * time.Millisecond}
+	release, err := limit.acquire(ctx)
+	td.CmpNoError(err)
+	defer release()
+
+	_, err = limit.acquire(ctx)
+	td.Cmp(err, errHandshakeQueueTimeout)
+
+	limit.MaxWait = 0
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = limit.acquire(cancelledCtx)
+	td.True(xerrors.Is(err, context.Canceled))
+	td.Cmp(atomic.LoadInt64(&limit.rejected), int64(2))
+	td.Cmp(atomic.LoadInt64(&limit.queued), int64(0))
+}
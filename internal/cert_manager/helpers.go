@@ -17,7 +17,13 @@ import (
 	"golang.org/x/crypto/acme"
 )
 
-var errCertExpired = errors.New("expired certificate")
+var (
+	errCertExpired = errors.New("expired certificate")
+
+	// errCertNameMismatch - certificate doesn't contain need domain, for example certificate of the description
+	// issued for need domain only after fail of issue with auto-included domains.
+	errCertNameMismatch = errors.New("certificate doesn't match domain")
+)
 
 func isTLSALPN01Hello(hello *tls.ClientHelloInfo) bool {
 	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
@@ -32,14 +38,21 @@ func pickChallenge(typ string, chal []*acme.Challenge) *acme.Challenge {
 	return nil
 }
 
-func createCertRequest(key crypto.Signer, commonName domain.DomainName, domains ...domain.DomainName) ([]byte, error) {
-	dnsNames := make([]string, len(domains))
-	for i, v := range domains {
-		dnsNames[i] = v.String()
+// createCertRequest create csr for domains and ip addresses. CommonName of subject replaced by commonName
+// (empty for ip address), other subject fields copied as is. Names sorted and deduplicated.
+func createCertRequest(key crypto.Signer, mustStaple bool, subject pkix.Name, commonName domain.DomainName, domains ...domain.DomainName) ([]byte, error) {
+	dnsNames, ips := splitIPNames(domain.SortedUnique(domains))
+	subject.CommonName = commonName.String()
+	if isIPName(subject.CommonName) {
+		subject.CommonName = ""
 	}
 	req := &x509.CertificateRequest{
-		Subject:  pkix.Name{CommonName: commonName.String()},
-		DNSNames: dnsNames,
+		Subject:     subject,
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+	}
+	if mustStaple {
+		req.ExtraExtensions = append(req.ExtraExtensions, mustStapleExtension)
 	}
 	return x509.CreateCertificateRequest(rand.Reader, req, key)
 }
@@ -58,7 +71,8 @@ func flatByteSlices(in [][]byte) []byte {
 }
 
 // Return valid parced certificate or error
-func validCertDer(domains []domain.DomainName, der [][]byte, key crypto.PrivateKey, useAsIs bool, now time.Time) (cert *tls.Certificate, err error) {
+func validCertDer(domains []domain.DomainName, der [][]byte, key crypto.PrivateKey, useAsIs bool, now time.Time,
+	skewTolerance time.Duration) (cert *tls.Certificate, err error) {
 	// parse public part(s)
 	x509Cert, err := x509.ParseCertificates(flatByteSlices(der))
 	if err != nil || len(x509Cert) == 0 {
@@ -73,10 +87,11 @@ func validCertDer(domains []domain.DomainName, der [][]byte, key crypto.PrivateK
 		Leaf:        leaf,
 	}
 
-	return validCertTLS(cert, domains, useAsIs, now)
+	return validCertTLS(cert, domains, useAsIs, now, skewTolerance)
 }
 
-func validCertTLS(cert *tls.Certificate, domains []domain.DomainName, useAsIs bool, now time.Time) (validCert *tls.Certificate, err error) {
+func validCertTLS(cert *tls.Certificate, domains []domain.DomainName, useAsIs bool, now time.Time,
+	skewTolerance time.Duration) (validCert *tls.Certificate, err error) {
 	if cert == nil {
 		return nil, errors.New("certificate is nil")
 	}
@@ -120,17 +135,17 @@ func validCertTLS(cert *tls.Certificate, domains []domain.DomainName, useAsIs bo
 		return nil, errors.New("unknown public key algorithm")
 	}
 
-	// verify the leaf is not expired and matches the domain name
-	if now.Before(cert.Leaf.NotBefore) {
+	// verify the leaf is not expired (with tolerance of local clock skew) and matches the domain name
+	if now.Add(skewTolerance).Before(cert.Leaf.NotBefore) {
 		return nil, errors.New("certificate is not valid yet")
 	}
-	if now.After(cert.Leaf.NotAfter) {
+	if now.Add(-skewTolerance).After(cert.Leaf.NotAfter) {
 		return nil, errCertExpired
 	}
 
 	for _, domain := range domains {
 		if err := cert.Leaf.VerifyHostname(string(domain)); err != nil {
-			return nil, err
+			return nil, errCertNameMismatch
 		}
 	}
 
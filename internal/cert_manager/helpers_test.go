@@ -0,0 +1,61 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+)
+
+func TestCreateCertRequestSubject(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	key, err := KeyECDSA.Generate()
+	td.CmpNoError(err)
+
+	subject := pkix.Name{CommonName: "ignored", Organization: []string{"Org"}, OrganizationalUnit: []string{"Unit1", "Unit2"}}
+	der, err := createCertRequest(key, false, subject, "test.ru", "test.ru", "www.test.ru")
+	td.CmpNoError(err)
+	csr, err := x509.ParseCertificateRequest(der)
+	td.CmpNoError(err)
+
+	td.Cmp(csr.Subject.CommonName, "test.ru")
+	td.Cmp(csr.Subject.Organization, []string{"Org"})
+	td.Cmp(csr.Subject.OrganizationalUnit, []string{"Unit1", "Unit2"})
+	td.Cmp(csr.DNSNames, []string{"test.ru", "www.test.ru"})
+	td.Cmp(subject.CommonName, "ignored")
+}
+
+func TestCreateCertRequestSortNames(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	key, err := KeyECDSA.Generate()
+	td.CmpNoError(err)
+
+	der, err := createCertRequest(key, false, pkix.Name{}, "test.ru", "www.test.ru", "test.ru", "a.test.ru", "test.ru")
+	td.CmpNoError(err)
+	csr, err := x509.ParseCertificateRequest(der)
+	td.CmpNoError(err)
+
+	td.Cmp(csr.Subject.CommonName, "test.ru")
+	td.Cmp(csr.DNSNames, []string{"a.test.ru", "test.ru", "www.test.ru"})
+}
+
+func TestCreateCertRequestIP(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	key, err := KeyECDSA.Generate()
+	td.CmpNoError(err)
+
+	der, err := createCertRequest(key, false, pkix.Name{}, "1.2.3.4", "1.2.3.4")
+	td.CmpNoError(err)
+	csr, err := x509.ParseCertificateRequest(der)
+	td.CmpNoError(err)
+
+	td.Cmp(csr.Subject.CommonName, "")
+	td.Cmp(csr.DNSNames, testdeep.Empty())
+	td.Cmp(csr.IPAddresses, []net.IP{net.ParseIP("1.2.3.4").To4()})
+}
@@ -0,0 +1,167 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rekby/fastuuid"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+	"github.com/rekby/lets-proxy2/internal/stringhelper"
+)
+
+const httpPreflightTimeout = 10 * time.Second
+
+// max size of checker response, preflight token answer is short
+const httpPreflightMaxResponseSize = 1024
+
+// HTTPPreflight check reachability of http-01 validation before order certificate,
+// for clear diagnostic instead of "connection refused" from acme server.
+type HTTPPreflight struct {
+	// ListenAddresses - addresses of listeners, which handle http-01 validation requests.
+	// At least one of them must accept connections.
+	ListenAddresses []string
+
+	// CheckerURL - external service for check reachability from internet. Empty - check local listeners only.
+	// Preflight send GET request to the url with query param url=http://<domain>/.well-known/acme-challenge/<token>,
+	// the checker must fetch the url and response with status 200 and fetched body.
+	CheckerURL string
+
+	// HTTPClient for requests to CheckerURL. nil - client with default timeout.
+	HTTPClient *http.Client
+}
+
+// httpPreflightChallenges return challenge types for order. http-01 excluded if preflight failed
+// and HTTPPreflightFallback enabled and other challenge type available.
+func (m *Manager) httpPreflightChallenges(ctx context.Context, challengeTypes []string, domains []domain.DomainName) []string {
+	if m.HTTPPreflight == nil || !stringhelper.Contains(challengeTypes, http01) {
+		return challengeTypes
+	}
+	logger := zc.L(ctx)
+
+	err := m.httpPreflight(ctx, domains)
+	if err == nil {
+		logger.Debug("HTTP-01 validation preflight passed")
+		return challengeTypes
+	}
+
+	logger.Warn("HTTP-01 validation preflight failed: acme server can't reach the domains by http. "+
+		"Check port 80 is open and forwarded to lets-proxy.", zap.Error(err))
+	if !m.HTTPPreflightFallback || len(challengeTypes) == 1 {
+		return challengeTypes
+	}
+
+	res := make([]string, 0, len(challengeTypes)-1)
+	for _, challengeType := range challengeTypes {
+		if challengeType != http01 {
+			res = append(res, challengeType)
+		}
+	}
+	logger.Info("Skip http-01 challenge after failed preflight", zap.Strings("challenges", res))
+	return res
+}
+
+func (m *Manager) httpPreflight(ctx context.Context, domains []domain.DomainName) error {
+	if err := m.HTTPPreflight.checkListeners(ctx); err != nil {
+		return err
+	}
+	if m.HTTPPreflight.CheckerURL == "" {
+		return nil
+	}
+	for _, d := range domains {
+		if err := m.httpPreflightDomain(ctx, d); err != nil {
+			return xerrors.Errorf("check domain %q: %w", d, err)
+		}
+	}
+	return nil
+}
+
+func (p *HTTPPreflight) checkListeners(ctx context.Context) error {
+	if len(p.ListenAddresses) == 0 {
+		return xerrors.New("no http listeners")
+	}
+
+	var err error
+	for _, addr := range p.ListenAddresses {
+		var conn net.Conn
+		conn, err = (&net.Dialer{Timeout: httpPreflightTimeout}).DialContext(ctx, "tcp", localDialAddress(addr))
+		log.DebugInfo(zc.L(ctx), err, "Preflight connect to http listener", zap.String("address", addr))
+		if err == nil {
+			_ = conn.Close()
+			return nil
+		}
+	}
+	return xerrors.Errorf("http listeners doesn't accept connections: %w", err)
+}
+
+// localDialAddress replace unspecified host of listen address by loopback
+func localDialAddress(listenAddr string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	switch ip := net.ParseIP(host); {
+	case host == "":
+		host = "127.0.0.1"
+	case ip != nil && ip.IsUnspecified() && ip.To4() != nil:
+		host = "127.0.0.1"
+	case ip != nil && ip.IsUnspecified():
+		host = "::1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (m *Manager) httpPreflightDomain(ctx context.Context, d domain.DomainName) error {
+	uuid := fastuuid.MustUUIDv4()
+	token := "preflight-" + hex.EncodeToString(uuid[:])
+	answer := "preflight-answer-" + token
+
+	key := d.ASCII() + "/" + token
+	if err := m.httpTokens.Put(ctx, key, []byte(answer)); err != nil {
+		return xerrors.Errorf("put preflight token: %w", err)
+	}
+	defer func() {
+		_ = m.httpTokens.Delete(ctx, key)
+	}()
+
+	checkURL, err := url.Parse(m.HTTPPreflight.CheckerURL)
+	if err != nil {
+		return xerrors.Errorf("parse checker url: %w", err)
+	}
+	query := checkURL.Query()
+	query.Set("url", "http://"+d.ASCII()+httpWellKnown+token)
+	checkURL.RawQuery = query.Encode()
+
+	client := m.HTTPPreflight.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: httpPreflightTimeout}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkURL.String(), nil)
+	if err != nil {
+		return xerrors.Errorf("create checker request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return xerrors.Errorf("request to checker: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpPreflightMaxResponseSize))
+	if err != nil {
+		return xerrors.Errorf("read checker response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != answer {
+		return xerrors.Errorf("checker can't get preflight token, status: %v, body: %q", resp.StatusCode, body)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestLocalDialAddress(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	td.Cmp(localDialAddress(":80"), "127.0.0.1:80")
+	td.Cmp(localDialAddress("0.0.0.0:80"), "127.0.0.1:80")
+	td.Cmp(localDialAddress("[::]:80"), "[::1]:80")
+	td.Cmp(localDialAddress("1.2.3.4:80"), "1.2.3.4:80")
+	td.Cmp(localDialAddress("bad"), "bad")
+}
+
+func TestManager_HTTPPreflightChallenges(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	m := New(nil, nil, nil)
+	m.EnableHTTPValidation = true
+	challenges := m.supportedChallenges()
+	e.Cmp(challenges, []string{tlsAlpn01, http01})
+
+	// without preflight
+	e.Cmp(m.httpPreflightChallenges(ctx, challenges, []domain.DomainName{"a.ru"}), challenges)
+
+	listener := th.NewLocalTcpListener(e)
+	var checkerFail int32
+	checker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// emulate fetch url from internet
+		fetchURL, err := url.Parse(r.URL.Query().Get("url"))
+		e.CmpNoError(err)
+		if atomic.LoadInt32(&checkerFail) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		m.HandleHTTPValidation(w, httptest.NewRequest(http.MethodGet, fetchURL.String(), nil).WithContext(ctx))
+	}))
+	defer checker.Close()
+
+	m.HTTPPreflight = &HTTPPreflight{ListenAddresses: []string{listener.Addr().String()}, CheckerURL: checker.URL}
+	m.HTTPPreflightFallback = true
+	e.Cmp(m.httpPreflightChallenges(ctx, challenges, []domain.DomainName{"a.ru", "b.ru"}), challenges)
+
+	atomic.StoreInt32(&checkerFail, 1)
+	e.Cmp(m.httpPreflightChallenges(ctx, challenges, []domain.DomainName{"a.ru"}), []string{tlsAlpn01})
+	e.Cmp(m.httpPreflightChallenges(ctx, []string{http01}, []domain.DomainName{"a.ru"}), []string{http01})
+
+	m.HTTPPreflightFallback = false
+	e.Cmp(m.httpPreflightChallenges(ctx, challenges, []domain.DomainName{"a.ru"}), challenges)
+
+	// listener doesn't accept connections
+	atomic.StoreInt32(&checkerFail, 0)
+	m.HTTPPreflightFallback = true
+	addr := listener.Addr().String()
+	e.CmpNoError(listener.Close())
+	m.HTTPPreflight = &HTTPPreflight{ListenAddresses: []string{addr}}
+	e.Cmp(m.httpPreflightChallenges(ctx, challenges, []domain.DomainName{"a.ru"}), []string{tlsAlpn01})
+
+	m.HTTPPreflight = &HTTPPreflight{}
+	e.CmpError(m.httpPreflight(ctx, []domain.DomainName{"a.ru"}))
+}
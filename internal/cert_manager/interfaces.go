@@ -5,6 +5,8 @@ import (
 	"context"
 	"crypto/tls"
 
+	"github.com/rekby/lets-proxy2/internal/acme_client_manager"
+	"github.com/rekby/lets-proxy2/internal/events"
 	"golang.org/x/crypto/acme"
 )
 
@@ -32,8 +34,23 @@ type AcmeClientManager interface {
 	GetClient(ctx context.Context) (client *acme.Client, clientDisableFunc func(), err error)
 }
 
+// accountProblemReporter - acme client manager, which handle errors of acme account
+// (acme_client_manager.AcmeManager). It return true if issue can be retried with next client.
+type accountProblemReporter interface {
+	ReportAccountProblem(ctx context.Context, client *acme.Client, problem error) (retry bool)
+}
+
+var _ accountProblemReporter = &acme_client_manager.AcmeManager{}
+
+type EventPublisher interface {
+	// Publish must not block
+	Publish(event events.Event)
+}
+
 type managerDefaults struct{}
 
 func (managerDefaults) IsDomainAllowed(ctx context.Context, domain string) (bool, error) {
 	return true, nil
 }
+
+func (managerDefaults) Publish(events.Event) {}
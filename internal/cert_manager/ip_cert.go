@@ -0,0 +1,105 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+)
+
+// after failed issue of ip certificate next try allowed after the interval:
+// many CAs don't issue certificates for ip addresses, it prevent order on every handshake
+const ipCertRetryInterval = time.Hour
+
+// helloIP return ip address for certificate, if client connect by ip address:
+// with empty SNI (local address of connection used) or with ip address in SNI.
+// It return nil if client request certificate for domain or ip certificates disabled.
+func (m *Manager) helloIP(hello *tls.ClientHelloInfo) net.IP {
+	if !m.AllowIPCerts {
+		return nil
+	}
+	if hello.ServerName != "" {
+		return net.ParseIP(hello.ServerName)
+	}
+	if hello.Conn == nil {
+		return nil
+	}
+	if addr, ok := hello.Conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// isIPAllowed return true if ip certificates enabled and ip contained in AllowedIPs
+func (m *Manager) isIPAllowed(d domain.DomainName) bool {
+	if !m.AllowIPCerts {
+		return false
+	}
+	ip := net.ParseIP(d.String())
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range m.AllowedIPs {
+		if allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIPCertDelayed return true if issue certificate for ip failed less then ipCertRetryInterval ago
+func (m *Manager) isIPCertDelayed(d domain.DomainName, now time.Time) bool {
+	m.ipCertFailuresMu.Lock()
+	defer m.ipCertFailuresMu.Unlock()
+
+	failed, ok := m.ipCertFailures[d]
+	return ok && now.Sub(failed) < ipCertRetryInterval
+}
+
+// ipCertIssueResult remember time of failed issue or forget previous failure after success
+func (m *Manager) ipCertIssueResult(d domain.DomainName, err error, now time.Time) {
+	m.ipCertFailuresMu.Lock()
+	defer m.ipCertFailuresMu.Unlock()
+
+	if err == nil {
+		delete(m.ipCertFailures, d)
+		return
+	}
+	if m.ipCertFailures == nil {
+		m.ipCertFailures = make(map[domain.DomainName]time.Time)
+	}
+	m.ipCertFailures[d] = now
+}
+
+// normalizeHost return normalized domain or ip address (without brackets and port) from host header
+func normalizeHost(host string) (domain.DomainName, error) {
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")); ip != nil {
+		return domain.DomainName(ip.String()), nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		if ip := net.ParseIP(h); ip != nil {
+			return domain.DomainName(ip.String()), nil
+		}
+	}
+	return domain.NormalizeDomain(host)
+}
+
+// isIPName return true if name is ip address
+func isIPName(name string) bool {
+	return net.ParseIP(name) != nil
+}
+
+// splitIPNames split names to dns names and ip addresses
+func splitIPNames(names []domain.DomainName) (dnsNames []string, ips []net.IP) {
+	for _, name := range names {
+		if ip := net.ParseIP(name.String()); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, name.String())
+		}
+	}
+	return dnsNames, ips
+}
@@ -0,0 +1,97 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+)
+
+func TestManager_HelloIP(t *testing.T) {
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	conn := NewConnMock(mc)
+	conn.LocalAddrMock.Return(&net.TCPAddr{IP: net.ParseIP("203.0.113.10"), Port: 443})
+
+	m := &Manager{}
+	td.Nil(m.helloIP(&tls.ClientHelloInfo{ServerName: "1.2.3.4"}))
+
+	m.AllowIPCerts = true
+	td.Cmp(m.helloIP(&tls.ClientHelloInfo{ServerName: "1.2.3.4"}), net.ParseIP("1.2.3.4"))
+	td.Nil(m.helloIP(&tls.ClientHelloInfo{ServerName: "example.com"}))
+	td.Cmp(m.helloIP(&tls.ClientHelloInfo{Conn: conn}), net.ParseIP("203.0.113.10"))
+}
+
+func TestManager_IsIPAllowed(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := &Manager{AllowedIPs: []net.IP{net.ParseIP("203.0.113.10"), net.ParseIP("2001:db8::10")}}
+	td.False(m.isIPAllowed("203.0.113.10"))
+
+	m.AllowIPCerts = true
+	td.True(m.isIPAllowed("203.0.113.10"))
+	td.True(m.isIPAllowed("2001:db8::10"))
+	td.False(m.isIPAllowed("203.0.113.11"))
+	td.False(m.isIPAllowed("example.com"))
+}
+
+func TestManager_IPCertDelayed(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := &Manager{}
+	now := time.Now()
+	td.False(m.isIPCertDelayed("1.2.3.4", now))
+
+	m.ipCertIssueResult("1.2.3.4", errors.New("test"), now)
+	td.True(m.isIPCertDelayed("1.2.3.4", now.Add(time.Minute)))
+	td.False(m.isIPCertDelayed("1.2.3.5", now.Add(time.Minute)))
+	td.False(m.isIPCertDelayed("1.2.3.4", now.Add(ipCertRetryInterval)))
+
+	m.ipCertIssueResult("1.2.3.4", nil, now)
+	td.False(m.isIPCertDelayed("1.2.3.4", now))
+}
+
+func TestNormalizeHost(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	for host, expected := range map[string]domain.DomainName{
+		"1.2.3.4":              "1.2.3.4",
+		"1.2.3.4:80":           "1.2.3.4",
+		"[2001:db8::10]":       "2001:db8::10",
+		"[2001:DB8::10]:80":    "2001:db8::10",
+		"Example.com":          "example.com",
+		"example.com:80":       "example.com",
+		"2001:db8:0:0:0:0:0:1": "2001:db8::1",
+	} {
+		res, err := normalizeHost(host)
+		td.CmpNoError(err, host)
+		td.Cmp(res, expected, host)
+	}
+}
+
+func TestManager_OrderChallenges(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := &Manager{EnableTLSValidation: true, EnableHTTPValidation: true}
+	td.Cmp(m.orderChallenges([]domain.DomainName{"example.com"}), []string{tlsAlpn01, http01})
+	td.Cmp(m.orderChallenges([]domain.DomainName{"1.2.3.4"}), []string{http01})
+
+	m.EnableHTTPValidation = false
+	td.Cmp(m.orderChallenges([]domain.DomainName{"1.2.3.4"}), testdeep.Empty())
+}
+
+func TestCertDescriptionFromDomainIP(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	td.Cmp(CertDescriptionFromDomain("1.2.3.4", KeyRSA, []string{"www."}),
+		CertDescription{MainDomain: "1.2.3.4", KeyType: KeyRSA})
+}
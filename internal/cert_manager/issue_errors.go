@@ -0,0 +1,188 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+)
+
+// Kinds of certificate issue failures. Errors of failed issue are *IssueError, which match its kind by xerrors.Is
+// and unwrap to original error (acme errors, network errors, etc.).
+var (
+	ErrRateLimited      = xerrors.New("rate limited by acme server")
+	ErrDomainNotAllowed = xerrors.New("domain not allowed for certificate")
+	ErrChallengeFailed  = xerrors.New("challenge validation failed")
+	ErrCARejected       = xerrors.New("rejected by acme server")
+	ErrIssueTimeout     = xerrors.New("certificate issue timeout")
+	ErrIssueFailed      = xerrors.New("certificate issue failed") // other failures
+)
+
+// issueErrorCategories - names of failure kinds for metrics and admin listing, in order of metrics
+var issueErrorCategories = []struct {
+	name string
+	kind error
+}{
+	{"rate_limited", ErrRateLimited},
+	{"domain_not_allowed", ErrDomainNotAllowed},
+	{"challenge_failed", ErrChallengeFailed},
+	{"ca_rejected", ErrCARejected},
+	{"timeout", ErrIssueTimeout},
+	{"other", ErrIssueFailed},
+}
+
+// maxIssueFailures - max count of remembered last failures for admin listing, oldest forgotten first
+const maxIssueFailures = 1000
+
+// acme problem types of failed validation, rfc 8555 section 6.7
+var challengeProblemTypes = map[string]bool{
+	"urn:ietf:params:acme:error:connection":        true,
+	"urn:ietf:params:acme:error:dns":               true,
+	"urn:ietf:params:acme:error:incorrectResponse": true,
+	"urn:ietf:params:acme:error:tls":               true,
+	"urn:ietf:params:acme:error:unauthorized":      true,
+}
+
+const rateLimitedProblemType = "urn:ietf:params:acme:error:rateLimited"
+
+// IssueError - failed certificate issue with kind of failure
+type IssueError struct {
+	Kind error // one of ErrRateLimited, ErrDomainNotAllowed, ErrChallengeFailed, ErrCARejected, ErrIssueTimeout, ErrIssueFailed
+	Err  error
+}
+
+func newIssueError(kind, err error) *IssueError {
+	return &IssueError{Kind: kind, Err: err}
+}
+
+func (e *IssueError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *IssueError) Unwrap() error {
+	return e.Err
+}
+
+// Is match kind of the error
+func (e *IssueError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Category return name of the failure kind: "rate_limited", "domain_not_allowed", "challenge_failed",
+// "ca_rejected", "timeout" or "other".
+func (e *IssueError) Category() string {
+	for _, category := range issueErrorCategories {
+		if category.kind == e.Kind {
+			return category.name
+		}
+	}
+	return "other"
+}
+
+// IssueErrorCategory return category of failed certificate issue,
+// empty string for nil and errors, which aren't IssueError.
+func IssueErrorCategory(err error) string {
+	var issueErr *IssueError
+	if xerrors.As(err, &issueErr) {
+		return issueErr.Category()
+	}
+	return ""
+}
+
+// classifyIssueError wrap error of certificate issue to IssueError by its cause
+func classifyIssueError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var issueErr *IssueError
+	if xerrors.As(err, &issueErr) {
+		return err
+	}
+
+	var acmeErr *acme.Error
+	var authzErr *acme.AuthorizationError
+	var orderErr *acme.OrderError
+	switch {
+	case xerrors.As(err, &acmeErr) && (acmeErr.ProblemType == rateLimitedProblemType || acmeErr.StatusCode == 429),
+		isErrTooManyOrders(err):
+		return newIssueError(ErrRateLimited, err)
+	case xerrors.As(err, &authzErr), xerrors.As(err, &orderErr),
+		xerrors.As(err, &acmeErr) && challengeProblemTypes[acmeErr.ProblemType]:
+		return newIssueError(ErrChallengeFailed, err)
+	case xerrors.As(err, &acmeErr):
+		return newIssueError(ErrCARejected, err)
+	case isTimeoutError(err):
+		return newIssueError(ErrIssueTimeout, err)
+	default:
+		return newIssueError(ErrIssueFailed, err)
+	}
+}
+
+type issueFailure struct {
+	cd       CertDescription
+	time     time.Time
+	category string
+	message  string
+	count    int // consecutive failures since last successful issue
+}
+
+// issueFailed count failure in metrics and remember it for admin listing until next successful issue
+func (m *Manager) issueFailed(cd CertDescription, err error, now time.Time) {
+	category := IssueErrorCategory(err)
+	for i := range m.issueFailureCounts {
+		if issueErrorCategories[i].name == category {
+			atomic.AddInt64(&m.issueFailureCounts[i], 1)
+		}
+	}
+
+	m.cachedCertsMu.Lock()
+	defer m.cachedCertsMu.Unlock()
+
+	// denied domains without known certificate aren't remembered: its count doesn't limited by known certificates.
+	// Denied renew of known certificate remembered for renewal backoff.
+	if _, known := m.cachedCerts[cd.String()]; category == "domain_not_allowed" && !known {
+		return
+	}
+
+	if m.issueFailures == nil {
+		m.issueFailures = make(map[string]issueFailure)
+	}
+	previous, exist := m.issueFailures[cd.String()]
+	if !exist && len(m.issueFailures) >= maxIssueFailures {
+		var oldestKey string
+		var oldest time.Time
+		for key, failure := range m.issueFailures {
+			if oldestKey == "" || failure.time.Before(oldest) {
+				oldestKey, oldest = key, failure.time
+			}
+		}
+		delete(m.issueFailures, oldestKey)
+	}
+	m.issueFailures[cd.String()] = issueFailure{cd: cd, time: now, category: category, message: err.Error(),
+		count: previous.count + 1}
+}
+
+// issueSucceeded forget last failure of certificate
+func (m *Manager) issueSucceeded(cd CertDescription) {
+	m.cachedCertsMu.Lock()
+	defer m.cachedCertsMu.Unlock()
+
+	delete(m.issueFailures, cd.String())
+}
+
+func (m *Manager) initIssueErrorMetrics(r prometheus.Registerer) {
+	m.issueFailureCounts = make([]int64, len(issueErrorCategories))
+	for i := range issueErrorCategories {
+		i := i
+		r.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "cert_issue_failures",
+			Help:        "Count of failed certificate issues by category",
+			ConstLabels: prometheus.Labels{"category": issueErrorCategories[i].name},
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&m.issueFailureCounts[i]))
+		}))
+	}
+}
@@ -0,0 +1,111 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+)
+
+func TestClassifyIssueError(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	td.Nil(classifyIssueError(nil))
+
+	table := []struct {
+		err      error
+		kind     error
+		category string
+	}{
+		{&acme.Error{StatusCode: http.StatusTooManyRequests, ProblemType: rateLimitedProblemType}, ErrRateLimited, "rate_limited"},
+		{errors.New("too many new orders recently"), ErrRateLimited, "rate_limited"},
+		{xerrors.Errorf("order authorization: %w", &acme.OrderError{Status: acme.StatusInvalid}), ErrChallengeFailed, "challenge_failed"},
+		{&acme.AuthorizationError{URI: "http://test"}, ErrChallengeFailed, "challenge_failed"},
+		{&acme.Error{StatusCode: http.StatusForbidden, ProblemType: "urn:ietf:params:acme:error:unauthorized"}, ErrChallengeFailed, "challenge_failed"},
+		{&acme.Error{StatusCode: http.StatusBadRequest, ProblemType: "urn:ietf:params:acme:error:rejectedIdentifier"}, ErrCARejected, "ca_rejected"},
+		{xerrors.Errorf("context canceled: %w", context.DeadlineExceeded), ErrIssueTimeout, "timeout"},
+		{errors.New("test"), ErrIssueFailed, "other"},
+		{errDomainDenied, ErrDomainNotAllowed, "domain_not_allowed"},
+	}
+	for _, test := range table {
+		res := classifyIssueError(test.err)
+		td.True(xerrors.Is(res, test.kind), test.err.Error())
+		td.True(xerrors.Is(res, test.err), test.err.Error())
+		td.Cmp(IssueErrorCategory(res), test.category, test.err.Error())
+
+		var issueErr *IssueError
+		td.True(xerrors.As(res, &issueErr))
+		td.Cmp(issueErr.Kind, test.kind)
+	}
+
+	td.Cmp(IssueErrorCategory(nil), "")
+	td.Cmp(IssueErrorCategory(errHaveNoCert), "")
+	td.True(xerrors.Is(errDomainDenied, domain.ErrDomainDenied))
+	td.False(xerrors.Is(errDomainDenied, ErrIssueFailed))
+}
+
+func TestManager_IssueFailures(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := &Manager{}
+	m.initIssueErrorMetrics(prometheus.NewRegistry())
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	failed := CertDescription{MainDomain: "failed.com", KeyType: KeyRSA}
+	cached := CertDescription{MainDomain: "cached.com", KeyType: KeyRSA}
+	m.cachedCertUpdate(cached, nil, now, true)
+
+	challengeErr := classifyIssueError(&acme.AuthorizationError{URI: "http://test"})
+	m.issueFailed(failed, challengeErr, now)
+	m.issueFailed(cached, classifyIssueError(errors.New("test")), now)
+	m.issueFailed(CertDescription{MainDomain: "denied.com", KeyType: KeyRSA}, errDomainDenied, now)
+
+	td.Cmp(m.Certs(), []CertInfo{
+		{Name: "cached.com", KeyType: "rsa", Mode: certModeOnDemand, LastServed: &now,
+			IssueErrorTime: &now, IssueErrorCategory: "other", IssueError: "certificate issue failed: test",
+			IssueFailures: 1},
+		{Name: "failed.com", KeyType: "rsa", Mode: certModeOnDemand,
+			IssueErrorTime: &now, IssueErrorCategory: "challenge_failed", IssueError: challengeErr.Error(),
+			IssueFailures: 1},
+	})
+	td.Cmp(m.issueFailureCounts, []int64{0, 1, 1, 0, 0, 1})
+
+	m.issueSucceeded(failed)
+	m.issueSucceeded(cached)
+	td.Cmp(m.Certs(), []CertInfo{{Name: "cached.com", KeyType: "rsa", Mode: certModeOnDemand, LastServed: &now}})
+
+	for i := 0; i <= maxIssueFailures; i++ {
+		m.issueFailed(CertDescription{MainDomain: "failed.com", KeyType: KeyRSA, Group: string(rune('a' + i))},
+			classifyIssueError(errors.New("test")), now.Add(time.Duration(i)*time.Second))
+	}
+	td.Cmp(m.issueFailures, testdeep.Len(maxIssueFailures))
+	td.Cmp(m.issueFailures, testdeep.Not(testdeep.ContainsKey(CertDescription{MainDomain: "failed.com", KeyType: KeyRSA,
+		Group: "a"}.String())))
+	td.Cmp(m.issueFailures, testdeep.ContainsKey(CertDescription{MainDomain: "failed.com", KeyType: KeyRSA,
+		Group: "b"}.String()))
+}
+
+func TestManager_GetCertificateIssueError(t *testing.T) {
+	td := testdeep.NewT(t)
+	c, cancel := createManager(t)
+	defer cancel()
+
+	c.certState.GetMock.Return(&certState{}, nil)
+	c.cache.GetMock.Return(nil, cache.ErrCacheMiss)
+	c.domainChecker.IsDomainAllowedMock.Return(false, nil)
+
+	_, err := c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: "test.ru"})
+	td.True(xerrors.Is(err, ErrDomainNotAllowed))
+	td.True(xerrors.Is(err, domain.ErrDomainDenied))
+}
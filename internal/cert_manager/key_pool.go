@@ -0,0 +1,213 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// KeyPool generate private keys of new certificates in background, for issue certificates without wait
+// of key generation (RSA keys generate slow). Pool refilled after every taken key.
+type KeyPool struct {
+	Size     int           // count of ready keys of every type
+	KeyTypes []KeyType     // types of pregenerated keys
+	MaxAge   time.Duration // unused keys older than MaxAge replaced by new, 0 - keep keys until used
+
+	mu      sync.Mutex
+	keys    map[KeyType][]pooledKey
+	started bool
+	refill  chan struct{}
+
+	hits   int64
+	misses int64
+}
+
+type pooledKey struct {
+	key     crypto.Signer
+	created time.Time
+}
+
+// NewKeyPool validate settings and create empty pool, it filled after Start
+func NewKeyPool(size int, keyTypes []KeyType, maxAge time.Duration) (*KeyPool, error) {
+	if size <= 0 {
+		return nil, xerrors.Errorf("key pool size must be positive, got: %v", size)
+	}
+	if maxAge < 0 {
+		return nil, xerrors.Errorf("negative max age of keys in pool: %v", maxAge)
+	}
+	if len(keyTypes) == 0 {
+		return nil, xerrors.New("key pool without key types")
+	}
+	for _, keyType := range keyTypes {
+		if keyType != KeyRSA && keyType != KeyECDSA {
+			return nil, xerrors.Errorf("unknown key type for key pool: %q", keyType)
+		}
+	}
+	return &KeyPool{Size: size, KeyTypes: keyTypes, MaxAge: maxAge, keys: make(map[KeyType][]pooledKey),
+		refill: make(chan struct{}, 1)}, nil
+}
+
+// Start fill the pool in background until ctx canceled. Keys of the pool dropped after stop.
+func (p *KeyPool) Start(ctx context.Context) {
+	p.mu.Lock()
+	p.started = true
+	p.mu.Unlock()
+
+	go func() {
+		logger := zc.L(ctx).Named("key_pool")
+		defer log.HandlePanic(logger)
+
+		defer func() {
+			p.mu.Lock()
+			p.started = false
+			p.keys = make(map[KeyType][]pooledKey)
+			p.mu.Unlock()
+			logger.Info("Key pool stopped")
+		}()
+
+		var expireCheck <-chan time.Time
+		if p.MaxAge > 0 {
+			ticker := time.NewTicker(p.MaxAge / 2)
+			defer ticker.Stop()
+			expireCheck = ticker.C
+		}
+
+		logger.Info("Key pool started", zap.Int("size", p.Size), zap.Any("key_types", p.KeyTypes),
+			zap.Duration("max_age", p.MaxAge))
+		for {
+			p.fill(ctx, logger)
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.refill:
+			case <-expireCheck:
+			}
+		}
+	}()
+}
+
+// fill remove expired keys and generate keys while pool isn't full. Key generated without lock.
+func (p *KeyPool) fill(ctx context.Context, logger *zap.Logger) {
+	p.removeExpired(time.Now())
+	for _, keyType := range p.KeyTypes {
+		for p.count(keyType) < p.Size {
+			if ctx.Err() != nil {
+				return
+			}
+			key, err := keyType.Generate()
+			if err != nil {
+				logger.Error("Generate key for pool", zap.Stringer("key_type", keyType), zap.Error(err))
+				return
+			}
+
+			p.mu.Lock()
+			if p.started {
+				p.keys[keyType] = append(p.keys[keyType], pooledKey{key: key, created: time.Now()})
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *KeyPool) count(keyType KeyType) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.keys[keyType])
+}
+
+func (p *KeyPool) removeExpired(now time.Time) {
+	if p.MaxAge <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for keyType, keys := range p.keys {
+		fresh := keys[:0]
+		for _, key := range keys {
+			if now.Sub(key.created) < p.MaxAge {
+				fresh = append(fresh, key)
+			}
+		}
+		for i := len(fresh); i < len(keys); i++ {
+			keys[i] = pooledKey{} // drop reference to removed key
+		}
+		p.keys[keyType] = fresh
+	}
+}
+
+// get take key from pool and start refill. Return false if pool is nil, empty or has expired keys only.
+func (p *KeyPool) get(keyType KeyType, now time.Time) (crypto.Signer, bool) {
+	if p == nil {
+		return nil, false
+	}
+
+	p.mu.Lock()
+	var res crypto.Signer
+	keys := p.keys[keyType]
+	for len(keys) > 0 && res == nil {
+		last := keys[len(keys)-1]
+		keys[len(keys)-1] = pooledKey{}
+		keys = keys[:len(keys)-1]
+		if p.MaxAge <= 0 || now.Sub(last.created) < p.MaxAge {
+			res = last.key
+		}
+	}
+	p.keys[keyType] = keys
+	p.mu.Unlock()
+
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+
+	if res == nil {
+		atomic.AddInt64(&p.misses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&p.hits, 1)
+	return res, true
+}
+
+// InitMetrics register counters of taken keys and count of ready keys
+func (p *KeyPool) InitMetrics(registry prometheus.Registerer) {
+	if p == nil || registry == nil || reflect.ValueOf(registry).IsNil() {
+		return
+	}
+
+	registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "key_pool_hits", Help: "Count of keys for new certificates, taken from key pool",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&p.hits))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "key_pool_misses", Help: "Count of keys for new certificates, generated because key pool was empty",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&p.misses))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "key_pool_ready_keys", Help: "Count of ready keys in key pool",
+		}, func() float64 {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			res := 0
+			for _, keys := range p.keys {
+				res += len(keys)
+			}
+			return float64(res)
+		}),
+	)
+}
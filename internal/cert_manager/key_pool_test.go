@@ -0,0 +1,90 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestNewKeyPool(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	_, err := NewKeyPool(0, []KeyType{KeyECDSA}, 0)
+	td.CmpError(err)
+	_, err = NewKeyPool(1, nil, 0)
+	td.CmpError(err)
+	_, err = NewKeyPool(1, []KeyType{"bad"}, 0)
+	td.CmpError(err)
+	_, err = NewKeyPool(1, []KeyType{KeyECDSA}, -time.Second)
+	td.CmpError(err)
+
+	var nilPool *KeyPool
+	_, ok := nilPool.get(KeyECDSA, time.Now())
+	td.False(ok)
+}
+
+func TestKeyPool(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	pool, err := NewKeyPool(2, []KeyType{KeyECDSA}, time.Hour)
+	td.CmpNoError(err)
+
+	_, ok := pool.get(KeyECDSA, time.Now())
+	td.False(ok, "empty before start")
+
+	ctx, cancel := context.WithCancel(ctx)
+	pool.Start(ctx)
+
+	waitCount := func(count int) {
+		t.Helper()
+		for i := 0; i < 1000 && pool.count(KeyECDSA) != count; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		td.Cmp(pool.count(KeyECDSA), count)
+	}
+
+	waitCount(2)
+	key, ok := pool.get(KeyECDSA, time.Now())
+	td.True(ok)
+	td.Isa(key, &ecdsa.PrivateKey{})
+	waitCount(2) // refilled
+
+	_, ok = pool.get(KeyRSA, time.Now())
+	td.False(ok, "key type without pool")
+
+	// expired keys doesn't returned
+	_, ok = pool.get(KeyECDSA, time.Now().Add(2*time.Hour))
+	td.False(ok)
+
+	m := &Manager{KeyPool: pool}
+	waitCount(2)
+	key, err = m.certKeyGetOrCreate(ctx, CertDescription{MainDomain: "example.com", KeyType: KeyECDSA})
+	td.CmpNoError(err)
+	td.NotNil(key)
+	td.Cmp(pool.hits, int64(2))
+	td.Cmp(pool.misses, int64(3))
+
+	cancel()
+	waitCount(0)
+}
+
+func TestKeyPool_RemoveExpired(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	pool, err := NewKeyPool(2, []KeyType{KeyECDSA}, time.Hour)
+	td.CmpNoError(err)
+
+	now := time.Now()
+	pool.keys[KeyECDSA] = []pooledKey{{created: now.Add(-2 * time.Hour)}, {created: now}}
+	pool.removeExpired(now)
+	td.Cmp(pool.keys[KeyECDSA], []pooledKey{{created: now}})
+}
@@ -0,0 +1,224 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// DefaultManagedCheckInterval - interval of check certificates of managed domains if ManagedCheckInterval is zero
+const DefaultManagedCheckInterval = time.Hour
+
+const (
+	certModeManaged  = "managed"
+	certModeOnDemand = "on-demand"
+)
+
+// CertInfo - info about cached certificate for admin listing
+type CertInfo struct {
+	Name       string     `json:"name"`
+	KeyType    string     `json:"key_type"`
+	Mode       string     `json:"mode"`
+	Expire     *time.Time `json:"expire,omitempty"`
+	LastServed *time.Time `json:"last_served,omitempty"`
+
+	// last failed issue after last successful issue, category by IssueErrorCategory
+	IssueErrorTime     *time.Time `json:"issue_error_time,omitempty"`
+	IssueErrorCategory string     `json:"issue_error_category,omitempty"`
+	IssueError         string     `json:"issue_error,omitempty"`
+	IssueFailures      int        `json:"issue_failures,omitempty"` // consecutive failures
+
+	// renew failed Manager.RenewalFailingAfter times, NextRenewAttempt - end of backoff after last failure
+	RenewalFailing   bool       `json:"renewal_failing,omitempty"`
+	NextRenewAttempt *time.Time `json:"next_renew_attempt,omitempty"`
+}
+
+func (m *Manager) newCertInfo(cd CertDescription) CertInfo {
+	res := CertInfo{Name: cd.MainDomain, KeyType: cd.KeyType.String(), Mode: certModeOnDemand}
+	if cd.Group != "" {
+		res.Name = certGroupStorePrefix + cd.Group
+	}
+	if m.isManagedCert(cd) {
+		res.Mode = certModeManaged
+	}
+	return res
+}
+
+// StartManaged issue certificates of ManagedDomains, which have no certificates, and renew its certificates
+// in renewal window. Check repeated every ManagedCheckInterval until ctx canceled.
+// Must be called after start listeners, which answer to acme challenges.
+func (m *Manager) StartManaged(ctx context.Context) {
+	if len(m.ManagedDomains) == 0 {
+		return
+	}
+	interval := m.ManagedCheckInterval
+	if interval <= 0 {
+		interval = DefaultManagedCheckInterval
+	}
+
+	go func() {
+		logger := zc.L(ctx).Named("managed")
+		defer log.HandlePanic(logger)
+
+		ctx := zc.WithLogger(ctx, logger)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			m.checkManagedCerts(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// checkManagedCerts get certificates of all allowed key types for every managed domain.
+// getCertificate issue absent certificates and start renew in background if need.
+func (m *Manager) checkManagedCerts(ctx context.Context) {
+	logger := zc.L(ctx)
+	for _, d := range m.ManagedDomains {
+		for _, keyType := range m.allowedKeyTypes() {
+			if ctx.Err() != nil {
+				return
+			}
+			domainCtx := zc.WithLogger(ctx, logger.With(domain.LogDomain(d), zap.Stringer("key_type", keyType)))
+			cert, err := m.getCertificate(domainCtx, d, keyType)
+			log.InfoError(zc.L(domainCtx), err, "Check managed certificate", log.Cert(cert))
+		}
+	}
+}
+
+func (m *Manager) allowedKeyTypes() []KeyType {
+	var res []KeyType
+	if m.AllowECDSACert {
+		res = append(res, KeyECDSA)
+	}
+	if m.AllowRSACert {
+		res = append(res, KeyRSA)
+	}
+	return res
+}
+
+// isManagedDomain return true if domain contained in ManagedDomains
+func (m *Manager) isManagedDomain(d domain.DomainName) bool {
+	for _, managed := range m.ManagedDomains {
+		if managed == d {
+			return true
+		}
+	}
+	return false
+}
+
+// isManagedCert return true if certificate contains managed domain.
+// Certificate description may be restored from store name, without subdomains and group domains.
+func (m *Manager) isManagedCert(cd CertDescription) bool {
+	if len(m.ManagedDomains) == 0 {
+		return false
+	}
+	if cd.Group != "" {
+		for _, group := range m.CertGroups {
+			if group.Name != cd.Group {
+				continue
+			}
+			for _, d := range group.Domains {
+				if m.isManagedDomain(d) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if m.isManagedDomain(domain.DomainName(cd.MainDomain)) {
+		return true
+	}
+	for _, subdomain := range m.autoSubdomains() {
+		if m.isManagedDomain(domain.DomainName(subdomain + cd.MainDomain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// managedDomainChecker allow managed domains and allowed ip addresses, check other domains by DomainChecker
+type managedDomainChecker struct {
+	m *Manager
+}
+
+func (c managedDomainChecker) IsDomainAllowed(ctx context.Context, d string) (bool, error) {
+	if c.m.isManagedDomain(domain.DomainName(d)) || c.m.isIPAllowed(domain.DomainName(d)) {
+		return true, nil
+	}
+	return c.m.DomainChecker.IsDomainAllowed(ctx, d)
+}
+
+// Certs return sorted list of cached certificates and certificates with failed last issue
+func (m *Manager) Certs() []CertInfo {
+	m.cachedCertsMu.Lock()
+	res := make([]CertInfo, 0, len(m.cachedCerts))
+	for key, info := range m.cachedCerts {
+		item := m.newCertInfo(info.cd)
+		if !info.expire.IsZero() {
+			expire := info.expire
+			item.Expire = &expire
+		}
+		if !info.lastServed.IsZero() {
+			lastServed := info.lastServed
+			item.LastServed = &lastServed
+		}
+		if failure, ok := m.issueFailures[key]; ok {
+			m.setIssueFailure(&item, failure)
+		}
+		res = append(res, item)
+	}
+	for key, failure := range m.issueFailures {
+		if _, ok := m.cachedCerts[key]; ok {
+			continue
+		}
+		item := m.newCertInfo(failure.cd)
+		m.setIssueFailure(&item, failure)
+		res = append(res, item)
+	}
+	m.cachedCertsMu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Name != res[j].Name {
+			return res[i].Name < res[j].Name
+		}
+		return res[i].KeyType < res[j].KeyType
+	})
+	return res
+}
+
+func (m *Manager) setIssueFailure(info *CertInfo, failure issueFailure) {
+	failureTime := failure.time
+	info.IssueErrorTime = &failureTime
+	info.IssueErrorCategory = failure.category
+	info.IssueError = failure.message
+	info.IssueFailures = failure.count
+	info.RenewalFailing = m.isFailureRenewalFailing(failure)
+	if backoff := m.renewalBackoff(failure.count); backoff > 0 {
+		nextAttempt := failure.time.Add(backoff)
+		info.NextRenewAttempt = &nextAttempt
+	}
+}
+
+// CertsHandler return cached certificates and its mode (managed or on-demand) as json
+func (m *Manager) CertsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(m.Certs())
+	})
+}
@@ -0,0 +1,120 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestManager_IsManagedCert(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := &Manager{
+		ManagedDomains: []domain.DomainName{"a.ru", "www.b.ru", "c.ru"},
+		AutoSubdomains: []string{"www."},
+		CertGroups:     []CertGroup{{Name: "g", Domains: []domain.DomainName{"c.ru", "d.ru"}}},
+	}
+
+	td.True(m.isManagedCert(CertDescription{MainDomain: "a.ru", KeyType: KeyRSA}))
+	td.True(m.isManagedCert(CertDescription{MainDomain: "b.ru", KeyType: KeyRSA}))
+	td.True(m.isManagedCert(CertDescription{Group: "g", KeyType: KeyECDSA}))
+	td.False(m.isManagedCert(CertDescription{MainDomain: "d.ru", KeyType: KeyRSA}))
+	td.False(m.isManagedCert(CertDescription{Group: "other", KeyType: KeyECDSA}))
+
+	td.True(m.isManagedDomain("www.b.ru"))
+	td.False(m.isManagedDomain("b.ru"))
+}
+
+func TestManagedDomainChecker(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	checker := NewDomainCheckerMock(mc)
+	checker.IsDomainAllowedMock.Expect(ctx, "other.ru").Return(false, nil)
+
+	m := &Manager{ManagedDomains: []domain.DomainName{"managed.ru"}, DomainChecker: checker}
+	domains, err := filterDomains(ctx, managedDomainChecker{m: m}, []domain.DomainName{"managed.ru", "other.ru"}, "managed.ru")
+	td.CmpNoError(err)
+	td.Cmp(domains, []domain.DomainName{"managed.ru"})
+}
+
+func TestManager_EvictCachedCertsManaged(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := &cache.DiskCache{Dir: th.TmpDir(e)}
+	for _, key := range []string{"a.ru.rsa.cer", "b.ru.rsa.cer", "c.ru.rsa.cer"} {
+		e.CmpNoError(storage.Put(ctx, key, []byte{}))
+	}
+
+	m := New(nil, storage, nil)
+	m.MaxCachedCerts = 1
+	m.ManagedDomains = []domain.DomainName{"a.ru"}
+	e.CmpNoError(m.LoadCachedCertsList(ctx))
+
+	m.evictCachedCerts(ctx, CertDescription{MainDomain: "c.ru", KeyType: KeyRSA}, time.Now())
+
+	keys, err := storage.Keys(ctx)
+	e.CmpNoError(err)
+	e.Cmp(keys, testdeep.Bag("a.ru.rsa.cer", "c.ru.rsa.cer"))
+}
+
+func TestManager_CertsHandler(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := New(nil, newCacheMock(td), nil)
+	m.ManagedDomains = []domain.DomainName{"a.ru"}
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	m.cachedCertUpdate(CertDescription{MainDomain: "b.ru", KeyType: KeyECDSA}, nil, now, true)
+	m.cachedCertUpdate(CertDescription{MainDomain: "a.ru", KeyType: KeyRSA},
+		&tls.Certificate{Leaf: &x509.Certificate{NotAfter: now.Add(time.Hour)}}, now, false)
+
+	resp := httptest.NewRecorder()
+	m.CertsHandler().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/certs", nil))
+	td.Cmp(resp.Header().Get("Content-Type"), "application/json")
+
+	var res []map[string]interface{}
+	td.CmpNoError(json.Unmarshal(resp.Body.Bytes(), &res))
+	td.Cmp(res, []map[string]interface{}{
+		{"name": "a.ru", "key_type": "rsa", "mode": "managed", "expire": "2026-01-02T04:04:05Z"},
+		{"name": "b.ru", "key_type": "ecdsa", "mode": "on-demand", "last_served": "2026-01-02T03:04:05Z"},
+	})
+}
+
+func TestManager_CheckManagedCerts(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	m := &Manager{ManagedDomains: []domain.DomainName{"a.ru"}}
+	td.Cmp(m.allowedKeyTypes(), testdeep.Empty())
+
+	m.AllowRSACert = true
+	m.AllowECDSACert = true
+	td.Cmp(m.allowedKeyTypes(), []KeyType{KeyECDSA, KeyRSA})
+
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	// must return without get certificates
+	m.checkManagedCerts(canceledCtx)
+}
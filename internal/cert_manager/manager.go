@@ -11,19 +11,21 @@ import (
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"reflect"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/rekby/lets-proxy2/internal/acme_client_manager"
 	"github.com/rekby/lets-proxy2/internal/domain"
-
-	"github.com/rekby/lets-proxy2/internal/contexthelper"
+	"github.com/rekby/lets-proxy2/internal/events"
 
 	"github.com/rekby/lets-proxy2/internal/metrics"
 
@@ -63,11 +65,18 @@ const domainKeyRSALength = 2048
 const renewBeforeExpire = time.Hour * 24 * 30
 const revokeAuthorizationTimeout = 5 * time.Minute
 const cleanupTimeout = time.Minute
+const wwwSubdomain = "www."
+
+// maxNeedDomainFallbackReserve - max part of issue timeout, reserved for issue certificate for need domain only
+const maxNeedDomainFallbackReserve = time.Minute
 
 var errHaveNoCert = errors.New("have no certificate for domain") // may return for any internal error
 var errRSADenied = xerrors.New("RSA certificate denied by config")
 var errECDSADenied = xerrors.New("ECDSA certificate denied by config")
 var errCertTypeUnknown = xerrors.New("unknown cert type")
+var errCertExpiredDenied = xerrors.New("expired certificate denied by OnExpiredCert policy")
+var errDomainDenied error = newIssueError(ErrDomainNotAllowed,
+	xerrors.Errorf("deny certificate issue by domain checker: %w", domain.ErrDomainDenied))
 
 type GetContext interface {
 	GetContext() context.Context
@@ -78,6 +87,25 @@ type KeyType string
 const KeyRSA KeyType = "rsa"
 const KeyECDSA KeyType = "ecdsa"
 
+// ExpiredCertPolicy is behavior of GetCertificate, when it found expired certificate in cache
+type ExpiredCertPolicy string
+
+const (
+	ExpiredCertReissue ExpiredCertPolicy = "reissue" // issue new certificate while handshake
+	ExpiredCertServe   ExpiredCertPolicy = "serve"   // return expired certificate (for debug)
+	ExpiredCertFail    ExpiredCertPolicy = "fail"    // abort handshake
+)
+
+// ParseExpiredCertPolicy parse ExpiredCertPolicy from string
+func ParseExpiredCertPolicy(s string) (ExpiredCertPolicy, error) {
+	switch policy := ExpiredCertPolicy(s); policy {
+	case ExpiredCertReissue, ExpiredCertServe, ExpiredCertFail:
+		return policy, nil
+	default:
+		return "", xerrors.Errorf("unknown expired cert policy: %q", s)
+	}
+}
+
 func (t KeyType) Generate() (crypto.Signer, error) {
 	switch t {
 	case KeyRSA:
@@ -98,12 +126,90 @@ type Manager struct {
 	CertificateIssueTimeout time.Duration
 	Cache                   cache.Bytes
 
+	// ValidationTimeout - max duration of order authorization (challenges validation) for one order.
+	// Order abandoned after timeout, certificate will be issued by next request. 0 - limited by CertificateIssueTimeout only.
+	ValidationTimeout time.Duration
+
 	// Subdomains, auto-issued with main domain.
 	// Every subdomain must have suffix dot. For example: "www."
 	AutoSubdomains []string
 
+	// AutoIncludeApexAndWww - include www subdomain within certificate of main domain (and main domain within
+	// certificate of www subdomain) even if "www." isn't in AutoSubdomains.
+	// If validation of auto-included domain failed - manager try to issue certificate for requested domain only
+	// and store it separately, shared certificate doesn't replaced by it.
+	AutoIncludeApexAndWww bool
+
+	// OnExpiredCert - behavior when expired certificate found in cache. Empty mean ExpiredCertReissue.
+	OnExpiredCert ExpiredCertPolicy
+
+	// MaxCachedCerts - max count of stored certificates, 0 - unlimited.
+	// Least recently served certificates removed from cache after issue new certificate over the limit.
+	MaxCachedCerts int
+
+	// ReuseKeyOnRenewal - issue certificates with stored key of certificate (if it strong enough) for keep
+	// TLSA records (see TLSA) valid. False - new key generated for every certificate.
+	// Forced key rotation available by RenewHandler.
+	ReuseKeyOnRenewal bool
+
+	// PinKeys - keep keys of certificates, evicted by MaxCachedCerts, for reuse by ReuseKeyOnRenewal on next issue.
+	PinKeys bool
+
+	// CacheGCRetention - certificates, expired and not served longer than the time, removed from cache by CacheGC.
+	// 0 - disable garbage collection of cache.
+	CacheGCRetention time.Duration
+
+	// CacheGCInterval - period of background garbage collection of cache, 0 - by CacheGCHandler only.
+	CacheGCInterval time.Duration
+
+	// CacheGCDryRun - background garbage collection report removable certificates without remove.
+	CacheGCDryRun bool
+
+	// PreferredChain - issuer common name of topmost certificate or sha256 fingerprint of issuer certificate
+	// for select chain from alternate chains, offered by acme server. Empty - use default chain.
+	PreferredChain string
+
+	// ServeRootCert - serve root (self-signed) certificate within chain, if acme server return it.
+	// Clients have root certificates already, it only increase handshake size.
+	ServeRootCert bool
+
+	// ServedIntermediates - intermediate certificates (der), served after leaf instead of chain from acme server.
+	// nil - serve chain from acme server. Full chain stored in cache anyway.
+	ServedIntermediates [][]byte
+
+	// ChallengeCleanupRetries - count of retries of remove challenge state after validation.
+	// Delay before retry doubled after every retry, starting from ChallengeCleanupRetryDelay.
+	ChallengeCleanupRetries    int
+	ChallengeCleanupRetryDelay time.Duration
+
+	// ChallengeMaxAge - challenge state older than it, which wasn't removed after validation, removed by
+	// StartChallengeSweeper. 0 - without sweep.
+	ChallengeMaxAge time.Duration
+
+	// AllowIPCerts - issue certificates for ip addresses from AllowedIPs, if client connect by ip address
+	// (empty SNI or ip address in SNI). Certificates for ip addresses validated by http-01 only,
+	// many CAs don't issue it: after failed issue next try for the ip will be after hour.
+	AllowIPCerts bool
+	AllowedIPs   []net.IP
+
+	// CertGroups - domains of every group share one certificate.
+	// Certificate of group issued only if all domains of the group allowed by DomainChecker.
+	CertGroups []CertGroup
+
+	// ManagedDomains - domains, which certificates issued at start and renewed proactively by StartManaged.
+	// Managed domains allowed without DomainChecker, its certificates never evicted by MaxCachedCerts.
+	ManagedDomains []domain.DomainName
+
+	// ManagedCheckInterval - interval of check certificates of managed domains, 0 - DefaultManagedCheckInterval.
+	ManagedCheckInterval time.Duration
+
+	// PersistOrders - store orders in process of authorization to cache and resume it after restart
+	// instead of create new orders.
+	PersistOrders bool
+
 	acmeClientManager       AcmeClientManager
 	DomainChecker           DomainChecker
+	Events                  EventPublisher
 	EnableHTTPValidation    bool
 	EnableTLSValidation     bool
 	SaveJSONMeta            bool
@@ -111,6 +217,52 @@ type Manager struct {
 	AllowRSACert            bool
 	AllowInsecureTLSChipers bool
 
+	// HTTPPreflight check http-01 validation reachable before order. nil - without check.
+	HTTPPreflight *HTTPPreflight
+
+	// HTTPPreflightFallback - skip http-01 challenge if preflight failed and other challenge type enabled.
+	HTTPPreflightFallback bool
+
+	// OCSPStapling - fetch ocsp responses for served certificates and staple it to handshakes.
+	OCSPStapling bool
+
+	// MustStaple - request certificates with OCSP Must-Staple extension. Require OCSPStapling.
+	MustStaple bool
+
+	// CertSubject - additional subject fields of certificate requests (Organization, OrganizationalUnit, ...).
+	// CommonName ignored: it always first domain of certificate. Public CAs usually ignore the fields.
+	CertSubject pkix.Name
+
+	// OCSPHTTPClient - client for requests to ocsp responders. nil - http.DefaultClient.
+	OCSPHTTPClient *http.Client
+
+	// DryRun - check domains and log certificates, which would be issued, but don't contact acme server.
+	// Self-signed placeholders served instead of new certificates, renew of existed certificates skipped.
+	DryRun bool
+
+	// ClockSkewTolerance - certificates accepted as valid during the period before NotBefore and after NotAfter,
+	// for slightly wrong local clock.
+	ClockSkewTolerance time.Duration
+
+	// ClockSkewWarning - warn if measured skew of local clock exceed it. 0 - without warning.
+	ClockSkewWarning time.Duration
+
+	// KeyPool - pregenerated keys for new certificates. nil - generate keys on demand.
+	KeyPool *KeyPool
+
+	// HandshakeLimit - limit of concurrent certificate operations of handshakes with queue. nil - without limit.
+	HandshakeLimit *HandshakeLimit
+
+	// RenewalBackoffMin, RenewalBackoffMax - delay of background renew after failed issue of certificate,
+	// doubled after every consecutive failure from RenewalBackoffMin up to RenewalBackoffMax.
+	// 0 RenewalBackoffMin - without delay. Renew by admin request doesn't delayed.
+	RenewalBackoffMin time.Duration
+	RenewalBackoffMax time.Duration
+
+	// RenewalFailingAfter - count of consecutive failed issues, after which certificate marked as renewal failing
+	// (see Certs and metrics). Existed certificate served until expire. 0 - certificates never marked.
+	RenewalFailingAfter int
+
 	certForDomainAuthorize cache.Value
 
 	certStateMu sync.Mutex
@@ -118,9 +270,42 @@ type Manager struct {
 
 	httpTokens cache.Bytes
 
+	// issued certificates, which failed to store to cache, by CertDescription.String()
+	unstoredCertsMu    sync.Mutex
+	unstoredCerts      map[string]*tls.Certificate
+	storeRetryInterval time.Duration
+	storeMu            sync.Mutex // serialize store of issued certificate with store of unstored certificate
+
+	// closed by Close, created on first use
+	stopMu    sync.Mutex
+	stopped   chan struct{}
+	isStopped bool
+
+	// time of last failed issue of certificates for ip addresses
+	ipCertFailuresMu sync.Mutex
+	ipCertFailures   map[domain.DomainName]time.Time
+
+	// challenges, which state isn't removed yet
+	challengeArtifacts challengeArtifacts
+
+	// ocsp responses by serial number of certificate
+	ocspStaplesMu sync.Mutex
+	ocspStaples   map[string]*ocspStaple
+
+	// served certificates and certificates, which stored in cache before start, by CertDescription.String()
+	cachedCertsMu sync.Mutex
+	cachedCerts   map[string]*cachedCertInfo
+
+	// last failures of certificate issue by CertDescription.String(), protected by cachedCertsMu
+	issueFailures map[string]issueFailure
+
+	// last measured skew of local clock, nanoseconds, atomic
+	clockSkew int64
+
 	// metrics
-	handleCertStart, certRequestStart   metrics.ProcessStartFunc
-	handleCertFinish, certRequestFinish metrics.ProcessFinishFunc
+	handleCertStart, certRequestStart, certStoreStart    metrics.ProcessStartFunc
+	handleCertFinish, certRequestFinish, certStoreFinish metrics.ProcessFinishFunc
+	issueFailureCounts                                   []int64 // by issueErrorCategories, atomic
 }
 
 func New(acmeClientManager AcmeClientManager, c cache.Bytes, r prometheus.Registerer) *Manager {
@@ -130,9 +315,14 @@ func New(acmeClientManager AcmeClientManager, c cache.Bytes, r prometheus.Regist
 	res.certState = cache.NewMemoryValueLRU("certstate")
 	res.CertificateIssueTimeout = time.Minute
 	res.httpTokens = cache.NewMemoryCache("Http validation tokens")
+	res.storeRetryInterval = defaultStoreRetryInterval
+	res.ChallengeCleanupRetries = defaultChallengeCleanupRetries
+	res.ChallengeCleanupRetryDelay = defaultChallengeCleanupRetryDelay
+	res.OnExpiredCert = ExpiredCertReissue
 	res.Cache = c
 	res.EnableTLSValidation = true
 	res.DomainChecker = managerDefaults{}
+	res.Events = managerDefaults{}
 	res.AllowRSACert = true
 	res.AllowECDSACert = true
 
@@ -152,10 +342,20 @@ func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (resultCert *tls.Ce
 
 	m.filterTlsHello(ctx, hello)
 
-	needDomain, err := domain.NormalizeDomain(hello.ServerName)
-	log.DebugInfo(logger, err, "Domain name normalization", zap.String("original", hello.ServerName), domain.LogDomain(needDomain))
-	if err != nil {
-		return nil, errHaveNoCert
+	var needDomain domain.DomainName
+	if ip := m.helloIP(hello); ip != nil {
+		needDomain = domain.DomainName(ip.String())
+		if !m.isIPAllowed(needDomain) {
+			logger.Debug("Deny certificate for ip address", zap.String("server_name", hello.ServerName),
+				domain.LogDomain(needDomain))
+			return nil, errHaveNoCert
+		}
+	} else {
+		needDomain, err = domain.NormalizeDomain(hello.ServerName)
+		log.DebugInfo(logger, err, "Domain name normalization", zap.String("original", hello.ServerName), domain.LogDomain(needDomain))
+		if err != nil {
+			return nil, errHaveNoCert
+		}
 	}
 
 	logger = logger.With(domain.LogDomain(needDomain))
@@ -167,19 +367,28 @@ func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (resultCert *tls.Ce
 		return m.handleTLSALPN(ctx, needDomain)
 	}
 
+	release, err := m.HandshakeLimit.acquire(ctx)
+	if err != nil {
+		logger.Warn("Reject certificate operation by handshake limit", zap.Error(err))
+		return nil, err
+	}
+	defer release()
+
 	certType := KeyRSA
 	if supportsECDSA(hello) {
 		certType = KeyECDSA
 	}
 	cert, err := m.getCertificate(ctx, needDomain, certType)
 	log.DebugInfo(logger, err, "Got certificate", log.Cert(cert))
-	if err == nil || certType == KeyRSA {
-		return cert, err
+	if err != nil && certType == KeyECDSA {
+		logger.Info("ECDSA certificate was failed, try to get RSA certificate")
+		ctx = zc.WithLogger(ctx, logger.With(zap.String("retry_type", "rsa")))
+		cert, err = m.getCertificate(ctx, needDomain, KeyRSA)
 	}
-
-	logger.Info("ECDSA certificate was failed, try to get RSA certificate")
-	ctx = zc.WithLogger(ctx, logger.With(zap.String("retry_type", "rsa")))
-	return m.getCertificate(ctx, needDomain, KeyRSA)
+	if err != nil {
+		return nil, err
+	}
+	return m.withOCSPStaple(ctx, cert), nil
 }
 
 //nolint:funlen,gocognit
@@ -197,18 +406,46 @@ func (m *Manager) getCertificate(ctx context.Context, needDomain domain.DomainNa
 		return nil, errCertTypeUnknown
 	}
 
-	certDescription := CertDescriptionFromDomain(needDomain, certType, m.AutoSubdomains)
+	certDescription, isGroup := CertDescriptionFromGroup(needDomain, certType, m.CertGroups)
+	if !isGroup {
+		certDescription = CertDescriptionFromDomain(needDomain, certType, m.autoSubdomains())
+	}
 
 	logger := zc.L(ctx).With(certDescription.ZapField())
 	ctx = zc.WithLogger(ctx, zc.L(ctx).With(certDescription.ZapField()))
 
 	now := time.Now()
 
+	// servedExpired - expired certificate served by OnExpiredCert policy, it isn't matched candidate of trace
+	var servedExpired bool
+	trace := log.NewCertSelection(logger)
+	if trace != nil {
+		defer func() {
+			fallback := ""
+			if servedExpired {
+				fallback = "expired certificate by OnExpiredCert policy"
+			}
+			trace.Log(logger, fallback)
+		}()
+	}
+	handleExpiredCert := func(cert *tls.Certificate) (*tls.Certificate, error) {
+		cert, err := m.handleExpiredCert(ctx, cert)
+		servedExpired = cert != nil
+		return cert, err
+	}
+
 	var locked = false
 	var lockedChecked = false
 
 	defer func() {
-		if isNeedRenew(resultCert, now) {
+		if resultCert != nil {
+			m.cachedCertUpdate(certDescription, resultCert, now, true)
+		}
+	}()
+
+	defer func() {
+		// wildcard certificates stored manually, exact certificate issued after expire of wildcard
+		if isNeedRenew(resultCert, now) && !isServedByWildcard(resultCert, needDomain) {
 			if !lockedChecked {
 				locked, err = isCertLocked(ctx, m.Cache, certDescription)
 				log.DebugError(logger, err, "Check locked before renew", zap.Bool("locked", locked))
@@ -228,11 +465,22 @@ func (m *Manager) getCertificate(ctx context.Context, needDomain domain.DomainNa
 	if cert != nil {
 		logger.Debug("Got certificate from local state", log.Cert(cert))
 
-		cert, err = validCertTLS(cert, []domain.DomainName{needDomain}, certState.GetUseAsIs(), now)
+		stateCert := cert
+		cert, err = validCertTLS(cert, []domain.DomainName{needDomain}, certState.GetUseAsIs(), now, m.ClockSkewTolerance)
 		logger.Debug("Validate certificate from local state", zap.Error(err))
+		traceCertCandidate(trace, certDescription, needDomain, "local state", err)
 		if err == nil {
 			return cert, nil
 		}
+		if err == errCertExpired {
+			if m.OnExpiredCert != ExpiredCertReissue && m.OnExpiredCert != "" {
+				return handleExpiredCert(stateCert)
+			}
+			err = cache.ErrCacheMiss // reissue
+		}
+		if err == errCertNameMismatch {
+			err = cache.ErrCacheMiss // issue with the domain
+		}
 	}
 	if err != nil {
 		logLevel := zapcore.ErrorLevel
@@ -252,18 +500,41 @@ func (m *Manager) getCertificate(ctx context.Context, needDomain domain.DomainNa
 		return nil, errHaveNoCert
 	}
 
-	cert, err = loadCertificateFromCache(ctx, m.Cache, certDescription)
+	if unstored := m.unstoredCert(certDescription); unstored != nil {
+		logger.Debug("Got certificate, which doesn't stored to cache yet")
+		cert, err = unstored, nil
+	} else {
+		cert, err = loadCertificateFromCache(ctx, m.Cache, certDescription, m.ClockSkewTolerance)
+	}
 	logLevel := zapcore.ErrorLevel
-	if err == nil || err == cache.ErrCacheMiss {
+	if err == nil || err == cache.ErrCacheMiss || err == errCertExpired {
 		logLevel = zapcore.DebugLevel
 	}
 	log.LevelParam(logger, logLevel, "Load certificate from cache", zap.Error(err))
 
+	loadedCert := cert
 	if err == nil {
-		cert, err = validCertDer([]domain.DomainName{needDomain}, cert.Certificate, cert.PrivateKey, locked, now)
+		cert, err = validCertDer([]domain.DomainName{needDomain}, m.servedChain(cert.Certificate), cert.PrivateKey, locked, now, m.ClockSkewTolerance)
 		logger.Debug("Check if certificate ok", zap.Error(err))
-		if err == nil {
-			certState.CertSet(ctx, locked, cert)
+		if err == errCertNameMismatch {
+			err = cache.ErrCacheMiss // issue with the domain
+		}
+	}
+	traceCertCandidate(trace, certDescription, needDomain, "cache", err)
+	if err == nil {
+		certState.CertSet(ctx, locked, cert)
+		return cert, nil
+	}
+	if err == errCertExpired && m.OnExpiredCert != ExpiredCertReissue && m.OnExpiredCert != "" {
+		return handleExpiredCert(loadedCert)
+	}
+	// certificate for the domain preferred, wildcard certificate served if domain has no own certificate
+	if err == cache.ErrCacheMiss && !locked && !isGroup {
+		cert = m.getWildcardCertificate(ctx, needDomain, certType, now)
+		traceWildcardCandidate(trace, needDomain, certType, cert != nil)
+		if cert != nil {
+			logger.Debug("Serve wildcard certificate", log.Cert(cert))
+			certState.CertSet(ctx, false, cert)
 			return cert, nil
 		}
 	}
@@ -271,44 +542,192 @@ func (m *Manager) getCertificate(ctx context.Context, needDomain domain.DomainNa
 		return nil, errHaveNoCert
 	}
 
+	// shared certificate of apex and www doesn't serve the domain, if its sibling failed validation
+	if !isGroup {
+		if ownCert := m.getNeedDomainCertificate(ctx, needDomain, certDescription, now); ownCert != nil {
+			traceCertCandidate(trace, needDomainCertDescription(needDomain, certType), needDomain, "cache", nil)
+			return ownCert, nil
+		}
+	}
+
 	if locked {
 		return nil, errHaveNoCert
 	}
 
-	return m.issueNewCert(ctx, needDomain, certDescription)
+	cert, err = m.issueNewCert(ctx, needDomain, certDescription, events.TypeCertIssued)
+	traceCertCandidate(trace, certDescription, needDomain, "issue", err)
+	return cert, err
 }
 
-func (m *Manager) issueNewCert(ctx context.Context, needDomain domain.DomainName, cd CertDescription) (cert *tls.Certificate, err error) {
+// handleExpiredCert return result of getCertificate for expired certificate by OnExpiredCert policy (except reissue)
+func (m *Manager) handleExpiredCert(ctx context.Context, cert *tls.Certificate) (*tls.Certificate, error) {
+	logger := zc.L(ctx)
+	if m.OnExpiredCert == ExpiredCertServe {
+		logger.Warn("Serve expired certificate by OnExpiredCert policy", zap.String("policy", string(m.OnExpiredCert)))
+		return cert, nil
+	}
+	logger.Warn("Deny expired certificate by OnExpiredCert policy", zap.String("policy", string(m.OnExpiredCert)))
+	return nil, errCertExpiredDenied
+}
+
+// issueNewCert publish successEventType after issue certificate
+func (m *Manager) issueNewCert(ctx context.Context, needDomain domain.DomainName, cd CertDescription, successEventType string) (cert *tls.Certificate, err error) {
 	m.certRequestStart()
 	defer func() {
 		m.certRequestFinish(err)
+		if IssueErrorCategory(err) != "" {
+			m.issueFailed(cd, err, time.Now())
+		}
 	}()
 	logger := zc.L(ctx)
 
-	allowed, err := m.DomainChecker.IsDomainAllowed(ctx, needDomain.ASCII())
-	log.DebugError(logger, err, "Check if domain allowed for certificate", zap.Bool("allowed", allowed))
-	if err != nil {
-		return nil, errHaveNoCert
+	if isIPName(needDomain.String()) {
+		now := time.Now()
+		if m.isIPCertDelayed(needDomain, now) {
+			logger.Debug("Skip issue certificate for ip address after recent failure",
+				zap.Duration("retry_interval", ipCertRetryInterval))
+			return nil, errHaveNoCert
+		}
+		defer func() {
+			m.ipCertIssueResult(needDomain, err, now)
+		}()
 	}
-	if !allowed {
-		logger.Info("Deny certificate issue by filter")
-		return nil, errHaveNoCert
+	if !m.isManagedDomain(needDomain) && !m.isIPAllowed(needDomain) {
+		allowed, err := m.DomainChecker.IsDomainAllowed(ctx, needDomain.ASCII())
+		log.DebugError(logger, err, "Check if domain allowed for certificate", zap.Bool("allowed", allowed))
+		if err != nil {
+			return nil, errHaveNoCert
+		}
+		if !allowed {
+			logger.Info("Deny certificate issue by filter")
+			return nil, errDomainDenied
+		}
 	}
-	certIssueContext, cancelFunc := context.WithTimeout(ctx, m.CertificateIssueTimeout)
-	defer cancelFunc()
-
 	domains := cd.DomainNames()
-	domains, err = filterDomains(ctx, m.DomainChecker, domains, needDomain)
+	domains, err = filterDomains(ctx, managedDomainChecker{m: m}, domains, needDomain)
 	log.DebugError(logger, err, "Filter domains", domain.LogDomains(domains))
+	if cd.Group != "" && len(domains) != len(cd.GroupDomains) {
+		logger.Warn("Deny certificate issue for group: some of group domains denied by filter",
+			domain.LogDomains(cd.GroupDomains), zap.NamedError("filter_error", err))
+		m.publishEvent(events.Event{Type: events.TypeCertIssueFailed, Domain: needDomain.String(),
+			Message: "some of group domains denied"})
+		return nil, errDomainDenied
+	}
+
+	// reserve part of timeout for issue certificate for need domain only
+	fallbackToNeedDomain := m.AutoIncludeApexAndWww && cd.Group == "" && len(domains) > 1
+	issueDeadline := time.Now().Add(m.CertificateIssueTimeout)
+	issueTimeout := m.CertificateIssueTimeout
+	if fallbackToNeedDomain {
+		issueTimeout -= needDomainFallbackReserve(m.CertificateIssueTimeout)
+	}
+
+	certIssueContext, cancelFunc := context.WithTimeout(ctx, issueTimeout)
+	defer cancelFunc()
+
+	storeCD := cd
+	sharedState := m.certStateGet(ctx, cd)
+	sharedCert, _ := sharedState.Cert()
+	sharedUseAsIs := sharedState.GetUseAsIs()
 
 	res, err := m.createCertificateForDomains(certIssueContext, cd, domains)
+	if err != nil && fallbackToNeedDomain && xerrors.Is(classifyIssueError(err), ErrChallengeFailed) {
+		logger.Warn("Can't issue certificate with auto-included domains, try to issue for need domain only", zap.Error(err))
+		fallbackContext, fallbackCancel := context.WithDeadline(ctx, issueDeadline)
+		defer fallbackCancel()
+
+		// own store of the certificate: shared certificate of apex and www must not be replaced by it
+		storeCD = needDomainCertDescription(needDomain, cd.KeyType)
+		res, err = m.createCertificateForDomains(fallbackContext, storeCD, []domain.DomainName{needDomain})
+		if err == nil && storeCD.String() != cd.String() {
+			// failed issue replaced local state of shared certificate, which still serve other domain
+			sharedState.CertSet(ctx, sharedUseAsIs, sharedCert)
+		}
+	}
+	if err == nil && m.DryRun {
+		logger.Info("Dry run: placeholder certificate created", log.Cert(res))
+		return res, nil
+	}
 	if err == nil {
 		logger.Info("Certificate issued.", log.Cert(res),
 			zap.Time("expire", res.Leaf.NotAfter))
+		m.cachedCertUpdate(storeCD, res, time.Now(), false)
+		m.evictCachedCerts(ctx, storeCD, time.Now())
+		m.issueSucceeded(cd)
+		m.publishEvent(events.Event{Type: successEventType, Domain: needDomain.String()})
 		return res, nil
 	}
-	logger.Warn("Can't issue certificate", zap.Error(err))
-	return nil, errHaveNoCert
+	err = classifyIssueError(err)
+	logIssueError(logger, err)
+	m.publishEvent(events.Event{Type: events.TypeCertIssueFailed, Domain: needDomain.String(), Message: err.Error()})
+	return nil, err
+}
+
+// needDomainFallbackReserve return part of issue timeout, reserved for issue certificate for need domain only
+// after failed validation of auto-included apex or www.
+func needDomainFallbackReserve(issueTimeout time.Duration) time.Duration {
+	if reserve := issueTimeout / 2; reserve < maxNeedDomainFallbackReserve {
+		return reserve
+	}
+	return maxNeedDomainFallbackReserve
+}
+
+// needDomainCertDescription return description of certificate for the domain only, issued if auto-included
+// apex or www failed validation. For apex it share store with certificate of apex and www.
+func needDomainCertDescription(needDomain domain.DomainName, keyType KeyType) CertDescription {
+	return CertDescription{MainDomain: needDomain.String(), KeyType: keyType}
+}
+
+// getNeedDomainCertificate return valid certificate for need domain only, if it stored separately
+// from certificate of cd, nil if it absent.
+func (m *Manager) getNeedDomainCertificate(ctx context.Context, needDomain domain.DomainName, cd CertDescription, now time.Time) *tls.Certificate {
+	if !m.AutoIncludeApexAndWww {
+		return nil
+	}
+	ownCD := needDomainCertDescription(needDomain, cd.KeyType)
+	if ownCD.storeName() == cd.storeName() {
+		return nil
+	}
+
+	certState := m.certStateGet(ctx, ownCD)
+	if cert, _ := certState.Cert(); cert != nil {
+		if cert, err := validCertTLS(cert, []domain.DomainName{needDomain}, certState.GetUseAsIs(), now, m.ClockSkewTolerance); err == nil {
+			return cert
+		}
+	}
+
+	cert, err := loadCertificateFromCache(ctx, m.Cache, ownCD, m.ClockSkewTolerance)
+	if err != nil {
+		return nil
+	}
+	cert, err = validCertDer([]domain.DomainName{needDomain}, m.servedChain(cert.Certificate), cert.PrivateKey, false, now, m.ClockSkewTolerance)
+	if err != nil {
+		return nil
+	}
+	certState.CertSet(ctx, false, cert)
+	return cert
+}
+
+// autoSubdomains return subdomains, auto-included within certificate of main domain
+func (m *Manager) autoSubdomains() []string {
+	if !m.AutoIncludeApexAndWww {
+		return m.AutoSubdomains
+	}
+	for _, subdomain := range m.AutoSubdomains {
+		if subdomain == wwwSubdomain {
+			return m.AutoSubdomains
+		}
+	}
+	res := make([]string, 0, len(m.AutoSubdomains)+1)
+	res = append(res, m.AutoSubdomains...)
+	return append(res, wwwSubdomain)
+}
+
+func (m *Manager) publishEvent(event events.Event) {
+	if m.Events == nil {
+		return
+	}
+	m.Events.Publish(event)
 }
 
 func (m *Manager) handleTLSALPN(ctx context.Context, needDomain domain.DomainName) (*tls.Certificate, error) {
@@ -403,6 +822,10 @@ func (m *Manager) createCertificateForDomains(ctx context.Context, cd CertDescri
 
 	logger.Debug("Start issue process")
 
+	if m.DryRun {
+		return m.createDryRunCertificate(ctx, cd, domainNames)
+	}
+
 	for {
 		acmeClient, acmeClientDisableFunc, err := m.acmeClientManager.GetClient(ctx)
 		log.DebugError(logger, err, "Get acme client")
@@ -418,6 +841,13 @@ func (m *Manager) createCertificateForDomains(ctx context.Context, cd CertDescri
 			logger.Info("Too many orders, try next client")
 			acmeClientDisableFunc()
 			continue
+		case acme_client_manager.IsAccountError(err):
+			reporter, ok := m.acmeClientManager.(accountProblemReporter)
+			if ok && reporter.ReportAccountProblem(ctx, acmeClient, err) {
+				logger.Info("Acme account can't be used, try other account", zap.Error(err))
+				continue
+			}
+			return nil, err
 		default:
 			return nil, err
 		}
@@ -427,15 +857,28 @@ func (m *Manager) createCertificateForDomains(ctx context.Context, cd CertDescri
 func (m *Manager) createOrderAndCertificate(ctx context.Context, acmeClient AcmeClient, cd CertDescription, domainNames []domain.DomainName) (*tls.Certificate, error) {
 	logger := zc.L(ctx)
 
-	order, err := m.createOrderForDomains(ctx, acmeClient, domainNames...)
+	order := m.resumePendingOrder(ctx, acmeClient, cd, domainNames)
+	order, err := m.authorizeOrder(ctx, acmeClient, order, func(order *acme.Order) {
+		m.savePendingOrder(ctx, cd, domainNames, order)
+	}, domainNames...)
 	log.DebugWarning(logger, err, "Domains authorized")
-	if err != nil {
-		return nil, errors.New("order authorization error")
+	if err == nil {
+		var res *tls.Certificate
+		res, err = m.issueCertificate(ctx, acmeClient, cd, order)
+		log.DebugWarning(logger, err, "Issue certificate")
+		if err == nil {
+			m.deletePendingOrder(ctx, cd)
+			return res, nil
+		}
+	} else {
+		err = xerrors.Errorf("order authorization: %w", err)
 	}
 
-	res, err := m.issueCertificate(ctx, acmeClient, cd, order)
-	log.DebugWarning(logger, err, "Issue certificate")
-	return res, err
+	// order, interrupted by timeout or stop, resumed by next issue
+	if ctx.Err() == nil {
+		m.deletePendingOrder(ctx, cd)
+	}
+	return nil, err
 }
 
 func (m *Manager) supportedChallenges() []string {
@@ -449,20 +892,58 @@ func (m *Manager) supportedChallenges() []string {
 	return allowedChallenges
 }
 
+// orderChallenges return supported challenges, which can validate every domain of order.
+// tls-alpn-01 doesn't used for ip addresses: challenge certificate must contain ip address as IP SAN.
+func (m *Manager) orderChallenges(domains []domain.DomainName) []string {
+	challenges := m.supportedChallenges()
+	for _, d := range domains {
+		if !isIPName(d.String()) {
+			continue
+		}
+		res := make([]string, 0, len(challenges))
+		for _, challenge := range challenges {
+			if challenge != tlsAlpn01 {
+				res = append(res, challenge)
+			}
+		}
+		return res
+	}
+	return challenges
+}
+
 // createOrderForDomains similar to func (m *Manager) verifyRFC(ctx context.Context, client *acme.Client, domain string) (*acme.Order, error)
 // from acme/autocert
 //
 //nolint:funlen,gocognit
 func (m *Manager) createOrderForDomains(ctx context.Context, acmeClient AcmeClient, domains ...domain.DomainName) (*acme.Order, error) {
+	return m.authorizeOrder(ctx, acmeClient, nil, nil, domains...)
+}
+
+// authorizeOrder satisfy authorizations of order for domains. resumed - existed order for continue,
+// nil - create new order. onNewOrder called for every created order, can be nil.
+func (m *Manager) authorizeOrder(ctx context.Context, acmeClient AcmeClient, resumed *acme.Order,
+	onNewOrder func(order *acme.Order), domains ...domain.DomainName) (*acme.Order, error) {
 	logger := zc.L(ctx)
-	challengeTypes := m.supportedChallenges()
+	challengeTypes := m.httpPreflightChallenges(ctx, m.orderChallenges(domains), domains)
 	logger.Debug("Start order authorization.")
 	var order *acme.Order
 
+	if m.ValidationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.ValidationTimeout)
+		defer cancel()
+	}
+
+	// last error of acme server, for distinguish rejected validation from timeout
+	var lastAcmeErr error
+
 	firstLoop := true
 authorizeOrderLoop:
 	for {
 		if ctx.Err() != nil {
+			if lastAcmeErr != nil {
+				return nil, xerrors.Errorf("order abandoned by timeout, last acme error: %w", lastAcmeErr)
+			}
 			return nil, xerrors.Errorf("context canceled: %w", ctx.Err())
 		}
 
@@ -474,12 +955,22 @@ authorizeOrderLoop:
 		authIDs := make([]acme.AuthzID, len(domains))
 		for i := range domains {
 			authIDs[i] = acme.AuthzID{Type: "dns", Value: domains[i].ASCII()}
+			if isIPName(domains[i].ASCII()) {
+				authIDs[i].Type = "ip"
+			}
 		}
 		var err error
-		order, err = acmeClient.AuthorizeOrder(ctx, authIDs)
-		log.DebugError(logger, err, "Create authorization order.", zap.Reflect("order", order))
-		if err != nil {
-			return nil, err
+		if resumed != nil {
+			order, resumed = resumed, nil
+		} else {
+			order, err = acmeClient.AuthorizeOrder(ctx, authIDs)
+			log.DebugError(logger, err, "Create authorization order.", zap.Reflect("order", order))
+			if err != nil {
+				return nil, err
+			}
+			if onNewOrder != nil {
+				onNewOrder(order)
+			}
 		}
 
 		//noinspection GoDeferInLoop
@@ -506,7 +997,7 @@ authorizeOrderLoop:
 		// pass
 		default:
 			logger.Error("Invalid new order status", zap.String("status", order.Status), zap.String("uri", order.URI))
-			return nil, errors.New("invalid new order status")
+			return nil, newIssueError(ErrCARejected, xerrors.Errorf("invalid new order status: %q", order.Status))
 		}
 
 		logger.Debug("Start authorization step")
@@ -546,26 +1037,25 @@ authorizeOrderLoop:
 				if err != nil {
 					continue authorizeOrderLoop
 				}
-				cleanupContext, cleanupContextCancel := context.WithTimeout(contexthelper.DropCancelContext(ctx), cleanupTimeout)
 				//noinspection GoDeferInLoop
-				defer cleanupContextCancel()
-				//noinspection GoDeferInLoop
-				defer cleanup(cleanupContext)
+				defer cleanup()
 
 				authorizedChallenge, err := acmeClient.Accept(ctx, chal)
 				log.DebugError(logger, err, "accept authorization", zap.Reflect("authorized_challenge", authorizedChallenge))
 				if err != nil {
+					lastAcmeErr = rejectionError(err, lastAcmeErr)
 					continue authorizeOrderLoop
 				}
 				authorization, err := acmeClient.WaitAuthorization(ctx, z.URI)
 				log.DebugError(logger, err, "wait authorization", zap.Reflect("authorization", authorization))
 				if err != nil {
+					lastAcmeErr = rejectionError(err, lastAcmeErr)
 					continue authorizeOrderLoop
 				}
 			}
 			if !hasCompatibleChallenge {
 				logger.Error("No compatible challenges")
-				return nil, fmt.Errorf("unable to satisfy %q for domain %q: no viable challenge type found", z.URI, z.Identifier.Value)
+				return nil, newIssueError(ErrChallengeFailed, fmt.Errorf("unable to satisfy %q for domain %q: no viable challenge type found", z.URI, z.Identifier.Value))
 			}
 		}
 
@@ -576,6 +1066,7 @@ authorizeOrderLoop:
 		if err == nil {
 			break authorizeOrderLoop
 		}
+		lastAcmeErr = rejectionError(err, lastAcmeErr)
 	}
 	return order, nil
 }
@@ -596,51 +1087,59 @@ func (m *Manager) issueCertificate(ctx context.Context, acmeClient AcmeClient, c
 	if err != nil {
 		return nil, err
 	}
+	m.warnKeyChange(ctx, cd, key)
 
-	csr, err := createCertRequest(key, domains[0], domains...)
+	csr, err := createCertRequest(key, m.MustStaple, m.CertSubject, domains[0], domains...)
 	log.DebugDPanic(logger, err, "Create certificate request")
 	if err != nil {
 		return nil, err
 	}
 
-	der, _, err := acmeClient.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	der, certURL, err := acmeClient.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
 	log.InfoError(logger, err, "Receive certificate from acme server")
 	if err != nil {
 		return nil, err
 	}
+	der = m.selectPreferredChain(ctx, acmeClient, der, certURL)
 
-	cert, err := validCertDer(domains, der, key, false, time.Now())
+	cert, err := validCertDer(domains, der, key, false, time.Now(), m.ClockSkewTolerance)
 	log.DebugDPanic(logger, err, "Check certificate is valid")
 	if err != nil {
 		return nil, err
 	}
 
-	err = storeCertificate(ctx, m.Cache, cd, cert)
-	log.DebugDPanic(logger, err, "Certificate stored")
-	if err != nil {
-		return nil, err
-	}
-	if m.SaveJSONMeta {
-		err = storeCertificateMeta(ctx, m.Cache, cd, cert)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return cert, nil
+	m.storeIssuedCertificate(ctx, cd, cert)
+	return m.servedCertificate(cert), nil
 }
 
 func (m *Manager) renewCertInBackground(ctx context.Context, needDomain domain.DomainName, cd CertDescription) {
 	// detach from request lifetime, but save log context
 	logger := zc.L(ctx).Named("background")
 	defer log.HandlePanic(logger)
+
+	// placeholder must not replace working certificate
+	if m.DryRun {
+		logger.Info("Dry run: certificate would be renewed", zap.String("cert_description", cd.String()))
+		return
+	}
+
+	if retry, delayed := m.renewalDelayed(cd, time.Now()); delayed {
+		logger.Debug("Skip reissue certificate in background by backoff after failures", zap.Time("retry", retry))
+		return
+	}
+
 	ctx, ctxCancel := context.WithTimeout(context.Background(), m.CertificateIssueTimeout)
 	defer ctxCancel()
 
 	logger.Debug("Start reissue certificate in background")
 
 	ctx = zc.WithLogger(ctx, logger)
-	_, err := m.issueNewCert(ctx, needDomain, cd)
+	_, err := m.issueNewCert(ctx, needDomain, cd, events.TypeCertRenewed)
 	log.DebugError(logger, err, "Cert reissue in background finished")
+	if err != nil && m.isRenewalFailing(cd) {
+		logger.Warn("Certificate renewal failing, current certificate served until expire",
+			zap.String("cert_description", cd.String()), zap.Error(err))
+	}
 }
 
 func (m *Manager) deactivatePendingAuthz(ctx context.Context, acmeClient AcmeClient, uries []string) {
@@ -662,19 +1161,31 @@ func (m *Manager) deactivatePendingAuthz(ctx context.Context, acmeClient AcmeCli
 	}
 }
 
+// certKeyGetOrCreate return stored key of certificate if ReuseKeyOnRenewal and new key else
 func (m *Manager) certKeyGetOrCreate(ctx context.Context, cd CertDescription) (crypto.Signer, error) {
 	logger := zc.L(ctx)
 
-	key, err := getCertificateKey(ctx, m.Cache, cd)
-	logger.Debug("Got certificate key from cache and reuse old key", zap.Error(err))
-	if err == nil {
-		return key, nil
+	if m.ReuseKeyOnRenewal && !isKeyRotationForced(ctx) {
+		key, err := getCertificateKey(ctx, m.Cache, cd)
+		logger.Debug("Got certificate key from cache for reuse", zap.Error(err))
+		if err != nil && err != cache.ErrCacheMiss {
+			return nil, err
+		}
+		if err == nil {
+			err = checkKeyReusable(key, cd.KeyType)
+			if err == nil {
+				return key, nil
+			}
+			logger.Warn("Stored key of certificate can't be reused, generate new key", zap.Error(err))
+		}
 	}
-	if err != cache.ErrCacheMiss {
-		return nil, err
+
+	if key, ok := m.KeyPool.get(cd.KeyType, time.Now()); ok {
+		logger.Debug("Got new key from key pool")
+		return key, nil
 	}
 
-	key, err = cd.KeyType.Generate()
+	key, err := cd.KeyType.Generate()
 	log.InfoError(logger, err, "Generate new key")
 	return key, err
 }
@@ -696,7 +1207,8 @@ func (m *Manager) filterTlsHello(ctx context.Context, hello *tls.ClientHelloInfo
 	hello.CipherSuites = newChipers
 }
 
-func (m *Manager) fulfill(ctx context.Context, acmeClient AcmeClient, challenge *acme.Challenge, domain domain.DomainName) (func(context.Context), error) {
+// fulfill write respond to challenge. Returned cleanup function remove it in background.
+func (m *Manager) fulfill(ctx context.Context, acmeClient AcmeClient, challenge *acme.Challenge, domain domain.DomainName) (func(), error) {
 	logger := zc.L(ctx)
 
 	switch challenge.Type {
@@ -707,10 +1219,9 @@ func (m *Manager) fulfill(ctx context.Context, acmeClient AcmeClient, challenge
 			return nil, err
 		}
 		m.putCertToken(ctx, domain, &cert)
-		return func(localContext context.Context) {
-			// handlepanic: in deleteCertToken
-			go m.deleteCertToken(localContext, domain)
-		}, nil
+		return m.trackChallenge(ctx, tlsAlpn01+"/"+domain.String(), func(localContext context.Context) error {
+			return m.deleteCertToken(localContext, domain)
+		}), nil
 	case http01:
 		resp, err := acmeClient.HTTP01ChallengeResponse(challenge.Token)
 		if err != nil {
@@ -720,7 +1231,9 @@ func (m *Manager) fulfill(ctx context.Context, acmeClient AcmeClient, challenge
 		err = m.httpTokens.Put(ctx, key, []byte(resp))
 		log.DebugError(logger, err, "Put token for http-01", zap.String("key", key))
 		if err == nil {
-			return func(localContext context.Context) { _ = m.httpTokens.Delete(localContext, key) }, nil
+			return m.trackChallenge(ctx, http01+"/"+key, func(localContext context.Context) error {
+				return m.httpTokens.Delete(localContext, key)
+			}), nil
 		} else {
 			return nil, err
 		}
@@ -733,6 +1246,28 @@ func (m *Manager) fulfill(ctx context.Context, acmeClient AcmeClient, challenge
 func (m *Manager) initMetrics(r prometheus.Registerer) {
 	m.handleCertStart, m.handleCertFinish = metrics.ToefCounters(r, "handle_cert", "handled certificates")
 	m.certRequestStart, m.certRequestFinish = metrics.ToefCounters(r, "cert_request", "request certificates from lets-encrypt")
+	m.certStoreStart, m.certStoreFinish = metrics.ToefCounters(r, "cert_store", "store issued certificates to cache")
+
+	if r == nil || reflect.ValueOf(r).IsNil() {
+		return
+	}
+	m.initIssueErrorMetrics(r)
+	r.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cert_renewal_failing", Help: "Count of certificates with renewal failing by RenewalFailingAfter",
+	}, func() float64 {
+		return float64(m.renewalFailingCount())
+	}))
+	r.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cached_certs", Help: "Count of known certificates in cache",
+	}, func() float64 {
+		return float64(m.cachedCertsCount())
+	}))
+	r.MustRegister(certExpireCollector{m: m})
+	r.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "clock_skew_seconds", Help: "Measured skew of local clock with acme server, positive if local clock is behind",
+	}, func() float64 {
+		return m.ClockSkew().Seconds()
+	}))
 }
 
 func (m *Manager) isHTTPValidationRequest(r *http.Request) bool {
@@ -755,20 +1290,21 @@ func (m *Manager) HandleHTTPValidation(w http.ResponseWriter, r *http.Request) b
 	logger := zc.L(ctx)
 
 	token := strings.TrimPrefix(r.URL.Path, httpWellKnown)
-	d, err := domain.NormalizeDomain(r.Host)
+	d, err := normalizeHost(r.Host)
 	log.DebugInfo(logger, err, "Domain normalization", zap.String("original", r.Host), domain.LogDomain(d))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return true
 	}
+	logger = logger.With(domain.LogDomain(d))
 	resp, err := m.httpTokens.Get(ctx, d.ASCII()+"/"+token)
 	logger.Debug("Get http token", zap.Error(err))
 	if err == nil {
 		w.WriteHeader(http.StatusOK)
 		_, err = w.Write(resp)
-		log.DebugInfo(logger, err, "Error write http token answer to response", domain.LogDomain(d), zap.String("token", token))
+		log.DebugInfo(logger, err, "Error write http token answer to response", zap.String("token", token))
 	} else {
-		logger.Warn("Have no validation token", domain.LogDomain(d), zap.String("token", token), zap.Error(err))
+		logger.Warn("Have no validation token", zap.String("token", token), zap.Error(err))
 	}
 	return true
 }
@@ -778,11 +1314,10 @@ func (m *Manager) putCertToken(ctx context.Context, key domain.DomainName, certi
 	log.DebugDPanicCtx(ctx, err, "Put cert token", zap.String("key", string(key)))
 }
 
-func (m *Manager) deleteCertToken(ctx context.Context, key domain.DomainName) {
-	defer log.HandlePanicCtx(ctx)
-
+func (m *Manager) deleteCertToken(ctx context.Context, key domain.DomainName) error {
 	err := m.certForDomainAuthorize.Delete(ctx, key.String())
-	log.DebugDPanicCtx(ctx, err, "Delete cert token", zap.String("key", key.String()))
+	log.DebugErrorCtx(ctx, err, "Delete cert token", zap.String("key", key.String()))
+	return err
 }
 
 // It isn't atomic syncronized - caller must not save two certificates with same name same time
@@ -874,7 +1409,8 @@ func getKeyType(cert *tls.Certificate) KeyType {
 	}
 }
 
-func loadCertificateFromCache(ctx context.Context, c cache.Bytes, cd CertDescription) (cert *tls.Certificate, err error) {
+func loadCertificateFromCache(ctx context.Context, c cache.Bytes, cd CertDescription,
+	skewTolerance time.Duration) (cert *tls.Certificate, err error) {
 	logger := zc.L(ctx)
 	logger.Debug("Check certificate in cache")
 	defer func() {
@@ -923,7 +1459,12 @@ func loadCertificateFromCache(ctx context.Context, c cache.Bytes, cd CertDescrip
 		// logical error, may be system failure
 		return nil, err
 	}
-	return validCertTLS(&cert2, nil, locked, time.Now())
+	res, err := validCertTLS(&cert2, nil, locked, time.Now(), skewTolerance)
+	if err == errCertExpired {
+		// return expired certificate for decision by caller
+		return &cert2, err
+	}
+	return res, err
 }
 
 func getCertificateKeyBytes(ctx context.Context, cache cache.Bytes, cd CertDescription) ([]byte, error) {
@@ -992,11 +1533,17 @@ func parsePrivateKey(keyPEMBlock []byte) (crypto.Signer, error) {
 	return nil, errors.New("tls: failed to parse private key")
 }
 
+// isNeedRenew return true if certificate expire in renewBeforeExpire,
+// short-lived certificates renewed after two thirds of lifetime.
 func isNeedRenew(cert *tls.Certificate, now time.Time) bool {
 	if cert == nil || cert.Leaf == nil {
 		return false
 	}
-	return cert.Leaf.NotAfter.Add(-renewBeforeExpire).Before(now)
+	renewBefore := renewBeforeExpire
+	if lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore); lifetime > 0 && lifetime/3 < renewBefore {
+		renewBefore = lifetime / 3
+	}
+	return cert.Leaf.NotAfter.Add(-renewBefore).Before(now)
 }
 
 func isCertLocked(ctx context.Context, storage cache.Bytes, certName CertDescription) (bool, error) {
@@ -1013,6 +1560,44 @@ func isCertLocked(ctx context.Context, storage cache.Bytes, certName CertDescrip
 	}
 }
 
+// logIssueError log network timeouts separately from rejects by acme server
+func logIssueError(logger *zap.Logger, err error) {
+	var acmeErr *acme.Error
+	var authzErr *acme.AuthorizationError
+	var orderErr *acme.OrderError
+	switch {
+	case xerrors.As(err, &acmeErr):
+		logger.Warn("Can't issue certificate: rejected by acme server", zap.Error(err),
+			zap.String("problem_type", acmeErr.ProblemType), zap.Int("status_code", acmeErr.StatusCode))
+	case xerrors.As(err, &authzErr), xerrors.As(err, &orderErr):
+		logger.Warn("Can't issue certificate: validation rejected by acme server", zap.Error(err))
+	case isTimeoutError(err):
+		logger.Warn("Can't issue certificate: timeout, check network connection to acme server", zap.Error(err))
+	default:
+		logger.Warn("Can't issue certificate", zap.Error(err))
+	}
+}
+
+// isTimeoutError return true for exceeded deadlines and network timeouts
+func isTimeoutError(err error) bool {
+	if xerrors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return xerrors.As(err, &netErr) && netErr.Timeout()
+}
+
+// rejectionError return err if it is reject by acme server, else prev
+func rejectionError(err, prev error) error {
+	var acmeErr *acme.Error
+	var authzErr *acme.AuthorizationError
+	var orderErr *acme.OrderError
+	if xerrors.As(err, &acmeErr) || xerrors.As(err, &authzErr) || xerrors.As(err, &orderErr) {
+		return err
+	}
+	return prev
+}
+
 func isErrTooManyOrders(err error) bool {
 	if err == nil {
 		return false
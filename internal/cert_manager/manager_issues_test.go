@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/gojuno/minimock/v3"
 	"github.com/maxatome/go-testdeep"
@@ -51,3 +52,53 @@ func TestIssue_134(t *testing.T) {
 	td.Nil(res)
 	td.True(xerrors.Is(err, testErr))
 }
+
+func TestManager_ValidationTimeout(t *testing.T) {
+	t.Parallel()
+
+	table := []struct {
+		name     string
+		waitErr  error
+		rejected bool
+	}{
+		{name: "Timeout"},
+		{name: "Rejected", waitErr: &acme.OrderError{Status: acme.StatusInvalid}, rejected: true},
+	}
+
+	for _, test := range table {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, ctxCancel := th.TestContext(t)
+			defer ctxCancel()
+
+			mc := minimock.NewController(t)
+			defer mc.Finish()
+
+			td := testdeep.NewT(t)
+
+			client := NewAcmeClientMock(mc)
+			client.AuthorizeOrderMock.Return(&acme.Order{Status: acme.StatusPending, URI: "http://order",
+				AuthzURLs: []string{"http://authz"}}, nil)
+			client.GetAuthorizationMock.Return(&acme.Authorization{Status: acme.StatusValid}, nil)
+			client.WaitOrderMock.Set(func(ctx context.Context, url string) (*acme.Order, error) {
+				if test.waitErr != nil {
+					return nil, test.waitErr
+				}
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+
+			m := &Manager{ValidationTimeout: 10 * time.Millisecond, EnableTLSValidation: true}
+			res, err := m.createOrderForDomains(ctx, client, "test.com")
+			td.Nil(res)
+			td.CmpError(err)
+
+			var orderErr *acme.OrderError
+			td.Cmp(xerrors.As(err, &orderErr), test.rejected)
+			td.Cmp(isTimeoutError(err), !test.rejected)
+			td.CmpNoError(ctx.Err())
+		})
+	}
+}
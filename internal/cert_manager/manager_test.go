@@ -4,21 +4,26 @@ package cert_manager
 //go:generate minimock -i github.com/rekby/lets-proxy2/internal/cache.Bytes -o ./cache_bytes_mock_test.go
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/rekby/fixenv"
 	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	zc "github.com/rekby/zapcontext"
 
@@ -136,7 +141,7 @@ func TestStoreLoadCertificate(t *testing.T) {
 	err = storeCertificate(ctx, cacheMock, cd, &cert)
 	e.CmpNoError(err)
 
-	resCert, err := loadCertificateFromCache(ctx, cacheMock, cd)
+	resCert, err := loadCertificateFromCache(ctx, cacheMock, cd, 0)
 	e.CmpNoError(err)
 
 	e.CmpNoError(err)
@@ -153,6 +158,23 @@ func TestIsNeedRenew(t *testing.T) {
 	td.False(isNeedRenew(cert, time.Date(2000, 6, 30, 0, 0, 0, 0, time.UTC)))
 }
 
+func TestIsNeedRenewShortLived(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	now := time.Now()
+	cert := func(notBefore, notAfter time.Time) *tls.Certificate {
+		return &tls.Certificate{Leaf: &x509.Certificate{NotBefore: notBefore, NotAfter: notAfter}}
+	}
+
+	// six days certificate renewed after four days
+	td.False(isNeedRenew(cert(now.Add(-3*24*time.Hour), now.Add(3*24*time.Hour)), now))
+	td.True(isNeedRenew(cert(now.Add(-5*24*time.Hour), now.Add(24*time.Hour)), now))
+
+	// 90 days certificate renewed 30 days before expire
+	td.False(isNeedRenew(cert(now.Add(-59*24*time.Hour), now.Add(31*24*time.Hour)), now))
+	td.True(isNeedRenew(cert(now.Add(-61*24*time.Hour), now.Add(29*24*time.Hour)), now))
+}
+
 type testManagerContext struct {
 	ctx context.Context
 
@@ -286,3 +308,236 @@ func createManager(t *testing.T) (res testManagerContext, cancel func()) {
 		ctxCancel()
 	}
 }
+
+func TestManager_GetCertificateNormalizeSNI(t *testing.T) {
+	table := []struct {
+		name       string
+		serverName string
+		expected   string
+	}{
+		{"Uppercase", "TeSt.RU", "test.ru"},
+		{"TrailingDot", "test.ru.", "test.ru"},
+		{"IDN", "Тест.рф", "xn--e1aybc.xn--p1ai"},
+	}
+
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			td := testdeep.NewT(t)
+			c, cancel := createManager(t)
+			defer cancel()
+
+			var cacheKeys []string
+			var checkedDomains []string
+			c.certState.GetMock.Return(&certState{}, nil)
+			c.cache.GetMock.Set(func(ctx context.Context, key string) (ba1 []byte, err error) {
+				cacheKeys = append(cacheKeys, key)
+				return nil, cache.ErrCacheMiss
+			})
+			c.domainChecker.IsDomainAllowedMock.Set(func(ctx context.Context, domain string) (b1 bool, err error) {
+				checkedDomains = append(checkedDomains, domain)
+				return false, nil
+			})
+
+			res, err := c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: test.serverName})
+			td.Nil(res)
+			td.CmpError(err)
+			td.Cmp(cacheKeys, testdeep.All(testdeep.NotEmpty(), testdeep.ArrayEach(testdeep.HasPrefix(test.expected+"."))))
+			td.Cmp(checkedDomains, testdeep.All(testdeep.NotEmpty(), testdeep.ArrayEach(test.expected)))
+		})
+	}
+}
+
+func TestManager_GetCertificateDeniedIDN(t *testing.T) {
+	for _, serverName := range []string{"😀.example.com", "xn--e28h.example.com", "pаypal.com"} {
+		t.Run(serverName, func(t *testing.T) {
+			td := testdeep.NewT(t)
+			c, cancel := createManager(t)
+			defer cancel()
+
+			res, err := c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: serverName})
+			td.Nil(res)
+			td.CmpError(err)
+		})
+	}
+}
+
+func TestManager_GetCertificateGroupDenied(t *testing.T) {
+	td := testdeep.NewT(t)
+	c, cancel := createManager(t)
+	defer cancel()
+
+	c.manager.CertGroups = []CertGroup{{Name: "test", Domains: []domain.DomainName{"test.ru", "denied.ru"}}}
+
+	var cacheKeys []string
+	c.certState.GetMock.Return(&certState{}, nil)
+	c.cache.GetMock.Set(func(ctx context.Context, key string) (ba1 []byte, err error) {
+		cacheKeys = append(cacheKeys, key)
+		return nil, cache.ErrCacheMiss
+	})
+	c.domainChecker.IsDomainAllowedMock.Set(func(ctx context.Context, domain string) (b1 bool, err error) {
+		return domain == "test.ru", nil
+	})
+
+	res, err := c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: "test.ru"})
+	td.Nil(res)
+	td.CmpError(err)
+	td.Cmp(cacheKeys, testdeep.All(testdeep.NotEmpty(), testdeep.ArrayEach(testdeep.HasPrefix("group_test."))))
+}
+
+func TestManager_AutoIncludeApexAndWww(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := Manager{AutoSubdomains: []string{"mail."}}
+	td.Cmp(m.autoSubdomains(), []string{"mail."})
+
+	m.AutoIncludeApexAndWww = true
+	td.Cmp(m.autoSubdomains(), []string{"mail.", "www."})
+	td.Cmp(m.AutoSubdomains, []string{"mail."})
+
+	m.AutoSubdomains = []string{"www."}
+	td.Cmp(m.autoSubdomains(), []string{"www."})
+
+	for _, serverName := range []string{"test.ru", "www.test.ru"} {
+		t.Run(serverName, func(t *testing.T) {
+			td := testdeep.NewT(t)
+			c, cancel := createManager(t)
+			defer cancel()
+
+			c.manager.AutoIncludeApexAndWww = true
+
+			var cacheKeys []string
+			c.certState.GetMock.Return(&certState{}, nil)
+			c.cache.GetMock.Set(func(ctx context.Context, key string) (ba1 []byte, err error) {
+				cacheKeys = append(cacheKeys, key)
+				return nil, cache.ErrCacheMiss
+			})
+			c.domainChecker.IsDomainAllowedMock.Return(false, nil)
+
+			res, err := c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: serverName})
+			td.Nil(res)
+			td.CmpError(err)
+			// wildcard certificate can serve www subdomain, www subdomain can have own certificate
+			// if apex failed validation
+			td.Cmp(cacheKeys, testdeep.All(testdeep.NotEmpty(), testdeep.ArrayEach(
+				testdeep.Any(testdeep.HasPrefix("test.ru."), testdeep.HasPrefix("*.test.ru."),
+					testdeep.HasPrefix(serverName+".")))))
+		})
+	}
+}
+
+func TestManager_OnExpiredCert(t *testing.T) {
+	expiredCertBytes, expiredKeyBytes := fastCreateTestCert([]string{"test.ru"}, time.Now().Add(-2*time.Hour))
+
+	table := []struct {
+		policy        ExpiredCertPolicy
+		fromState     bool
+		expectedCert  bool
+		expectedErr   error
+		expectedIssue bool
+	}{
+		{ExpiredCertReissue, false, false, errDomainDenied, true},
+		{ExpiredCertReissue, true, false, errDomainDenied, true},
+		{"", false, false, errDomainDenied, true},
+		{ExpiredCertServe, false, true, nil, false},
+		{ExpiredCertServe, true, true, nil, false},
+		{ExpiredCertFail, false, false, errCertExpiredDenied, false},
+		{ExpiredCertFail, true, false, errCertExpiredDenied, false},
+	}
+
+	for _, test := range table {
+		name := fmt.Sprintf("%v-from_state_%v", test.policy, test.fromState)
+		t.Run(name, func(t *testing.T) {
+			td := testdeep.NewT(t)
+			c, cancel := createManager(t)
+			defer cancel()
+
+			c.manager.OnExpiredCert = test.policy
+
+			state := &certState{}
+			if test.fromState {
+				cert, err := tls.X509KeyPair(expiredCertBytes, expiredKeyBytes)
+				td.CmpNoError(err)
+				cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+				td.CmpNoError(err)
+				state.cert = &cert
+			}
+			c.certState.GetMock.Return(state, nil)
+			// fail policy doesn't touch cache if expired certificate in local state
+			if !test.fromState || test.policy != ExpiredCertFail {
+				c.cache.GetMock.Set(func(ctx context.Context, key string) (ba1 []byte, err error) {
+					switch key {
+					case "test.ru.rsa.cer":
+						return expiredCertBytes, nil
+					case "test.ru.rsa.key":
+						return expiredKeyBytes, nil
+					default:
+						return nil, cache.ErrCacheMiss
+					}
+				})
+			}
+
+			// deny issue new certificate
+			issueTried := make(chan bool, 1)
+			if test.expectedIssue || test.policy == ExpiredCertServe {
+				c.domainChecker.IsDomainAllowedMock.Set(func(ctx context.Context, domain string) (b1 bool, err error) {
+					select {
+					case issueTried <- true:
+					default:
+					}
+					return false, nil
+				})
+			}
+
+			logs := &testLogWriter{}
+			ctx := zc.WithLogger(c.ctx, zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+				zapcore.AddSync(logs), zapcore.DebugLevel)))
+			res, err := c.manager.getCertificate(ctx, "test.ru", KeyRSA)
+			td.Cmp(res != nil, test.expectedCert)
+			td.Cmp(err, test.expectedErr)
+			if test.policy == ExpiredCertServe {
+				td.Cmp(logs.String(), testdeep.Contains(`"chosen":"expired certificate by OnExpiredCert policy"`))
+			} else {
+				td.Cmp(logs.String(), testdeep.Not(testdeep.Contains(`"chosen":"expired certificate by OnExpiredCert policy"`)))
+			}
+
+			if test.policy == ExpiredCertServe {
+				// wait renew in background
+				select {
+				case <-issueTried:
+				case <-time.After(time.Second):
+					t.Error("no background renew")
+				}
+			}
+		})
+	}
+}
+
+// testLogWriter collect log messages, it can be written from background goroutines
+type testLogWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *testLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *testLogWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestParseExpiredCertPolicy(t *testing.T) {
+	td := testdeep.NewT(t)
+	for _, policy := range []ExpiredCertPolicy{ExpiredCertReissue, ExpiredCertServe, ExpiredCertFail} {
+		res, err := ParseExpiredCertPolicy(string(policy))
+		td.CmpNoError(err)
+		td.Cmp(res, policy)
+	}
+
+	_, err := ParseExpiredCertPolicy("")
+	td.CmpError(err)
+}
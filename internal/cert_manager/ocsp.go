@@ -0,0 +1,276 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+var errNoOCSPResponse = errors.New("have no ocsp response")
+
+const (
+	ocspFetchTimeout    = 10 * time.Second
+	ocspRetryInterval   = time.Minute
+	ocspDefaultValidity = time.Hour // if responder doesn't set next update
+	ocspMaxResponseSize = 1 << 20
+)
+
+// TLS Feature extension with status_request, https://datatracker.ietf.org/doc/html/rfc7633
+var mustStapleExtension = pkix.Extension{
+	Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24},
+	Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05}, // SEQUENCE { INTEGER 5 }
+}
+
+// ocspStaple is last good ocsp response for certificate
+type ocspStaple struct {
+	fetchMu sync.Mutex // one request to responder at time
+
+	mu         sync.Mutex
+	raw        []byte
+	thisUpdate time.Time
+	nextUpdate time.Time
+	lastFailed time.Time
+	certExpire time.Time
+}
+
+// get return valid response or nil and need to update the response:
+// it is invalid or half of its validity period passed.
+func (s *ocspStaple) get(now time.Time) (raw []byte, needUpdate bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.raw != nil && now.Before(s.nextUpdate) {
+		raw = s.raw
+	}
+	refreshTime := s.thisUpdate.Add(s.nextUpdate.Sub(s.thisUpdate) / 2) //nolint:gomnd
+	needUpdate = (raw == nil || now.After(refreshTime)) && now.Sub(s.lastFailed) > ocspRetryInterval
+	return raw, needUpdate
+}
+
+// response return valid response and its validity period, nil if it doesn't exist or expired
+func (s *ocspStaple) response(now time.Time) (raw []byte, thisUpdate, nextUpdate time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.raw == nil || !now.Before(s.nextUpdate) {
+		return nil, time.Time{}, time.Time{}
+	}
+	return s.raw, s.thisUpdate, s.nextUpdate
+}
+
+// withOCSPStaple return copy of certificate with ocsp response if stapling enabled and response available.
+// First handshake with the certificate wait response from responder, next - update it in background.
+func (m *Manager) withOCSPStaple(ctx context.Context, cert *tls.Certificate) *tls.Certificate {
+	// no issuer or responder: self-signed placeholder or ocsp doesn't supported by CA
+	if !m.OCSPStapling || cert == nil || cert.Leaf == nil || len(cert.Certificate) < 2 || len(cert.Leaf.OCSPServer) == 0 {
+		return cert
+	}
+
+	staple := m.ocspStapleGet(cert.Leaf)
+	raw, needUpdate := staple.get(time.Now())
+	switch {
+	case needUpdate && raw == nil:
+		fetchCtx, cancel := context.WithTimeout(ctx, ocspFetchTimeout)
+		m.ocspUpdate(fetchCtx, staple, cert)
+		cancel()
+		raw, _ = staple.get(time.Now())
+	case needUpdate:
+		go m.ocspUpdateInBackground(ctx, staple, cert)
+	}
+
+	if raw == nil {
+		return cert
+	}
+	res := *cert
+	res.OCSPStaple = raw
+	return &res
+}
+
+func (m *Manager) ocspStapleGet(leaf *x509.Certificate) *ocspStaple {
+	m.ocspStaplesMu.Lock()
+	defer m.ocspStaplesMu.Unlock()
+
+	key := leaf.SerialNumber.Text(16) //nolint:gomnd
+	if staple, ok := m.ocspStaples[key]; ok {
+		return staple
+	}
+
+	now := time.Now()
+	if m.ocspStaples == nil {
+		m.ocspStaples = make(map[string]*ocspStaple)
+	}
+	for k, staple := range m.ocspStaples {
+		if now.After(staple.certExpire) {
+			delete(m.ocspStaples, k)
+		}
+	}
+	staple := &ocspStaple{certExpire: leaf.NotAfter}
+	m.ocspStaples[key] = staple
+	return staple
+}
+
+func (m *Manager) ocspUpdateInBackground(ctx context.Context, staple *ocspStaple, cert *tls.Certificate) {
+	// detach from handshake lifetime, but save log context
+	logger := zc.L(ctx).Named("background")
+	defer log.HandlePanic(logger)
+	ctx, cancel := context.WithTimeout(zc.WithLogger(context.Background(), logger), ocspFetchTimeout)
+	defer cancel()
+
+	m.ocspUpdate(ctx, staple, cert)
+}
+
+func (m *Manager) ocspUpdate(ctx context.Context, staple *ocspStaple, cert *tls.Certificate) {
+	staple.fetchMu.Lock()
+	defer staple.fetchMu.Unlock()
+
+	// updated while wait lock
+	if _, needUpdate := staple.get(time.Now()); !needUpdate {
+		return
+	}
+
+	logger := zc.L(ctx)
+	resp, raw, err := m.fetchOCSP(ctx, cert)
+	if err == nil && resp.Status != ocsp.Good {
+		err = xerrors.Errorf("bad certificate status in ocsp response: %v", resp.Status)
+	}
+
+	staple.mu.Lock()
+	defer staple.mu.Unlock()
+
+	if err != nil {
+		logger.Warn("Can't update ocsp response", log.Cert(cert), zap.Error(err))
+		staple.lastFailed = time.Now()
+		return
+	}
+
+	nextUpdate := resp.NextUpdate
+	if nextUpdate.IsZero() {
+		nextUpdate = resp.ThisUpdate.Add(ocspDefaultValidity)
+	}
+	staple.raw, staple.thisUpdate, staple.nextUpdate = raw, resp.ThisUpdate, nextUpdate
+	logger.Debug("Ocsp response updated", log.Cert(cert), zap.Time("next_update", nextUpdate))
+}
+
+func (m *Manager) fetchOCSP(ctx context.Context, cert *tls.Certificate) (*ocsp.Response, []byte, error) {
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, xerrors.Errorf("parse issuer certificate: %w", err)
+	}
+	reqBytes, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("create ocsp request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cert.Leaf.OCSPServer[0], bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("create http request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	client := m.OCSPHTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("request to ocsp responder: %w", err)
+	}
+	defer func() { _ = httpResp.Body.Close() }()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, xerrors.Errorf("bad http status from ocsp responder: %v", httpResp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, ocspMaxResponseSize))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("read ocsp response: %w", err)
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, cert.Leaf, issuer)
+	if err != nil {
+		return nil, nil, xerrors.Errorf("parse ocsp response: %w", err)
+	}
+	return resp, raw, nil
+}
+
+// OCSPResponse return ocsp response (DER) of served certificate for domain (ECDSA certificate first) and its
+// validity period. It is same response, which stapled to tls handshakes: it fetched if need same as for handshake.
+// Certificates doesn't issued or loaded from storage for the request.
+func (m *Manager) OCSPResponse(ctx context.Context, d domain.DomainName) (raw []byte, thisUpdate, nextUpdate time.Time, err error) {
+	if !m.OCSPStapling {
+		return nil, time.Time{}, time.Time{}, errNoOCSPResponse
+	}
+
+	for _, keyType := range []KeyType{KeyECDSA, KeyRSA} {
+		cd, isGroup := CertDescriptionFromGroup(d, keyType, m.CertGroups)
+		if !isGroup {
+			cd = CertDescriptionFromDomain(d, keyType, m.autoSubdomains())
+		}
+		state := m.certStateGet(ctx, cd)
+		cert, _ := state.Cert()
+		if cert == nil {
+			continue
+		}
+		cert, err = validCertTLS(cert, []domain.DomainName{d}, state.GetUseAsIs(), time.Now(), m.ClockSkewTolerance)
+		if err != nil || m.withOCSPStaple(ctx, cert).OCSPStaple == nil {
+			continue
+		}
+		raw, thisUpdate, nextUpdate = m.ocspStapleGet(cert.Leaf).response(time.Now())
+		if raw != nil {
+			return raw, thisUpdate, nextUpdate, nil
+		}
+	}
+	return nil, time.Time{}, time.Time{}, errNoOCSPResponse
+}
+
+// OCSPHandler serve ocsp responses of served certificates by path /ocsp/<domain> for staple it by other servers.
+// Cache-Control max-age of response is time until next update of ocsp response.
+func (m *Manager) OCSPHandler(logger *zap.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		d, err := domain.NormalizeDomain(name)
+		if err != nil || name == "" {
+			http.Error(w, "Bad domain", http.StatusBadRequest)
+			return
+		}
+
+		raw, thisUpdate, nextUpdate, err := m.OCSPResponse(zc.WithLogger(r.Context(), logger), d)
+		log.DebugError(logger, err, "Get ocsp response", domain.LogDomain(d))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		maxAge := int64(time.Until(nextUpdate) / time.Second)
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(maxAge, 10))
+		w.Header().Set("Expires", nextUpdate.UTC().Format(http.TimeFormat))
+		w.Header().Set("Last-Modified", thisUpdate.UTC().Format(http.TimeFormat))
+		_, _ = w.Write(raw)
+	})
+}
@@ -0,0 +1,185 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
+)
+
+func TestCreateCertRequestMustStaple(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	key, err := KeyECDSA.Generate()
+	td.CmpNoError(err)
+
+	for _, mustStaple := range []bool{false, true} {
+		der, err := createCertRequest(key, mustStaple, pkix.Name{}, "test.ru", "test.ru")
+		td.CmpNoError(err)
+		csr, err := x509.ParseCertificateRequest(der)
+		td.CmpNoError(err)
+
+		var found bool
+		for _, ext := range csr.Extensions {
+			if ext.Id.Equal(mustStapleExtension.Id) {
+				found = true
+				td.Cmp(ext.Value, mustStapleExtension.Value)
+			}
+		}
+		td.Cmp(found, mustStaple)
+	}
+}
+
+func TestManager_WithOCSPStaple(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	issuerCert := testcert.New(t, x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test issuer"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	issuer, issuerKey := issuerCert.Leaf, issuerCert.PrivateKey.(crypto.Signer)
+
+	var requests int64
+	status := ocsp.Good
+	var leaf *x509.Certificate
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		td.CmpNoError(err)
+		td.Cmp(req.SerialNumber, leaf.SerialNumber)
+
+		resp, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, issuerKey)
+		td.CmpNoError(err)
+		_, _ = w.Write(resp)
+	}))
+	defer responder.Close()
+
+	cert := testcert.New(t, x509.Certificate{
+		Subject:    pkix.Name{CommonName: "test.ru"},
+		DNSNames:   []string{"test.ru"},
+		OCSPServer: []string{responder.URL},
+	}, issuerCert, nil)
+	cert.Certificate = append(cert.Certificate, issuerCert.Certificate[0])
+	leaf = cert.Leaf
+
+	m := &Manager{}
+	td.Nil(m.withOCSPStaple(ctx, cert).OCSPStaple)
+	td.Cmp(atomic.LoadInt64(&requests), int64(0))
+
+	m.OCSPStapling = true
+	res := m.withOCSPStaple(ctx, cert)
+	td.NotNil(res.OCSPStaple)
+	td.Nil(cert.OCSPStaple)
+	parsed, err := ocsp.ParseResponseForCert(res.OCSPStaple, leaf, issuer)
+	td.CmpNoError(err)
+	td.Cmp(parsed.Status, ocsp.Good)
+
+	// from memory
+	td.Cmp(m.withOCSPStaple(ctx, cert).OCSPStaple, res.OCSPStaple)
+	td.Cmp(atomic.LoadInt64(&requests), int64(1))
+
+	// revoked certificate doesn't stapled and request doesn't repeat immediately
+	m = &Manager{OCSPStapling: true}
+	status = ocsp.Revoked
+	td.Nil(m.withOCSPStaple(ctx, cert).OCSPStaple)
+	td.Nil(m.withOCSPStaple(ctx, cert).OCSPStaple)
+	td.Cmp(atomic.LoadInt64(&requests), int64(2))
+
+	// without issuer
+	placeholder, err := (&Manager{}).createDryRunCertificate(ctx, CertDescription{MainDomain: "test.ru", KeyType: KeyECDSA}, []domain.DomainName{"test.ru"})
+	td.CmpNoError(err)
+	td.Cmp(m.withOCSPStaple(ctx, placeholder), placeholder)
+}
+
+func TestManager_OCSPHandler(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	issuerCert := testcert.New(t, x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test issuer"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	issuer, issuerKey := issuerCert.Leaf, issuerCert.PrivateKey.(crypto.Signer)
+
+	var requests int64
+	nextUpdate := time.Now().Add(time.Hour).Truncate(time.Second)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		e.CmpNoError(err)
+		resp, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   nextUpdate,
+		}, issuerKey)
+		e.CmpNoError(err)
+		_, _ = w.Write(resp)
+	}))
+	defer responder.Close()
+
+	cert := testcert.New(t, x509.Certificate{
+		Subject:    pkix.Name{CommonName: "test.ru"},
+		DNSNames:   []string{"test.ru"},
+		OCSPServer: []string{responder.URL},
+	}, issuerCert, nil)
+	cert.Certificate = append(cert.Certificate, issuerCert.Certificate[0])
+
+	m := New(nil, newCacheMock(e), nil)
+	m.certStateGet(ctx, CertDescriptionFromDomain("test.ru", KeyECDSA, nil)).CertSet(ctx, false, cert)
+	handler := m.OCSPHandler(zap.NewNop())
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	// stapling disabled
+	e.Cmp(get("/ocsp/test.ru").Code, http.StatusNotFound)
+
+	m.OCSPStapling = true
+	for i := 0; i < 2; i++ {
+		recorder := get("/ocsp/test.ru")
+		e.Cmp(recorder.Code, http.StatusOK)
+		e.Cmp(recorder.Header().Get("Content-Type"), "application/ocsp-response")
+		e.Cmp(recorder.Header().Get("Cache-Control"), testdeep.Re(`^public, max-age=(35|36)[0-9]{2}$`))
+		e.Cmp(recorder.Header().Get("Expires"), nextUpdate.UTC().Format(http.TimeFormat))
+		parsed, err := ocsp.ParseResponseForCert(recorder.Body.Bytes(), cert.Leaf, issuer)
+		e.CmpNoError(err)
+		e.Cmp(parsed.Status, ocsp.Good)
+	}
+	// cached response reused
+	e.Cmp(atomic.LoadInt64(&requests), int64(1))
+
+	e.Cmp(get("/ocsp/other.ru").Code, http.StatusNotFound)
+	e.Cmp(get("/ocsp/").Code, http.StatusBadRequest)
+}
@@ -0,0 +1,134 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// pendingOrderMaxAge - records of orders older than it removed without request to acme server,
+// acme servers expire pending orders within the time.
+const pendingOrderMaxAge = 7 * 24 * time.Hour
+
+// pendingOrder - order in process of authorization, stored to cache for resume it after restart
+type pendingOrder struct {
+	URL       string    `json:"url"`
+	Domains   []string  `json:"domains"`
+	AuthzURLs []string  `json:"authz_urls"`
+	Status    string    `json:"status"`
+	Created   time.Time `json:"created"`
+}
+
+// acmeOrderGetter - acme client, which can get order by url (acme.Client). Orders resumed with such clients only.
+type acmeOrderGetter interface {
+	GetOrder(ctx context.Context, url string) (*acme.Order, error)
+}
+
+var _ acmeOrderGetter = &acme.Client{}
+
+// savePendingOrder store new order of certificate for resume after restart
+func (m *Manager) savePendingOrder(ctx context.Context, cd CertDescription, domains []domain.DomainName, order *acme.Order) {
+	if !m.PersistOrders {
+		return
+	}
+	record := pendingOrder{URL: order.URI, AuthzURLs: order.AuthzURLs, Status: order.Status, Created: time.Now()}
+	for _, d := range domains {
+		record.Domains = append(record.Domains, d.ASCII())
+	}
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = m.Cache.Put(ctx, cd.PendingOrderStoreName(), data)
+	}
+	log.DebugWarning(zc.L(ctx), err, "Store pending order", zap.String("order_url", order.URI))
+}
+
+// deletePendingOrder remove record of finished order
+func (m *Manager) deletePendingOrder(ctx context.Context, cd CertDescription) {
+	if !m.PersistOrders {
+		return
+	}
+	err := m.Cache.Delete(ctx, cd.PendingOrderStoreName())
+	log.DebugWarning(zc.L(ctx), err, "Remove pending order record")
+}
+
+// resumePendingOrder return order, stored by previous process, if it is for same domains and can be continued:
+// pending or ready at acme server now. Other records removed. nil - need new order.
+func (m *Manager) resumePendingOrder(ctx context.Context, acmeClient AcmeClient, cd CertDescription, domains []domain.DomainName) *acme.Order {
+	if !m.PersistOrders {
+		return nil
+	}
+	logger := zc.L(ctx)
+
+	data, err := m.Cache.Get(ctx, cd.PendingOrderStoreName())
+	if err == cache.ErrCacheMiss {
+		return nil
+	}
+	if err != nil {
+		logger.Warn("Can't read pending order record", zap.Error(err))
+		return nil
+	}
+
+	var record pendingOrder
+	if err = json.Unmarshal(data, &record); err != nil {
+		logger.Warn("Remove bad pending order record", zap.Error(err))
+		m.deletePendingOrder(ctx, cd)
+		return nil
+	}
+	logger = logger.With(zap.String("order_url", record.URL))
+
+	if time.Since(record.Created) > pendingOrderMaxAge || !sameDomains(record.Domains, domains) {
+		logger.Info("Remove outdated pending order record", zap.Time("created", record.Created),
+			zap.Strings("order_domains", record.Domains))
+		m.deletePendingOrder(ctx, cd)
+		return nil
+	}
+
+	getter, ok := acmeClient.(acmeOrderGetter)
+	if !ok {
+		logger.Debug("Acme client can't get orders, skip resume of pending order")
+		return nil
+	}
+	order, err := getter.GetOrder(ctx, record.URL)
+	if err != nil {
+		logger.Info("Can't get pending order from acme server, create new order", zap.Error(err))
+		m.deletePendingOrder(ctx, cd)
+		return nil
+	}
+
+	switch order.Status {
+	case acme.StatusPending, acme.StatusReady:
+		logger.Info("Resume pending order", zap.String("status", order.Status), zap.Time("expires", order.Expires))
+		return order
+	default:
+		// invalid, expired or valid - certificate of valid order can't be used: key of request lost with process
+		logger.Info("Pending order can't be resumed, create new order", zap.String("status", order.Status))
+		m.deletePendingOrder(ctx, cd)
+		return nil
+	}
+}
+
+// sameDomains compare ascii names of order with domains of certificate, independent of order
+func sameDomains(names []string, domains []domain.DomainName) bool {
+	if len(names) != len(domains) {
+		return false
+	}
+	exist := make(map[string]bool, len(names))
+	for _, name := range names {
+		exist[name] = true
+	}
+	for _, d := range domains {
+		if !exist[d.ASCII()] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+type acmeOrderClientMock struct {
+	*AcmeClientMock
+	getOrder func(ctx context.Context, url string) (*acme.Order, error)
+}
+
+func (c acmeOrderClientMock) GetOrder(ctx context.Context, url string) (*acme.Order, error) {
+	return c.getOrder(ctx, url)
+}
+
+func TestManager_ResumePendingOrder(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(t)
+	defer mc.Finish()
+
+	cd := CertDescription{MainDomain: "test.ru", KeyType: KeyRSA}
+	domains := []domain.DomainName{"test.ru", "www.test.ru"}
+	m := New(nil, cache.NewMemoryCache("test"), nil)
+
+	var orderStatus string
+	var orderErr error
+	var getOrderURLs []string
+	client := acmeOrderClientMock{AcmeClientMock: NewAcmeClientMock(mc),
+		getOrder: func(ctx context.Context, url string) (*acme.Order, error) {
+			getOrderURLs = append(getOrderURLs, url)
+			if orderErr != nil {
+				return nil, orderErr
+			}
+			return &acme.Order{URI: url, Status: orderStatus}, nil
+		},
+	}
+	stored := func() bool {
+		_, err := m.Cache.Get(ctx, cd.PendingOrderStoreName())
+		return err == nil
+	}
+	save := func() {
+		m.savePendingOrder(ctx, cd, domains, &acme.Order{URI: "http://order", Status: acme.StatusPending})
+	}
+
+	// disabled
+	save()
+	td.False(stored())
+	td.Nil(m.resumePendingOrder(ctx, client, cd, domains))
+
+	m.PersistOrders = true
+	td.Nil(m.resumePendingOrder(ctx, client, cd, domains))
+
+	save()
+	td.True(stored())
+	var record pendingOrder
+	data, _ := m.Cache.Get(ctx, cd.PendingOrderStoreName())
+	td.CmpNoError(json.Unmarshal(data, &record))
+	td.Cmp(record, testdeep.Struct(pendingOrder{URL: "http://order", Domains: []string{"test.ru", "www.test.ru"},
+		Status: acme.StatusPending}, testdeep.StructFields{"Created": testdeep.Between(time.Now().Add(-time.Minute), time.Now())}))
+
+	// resume pending and ready orders, independent of order of domains
+	for _, status := range []string{acme.StatusPending, acme.StatusReady} {
+		orderStatus = status
+		order := m.resumePendingOrder(ctx, client, cd, []domain.DomainName{"www.test.ru", "test.ru"})
+		td.Cmp(order, testdeep.Struct(&acme.Order{URI: "http://order", Status: status}, nil))
+		td.True(stored())
+	}
+
+	// client without get order
+	td.Nil(m.resumePendingOrder(ctx, NewAcmeClientMock(mc), cd, domains))
+	td.True(stored())
+
+	// orders, which can't be resumed
+	orderStatus = acme.StatusValid
+	td.Nil(m.resumePendingOrder(ctx, client, cd, domains))
+	td.False(stored())
+
+	save()
+	orderErr = xerrors.New("test")
+	td.Nil(m.resumePendingOrder(ctx, client, cd, domains))
+	td.False(stored())
+	orderErr = nil
+
+	getOrderURLs = nil
+	save()
+	td.Nil(m.resumePendingOrder(ctx, client, cd, []domain.DomainName{"test.ru"}))
+	td.False(stored())
+
+	td.CmpNoError(m.Cache.Put(ctx, cd.PendingOrderStoreName(), []byte("bad")))
+	td.Nil(m.resumePendingOrder(ctx, client, cd, domains))
+	td.False(stored())
+
+	data, _ = json.Marshal(pendingOrder{URL: "http://order", Domains: []string{"test.ru", "www.test.ru"},
+		Created: time.Now().Add(-pendingOrderMaxAge - time.Hour)})
+	td.CmpNoError(m.Cache.Put(ctx, cd.PendingOrderStoreName(), data))
+	td.Nil(m.resumePendingOrder(ctx, client, cd, domains))
+	td.False(stored())
+	td.Cmp(getOrderURLs, testdeep.Empty())
+
+	save()
+	m.deletePendingOrder(ctx, cd)
+	td.False(stored())
+}
+
+func TestManager_AuthorizeResumedOrder(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(t)
+	defer mc.Finish()
+
+	// resumed ready order doesn't create new order
+	client := NewAcmeClientMock(mc)
+	resumed := &acme.Order{URI: "http://order", Status: acme.StatusReady}
+	m := &Manager{EnableTLSValidation: true}
+	order, err := m.authorizeOrder(ctx, client, resumed, func(order *acme.Order) {
+		t.Error("new order created")
+	}, "test.ru")
+	td.CmpNoError(err)
+	td.Cmp(order, resumed)
+
+	// new order reported
+	newOrder := &acme.Order{URI: "http://new-order", Status: acme.StatusReady}
+	client.AuthorizeOrderMock.Return(newOrder, nil)
+	var created []*acme.Order
+	order, err = m.authorizeOrder(ctx, client, nil, func(order *acme.Order) {
+		created = append(created, order)
+	}, "test.ru")
+	td.CmpNoError(err)
+	td.Cmp(order, newOrder)
+	td.Cmp(created, []*acme.Order{newOrder})
+}
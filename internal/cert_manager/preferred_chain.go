@@ -0,0 +1,83 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// acmeAlternateChainsClient is part of acme client for get alternate certificate chains.
+// It is separate from AcmeClient for optional support.
+type acmeAlternateChainsClient interface {
+	ListCertAlternates(ctx context.Context, url string) ([]string, error)
+	FetchCert(ctx context.Context, url string, bundle bool) ([][]byte, error)
+}
+
+// selectPreferredChain return certificate chain, which match to m.PreferredChain: default chain
+// or one of alternate chains, offered by acme server. It return default chain if no match chain.
+func (m *Manager) selectPreferredChain(ctx context.Context, acmeClient AcmeClient, der [][]byte, certURL string) [][]byte {
+	if m.PreferredChain == "" || chainMatch(der, m.PreferredChain) {
+		return der
+	}
+	logger := zc.L(ctx).With(zap.String("preferred_chain", m.PreferredChain))
+
+	alternatesClient, ok := acmeClient.(acmeAlternateChainsClient)
+	if !ok {
+		logger.Info("Acme client doesn't support alternate chains, use default chain")
+		return der
+	}
+
+	alternates, err := alternatesClient.ListCertAlternates(ctx, certURL)
+	log.DebugError(logger, err, "List alternate certificate chains", zap.Strings("alternates", alternates))
+	if err != nil {
+		return der
+	}
+
+	for _, alternateURL := range alternates {
+		alternateDer, err := alternatesClient.FetchCert(ctx, alternateURL, true)
+		log.DebugError(logger, err, "Fetch alternate certificate chain", zap.String("url", alternateURL))
+		if err != nil {
+			continue
+		}
+		if chainMatch(alternateDer, m.PreferredChain) {
+			logger.Info("Use preferred certificate chain", zap.String("url", alternateURL))
+			return alternateDer
+		}
+	}
+
+	logger.Info("Preferred certificate chain isn't offered by acme server, use default chain",
+		zap.Int("alternates_count", len(alternates)))
+	return der
+}
+
+// chainMatch check if the chain match to preferred: issuer common name of topmost certificate of the chain
+// (same as certbot) or sha256 fingerprint of any issuer certificate of the chain (hex, case and colons ignored).
+func chainMatch(der [][]byte, preferred string) bool {
+	if len(der) == 0 {
+		return false
+	}
+	top, err := x509.ParseCertificate(der[len(der)-1])
+	if err != nil {
+		return false
+	}
+	if top.Issuer.CommonName == preferred {
+		return true
+	}
+
+	fingerprint := strings.ToLower(strings.ReplaceAll(preferred, ":", ""))
+	for _, certDer := range der[1:] {
+		sum := sha256.Sum256(certDer)
+		if hex.EncodeToString(sum[:]) == fingerprint {
+			return true
+		}
+	}
+	return false
+}
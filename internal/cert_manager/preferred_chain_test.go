@@ -0,0 +1,104 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
+)
+
+type alternateChainsClientFake struct {
+	AcmeClient // not used
+
+	alternates map[string][][]byte
+}
+
+func (c alternateChainsClientFake) ListCertAlternates(_ context.Context, url string) ([]string, error) {
+	if url != "cert-url" {
+		return nil, errors.New("unexpected url")
+	}
+	var res []string
+	for alternateURL := range c.alternates {
+		res = append(res, alternateURL)
+	}
+	return res, nil
+}
+
+func (c alternateChainsClientFake) FetchCert(_ context.Context, url string, _ bool) ([][]byte, error) {
+	if der, ok := c.alternates[url]; ok {
+		return der, nil
+	}
+	return nil, errors.New("not found")
+}
+
+// testChains return default chain (cross-signed by old root) and alternate chain (short)
+func testChains(t *testing.T) (defaultChain, alternateChain [][]byte) {
+	ca := func(cn string) x509.Certificate {
+		return x509.Certificate{Subject: pkix.Name{CommonName: cn}, IsCA: true, BasicConstraintsValid: true}
+	}
+
+	oldRoot := testcert.New(t, ca("Old Root"), nil, nil)
+	root := testcert.New(t, ca("New Root"), nil, nil)
+	cross := testcert.New(t, ca("New Root"), oldRoot, root.PrivateKey.(crypto.Signer))
+	inter := testcert.New(t, ca("Inter"), root, nil)
+	leaf := testcert.New(t, x509.Certificate{Subject: pkix.Name{CommonName: "test.ru"}}, inter, nil)
+
+	leafDer, interDer := leaf.Certificate[0], inter.Certificate[0]
+	return [][]byte{leafDer, interDer, cross.Certificate[0]}, [][]byte{leafDer, interDer}
+}
+
+func TestChainMatch(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	defaultChain, alternateChain := testChains(t)
+	td.True(chainMatch(defaultChain, "Old Root"))
+	td.False(chainMatch(defaultChain, "New Root"))
+	td.True(chainMatch(alternateChain, "New Root"))
+	td.False(chainMatch(alternateChain, "Inter"))
+	td.False(chainMatch(nil, "New Root"))
+
+	sum := sha256.Sum256(alternateChain[1])
+	fingerprint := strings.ToUpper(hex.EncodeToString(sum[:]))
+	td.True(chainMatch(defaultChain, fingerprint))
+	td.True(chainMatch(alternateChain, fingerprint[:2]+":"+fingerprint[2:]))
+
+	leafSum := sha256.Sum256(alternateChain[0])
+	td.False(chainMatch(alternateChain, hex.EncodeToString(leafSum[:])))
+}
+
+func TestManager_SelectPreferredChain(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	defaultChain, alternateChain := testChains(t)
+	client := alternateChainsClientFake{alternates: map[string][][]byte{"alternate-url": alternateChain}}
+
+	m := New(nil, nil, nil)
+	td.Cmp(m.selectPreferredChain(ctx, client, defaultChain, "cert-url"), defaultChain)
+
+	m.PreferredChain = "New Root"
+	td.Cmp(m.selectPreferredChain(ctx, client, defaultChain, "cert-url"), alternateChain)
+
+	m.PreferredChain = "Old Root"
+	td.Cmp(m.selectPreferredChain(ctx, client, defaultChain, "cert-url"), defaultChain)
+
+	m.PreferredChain = "Unknown Root"
+	td.Cmp(m.selectPreferredChain(ctx, client, defaultChain, "cert-url"), defaultChain)
+
+	// client without alternate chains support
+	m.PreferredChain = "New Root"
+	td.Cmp(m.selectPreferredChain(ctx, NewAcmeClientMock(t), defaultChain, "cert-url"), defaultChain)
+}
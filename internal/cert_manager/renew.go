@@ -0,0 +1,102 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"net/http"
+	"strconv"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/events"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// minReusedECDSAKeyBits - min curve size of reused ecdsa key, same as for new keys (P-256)
+const minReusedECDSAKeyBits = 256
+
+type forceKeyRotationKey struct{}
+
+// withForcedKeyRotation mark context for issue certificate with new key, even if ReuseKeyOnRenewal
+func withForcedKeyRotation(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceKeyRotationKey{}, true)
+}
+
+func isKeyRotationForced(ctx context.Context) bool {
+	forced, _ := ctx.Value(forceKeyRotationKey{}).(bool)
+	return forced
+}
+
+// checkKeyReusable return error if key has other type than certificate or weak (for example generated
+// by old version with short key length).
+func checkKeyReusable(key crypto.Signer, keyType KeyType) error {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if keyType != KeyRSA {
+			return xerrors.Errorf("rsa key for %v certificate", keyType)
+		}
+		if bits := k.N.BitLen(); bits < domainKeyRSALength {
+			return xerrors.Errorf("weak rsa key: %v bits, need %v", bits, domainKeyRSALength)
+		}
+	case *ecdsa.PrivateKey:
+		if keyType != KeyECDSA {
+			return xerrors.Errorf("ecdsa key for %v certificate", keyType)
+		}
+		if bits := k.Curve.Params().BitSize; bits < minReusedECDSAKeyBits {
+			return xerrors.Errorf("weak ecdsa key: %v bits, need %v", bits, minReusedECDSAKeyBits)
+		}
+	default:
+		return xerrors.Errorf("unexpected key type: %T", key)
+	}
+	return nil
+}
+
+// Renew issue new certificates of all allowed key types for domain now. If rotateKey - with new keys,
+// even if ReuseKeyOnRenewal.
+func (m *Manager) Renew(ctx context.Context, needDomain domain.DomainName, rotateKey bool) error {
+	if rotateKey {
+		ctx = withForcedKeyRotation(ctx)
+	}
+	for _, keyType := range m.allowedKeyTypes() {
+		cd, isGroup := CertDescriptionFromGroup(needDomain, keyType, m.CertGroups)
+		if !isGroup {
+			cd = CertDescriptionFromDomain(needDomain, keyType, m.autoSubdomains())
+		}
+		certCtx := zc.WithLogger(ctx, zc.L(ctx).With(cd.ZapField()))
+		if _, err := m.issueNewCert(certCtx, needDomain, cd, events.TypeCertRenewed); err != nil {
+			return xerrors.Errorf("renew certificate %v: %w", cd, err)
+		}
+	}
+	return nil
+}
+
+// RenewHandler renew certificates of domain by POST /renew?domain=example.com, with new keys if rotate_key=true
+func (m *Manager) RenewHandler(logger *zap.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		needDomain, err := domain.NormalizeDomain(r.URL.Query().Get("domain"))
+		if err != nil || needDomain == "" {
+			http.Error(w, "Bad domain", http.StatusBadRequest)
+			return
+		}
+		rotateKey, _ := strconv.ParseBool(r.URL.Query().Get("rotate_key"))
+
+		ctx := zc.WithLogger(r.Context(), logger.With(domain.LogDomain(needDomain), zap.Bool("rotate_key", rotateKey)))
+		err = m.Renew(ctx, needDomain, rotateKey)
+		log.InfoError(zc.L(ctx), err, "Renew certificates by admin request", zap.String("remote_address", r.RemoteAddr))
+		if err != nil {
+			http.Error(w, "Can't renew certificate", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
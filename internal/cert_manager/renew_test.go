@@ -0,0 +1,110 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestCheckKeyReusable(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, domainKeyRSALength)
+	td.CmpNoError(err)
+	weakRSAKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	td.CmpNoError(err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	td.CmpNoError(err)
+	weakECDSAKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	td.CmpNoError(err)
+
+	td.CmpNoError(checkKeyReusable(rsaKey, KeyRSA))
+	td.CmpNoError(checkKeyReusable(ecdsaKey, KeyECDSA))
+	td.CmpError(checkKeyReusable(weakRSAKey, KeyRSA))
+	td.CmpError(checkKeyReusable(weakECDSAKey, KeyECDSA))
+	td.CmpError(checkKeyReusable(rsaKey, KeyECDSA))
+	td.CmpError(checkKeyReusable(ecdsaKey, KeyRSA))
+}
+
+func TestManager_CertKeyGetOrCreate(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := &cache.DiskCache{Dir: th.TmpDir(e)}
+	m := New(nil, storage, nil)
+	cd := CertDescription{MainDomain: "test.ru", KeyType: KeyECDSA}
+	pemEncodeECKey := func(key *ecdsa.PrivateKey) []byte {
+		der, err := x509.MarshalECPrivateKey(key)
+		e.CmpNoError(err)
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	}
+
+	storedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	e.CmpNoError(err)
+	e.CmpNoError(storage.Put(ctx, cd.KeyStoreName(), pemEncodeECKey(storedKey)))
+
+	// rotate by default
+	key, err := m.certKeyGetOrCreate(ctx, cd)
+	e.CmpNoError(err)
+	e.False(storedKey.Equal(key))
+
+	m.ReuseKeyOnRenewal = true
+	key, err = m.certKeyGetOrCreate(ctx, cd)
+	e.CmpNoError(err)
+	e.True(storedKey.Equal(key))
+
+	key, err = m.certKeyGetOrCreate(withForcedKeyRotation(ctx), cd)
+	e.CmpNoError(err)
+	e.False(storedKey.Equal(key))
+
+	// weak key replaced
+	weakKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	e.CmpNoError(err)
+	e.CmpNoError(storage.Put(ctx, cd.KeyStoreName(), pemEncodeECKey(weakKey)))
+	key, err = m.certKeyGetOrCreate(ctx, cd)
+	e.CmpNoError(err)
+	e.False(weakKey.Equal(key))
+	e.CmpNoError(checkKeyReusable(key, KeyECDSA))
+}
+
+func TestManager_RenewHandler(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	mc := minimock.NewController(e)
+	defer mc.Finish()
+
+	checker := NewDomainCheckerMock(mc)
+	checker.IsDomainAllowedMock.Return(true, nil)
+
+	m := New(nil, newCacheMock(e), nil)
+	m.DryRun = true
+	m.DomainChecker = checker
+	handler := m.RenewHandler(zap.NewNop())
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/renew?domain=test.ru", nil))
+	e.Cmp(recorder.Code, http.StatusMethodNotAllowed)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/renew", nil))
+	e.Cmp(recorder.Code, http.StatusBadRequest)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/renew?domain=test.ru&rotate_key=true", nil).WithContext(ctx))
+	e.Cmp(recorder.Code, http.StatusNoContent)
+}
@@ -0,0 +1,67 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"time"
+)
+
+// renewalBackoff return delay of renew after count consecutive failures:
+// RenewalBackoffMin doubled after every failure, up to RenewalBackoffMax.
+func (m *Manager) renewalBackoff(count int) time.Duration {
+	if m.RenewalBackoffMin <= 0 || count <= 0 {
+		return 0
+	}
+	res := m.RenewalBackoffMin
+	for i := 1; i < count; i++ {
+		if m.RenewalBackoffMax > 0 && res >= m.RenewalBackoffMax {
+			break
+		}
+		if res > res*2 { // overflow
+			break
+		}
+		res *= 2
+	}
+	if m.RenewalBackoffMax > 0 && res > m.RenewalBackoffMax {
+		res = m.RenewalBackoffMax
+	}
+	return res
+}
+
+// renewalDelayed return time of next renew attempt and true if renew of certificate delayed by failures
+func (m *Manager) renewalDelayed(cd CertDescription, now time.Time) (time.Time, bool) {
+	m.cachedCertsMu.Lock()
+	failure, ok := m.issueFailures[cd.String()]
+	m.cachedCertsMu.Unlock()
+
+	if !ok {
+		return time.Time{}, false
+	}
+	retry := failure.time.Add(m.renewalBackoff(failure.count))
+	return retry, now.Before(retry)
+}
+
+func (m *Manager) isFailureRenewalFailing(failure issueFailure) bool {
+	return m.RenewalFailingAfter > 0 && failure.count >= m.RenewalFailingAfter
+}
+
+// isRenewalFailing return true if certificate failed to issue RenewalFailingAfter times since last successful issue
+func (m *Manager) isRenewalFailing(cd CertDescription) bool {
+	m.cachedCertsMu.Lock()
+	defer m.cachedCertsMu.Unlock()
+
+	failure, ok := m.issueFailures[cd.String()]
+	return ok && m.isFailureRenewalFailing(failure)
+}
+
+func (m *Manager) renewalFailingCount() int {
+	m.cachedCertsMu.Lock()
+	defer m.cachedCertsMu.Unlock()
+
+	res := 0
+	for _, failure := range m.issueFailures {
+		if m.isFailureRenewalFailing(failure) {
+			res++
+		}
+	}
+	return res
+}
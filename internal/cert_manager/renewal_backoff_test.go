@@ -0,0 +1,93 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestManager_RenewalBackoff(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := &Manager{}
+	td.Cmp(m.renewalBackoff(3), time.Duration(0))
+
+	m.RenewalBackoffMin = time.Minute
+	m.RenewalBackoffMax = 10 * time.Minute
+	for count, expected := range []time.Duration{0, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute,
+		10 * time.Minute, 10 * time.Minute} {
+		td.Cmp(m.renewalBackoff(count), expected, count)
+	}
+	td.Cmp(m.renewalBackoff(1000), 10*time.Minute)
+
+	// without max
+	m.RenewalBackoffMax = 0
+	td.Cmp(m.renewalBackoff(4), 8*time.Minute)
+	td.Gt(m.renewalBackoff(1000), time.Duration(0))
+}
+
+func TestManager_RenewalFailing(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	m := &Manager{RenewalBackoffMin: time.Minute, RenewalBackoffMax: time.Hour, RenewalFailingAfter: 3}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	cd := CertDescription{MainDomain: "stale.com", KeyType: KeyRSA}
+	m.cachedCertUpdate(cd, nil, now, true)
+
+	_, delayed := m.renewalDelayed(cd, now)
+	td.False(delayed)
+
+	// denied renew of known certificate remembered
+	for i := 0; i < 3; i++ {
+		m.issueFailed(cd, errDomainDenied, now)
+	}
+	retry, delayed := m.renewalDelayed(cd, now.Add(3*time.Minute))
+	td.True(delayed)
+	td.Cmp(retry, now.Add(4*time.Minute))
+	_, delayed = m.renewalDelayed(cd, now.Add(4*time.Minute))
+	td.False(delayed)
+	td.True(m.isRenewalFailing(cd))
+	td.Cmp(m.renewalFailingCount(), 1)
+
+	nextAttempt := now.Add(4 * time.Minute)
+	td.Cmp(m.Certs(), []CertInfo{{Name: "stale.com", KeyType: "rsa", Mode: certModeOnDemand, LastServed: &now,
+		IssueErrorTime: &now, IssueErrorCategory: "domain_not_allowed", IssueError: errDomainDenied.Error(),
+		IssueFailures: 3, RenewalFailing: true, NextRenewAttempt: &nextAttempt}})
+
+	// successful issue reset backoff
+	m.issueSucceeded(cd)
+	_, delayed = m.renewalDelayed(cd, now)
+	td.False(delayed)
+	td.False(m.isRenewalFailing(cd))
+	td.Cmp(m.renewalFailingCount(), 0)
+}
+
+func TestManager_RenewCertInBackgroundBackoff(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	var buf bytes.Buffer
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&buf),
+		zapcore.DebugLevel))
+	ctx = zc.WithLogger(ctx, logger)
+
+	m := &Manager{RenewalBackoffMin: time.Hour}
+	cd := CertDescription{MainDomain: "stale.com", KeyType: KeyRSA}
+	m.issueFailed(cd, classifyIssueError(errors.New("test")), time.Now())
+
+	// issue without acme client panic, so renew must be skipped before it
+	m.renewCertInBackground(ctx, "stale.com", cd)
+	td.Cmp(buf.String(), testdeep.Contains("Skip reissue certificate in background by backoff after failures"))
+	td.Cmp(buf.String(), testdeep.Not(testdeep.Contains("Start reissue certificate in background")))
+}
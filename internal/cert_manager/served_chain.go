@@ -0,0 +1,45 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// servedChain return chain for serve in handshake: leaf with ServedIntermediates if it set,
+// else the chain without root (self-signed) certificates if ServeRootCert disabled.
+func (m *Manager) servedChain(der [][]byte) [][]byte {
+	if len(der) == 0 {
+		return der
+	}
+	if m.ServedIntermediates != nil {
+		res := make([][]byte, 0, len(m.ServedIntermediates)+1)
+		res = append(res, der[0])
+		return append(res, m.ServedIntermediates...)
+	}
+	if m.ServeRootCert {
+		return der
+	}
+
+	end := len(der)
+	for end > 1 && isSelfSignedDer(der[end-1]) {
+		end--
+	}
+	return der[:end]
+}
+
+// servedCertificate return copy of the certificate with served chain
+func (m *Manager) servedCertificate(cert *tls.Certificate) *tls.Certificate {
+	res := *cert
+	res.Certificate = m.servedChain(cert.Certificate)
+	return &res
+}
+
+func isSelfSignedDer(der []byte) bool {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil
+}
@@ -0,0 +1,48 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
+)
+
+func TestManager_ServedChain(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	rootDer := testcert.New(t, x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Root"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil, nil).Certificate[0]
+
+	chain, _ := testChains(t)
+	leafDer, interDer, crossDer := chain[0], chain[1], chain[2]
+	chainWithRoot := [][]byte{leafDer, interDer, crossDer, rootDer}
+
+	td.True(isSelfSignedDer(rootDer))
+	td.False(isSelfSignedDer(crossDer))
+	td.False(isSelfSignedDer([]byte("bad")))
+
+	m := Manager{}
+	td.Cmp(m.servedChain(chainWithRoot), [][]byte{leafDer, interDer, crossDer})
+	td.Cmp(m.servedChain(chain), chain)
+	td.Cmp(m.servedChain([][]byte{rootDer}), [][]byte{rootDer})
+	td.Cmp(m.servedChain(nil), testdeep.Nil())
+
+	m.ServeRootCert = true
+	td.Cmp(m.servedChain(chainWithRoot), chainWithRoot)
+
+	m.ServedIntermediates = [][]byte{interDer}
+	td.Cmp(m.servedChain(chainWithRoot), [][]byte{leafDer, interDer})
+
+	cert := &tls.Certificate{Certificate: chainWithRoot}
+	served := m.servedCertificate(cert)
+	td.Cmp(served.Certificate, [][]byte{leafDer, interDer})
+	td.Cmp(cert.Certificate, chainWithRoot)
+}
@@ -0,0 +1,149 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"sort"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// TLSAInfo - values of TLSA records (usage DANE-EE, selector SubjectPublicKeyInfo) of stored certificate
+// for publish in DNS, for example: _25._tcp.example.com. IN TLSA 3 1 1 <hash>.
+// Values changed with key of certificate only, see Manager.ReuseKeyOnRenewal.
+type TLSAInfo struct {
+	Name    string    `json:"name"`
+	KeyType string    `json:"key_type"`
+	Domains []string  `json:"domains"`
+	Expire  time.Time `json:"expire"`
+	SHA256  string    `json:"tlsa_sha256"` // 3 1 1
+	SHA512  string    `json:"tlsa_sha512"` // 3 1 2
+}
+
+// TLSA return TLSA records values of stored certificates. If cache can't list keys - for known certificates only.
+func (m *Manager) TLSA(ctx context.Context) ([]TLSAInfo, error) {
+	var cds []CertDescription
+	if lister, ok := m.Cache.(cache.KeysLister); ok {
+		keys, err := lister.Keys(ctx)
+		if err != nil {
+			return nil, xerrors.Errorf("list cache keys: %w", err)
+		}
+		for _, key := range keys {
+			if cd, ok := certDescriptionFromCertStoreName(key); ok {
+				cds = append(cds, cd)
+			}
+		}
+	} else {
+		m.cachedCertsMu.Lock()
+		for _, info := range m.cachedCerts {
+			cds = append(cds, info.cd)
+		}
+		m.cachedCertsMu.Unlock()
+	}
+
+	res := make([]TLSAInfo, 0, len(cds))
+	for _, cd := range cds {
+		leaf, err := getStoredLeaf(ctx, m.Cache, cd)
+		if err == cache.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("get certificate %v: %w", cd, err)
+		}
+		item := TLSAInfo{Name: cd.MainDomain, KeyType: cd.KeyType.String(), Domains: leaf.DNSNames, Expire: leaf.NotAfter}
+		if cd.Group != "" {
+			item.Name = certGroupStorePrefix + cd.Group
+		}
+		item.SHA256, item.SHA512 = tlsaRecords(leaf.RawSubjectPublicKeyInfo)
+		res = append(res, item)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Name != res[j].Name {
+			return res[i].Name < res[j].Name
+		}
+		return res[i].KeyType < res[j].KeyType
+	})
+	return res, nil
+}
+
+// TLSAHandler return TLSA records values of stored certificates as json
+func (m *Manager) TLSAHandler(logger *zap.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, err := m.TLSA(zc.WithLogger(r.Context(), logger))
+		log.DebugError(logger, err, "Get TLSA records", zap.Int("count", len(res)))
+		if err != nil {
+			http.Error(w, "Can't get TLSA records", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	})
+}
+
+// tlsaRecords return data of TLSA records 3 1 1 and 3 1 2 for public key
+func tlsaRecords(spki []byte) (sha256Record, sha512Record string) {
+	sum256 := sha256.Sum256(spki)
+	sum512 := sha512.Sum512(spki)
+	return "3 1 1 " + hex.EncodeToString(sum256[:]), "3 1 2 " + hex.EncodeToString(sum512[:])
+}
+
+// warnKeyChange warn if stored certificate has other key than key for new certificate:
+// TLSA records of the certificate must be updated after issue. Without ReuseKeyOnRenewal the change is expected
+// and logged with info level.
+func (m *Manager) warnKeyChange(ctx context.Context, cd CertDescription, key crypto.Signer) {
+	logger := zc.L(ctx)
+
+	leaf, err := getStoredLeaf(ctx, m.Cache, cd)
+	if err == cache.ErrCacheMiss {
+		return
+	}
+	if err != nil {
+		logger.Debug("Can't get stored certificate for compare keys", zap.Error(err))
+		return
+	}
+
+	newSPKI, err := x509.MarshalPKIXPublicKey(key.Public())
+	log.DebugDPanic(logger, err, "Marshal public key")
+	if err != nil || bytes.Equal(newSPKI, leaf.RawSubjectPublicKeyInfo) {
+		return
+	}
+
+	oldRecord, _ := tlsaRecords(leaf.RawSubjectPublicKeyInfo)
+	newRecord, _ := tlsaRecords(newSPKI)
+	level := zapcore.InfoLevel
+	if m.ReuseKeyOnRenewal {
+		level = zapcore.WarnLevel
+	}
+	log.LevelParam(logger, level, "Key of certificate will be changed, update TLSA records", cd.ZapField(),
+		zap.String("old_tlsa", oldRecord), zap.String("new_tlsa", newRecord))
+}
+
+// getStoredLeaf return leaf certificate from cache without key and validation
+func getStoredLeaf(ctx context.Context, c cache.Bytes, cd CertDescription) (*x509.Certificate, error) {
+	certBytes, err := c.Get(ctx, cd.CertStoreName())
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certBytes)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, xerrors.New("no certificate in pem")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
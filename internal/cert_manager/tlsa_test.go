@@ -0,0 +1,109 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
+)
+
+func TestManager_TLSA(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := &cache.DiskCache{Dir: th.TmpDir(e)}
+	m := New(nil, storage, nil)
+
+	cert := testcert.New(t, x509.Certificate{
+		NotAfter: time.Now().Add(time.Hour).Truncate(time.Second),
+		DNSNames: []string{"test.ru", "www.test.ru"},
+	}, nil, nil)
+	key := cert.PrivateKey.(*ecdsa.PrivateKey)
+	cd := CertDescription{MainDomain: "test.ru", KeyType: KeyECDSA}
+	e.CmpNoError(storeCertificate(ctx, storage, cd, cert))
+
+	spki, err := x509.MarshalPKIXPublicKey(key.Public())
+	e.CmpNoError(err)
+	sum := sha256.Sum256(spki)
+	sum512 := sha512.Sum512(spki)
+
+	res, err := m.TLSA(ctx)
+	e.CmpNoError(err)
+	e.Cmp(res, []TLSAInfo{{
+		Name:    "test.ru",
+		KeyType: "ecdsa",
+		Domains: []string{"test.ru", "www.test.ru"},
+		Expire:  cert.Leaf.NotAfter.UTC(),
+		SHA256:  "3 1 1 " + hex.EncodeToString(sum[:]),
+		SHA512:  "3 1 2 " + hex.EncodeToString(sum512[:]),
+	}})
+
+	recorder := httptest.NewRecorder()
+	m.TLSAHandler(zap.NewNop()).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/tlsa", nil))
+	e.Cmp(recorder.Header().Get("Content-Type"), "application/json")
+	var handlerRes []TLSAInfo
+	e.CmpNoError(json.Unmarshal(recorder.Body.Bytes(), &handlerRes))
+	e.Cmp(handlerRes, res)
+
+	var warnings []string
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.AddSync(ioutil.Discard), zapcore.DebugLevel), zap.Hooks(func(entry zapcore.Entry) error {
+		if entry.Level == zapcore.WarnLevel {
+			warnings = append(warnings, entry.Message)
+		}
+		return nil
+	}))
+	logCtx := zc.WithLogger(ctx, logger)
+
+	m.ReuseKeyOnRenewal = true
+	m.warnKeyChange(logCtx, cd, key)
+	e.Cmp(warnings, testdeep.Empty())
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	e.CmpNoError(err)
+	m.warnKeyChange(logCtx, cd, newKey)
+	e.Cmp(warnings, []string{"Key of certificate will be changed, update TLSA records"})
+
+	// certificate without stored certificate - new key expected
+	m.warnKeyChange(logCtx, CertDescription{MainDomain: "other.ru", KeyType: KeyECDSA}, newKey)
+	e.Cmp(warnings, testdeep.Len(1))
+}
+
+func TestManager_EvictCachedCertPinKeys(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	storage := &cache.DiskCache{Dir: th.TmpDir(e)}
+	for _, key := range []string{"a.ru.rsa.cer", "a.ru.rsa.key", "a.ru.rsa.json"} {
+		e.CmpNoError(storage.Put(ctx, key, []byte{}))
+	}
+
+	m := New(nil, storage, nil)
+	m.PinKeys = true
+	e.CmpNoError(m.evictCachedCert(ctx, CertDescription{MainDomain: "a.ru", KeyType: KeyRSA}))
+
+	keys, err := storage.Keys(ctx)
+	e.CmpNoError(err)
+	sort.Strings(keys)
+	e.Cmp(keys, []string{"a.ru.rsa.key"})
+}
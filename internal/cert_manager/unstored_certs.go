@@ -0,0 +1,184 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const defaultStoreRetryInterval = time.Minute
+
+// storeIssuedCertificate store certificate to cache. If store failed (for example disk is full) -
+// the certificate kept in memory, served from it and store retried in background.
+// It prevent issue new certificate (and waste rate limits) on every handshake.
+func (m *Manager) storeIssuedCertificate(ctx context.Context, cd CertDescription, cert *tls.Certificate) {
+	logger := zc.L(ctx)
+
+	// serialized with background store: older unstored certificate must not overwrite stored newer certificate
+	m.storeMu.Lock()
+	err := m.storeCertificateAndMeta(ctx, cd, cert)
+	if err == nil {
+		// older unstored certificate replaced by the stored certificate, its retry stopped
+		m.unstoredCertsMu.Lock()
+		delete(m.unstoredCerts, cd.String())
+		m.unstoredCertsMu.Unlock()
+	}
+	m.storeMu.Unlock()
+
+	if err == nil {
+		logger.Debug("Certificate stored")
+		return
+	}
+
+	logger.Error("Can't store issued certificate to cache (disk is full?). "+
+		"Keep certificate in memory and retry store in background.", zap.Error(err))
+
+	m.unstoredCertsMu.Lock()
+	if m.unstoredCerts == nil {
+		m.unstoredCerts = make(map[string]*tls.Certificate)
+	}
+	_, retryStarted := m.unstoredCerts[cd.String()]
+	m.unstoredCerts[cd.String()] = cert
+	m.unstoredCertsMu.Unlock()
+
+	if !retryStarted {
+		// handlepanic: in retryStoreCertificate
+		go m.retryStoreCertificate(logger.Named("background_store"), cd)
+	}
+}
+
+func (m *Manager) storeCertificateAndMeta(ctx context.Context, cd CertDescription, cert *tls.Certificate) (err error) {
+	m.certStoreStart()
+	defer func() {
+		m.certStoreFinish(err)
+	}()
+
+	err = storeCertificate(ctx, m.Cache, cd, cert)
+	if err != nil {
+		return err
+	}
+	if m.SaveJSONMeta {
+		err = storeCertificateMeta(ctx, m.Cache, cd, cert)
+	}
+	return err
+}
+
+// unstoredCert return certificate, which issued but not stored to cache yet. nil if no the certificate.
+func (m *Manager) unstoredCert(cd CertDescription) *tls.Certificate {
+	m.unstoredCertsMu.Lock()
+	defer m.unstoredCertsMu.Unlock()
+
+	return m.unstoredCerts[cd.String()]
+}
+
+// retryStoreCertificate store certificate from unstored list until success, remove of the certificate from list
+// or stop of manager.
+func (m *Manager) retryStoreCertificate(logger *zap.Logger, cd CertDescription) {
+	defer log.HandlePanic(logger)
+
+	// detach from request lifetime, but save log context
+	ctx, cancel := context.WithCancel(zc.WithLogger(context.Background(), logger))
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stoppedChan():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	key := cd.String()
+
+	ticker := time.NewTicker(m.storeRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("Manager stopped, stop retry store certificate")
+			return
+		case <-ticker.C:
+		}
+
+		stop, err := m.retryStoreCertificateOnce(ctx, cd, key)
+		if stop {
+			return
+		}
+		log.InfoError(logger, err, "Retry store certificate to cache")
+	}
+}
+
+// retryStoreCertificateOnce store certificate, which is current unstored certificate for the key.
+// It return stop = true if nothing to store more.
+func (m *Manager) retryStoreCertificateOnce(ctx context.Context, cd CertDescription, key string) (stop bool, err error) {
+	logger := zc.L(ctx)
+
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+
+	m.unstoredCertsMu.Lock()
+	cert := m.unstoredCerts[key]
+	m.unstoredCertsMu.Unlock()
+
+	if cert == nil {
+		logger.Info("Certificate removed from unstored list, stop retry store it")
+		return true, nil
+	}
+	if cert.Leaf != nil && time.Now().After(cert.Leaf.NotAfter) {
+		logger.Warn("Unstored certificate expired, stop retry store it")
+		m.removeUnstoredCert(key, cert)
+		return true, nil
+	}
+
+	// certificate can't be replaced while store: storeIssuedCertificate wait storeMu
+	err = m.storeCertificateAndMeta(ctx, cd, cert)
+	if err != nil {
+		return false, err
+	}
+	m.removeUnstoredCert(key, cert)
+	return true, nil
+}
+
+// Close stop background work of manager, started by the manager itself (without Start* methods).
+func (m *Manager) Close() error {
+	m.stopMu.Lock()
+	defer m.stopMu.Unlock()
+
+	if m.stopped == nil {
+		m.stopped = make(chan struct{})
+	}
+	if !m.isStopped {
+		m.isStopped = true
+		close(m.stopped)
+	}
+	return nil
+}
+
+// stoppedChan return channel, closed by Close
+func (m *Manager) stoppedChan() <-chan struct{} {
+	m.stopMu.Lock()
+	defer m.stopMu.Unlock()
+
+	if m.stopped == nil {
+		m.stopped = make(chan struct{})
+	}
+	return m.stopped
+}
+
+// removeUnstoredCert remove certificate from unstored list if it wasn't replaced by newer certificate.
+// It return true if the cert removed.
+func (m *Manager) removeUnstoredCert(key string, cert *tls.Certificate) bool {
+	m.unstoredCertsMu.Lock()
+	defer m.unstoredCertsMu.Unlock()
+
+	if m.unstoredCerts[key] != cert {
+		return false
+	}
+	delete(m.unstoredCerts, key)
+	return true
+}
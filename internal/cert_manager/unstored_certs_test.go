@@ -0,0 +1,141 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
+)
+
+// storedCertTemplate is template of long valid certificate - for prevent background renew
+func storedCertTemplate() x509.Certificate {
+	return x509.Certificate{NotAfter: time.Now().Add(renewBeforeExpire * 2), DNSNames: []string{"test.ru"}}
+}
+
+func TestManager_StoreIssuedCertificateFailed(t *testing.T) {
+	td := testdeep.NewT(t)
+	c, cancel := createManager(t)
+	defer cancel()
+
+	cert := *testcert.New(t, storedCertTemplate(), nil, nil)
+
+	var mu sync.Mutex
+	diskFull := true
+	stored := make(map[string][]byte)
+	c.cache.PutMock.Set(func(ctx context.Context, key string, data []byte) (err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if diskFull {
+			return errors.New("no space left on device")
+		}
+		stored[key] = data
+		return nil
+	})
+	c.cache.GetMock.Return(nil, cache.ErrCacheMiss)
+	c.manager.storeRetryInterval = time.Millisecond * 10
+
+	cd := CertDescription{MainDomain: "test.ru", KeyType: KeyRSA}
+	c.manager.storeIssuedCertificate(c.ctx, cd, &cert)
+	td.Cmp(c.manager.unstoredCert(cd), &cert)
+
+	// serve unstored certificate instead of issue new
+	c.certState.GetMock.Return(&certState{}, nil)
+	res, err := c.manager.getCertificate(c.ctx, "test.ru", KeyRSA)
+	td.CmpNoError(err)
+	td.Cmp(res.Certificate, cert.Certificate)
+
+	mu.Lock()
+	diskFull = false
+	mu.Unlock()
+
+	for i := 0; i < 100 && c.manager.unstoredCert(cd) != nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	td.Nil(c.manager.unstoredCert(cd))
+
+	mu.Lock()
+	defer mu.Unlock()
+	td.Cmp(stored, testdeep.ContainsKey(cd.CertStoreName()))
+	td.Cmp(stored, testdeep.ContainsKey(cd.KeyStoreName()))
+}
+
+func TestManager_StoreIssuedCertificateReplaceUnstored(t *testing.T) {
+	td := testdeep.NewT(t)
+	c, cancel := createManager(t)
+	defer cancel()
+	defer func() { _ = c.manager.Close() }()
+
+	var mu sync.Mutex
+	diskFull := true
+	puts := 0
+	c.cache.PutMock.Set(func(ctx context.Context, key string, data []byte) (err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		puts++
+		if diskFull {
+			return errors.New("no space left on device")
+		}
+		return nil
+	})
+	c.cache.GetMock.Return(nil, cache.ErrCacheMiss)
+	c.manager.storeRetryInterval = time.Hour
+
+	cd := CertDescription{MainDomain: "test.ru", KeyType: KeyRSA}
+	old := testcert.New(t, storedCertTemplate(), nil, nil)
+	c.manager.storeIssuedCertificate(c.ctx, cd, old)
+	td.Cmp(c.manager.unstoredCert(cd), old)
+
+	// stored newer certificate replace unstored, retry doesn't store old certificate
+	mu.Lock()
+	diskFull = false
+	mu.Unlock()
+	c.manager.storeIssuedCertificate(c.ctx, cd, testcert.New(t, storedCertTemplate(), nil, nil))
+	td.Nil(c.manager.unstoredCert(cd))
+
+	mu.Lock()
+	putsBefore := puts
+	mu.Unlock()
+	stop, err := c.manager.retryStoreCertificateOnce(c.ctx, cd, cd.String())
+	td.True(stop)
+	td.CmpNoError(err)
+	mu.Lock()
+	td.Cmp(puts, putsBefore)
+	mu.Unlock()
+}
+
+func TestManager_RetryStoreCertificateStopped(t *testing.T) {
+	td := testdeep.NewT(t)
+	c, cancel := createManager(t)
+	defer cancel()
+
+	c.manager.storeRetryInterval = time.Hour
+
+	cd := CertDescription{MainDomain: "test.ru", KeyType: KeyRSA}
+	c.manager.unstoredCerts = map[string]*tls.Certificate{cd.String(): {}}
+
+	done := make(chan struct{})
+	go func() {
+		c.manager.retryStoreCertificate(zap.NewNop(), cd)
+		close(done)
+	}()
+
+	td.CmpNoError(c.manager.Close())
+	td.CmpNoError(c.manager.Close()) // second close
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("retry store doesn't stopped")
+	}
+}
@@ -0,0 +1,119 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// WarmCacheStats - result of WarmCache
+type WarmCacheStats struct {
+	Loaded  int // valid certificates, loaded to memory
+	Expired int // expired certificates, not loaded
+	Skipped int // certificates, which can't be requested with current config: groups removed, subdomains changed
+	Failed  int // corrupted certificates or certificates, which can't be read
+}
+
+// WarmCache load valid certificates from cache to memory, so first handshakes of domains don't wait for
+// read of cache. Expired and corrupted certificates skipped, expired certificates reissued in background
+// if reissueExpired. Cache must implement cache.KeysLister.
+func (m *Manager) WarmCache(ctx context.Context, reissueExpired bool) (WarmCacheStats, error) {
+	var stats WarmCacheStats
+	logger := zc.L(ctx)
+	start := time.Now()
+
+	lister, ok := m.Cache.(cache.KeysLister)
+	if !ok {
+		return stats, xerrors.New("cache doesn't support list keys")
+	}
+	keys, err := lister.Keys(ctx)
+	if err != nil {
+		return stats, xerrors.Errorf("list cache keys: %w", err)
+	}
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		storeCD, ok := certDescriptionFromCertStoreName(key)
+		if !ok {
+			continue
+		}
+		cd, needDomain, ok := m.certDescriptionForWarm(storeCD)
+		if !ok {
+			logger.Debug("Skip certificate, which can't be requested with current config", storeCD.ZapField())
+			stats.Skipped++
+			continue
+		}
+
+		switch m.warmCert(zc.WithLogger(ctx, logger.With(cd.ZapField())), cd, needDomain, reissueExpired) {
+		case nil:
+			stats.Loaded++
+		case errCertExpired:
+			stats.Expired++
+		default:
+			stats.Failed++
+		}
+	}
+
+	logger.Info("Warm certificates cache", zap.Int("loaded", stats.Loaded), zap.Int("expired", stats.Expired),
+		zap.Int("skipped", stats.Skipped), zap.Int("failed", stats.Failed), zap.Bool("reissue_expired", reissueExpired),
+		zap.Duration("duration", time.Since(start)))
+	return stats, nil
+}
+
+// certDescriptionForWarm return full description of stored certificate (with domains of group and subdomains)
+// and domain, which served by it. false for certificates, which can't be requested with current config:
+// of groups, which doesn't exist in config, or stored with name of other auto subdomains.
+func (m *Manager) certDescriptionForWarm(storeCD CertDescription) (CertDescription, domain.DomainName, bool) {
+	if storeCD.Group == "" {
+		needDomain := domain.DomainName(storeCD.MainDomain)
+		cd := CertDescriptionFromDomain(needDomain, storeCD.KeyType, m.autoSubdomains())
+		return cd, needDomain, cd.MainDomain == storeCD.MainDomain
+	}
+	for _, group := range m.CertGroups {
+		if group.Name == storeCD.Group && len(group.Domains) > 0 {
+			cd, _ := CertDescriptionFromGroup(group.Domains[0], storeCD.KeyType, m.CertGroups)
+			return cd, group.Domains[0], true
+		}
+	}
+	return CertDescription{}, "", false
+}
+
+// warmCert load certificate from cache to local state, same as first handshake for the domain
+func (m *Manager) warmCert(ctx context.Context, cd CertDescription, needDomain domain.DomainName, reissueExpired bool) error {
+	logger := zc.L(ctx)
+	now := time.Now()
+
+	locked, err := isCertLocked(ctx, m.Cache, cd)
+	if err == nil {
+		var cert *tls.Certificate
+		cert, err = loadCertificateFromCache(ctx, m.Cache, cd, m.ClockSkewTolerance)
+		if err == nil {
+			cert, err = validCertDer([]domain.DomainName{needDomain}, m.servedChain(cert.Certificate), cert.PrivateKey,
+				locked, now, m.ClockSkewTolerance)
+		}
+		if err == nil {
+			m.certStateGet(ctx, cd).CertSet(ctx, locked, cert)
+			m.cachedCertUpdate(cd, cert, now, false)
+			return nil
+		}
+	}
+
+	if err == errCertExpired && reissueExpired && !locked {
+		logger.Info("Reissue expired certificate from cache in background")
+		// handlepanic: in renewCertInBackground
+		go m.renewCertInBackground(ctx, needDomain, cd)
+	}
+	log.DebugWarning(logger, err, "Skip certificate while warm cache")
+	return err
+}
@@ -0,0 +1,54 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestManager_WarmCache(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	const day = 24 * time.Hour
+	now := time.Now()
+	storage := &cache.DiskCache{Dir: th.TmpDir(e)}
+	put := func(name string, notAfter time.Time, names ...string) {
+		cert, key := testCertPEM(t, notAfter, names...)
+		e.CmpNoError(storage.Put(ctx, name+".cer", cert))
+		e.CmpNoError(storage.Put(ctx, name+".key", key))
+	}
+	put("valid.ru.ecdsa", now.Add(60*day), "valid.ru", "www.valid.ru")
+	put("group_sites.rsa", now.Add(60*day), "a.ru", "b.ru")
+	put("expired.ru.rsa", now.Add(-day), "expired.ru")
+	put("group_removed.rsa", now.Add(60*day), "removed.ru")
+	put("www.sub.ru.rsa", now.Add(60*day), "www.sub.ru")
+	e.CmpNoError(storage.Put(ctx, "bad.ru.rsa.cer", []byte("bad")))
+	e.CmpNoError(storage.Put(ctx, "bad.ru.rsa.key", []byte("bad")))
+	e.CmpNoError(storage.Put(ctx, "other.json", []byte("{}")))
+
+	m := New(nil, storage, nil)
+	m.AutoSubdomains = []string{"www."}
+	m.CertGroups = []CertGroup{{Name: "sites", Domains: []domain.DomainName{"a.ru", "b.ru"}}}
+
+	stats, err := m.WarmCache(ctx, false)
+	e.CmpNoError(err)
+	e.Cmp(stats, WarmCacheStats{Loaded: 2, Expired: 1, Skipped: 2, Failed: 1})
+
+	cert, err := m.certStateGet(ctx, CertDescription{MainDomain: "valid.ru", KeyType: KeyECDSA}).Cert()
+	e.CmpNoError(err)
+	e.Cmp(cert.Leaf.DNSNames, []string{"valid.ru", "www.valid.ru"})
+	cert, err = m.certStateGet(ctx, CertDescription{Group: "sites", KeyType: KeyRSA}).Cert()
+	e.CmpNoError(err)
+	e.Cmp(cert.Leaf.DNSNames, []string{"a.ru", "b.ru"})
+	cert, _ = m.certStateGet(ctx, CertDescription{MainDomain: "expired.ru", KeyType: KeyRSA}).Cert()
+	e.Nil(cert)
+	e.Cmp(m.cachedCertsCount(), 2)
+
+	_, err = New(nil, cache.NewMemoryCache("test"), nil).WarmCache(ctx, false)
+	e.CmpError(err)
+}
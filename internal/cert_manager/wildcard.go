@@ -0,0 +1,64 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// wildcardCertDescription return description of wildcard certificate, which can serve the domain
+func wildcardCertDescription(needDomain domain.DomainName, keyType KeyType) (CertDescription, bool) {
+	name := needDomain.String()
+	index := strings.Index(name, ".")
+	if index <= 0 || !strings.Contains(name[index+1:], ".") {
+		return CertDescription{}, false
+	}
+	return CertDescription{MainDomain: "*" + name[index:], KeyType: keyType}, true
+}
+
+// getWildcardCertificate return valid wildcard certificate for the domain from cache or nil.
+// Wildcard certificates doesn't issued by manager, they can be stored to cache manually only.
+func (m *Manager) getWildcardCertificate(ctx context.Context, needDomain domain.DomainName, keyType KeyType, now time.Time) *tls.Certificate {
+	cd, ok := wildcardCertDescription(needDomain, keyType)
+	if !ok {
+		return nil
+	}
+	logger := zc.L(ctx).With(zap.Stringer("wildcard_cert_name", cd))
+
+	cert, err := loadCertificateFromCache(ctx, m.Cache, cd, m.ClockSkewTolerance)
+	if err == nil {
+		cert, err = validCertDer([]domain.DomainName{needDomain}, m.servedChain(cert.Certificate), cert.PrivateKey, false, now, m.ClockSkewTolerance)
+	}
+	logLevel := zapcore.WarnLevel
+	if err == nil || err == cache.ErrCacheMiss {
+		logLevel = zapcore.DebugLevel
+	}
+	log.LevelParam(logger, logLevel, "Get wildcard certificate from cache", zap.Error(err))
+	if err != nil {
+		return nil
+	}
+	return cert
+}
+
+// isServedByWildcard check if certificate serve the domain by wildcard name only
+func isServedByWildcard(cert *tls.Certificate, needDomain domain.DomainName) bool {
+	if cert == nil || cert.Leaf == nil {
+		return false
+	}
+	for _, name := range cert.Leaf.DNSNames {
+		if strings.EqualFold(name, needDomain.String()) {
+			return false
+		}
+	}
+	return true
+}
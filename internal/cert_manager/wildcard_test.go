@@ -0,0 +1,133 @@
+//nolint:golint
+package cert_manager
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/cache"
+	"github.com/rekby/lets-proxy2/internal/domain"
+)
+
+func TestWildcardCertDescription(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	cd, ok := wildcardCertDescription("api.example.com", KeyRSA)
+	td.True(ok)
+	td.Cmp(cd, CertDescription{MainDomain: "*.example.com", KeyType: KeyRSA})
+	td.Cmp(cd.CertStoreName(), "*.example.com.rsa.cer")
+
+	cd, ok = wildcardCertDescription("a.b.example.com", KeyECDSA)
+	td.True(ok)
+	td.Cmp(cd.MainDomain, "*.b.example.com")
+
+	for _, needDomain := range []domain.DomainName{"example.com", "com", ""} {
+		_, ok = wildcardCertDescription(needDomain, KeyRSA)
+		td.False(ok, needDomain)
+	}
+}
+
+func TestManager_WildcardAndExactCertificates(t *testing.T) {
+	now := time.Now()
+	wildcardCert, wildcardKey := fastCreateTestCert([]string{"*.example.com"}, now)
+	// exact certificate in renewal window
+	exactCert, exactKey := fastCreateTestCert([]string{"api.example.com", "api-v2.example.com"}, now.Add(-50*time.Minute))
+	expiredWildcardCert, expiredWildcardKey := fastCreateTestCert([]string{"*.example.com"}, now.Add(-2*time.Hour))
+
+	table := []struct {
+		name           string
+		serverName     string
+		storage        map[string][]byte
+		expectedDomain string // first dns name of served certificate, empty - no certificate
+		expectedIssue  bool
+	}{
+		{
+			name:       "ExactOverWildcard",
+			serverName: "api.example.com",
+			storage: map[string][]byte{
+				"*.example.com.rsa.cer": wildcardCert, "*.example.com.rsa.key": wildcardKey,
+				"api.example.com.rsa.cer": exactCert, "api.example.com.rsa.key": exactKey,
+			},
+			expectedDomain: "api.example.com",
+		},
+		{
+			name:       "WildcardOnly",
+			serverName: "api.example.com",
+			storage: map[string][]byte{
+				"*.example.com.rsa.cer": wildcardCert, "*.example.com.rsa.key": wildcardKey,
+			},
+			expectedDomain: "*.example.com",
+		},
+		{
+			name:       "WildcardForOtherSubdomain",
+			serverName: "www.example.com",
+			storage: map[string][]byte{
+				"*.example.com.rsa.cer": wildcardCert, "*.example.com.rsa.key": wildcardKey,
+				"api.example.com.rsa.cer": exactCert, "api.example.com.rsa.key": exactKey,
+			},
+			expectedDomain: "*.example.com",
+		},
+		{
+			name:       "WildcardMatchOneLevel",
+			serverName: "a.b.example.com",
+			storage: map[string][]byte{
+				"*.example.com.rsa.cer": wildcardCert, "*.example.com.rsa.key": wildcardKey,
+			},
+			expectedIssue: true,
+		},
+		{
+			name:       "ExpiredWildcard",
+			serverName: "api.example.com",
+			storage: map[string][]byte{
+				"*.example.com.rsa.cer": expiredWildcardCert, "*.example.com.rsa.key": expiredWildcardKey,
+			},
+			expectedIssue: true,
+		},
+	}
+
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			td := testdeep.NewT(t)
+			c, cancel := createManager(t)
+			defer cancel()
+
+			state := &certState{}
+			c.certState.GetMock.Return(state, nil)
+			c.cache.GetMock.Set(func(ctx context.Context, key string) (ba1 []byte, err error) {
+				if value, ok := test.storage[key]; ok {
+					return value, nil
+				}
+				return nil, cache.ErrCacheMiss
+			})
+			// exact certificates renewed in background, wildcard certificates - never
+			expectIssue := test.expectedIssue || test.expectedDomain == "api.example.com"
+			issueTried := make(chan bool, 2)
+			if expectIssue {
+				c.domainChecker.IsDomainAllowedMock.Set(func(ctx context.Context, domain string) (b1 bool, err error) {
+					issueTried <- true
+					return false, nil
+				})
+			}
+
+			res, err := c.manager.GetCertificate(&tls.ClientHelloInfo{Conn: c.connContext, ServerName: test.serverName})
+			if test.expectedDomain == "" {
+				td.Nil(res)
+				td.Cmp(err, errDomainDenied)
+			} else {
+				td.CmpNoError(err)
+				td.Cmp(res.Leaf.DNSNames[0], test.expectedDomain)
+				td.Cmp(state.cert, res)
+			}
+
+			select {
+			case <-issueTried:
+			case <-time.After(100 * time.Millisecond):
+				td.False(expectIssue, "no issue")
+			}
+		})
+	}
+}
@@ -15,6 +15,20 @@ type Config struct {
 
 	listenConfig
 	secretHandlerConfig
+
+	// SensitiveAuth - access restrictions for sensitive endpoints (as acme accounts export) instead of common.
+	SensitiveAuth secrethandler.Config
+
+	// DomainStatsLimit - max count of separately counted domains in /stats/domains. 0 - disable domain stats.
+	DomainStatsLimit int
+
+	// TrackConnections - list active connections on /connections and close it by DELETE /connections/{id}.
+	TrackConnections bool
+
+	// TextfilePath - write metrics to the file in prometheus text format every TextfileIntervalSeconds,
+	// for textfile collector of node_exporter. Empty - don't write metrics to file.
+	TextfilePath            string
+	TextfileIntervalSeconds int
 }
 
 func (c Config) GetListenConfig() tlslistener.Config {
@@ -24,3 +38,12 @@ func (c Config) GetListenConfig() tlslistener.Config {
 func (c Config) GetSecretHandlerConfig() secrethandler.Config {
 	return secrethandler.Config(c.secretHandlerConfig)
 }
+
+// GetSensitiveSecretHandlerConfig return access config for sensitive endpoints.
+// It is common config if SensitiveAuth has no authentication.
+func (c Config) GetSensitiveSecretHandlerConfig() secrethandler.Config {
+	if c.SensitiveAuth.HasAuthentication() {
+		return c.SensitiveAuth
+	}
+	return c.GetSecretHandlerConfig()
+}
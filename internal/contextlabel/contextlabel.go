@@ -5,4 +5,51 @@ type Label string
 const (
 	ConnectionID  Label = "connection_id"
 	TLSConnection Label = "tls"
+	RequestID     Label = "request_id"
+
+	// Listener - name of additional listener, which accept the connection. Empty for main listener.
+	Listener Label = "listener"
+
+	// ChallengesDisabled - listener of the connection doesn't answer to acme challenges.
+	ChallengesDisabled Label = "challenges_disabled"
+
+	// SlowConnectionExempt - func(), which exempt the connection from slow connections detection.
+	// Absent if detection disabled.
+	SlowConnectionExempt Label = "slow_connection_exempt"
+
+	// ConnectionBackend - func(backend string), which save backend of last request of the connection
+	// for list of active connections. Absent if connections tracking disabled.
+	ConnectionBackend Label = "connection_backend"
+
+	// ConnectionRouteGeneration - func(generation uint64), which save generation of routes of last request
+	// of the connection. Absent if connections tracking disabled.
+	ConnectionRouteGeneration Label = "connection_route_generation"
+
+	// ConnectionRequest - func(host, path string), which save host and path of last request of the connection
+	// for check its backend by new routes after reload. Absent if connections tracking disabled.
+	ConnectionRequest Label = "connection_request"
+
+	// TimeoutsExempt - func() error, which remove read and write timeouts of the request (for streamed responses).
+	// Absent if the timeouts disabled.
+	TimeoutsExempt Label = "timeouts_exempt"
+
+	// ClientCertificate - *x509.Certificate of client, verified by tls handshake or passed by trusted upstream.
+	// Absent if request without client certificate or client certificates disabled.
+	ClientCertificate Label = "client_certificate"
+
+	// DomainDenied - *int32, set to 1 (atomic) if fallback certificate served to the connection
+	// because domain denied. Absent if fallback certificate disabled.
+	DomainDenied Label = "domain_denied"
+
+	// SplitBackend - backend (host:port) of request, selected by split route (canary or stable).
+	// Absent if request doesn't match split routes or split route keep backend of routes.
+	SplitBackend Label = "split_backend"
+
+	// LongLivedRoute - rewrite rule of long-lived route, matched to request (internal type of proxy).
+	// Absent for requests to other routes.
+	LongLivedRoute Label = "long_lived_route"
+
+	// RouteHostWithPort - true if routes match requests by host with port of Host header.
+	// Absent if port removed from host before match.
+	RouteHostWithPort Label = "route_host_with_port"
 )
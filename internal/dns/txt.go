@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+
+	mdns "github.com/miekg/dns"
+)
+
+// TXTResolver resolve TXT records of domains
+type TXTResolver interface {
+	// LookupTXT return TXT records of domain. It MUST finish work when context canceled
+	LookupTXT(ctx context.Context, host string) ([]string, error)
+}
+
+var errNoTXTResolvers = errors.New("no resolvers with TXT records support")
+
+// LookupTXT return TXT records of host (strings of every record joined), nil without error if host has no TXT records
+func (r *Resolver) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	logger := zc.L(ctx).With(zap.String("dns_server", r.server))
+	ctx = zc.WithLogger(ctx, logger)
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+
+	res, err := lookupTXTWithClient(ctx, host, r.server, r.maxDNSRecursionDeep, r.udp)
+	if err == errTruncatedResponse {
+		logger.Debug("fallback to tcp request")
+		res, err = lookupTXTWithClient(ctx, host, r.server, r.maxDNSRecursionDeep, r.tcp)
+	}
+	log.DebugError(logger, err, "TXT lookup", zap.String("host", host), zap.Strings("records", res))
+	return res, err
+}
+
+func lookupTXTWithClient(ctx context.Context, host string, server string, recursion int, client mDNSClient) ([]string, error) {
+	logger := zc.L(ctx)
+
+	if recursion <= 0 {
+		logger.Error("Max recursion while resolve domain")
+		return nil, errors.New("max recursion while resolve domain")
+	}
+
+	if ctx.Err() != nil {
+		logger.Debug("Context canceled")
+		return nil, ctx.Err()
+	}
+
+	var msdID uint16
+	for msdID == 0 {
+		msdID = mdns.Id()
+	}
+
+	msg := mdns.Msg{
+		MsgHdr: mdns.MsgHdr{
+			Id: msdID,
+		},
+		Question: []mdns.Question{
+			{Name: host, Qclass: mdns.ClassINET, Qtype: mdns.TypeTXT},
+		},
+	}
+	msg.RecursionDesired = true
+	exchangeCompleted := make(chan struct {
+		answer *mdns.Msg
+		err    error
+	}, 1)
+
+	go func() { // nolint:wsl
+		defer close(exchangeCompleted)
+		defer log.HandlePanic(logger)
+
+		dnsAnswer, _, dnsErr := client.Exchange(&msg, server)
+		exchangeCompleted <- struct {
+			answer *mdns.Msg
+			err    error
+		}{answer: dnsAnswer, err: dnsErr}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case answer := <-exchangeCompleted:
+		dnsAnswer := answer.answer
+		if dnsAnswer != nil && dnsAnswer.Truncated {
+			return nil, errTruncatedResponse
+		}
+
+		if answer.err != nil {
+			return nil, answer.err
+		}
+		if dnsAnswer == nil {
+			return nil, errPanic
+		}
+
+		var res []string
+		for _, r := range dnsAnswer.Answer {
+			switch r := r.(type) {
+			case *mdns.TXT:
+				res = append(res, strings.Join(r.Txt, ""))
+			case *mdns.CNAME:
+				logger.Debug("Receive CNAME record for domain.", zap.String("target", r.Target))
+				return lookupTXTWithClient(ctx, r.Target, server, recursion-1, client)
+			default:
+				// pass
+			}
+		}
+		return res, nil
+	}
+}
+
+// LookupTXT return TXT records of host, used underly resolvers with TXT support in parallel
+// If any of resolvers return records - return sum array of the records (may duplicated)
+// If all resolvers return error - return any of they errors
+func (p Parallel) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	logger := zc.L(ctx)
+
+	var resolvers []TXTResolver
+	for _, r := range p {
+		if txtResolver, ok := r.(TXTResolver); ok {
+			resolvers = append(resolvers, txtResolver)
+		}
+	}
+	if len(resolvers) == 0 {
+		return nil, errNoTXTResolvers
+	}
+
+	var records = make([][]string, len(resolvers))
+	var errs = make([]error, len(resolvers))
+
+	var wg sync.WaitGroup
+	wg.Add(len(resolvers))     // nolint:wsl
+	for i := range resolvers { // nolint:wsl
+		go func(i int) {
+			defer wg.Done()
+			defer log.HandlePanic(logger)
+
+			records[i], errs[i] = resolvers[i].LookupTXT(ctx, host)
+		}(i)
+	}
+
+	wg.Wait()
+
+	var res []string
+	var err error
+	for i := range records {
+		res = append(res, records[i]...)
+		if errs[i] != nil {
+			err = errs[i]
+		}
+	}
+	if len(res) == 0 {
+		return nil, err
+	}
+	return res, nil
+}
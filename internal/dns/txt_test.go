@@ -0,0 +1,107 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+	mdns "github.com/miekg/dns"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+var (
+	_ TXTResolver = &Resolver{}
+	_ TXTResolver = Parallel{}
+)
+
+func TestResolver_LookupTXT(t *testing.T) {
+	ctx, cancel := th.TestContext(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+
+	udp := NewMDNSClientMock(mc)
+	tcp := NewMDNSClientMock(mc)
+	udp.ExchangeMock.Set(func(m *mdns.Msg, address string) (r *mdns.Msg, rtt time.Duration, err error) {
+		td.Cmp(address, "1.2.3.4:53")
+		td.Cmp(m.Question[0].Qtype, mdns.TypeTXT)
+		switch m.Question[0].Name {
+		case "_marker.example.com.":
+			return &mdns.Msg{Answer: []mdns.RR{
+				&mdns.CNAME{Hdr: mdns.RR_Header{Rrtype: mdns.TypeCNAME}, Target: "_marker.target.com."},
+			}}, 0, nil
+		case "_marker.target.com.":
+			return &mdns.Msg{Answer: []mdns.RR{
+				&mdns.TXT{Hdr: mdns.RR_Header{Rrtype: mdns.TypeTXT}, Txt: []string{"al", "low"}},
+				&mdns.TXT{Hdr: mdns.RR_Header{Rrtype: mdns.TypeTXT}, Txt: []string{"other"}},
+			}}, 0, nil
+		case "long.com.":
+			return &mdns.Msg{MsgHdr: mdns.MsgHdr{Truncated: true}}, 0, nil
+		default:
+			return &mdns.Msg{}, 0, nil
+		}
+	})
+	tcp.ExchangeMock.Return(&mdns.Msg{Answer: []mdns.RR{
+		&mdns.TXT{Hdr: mdns.RR_Header{Rrtype: mdns.TypeTXT}, Txt: []string{"tcp"}},
+	}}, 0, nil)
+
+	r := NewResolver("1.2.3.4:53")
+	r.udp = udp
+	r.tcp = tcp
+
+	records, err := r.LookupTXT(ctx, "_marker.example.com")
+	td.CmpNoError(err)
+	td.Cmp(records, []string{"allow", "other"})
+
+	records, err = r.LookupTXT(ctx, "none.com")
+	td.CmpNoError(err)
+	td.Nil(records)
+
+	records, err = r.LookupTXT(ctx, "long.com")
+	td.CmpNoError(err)
+	td.Cmp(records, []string{"tcp"})
+}
+
+func TestParallel_LookupTXT(t *testing.T) {
+	ctx, cancel := th.TestContext(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+
+	_, err := NewParallel(NewResolverInterfaceMock(mc)).LookupTXT(ctx, "example.com")
+	td.CmpError(err)
+
+	testErr := errors.New("test")
+	p := NewParallel(txtResolverFunc(func(host string) ([]string, error) {
+		return []string{"a-" + host}, nil
+	}), txtResolverFunc(func(host string) ([]string, error) {
+		return nil, testErr
+	}))
+	records, err := p.LookupTXT(ctx, "example.com")
+	td.CmpNoError(err)
+	td.Cmp(records, []string{"a-example.com"})
+
+	p = NewParallel(txtResolverFunc(func(host string) ([]string, error) {
+		return nil, testErr
+	}))
+	records, err = p.LookupTXT(ctx, "example.com")
+	td.Cmp(err, testErr)
+	td.Nil(records)
+}
+
+type txtResolverFunc func(host string) ([]string, error)
+
+func (f txtResolverFunc) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, nil
+}
+
+func (f txtResolverFunc) LookupTXT(ctx context.Context, host string) ([]string, error) {
+	return f(host)
+}
@@ -2,17 +2,24 @@ package domain
 
 import (
 	"net"
+	"sort"
 	"strings"
+	"unicode"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	"golang.org/x/net/idna"
 	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/stringhelper"
 )
 
 type DomainName string // Normalized domain name.
 
+// ErrDomainDenied - domain denied by domain checkers, errors of the denial wrap it.
+var ErrDomainDenied = xerrors.New("domain denied")
+
 func (d DomainName) String() string {
 	return string(d)
 }
@@ -45,9 +52,135 @@ func NormalizeDomain(domain string) (DomainName, error) {
 	}
 	domain, err := domainNormalizationProfile.ToASCII(domain)
 	domain = strings.TrimSuffix(domain, ".")
+	if err == nil {
+		err = validateIDNLabels(domain)
+	}
 	return DomainName(domain), err
 }
 
+// allowedScriptsCombinations - scripts, which can be mixed in one label (as in UTS #39 highly restrictive level).
+// Labels with one script (and common chars as digits and hyphen) allowed always.
+var allowedScriptsCombinations = [][]string{
+	{"Latin", "Han", "Hiragana", "Katakana"},
+	{"Latin", "Han", "Bopomofo"},
+	{"Latin", "Han", "Hangul"},
+}
+
+// validateIDNLabels check unicode form of punycode labels.
+// It deny symbols (as emoji), which disallowed by IDNA2008 and labels with mixed scripts.
+func validateIDNLabels(asciiDomain string) error {
+	for _, label := range strings.Split(asciiDomain, ".") {
+		if !strings.HasPrefix(label, "xn--") {
+			continue
+		}
+		unicodeLabel, err := idna.ToUnicode(label)
+		if err != nil {
+			return xerrors.Errorf("decode punycode label %q: %w", label, err)
+		}
+
+		scripts := make(map[string]bool)
+		for _, r := range unicodeLabel {
+			if r == '-' || unicode.IsDigit(r) || unicode.Is(unicode.Inherited, r) {
+				continue
+			}
+			if !unicode.IsLetter(r) && !unicode.IsMark(r) {
+				return xerrors.Errorf("label %q contains disallowed rune %U", unicodeLabel, r)
+			}
+			if script := runeScript(r); script != "Common" {
+				scripts[script] = true
+			}
+		}
+		if !isAllowedScriptsMix(scripts) {
+			return xerrors.Errorf("label %q mix scripts", unicodeLabel)
+		}
+	}
+	return nil
+}
+
+func runeScript(r rune) string {
+	for name, table := range unicode.Scripts {
+		if name == "Common" || name == "Inherited" {
+			continue
+		}
+		if unicode.Is(table, r) {
+			return name
+		}
+	}
+	return "Common"
+}
+
+func isAllowedScriptsMix(scripts map[string]bool) bool {
+	if len(scripts) <= 1 {
+		return true
+	}
+
+combinations:
+	for _, combination := range allowedScriptsCombinations {
+		for script := range scripts {
+			if !stringhelper.Contains(combination, script) {
+				continue combinations
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// NormalizeHost normalize host of request (Host header, SNI) for compare with domains: punycode in lower case
+// without trailing dot, same as NormalizeDomain. keepPort - keep port of host:port, else port removed.
+// Hosts, which aren't valid domains (ip addresses, bad names), lowercased only.
+func NormalizeHost(host string, keepPort bool) string {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ""
+	}
+	if !isNormalizedASCII(name) {
+		if normalized, err := NormalizeDomain(name); err == nil {
+			name = normalized.String()
+		} else {
+			name = strings.TrimSuffix(strings.ToLower(name), ".")
+		}
+	}
+	if keepPort && port != "" {
+		return net.JoinHostPort(name, port)
+	}
+	if strings.Contains(name, ":") {
+		return "[" + name + "]"
+	}
+	return name
+}
+
+// isNormalizedASCII return true for names of lower case ascii letters, digits, hyphens and dots
+// without trailing dot, which NormalizeDomain doesn't change
+func isNormalizedASCII(name string) bool {
+	if name == "" || strings.HasSuffix(name, ".") {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// SortedUnique return copy of domains in canonical order without duplicates,
+// so same set of domains give same list independent of its order.
+func SortedUnique(domains []DomainName) []DomainName {
+	sorted := append([]DomainName(nil), domains...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	res := sorted[:0]
+	for i, d := range sorted {
+		if i == 0 || d != sorted[i-1] {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
 func LogDomain(domain DomainName) zap.Field {
 	return zap.String("domain", domain.FullString())
 }
@@ -0,0 +1,103 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	table := []struct {
+		name     string
+		source   string
+		expected DomainName
+	}{
+		{"Lower", "example.com", "example.com"},
+		{"Uppercase", "ExAmPlE.COM", "example.com"},
+		{"TrailingDot", "example.com.", "example.com"},
+		{"WithPort", "Example.com:443", "example.com"},
+		{"IDN", "café.example.com", "xn--caf-dma.example.com"},
+		{"IDNUppercase", "CAFÉ.Example.com.", "xn--caf-dma.example.com"},
+		{"Punycode", "xn--caf-dma.example.com", "xn--caf-dma.example.com"},
+		{"Cyrillic", "тест.рф", "xn--e1aybc.xn--p1ai"},
+		{"JapaneseMixed", "日本語テストabc.jp", "xn--abc-4k4bocn0926g0ecl32k.jp"},
+		{"DigitsAndHyphen", "тест-123.example.com", "xn---123-u4d6efc.example.com"},
+	}
+
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			td := testdeep.NewT(t)
+			res, err := NormalizeDomain(test.source)
+			td.CmpNoError(err)
+			td.Cmp(res, test.expected)
+		})
+	}
+}
+
+func TestNormalizeDomainError(t *testing.T) {
+	td := testdeep.NewT(t)
+	for _, source := range []string{"", ".", "a..b", "example.com:443:1"} {
+		_, err := NormalizeDomain(source)
+		td.CmpError(err, source)
+	}
+}
+
+func TestNormalizeDomainIDNDenied(t *testing.T) {
+	table := []struct {
+		name   string
+		source string
+	}{
+		{"Emoji", "😀.example.com"},
+		{"EmojiPunycode", "xn--e28h.example.com"},
+		{"EmojiInLabel", "test😀.example.com"},
+		{"MixedLatinCyrillic", "pаypal.com"}, // Cyrillic 'а'
+		{"MixedLatinCyrillicPunycode", "xn--pypal-4ve.com"},
+		{"MixedGreekLatin", "αbc.example.com"},
+	}
+
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			td := testdeep.NewT(t)
+			_, err := NormalizeDomain(test.source)
+			td.CmpError(err)
+		})
+	}
+}
+
+func TestDomainName_Unicode(t *testing.T) {
+	td := testdeep.NewT(t)
+	td.Cmp(DomainName("xn--caf-dma.example.com").Unicode(), "café.example.com")
+	td.Cmp(DomainName("example.com").Unicode(), "example.com")
+}
+
+func TestSortedUnique(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	domains := []DomainName{"www.example.com", "example.com", "a.example.com", "example.com"}
+	td.Cmp(SortedUnique(domains), []DomainName{"a.example.com", "example.com", "www.example.com"})
+	td.Cmp(domains, []DomainName{"www.example.com", "example.com", "a.example.com", "example.com"})
+	td.Cmp(SortedUnique(nil), testdeep.Empty())
+}
+
+func TestNormalizeHost(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	for _, test := range []struct {
+		host, withoutPort, withPort string
+	}{
+		{"example.com", "example.com", "example.com"},
+		{"Example.com:443", "example.com", "example.com:443"},
+		{"EXAMPLE.COM.", "example.com", "example.com"},
+		{"example.com.:8443", "example.com", "example.com:8443"},
+		{"Тест.рф", "xn--e1aybc.xn--p1ai", "xn--e1aybc.xn--p1ai"},
+		{"тест.рф.:80", "xn--e1aybc.xn--p1ai", "xn--e1aybc.xn--p1ai:80"},
+		{"XN--E1AYBC.xn--p1ai", "xn--e1aybc.xn--p1ai", "xn--e1aybc.xn--p1ai"},
+		{"127.0.0.1:80", "127.0.0.1", "127.0.0.1:80"},
+		{"[::1]:80", "[::1]", "[::1]:80"},
+		{"[::1]", "[::1]", "[::1]"},
+		{"", "", ""},
+	} {
+		td.Cmp(NormalizeHost(test.host, false), test.withoutPort, test.host)
+		td.Cmp(NormalizeHost(test.host, true), test.withPort, test.host)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"regexp"
 	"strings"
+	"time"
 
 	"golang.org/x/xerrors"
 
@@ -27,11 +28,31 @@ type Config struct {
 	BlackList                 string
 	WhiteList                 string
 	Resolver                  string
+
+	IssuancePolicyURL            string
+	IssuancePolicyTimeoutSeconds int
+	IssuancePolicyCacheSeconds   int
+
+	// Checkers - pipeline of checkers, used instead of other rules of the section (except Resolver and
+	// self ip detection settings) if not empty. CheckersCombinator - "all" (default) or "any".
+	Checkers           []CheckerConfig
+	CheckersCombinator string
 }
 
 func (c *Config) CreateDomainChecker(ctx context.Context) (DomainChecker, error) {
 	logger := zc.L(ctx)
 
+	resolver, err := c.createResolver(logger)
+	if err != nil {
+		log.DebugError(logger, err, "Create resolver")
+		return nil, err
+	}
+	SetDefaultResolver(resolver)
+
+	if len(c.Checkers) > 0 {
+		return c.createPipeline(ctx, resolver)
+	}
+
 	var listCheckers DomainChecker = True{}
 
 	if c.BlackList != "" {
@@ -52,13 +73,6 @@ func (c *Config) CreateDomainChecker(ctx context.Context) (DomainChecker, error)
 		listCheckers = NewAny(listCheckers, NewRegexp(r))
 	}
 
-	resolver, err := c.createResolver(logger)
-	if err != nil {
-		log.DebugError(logger, err, "Create resolver")
-		return nil, err
-	}
-	SetDefaultResolver(resolver)
-
 	var ipCheckers Any
 
 	if c.IPSelf {
@@ -89,9 +103,24 @@ func (c *Config) CreateDomainChecker(ctx context.Context) (DomainChecker, error)
 	}
 
 	res := NewAll(listCheckers, ipCheckers)
+
+	// external policy check last - for prevent requests for domains, denied by local rules
+	if c.IssuancePolicyURL != "" {
+		logger.Info("Use issuance policy callback", zap.String("url", c.IssuancePolicyURL))
+		res = append(res, NewIssuancePolicy(c.IssuancePolicyURL,
+			time.Duration(c.IssuancePolicyTimeoutSeconds)*time.Second, time.Duration(c.IssuancePolicyCacheSeconds)*time.Second))
+	}
 	return res, nil
 }
 
+// CustomResolver return resolver of configured dns servers, nil if system resolver used
+func (c *Config) CustomResolver(ctx context.Context) (Resolver, error) {
+	if strings.TrimSpace(c.Resolver) == "" {
+		return nil, nil
+	}
+	return c.createResolver(zc.L(ctx))
+}
+
 func (c *Config) createResolver(logger *zap.Logger) (Resolver, error) {
 	var resolver Resolver
 	if strings.TrimSpace(c.Resolver) == "" {
@@ -0,0 +1,198 @@
+//nolint:golint
+package domain_checker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const (
+	issuancePolicyScopeDomain   = "domain"
+	issuancePolicyScopeWildcard = "wildcard"
+
+	issuancePolicyMaxResponseSize = 4096
+
+	// issuancePolicyCacheMaxEntries - limit of cached allow decisions, cache filled by domains from client hello
+	issuancePolicyCacheMaxEntries = 10000
+)
+
+// IssuancePolicy ask external http service about allow certificate for domain.
+// It send GET request to URL with query param domain=<domain> and wait json response:
+// {"allow": true|false, "scope": "domain"|"wildcard"}
+// scope wildcard mean: decision is same for all subdomains of the domain.
+// Allow decisions cached for CacheTime, up to issuancePolicyCacheMaxEntries decisions.
+type IssuancePolicy struct {
+	URL        string
+	CacheTime  time.Duration
+	HTTPClient *http.Client
+
+	now func() time.Time
+
+	mu              sync.Mutex
+	cache           map[string]time.Time // allowed domain (or ".domain" for wildcard) -> expire time
+	cacheMaxEntries int                  // 0 - issuancePolicyCacheMaxEntries
+}
+
+type issuancePolicyResponse struct {
+	Allow bool   `json:"allow"`
+	Scope string `json:"scope"`
+}
+
+// NewIssuancePolicy create policy, timeout 0 mean default timeout (10 seconds).
+func NewIssuancePolicy(callbackURL string, timeout, cacheTime time.Duration) *IssuancePolicy {
+	if timeout <= 0 {
+		timeout = defaultPolicyCheckerTimeout
+	}
+	return &IssuancePolicy{
+		URL:        callbackURL,
+		CacheTime:  cacheTime,
+		HTTPClient: &http.Client{Timeout: timeout},
+		now:        time.Now,
+		cache:      make(map[string]time.Time),
+	}
+}
+
+func (p *IssuancePolicy) IsDomainAllowed(ctx context.Context, domain string) (bool, error) {
+	logger := zc.L(ctx)
+	if p.isCachedAllow(domain) {
+		logger.Debug("Allowed by cached issuance policy decision")
+		return true, nil
+	}
+
+	resp, err := p.query(ctx, domain)
+	log.InfoError(logger, err, "Query issuance policy", zap.Bool("allow", resp.Allow), zap.String("scope", resp.Scope))
+	if err != nil {
+		return false, err
+	}
+
+	if resp.Allow && p.CacheTime > 0 {
+		key := domain
+		if resp.Scope == issuancePolicyScopeWildcard {
+			key = "." + domain
+		}
+		p.cacheAllow(key)
+	}
+	return resp.Allow, nil
+}
+
+func (p *IssuancePolicy) cacheAllow(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	maxEntries := p.cacheMaxEntries
+	if maxEntries == 0 {
+		maxEntries = issuancePolicyCacheMaxEntries
+	}
+	if _, exists := p.cache[key]; !exists && len(p.cache) >= maxEntries {
+		p.evictCacheLocked(now)
+	}
+	p.cache[key] = now.Add(p.CacheTime)
+}
+
+// evictCacheLocked remove expired decisions, or decision with nearest expire time if nothing expired.
+// Must be called with locked mu.
+func (p *IssuancePolicy) evictCacheLocked(now time.Time) {
+	var nearestKey string
+	var nearestExpire time.Time
+	removed := false
+	for key, expire := range p.cache {
+		if now.After(expire) {
+			delete(p.cache, key)
+			removed = true
+			continue
+		}
+		if nearestKey == "" || expire.Before(nearestExpire) {
+			nearestKey, nearestExpire = key, expire
+		}
+	}
+	if !removed && nearestKey != "" {
+		delete(p.cache, nearestKey)
+	}
+}
+
+// isCachedAllow check cached decision for the domain and wildcard decisions for the domain and its parents.
+func (p *IssuancePolicy) isCachedAllow(domain string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	isAllowed := func(key string) bool {
+		expire, ok := p.cache[key]
+		if ok && now.After(expire) {
+			delete(p.cache, key)
+			return false
+		}
+		return ok
+	}
+
+	if isAllowed(domain) {
+		return true
+	}
+	for suffix := domain; suffix != ""; {
+		if isAllowed("." + suffix) {
+			return true
+		}
+		index := strings.IndexByte(suffix, '.')
+		if index < 0 {
+			break
+		}
+		suffix = suffix[index+1:]
+	}
+	return false
+}
+
+func (p *IssuancePolicy) query(ctx context.Context, domain string) (issuancePolicyResponse, error) {
+	var res issuancePolicyResponse
+
+	callbackURL, err := url.Parse(p.URL)
+	if err != nil {
+		return res, xerrors.Errorf("parse issuance policy url: %w", err)
+	}
+	query := callbackURL.Query()
+	query.Set("domain", domain)
+	callbackURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, callbackURL.String(), nil)
+	if err != nil {
+		return res, xerrors.Errorf("create issuance policy request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return res, xerrors.Errorf("issuance policy request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return res, xerrors.Errorf("issuance policy response status: %v", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, issuancePolicyMaxResponseSize))
+	if err != nil {
+		return res, xerrors.Errorf("read issuance policy response: %w", err)
+	}
+	if err = json.Unmarshal(body, &res); err != nil {
+		return res, xerrors.Errorf("parse issuance policy response: %w", err)
+	}
+	switch res.Scope {
+	case "", issuancePolicyScopeDomain, issuancePolicyScopeWildcard:
+		// pass
+	default:
+		return res, xerrors.Errorf("unknown issuance policy scope: %q", res.Scope)
+	}
+	return res, nil
+}
@@ -0,0 +1,126 @@
+//nolint:golint
+package domain_checker
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestIssuancePolicy(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		switch r.URL.Query().Get("domain") {
+		case "allow.com":
+			_, _ = fmt.Fprint(w, `{"allow": true}`)
+		case "wildcard.com":
+			_, _ = fmt.Fprint(w, `{"allow": true, "scope": "wildcard"}`)
+		case "deny.com":
+			_, _ = fmt.Fprint(w, `{"allow": false}`)
+		case "bad-scope.com":
+			_, _ = fmt.Fprint(w, `{"allow": true, "scope": "other"}`)
+		case "bad-json.com":
+			_, _ = fmt.Fprint(w, `{"allow": tr`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	policy := NewIssuancePolicy(server.URL+"/check?token=secret", time.Second, time.Minute)
+	policy.now = func() time.Time { return now }
+
+	check := func(domain string, expectedAllow bool, expectedErr bool, expectedRequests int64) {
+		t.Helper()
+		td := testdeep.NewT(t)
+		atomic.StoreInt64(&requests, 0)
+		res, err := policy.IsDomainAllowed(ctx, domain)
+		td.Cmp(res, expectedAllow, domain)
+		td.Cmp(err != nil, expectedErr, domain)
+		td.Cmp(atomic.LoadInt64(&requests), expectedRequests, domain)
+	}
+
+	check("allow.com", true, false, 1)
+	check("allow.com", true, false, 0) // cached
+	check("sub.allow.com", false, true, 1)
+
+	check("wildcard.com", true, false, 1)
+	check("sub.wildcard.com", true, false, 0)
+	check("a.b.wildcard.com", true, false, 0)
+	check("otherwildcard.com", false, true, 1)
+
+	check("deny.com", false, false, 1)
+	check("deny.com", false, false, 1) // deny doesn't cached
+
+	check("bad-scope.com", false, true, 1)
+	check("bad-json.com", false, true, 1)
+	check("error.com", false, true, 1)
+
+	now = now.Add(time.Minute + time.Second)
+	check("allow.com", true, false, 1) // cache expired
+}
+
+func TestIssuancePolicyCache(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	policy := NewIssuancePolicy("http://localhost/", 0, time.Minute)
+	td.Cmp(policy.HTTPClient.Timeout, defaultPolicyCheckerTimeout)
+
+	now := time.Now()
+	policy.now = func() time.Time { return now }
+	policy.cacheMaxEntries = 2
+
+	policy.cacheAllow("a.com")
+	now = now.Add(time.Second)
+	policy.cacheAllow(".b.com")
+	td.True(policy.isCachedAllow("a.com"))
+	td.True(policy.isCachedAllow("x.y.b.com"))
+	td.False(policy.isCachedAllow("xb.com"))
+
+	// nearest expire evicted
+	policy.cacheAllow("c.com")
+	td.Len(policy.cache, 2)
+	td.False(policy.isCachedAllow("a.com"))
+	td.True(policy.isCachedAllow("c.com"))
+
+	// expired evicted
+	now = now.Add(time.Minute + time.Second)
+	policy.cacheAllow("d.com")
+	td.Cmp(policy.cache, map[string]time.Time{"d.com": now.Add(time.Minute)})
+}
+
+func TestConfig_CreateDomainCheckerIssuancePolicy(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"allow": %v}`, r.URL.Query().Get("domain") == "allow.com")
+	}))
+	defer server.Close()
+
+	c := &Config{IssuancePolicyURL: server.URL, IssuancePolicyTimeoutSeconds: 1}
+	checker, err := c.CreateDomainChecker(ctx)
+	td.CmpNoError(err)
+
+	res, err := checker.IsDomainAllowed(ctx, "allow.com")
+	td.CmpNoError(err)
+	td.True(res)
+
+	res, err = checker.IsDomainAllowed(ctx, "deny.com")
+	td.CmpNoError(err)
+	td.False(res)
+}
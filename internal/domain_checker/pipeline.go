@@ -0,0 +1,251 @@
+//nolint:golint
+package domain_checker
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/dns"
+	domainName "github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const (
+	CheckerAllowList = "allowlist"
+	CheckerRegexp    = "regexp"
+	CheckerDNS       = "dns"
+	CheckerPolicy    = "policy"
+	CheckerTXT       = "txt"
+
+	CombinatorAll = "all"
+	CombinatorAny = "any"
+
+	defaultPolicyCheckerTimeout = 10 * time.Second
+)
+
+// CheckerConfig is one checker of domain checkers pipeline
+type CheckerConfig struct {
+	// Type - allowlist, regexp, dns, policy or txt
+	Type string
+
+	// Name for logs, empty - type with index in pipeline
+	Name string
+
+	// Invert - allow domain if checker deny it
+	Invert bool
+
+	// allowlist: domains, "*.example.com" match all subdomains of example.com
+	Domains []string
+
+	// regexp: allow domain if it match the regexp (punycode or unicode form)
+	Regexp string
+
+	// dns: allow domain if it resolved to public ip. With IPSelf or IPList - if resolved to the ips only.
+	IPSelf bool
+	IPList string
+
+	// policy: external issuance policy
+	URL            string
+	TimeoutSeconds int
+	CacheSeconds   int
+
+	// txt: allow domain if TXT record TXTName.<domain> has value TXTValue. Default "_letsproxy" and "allow".
+	// Results cached for CacheSeconds (default 60, negative - without cache).
+	TXTName  string
+	TXTValue string
+}
+
+// createPipeline create checkers from c.Checkers and combine it by c.CheckersCombinator
+func (c *Config) createPipeline(ctx context.Context, resolver Resolver) (DomainChecker, error) {
+	checkers := make([]DomainChecker, 0, len(c.Checkers))
+	for i := range c.Checkers {
+		checkerConfig := &c.Checkers[i]
+		name := checkerConfig.Name
+		if name == "" {
+			name = checkerConfig.Type + "-" + strconv.Itoa(i)
+		}
+
+		checker, err := checkerConfig.create(ctx, c, resolver)
+		if err != nil {
+			return nil, xerrors.Errorf("create domain checker %q: %w", name, err)
+		}
+		if checkerConfig.Invert {
+			checker = NewNot(checker)
+		}
+		checkers = append(checkers, namedChecker{name: name, checker: checker})
+	}
+
+	zc.L(ctx).Info("Use domain checkers pipeline", zap.String("combinator", c.CheckersCombinator),
+		zap.Int("checkers_count", len(checkers)))
+	switch c.CheckersCombinator {
+	case "", CombinatorAll:
+		return NewAll(checkers...), nil
+	case CombinatorAny:
+		return NewAny(checkers...), nil
+	default:
+		return nil, xerrors.Errorf("unknown domain checkers combinator: %q", c.CheckersCombinator)
+	}
+}
+
+func (cc *CheckerConfig) create(ctx context.Context, c *Config, resolver Resolver) (DomainChecker, error) {
+	switch cc.Type {
+	case CheckerAllowList:
+		if len(cc.Domains) == 0 {
+			return nil, xerrors.New("allowlist without domains")
+		}
+		return NewAllowList(cc.Domains)
+	case CheckerRegexp:
+		r, err := regexp.Compile(cc.Regexp)
+		if err != nil {
+			return nil, xerrors.Errorf("compile regexp %q: %w", cc.Regexp, err)
+		}
+		return NewRegexp(r), nil
+	case CheckerDNS:
+		return cc.createDNS(ctx, c, resolver)
+	case CheckerPolicy:
+		if cc.URL == "" {
+			return nil, xerrors.New("policy without url")
+		}
+		return NewIssuancePolicy(cc.URL, time.Duration(cc.TimeoutSeconds)*time.Second,
+			time.Duration(cc.CacheSeconds)*time.Second), nil
+	case CheckerTXT:
+		return cc.createTXT(resolver)
+	default:
+		return nil, xerrors.Errorf("unknown domain checker type: %q", cc.Type)
+	}
+}
+
+func (cc *CheckerConfig) createDNS(ctx context.Context, c *Config, resolver Resolver) (DomainChecker, error) {
+	if !cc.IPSelf && cc.IPList == "" {
+		return dnsExists{resolver: resolver}, nil
+	}
+
+	var res Any
+	if cc.IPSelf {
+		// self ip detection settings - common for section
+		selfIPChecker, err := NewSelfIPChecker(ctx, c)
+		if err != nil {
+			return nil, xerrors.Errorf("create self ip checker: %w", err)
+		}
+		res = append(res, selfIPChecker)
+	}
+	if cc.IPList != "" {
+		ips, err := ParseIPList(ctx, cc.IPList, ",")
+		if err != nil {
+			return nil, xerrors.Errorf("parse ip list: %w", err)
+		}
+		ipList := NewIPList(ctx, func(ctx context.Context) ([]net.IP, error) {
+			return ips, nil
+		})
+		ipList.Resolver = resolver
+		res = append(res, ipList)
+	}
+	return res, nil
+}
+
+func (cc *CheckerConfig) createTXT(resolver Resolver) (DomainChecker, error) {
+	txtResolver, ok := resolver.(dns.TXTResolver)
+	if !ok {
+		return nil, xerrors.New("resolver doesn't support txt records")
+	}
+
+	name := cc.TXTName
+	if name == "" {
+		name = defaultTXTMarkerName
+	}
+	if !isTXTMarkerName(name) {
+		return nil, xerrors.Errorf("bad txt record name: %q", name)
+	}
+
+	value := cc.TXTValue
+	if value == "" {
+		value = defaultTXTMarkerValue
+	}
+
+	cacheTime := time.Duration(cc.CacheSeconds) * time.Second
+	if cc.CacheSeconds == 0 {
+		cacheTime = defaultTXTMarkerCacheTime
+	}
+	return NewTXTMarker(txtResolver, name, value, cacheTime), nil
+}
+
+// namedChecker log result of the checker with its name
+type namedChecker struct {
+	name    string
+	checker DomainChecker
+}
+
+func (n namedChecker) IsDomainAllowed(ctx context.Context, domain string) (bool, error) {
+	logger := zc.L(ctx).With(zap.String("checker", n.name))
+	res, err := n.checker.IsDomainAllowed(zc.WithLogger(ctx, logger), domain)
+	log.DebugError(logger, err, "Domain checker result", zap.Bool("allowed", res))
+	return res, err
+}
+
+// AllowList allow domains from list and subdomains of wildcard domains ("*.example.com")
+type AllowList struct {
+	domains   map[string]bool
+	wildcards []string // with leading dot
+}
+
+func NewAllowList(domains []string) (*AllowList, error) {
+	res := &AllowList{domains: make(map[string]bool, len(domains))}
+	for _, item := range domains {
+		wildcard := strings.HasPrefix(item, "*.")
+		normalized, err := domainName.NormalizeDomain(strings.TrimPrefix(item, "*."))
+		if err != nil {
+			return nil, xerrors.Errorf("normalize allowlist domain %q: %w", item, err)
+		}
+		if wildcard {
+			res.wildcards = append(res.wildcards, "."+normalized.ASCII())
+		} else {
+			res.domains[normalized.ASCII()] = true
+		}
+	}
+	return res, nil
+}
+
+func (a *AllowList) IsDomainAllowed(ctx context.Context, domain string) (bool, error) {
+	asciiDomain := domainName.DomainName(domain).ASCII()
+	if a.domains[asciiDomain] {
+		log.DebugCtx(ctx, "Domain allowed by allowlist")
+		return true, nil
+	}
+	for _, wildcard := range a.wildcards {
+		if strings.HasSuffix(asciiDomain, wildcard) {
+			log.DebugCtx(ctx, "Domain allowed by allowlist wildcard", zap.String("wildcard", "*"+wildcard))
+			return true, nil
+		}
+	}
+	log.InfoCtx(ctx, "Domain doesn't match allowlist")
+	return false, nil
+}
+
+// dnsExists allow domain if it resolved to public ip address
+type dnsExists struct {
+	resolver Resolver
+}
+
+func (d dnsExists) IsDomainAllowed(ctx context.Context, domain string) (bool, error) {
+	logger := zc.L(ctx)
+	ips, err := d.resolver.LookupIPAddr(ctx, domain)
+	log.DebugInfo(logger, err, "Resolve domain ip addresses", zap.Any("ips", ips))
+	if err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		if isPublicIP(ip.IP) {
+			return true, nil
+		}
+	}
+	logger.Info("Domain has no public ip address")
+	return false, nil
+}
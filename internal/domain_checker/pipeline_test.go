@@ -0,0 +1,99 @@
+//nolint:golint
+package domain_checker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestConfig_CreatePipeline(t *testing.T) {
+	ctx, cancel := th.TestContext(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	resolver := NewResolverMock(mc)
+	resolver.LookupIPAddrMock.Set(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "example.com", "www.example.com", "test.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("1.2.3.4")}}, nil
+		default:
+			return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+		}
+	})
+
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"allow": ` + strconv.FormatBool(r.URL.Query().Get("domain") != "www.example.com") + `}`))
+	}))
+	defer policy.Close()
+
+	cfg := Config{Checkers: []CheckerConfig{
+		{Type: CheckerAllowList, Domains: []string{"example.com", "*.example.com", "local.org"}},
+		{Type: CheckerRegexp, Regexp: `^test\.`, Invert: true},
+		{Type: CheckerDNS, IPList: "1.2.3.4"},
+		{Type: CheckerPolicy, URL: policy.URL},
+	}}
+	checker, err := cfg.createPipeline(ctx, resolver)
+	td.CmpNoError(err)
+
+	for domain, expected := range map[string]bool{
+		"example.com":      true,
+		"www.example.com":  false, // policy
+		"test.example.com": false, // inverted regexp
+		"local.org":        false, // dns
+		"other.org":        false, // allowlist
+	} {
+		res, err := checker.IsDomainAllowed(ctx, domain)
+		td.CmpNoError(err, domain)
+		td.Cmp(res, expected, domain)
+	}
+
+	cfg = Config{CheckersCombinator: CombinatorAny, Checkers: []CheckerConfig{
+		{Type: CheckerAllowList, Domains: []string{"example.com"}},
+		{Type: CheckerDNS},
+	}}
+	checker, err = cfg.createPipeline(ctx, resolver)
+	td.CmpNoError(err)
+	for domain, expected := range map[string]bool{
+		"example.com":      true,
+		"test.example.com": true,
+		"local.org":        false,
+	} {
+		res, err := checker.IsDomainAllowed(ctx, domain)
+		td.CmpNoError(err, domain)
+		td.Cmp(res, expected, domain)
+	}
+}
+
+func TestConfig_CreatePipelineErrors(t *testing.T) {
+	ctx, cancel := th.TestContext(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+
+	for _, cfg := range []Config{
+		{Checkers: []CheckerConfig{{Type: "unknown"}}},
+		{Checkers: []CheckerConfig{{Type: CheckerAllowList}}},
+		{Checkers: []CheckerConfig{{Type: CheckerRegexp, Regexp: "12("}}},
+		{Checkers: []CheckerConfig{{Type: CheckerPolicy}}},
+		{Checkers: []CheckerConfig{{Type: CheckerDNS, IPList: "bad"}}},
+		{Checkers: []CheckerConfig{{Type: CheckerDNS}}, CheckersCombinator: "none"},
+		{Checkers: []CheckerConfig{{Type: CheckerTXT, TXTName: "bad name"}}},
+		{Checkers: []CheckerConfig{{Type: CheckerTXT, TXTName: "_letsproxy."}}},
+	} {
+		res, err := cfg.CreateDomainChecker(ctx)
+		td.Nil(res)
+		td.CmpError(err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	domainName "github.com/rekby/lets-proxy2/internal/domain"
 	"github.com/rekby/lets-proxy2/internal/log"
 )
 
@@ -47,7 +48,14 @@ type Regexp regexp.Regexp
 
 func (r *Regexp) IsDomainAllowed(ctx context.Context, domain string) (bool, error) {
 	reg := (*regexp.Regexp)(r)
+
+	// regexp can be written for punycode or unicode form of domain
 	result := reg.MatchString(domain)
+	if !result {
+		if unicodeDomain := domainName.DomainName(domain).Unicode(); unicodeDomain != domain {
+			result = reg.MatchString(unicodeDomain)
+		}
+	}
 	logLevel := zapcore.DebugLevel
 	if !result {
 		logLevel = zapcore.InfoLevel
@@ -49,3 +49,24 @@ func TestRegexp(t *testing.T) {
 	td.False(res)
 	td.CmpNoError(err)
 }
+
+func TestRegexpIDN(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	// unicode regexp
+	res, err := NewRegexp(regexp.MustCompile(`^café\.example\.com$`)).IsDomainAllowed(ctx, "xn--caf-dma.example.com")
+	td.True(res)
+	td.CmpNoError(err)
+
+	// punycode regexp
+	res, err = NewRegexp(regexp.MustCompile(`^xn--caf-dma\.example\.com$`)).IsDomainAllowed(ctx, "xn--caf-dma.example.com")
+	td.True(res)
+	td.CmpNoError(err)
+
+	res, err = NewRegexp(regexp.MustCompile(`^café\.example\.com$`)).IsDomainAllowed(ctx, "xn--cafe-dma.example.com")
+	td.False(res)
+	td.CmpNoError(err)
+}
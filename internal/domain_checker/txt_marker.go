@@ -0,0 +1,121 @@
+//nolint:golint
+package domain_checker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/dns"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const (
+	defaultTXTMarkerName      = "_letsproxy"
+	defaultTXTMarkerValue     = "allow"
+	defaultTXTMarkerCacheTime = time.Minute
+)
+
+// TXTMarker allow domain if TXT record Name.<domain> has Value (opt-in of domain owner).
+// Results (allow and deny) cached for CacheTime, lookup errors doesn't cache.
+type TXTMarker struct {
+	Name      string
+	Value     string
+	CacheTime time.Duration
+	Resolver  dns.TXTResolver
+
+	now func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]txtMarkerCacheItem
+}
+
+type txtMarkerCacheItem struct {
+	allowed bool
+	expire  time.Time
+}
+
+func NewTXTMarker(resolver dns.TXTResolver, name, value string, cacheTime time.Duration) *TXTMarker {
+	return &TXTMarker{
+		Name:      name,
+		Value:     value,
+		CacheTime: cacheTime,
+		Resolver:  resolver,
+		now:       time.Now,
+		cache:     make(map[string]txtMarkerCacheItem),
+	}
+}
+
+func (m *TXTMarker) IsDomainAllowed(ctx context.Context, domain string) (bool, error) {
+	logger := zc.L(ctx)
+	if allowed, ok := m.cached(domain); ok {
+		logger.Debug("Use cached txt marker result", zap.Bool("allowed", allowed))
+		return allowed, nil
+	}
+
+	recordName := m.Name + "." + domain
+	records, err := m.Resolver.LookupTXT(ctx, recordName)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		records, err = nil, nil
+	}
+	log.DebugInfo(logger, err, "Lookup txt marker", zap.String("record", recordName), zap.Strings("values", records))
+	if err != nil {
+		return false, xerrors.Errorf("lookup txt marker %q: %w", recordName, err)
+	}
+
+	allowed := false
+	for _, record := range records {
+		if strings.TrimSpace(record) == m.Value {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		logger.Info("Domain has no txt marker", zap.String("record", recordName), zap.String("value", m.Value))
+	}
+
+	if m.CacheTime > 0 {
+		m.mu.Lock()
+		m.cache[domain] = txtMarkerCacheItem{allowed: allowed, expire: m.now().Add(m.CacheTime)}
+		m.mu.Unlock()
+	}
+	return allowed, nil
+}
+
+func (m *TXTMarker) cached(domain string) (allowed bool, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	for key, item := range m.cache {
+		if now.After(item.expire) {
+			delete(m.cache, key)
+		}
+	}
+	item, ok := m.cache[domain]
+	return item.allowed, ok
+}
+
+// isTXTMarkerName return true if name is sequence of dns labels with letters, digits, hyphens and underscores
+func isTXTMarkerName(name string) bool {
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
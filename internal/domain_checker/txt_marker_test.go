@@ -0,0 +1,104 @@
+//nolint:golint
+package domain_checker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+type testTXTResolver struct {
+	net.Resolver
+	records map[string][]string
+	err     error
+	calls   int32
+}
+
+func (r *testTXTResolver) LookupTXT(_ context.Context, host string) ([]string, error) {
+	atomic.AddInt32(&r.calls, 1)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if records, ok := r.records[host]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestTXTMarker(t *testing.T) {
+	ctx, cancel := th.TestContext(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+
+	resolver := &testTXTResolver{records: map[string][]string{
+		"_letsproxy.allowed.com": {"v=1", " allow "},
+		"_letsproxy.denied.com":  {"deny"},
+	}}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewTXTMarker(resolver, "_letsproxy", "allow", time.Minute)
+	m.now = func() time.Time { return now }
+
+	for domain, expected := range map[string]bool{
+		"allowed.com": true,
+		"denied.com":  false,
+		"absent.com":  false,
+	} {
+		res, err := m.IsDomainAllowed(ctx, domain)
+		td.CmpNoError(err, domain)
+		td.Cmp(res, expected, domain)
+	}
+	td.Cmp(atomic.LoadInt32(&resolver.calls), int32(3))
+
+	// cached
+	resolver.records["_letsproxy.absent.com"] = []string{"allow"}
+	res, err := m.IsDomainAllowed(ctx, "absent.com")
+	td.CmpNoError(err)
+	td.False(res)
+	td.Cmp(atomic.LoadInt32(&resolver.calls), int32(3))
+
+	now = now.Add(time.Minute + time.Second)
+	res, err = m.IsDomainAllowed(ctx, "absent.com")
+	td.CmpNoError(err)
+	td.True(res)
+	td.Cmp(atomic.LoadInt32(&resolver.calls), int32(4))
+
+	// errors doesn't cache
+	resolver.err = errors.New("test")
+	res, err = m.IsDomainAllowed(ctx, "other.com")
+	td.CmpError(err)
+	td.False(res)
+	resolver.err = nil
+	resolver.records["_letsproxy.other.com"] = []string{"allow"}
+	res, err = m.IsDomainAllowed(ctx, "other.com")
+	td.CmpNoError(err)
+	td.True(res)
+}
+
+func TestCheckerConfig_CreateTXT(t *testing.T) {
+	ctx, cancel := th.TestContext(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+
+	checker, err := (&CheckerConfig{Type: CheckerTXT}).create(ctx, &Config{}, &testTXTResolver{})
+	td.CmpNoError(err)
+	td.Cmp(checker, testdeep.Struct(&TXTMarker{Name: "_letsproxy", Value: "allow", CacheTime: time.Minute},
+		testdeep.StructFields{"Resolver": testdeep.NotNil(), "now": testdeep.Ignore(), "cache": testdeep.Ignore()}))
+
+	checker, err = (&CheckerConfig{Type: CheckerTXT, TXTName: "_opt-in.lets", TXTValue: "yes", CacheSeconds: -1}).
+		create(ctx, &Config{}, &testTXTResolver{})
+	td.CmpNoError(err)
+	td.Cmp(checker, testdeep.Struct(&TXTMarker{Name: "_opt-in.lets", Value: "yes", CacheTime: -time.Second},
+		testdeep.StructFields{"Resolver": testdeep.NotNil(), "now": testdeep.Ignore(), "cache": testdeep.Ignore()}))
+
+	_, err = (&CheckerConfig{Type: CheckerTXT}).create(ctx, &Config{}, NewResolverMock(td))
+	td.CmpError(err)
+}
@@ -0,0 +1,179 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	"go.uber.org/zap"
+)
+
+const (
+	TypeCertIssued      = "cert_issued"
+	TypeCertRenewed     = "cert_renewed"
+	TypeCertIssueFailed = "cert_issue_failed"
+	TypeBackendDown     = "backend_down"
+	TypeBackendUp       = "backend_up"
+)
+
+const subscriberBufferSize = 100
+
+var errTooManySubscribers = errors.New("too many event subscribers")
+
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Domain  string    `json:"domain,omitempty"`
+	Backend string    `json:"backend,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// Bus deliver events to subscribers. Nil bus is valid and drop all events.
+type Bus struct {
+	MaxSubscribers    int
+	HeartbeatInterval time.Duration
+
+	logger      *zap.Logger
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	types  map[string]bool // nil for all types
+	events chan Event
+}
+
+func New(logger *zap.Logger, maxSubscribers int, heartbeatInterval time.Duration) *Bus {
+	return &Bus{
+		MaxSubscribers:    maxSubscribers,
+		HeartbeatInterval: heartbeatInterval,
+		logger:            logger,
+		subscribers:       make(map[*subscriber]struct{}),
+	}
+}
+
+// Publish send event to subscribers without blocking. Slow subscribers lost events.
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		if sub.types != nil && !sub.types[event.Type] {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			b.logger.Warn("Event subscriber is slow, drop event", zap.String("event_type", event.Type))
+		}
+	}
+}
+
+func (b *Bus) subscribe(types []string) (*subscriber, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.MaxSubscribers > 0 && len(b.subscribers) >= b.MaxSubscribers {
+		return nil, errTooManySubscribers
+	}
+
+	sub := &subscriber{events: make(chan Event, subscriberBufferSize)}
+	if len(types) > 0 {
+		sub.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub, nil
+}
+
+func (b *Bus) unsubscribe(sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subscribers, sub)
+}
+
+// ServeHTTP stream events as server-sent events. Query arg types - comma separated filter of event types.
+func (b *Bus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming doesn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	var types []string
+	if typesArg := r.URL.Query().Get("types"); typesArg != "" {
+		types = strings.Split(typesArg, ",")
+	}
+
+	sub, err := b.subscribe(types)
+	log.DebugInfo(b.logger, err, "Subscribe to events", zap.Strings("types", types),
+		zap.String("remote_addr", r.RemoteAddr))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer b.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var heartbeat <-chan time.Time
+	if b.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(b.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		case event := <-sub.events:
+			var data []byte
+			data, err = json.Marshal(event)
+			if err == nil {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			}
+		}
+		if err != nil {
+			b.logger.Debug("Stop send events", zap.Error(err))
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+type Config struct {
+	Enable                   bool
+	MaxSubscribers           int
+	HeartbeatIntervalSeconds int
+}
+
+// CreateBus return nil if events disabled
+func (c Config) CreateBus(logger *zap.Logger) *Bus {
+	if !c.Enable {
+		logger.Info("Events stream disabled")
+		return nil
+	}
+	logger.Info("Events stream enabled", zap.Int("max_subscribers", c.MaxSubscribers))
+	return New(logger, c.MaxSubscribers, time.Duration(c.HeartbeatIntervalSeconds)*time.Second)
+}
@@ -0,0 +1,79 @@
+package events
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+)
+
+func TestNilBus(t *testing.T) {
+	var b *Bus
+	b.Publish(Event{Type: TypeCertIssued})
+}
+
+func TestBusSubscribers(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	b := New(zap.NewNop(), 1, 0)
+	sub, err := b.subscribe([]string{TypeCertIssued})
+	td.CmpNoError(err)
+
+	_, err = b.subscribe(nil)
+	td.CmpError(err)
+
+	b.Publish(Event{Type: TypeCertRenewed})
+	b.Publish(Event{Type: TypeCertIssued, Domain: "example.com"})
+	event := <-sub.events
+	td.Cmp(event.Type, TypeCertIssued)
+	td.Cmp(event.Domain, "example.com")
+	td.False(event.Time.IsZero())
+
+	b.unsubscribe(sub)
+	_, err = b.subscribe(nil)
+	td.CmpNoError(err)
+}
+
+func TestBusServeHTTP(t *testing.T) {
+	td := testdeep.NewT(t)
+	td.FailureIsFatal()
+
+	b := New(zap.NewNop(), 0, time.Millisecond)
+	server := httptest.NewServer(b)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events?types=" + TypeCertIssueFailed)
+	td.CmpNoError(err)
+	defer resp.Body.Close()
+	td.Cmp(resp.Header.Get("Content-Type"), "text/event-stream")
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	td.CmpNoError(err)
+	td.Cmp(line, ": heartbeat\n")
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			b.Publish(Event{Type: TypeCertIssued})
+			b.Publish(Event{Type: TypeCertIssueFailed, Domain: "example.com"})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	for {
+		line, err = reader.ReadString('\n')
+		td.CmpNoError(err)
+		if strings.HasPrefix(line, "event:") {
+			break
+		}
+	}
+	td.Cmp(line, "event: "+TypeCertIssueFailed+"\n")
+	line, err = reader.ReadString('\n')
+	td.CmpNoError(err)
+	td.Contains(line, `"domain":"example.com"`)
+}
@@ -0,0 +1,94 @@
+package log
+
+import (
+	"sort"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Specificity of certificate candidate for server name, higher is more specific
+const (
+	CertSpecificityDefault  = iota // default certificate, regardless of server name
+	CertSpecificityWildcard        // wildcard certificate of parent domain
+	CertSpecificityShared          // certificate of group or of main domain with auto subdomains
+	CertSpecificityExact           // certificate of the server name
+)
+
+// CertCandidate - certificate, considered while select certificate for server name
+type CertCandidate struct {
+	Key         string // name of certificate: cache key or domain name of static certificate
+	Source      string // where certificate looked for: static, local state, cache, issue, ...
+	Specificity int
+	Matched     bool
+	Reason      string // why candidate doesn't matched
+}
+
+func (c CertCandidate) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("key", c.Key)
+	enc.AddString("source", c.Source)
+	enc.AddInt("specificity", c.Specificity)
+	enc.AddBool("matched", c.Matched)
+	if c.Reason != "" {
+		enc.AddString("reason", c.Reason)
+	}
+	return nil
+}
+
+type certCandidates []CertCandidate
+
+func (c certCandidates) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, candidate := range c {
+		if err := enc.AppendObject(candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CertSelection - trace of certificate selection: considered candidates and final choice (first matched candidate).
+// It is nil if debug messages disabled for logger, methods of nil trace do nothing -
+// so selection without trace doesn't collect candidates.
+// Debug messages enabled by log level or by debug domains (written for the domains only).
+type CertSelection struct {
+	candidates certCandidates
+	chosen     string
+}
+
+// NewCertSelection return trace of certificate selection or nil if debug messages disabled for logger
+func NewCertSelection(logger *zap.Logger) *CertSelection {
+	if !logger.Core().Enabled(zapcore.DebugLevel) {
+		return nil
+	}
+	return &CertSelection{}
+}
+
+// Add considered candidate
+func (s *CertSelection) Add(candidate CertCandidate) {
+	if s == nil {
+		return
+	}
+	s.candidates = append(s.candidates, candidate)
+	if candidate.Matched && s.chosen == "" {
+		s.chosen = candidate.Source + ": " + candidate.Key
+	}
+}
+
+// Log write candidates, ranked by specificity, and final choice. fallback used as choice if no candidates matched.
+func (s *CertSelection) Log(logger *zap.Logger, fallback string) {
+	if s == nil {
+		return
+	}
+	chosen := s.chosen
+	if chosen == "" {
+		chosen = fallback
+	}
+	if chosen == "" {
+		chosen = "none"
+	}
+	ranked := append(certCandidates{}, s.candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Specificity > ranked[j].Specificity
+	})
+	logger.Debug("Certificate selection", zap.Array("candidates", ranked), zap.String("chosen", chosen))
+}
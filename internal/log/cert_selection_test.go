@@ -0,0 +1,66 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestCertSelection(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	var buf bytes.Buffer
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&buf), zapcore.DebugLevel)
+	debugDomains, err := NewDebugDomains(nil)
+	td.CmpNoError(err)
+	logger := zap.New(NewDebugDomainsCore(core, zapcore.InfoLevel, debugDomains))
+
+	// disabled
+	trace := NewCertSelection(logger)
+	td.Nil(trace)
+	trace.Add(CertCandidate{Key: "example.com", Matched: true})
+	trace.Log(logger, "")
+	td.Cmp(buf.Len(), 0)
+
+	// enabled by debug domain
+	td.CmpNoError(debugDomains.Set([]string{"www.example.com"}))
+	logger = logger.With(zap.String("server_name", "www.example.com"))
+	td.Nil(NewCertSelection(zap.NewNop()))
+	trace = NewCertSelection(logger)
+	td.NotNil(trace)
+	trace.Add(CertCandidate{Key: "*.example.com", Source: "static", Specificity: CertSpecificityWildcard, Matched: true})
+	trace.Add(CertCandidate{Key: "www.example.com", Source: "static", Specificity: CertSpecificityExact,
+		Reason: "no certificate"})
+	trace.Add(CertCandidate{Key: "example.com", Source: "cache", Specificity: CertSpecificityShared, Matched: true})
+	trace.Log(logger, "fallback")
+
+	var message struct {
+		Msg        string
+		Chosen     string
+		Candidates []map[string]interface{}
+	}
+	td.CmpNoError(json.Unmarshal(buf.Bytes(), &message))
+	td.Cmp(message.Msg, "Certificate selection")
+	td.Cmp(message.Chosen, "static: *.example.com")
+	td.Cmp(message.Candidates, []map[string]interface{}{
+		{"key": "www.example.com", "source": "static", "specificity": 3.0, "matched": false, "reason": "no certificate"},
+		{"key": "example.com", "source": "cache", "specificity": 2.0, "matched": true},
+		{"key": "*.example.com", "source": "static", "specificity": 1.0, "matched": true},
+	})
+
+	buf.Reset()
+	trace = NewCertSelection(logger)
+	trace.Log(logger, "")
+	td.CmpNoError(json.Unmarshal(buf.Bytes(), &message))
+	td.Cmp(message.Chosen, "none")
+
+	// other domains doesn't logged
+	buf.Reset()
+	logger = zap.New(NewDebugDomainsCore(core, zapcore.InfoLevel, debugDomains)).With(zap.String("server_name", "other.com"))
+	NewCertSelection(logger).Log(logger, "")
+	td.Cmp(buf.Len(), 0)
+}
@@ -0,0 +1,203 @@
+package log
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+)
+
+// log fields, which contain domain names
+const (
+	domainField     = "domain"
+	domainsField    = "domains"
+	serverNameField = "server_name"
+)
+
+const punycodePrefix = "(punycode:"
+
+const maxDebugDomainsRequestSize = 1 << 20
+
+// DebugDomains - domains, for which debug messages logged regardless of log level.
+// Domains of messages detected by fields "domain", "domains" and "server_name" of the message and of the logger.
+// It can be changed at runtime.
+type DebugDomains struct {
+	count int32
+
+	mu      sync.RWMutex
+	domains map[string]bool
+}
+
+// NewDebugDomains create list of debug domains
+func NewDebugDomains(domains []string) (*DebugDomains, error) {
+	res := &DebugDomains{}
+	if err := res.Set(domains); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Set replace list of debug domains
+func (d *DebugDomains) Set(domains []string) error {
+	m := make(map[string]bool, len(domains))
+	for _, s := range domains {
+		name, err := domain.NormalizeDomain(s)
+		if err != nil {
+			return xerrors.Errorf("normalize debug domain %q: %w", s, err)
+		}
+		m[name.ASCII()] = true
+	}
+
+	d.mu.Lock()
+	d.domains = m
+	atomic.StoreInt32(&d.count, int32(len(m)))
+	d.mu.Unlock()
+	return nil
+}
+
+// List return sorted debug domains
+func (d *DebugDomains) List() []string {
+	d.mu.RLock()
+	res := make([]string, 0, len(d.domains))
+	for name := range d.domains {
+		res = append(res, name)
+	}
+	d.mu.RUnlock()
+
+	sort.Strings(res)
+	return res
+}
+
+// Handler return debug domains as json array for GET requests and replace it by json array from body
+// of PUT requests
+func (d *DebugDomains) Handler(logger *zap.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			// pass
+		case http.MethodPut:
+			var domains []string
+			err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxDebugDomainsRequestSize)).Decode(&domains)
+			if err == nil {
+				err = d.Set(domains)
+			}
+			InfoError(logger, err, "Set debug log domains", zap.Strings("domains", domains),
+				zap.String("remote_address", r.RemoteAddr))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(d.List())
+	})
+}
+
+func (d *DebugDomains) isEmpty() bool {
+	return d == nil || atomic.LoadInt32(&d.count) == 0
+}
+
+func (d *DebugDomains) contains(domains []string) bool {
+	if d.isEmpty() || len(domains) == 0 {
+		return false
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, name := range domains {
+		if d.domains[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// NewDebugDomainsCore return core, which write messages with level enabled by level or debug messages
+// about debug domains. Core must be enabled for debug level.
+func NewDebugDomainsCore(core zapcore.Core, level zapcore.LevelEnabler, domains *DebugDomains) zapcore.Core {
+	return &debugDomainsCore{Core: core, level: level, debugDomains: domains}
+}
+
+type debugDomainsCore struct {
+	zapcore.Core
+	level        zapcore.LevelEnabler
+	debugDomains *DebugDomains
+
+	// domains from fields of logger
+	domains []string
+}
+
+func (c *debugDomainsCore) Enabled(level zapcore.Level) bool {
+	return c.level.Enabled(level) || !c.debugDomains.isEmpty() && c.Core.Enabled(level)
+}
+
+func (c *debugDomainsCore) With(fields []zapcore.Field) zapcore.Core {
+	res := *c
+	res.Core = c.Core.With(fields)
+	if domains := fieldsDomains(fields); len(domains) > 0 {
+		res.domains = append(append(make([]string, 0, len(c.domains)+len(domains)), c.domains...), domains...)
+	}
+	return &res
+}
+
+func (c *debugDomainsCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *debugDomainsCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	if !c.level.Enabled(entry.Level) && !c.debugDomains.contains(c.domains) &&
+		!c.debugDomains.contains(fieldsDomains(fields)) {
+		return nil
+	}
+	return c.Core.Write(entry, fields)
+}
+
+// fieldsDomains return normalized domains from domain fields
+func fieldsDomains(fields []zapcore.Field) []string {
+	var res []string
+	for _, field := range fields {
+		switch field.Key {
+		case domainField, serverNameField:
+			if field.Type == zapcore.StringType {
+				res = append(res, normalizeLogDomain(field.String))
+			}
+		case domainsField:
+			if field.Type != zapcore.ArrayMarshalerType {
+				continue
+			}
+			enc := zapcore.NewMapObjectEncoder()
+			field.AddTo(enc)
+			values, _ := enc.Fields[field.Key].([]interface{})
+			for _, value := range values {
+				if s, ok := value.(string); ok {
+					res = append(res, normalizeLogDomain(s))
+				}
+			}
+		}
+	}
+	return res
+}
+
+// normalizeLogDomain return ascii form of domain, logged as domain.FullString or as server name
+func normalizeLogDomain(s string) string {
+	if index := strings.Index(s, punycodePrefix); index >= 0 {
+		s = strings.TrimSuffix(s[index+len(punycodePrefix):], ")")
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+}
@@ -0,0 +1,85 @@
+package log
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+)
+
+func TestDebugDomainsCore(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	debugDomains, err := NewDebugDomains([]string{"Example.com.", "пример.рф"})
+	td.CmpNoError(err)
+	td.Cmp(debugDomains.List(), []string{"example.com", "xn--e1afmkfd.xn--p1ai"})
+
+	var buf bytes.Buffer
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&buf), zapcore.DebugLevel)
+	logger := zap.New(NewDebugDomainsCore(core, zapcore.InfoLevel, debugDomains))
+
+	logged := func(f func()) bool {
+		buf.Reset()
+		f()
+		return buf.Len() > 0
+	}
+
+	td.True(logged(func() { logger.Info("info") }))
+	td.False(logged(func() { logger.Debug("debug") }))
+	td.False(logged(func() { logger.Debug("debug", domain.LogDomain("other.com")) }))
+	td.True(logged(func() { logger.Debug("debug", domain.LogDomain("example.com")) }))
+	td.True(logged(func() { logger.Debug("debug", domain.LogDomain("xn--e1afmkfd.xn--p1ai")) }))
+	td.True(logged(func() { logger.Debug("debug", zap.String("server_name", "EXAMPLE.com")) }))
+	td.True(logged(func() {
+		logger.Debug("debug", domain.LogDomains([]domain.DomainName{"other.com", "example.com"}))
+	}))
+	td.True(logged(func() { logger.With(domain.LogDomain("example.com")).Named("sub").Debug("debug") }))
+	td.False(logged(func() { logger.With(domain.LogDomain("other.com")).Debug("debug") }))
+
+	// runtime change
+	domainLogger := logger.With(domain.LogDomain("example.com"))
+	td.CmpNoError(debugDomains.Set(nil))
+	td.False(logged(func() { domainLogger.Debug("debug") }))
+	td.True(logged(func() { domainLogger.Info("info") }))
+	td.CmpNoError(debugDomains.Set([]string{"example.com"}))
+	td.True(logged(func() { domainLogger.Debug("debug") }))
+
+	td.CmpError(debugDomains.Set([]string{"bad domain"}))
+	td.Cmp(debugDomains.List(), []string{"example.com"})
+}
+
+func TestDebugDomains_Handler(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	debugDomains, err := NewDebugDomains(nil)
+	td.CmpNoError(err)
+
+	request := func(method, body string) (int, string) {
+		w := httptest.NewRecorder()
+		debugDomains.Handler(zap.NewNop()).ServeHTTP(w, httptest.NewRequest(method, "/log/debug-domains", strings.NewReader(body)))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := request(http.MethodGet, "")
+	td.Cmp(code, http.StatusOK)
+	td.Cmp(body, "[]\n")
+
+	code, body = request(http.MethodPut, `["b.com", "A.com"]`)
+	td.Cmp(code, http.StatusOK)
+	td.Cmp(body, `["a.com","b.com"]`+"\n")
+
+	code, _ = request(http.MethodPut, `["bad domain"]`)
+	td.Cmp(code, http.StatusBadRequest)
+	code, _ = request(http.MethodPut, `{}`)
+	td.Cmp(code, http.StatusBadRequest)
+	code, _ = request(http.MethodPost, `[]`)
+	td.Cmp(code, http.StatusMethodNotAllowed)
+	td.Cmp(debugDomains.List(), []string{"a.com", "b.com"})
+}
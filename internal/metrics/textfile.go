@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+const textfileMode = 0o644
+
+// WriteTextfile write metrics of gatherer to file in prometheus text exposition format, for textfile collector
+// of node_exporter. File replaced atomically: metrics written to temporary file in same dir, then it renamed.
+func WriteTextfile(gatherer prometheus.Gatherer, path string) (err error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return xerrors.Errorf("gather metrics: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return xerrors.Errorf("create temporary metrics file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	encoder := expfmt.NewEncoder(tmp, expfmt.FmtText)
+	for _, family := range families {
+		if err = encoder.Encode(family); err != nil {
+			return xerrors.Errorf("encode metrics: %w", err)
+		}
+	}
+	if err = tmp.Chmod(textfileMode); err != nil {
+		return xerrors.Errorf("set mode of metrics file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return xerrors.Errorf("close temporary metrics file: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return xerrors.Errorf("rename temporary metrics file: %w", err)
+	}
+	return nil
+}
+
+// StartTextfile write metrics to textfile now and every interval until ctx done
+func StartTextfile(ctx context.Context, logger *zap.Logger, gatherer prometheus.Gatherer, path string, interval time.Duration) error {
+	if interval <= 0 {
+		return xerrors.Errorf("interval of metrics textfile must be positive: %v", interval)
+	}
+	if err := WriteTextfile(gatherer, path); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := WriteTextfile(gatherer, path); err != nil {
+					logger.Error("Write metrics textfile", zap.String("path", path), zap.Error(err))
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestWriteTextfile(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.prom")
+
+	r := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "Test gauge"}, []string{"name"})
+	r.MustRegister(gauge)
+	gauge.WithLabelValues("a").Set(1.5)
+
+	td.CmpNoError(WriteTextfile(r, path))
+	content, err := os.ReadFile(path)
+	td.CmpNoError(err)
+	td.Cmp(string(content), "# HELP test_gauge Test gauge\n# TYPE test_gauge gauge\ntest_gauge{name=\"a\"} 1.5\n")
+	stat, err := os.Stat(path)
+	td.CmpNoError(err)
+	td.Cmp(stat.Mode().Perm(), os.FileMode(textfileMode))
+
+	// file replaced, without temporary files
+	gauge.WithLabelValues("a").Set(2)
+	td.CmpNoError(WriteTextfile(r, path))
+	content, _ = os.ReadFile(path)
+	td.Cmp(string(content), testdeep.Contains(`test_gauge{name="a"} 2`))
+	entries, err := os.ReadDir(dir)
+	td.CmpNoError(err)
+	td.Cmp(len(entries), 1)
+
+	td.CmpError(WriteTextfile(r, filepath.Join(dir, "not-exist", "test.prom")))
+}
+
+func TestStartTextfile(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	// not t.TempDir: writer may create temporary file after cancel, don't fail test by error of cleanup
+	dir, err := os.MkdirTemp("", "lets-proxy2-textfile")
+	td.CmpNoError(err)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(dir, "test.prom")
+	r := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_counter", Help: "Test counter"})
+	r.MustRegister(counter)
+
+	td.CmpError(StartTextfile(ctx, zap.NewNop(), r, path, 0))
+	td.CmpNoError(StartTextfile(ctx, zap.NewNop(), r, path, 10*time.Millisecond))
+	content, err := os.ReadFile(path)
+	td.CmpNoError(err)
+	td.Cmp(string(content), testdeep.Contains("test_counter 0"))
+
+	counter.Inc()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		content, _ = os.ReadFile(path)
+		if strings.Contains(string(content), "test_counter 1") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	td.Cmp(string(content), testdeep.Contains("test_counter 1"))
+}
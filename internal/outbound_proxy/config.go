@@ -0,0 +1,82 @@
+//nolint:golint
+package outbound_proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// ProxyFunc return url of proxy for the request, nil - connect directly. Same as http.Transport.Proxy.
+type ProxyFunc func(req *http.Request) (*url.URL, error)
+
+// Config of proxy for outbound connections: to backends and acme server.
+type Config struct {
+	// UseEnvironment - use proxy from HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables if URL empty.
+	UseEnvironment bool
+
+	// URL of proxy, override environment: http://[user:password@]host:port, https://..., socks5://..., socks5h://...
+	// Loopback addresses connected directly.
+	URL string
+}
+
+// GetProxyFunc return proxy func by config, it never return nil func without error.
+func (c Config) GetProxyFunc() (ProxyFunc, error) {
+	if c.URL == "" {
+		if c.UseEnvironment {
+			return http.ProxyFromEnvironment, nil
+		}
+		return Direct, nil
+	}
+
+	proxyURL, err := ParseURL(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if isLoopback(req.URL.Hostname()) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// ParseURL parse and validate url of proxy
+func ParseURL(s string) (*url.URL, error) {
+	proxyURL, err := url.Parse(s)
+	if err != nil {
+		return nil, xerrors.Errorf("parse proxy url: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case schemeHTTP, schemeHTTPS, schemeSOCKS5, schemeSOCKS5H:
+	default:
+		return nil, xerrors.Errorf("unsupported proxy scheme %q, supported: http, https, socks5, socks5h", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, xerrors.Errorf("empty proxy host in url %q", proxyURL.Redacted())
+	}
+	return proxyURL, nil
+}
+
+// Direct doesn't use proxy for any request
+func Direct(_ *http.Request) (*url.URL, error) {
+	return nil, nil
+}
+
+// NewHTTPClient return http client, which connect through the proxy.
+func NewHTTPClient(proxy ProxyFunc) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	return &http.Client{Transport: transport}
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
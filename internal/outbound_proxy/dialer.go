@@ -0,0 +1,269 @@
+//nolint:golint
+package outbound_proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	schemeHTTP    = "http"
+	schemeHTTPS   = "https"
+	schemeSOCKS5  = "socks5"
+	schemeSOCKS5H = "socks5h"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc1928, https://datatracker.ietf.org/doc/html/rfc1929
+const (
+	socks5Version          = 5
+	socks5AuthNone         = 0
+	socks5AuthPassword     = 2
+	socks5AuthNoAcceptable = 0xff
+	socks5PasswordVersion  = 1
+	socks5CommandConnect   = 1
+	socks5AddressIPv4      = 1
+	socks5AddressDomain    = 3
+	socks5AddressIPv6      = 4
+	socks5ReplySucceeded   = 0
+)
+
+// Dialer dial tcp connections through proxy, selected by Proxy for http request to the address.
+type Dialer struct {
+	Proxy ProxyFunc
+
+	// Dial connect to proxy or to address directly
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyURL, err := d.Proxy(&http.Request{Method: http.MethodGet, URL: &url.URL{Scheme: schemeHTTP, Host: addr}})
+	if err != nil {
+		return nil, xerrors.Errorf("get proxy for %q: %w", addr, err)
+	}
+	if proxyURL == nil {
+		return d.Dial(ctx, network, addr)
+	}
+
+	conn, err := d.Dial(ctx, "tcp", proxyAddress(proxyURL))
+	if err != nil {
+		return nil, xerrors.Errorf("connect to proxy: %w", err)
+	}
+
+	// handshake with proxy is sync, break it by context
+	stopWatch := make(chan struct{})
+	watchFinished := make(chan struct{})
+	go func() {
+		defer close(watchFinished)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-stopWatch:
+		}
+	}()
+
+	conn, err = d.handshake(ctx, conn, proxyURL, addr)
+	close(stopWatch)
+	<-watchFinished
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, xerrors.Errorf("connect to %q through proxy %q: %w", addr, proxyURL.Redacted(), err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	switch proxyURL.Scheme {
+	case schemeHTTPS:
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return conn, xerrors.Errorf("tls handshake with proxy: %w", err)
+		}
+		return httpConnect(tlsConn, proxyURL, addr)
+	case schemeSOCKS5, schemeSOCKS5H:
+		return conn, d.socks5Connect(ctx, conn, proxyURL, addr)
+	default:
+		return httpConnect(conn, proxyURL, addr)
+	}
+}
+
+func proxyAddress(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+	port := "1080"
+	switch proxyURL.Scheme {
+	case schemeHTTP:
+		port = "80"
+	case schemeHTTPS:
+		port = "443"
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+func httpConnect(conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, xerrors.Errorf("write connect request: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, xerrors.Errorf("read connect response: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, xerrors.Errorf("proxy refused connect: %v", resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+func (d *Dialer) socks5Connect(ctx context.Context, conn net.Conn, proxyURL *url.URL, addr string) error {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return xerrors.Errorf("split host port: %w", err)
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return xerrors.Errorf("parse port: %w", err)
+	}
+
+	// socks5 - resolve address locally, socks5h - by proxy
+	ip := net.ParseIP(host)
+	if ip == nil && proxyURL.Scheme == schemeSOCKS5 {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return xerrors.Errorf("resolve %q: %w", host, err)
+		}
+		ip = ips[0]
+	}
+
+	method := byte(socks5AuthNone)
+	if proxyURL.User != nil {
+		method = socks5AuthPassword
+	}
+	if _, err = conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return xerrors.Errorf("write socks5 greeting: %w", err)
+	}
+	reply := make([]byte, 2) //nolint:gomnd
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return xerrors.Errorf("read socks5 greeting: %w", err)
+	}
+	if reply[0] != socks5Version || reply[1] == socks5AuthNoAcceptable || reply[1] != method {
+		return xerrors.Errorf("socks5 proxy doesn't accept auth method %v, reply: %v", method, reply)
+	}
+
+	if method == socks5AuthPassword {
+		if err = socks5Auth(conn, proxyURL.User); err != nil {
+			return err
+		}
+	}
+
+	req := []byte{socks5Version, socks5CommandConnect, 0}
+	switch {
+	case ip != nil && ip.To4() != nil:
+		req = append(append(req, socks5AddressIPv4), ip.To4()...)
+	case ip != nil:
+		req = append(append(req, socks5AddressIPv6), ip.To16()...)
+	default:
+		if len(host) > 255 { //nolint:gomnd
+			return xerrors.Errorf("too long host name for socks5: %q", host)
+		}
+		req = append(append(req, socks5AddressDomain, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port)) //nolint:gomnd
+	if _, err = conn.Write(req); err != nil {
+		return xerrors.Errorf("write socks5 connect request: %w", err)
+	}
+
+	header := make([]byte, 4) //nolint:gomnd
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return xerrors.Errorf("read socks5 connect reply: %w", err)
+	}
+	if header[0] != socks5Version || header[1] != socks5ReplySucceeded {
+		return xerrors.Errorf("socks5 proxy refused connect, reply code: %v", header[1])
+	}
+
+	var addrLen int
+	switch header[3] {
+	case socks5AddressIPv4:
+		addrLen = net.IPv4len
+	case socks5AddressIPv6:
+		addrLen = net.IPv6len
+	case socks5AddressDomain:
+		lenByte := make([]byte, 1)
+		if _, err = io.ReadFull(conn, lenByte); err != nil {
+			return xerrors.Errorf("read socks5 bound address: %w", err)
+		}
+		addrLen = int(lenByte[0])
+	default:
+		return xerrors.Errorf("unknown socks5 address type: %v", header[3])
+	}
+	// bound address and port doesn't used
+	if _, err = io.ReadFull(conn, make([]byte, addrLen+2)); err != nil {
+		return xerrors.Errorf("read socks5 bound address: %w", err)
+	}
+	return nil
+}
+
+func socks5Auth(conn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 { //nolint:gomnd
+		return xerrors.New("too long socks5 username or password")
+	}
+
+	req := []byte{socks5PasswordVersion, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return xerrors.Errorf("write socks5 auth: %w", err)
+	}
+
+	reply := make([]byte, 2) //nolint:gomnd
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return xerrors.Errorf("read socks5 auth reply: %w", err)
+	}
+	if reply[1] != 0 {
+		return xerrors.New("socks5 proxy authentication failed")
+	}
+	return nil
+}
+
+// bufferedConn read data, which was read to buffer while read proxy response
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
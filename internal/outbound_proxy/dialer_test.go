@@ -0,0 +1,149 @@
+//nolint:golint
+package outbound_proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+)
+
+func TestDialer(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	backend := startTestServer(t, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	})
+	httpProxy := startTestServer(t, testHTTPConnectProxy)
+	socksProxy := startTestServer(t, testSOCKS5Proxy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	check := func(proxyURL string, addr string) error {
+		u, err := ParseURL(proxyURL)
+		td.CmpNoError(err)
+		dialer := &Dialer{
+			Proxy: func(*http.Request) (*url.URL, error) { return u, nil },
+			Dial:  (&net.Dialer{}).DialContext,
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = conn.Close() }()
+
+		_, err = conn.Write([]byte("ping"))
+		td.CmpNoError(err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		td.CmpNoError(err)
+		td.Cmp(string(buf), "ping")
+		return nil
+	}
+
+	_, port, _ := net.SplitHostPort(backend)
+	td.CmpNoError(check("http://user:password@"+httpProxy, backend))
+	td.CmpError(check("http://user:bad@"+httpProxy, backend))
+	td.CmpNoError(check("socks5://"+socksProxy, backend))
+	td.CmpNoError(check("socks5h://user:password@"+socksProxy, "localhost:"+port))
+	td.CmpError(check("socks5://user:bad@"+socksProxy, backend))
+
+	// direct
+	dialer := &Dialer{Proxy: Direct, Dial: (&net.Dialer{}).DialContext}
+	conn, err := dialer.DialContext(ctx, "tcp", backend)
+	td.CmpNoError(err)
+	_ = conn.Close()
+}
+
+func startTestServer(t *testing.T, handle func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	testdeep.CmpNoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func testHTTPConnectProxy(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	expectedAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:password"))
+	if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != expectedAuth {
+		_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		return
+	}
+	testPipe(conn, req.Host, "HTTP/1.1 200 Connection established\r\n\r\n")
+}
+
+func testSOCKS5Proxy(conn net.Conn) {
+	read := func(n int) []byte {
+		buf := make([]byte, n)
+		_, _ = io.ReadFull(conn, buf)
+		return buf
+	}
+
+	greeting := read(2)
+	methods := read(int(greeting[1]))
+	if methods[0] == socks5AuthPassword {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthPassword})
+		header := read(2)
+		user := string(read(int(header[1])))
+		password := string(read(int(read(1)[0])))
+		if user != "user" || password != "password" {
+			_, _ = conn.Write([]byte{socks5PasswordVersion, 1})
+			return
+		}
+		_, _ = conn.Write([]byte{socks5PasswordVersion, 0})
+	} else {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNone})
+	}
+
+	header := read(4)
+	var host string
+	switch header[3] {
+	case socks5AddressIPv4:
+		host = net.IP(read(net.IPv4len)).String()
+	case socks5AddressIPv6:
+		host = net.IP(read(net.IPv6len)).String()
+	case socks5AddressDomain:
+		host = string(read(int(read(1)[0])))
+	}
+	portBytes := read(2)
+	port := int(portBytes[0])<<8 | int(portBytes[1])
+	testPipe(conn, net.JoinHostPort(host, strconv.Itoa(port)), string([]byte{socks5Version, 0, 0, socks5AddressIPv4, 0, 0, 0, 0, 0, 0}))
+}
+
+func testPipe(conn net.Conn, addr string, okResponse string) {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer func() { _ = target.Close() }()
+
+	_, _ = conn.Write([]byte(okResponse))
+	go func() { _, _ = io.Copy(target, conn) }()
+	_, _ = io.Copy(conn, target)
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/dns"
+)
+
+// AddressFamily - preference of ip version for connections to backends
+type AddressFamily string
+
+const (
+	AddressFamilyAny        AddressFamily = "any"
+	AddressFamilyPreferIPv4 AddressFamily = "prefer-ipv4"
+	AddressFamilyPreferIPv6 AddressFamily = "prefer-ipv6"
+	AddressFamilyIPv4Only   AddressFamily = "ipv4-only"
+	AddressFamilyIPv6Only   AddressFamily = "ipv6-only"
+)
+
+// ParseAddressFamily parse address family from config. Empty string mean AddressFamilyAny.
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch f := AddressFamily(s); f {
+	case "":
+		return AddressFamilyAny, nil
+	case AddressFamilyAny, AddressFamilyPreferIPv4, AddressFamilyPreferIPv6, AddressFamilyIPv4Only, AddressFamilyIPv6Only:
+		return f, nil
+	default:
+		return "", xerrors.Errorf("unknown address family: %q", s)
+	}
+}
+
+// ipVersions return suffixes of networks ("tcp4", "ip6", ...) for resolve addresses, in order of preference.
+// Empty suffix mean any ip version.
+func (f AddressFamily) ipVersions() []string {
+	switch f {
+	case AddressFamilyPreferIPv4:
+		return []string{"4", "6"}
+	case AddressFamilyPreferIPv6:
+		return []string{"6", "4"}
+	case AddressFamilyIPv4Only:
+		return []string{"4"}
+	case AddressFamilyIPv6Only:
+		return []string{"6"}
+	default:
+		return []string{""}
+	}
+}
+
+// filterIPs return ips of allowed families, preferred family first. Order within family kept.
+func (f AddressFamily) filterIPs(ips []net.IP) []net.IP {
+	var res []net.IP
+	for _, version := range f.ipVersions() {
+		for _, ip := range ips {
+			isIPv4 := ip.To4() != nil
+			if version == "" || (version == "4") == isIPv4 {
+				res = append(res, ip)
+			}
+		}
+	}
+	return res
+}
+
+// resolveTCPAddr resolve address with preferred family. It fallback to other family
+// if preferred has no address, except "only" families.
+func (f AddressFamily) resolveTCPAddr(addr string) (res *net.TCPAddr, err error) {
+	for _, version := range f.ipVersions() {
+		if res, err = net.ResolveTCPAddr("tcp"+version, addr); err == nil {
+			return res, nil
+		}
+	}
+	return nil, err
+}
+
+// resolveIPAddr same as resolveTCPAddr for address without port
+func (f AddressFamily) resolveIPAddr(addr string) (res *net.IPAddr, err error) {
+	for _, version := range f.ipVersions() {
+		if res, err = net.ResolveIPAddr("ip"+version, addr); err == nil {
+			return res, nil
+		}
+	}
+	return nil, err
+}
+
+// dialContext dial to address with preferred family first, then other addresses (if allowed by family).
+// Host of address resolved by resolver, nil - system resolver.
+func (f AddressFamily) dialContext(ctx context.Context, resolver dns.ResolverInterface, network, addr string) (net.Conn, error) {
+	dialer := newDialer()
+	if (f == AddressFamilyAny || f == "") && resolver == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, xerrors.Errorf("split host port: %w", err)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ips, err = lookupBackendIPs(ctx, resolver, host)
+		if err != nil {
+			return nil, xerrors.Errorf("lookup backend ip: %w", err)
+		}
+	}
+
+	ips = f.filterIPs(ips)
+	if len(ips) == 0 {
+		return nil, xerrors.Errorf("no addresses of family %q for backend %q", f, host)
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+	}
+	return nil, err
+}
+
+func lookupBackendIPs(ctx context.Context, resolver dns.ResolverInterface, host string) ([]net.IP, error) {
+	if resolver == nil {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestParseAddressFamily(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	table := []struct {
+		s   string
+		res AddressFamily
+		ok  bool
+	}{
+		{"", AddressFamilyAny, true},
+		{"any", AddressFamilyAny, true},
+		{"prefer-ipv4", AddressFamilyPreferIPv4, true},
+		{"prefer-ipv6", AddressFamilyPreferIPv6, true},
+		{"ipv4-only", AddressFamilyIPv4Only, true},
+		{"ipv6-only", AddressFamilyIPv6Only, true},
+		{"ipv6", "", false},
+	}
+	for _, test := range table {
+		res, err := ParseAddressFamily(test.s)
+		td.Cmp(res, test.res, test.s)
+		td.Cmp(err == nil, test.ok, test.s)
+	}
+}
+
+func TestAddressFamily_FilterIPs(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	ipv4a, ipv4b := net.ParseIP("1.1.1.1"), net.ParseIP("2.2.2.2")
+	ipv6a, ipv6b := net.ParseIP("::1"), net.ParseIP("::2")
+	ips := []net.IP{ipv4a, ipv6a, ipv4b, ipv6b}
+
+	td.Cmp(AddressFamilyAny.filterIPs(ips), ips)
+	td.Cmp(AddressFamilyPreferIPv4.filterIPs(ips), []net.IP{ipv4a, ipv4b, ipv6a, ipv6b})
+	td.Cmp(AddressFamilyPreferIPv6.filterIPs(ips), []net.IP{ipv6a, ipv6b, ipv4a, ipv4b})
+	td.Cmp(AddressFamilyIPv4Only.filterIPs(ips), []net.IP{ipv4a, ipv4b})
+	td.Cmp(AddressFamilyIPv6Only.filterIPs(ips), []net.IP{ipv6a, ipv6b})
+	td.Nil(AddressFamilyIPv6Only.filterIPs([]net.IP{ipv4a}))
+}
+
+func TestAddressFamily_ResolveTCPAddr(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	addr, err := AddressFamilyPreferIPv6.resolveTCPAddr("1.2.3.4:80")
+	td.CmpNoError(err)
+	td.Cmp(addr.String(), "1.2.3.4:80")
+
+	_, err = AddressFamilyIPv6Only.resolveTCPAddr("1.2.3.4:80")
+	td.CmpError(err)
+
+	addr, err = AddressFamilyIPv6Only.resolveTCPAddr("[::4]:80")
+	td.CmpNoError(err)
+	td.Cmp(addr.String(), "[::4]:80")
+
+	ipAddr, err := AddressFamilyPreferIPv4.resolveIPAddr("::4")
+	td.CmpNoError(err)
+	td.Cmp(ipAddr.String(), "::4")
+
+	_, err = AddressFamilyIPv4Only.resolveIPAddr("::4")
+	td.CmpError(err)
+}
+
+func TestAddressFamily_DialContext(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	listener := th.NewLocalTcpListener(e)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	addr := listener.Addr().String()
+
+	for _, family := range []AddressFamily{AddressFamilyAny, AddressFamilyPreferIPv6, AddressFamilyIPv4Only} {
+		conn, err := family.dialContext(ctx, nil, "tcp", addr)
+		e.CmpNoError(err, family)
+		if err == nil {
+			_ = conn.Close()
+		}
+	}
+
+	_, err := AddressFamilyIPv6Only.dialContext(ctx, nil, "tcp", addr)
+	e.CmpError(err)
+
+	// backend name resolved by custom resolver
+	_, port, err := net.SplitHostPort(addr)
+	e.CmpNoError(err)
+	resolver := testResolver{"backend.internal": {{IP: net.ParseIP("::1")}, {IP: net.ParseIP("127.0.0.1")}}}
+	conn, err := AddressFamilyAny.dialContext(ctx, resolver, "tcp", net.JoinHostPort("backend.internal", port))
+	e.CmpNoError(err)
+	if err == nil {
+		_ = conn.Close()
+	}
+
+	_, err = AddressFamilyIPv6Only.dialContext(ctx, resolver, "tcp", net.JoinHostPort("backend.internal", port))
+	e.CmpError(err)
+
+	_, err = AddressFamilyAny.dialContext(ctx, resolver, "tcp", net.JoinHostPort("unknown.internal", port))
+	e.CmpError(err)
+}
+
+type testResolver map[string][]net.IPAddr
+
+func (r testResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("not found")
+}
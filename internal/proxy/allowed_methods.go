@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/stringhelper"
+)
+
+// ParseAllowedMethods validate names of http methods and return them in upper case without duplicates
+func ParseAllowedMethods(methods []string) ([]string, error) {
+	res := make([]string, 0, len(methods))
+	for _, method := range methods {
+		if !httpguts.ValidHeaderFieldName(method) {
+			return nil, xerrors.Errorf("bad http method: %q", method)
+		}
+		method = strings.ToUpper(method)
+		if !stringhelper.Contains(res, method) {
+			res = append(res, method)
+		}
+	}
+	return res, nil
+}
+
+// allowedMethods return allowed methods of first rule, matched to request, nil if any method allowed by the rule
+// or no rule matched
+func (d DirectorRewrite) allowedMethods(request *http.Request) []string {
+	for i := range d {
+		if d[i].match(request) {
+			return d[i].allowedMethods
+		}
+	}
+	return nil
+}
+
+// handleMethodNotAllowed reject requests with methods, which aren't allowed for its route (or by AllowedMethods
+// for routes without own methods), by 405 status with Allow header.
+func (p *HTTPProxy) handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) bool {
+	rules := p.AllowedMethodsRules
+	if director, ok := p.Director.(*ReloadableDirector); ok {
+		rules = director.AllowedMethodsRules()
+	}
+	methods := rules.allowedMethods(r)
+	if methods == nil {
+		methods = p.AllowedMethods
+	}
+	if len(methods) == 0 || stringhelper.Contains(methods, r.Method) {
+		return false
+	}
+
+	p.logger.Info("Reject request with not allowed method", zap.String("method", r.Method),
+		zap.Strings("allowed_methods", methods), zap.String("remote_addr", r.RemoteAddr),
+		zap.String("host", r.Host), zap.String("path", r.URL.Path))
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	if !p.ErrorPages.Write(w, r, http.StatusMethodNotAllowed) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestParseAllowedMethods(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	methods, err := ParseAllowedMethods([]string{"get", "HEAD", "GET", "PURGE"})
+	td.CmpNoError(err)
+	td.Cmp(methods, []string{"GET", "HEAD", "PURGE"})
+
+	methods, err = ParseAllowedMethods(nil)
+	td.CmpNoError(err)
+	td.Cmp(methods, testdeep.Empty())
+
+	for _, method := range []string{"", "GE T", "GET,HEAD", "GET\n"} {
+		_, err = ParseAllowedMethods([]string{method})
+		td.CmpError(err, method)
+	}
+
+	_, err = NewDirectorRewrite([]RewriteRuleConfig{{Route: "*/", AllowedMethods: []string{"G(ET"}}})
+	td.CmpError(err)
+}
+
+func TestHTTPProxy_HandleMethodNotAllowed(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	p := &HTTPProxy{logger: zap.NewNop()}
+	var err error
+	p.AllowedMethods, err = ParseAllowedMethods([]string{"GET", "HEAD", "POST"})
+	e.CmpNoError(err)
+	p.AllowedMethodsRules, err = NewDirectorRewrite([]RewriteRuleConfig{
+		{Route: "mirror.example.com/", AllowedMethods: []string{"GET", "head"}},
+		{Route: "mirror.example.com/", Backend: "other:80"},
+		{Route: "*/api/", Backend: "api:80"},
+	})
+	e.CmpNoError(err)
+
+	handle := func(method, url string) (bool, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		return p.handleMethodNotAllowed(w, httptest.NewRequest(method, url, nil)), w
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		handled, _ := handle(method, "http://mirror.example.com/file")
+		e.False(handled, method)
+	}
+	handled, w := handle(http.MethodPost, "http://Mirror.example.com:443/file")
+	e.True(handled)
+	e.Cmp(w.Code, http.StatusMethodNotAllowed)
+	e.Cmp(w.Header().Get("Allow"), "GET, HEAD")
+
+	// routes without own methods and requests without matched route use global methods
+	handled, _ = handle(http.MethodPost, "http://example.com/api/")
+	e.False(handled)
+	handled, w = handle(http.MethodDelete, "http://example.com/")
+	e.True(handled)
+	e.Cmp(w.Header().Get("Allow"), "GET, HEAD, POST")
+
+	p.AllowedMethods = nil
+	handled, _ = handle(http.MethodDelete, "http://example.com/")
+	e.False(handled)
+	handled, _ = handle(http.MethodDelete, "http://mirror.example.com/")
+	e.True(handled)
+
+	// rules of reloadable director replace own rules of proxy and reloaded with routes
+	director := NewReloadableDirector(NewDirectorHost("backend:80"), nil)
+	p.Director = director
+	handled, _ = handle(http.MethodDelete, "http://mirror.example.com/")
+	e.False(handled)
+
+	rules, err := NewDirectorRewrite([]RewriteRuleConfig{{Route: "*/", AllowedMethods: []string{"GET"}}})
+	e.CmpNoError(err)
+	director.Replace(NewDirectorHost("backend:80"), rules)
+	handled, w = handle(http.MethodDelete, "http://example.com/")
+	e.True(handled)
+	e.Cmp(w.Header().Get("Allow"), "GET")
+}
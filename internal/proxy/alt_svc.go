@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+// alternative service in format protocol-id="[host]:port", rfc 7838 section 3
+var altSvcAlternativeRegexp = regexp.MustCompile(`^[a-zA-Z0-9!#$%&'*+.^_` + "`" + `|~-]+="[^"\s]*:[0-9]{1,5}"$`)
+
+// NewAltSvc return value of Alt-Svc header for alternatives like `h3=":443"`.
+// maxAge added to every alternative, 0 - default of client (24 hours).
+func NewAltSvc(alternatives []string, maxAge time.Duration) (string, error) {
+	if maxAge < 0 {
+		return "", xerrors.Errorf("negative alt-svc max age: %v", maxAge)
+	}
+
+	values := make([]string, 0, len(alternatives))
+	for _, alternative := range alternatives {
+		alternative = strings.TrimSpace(alternative)
+		if !altSvcAlternativeRegexp.MatchString(alternative) {
+			return "", xerrors.Errorf("bad alt-svc alternative, expected protocol=\"[host]:port\": %q", alternative)
+		}
+		if maxAge > 0 {
+			alternative += "; ma=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+		}
+		values = append(values, alternative)
+	}
+	return strings.Join(values, ", "), nil
+}
+
+// setAltSvc advertise alternative services (for example HTTP/3) in responses of tls connections only
+func (p *HTTPProxy) setAltSvc(w http.ResponseWriter, r *http.Request) {
+	if p.AltSvc == "" {
+		return
+	}
+	ctx, err := p.GetContext(r)
+	if err != nil {
+		return
+	}
+	if isTLS, _ := ctx.Value(contextlabel.TLSConnection).(bool); isTLS {
+		w.Header().Set("Alt-Svc", p.AltSvc)
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+func TestNewAltSvc(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	res, err := NewAltSvc(nil, time.Hour)
+	td.CmpNoError(err)
+	td.Cmp(res, "")
+
+	res, err = NewAltSvc([]string{`h3=":443"`, ` h3-29="alt.example.com:8443" `}, time.Hour)
+	td.CmpNoError(err)
+	td.Cmp(res, `h3=":443"; ma=3600, h3-29="alt.example.com:8443"; ma=3600`)
+
+	res, err = NewAltSvc([]string{`h3=":443"`}, 0)
+	td.CmpNoError(err)
+	td.Cmp(res, `h3=":443"`)
+
+	for _, bad := range []string{"", "h3", `h3=:443`, `h3=":port"`, `h3=":443"; ma=10`, `h 3=":443"`} {
+		_, err = NewAltSvc([]string{bad}, 0)
+		td.CmpError(err, bad)
+	}
+	_, err = NewAltSvc([]string{`h3=":443"`}, -time.Second)
+	td.CmpError(err)
+}
+
+func TestHTTPProxy_setAltSvc(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	check := func(altSvc string, isTLS interface{}) string {
+		p := &HTTPProxy{AltSvc: altSvc, GetContext: func(_ *http.Request) (context.Context, error) {
+			return context.WithValue(context.Background(), contextlabel.TLSConnection, isTLS), nil
+		}}
+		w := httptest.NewRecorder()
+		p.setAltSvc(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Header().Get("Alt-Svc")
+	}
+
+	td.Cmp(check(`h3=":443"`, true), `h3=":443"`)
+	td.Cmp(check(`h3=":443"`, false), "")
+	td.Cmp(check(`h3=":443"`, nil), "")
+	td.Cmp(check("", true), "")
+}
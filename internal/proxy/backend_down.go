@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/events"
+)
+
+// BackendDownMode - behavior of proxy when backend doesn't accept connections
+type BackendDownMode string
+
+const (
+	BackendDownFailFast   BackendDownMode = "fail-fast"
+	BackendDownRetry      BackendDownMode = "retry"
+	BackendDownStaleCache BackendDownMode = "serve-stale-cache"
+)
+
+const (
+	backendDownRetryMinDelay = 100 * time.Millisecond
+	backendDownRetryMaxDelay = time.Second
+
+	// max size of body of cached response
+	staleCacheMaxBodySize = 1 << 20
+)
+
+// ParseBackendDownMode parse mode from config. Empty string mean BackendDownFailFast.
+func ParseBackendDownMode(s string) (BackendDownMode, error) {
+	switch mode := BackendDownMode(s); mode {
+	case "":
+		return BackendDownFailFast, nil
+	case BackendDownFailFast, BackendDownRetry, BackendDownStaleCache:
+		return mode, nil
+	default:
+		return "", xerrors.Errorf("unknown backend down mode: %q", s)
+	}
+}
+
+// BackendDown handle requests while backend doesn't accept connections.
+type BackendDown struct {
+	Mode BackendDownMode
+
+	// RetryTimeout - max time for wait backend in retry mode.
+	RetryTimeout time.Duration
+
+	// StaleCache - last good responses for serve-stale-cache mode.
+	StaleCache *StaleCache
+
+	// Events - receive backend down and up events, when requests to backend change health of it. nil - without events.
+	Events EventPublisher
+}
+
+type EventPublisher interface {
+	// Publish must not block
+	Publish(event events.Event)
+}
+
+// wrap return transport with the behavior
+func (b *BackendDown) wrap(transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if b.Events != nil {
+		// under retries - every attempt change health
+		transport = &backendHealthTransport{next: transport, events: b.Events}
+	}
+	switch b.Mode {
+	case BackendDownRetry:
+		return backendRetryTransport{next: transport, timeout: b.RetryTimeout}
+	case BackendDownStaleCache:
+		return staleCacheTransport{next: transport, cache: b.StaleCache}
+	default:
+		return transport
+	}
+}
+
+// isBackendDown check if request failed while connect to backend, it mean request doesn't sent.
+func isBackendDown(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// backendHealthTransport publish event when backend go down (doesn't accept connections)
+// and when it up again (first successful request after down).
+type backendHealthTransport struct {
+	next   http.RoundTripper
+	events EventPublisher
+
+	mu   sync.Mutex
+	down map[string]bool // by backend address, contain down backends only
+}
+
+func (t *backendHealthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err == nil:
+		t.setDown(req, false, nil)
+	case isBackendDown(err):
+		t.setDown(req, true, err)
+	}
+	return resp, err
+}
+
+func (t *backendHealthTransport) setDown(req *http.Request, down bool, err error) {
+	backend := req.URL.Host
+
+	t.mu.Lock()
+	changed := t.down[backend] != down
+	if changed {
+		if down {
+			if t.down == nil {
+				t.down = make(map[string]bool)
+			}
+			t.down[backend] = true
+		} else {
+			delete(t.down, backend)
+		}
+	}
+	t.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	event := events.Event{Type: events.TypeBackendUp, Backend: backend}
+	if down {
+		event.Type = events.TypeBackendDown
+		event.Message = err.Error()
+	}
+	zc.L(req.Context()).Info("Backend health changed", zap.String("backend", backend), zap.Bool("down", down))
+	t.events.Publish(event)
+}
+
+type backendRetryTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t backendRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	// request body closed by transport and can't be sent again
+	if err == nil || !isBackendDown(err) || (req.Body != nil && req.Body != http.NoBody) {
+		return resp, err
+	}
+
+	logger := zc.L(req.Context())
+	logger.Info("Backend down, wait for it", zap.Duration("timeout", t.timeout), zap.Error(err))
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	defer cancel()
+
+	delay := backendDownRetryMinDelay
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+
+		resp, err = t.next.RoundTrip(req)
+		if err == nil || !isBackendDown(err) {
+			logger.Debug("Backend request retried", zap.Error(err))
+			return resp, err
+		}
+		delay *= 2
+		if delay > backendDownRetryMaxDelay {
+			delay = backendDownRetryMaxDelay
+		}
+	}
+}
+
+// StaleCache is bounded in memory cache of last good responses for GET requests, by request url.
+// Only last stored variant of response with Vary kept, it served for requests with same headers from Vary.
+type StaleCache struct {
+	TTL        time.Duration
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+}
+
+type staleCacheEntry struct {
+	key     string
+	vary    []string
+	variant string
+	status  int
+	header  http.Header
+	body    []byte
+	created time.Time
+}
+
+func NewStaleCache(ttl time.Duration, maxEntries int) *StaleCache {
+	return &StaleCache{TTL: ttl, MaxEntries: maxEntries, entries: make(map[string]*list.Element)}
+}
+
+func (c *StaleCache) get(key string, now time.Time) *staleCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*staleCacheEntry)
+	if now.Sub(entry.created) > c.TTL {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+func (c *StaleCache) put(entry *staleCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*staleCacheEntry).key)
+	}
+}
+
+func staleCacheKey(req *http.Request) string {
+	return req.Host + " " + req.URL.String()
+}
+
+// isStaleCacheable check request and response can be served to other clients
+func isStaleCacheable(req *http.Request, resp *http.Response) bool {
+	if req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" || req.Header.Get("Range") != "" {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" || resp.ContentLength > staleCacheMaxBodySize {
+		return false
+	}
+	for _, name := range responseVary(resp) {
+		if name == "*" {
+			return false
+		}
+	}
+	cacheControl := strings.ToLower(resp.Header.Get("Cache-Control"))
+	return !strings.Contains(cacheControl, "private") && !strings.Contains(cacheControl, "no-store")
+}
+
+type staleCacheTransport struct {
+	next  http.RoundTripper
+	cache *StaleCache
+}
+
+func (t staleCacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		if req.Method != http.MethodGet || !isBackendDown(err) {
+			return resp, err
+		}
+		entry := t.cache.get(staleCacheKey(req), time.Now())
+		if entry == nil || responseCacheVariantKey(req, entry.vary) != entry.variant {
+			return resp, err
+		}
+		zc.L(req.Context()).Info("Backend down, serve stale response", zap.Time("created", entry.created), zap.Error(err))
+		return entry.response(req, time.Now()), nil
+	}
+
+	if isStaleCacheable(req, resp) {
+		vary := responseVary(resp)
+		resp.Body = &staleCacheBody{
+			ReadCloser: resp.Body,
+			cache:      t.cache,
+			entry: &staleCacheEntry{
+				key:     staleCacheKey(req),
+				vary:    vary,
+				variant: responseCacheVariantKey(req, vary),
+				status:  resp.StatusCode,
+				header:  resp.Header.Clone(),
+			},
+		}
+	}
+	return resp, nil
+}
+
+func (e *staleCacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int(now.Sub(e.created).Seconds())))
+	header.Set("Warning", `110 - "Response is Stale"`)
+	return &http.Response{
+		Status:        strconv.Itoa(e.status) + " " + http.StatusText(e.status),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// staleCacheBody store response to cache if it read completely
+type staleCacheBody struct {
+	io.ReadCloser
+	cache    *StaleCache
+	entry    *staleCacheEntry
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (b *staleCacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if b.buf.Len()+n > staleCacheMaxBodySize {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.overflow && b.entry != nil {
+		b.entry.body = b.buf.Bytes()
+		b.entry.created = time.Now()
+		b.cache.put(b.entry)
+		b.entry = nil
+	}
+	return n, err
+}
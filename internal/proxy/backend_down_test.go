@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/events"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+var errTestBackendDown = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+func TestBackendRetryTransport(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	calls := 0
+	rtMock := NewRoundTripperMock(mc)
+	rtMock.RoundTripMock.Set(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls < 3 {
+			return nil, errTestBackendDown
+		}
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	transport := (&BackendDown{Mode: BackendDownRetry, RetryTimeout: 5 * time.Second}).wrap(rtMock)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend/", nil)
+	resp, err := transport.RoundTrip(req)
+	td.CmpNoError(err)
+	td.Cmp(resp.StatusCode, http.StatusOK)
+	td.Cmp(calls, 3)
+
+	// timeout
+	calls = -100
+	transport = (&BackendDown{Mode: BackendDownRetry, RetryTimeout: 150 * time.Millisecond}).wrap(rtMock)
+	_, err = transport.RoundTrip(req)
+	td.Cmp(err, errTestBackendDown)
+
+	// request with body can't be retried
+	calls = 0
+	req, _ = http.NewRequestWithContext(ctx, http.MethodPost, "http://backend/", strings.NewReader("body"))
+	_, err = transport.RoundTrip(req)
+	td.Cmp(err, errTestBackendDown)
+	td.Cmp(calls, 1)
+}
+
+type testEventPublisher []events.Event
+
+func (p *testEventPublisher) Publish(event events.Event) {
+	*p = append(*p, event)
+}
+
+func TestBackendHealthEvents(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	var backendErr error
+	rtMock := NewRoundTripperMock(mc)
+	rtMock.RoundTripMock.Set(func(req *http.Request) (*http.Response, error) {
+		if backendErr != nil {
+			return nil, backendErr
+		}
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	})
+
+	var published testEventPublisher
+	transport := (&BackendDown{Mode: BackendDownFailFast, Events: &published}).wrap(rtMock)
+	roundTrip := func(url string, err error) {
+		backendErr = err
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		_, _ = transport.RoundTrip(req)
+	}
+
+	roundTrip("http://a:80/", nil)
+	roundTrip("http://a:80/", errTestBackendDown)
+	roundTrip("http://a:80/", errTestBackendDown)
+	roundTrip("http://b:80/", io.ErrUnexpectedEOF) // not backend down
+	roundTrip("http://b:80/", nil)
+	roundTrip("http://a:80/", nil)
+	roundTrip("http://a:80/", nil)
+
+	td.Cmp(published, testEventPublisher{
+		{Type: events.TypeBackendDown, Backend: "a:80", Message: errTestBackendDown.Error()},
+		{Type: events.TypeBackendUp, Backend: "a:80"},
+	})
+}
+
+func TestStaleCacheTransport(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	backendDown := false
+	rtMock := NewRoundTripperMock(mc)
+	rtMock.RoundTripMock.Set(func(req *http.Request) (*http.Response, error) {
+		if backendDown {
+			return nil, errTestBackendDown
+		}
+		header := http.Header{"Content-Type": []string{"text/plain"}}
+		if req.URL.Path == "/private" {
+			header.Set("Cache-Control", "private")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(strings.NewReader("ok " + req.URL.Path))}, nil
+	})
+
+	cache := NewStaleCache(time.Minute, 2)
+	transport := (&BackendDown{Mode: BackendDownStaleCache, StaleCache: cache}).wrap(rtMock)
+	get := func(path string) (*http.Response, error) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend"+path, nil)
+		req.Host = "example.com"
+		resp, err := transport.RoundTrip(req)
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			resp.Body = io.NopCloser(strings.NewReader(string(body)))
+		}
+		return resp, err
+	}
+
+	for _, path := range []string{"/1", "/2", "/3", "/private"} {
+		_, err := get(path)
+		td.CmpNoError(err)
+	}
+
+	backendDown = true
+	resp, err := get("/3")
+	td.CmpNoError(err)
+	td.Cmp(resp.StatusCode, http.StatusOK)
+	td.Cmp(resp.Header.Get("Content-Type"), "text/plain")
+	td.Cmp(resp.Header.Get("Warning"), `110 - "Response is Stale"`)
+	body, _ := io.ReadAll(resp.Body)
+	td.Cmp(string(body), "ok /3")
+
+	_, err = get("/2")
+	td.CmpNoError(err)
+
+	// evicted by max entries
+	_, err = get("/1")
+	td.Cmp(err, errTestBackendDown)
+
+	_, err = get("/private")
+	td.Cmp(err, errTestBackendDown)
+
+	// expired
+	td.Nil(cache.get("example.com http://backend/3", time.Now().Add(2*time.Minute)))
+	_, err = get("/3")
+	td.Cmp(err, errTestBackendDown)
+}
+
+func TestStaleCacheTransportVary(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	backendDown := false
+	rtMock := NewRoundTripperMock(mc)
+	rtMock.RoundTripMock.Set(func(req *http.Request) (*http.Response, error) {
+		if backendDown {
+			return nil, errTestBackendDown
+		}
+		header := http.Header{"Vary": []string{"Accept-Language"}}
+		if req.URL.Path == "/any" {
+			header.Set("Vary", "*")
+		}
+		body := "ok " + req.Header.Get("Accept-Language")
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(strings.NewReader(body))}, nil
+	})
+
+	transport := (&BackendDown{Mode: BackendDownStaleCache, StaleCache: NewStaleCache(time.Minute, 10)}).wrap(rtMock)
+	get := func(path, lang string) (string, error) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend"+path, nil)
+		req.Host = "example.com"
+		req.Header.Set("Accept-Language", lang)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return "", err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return string(body), nil
+	}
+
+	for _, path := range []string{"/", "/any"} {
+		_, err := get(path, "en")
+		td.CmpNoError(err)
+	}
+
+	backendDown = true
+	body, err := get("/", "en")
+	td.CmpNoError(err)
+	td.Cmp(body, "ok en")
+
+	// other variant isn't stored
+	_, err = get("/", "ru")
+	td.Cmp(err, errTestBackendDown)
+
+	_, err = get("/any", "en")
+	td.Cmp(err, errTestBackendDown)
+}
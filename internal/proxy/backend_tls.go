@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// BackendTLS - tls settings of one https backend
+type BackendTLS struct {
+	// ServerName override SNI and verified name of backend certificate. Empty mean Transport.ServerName.
+	ServerName string
+
+	// CertSHA256 - allowed sha256 fingerprints of backend certificate. Backend with pinned certificate
+	// trusted without verification by CA and name. Empty - verify certificate as usual.
+	CertSHA256 [][sha256.Size]byte
+}
+
+// ParseCertFingerprint parse hex sha256 fingerprint of certificate,
+// bytes may be separated by colons (as printed by openssl x509 -fingerprint -sha256).
+func ParseCertFingerprint(s string) ([sha256.Size]byte, error) {
+	var res [sha256.Size]byte
+
+	decoded, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(s), ":", ""))
+	if err != nil {
+		return res, xerrors.Errorf("decode hex fingerprint %q: %w", s, err)
+	}
+	if len(decoded) != sha256.Size {
+		return res, xerrors.Errorf("sha256 fingerprint must have %v bytes, got %v: %q", sha256.Size, len(decoded), s)
+	}
+	copy(res[:], decoded)
+	return res, nil
+}
+
+// verifyPinnedCertificate check fingerprint of backend leaf certificate, for tls.Config.VerifyPeerCertificate
+func (b BackendTLS) verifyPinnedCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("backend has no certificate")
+	}
+	fingerprint := sha256.Sum256(rawCerts[0])
+	for _, pin := range b.CertSHA256 {
+		if bytes.Equal(fingerprint[:], pin[:]) {
+			return nil
+		}
+	}
+	return xerrors.Errorf("backend certificate doesn't match pinned fingerprints, sha256: %x", fingerprint)
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestParseCertFingerprint(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	expected := sha256.Sum256([]byte("test"))
+	for _, s := range []string{
+		"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		"9F:86:D0:81:88:4C:7D:65:9A:2F:EA:A0:C5:5A:D0:15:A3:BF:4F:1B:2B:0B:82:2C:D1:5D:6C:15:B0:F0:0A:08",
+	} {
+		res, err := ParseCertFingerprint(s)
+		td.CmpNoError(err, s)
+		td.Cmp(res, expected, s)
+	}
+
+	for _, s := range []string{"", "zz", "9f86d081884c7d659a2feaa0c55ad015"} {
+		_, err := ParseCertFingerprint(s)
+		td.CmpError(err, s)
+	}
+}
+
+func TestTransport_BackendTLS(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	backendAddr := strings.TrimPrefix(backend.URL, "https://")
+
+	do := func(tr Transport) (*http.Response, error) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, backend.URL, nil)
+		req.Host = "example.com"
+		resp, err := tr.RoundTrip(req)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	// self-signed certificate
+	_, err := do(Transport{Pool: &ConnectionPool{}})
+	td.CmpError(err)
+
+	fingerprint := sha256.Sum256(backend.Certificate().Raw)
+	tr := Transport{Pool: &ConnectionPool{}, Backends: map[string]BackendTLS{
+		backendAddr: {ServerName: "backend.internal", CertSHA256: [][sha256.Size]byte{{1}, fingerprint}},
+	}}
+	resp, err := do(tr)
+	td.CmpNoError(err)
+	td.Cmp(resp.StatusCode, http.StatusOK)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, backend.URL, nil)
+	httpTransport := tr.getTransport(req)
+	td.Cmp(httpTransport.TLSClientConfig.ServerName, "backend.internal")
+	td.True(httpTransport.TLSClientConfig.InsecureSkipVerify)
+
+	// wrong pin with ignore cert
+	_, err = do(Transport{IgnoreHTTPSCertificate: true, Backends: map[string]BackendTLS{
+		backendAddr: {CertSHA256: [][sha256.Size]byte{{1}}},
+	}})
+	td.CmpError(err)
+
+	// other backend
+	tr = Transport{ServerName: "default", Backends: map[string]BackendTLS{"127.0.0.1:1": {ServerName: "other"}}}
+	httpTransport = tr.getTransport(req)
+	td.Cmp(httpTransport.TLSClientConfig.ServerName, "default")
+	td.Nil(httpTransport.TLSClientConfig.VerifyPeerCertificate)
+}
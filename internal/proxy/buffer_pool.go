@@ -0,0 +1,34 @@
+package proxy
+
+import "sync"
+
+// BufferPool - pool of buffers for copy response bodies from backends to clients, reused between requests
+// instead of allocate new buffer for every request. It implements httputil.BufferPool.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool create pool of buffers with the size
+func NewBufferPool(size int) *BufferPool {
+	res := &BufferPool{size: size}
+	res.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return res
+}
+
+// Get return buffer from pool or new buffer
+func (p *BufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+// Put return buffer to pool. Buffers of other size, than size of pool, dropped.
+func (p *BufferPool) Put(buf []byte) {
+	if cap(buf) != p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
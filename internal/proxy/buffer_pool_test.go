@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestBufferPool(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	p := NewBufferPool(1024)
+	buf := p.Get()
+	td.Cmp(len(buf), 1024)
+
+	// returned buffer restored to full size
+	p.Put(buf[:10])
+	td.Cmp(len(p.Get()), 1024)
+
+	// foreign buffers dropped
+	p.Put(make([]byte, 10))
+	td.Cmp(len(p.Get()), 1024)
+}
+
+func TestHTTPProxy_BufferPool(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	body := bytes.Repeat([]byte("0123456789"), 100000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/break" {
+			_, _ = w.Write(body[:len(body)/2])
+			panic(http.ErrAbortHandler)
+		}
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+
+	listener := th.NewLocalTcpListener(e)
+	proxy := NewHTTPProxy(e.Ctx, listener)
+	proxy.Director = NewDirectorChain(NewDirectorHost(backend.Listener.Addr().String()), NewSetSchemeDirector(ProtocolHTTP))
+	proxy.BufferPool = NewBufferPool(1024)
+	go func() { _ = proxy.Start() }()
+	defer func() { _ = proxy.Close() }()
+
+	client := http.Client{Timeout: 10 * time.Second}
+	for i := 0; i < 3; i++ {
+		// interrupted copy return buffer to pool too
+		resp, err := client.Get("http://" + listener.Addr().String() + "/break")
+		if err == nil {
+			_, _ = io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+		}
+
+		resp, err = client.Get("http://" + listener.Addr().String() + "/")
+		e.CmpNoError(err)
+		res, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		e.CmpNoError(err)
+		e.True(bytes.Equal(res, body))
+	}
+}
+
+// BenchmarkHTTPProxy_Streaming - copy of streamed responses with and without buffer pool, compare allocations
+// by -benchmem.
+func BenchmarkHTTPProxy_Streaming(b *testing.B) {
+	chunk := bytes.Repeat([]byte("x"), 4096)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 16; i++ {
+			_, _ = w.Write(chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+
+	for _, bench := range []struct {
+		name string
+		pool *BufferPool
+	}{
+		{"without_pool", nil},
+		{"with_pool", NewBufferPool(32 << 10)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			proxy := NewHTTPProxy(zc.WithLogger(context.Background(), zap.NewNop()), listener)
+			proxy.Director = NewDirectorChain(NewDirectorHost(backend.Listener.Addr().String()), NewSetSchemeDirector(ProtocolHTTP))
+			proxy.BufferPool = bench.pool
+			go func() { _ = proxy.Start() }()
+			defer func() { _ = proxy.Close() }()
+
+			client := http.Client{}
+			url := "http://" + listener.Addr().String() + "/"
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Get(url)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				_ = resp.Body.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+// Sources of client certificate, sent to backend in Source claim
+const (
+	ClientCertSourceTLS    = "tls"    // verified by tls handshake with the proxy
+	ClientCertSourceHeader = "header" // passed in header by upstream tls terminator from trusted network
+)
+
+// ClientCertAny - value of ClientCert of rewrite rule, which match requests with any client certificate
+const ClientCertAny = "*"
+
+// ClientCerts detect identity of client by tls client certificate, verified by the proxy or passed in header
+// by upstream tls terminator (mTLS on outer proxy). The header trusted from TrustedNetworks only
+// and removed from requests of other sources.
+type ClientCerts struct {
+	Header          string // header with client certificate from upstream, empty - native tls client certificates only
+	TrustedNetworks []net.IPNet
+
+	// ClaimsHeaderPrefix - prefix of headers with claims of client certificate, sent to backend.
+	// Headers with the prefix removed from all incoming requests. Empty - don't send claims.
+	ClaimsHeaderPrefix string
+
+	RequiredRoutes []route // requests to the routes without client certificate denied
+}
+
+// NewClientCerts validate and parse settings of client certificates
+func NewClientCerts(header string, trustedNetworks []string, claimsHeaderPrefix string, requiredRoutes []string) (*ClientCerts, error) {
+	if header != "" && !httpguts.ValidHeaderFieldName(header) {
+		return nil, xerrors.Errorf("bad client certificate header name: %q", header)
+	}
+	if header != "" && len(trustedNetworks) == 0 {
+		return nil, xerrors.Errorf("client certificate header %q need trusted networks", header)
+	}
+	if header == "" && len(trustedNetworks) > 0 {
+		return nil, xerrors.New("trusted networks of client certificate header without header")
+	}
+	if claimsHeaderPrefix != "" && !httpguts.ValidHeaderFieldName(claimsHeaderPrefix) {
+		return nil, xerrors.Errorf("bad client certificate claims header prefix: %q", claimsHeaderPrefix)
+	}
+	if header != "" && claimsHeaderPrefix != "" && hasHeaderPrefix(header, claimsHeaderPrefix) {
+		return nil, xerrors.Errorf("client certificate header %q has claims header prefix %q", header, claimsHeaderPrefix)
+	}
+
+	res := &ClientCerts{Header: header, ClaimsHeaderPrefix: claimsHeaderPrefix}
+	for _, network := range trustedNetworks {
+		_, parsedNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, xerrors.Errorf("parse trusted network of client certificate header %q: %w", network, err)
+		}
+		res.TrustedNetworks = append(res.TrustedNetworks, *parsedNet)
+	}
+	for _, s := range requiredRoutes {
+		r, err := parseRoute(s)
+		if err != nil {
+			return nil, xerrors.Errorf("client certificate required route: %w", err)
+		}
+		res.RequiredRoutes = append(res.RequiredRoutes, r)
+	}
+	return res, nil
+}
+
+// ClientCertFromContext return client certificate of request or nil if request without client certificate
+func ClientCertFromContext(ctx context.Context) *x509.Certificate {
+	cert, _ := ctx.Value(contextlabel.ClientCertificate).(*x509.Certificate)
+	return cert
+}
+
+// clientCertMatch return true if identity is common name of subject or one of subject alternative names
+// (dns, email or uri) of the certificate. ClientCertAny match any certificate.
+func clientCertMatch(cert *x509.Certificate, identity string) bool {
+	if cert == nil {
+		return false
+	}
+	if identity == ClientCertAny || identity == cert.Subject.CommonName {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(name, identity) {
+			return true
+		}
+	}
+	for _, email := range cert.EmailAddresses {
+		if email == identity {
+			return true
+		}
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClientCertHeader parse certificate in formats of popular tls terminators:
+// pem, url escaped pem (nginx $ssl_client_escaped_cert, aws alb) and base64 of der.
+func parseClientCertHeader(value string) (*x509.Certificate, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "%") {
+		unescaped, err := url.QueryUnescape(value)
+		if err != nil {
+			return nil, xerrors.Errorf("unescape client certificate: %w", err)
+		}
+		value = strings.TrimSpace(unescaped)
+	}
+
+	var der []byte
+	if strings.HasPrefix(value, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(value))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, xerrors.New("no certificate in pem of client certificate")
+		}
+		der = block.Bytes
+	} else {
+		var err error
+		der, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+		if err != nil {
+			return nil, xerrors.Errorf("decode base64 of client certificate: %w", err)
+		}
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, xerrors.Errorf("parse client certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func hasHeaderPrefix(name, prefix string) bool {
+	return len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix)
+}
+
+func (c *ClientCerts) isTrusted(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for i := range c.TrustedNetworks {
+		if c.TrustedNetworks[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setClaims send claims of client certificate to backend in headers with ClaimsHeaderPrefix
+func (c *ClientCerts) setClaims(header http.Header, cert *x509.Certificate, source string) {
+	if c.ClaimsHeaderPrefix == "" {
+		return
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	uris := make([]string, 0, len(cert.URIs))
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+
+	claims := map[string]string{
+		"Subject": cert.Subject.String(),
+		"Issuer":  cert.Issuer.String(),
+		"Serial":  hex.EncodeToString(cert.SerialNumber.Bytes()),
+		"SHA256":  hex.EncodeToString(fingerprint[:]),
+		"DNS":     strings.Join(cert.DNSNames, ","),
+		"Email":   strings.Join(cert.EmailAddresses, ","),
+		"URI":     strings.Join(uris, ","),
+		"Source":  source,
+	}
+	for name, value := range claims {
+		if value != "" {
+			header.Set(c.ClaimsHeaderPrefix+name, value)
+		}
+	}
+}
+
+// withClientCert remove untrusted client certificate headers and spoofed claims, save client certificate
+// to request context and send its claims to backend. Certificate from trusted header has priority over
+// tls client certificate: tls connection from trusted network is connection of upstream terminator.
+func (p *HTTPProxy) withClientCert(r *http.Request) *http.Request {
+	c := p.ClientCert
+	if c == nil {
+		return r
+	}
+
+	if c.ClaimsHeaderPrefix != "" {
+		for name := range r.Header {
+			if hasHeaderPrefix(name, c.ClaimsHeaderPrefix) {
+				delete(r.Header, name)
+			}
+		}
+	}
+
+	var cert *x509.Certificate
+	var source string
+	if c.Header != "" {
+		// check all header values: Get return first value only and empty first value can hide forged second
+		values := r.Header.Values(c.Header)
+		switch {
+		case !c.isTrusted(r.RemoteAddr):
+			if len(values) > 0 {
+				p.logger.Debug("Remove client certificate header from untrusted source", zap.String("remote_addr", r.RemoteAddr))
+			}
+			r.Header.Del(c.Header)
+		case len(values) > 1:
+			p.logger.Warn("Remove multiple client certificate headers", zap.String("remote_addr", r.RemoteAddr),
+				zap.Int("count", len(values)))
+			r.Header.Del(c.Header)
+		case len(values) == 1 && values[0] != "":
+			var err error
+			cert, err = parseClientCertHeader(values[0])
+			if err != nil {
+				p.logger.Warn("Remove bad client certificate header", zap.String("remote_addr", r.RemoteAddr), zap.Error(err))
+				r.Header.Del(c.Header)
+			}
+			source = ClientCertSourceHeader
+		}
+	}
+	if cert == nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cert = r.TLS.VerifiedChains[0][0]
+		source = ClientCertSourceTLS
+	}
+	if cert == nil {
+		return r
+	}
+
+	c.setClaims(r.Header, cert, source)
+	return r.WithContext(context.WithValue(r.Context(), contextlabel.ClientCertificate, cert))
+}
+
+// handleClientCertRequired deny requests without client certificate to RequiredRoutes with 403 status
+func (p *HTTPProxy) handleClientCertRequired(w http.ResponseWriter, r *http.Request) bool {
+	if p.ClientCert == nil || ClientCertFromContext(r.Context()) != nil {
+		return false
+	}
+	for _, requiredRoute := range p.ClientCert.RequiredRoutes {
+		if !requiredRoute.match(r) {
+			continue
+		}
+		p.logger.Info("Deny request without client certificate", zap.String("remote_addr", r.RemoteAddr),
+			zap.String("host", r.Host), zap.String("path", r.URL.Path))
+		if !p.ErrorPages.Write(w, r, http.StatusForbidden) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		return true
+	}
+	return false
+}
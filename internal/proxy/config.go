@@ -2,9 +2,12 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,20 +18,253 @@ import (
 	zc "github.com/rekby/zapcontext"
 )
 
-const defaultHTTPPort = 80
+const (
+	defaultHTTPPort  = 80
+	defaultHTTPSPort = 443
+)
 
 //nolint:lll
 type Config struct {
-	DefaultTarget           string
-	TargetMap               []string
-	Headers                 []string
-	KeepAliveTimeoutSeconds int
-	HTTPSBackend            bool
-	HTTPSBackendIgnoreCert  bool
-	EnableAccessLog         bool
+	DefaultTarget                     string
+	DefaultUpstreamScheme             string
+	DefaultUpstreamHTTPPort           int
+	DefaultUpstreamHTTPSPort          int
+	TargetMap                         []string
+	Headers                           []string
+	KeepAliveTimeoutSeconds           int
+	ReadHeaderTimeoutSeconds          int
+	ReadTimeoutSeconds                int
+	WriteTimeoutSeconds               int
+	HTTPSBackend                      bool
+	HTTPSBackendIgnoreCert            bool
+	HTTPSBackendCAFile                string
+	HTTPSBackendServerName            string
+	HTTPSBackendServerNameMap         []string
+	HTTPSBackendCertPins              []string
+	HTTPSBackendClientCert            string
+	HTTPSBackendClientKey             string
+	BackendHTTP2                      bool
+	BackendMaxIdleConns               int
+	BackendMaxIdleConnsPerHost        int
+	BackendMaxConnsPerHost            int
+	BackendIdleConnTimeoutSeconds     int
+	UpstreamAddressFamily             string
+	BackendDownMode                   string
+	BackendDownRetryTimeoutSeconds    int
+	BackendDownStaleCacheTTLSeconds   int
+	BackendDownStaleCacheMaxEntries   int
+	ResponseCacheRoutes               []string
+	ResponseCacheMaxEntrySizeKB       int
+	ResponseCacheMaxSizeMB            int
+	ResponseCacheMaxTTLSeconds        int
+	RequestCoalescingRoutes           []string
+	RequestCoalescingMaxSizeKB        int
+	RequestCoalescingTimeoutSeconds   int
+	EnableAccessLog                   bool
+	ErrorPages                        []string
+	RequestIDHeader                   string
+	RequestIDAcceptIncoming           bool
+	RequestIDFormat                   string
+	AltSvc                            []string
+	AltSvcMaxAgeSeconds               int
+	HSTSMode                          string
+	HSTSMaxAgeSeconds                 int
+	HSTSIncludeSubDomains             bool
+	PlainHTTPMode                     string
+	FlushIntervalMilliseconds         int
+	BufferPoolSizeKB                  int
+	LoopDetection                     bool
+	LoopDetectionMaxVia               int
+	RouteHostWithPort                 bool
+	AllowedMethods                    []string
+	StreamContentTypes                []string
+	RewriteRules                      []RewriteRuleConfig
+	RetryPolicies                     []RetryPolicyConfig
+	RetryBudgetRatio                  float64
+	RetryBudgetMinRetries             int
+	RetryBudgetWindowSeconds          int
+	ReloadRoutes                      bool
+	ReloadRoutesGracePeriodSeconds    int
+	MaxRequestHeaderBytes             int
+	MaxRequestHeaders                 int
+	DebugCaptureFile                  string
+	DebugCaptureRoutes                []string
+	DebugCaptureMaxBodyBytes          int
+	DebugCaptureRedactHeaders         []string
+	DebugCaptureMaxDurationSeconds    int
+	ExpectContinueMode                string
+	ExpectContinueTimeoutMilliseconds int
+	MissingHostMode                   string
+	MissingHostDefaultHost            string
+	MissingHostBackend                string
+	ClientCertHeader                  string
+	ClientCertTrustedNetworks         []string
+	ClientCertClaimsHeaderPrefix      string
+	ClientCertRequiredRoutes          []string
+	SplitRoutes                       []SplitRouteConfig
 }
 
 func (c *Config) Apply(ctx context.Context, p *HTTPProxy) error {
+	director, resErr := c.GetDirector(ctx)
+	p.EnableAccessLog = c.EnableAccessLog
+
+	errorPages, err := c.getErrorPages(ctx)
+	p.ErrorPages = errorPages
+	if resErr == nil {
+		resErr = err
+	}
+
+	p.RequestIDHeader = c.RequestIDHeader
+	p.RequestIDAcceptIncoming = c.RequestIDAcceptIncoming
+	requestIDGenerator, err := NewRequestIDGenerator(c.RequestIDFormat)
+	if err == nil {
+		p.RequestIDGenerator = requestIDGenerator
+	} else if resErr == nil {
+		resErr = err
+	}
+
+	altSvc, err := NewAltSvc(c.AltSvc, time.Duration(c.AltSvcMaxAgeSeconds)*time.Second)
+	p.AltSvc = altSvc
+	if resErr == nil {
+		resErr = err
+	}
+	zc.L(ctx).Info("Alt-Svc header", zap.String("value", altSvc))
+
+	hstsMaxAge := time.Duration(c.HSTSMaxAgeSeconds) * time.Second
+	if c.HSTSMode == HSTSPreloadReady && hstsMaxAge < HSTSPreloadMinMaxAge {
+		zc.L(ctx).Warn("HSTS max age is less than required for preload list, use preload minimum",
+			zap.Duration("max_age", hstsMaxAge), zap.Duration("preload_min_max_age", HSTSPreloadMinMaxAge))
+	}
+	hsts, err := NewHSTS(c.HSTSMode, hstsMaxAge, c.HSTSIncludeSubDomains)
+	p.HSTS = hsts
+	if resErr == nil {
+		resErr = err
+	}
+	err = checkPlainHTTPMode(c.PlainHTTPMode, c.HSTSMode)
+	p.PlainHTTP = c.PlainHTTPMode
+	if resErr == nil {
+		resErr = err
+	}
+	zc.L(ctx).Info("HSTS header", zap.String("value", hsts), zap.String("plain_http", c.PlainHTTPMode))
+
+	transport, err := c.getTransport(ctx)
+	p.HTTPTransport = transport
+	if resErr == nil {
+		resErr = err
+	}
+
+	backendDown, err := c.getBackendDown(ctx)
+	p.BackendDown = backendDown
+	if resErr == nil {
+		resErr = err
+	}
+
+	responseCache, err := c.getResponseCache(ctx)
+	p.ResponseCache = responseCache
+	if resErr == nil {
+		resErr = err
+	}
+
+	requestCoalescing, err := c.getRequestCoalescing(ctx)
+	p.RequestCoalescing = requestCoalescing
+	if resErr == nil {
+		resErr = err
+	}
+
+	retries, err := c.getRetries(ctx)
+	p.Retries = retries
+	if resErr == nil {
+		resErr = err
+	}
+
+	clientCerts, err := c.getClientCerts(ctx)
+	p.ClientCert = clientCerts
+	if resErr == nil {
+		resErr = err
+	}
+
+	longLived, err := c.getLongLived()
+	p.LongLived = longLived
+	if resErr == nil {
+		resErr = err
+	}
+
+	allowedMethods, err := ParseAllowedMethods(c.AllowedMethods)
+	p.AllowedMethods = allowedMethods
+	if resErr == nil {
+		resErr = err
+	}
+
+	allowedMethodsRules, err := c.GetAllowedMethodsRules()
+	p.AllowedMethodsRules = allowedMethodsRules
+	if resErr == nil {
+		resErr = err
+	}
+
+	splits, err := c.getSplits(ctx)
+	p.Splits = splits
+	if resErr == nil {
+		resErr = err
+	}
+
+	if c.ReloadRoutesGracePeriodSeconds < 0 && resErr == nil {
+		resErr = fmt.Errorf("negative reload routes grace period: %v", c.ReloadRoutesGracePeriodSeconds)
+	}
+
+	if (c.KeepAliveTimeoutSeconds < 0 || c.ReadHeaderTimeoutSeconds < 0 || c.ReadTimeoutSeconds < 0 ||
+		c.WriteTimeoutSeconds < 0) && resErr == nil {
+		resErr = fmt.Errorf("negative timeout, keep alive: %v, read header: %v, read: %v, write: %v",
+			c.KeepAliveTimeoutSeconds, c.ReadHeaderTimeoutSeconds, c.ReadTimeoutSeconds, c.WriteTimeoutSeconds)
+	}
+
+	if c.LoopDetectionMaxVia < 0 && resErr == nil {
+		resErr = fmt.Errorf("negative loop detection max via: %v", c.LoopDetectionMaxVia)
+	}
+
+	if c.BufferPoolSizeKB < 0 && resErr == nil {
+		resErr = fmt.Errorf("negative buffer pool size: %v", c.BufferPoolSizeKB)
+	}
+
+	if (c.MaxRequestHeaderBytes < 0 || c.MaxRequestHeaders < 0) && resErr == nil {
+		resErr = fmt.Errorf("negative request headers limit, bytes: %v, count: %v", c.MaxRequestHeaderBytes, c.MaxRequestHeaders)
+	}
+
+	answerExpectContinue, err := c.getAnswerExpectContinue()
+	if resErr == nil {
+		resErr = err
+	}
+
+	if resErr != nil {
+		zc.L(ctx).Error("Can't parse proxy config", zap.Error(resErr))
+		return resErr
+	}
+
+	p.Director = director
+	if c.ReloadRoutes {
+		p.Director = NewReloadableDirector(director, allowedMethodsRules)
+	}
+	p.IdleTimeout = time.Duration(c.KeepAliveTimeoutSeconds) * time.Second
+	p.ReadHeaderTimeout = time.Duration(c.ReadHeaderTimeoutSeconds) * time.Second
+	p.ReadTimeout = time.Duration(c.ReadTimeoutSeconds) * time.Second
+	p.WriteTimeout = time.Duration(c.WriteTimeoutSeconds) * time.Second
+	p.MaxHeaderBytes = c.MaxRequestHeaderBytes
+	p.MaxHeaders = c.MaxRequestHeaders
+	p.AnswerExpectContinue = answerExpectContinue
+	p.MissingHost = c.MissingHostMode
+	p.FlushInterval = time.Duration(c.FlushIntervalMilliseconds) * time.Millisecond
+	if c.BufferPoolSizeKB > 0 {
+		p.BufferPool = NewBufferPool(c.BufferPoolSizeKB << 10)
+	}
+	if c.LoopDetection {
+		p.LoopDetection = NewLoopDetection(c.LoopDetectionMaxVia)
+	}
+	p.RouteHostWithPort = c.RouteHostWithPort
+	p.StreamContentTypes = NewStreamContentTypes(c.StreamContentTypes)
+	return nil
+}
+
+// GetDirector create routes of requests to backends from config
+func (c *Config) GetDirector(ctx context.Context) (Director, error) {
 	var resErr error
 
 	var chain []Director
@@ -46,18 +282,32 @@ func (c *Config) Apply(ctx context.Context, p *HTTPProxy) error {
 	appendDirector(c.getMapDirector)
 	appendDirector(c.getHeadersDirector)
 	appendDirector(c.getSchemaDirector)
-	p.HTTPTransport = Transport{c.HTTPSBackendIgnoreCert}
-	p.EnableAccessLog = c.EnableAccessLog
-
+	appendDirector(c.getRewriteDirector)
 	if resErr != nil {
-		zc.L(ctx).Error("Can't parse proxy config", zap.Error(resErr))
-		return resErr
+		return nil, resErr
 	}
+	return c.wrapMissingHostDirector(ctx, NewDirectorChain(chain...))
+}
 
-	chainDirector := NewDirectorChain(chain...)
-	p.Director = chainDirector
-	p.IdleTimeout = time.Duration(c.KeepAliveTimeoutSeconds) * time.Second
-	return nil
+// wrapMissingHostDirector decide host of requests without it before routes
+func (c *Config) wrapMissingHostDirector(ctx context.Context, next Director) (Director, error) {
+	err := checkMissingHostMode(c.MissingHostMode, c.MissingHostDefaultHost, c.MissingHostBackend)
+	if err != nil {
+		return nil, err
+	}
+
+	res := DirectorMissingHost{Next: next}
+	switch c.MissingHostMode {
+	case MissingHostDefaultHost:
+		res.DefaultHost = c.MissingHostDefaultHost
+	case MissingHostDefaultBackend:
+		res.Backend = c.MissingHostBackend
+	default:
+		return next, nil
+	}
+	zc.L(ctx).Info("Missing host mode", zap.String("mode", c.MissingHostMode),
+		zap.String("default_host", res.DefaultHost), zap.String("backend", res.Backend))
+	return res, nil
 }
 
 func (c *Config) getDefaultTargetDirector(ctx context.Context) (Director, error) {
@@ -68,17 +318,26 @@ func (c *Config) getDefaultTargetDirector(ctx context.Context) (Director, error)
 	if s == "" {
 		return nil, errors.New("empty default target")
 	}
-	defaultTarget, err := net.ResolveTCPAddr("tcp", c.DefaultTarget)
+	family, err := ParseAddressFamily(c.UpstreamAddressFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultTarget, err = family.resolveTCPAddr(c.DefaultTarget)
 	logger.Debug("Parse default target as tcp address", zap.Stringer("default_target", defaultTarget), zap.Error(err))
 
 	if err != nil {
-		defaultTargetIP, err := net.ResolveIPAddr("ip", c.DefaultTarget)
+		defaultTargetIP, err := family.resolveIPAddr(c.DefaultTarget)
 		logger.Debug("Parse default target as ip address", zap.Stringer("default_target", defaultTarget), zap.Error(err))
 		if err != nil {
 			logger.Error("Error parse default target address")
 			return nil, err
 		}
-		defaultTarget = &net.TCPAddr{IP: defaultTargetIP.IP, Port: defaultHTTPPort}
+		upstream, err := c.getUpstreamDefaults()
+		if err != nil {
+			return nil, err
+		}
+		defaultTarget = &net.TCPAddr{IP: defaultTargetIP.IP, Port: upstream.port(upstream.scheme)}
 	}
 
 	if len(defaultTarget.IP) == 0 {
@@ -114,6 +373,34 @@ func (c *Config) getHeadersDirector(ctx context.Context) (Director, error) {
 	return NewDirectorSetHeaders(m), nil
 }
 
+// can return nil, nil
+func (c *Config) getErrorPages(ctx context.Context) (*ErrorPages, error) {
+	logger := zc.L(ctx)
+	if len(c.ErrorPages) == 0 {
+		return nil, nil
+	}
+
+	sources := make(map[int]string)
+	for _, line := range c.ErrorPages {
+		lineParts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(lineParts) != 2 {
+			logger.Error("Can't split error page line to parts", zap.String("line", line))
+			return nil, errors.New("can't parse error pages proxy config")
+		}
+		statusCode, err := strconv.Atoi(lineParts[0])
+		// 403 - for domains, denied by OnDomainDenied = "http_deny"
+		if err != nil || (statusCode != http.StatusForbidden && (statusCode < 500 || statusCode > 599)) {
+			logger.Error("Bad status code for error page", zap.String("line", line))
+			return nil, fmt.Errorf("bad status code for error page: %q", lineParts[0])
+		}
+		sources[statusCode] = strings.TrimSpace(lineParts[1])
+	}
+
+	pages, err := NewErrorPages(sources)
+	log.InfoError(logger, err, "Load error pages", zap.Any("pages", sources))
+	return pages, err
+}
+
 // can return nil, nil
 func (c *Config) getMapDirector(ctx context.Context) (Director, error) {
 	logger := zc.L(ctx)
@@ -121,9 +408,14 @@ func (c *Config) getMapDirector(ctx context.Context) (Director, error) {
 		return nil, nil
 	}
 
+	family, err := ParseAddressFamily(c.UpstreamAddressFamily)
+	if err != nil {
+		return nil, err
+	}
+
 	m := make(map[string]string)
 	for _, line := range c.TargetMap {
-		from, to, err := parseTCPMapPair(line)
+		from, to, err := parseTCPMapPair(line, family)
 		log.DebugError(logger, err, "Parse target map", zap.String("line", line),
 			zap.String("from", from), zap.String("to", to))
 		if err != nil {
@@ -137,13 +429,384 @@ func (c *Config) getMapDirector(ctx context.Context) (Director, error) {
 }
 
 func (c *Config) getSchemaDirector(ctx context.Context) (Director, error) {
-	if c.HTTPSBackend {
-		return NewSetSchemeDirector(ProtocolHTTPS), nil
+	upstream, err := c.getUpstreamDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return NewSetSchemeDirector(upstream.scheme), nil
+}
+
+// getUpstreamDefaults return scheme and ports of upstream targets without them.
+// Default scheme is https for HTTPSBackend = true, else http.
+func (c *Config) getUpstreamDefaults() (upstreamDefaults, error) {
+	res := upstreamDefaults{
+		scheme:    strings.ToLower(strings.TrimSpace(c.DefaultUpstreamScheme)),
+		httpPort:  c.DefaultUpstreamHTTPPort,
+		httpsPort: c.DefaultUpstreamHTTPSPort,
+	}
+	switch res.scheme {
+	case "":
+		res.scheme = ProtocolHTTP
+		if c.HTTPSBackend {
+			res.scheme = ProtocolHTTPS
+		}
+	case ProtocolHTTP:
+		if c.HTTPSBackend {
+			return res, errors.New("DefaultUpstreamScheme = \"http\" conflicts with HTTPSBackend = true")
+		}
+	case ProtocolHTTPS:
+	default:
+		return res, fmt.Errorf("bad DefaultUpstreamScheme, expected http or https: %q", c.DefaultUpstreamScheme)
+	}
+
+	if res.httpPort == 0 {
+		res.httpPort = defaultHTTPPort
+	}
+	if res.httpsPort == 0 {
+		res.httpsPort = defaultHTTPSPort
+	}
+	for _, port := range []int{res.httpPort, res.httpsPort} {
+		if port < 1 || port > 65535 {
+			return res, fmt.Errorf("bad default upstream port: %v", port)
+		}
+	}
+	return res, nil
+}
+
+// upstreamRewriteRules return rewrite rules with backends, completed by default upstream port.
+// Rules of fastcgi backends returned without change.
+func (c *Config) upstreamRewriteRules() ([]RewriteRuleConfig, error) {
+	upstream, err := c.getUpstreamDefaults()
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]RewriteRuleConfig, len(c.RewriteRules))
+	for i, rule := range c.RewriteRules {
+		if rule.Backend != "" && rule.UpstreamProto == "" && !strings.HasPrefix(rule.Backend, fastCGIUnixPrefix) {
+			rule.Backend, err = upstream.complete(rule.Backend)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite rule %q: %w", rule.Route, err)
+			}
+		}
+		rules[i] = rule
+	}
+	return rules, nil
+}
+
+func (c *Config) newDirectorRewrite() (DirectorRewrite, error) {
+	rules, err := c.upstreamRewriteRules()
+	if err != nil {
+		return nil, err
 	}
-	return NewSetSchemeDirector(ProtocolHTTP), nil
+	return NewDirectorRewrite(rules)
+}
+
+// can return nil, nil
+func (c *Config) getRewriteDirector(ctx context.Context) (Director, error) {
+	if len(c.RewriteRules) == 0 {
+		return nil, nil
+	}
+
+	director, err := c.newDirectorRewrite()
+	log.InfoError(zc.L(ctx), err, "Create rewrite director", zap.Any("rules", c.RewriteRules))
+	if err != nil {
+		return nil, err
+	}
+	return director, nil
+}
+
+func (c *Config) getTransport(ctx context.Context) (Transport, error) {
+	logger := zc.L(ctx)
+
+	transport := Transport{
+		IgnoreHTTPSCertificate: c.HTTPSBackendIgnoreCert,
+		ServerName:             c.HTTPSBackendServerName,
+		HTTP2:                  c.BackendHTTP2,
+	}
+
+	family, err := ParseAddressFamily(c.UpstreamAddressFamily)
+	if err != nil {
+		return Transport{}, err
+	}
+	transport.AddressFamily = family
+
+	transport.Backends, err = c.getBackendsTLS(ctx, family)
+	if err != nil {
+		return Transport{}, err
+	}
+
+	pool, err := c.getConnectionPool(ctx)
+	if err != nil {
+		return Transport{}, err
+	}
+	transport.Pool = pool
+
+	if c.ExpectContinueTimeoutMilliseconds < 0 {
+		return Transport{}, fmt.Errorf("negative expect continue timeout: %v", c.ExpectContinueTimeoutMilliseconds)
+	}
+	transport.ExpectContinueTimeout = time.Duration(c.ExpectContinueTimeoutMilliseconds) * time.Millisecond
+
+	if c.HTTPSBackend && c.HTTPSBackendIgnoreCert {
+		logger.Warn("INSECURE: backend https certificate validation disabled by HTTPSBackendIgnoreCert. " +
+			"Connections to backend can be intercepted.")
+	}
+
+	if c.HTTPSBackendCAFile != "" {
+		if c.HTTPSBackendIgnoreCert {
+			return Transport{}, errors.New("HTTPSBackendCAFile can't be used with HTTPSBackendIgnoreCert = true")
+		}
+		transport.RootCAs, err = loadBackendCA(c.HTTPSBackendCAFile)
+		log.DebugError(logger, err, "Load backend CA file", zap.String("file", c.HTTPSBackendCAFile))
+		if err != nil {
+			return Transport{}, err
+		}
+	}
+
+	if c.HTTPSBackendClientCert != "" || c.HTTPSBackendClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.HTTPSBackendClientCert, c.HTTPSBackendClientKey)
+		log.DebugError(logger, err, "Load backend client certificate",
+			zap.String("cert", c.HTTPSBackendClientCert), zap.String("key", c.HTTPSBackendClientKey))
+		if err != nil {
+			return Transport{}, fmt.Errorf("load backend client certificate: %w", err)
+		}
+		transport.ClientCertificates = []tls.Certificate{cert}
+	}
+
+	return transport, nil
+}
+
+// getBackendsTLS return tls settings of backends from HTTPSBackendServerNameMap and HTTPSBackendCertPins,
+// lines in format "<backend address>-<value>". Return nil map if no settings.
+func (c *Config) getBackendsTLS(ctx context.Context, family AddressFamily) (map[string]BackendTLS, error) {
+	if len(c.HTTPSBackendServerNameMap) == 0 && len(c.HTTPSBackendCertPins) == 0 {
+		return nil, nil
+	}
+
+	logger := zc.L(ctx)
+	res := make(map[string]BackendTLS)
+	parseLine := func(line string) (string, string, error) {
+		lineParts := strings.SplitN(strings.TrimSpace(line), "-", 2)
+		if len(lineParts) != 2 || strings.TrimSpace(lineParts[1]) == "" {
+			return "", "", fmt.Errorf("can't split backend tls line to address and value: %q", line)
+		}
+		addr, err := family.resolveTCPAddr(lineParts[0])
+		if err != nil {
+			return "", "", fmt.Errorf("backend address can't resolve: %w", err)
+		}
+		if len(addr.IP) == 0 {
+			return "", "", fmt.Errorf("backend address has no ip: %q", line)
+		}
+		return addr.String(), strings.TrimSpace(lineParts[1]), nil
+	}
+
+	for _, line := range c.HTTPSBackendServerNameMap {
+		backend, serverName, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		backendTLS := res[backend]
+		backendTLS.ServerName = serverName
+		res[backend] = backendTLS
+	}
+
+	for _, line := range c.HTTPSBackendCertPins {
+		backend, pin, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		fingerprint, err := ParseCertFingerprint(pin)
+		if err != nil {
+			return nil, err
+		}
+		backendTLS := res[backend]
+		backendTLS.CertSHA256 = append(backendTLS.CertSHA256, fingerprint)
+		res[backend] = backendTLS
+	}
+
+	logger.Info("Backends tls settings", zap.Any("backends", res))
+	return res, nil
+}
+
+func (c *Config) getConnectionPool(ctx context.Context) (*ConnectionPool, error) {
+	if c.BackendMaxIdleConns < 0 || c.BackendMaxIdleConnsPerHost < 0 || c.BackendMaxConnsPerHost < 0 ||
+		c.BackendIdleConnTimeoutSeconds < 0 {
+		return nil, errors.New("backend connection pool settings must be non negative")
+	}
+
+	pool := &ConnectionPool{
+		MaxIdleConns:        c.BackendMaxIdleConns,
+		MaxIdleConnsPerHost: c.BackendMaxIdleConnsPerHost,
+		MaxConnsPerHost:     c.BackendMaxConnsPerHost,
+		IdleConnTimeout:     time.Duration(c.BackendIdleConnTimeoutSeconds) * time.Second,
+	}
+
+	zc.L(ctx).Info("Backend connection pool", zap.Int("max_idle_conns", pool.MaxIdleConns),
+		zap.Int("max_idle_conns_per_host", pool.MaxIdleConnsPerHost), zap.Int("max_conns_per_host", pool.MaxConnsPerHost),
+		zap.Duration("idle_conn_timeout", pool.IdleConnTimeout))
+	return pool, nil
+}
+
+func (c *Config) getBackendDown(ctx context.Context) (*BackendDown, error) {
+	mode, err := ParseBackendDownMode(c.BackendDownMode)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &BackendDown{Mode: mode}
+	switch mode {
+	case BackendDownRetry:
+		if c.BackendDownRetryTimeoutSeconds <= 0 {
+			return nil, errors.New("backend down retry timeout must be positive")
+		}
+		res.RetryTimeout = time.Duration(c.BackendDownRetryTimeoutSeconds) * time.Second
+	case BackendDownStaleCache:
+		if c.BackendDownStaleCacheTTLSeconds <= 0 || c.BackendDownStaleCacheMaxEntries <= 0 {
+			return nil, errors.New("backend down stale cache ttl and max entries must be positive")
+		}
+		res.StaleCache = NewStaleCache(time.Duration(c.BackendDownStaleCacheTTLSeconds)*time.Second,
+			c.BackendDownStaleCacheMaxEntries)
+	}
+
+	zc.L(ctx).Info("Backend down mode", zap.String("mode", string(mode)), zap.Duration("retry_timeout", res.RetryTimeout))
+	return res, nil
+}
+
+// getAnswerExpectContinue return true if proxy answer 100 Continue itself
+func (c *Config) getAnswerExpectContinue() (bool, error) {
+	switch c.ExpectContinueMode {
+	case ExpectContinueBackend, "":
+		return false, nil
+	case ExpectContinueProxy:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown expect continue mode: %q", c.ExpectContinueMode)
+	}
+}
+
+// can return nil, nil
+// GetDebugCapture create capture of exchanges with backends, nil if DebugCaptureFile is empty.
+// It created separately from Apply: its handler registered before create proxy.
+func (c *Config) GetDebugCapture(ctx context.Context) (*DebugCapture, error) {
+	if c.DebugCaptureFile == "" {
+		return nil, nil
+	}
+	if c.DebugCaptureMaxBodyBytes < 0 || c.DebugCaptureMaxDurationSeconds <= 0 {
+		return nil, fmt.Errorf("debug capture max body bytes must be non negative and max duration must be positive, got: %v, %v",
+			c.DebugCaptureMaxBodyBytes, c.DebugCaptureMaxDurationSeconds)
+	}
+
+	capture, err := NewDebugCapture(c.DebugCaptureFile, c.DebugCaptureRoutes, c.DebugCaptureRedactHeaders,
+		int64(c.DebugCaptureMaxBodyBytes), time.Duration(c.DebugCaptureMaxDurationSeconds)*time.Second)
+	log.InfoError(zc.L(ctx), err, "Create debug capture", zap.String("file", c.DebugCaptureFile),
+		zap.Strings("routes", c.DebugCaptureRoutes), zap.Int("max_body_bytes", c.DebugCaptureMaxBodyBytes),
+		zap.Strings("redact_headers", c.DebugCaptureRedactHeaders))
+	return capture, err
+}
+
+func (c *Config) getResponseCache(ctx context.Context) (*ResponseCache, error) {
+	if len(c.ResponseCacheRoutes) == 0 {
+		return nil, nil
+	}
+	if c.ResponseCacheMaxEntrySizeKB <= 0 || c.ResponseCacheMaxSizeMB <= 0 || c.ResponseCacheMaxTTLSeconds <= 0 {
+		return nil, errors.New("response cache max entry size, max size and max ttl must be positive")
+	}
+
+	cache, err := NewResponseCache(c.ResponseCacheRoutes, int64(c.ResponseCacheMaxEntrySizeKB)<<10,
+		int64(c.ResponseCacheMaxSizeMB)<<20, time.Duration(c.ResponseCacheMaxTTLSeconds)*time.Second)
+	log.InfoError(zc.L(ctx), err, "Create response cache", zap.Strings("routes", c.ResponseCacheRoutes),
+		zap.Int("max_entry_size_kb", c.ResponseCacheMaxEntrySizeKB), zap.Int("max_size_mb", c.ResponseCacheMaxSizeMB),
+		zap.Int("max_ttl_seconds", c.ResponseCacheMaxTTLSeconds))
+	return cache, err
+}
+
+func (c *Config) getRequestCoalescing(ctx context.Context) (*RequestCoalescing, error) {
+	if len(c.RequestCoalescingRoutes) == 0 {
+		return nil, nil
+	}
+	if c.RequestCoalescingMaxSizeKB <= 0 || c.RequestCoalescingTimeoutSeconds <= 0 {
+		return nil, errors.New("request coalescing max size and timeout must be positive")
+	}
+
+	coalescing, err := NewRequestCoalescing(c.RequestCoalescingRoutes, int64(c.RequestCoalescingMaxSizeKB)<<10,
+		time.Duration(c.RequestCoalescingTimeoutSeconds)*time.Second)
+	log.InfoError(zc.L(ctx), err, "Create request coalescing", zap.Strings("routes", c.RequestCoalescingRoutes),
+		zap.Int("max_size_kb", c.RequestCoalescingMaxSizeKB),
+		zap.Int("timeout_seconds", c.RequestCoalescingTimeoutSeconds))
+	return coalescing, err
+}
+
+// can return nil, nil
+func (c *Config) getRetries(ctx context.Context) (*Retries, error) {
+	if len(c.RetryPolicies) == 0 {
+		return nil, nil
+	}
+
+	budget := &RetryBudget{Ratio: c.RetryBudgetRatio, MinRetries: c.RetryBudgetMinRetries,
+		Window: time.Duration(c.RetryBudgetWindowSeconds) * time.Second}
+	retries, err := NewRetries(c.RetryPolicies, budget)
+	log.InfoError(zc.L(ctx), err, "Create retries", zap.Any("policies", c.RetryPolicies),
+		zap.Float64("budget_ratio", budget.Ratio), zap.Int("budget_min_retries", budget.MinRetries),
+		zap.Duration("budget_window", budget.Window))
+	return retries, err
+}
+
+// can return nil, nil
+func (c *Config) getClientCerts(ctx context.Context) (*ClientCerts, error) {
+	rewriteByClientCert := false
+	for _, rule := range c.RewriteRules {
+		rewriteByClientCert = rewriteByClientCert || rule.ClientCert != ""
+	}
+	if c.ClientCertHeader == "" && len(c.ClientCertTrustedNetworks) == 0 && c.ClientCertClaimsHeaderPrefix == "" &&
+		len(c.ClientCertRequiredRoutes) == 0 && !rewriteByClientCert {
+		return nil, nil
+	}
+
+	clientCerts, err := NewClientCerts(c.ClientCertHeader, c.ClientCertTrustedNetworks, c.ClientCertClaimsHeaderPrefix,
+		c.ClientCertRequiredRoutes)
+	log.InfoError(zc.L(ctx), err, "Create client certificates", zap.String("header", c.ClientCertHeader),
+		zap.Strings("trusted_networks", c.ClientCertTrustedNetworks),
+		zap.String("claims_header_prefix", c.ClientCertClaimsHeaderPrefix),
+		zap.Strings("required_routes", c.ClientCertRequiredRoutes))
+	return clientCerts, err
+}
+
+// getLongLived return rewrite rules for detect long-lived routes, nil if rules without long-lived routes.
+// Errors of rules logged by getRewriteDirector.
+// can return nil, nil
+func (c *Config) getLongLived() (DirectorRewrite, error) {
+	for _, rule := range c.RewriteRules {
+		if rule.LongLived {
+			return c.newDirectorRewrite()
+		}
+	}
+	return nil, nil
+}
+
+// GetAllowedMethodsRules return rewrite rules for detect allowed methods of routes, nil if rules without
+// allowed methods. Errors of rules logged by getRewriteDirector.
+// can return nil, nil
+func (c *Config) GetAllowedMethodsRules() (DirectorRewrite, error) {
+	for _, rule := range c.RewriteRules {
+		if len(rule.AllowedMethods) > 0 {
+			return c.newDirectorRewrite()
+		}
+	}
+	return nil, nil
+}
+
+// can return nil, nil
+func (c *Config) getSplits(ctx context.Context) (Splits, error) {
+	if len(c.SplitRoutes) == 0 {
+		return nil, nil
+	}
+
+	splits, err := NewSplits(c.SplitRoutes)
+	log.InfoError(zc.L(ctx), err, "Create split routes", zap.Any("split_routes", c.SplitRoutes))
+	return splits, err
 }
 
-func parseTCPMapPair(line string) (from, to string, err error) {
+// parseTCPMapPair parse "from-to" pair. Address "to" resolved with the family preference.
+func parseTCPMapPair(line string, family AddressFamily) (from, to string, err error) {
 	line = strings.TrimSpace(line)
 	lineParts := strings.Split(line, "-")
 	if len(lineParts) != 2 {
@@ -156,7 +819,7 @@ func parseTCPMapPair(line string) (from, to string, err error) {
 	if len(fromTCP.IP) == 0 {
 		return "", "", errors.New("from addr has no ip")
 	}
-	toTCP, err := net.ResolveTCPAddr("tcp", lineParts[1])
+	toTCP, err := family.resolveTCPAddr(lineParts[1])
 	if err != nil {
 		return "", "", fmt.Errorf("to line can't resolve addr: %v", err.Error())
 	}
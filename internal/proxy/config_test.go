@@ -1,9 +1,15 @@
 package proxy
 
 import (
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
 
 	"github.com/maxatome/go-testdeep"
 )
@@ -13,47 +19,47 @@ func TestParseTcpMapPair(t *testing.T) {
 	var from, to string
 	var err error
 
-	from, to, err = parseTCPMapPair("")
+	from, to, err = parseTCPMapPair("", AddressFamilyAny)
 	td.CmpDeeply(from, "")
 	td.CmpDeeply(to, "")
 	td.CmpError(err)
 
-	from, to, err = parseTCPMapPair("a-b")
+	from, to, err = parseTCPMapPair("a-b", AddressFamilyAny)
 	td.CmpDeeply(from, "")
 	td.CmpDeeply(to, "")
 	td.CmpError(err)
 
-	from, to, err = parseTCPMapPair(":123-b")
+	from, to, err = parseTCPMapPair(":123-b", AddressFamilyAny)
 	td.CmpDeeply(from, "")
 	td.CmpDeeply(to, "")
 	td.CmpError(err)
 
-	from, to, err = parseTCPMapPair("1.2.3.4-b")
+	from, to, err = parseTCPMapPair("1.2.3.4-b", AddressFamilyAny)
 	td.CmpDeeply(from, "")
 	td.CmpDeeply(to, "")
 	td.CmpError(err)
 
-	from, to, err = parseTCPMapPair("1.2.3.4:123-b")
+	from, to, err = parseTCPMapPair("1.2.3.4:123-b", AddressFamilyAny)
 	td.CmpDeeply(from, "")
 	td.CmpDeeply(to, "")
 	td.CmpError(err)
 
-	from, to, err = parseTCPMapPair("1.2.3.4:123-2.2.2.2")
+	from, to, err = parseTCPMapPair("1.2.3.4:123-2.2.2.2", AddressFamilyAny)
 	td.CmpDeeply(from, "")
 	td.CmpDeeply(to, "")
 	td.CmpError(err)
 
-	from, to, err = parseTCPMapPair("1.2.3.4:123-:456")
+	from, to, err = parseTCPMapPair("1.2.3.4:123-:456", AddressFamilyAny)
 	td.CmpDeeply(from, "")
 	td.CmpDeeply(to, "")
 	td.CmpError(err)
 
-	from, to, err = parseTCPMapPair("1.2.3.4:123-2.2.2.2:456")
+	from, to, err = parseTCPMapPair("1.2.3.4:123-2.2.2.2:456", AddressFamilyAny)
 	td.CmpDeeply(from, "1.2.3.4:123")
 	td.CmpDeeply(to, "2.2.2.2:456")
 	td.CmpNoError(err)
 
-	from, to, err = parseTCPMapPair("[::1]:123-[::2]:456")
+	from, to, err = parseTCPMapPair("[::1]:123-[::2]:456", AddressFamilyAny)
 	td.CmpDeeply(from, "[::1]:123")
 	td.CmpDeeply(to, "[::2]:456")
 	td.CmpNoError(err)
@@ -109,6 +115,22 @@ func TestConfig_getDefaultTargetDirector(t *testing.T) {
 	director, err = c.getDefaultTargetDirector(ctx)
 	td.CmpDeeply(director, NewDirectorHost("1.2.3.4:555"))
 	td.CmpNoError(err)
+
+	c = Config{
+		DefaultTarget:            "1.2.3.4",
+		DefaultUpstreamScheme:    "https",
+		DefaultUpstreamHTTPSPort: 8443,
+	}
+	director, err = c.getDefaultTargetDirector(ctx)
+	td.CmpDeeply(director, NewDirectorHost("1.2.3.4:8443"))
+	td.CmpNoError(err)
+
+	c = Config{
+		DefaultTarget:         "1.2.3.4",
+		DefaultUpstreamScheme: "ftp",
+	}
+	_, err = c.getDefaultTargetDirector(ctx)
+	td.CmpError(err)
 }
 
 func TestConfig_getHeadersDirector(t *testing.T) {
@@ -223,6 +245,23 @@ func TestConfig_getSchemeDirector(t *testing.T) {
 	director, err = c.getSchemaDirector(ctx)
 	td.CmpNoError(err)
 	td.CmpDeeply(director, NewSetSchemeDirector(ProtocolHTTPS))
+
+	c = &Config{
+		DefaultUpstreamScheme: "HTTPS",
+	}
+	director, err = c.getSchemaDirector(ctx)
+	td.CmpNoError(err)
+	td.CmpDeeply(director, NewSetSchemeDirector(ProtocolHTTPS))
+
+	for _, c = range []*Config{
+		{DefaultUpstreamScheme: "http", HTTPSBackend: true},
+		{DefaultUpstreamScheme: "ws"},
+		{DefaultUpstreamHTTPPort: 70000},
+		{DefaultUpstreamHTTPSPort: -1},
+	} {
+		_, err = c.getSchemaDirector(ctx)
+		td.CmpError(err, "%#v", c)
+	}
 }
 
 func TestConfig_Apply(t *testing.T) {
@@ -290,3 +329,497 @@ func TestConfig_Apply(t *testing.T) {
 	transport = p.HTTPTransport.(Transport)
 	transport.IgnoreHTTPSCertificate = true
 }
+
+func TestConfig_getTransport(t *testing.T) {
+	e, ctx, cancel := th.NewEnv(t)
+	defer cancel()
+
+	td := testdeep.NewT(t)
+	tmpDir := th.TmpDir(e)
+
+	certFile := filepath.Join(tmpDir, "cert.pem")
+	keyFile := filepath.Join(tmpDir, "key.pem")
+	badFile := filepath.Join(tmpDir, "bad.pem")
+	td.CmpNoError(ioutil.WriteFile(certFile, testcert.LocalhostCert, 0600))
+	td.CmpNoError(ioutil.WriteFile(keyFile, testcert.LocalhostKey, 0600))
+	td.CmpNoError(ioutil.WriteFile(badFile, []byte("asd"), 0600))
+
+	c := Config{HTTPSBackendIgnoreCert: true, HTTPSBackendServerName: "backend"}
+	transport, err := c.getTransport(ctx)
+	td.CmpNoError(err)
+	td.CmpDeeply(transport, Transport{IgnoreHTTPSCertificate: true, ServerName: "backend", Pool: &ConnectionPool{}, AddressFamily: AddressFamilyAny})
+
+	c = Config{BackendMaxIdleConns: 10, BackendMaxIdleConnsPerHost: 5, BackendMaxConnsPerHost: 7, BackendIdleConnTimeoutSeconds: 3}
+	transport, err = c.getTransport(ctx)
+	td.CmpNoError(err)
+	td.CmpDeeply(transport.Pool, &ConnectionPool{MaxIdleConns: 10, MaxIdleConnsPerHost: 5, MaxConnsPerHost: 7, IdleConnTimeout: 3 * time.Second})
+
+	c = Config{BackendMaxConnsPerHost: -1}
+	_, err = c.getTransport(ctx)
+	td.CmpError(err)
+
+	c = Config{UpstreamAddressFamily: "ipv6-only"}
+	transport, err = c.getTransport(ctx)
+	td.CmpNoError(err)
+	td.Cmp(transport.AddressFamily, AddressFamilyIPv6Only)
+
+	c = Config{ExpectContinueTimeoutMilliseconds: 300}
+	transport, err = c.getTransport(ctx)
+	td.CmpNoError(err)
+	td.Cmp(transport.ExpectContinueTimeout, 300*time.Millisecond)
+
+	c = Config{ExpectContinueTimeoutMilliseconds: -1}
+	_, err = c.getTransport(ctx)
+	td.CmpError(err)
+
+	c = Config{UpstreamAddressFamily: "bad"}
+	_, err = c.getTransport(ctx)
+	td.CmpError(err)
+
+	c = Config{HTTPSBackendIgnoreCert: true, HTTPSBackendCAFile: certFile}
+	_, err = c.getTransport(ctx)
+	td.CmpError(err)
+
+	c = Config{HTTPSBackendCAFile: badFile}
+	_, err = c.getTransport(ctx)
+	td.CmpError(err)
+
+	c = Config{HTTPSBackendCAFile: filepath.Join(tmpDir, "not-exist.pem")}
+	_, err = c.getTransport(ctx)
+	td.CmpError(err)
+
+	c = Config{HTTPSBackendCAFile: certFile}
+	transport, err = c.getTransport(ctx)
+	td.CmpNoError(err)
+	td.NotNil(transport.RootCAs)
+
+	c = Config{HTTPSBackendClientCert: certFile}
+	_, err = c.getTransport(ctx)
+	td.CmpError(err)
+
+	c = Config{HTTPSBackendClientCert: certFile, HTTPSBackendClientKey: keyFile}
+	transport, err = c.getTransport(ctx)
+	td.CmpNoError(err)
+	td.Len(transport.ClientCertificates, 1)
+}
+
+func TestConfig_getErrorPages(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	c := &Config{}
+	pages, err := c.getErrorPages(ctx)
+	td.Nil(pages)
+	td.CmpNoError(err)
+
+	for _, line := range []string{"asd", "asd:https://example.com", "404:https://example.com", "502:/not-exist.html"} {
+		c = &Config{ErrorPages: []string{line}}
+		pages, err = c.getErrorPages(ctx)
+		td.Nil(pages, line)
+		td.CmpError(err, line)
+	}
+
+	c = &Config{ErrorPages: []string{"502:https://example.com/502", " 504: https://example.com/504", "403:https://example.com/denied"}}
+	pages, err = c.getErrorPages(ctx)
+	td.CmpNoError(err)
+	td.Cmp(pages.sources, map[int]string{502: "https://example.com/502", 504: "https://example.com/504", 403: "https://example.com/denied"})
+}
+
+func TestConfig_getBackendDown(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	res, err := (&Config{}).getBackendDown(ctx)
+	td.CmpNoError(err)
+	td.Cmp(res, &BackendDown{Mode: BackendDownFailFast})
+
+	res, err = (&Config{BackendDownMode: "retry", BackendDownRetryTimeoutSeconds: 3}).getBackendDown(ctx)
+	td.CmpNoError(err)
+	td.Cmp(res, &BackendDown{Mode: BackendDownRetry, RetryTimeout: 3 * time.Second})
+
+	res, err = (&Config{BackendDownMode: "serve-stale-cache", BackendDownStaleCacheTTLSeconds: 60,
+		BackendDownStaleCacheMaxEntries: 10}).getBackendDown(ctx)
+	td.CmpNoError(err)
+	td.Cmp(res.StaleCache, testdeep.Struct(&StaleCache{TTL: time.Minute, MaxEntries: 10}, nil))
+
+	_, err = (&Config{BackendDownMode: "retry"}).getBackendDown(ctx)
+	td.CmpError(err)
+	_, err = (&Config{BackendDownMode: "serve-stale-cache", BackendDownStaleCacheTTLSeconds: 60}).getBackendDown(ctx)
+	td.CmpError(err)
+	_, err = (&Config{BackendDownMode: "bad"}).getBackendDown(ctx)
+	td.CmpError(err)
+}
+
+func TestConfig_getResponseCache(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	res, err := (&Config{ResponseCacheMaxSizeMB: 10}).getResponseCache(ctx)
+	td.CmpNoError(err)
+	td.Nil(res)
+
+	res, err = (&Config{ResponseCacheRoutes: []string{"Example.com/static/", "*/"}, ResponseCacheMaxEntrySizeKB: 1,
+		ResponseCacheMaxSizeMB: 2, ResponseCacheMaxTTLSeconds: 60}).getResponseCache(ctx)
+	td.CmpNoError(err)
+	td.Cmp(res, testdeep.Struct(&ResponseCache{MaxEntrySize: 1024, MaxSize: 2 << 20, MaxTTL: time.Minute}, testdeep.StructFields{
+		"routes": []route{{host: "example.com", pathPrefix: "/static/"}, {pathPrefix: "/"}},
+	}))
+
+	_, err = (&Config{ResponseCacheRoutes: []string{"*/"}, ResponseCacheMaxSizeMB: 2, ResponseCacheMaxTTLSeconds: 60}).getResponseCache(ctx)
+	td.CmpError(err)
+	_, err = (&Config{ResponseCacheRoutes: []string{"/static"}, ResponseCacheMaxEntrySizeKB: 1, ResponseCacheMaxSizeMB: 2,
+		ResponseCacheMaxTTLSeconds: 60}).getResponseCache(ctx)
+	td.CmpError(err)
+}
+
+func TestConfig_getBackendsTLS(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	res, err := (&Config{}).getBackendsTLS(ctx, AddressFamilyAny)
+	td.CmpNoError(err)
+	td.Nil(res)
+
+	pin1 := strings.Repeat("ab", 32)
+	pin2 := strings.Repeat("CD:", 31) + "CD"
+	res, err = (&Config{
+		HTTPSBackendServerNameMap: []string{"10.0.0.1:443-backend-1.internal", "[::1]:8443-backend2"},
+		HTTPSBackendCertPins:      []string{"10.0.0.1:443-" + pin1, "10.0.0.1:443-" + pin2, "10.0.0.2:443-" + pin1},
+	}).getBackendsTLS(ctx, AddressFamilyAny)
+	td.CmpNoError(err)
+	fingerprint1, _ := ParseCertFingerprint(pin1)
+	fingerprint2, _ := ParseCertFingerprint(pin2)
+	td.Cmp(res, map[string]BackendTLS{
+		"10.0.0.1:443": {ServerName: "backend-1.internal", CertSHA256: [][sha256.Size]byte{fingerprint1, fingerprint2}},
+		"[::1]:8443":   {ServerName: "backend2"},
+		"10.0.0.2:443": {CertSHA256: [][sha256.Size]byte{fingerprint1}},
+	})
+
+	for _, c := range []Config{
+		{HTTPSBackendServerNameMap: []string{"10.0.0.1:443"}},
+		{HTTPSBackendServerNameMap: []string{"10.0.0.1:443- "}},
+		{HTTPSBackendServerNameMap: []string{":443-backend"}},
+		{HTTPSBackendServerNameMap: []string{"bad-backend"}},
+		{HTTPSBackendCertPins: []string{"10.0.0.1:443-abcd"}},
+		{HTTPSBackendCertPins: []string{"10.0.0.1:443-" + strings.Repeat("zz", 32)}},
+	} {
+		_, err = c.getBackendsTLS(ctx, AddressFamilyAny)
+		td.CmpError(err, c)
+	}
+}
+
+func TestConfig_getRewriteDirector(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	res, err := (&Config{}).getRewriteDirector(ctx)
+	td.CmpNoError(err)
+	td.Nil(res)
+
+	res, err = (&Config{RewriteRules: []RewriteRuleConfig{{Route: "*/", Host: "backend"}}}).getRewriteDirector(ctx)
+	td.CmpNoError(err)
+	td.Cmp(res, DirectorRewrite{{route: route{pathPrefix: "/"}, host: "backend"}})
+
+	_, err = (&Config{RewriteRules: []RewriteRuleConfig{{Route: "*/", PathRegexp: "("}}}).getRewriteDirector(ctx)
+	td.CmpError(err)
+
+	// backends completed by default port of scheme
+	res, err = (&Config{
+		DefaultUpstreamScheme:    "https",
+		DefaultUpstreamHTTPSPort: 8443,
+		RewriteRules: []RewriteRuleConfig{
+			{Route: "a.com/", Backend: "backend-a"},
+			{Route: "b.com/", Backend: "http://backend-b"},
+			{Route: "c.com/", Backend: "HTTPS://[::1]"},
+			{Route: "d.com/", Backend: "backend-d:81"},
+		},
+	}).getRewriteDirector(ctx)
+	td.CmpNoError(err)
+	td.Cmp(res, testdeep.Smuggle(func(d DirectorRewrite) [][2]string {
+		var backends [][2]string
+		for _, rule := range d {
+			backends = append(backends, [2]string{rule.backendScheme, rule.backend})
+		}
+		return backends
+	}, [][2]string{
+		{"", "backend-a:8443"},
+		{"http", "backend-b:80"},
+		{"https", "[::1]:8443"},
+		{"", "backend-d:81"},
+	}))
+
+	for _, backend := range []string{"ftp://backend", "http://", "backend:0", "https://backend/path", "user@backend"} {
+		_, err = (&Config{RewriteRules: []RewriteRuleConfig{{Route: "*/", Backend: backend}}}).getRewriteDirector(ctx)
+		td.CmpError(err, backend)
+	}
+}
+
+func TestConfig_ApplyAltSvc(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	err := (&Config{DefaultTarget: ":80", AltSvc: []string{`h3=":443"`}, AltSvcMaxAgeSeconds: 60}).Apply(ctx, p)
+	td.CmpNoError(err)
+	td.Cmp(p.AltSvc, `h3=":443"; ma=60`)
+
+	err = (&Config{DefaultTarget: ":80", AltSvc: []string{"h3"}}).Apply(ctx, p)
+	td.CmpError(err)
+}
+
+func TestConfig_ApplyStreaming(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	err := (&Config{DefaultTarget: ":80", FlushIntervalMilliseconds: 100, StreamContentTypes: []string{"application/x-ndjson"}}).Apply(ctx, p)
+	td.CmpNoError(err)
+	td.Cmp(p.FlushInterval, 100*time.Millisecond)
+	td.Cmp(p.StreamContentTypes, StreamContentTypes{"application/x-ndjson"})
+}
+
+func TestConfig_ApplyBufferPool(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80"}).Apply(ctx, p))
+	td.Nil(p.BufferPool)
+
+	td.CmpNoError((&Config{DefaultTarget: ":80", BufferPoolSizeKB: 64}).Apply(ctx, p))
+	td.Cmp(len(p.BufferPool.Get()), 64<<10)
+
+	td.CmpError((&Config{DefaultTarget: ":80", BufferPoolSizeKB: -1}).Apply(ctx, &HTTPProxy{}))
+}
+
+func TestConfig_ApplyLoopDetection(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80", LoopDetectionMaxVia: 5}).Apply(ctx, p))
+	td.Nil(p.LoopDetection)
+
+	td.CmpNoError((&Config{DefaultTarget: ":80", LoopDetection: true, LoopDetectionMaxVia: 5}).Apply(ctx, p))
+	td.Cmp(p.LoopDetection.maxVia, 5)
+
+	td.CmpError((&Config{DefaultTarget: ":80", LoopDetection: true, LoopDetectionMaxVia: -1}).Apply(ctx, &HTTPProxy{}))
+}
+
+func TestConfig_ApplyRouteHostWithPort(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80"}).Apply(ctx, p))
+	td.False(p.RouteHostWithPort)
+
+	td.CmpNoError((&Config{DefaultTarget: ":80", RouteHostWithPort: true}).Apply(ctx, p))
+	td.True(p.RouteHostWithPort)
+}
+
+func TestConfig_ApplyAllowedMethods(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80"}).Apply(ctx, p))
+	td.Cmp(p.AllowedMethods, testdeep.Empty())
+	td.Nil(p.AllowedMethodsRules)
+
+	td.CmpNoError((&Config{DefaultTarget: ":80", AllowedMethods: []string{"get", "head"},
+		RewriteRules: []RewriteRuleConfig{{Route: "*/api/", AllowedMethods: []string{"POST"}}}}).Apply(ctx, p))
+	td.Cmp(p.AllowedMethods, []string{"GET", "HEAD"})
+	td.Cmp(p.AllowedMethodsRules, testdeep.Len(1))
+
+	td.CmpError((&Config{DefaultTarget: ":80", AllowedMethods: []string{"GET HEAD"}}).Apply(ctx, &HTTPProxy{}))
+}
+
+func TestConfig_ApplyReloadRoutes(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80"}).Apply(ctx, p))
+	td.Cmp(p.Director, testdeep.Isa(DirectorChain{}))
+
+	td.CmpNoError((&Config{DefaultTarget: ":80", ReloadRoutes: true}).Apply(ctx, p))
+	td.Cmp(p.Director, testdeep.Isa(&ReloadableDirector{}))
+
+	td.CmpError((&Config{DefaultTarget: ":80", ReloadRoutes: true, ReloadRoutesGracePeriodSeconds: -1}).Apply(ctx, p))
+}
+
+func TestConfig_ApplyHeadersLimits(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80", MaxRequestHeaderBytes: 4096, MaxRequestHeaders: 50}).Apply(ctx, p))
+	td.Cmp(p.MaxHeaderBytes, 4096)
+	td.Cmp(p.MaxHeaders, 50)
+
+	td.CmpError((&Config{DefaultTarget: ":80", MaxRequestHeaders: -1}).Apply(ctx, p))
+}
+
+func TestConfig_ApplyExpectContinue(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80"}).Apply(ctx, p))
+	td.False(p.AnswerExpectContinue)
+
+	p = &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80", ExpectContinueMode: ExpectContinueProxy}).Apply(ctx, p))
+	td.True(p.AnswerExpectContinue)
+
+	td.CmpError((&Config{DefaultTarget: ":80", ExpectContinueMode: "bad"}).Apply(ctx, &HTTPProxy{}))
+}
+
+func TestConfig_ApplyHSTS(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80", HSTSMode: HSTSEnabled, HSTSMaxAgeSeconds: 60}).Apply(ctx, p))
+	td.Cmp(p.HSTS, "max-age=60")
+	td.Cmp(p.PlainHTTP, "")
+
+	p = &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80", HSTSMode: HSTSPreloadReady, HSTSMaxAgeSeconds: 60,
+		PlainHTTPMode: PlainHTTPRedirect}).Apply(ctx, p))
+	td.Cmp(p.HSTS, "max-age=31536000; includeSubDomains; preload")
+	td.Cmp(p.PlainHTTP, PlainHTTPRedirect)
+
+	td.CmpError((&Config{DefaultTarget: ":80", HSTSMode: HSTSPreloadReady}).Apply(ctx, &HTTPProxy{}))
+	td.CmpError((&Config{DefaultTarget: ":80", HSTSMode: "bad"}).Apply(ctx, &HTTPProxy{}))
+	td.CmpError((&Config{DefaultTarget: ":80", PlainHTTPMode: "bad"}).Apply(ctx, &HTTPProxy{}))
+}
+
+func TestConfig_ApplyTimeouts(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	p := &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80", KeepAliveTimeoutSeconds: 1, ReadHeaderTimeoutSeconds: 2,
+		ReadTimeoutSeconds: 3, WriteTimeoutSeconds: 4}).Apply(ctx, p))
+	td.Cmp(p.IdleTimeout, time.Second)
+	td.Cmp(p.ReadHeaderTimeout, 2*time.Second)
+	td.Cmp(p.ReadTimeout, 3*time.Second)
+	td.Cmp(p.WriteTimeout, 4*time.Second)
+
+	td.CmpError((&Config{DefaultTarget: ":80", ReadHeaderTimeoutSeconds: -1}).Apply(ctx, &HTTPProxy{}))
+	td.CmpError((&Config{DefaultTarget: ":80", WriteTimeoutSeconds: -1}).Apply(ctx, &HTTPProxy{}))
+}
+
+func TestConfig_getClientCerts(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	res, err := (&Config{}).getClientCerts(ctx)
+	td.CmpNoError(err)
+	td.Nil(res)
+
+	res, err = (&Config{RewriteRules: []RewriteRuleConfig{{Route: "*/", ClientCert: ClientCertAny}}}).getClientCerts(ctx)
+	td.CmpNoError(err)
+	td.Cmp(res, &ClientCerts{})
+
+	res, err = (&Config{ClientCertHeader: "X-Client-Cert", ClientCertTrustedNetworks: []string{"10.0.0.0/8"},
+		ClientCertClaimsHeaderPrefix: "X-Client-Cert-"}).getClientCerts(ctx)
+	td.CmpNoError(err)
+	td.Cmp(res.Header, "X-Client-Cert")
+	td.Cmp(res.ClaimsHeaderPrefix, "X-Client-Cert-")
+
+	_, err = (&Config{ClientCertHeader: "X-Client-Cert"}).getClientCerts(ctx)
+	td.CmpError(err)
+}
+
+func TestConfig_getSplits(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	res, err := (&Config{}).getSplits(ctx)
+	td.CmpNoError(err)
+	td.Nil(res)
+
+	res, err = (&Config{SplitRoutes: []SplitRouteConfig{{Route: "*/", CanaryBackend: "127.0.0.1:2", CanaryPercent: 5}}}).getSplits(ctx)
+	td.CmpNoError(err)
+	td.Cmp(res, Splits{{route: route{pathPrefix: "/"}, canaryBackend: "127.0.0.1:2", canaryPercent: 5}})
+
+	_, err = (&Config{SplitRoutes: []SplitRouteConfig{{Route: "*/"}}}).getSplits(ctx)
+	td.CmpError(err)
+}
+
+func TestConfig_getRetries(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	retries, err := (&Config{}).getRetries(ctx)
+	td.CmpNoError(err)
+	td.Nil(retries)
+
+	retries, err = (&Config{RetryPolicies: []RetryPolicyConfig{{Route: "*/", MaxAttempts: 2}}, RetryBudgetRatio: 0.2,
+		RetryBudgetMinRetries: 5, RetryBudgetWindowSeconds: 10}).getRetries(ctx)
+	td.CmpNoError(err)
+	td.Cmp(retries.Budget, testdeep.Struct(&RetryBudget{Ratio: 0.2, MinRetries: 5, Window: 10 * time.Second}, nil))
+
+	_, err = (&Config{RetryPolicies: []RetryPolicyConfig{{Route: "*/", MaxAttempts: 2}}}).getRetries(ctx)
+	td.CmpError(err)
+}
+
+func TestConfig_GetDirectorMissingHost(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	director, err := (&Config{DefaultTarget: ":80", MissingHostMode: MissingHostDefaultBackend,
+		MissingHostBackend: "127.0.0.2:80"}).GetDirector(ctx)
+	td.CmpNoError(err)
+	td.Cmp(director, testdeep.Struct(DirectorMissingHost{Backend: "127.0.0.2:80"}, nil))
+
+	p := &HTTPProxy{}
+	td.CmpNoError((&Config{DefaultTarget: ":80", MissingHostMode: MissingHostReject}).Apply(ctx, p))
+	td.Cmp(p.MissingHost, MissingHostReject)
+
+	_, err = (&Config{DefaultTarget: ":80", MissingHostMode: MissingHostDefaultHost}).GetDirector(ctx)
+	td.CmpError(err)
+}
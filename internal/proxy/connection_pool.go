@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+	"golang.org/x/xerrors"
+)
+
+// maxPoolTransports - max count of cached transports (by server name and settings), least recently used
+// transport evicted first. Server name can be from Host of client request, so count must be limited.
+const maxPoolTransports = 1000
+
+// ConnectionPool keep connections to backends between requests.
+// Settings apply to HTTP/1.1 connections, HTTP/2 multiplex requests over one connection.
+// Settings can be overridden for routes by PoolSettings in request context (see withPoolSettings).
+// Must be used by one Transport only: transports cached by server name.
+type ConnectionPool struct {
+	// atomic, first in struct for 64-bit alignment
+	openConns      int64
+	activeRequests int64
+
+	// MaxIdleConns - max count of idle connections to all backends. 0 - unlimited.
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost - max count of idle connections to every backend.
+	MaxIdleConnsPerHost int
+
+	// MaxConnsPerHost - limit of connections (active and idle) to every backend.
+	// Requests over the limit wait for free connection. 0 - unlimited.
+	MaxConnsPerHost int
+
+	// IdleConnTimeout - idle connection closed after the timeout. 0 - unlimited.
+	IdleConnTimeout time.Duration
+
+	mu            sync.Mutex
+	transports    map[poolTransportKey]*poolTransport
+	byTransport   map[*http.Transport]*poolTransport
+	maxTransports int // 0 - maxPoolTransports
+	h2cTransport  *http2.Transport
+}
+
+// PoolSettings - settings of backend connections of route, override settings of ConnectionPool.
+// 0 - setting of ConnectionPool.
+type PoolSettings struct {
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+}
+
+type poolSettingsKey struct{}
+
+// newPoolSettings validate settings of route, return nil if all settings from ConnectionPool
+func newPoolSettings(maxIdleConnsPerHost, maxConnsPerHost, idleConnTimeoutSeconds int) (*PoolSettings, error) {
+	if maxIdleConnsPerHost < 0 || maxConnsPerHost < 0 || idleConnTimeoutSeconds < 0 {
+		return nil, xerrors.Errorf("backend connection pool settings must be non negative, got max idle conns per host: %v, "+
+			"max conns per host: %v, idle conn timeout: %v", maxIdleConnsPerHost, maxConnsPerHost, idleConnTimeoutSeconds)
+	}
+	if maxIdleConnsPerHost == 0 && maxConnsPerHost == 0 && idleConnTimeoutSeconds == 0 {
+		return nil, nil
+	}
+	return &PoolSettings{
+		MaxIdleConnsPerHost: maxIdleConnsPerHost,
+		MaxConnsPerHost:     maxConnsPerHost,
+		IdleConnTimeout:     time.Duration(idleConnTimeoutSeconds) * time.Second,
+	}, nil
+}
+
+// withPoolSettings save settings of backend connections for request to context
+func withPoolSettings(ctx context.Context, settings PoolSettings) context.Context {
+	return context.WithValue(ctx, poolSettingsKey{}, settings)
+}
+
+func requestPoolSettings(req *http.Request) (PoolSettings, bool) {
+	settings, ok := req.Context().Value(poolSettingsKey{}).(PoolSettings)
+	return settings, ok
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type poolTransportKey struct {
+	scheme     string
+	serverName string
+	backend    string    // for backends with own tls settings only
+	routeTLS   *RouteTLS // for routes with own tls settings only
+	settings   PoolSettings
+}
+
+type poolTransport struct {
+	transport *http.Transport
+	lastUsed  time.Time // protected by ConnectionPool.mu
+	evicted   int32     // atomic
+}
+
+// closeIdleIfEvicted close idle connections of evicted transport: connections of requests, finished after eviction,
+// returned to its idle pool.
+func (t *poolTransport) closeIdleIfEvicted() {
+	if atomic.LoadInt32(&t.evicted) != 0 {
+		t.transport.CloseIdleConnections()
+	}
+}
+
+// InitMetrics register gauges of backend connections
+func (p *ConnectionPool) InitMetrics(r prometheus.Registerer) {
+	if r == nil || reflect.ValueOf(r).IsNil() {
+		return
+	}
+
+	r.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "backend_connections_open", Help: "Count of open connections to backends",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&p.openConns))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "backend_connections_active", Help: "Count of backend requests in progress",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&p.activeRequests))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "backend_connections_idle", Help: "Count of idle connections to backends (approximate)",
+		}, func() float64 {
+			return float64(p.idleConns())
+		}),
+	)
+}
+
+func (p *ConnectionPool) idleConns() int64 {
+	idle := atomic.LoadInt64(&p.openConns) - atomic.LoadInt64(&p.activeRequests)
+	if idle < 0 {
+		return 0
+	}
+	return idle
+}
+
+// getTransport return cached transport for the key, create it by newTransport if need.
+// Settings of key override settings of the pool.
+func (p *ConnectionPool) getTransport(key poolTransportKey, newTransport func() *http.Transport) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if cached, ok := p.transports[key]; ok {
+		cached.lastUsed = now
+		return cached.transport
+	}
+
+	transport := newTransport()
+	transport.MaxIdleConns = p.MaxIdleConns
+	transport.MaxIdleConnsPerHost = p.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = p.MaxConnsPerHost
+	transport.IdleConnTimeout = p.IdleConnTimeout
+	if key.settings.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = key.settings.MaxIdleConnsPerHost
+	}
+	if key.settings.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = key.settings.MaxConnsPerHost
+	}
+	if key.settings.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = key.settings.IdleConnTimeout
+	}
+	transport.DialContext = p.countConnections(transport.DialContext)
+
+	if p.transports == nil {
+		p.transports = make(map[poolTransportKey]*poolTransport)
+		p.byTransport = make(map[*http.Transport]*poolTransport)
+	}
+	maxTransports := p.maxTransports
+	if maxTransports == 0 {
+		maxTransports = maxPoolTransports
+	}
+	if len(p.transports) >= maxTransports {
+		p.evictOldestTransport()
+	}
+	cached := &poolTransport{transport: transport, lastUsed: now}
+	p.transports[key] = cached
+	p.byTransport[transport] = cached
+	return transport
+}
+
+// evictOldestTransport remove least recently used transport from cache and close its idle connections.
+// Must be called with locked mu.
+func (p *ConnectionPool) evictOldestTransport() {
+	var oldestKey poolTransportKey
+	var oldest *poolTransport
+	for key, cached := range p.transports {
+		if oldest == nil || cached.lastUsed.Before(oldest.lastUsed) {
+			oldestKey, oldest = key, cached
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	delete(p.transports, oldestKey)
+	delete(p.byTransport, oldest.transport)
+	atomic.StoreInt32(&oldest.evicted, 1)
+	oldest.transport.CloseIdleConnections()
+}
+
+func (p *ConnectionPool) roundTrip(transport http.RoundTripper, req *http.Request) (*http.Response, error) {
+	var cached *poolTransport
+	if httpTransport, ok := transport.(*http.Transport); ok {
+		p.mu.Lock()
+		cached = p.byTransport[httpTransport]
+		p.mu.Unlock()
+	}
+
+	atomic.AddInt64(&p.activeRequests, 1)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		atomic.AddInt64(&p.activeRequests, -1)
+		return resp, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// connection upgraded and doesn't return to pool, body must be kept as io.ReadWriteCloser
+		atomic.AddInt64(&p.activeRequests, -1)
+		return resp, nil
+	}
+	resp.Body = &poolResponseBody{ReadCloser: resp.Body, pool: p, transport: cached}
+	return resp, nil
+}
+
+// getH2CTransport return cached h2c transport, create it by newTransport if need.
+func (p *ConnectionPool) getH2CTransport(newTransport func() *http2.Transport) *http2.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.h2cTransport != nil {
+		return p.h2cTransport
+	}
+
+	transport := newTransport()
+	// h2c transport dial plain tcp connections, tls config doesn't used
+	dialTLS := transport.DialTLSContext
+	dial := p.countConnections(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialTLS(ctx, network, addr, nil)
+	})
+	transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+		return dial(ctx, network, addr)
+	}
+	p.h2cTransport = transport
+	return p.h2cTransport
+}
+
+func (p *ConnectionPool) countConnections(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&p.openConns, 1)
+		return &poolConn{Conn: conn, pool: p}, nil
+	}
+}
+
+type poolConn struct {
+	net.Conn
+	pool      *ConnectionPool
+	closeOnce sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.AddInt64(&c.pool.openConns, -1)
+	})
+	return c.Conn.Close()
+}
+
+// poolResponseBody mark request finished when body closed
+type poolResponseBody struct {
+	io.ReadCloser
+	pool      *ConnectionPool
+	transport *poolTransport // nil for transports, which aren't cached
+	closeOnce sync.Once
+}
+
+func (b *poolResponseBody) Close() error {
+	b.closeOnce.Do(func() {
+		atomic.AddInt64(&b.pool.activeRequests, -1)
+	})
+	err := b.ReadCloser.Close()
+	if b.transport != nil {
+		b.transport.closeIdleIfEvicted()
+	}
+	return err
+}
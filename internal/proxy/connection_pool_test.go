@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestConnectionPool(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	pool := &ConnectionPool{MaxIdleConnsPerHost: 10}
+	transport := Transport{Pool: pool}
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodGet, backend.URL, nil)
+		td.CmpNoError(err)
+		req = req.WithContext(ctx)
+
+		resp, err := transport.RoundTrip(req)
+		td.CmpNoError(err)
+		td.Cmp(atomic.LoadInt64(&pool.activeRequests), int64(1))
+		_, err = io.ReadAll(resp.Body)
+		td.CmpNoError(err)
+		td.CmpNoError(resp.Body.Close())
+		td.Cmp(atomic.LoadInt64(&pool.activeRequests), int64(0))
+	}
+
+	// connection reused
+	td.Cmp(atomic.LoadInt64(&pool.openConns), int64(1))
+	td.Cmp(pool.idleConns(), int64(1))
+
+	req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+	req = req.WithContext(ctx)
+	httpTransport := transport.getTransport(req)
+	td.True(httpTransport != defaultHTTPTransport)
+	td.Cmp(httpTransport.MaxIdleConnsPerHost, 10)
+
+	httpTransport.CloseIdleConnections()
+	td.Cmp(atomic.LoadInt64(&pool.openConns), int64(0))
+}
+
+func TestConnectionPool_HTTPSTransportCache(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	transport := Transport{Pool: &ConnectionPool{MaxConnsPerHost: 5}}
+	getTransport := func(url string) *http.Transport {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		return transport.getTransport(req.WithContext(ctx))
+	}
+
+	first := getTransport("https://a.ru")
+	td.True(first == getTransport("https://a.ru"))
+	td.True(first != getTransport("https://b.ru"))
+	td.Cmp(first.TLSClientConfig.ServerName, "a.ru")
+	td.Cmp(first.MaxConnsPerHost, 5)
+}
+
+func TestConnectionPool_EvictTransport(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	}))
+	defer backend.Close()
+
+	pool := &ConnectionPool{MaxIdleConnsPerHost: 10, maxTransports: 2}
+	transport := Transport{Pool: pool}
+	getTransport := func(url string) *http.Transport {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		return transport.getTransport(req.WithContext(ctx))
+	}
+
+	// idle connection of first transport
+	req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	td.CmpNoError(err)
+	_, err = io.ReadAll(resp.Body)
+	td.CmpNoError(err)
+	td.CmpNoError(resp.Body.Close())
+	td.Cmp(atomic.LoadInt64(&pool.openConns), int64(1))
+
+	httpTransport := getTransport(backend.URL)
+	a := getTransport("https://a.ru")
+	td.True(httpTransport == getTransport(backend.URL)) // a.ru is least recently used
+
+	// count of transports limited, least recently used evicted with its idle connections
+	getTransport("https://b.ru")
+	td.Len(pool.transports, 2)
+	td.True(a != getTransport("https://a.ru"))
+	td.True(httpTransport != getTransport(backend.URL))
+	td.Len(pool.transports, 2)
+	td.Cmp(atomic.LoadInt64(&pool.openConns), int64(0))
+}
+
+func TestConnectionPool_RouteSettings(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	transport := Transport{Pool: &ConnectionPool{MaxIdleConnsPerHost: 10, MaxConnsPerHost: 5,
+		IdleConnTimeout: time.Minute}}
+	getTransport := func(url string, settings *PoolSettings) *http.Transport {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req = req.WithContext(ctx)
+		if settings != nil {
+			req = req.WithContext(withPoolSettings(ctx, *settings))
+		}
+		return transport.getTransport(req)
+	}
+
+	for _, url := range []string{"http://a.ru", "https://a.ru"} {
+		common := getTransport(url, nil)
+		route := getTransport(url, &PoolSettings{MaxConnsPerHost: 50})
+		td.True(common != route, url)
+		td.True(route == getTransport(url, &PoolSettings{MaxConnsPerHost: 50}), url)
+		td.Cmp(common.MaxConnsPerHost, 5, url)
+		td.Cmp(route.MaxConnsPerHost, 50, url)
+		td.Cmp(route.MaxIdleConnsPerHost, 10, url)
+		td.Cmp(route.IdleConnTimeout, time.Minute, url)
+	}
+
+	settings, err := newPoolSettings(0, 0, 0)
+	td.CmpNoError(err)
+	td.Nil(settings)
+	settings, err = newPoolSettings(1, 2, 3)
+	td.CmpNoError(err)
+	td.Cmp(settings, &PoolSettings{MaxIdleConnsPerHost: 1, MaxConnsPerHost: 2, IdleConnTimeout: 3 * time.Second})
+	_, err = newPoolSettings(-1, 0, 0)
+	td.CmpError(err)
+
+	// settings of split route have priority over rewrite rule
+	rewrite, err := NewDirectorRewrite([]RewriteRuleConfig{
+		{Route: "*/", BackendMaxConnsPerHost: 7},
+	})
+	td.CmpNoError(err)
+	req := httptest.NewRequest(http.MethodGet, "http://a.ru/", nil).WithContext(ctx)
+	td.CmpNoError(rewrite.Director(req))
+	td.Cmp(req.Context().Value(poolSettingsKey{}), PoolSettings{MaxConnsPerHost: 7})
+
+	splits, err := NewSplits([]SplitRouteConfig{{Route: "*/", CanaryBackend: "127.0.0.1:2", BackendMaxConnsPerHost: 8}})
+	td.CmpNoError(err)
+	req = httptest.NewRequest(http.MethodGet, "http://a.ru/", nil).WithContext(ctx)
+	req = (&HTTPProxy{Splits: splits, logger: zap.NewNop()}).withSplit(httptest.NewRecorder(), req)
+	td.CmpNoError(rewrite.Director(req))
+	td.Cmp(req.Context().Value(poolSettingsKey{}), PoolSettings{MaxConnsPerHost: 8})
+}
@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+const debugCaptureRedacted = "[REDACTED]"
+
+// DebugCapture write exchanges with backends (request and response with headers and bodies up to limit)
+// of matched requests to file as json lines, for diagnose backend interactions.
+// Requests matched by permanent routes and by routes, enabled by Handler for limited duration.
+type DebugCapture struct {
+	File          string
+	MaxBodySize   int64         // max captured size of every body, 0 - without bodies
+	RedactHeaders []string      // values of the headers replaced in captured exchanges
+	MaxDuration   time.Duration // max duration of capture, enabled by Handler
+
+	routes []route
+
+	mu           sync.Mutex
+	file         *os.File
+	tempRoutes   []route
+	tempRoutesTo time.Time
+}
+
+// DebugCaptureExchange - captured exchange, line of capture file
+type DebugCaptureExchange struct {
+	Time                  time.Time   `json:"time"`
+	DurationMilliseconds  int64       `json:"duration_ms"`
+	RequestID             string      `json:"request_id,omitempty"`
+	RemoteAddr            string      `json:"remote_addr"`
+	Method                string      `json:"method"`
+	Host                  string      `json:"host"`
+	URL                   string      `json:"url"`
+	RequestHeaders        http.Header `json:"request_headers"`
+	RequestBody           string      `json:"request_body,omitempty"`
+	RequestBodyTruncated  bool        `json:"request_body_truncated,omitempty"`
+	Status                int         `json:"status,omitempty"`
+	ResponseHeaders       http.Header `json:"response_headers,omitempty"`
+	ResponseBody          string      `json:"response_body,omitempty"`
+	ResponseBodyTruncated bool        `json:"response_body_truncated,omitempty"`
+	Error                 string      `json:"error,omitempty"`
+}
+
+// NewDebugCapture create capture for requests, matched to routes "host/path-prefix". Host "*" match any host.
+func NewDebugCapture(file string, routes, redactHeaders []string, maxBodySize int64, maxDuration time.Duration) (*DebugCapture, error) {
+	res := &DebugCapture{File: file, MaxBodySize: maxBodySize, MaxDuration: maxDuration}
+	for _, header := range redactHeaders {
+		res.RedactHeaders = append(res.RedactHeaders, http.CanonicalHeaderKey(header))
+	}
+	for _, s := range routes {
+		r, err := parseRoute(s)
+		if err != nil {
+			return nil, xerrors.Errorf("debug capture: %w", err)
+		}
+		res.routes = append(res.routes, r)
+	}
+	return res, nil
+}
+
+// Enable capture requests, matched to routes, during duration (limited by MaxDuration).
+// It replace routes of previous Enable call.
+func (c *DebugCapture) Enable(routes []string, duration time.Duration) (time.Time, error) {
+	parsed := make([]route, 0, len(routes))
+	for _, s := range routes {
+		r, err := parseRoute(s)
+		if err != nil {
+			return time.Time{}, err
+		}
+		parsed = append(parsed, r)
+	}
+	if duration <= 0 {
+		return time.Time{}, xerrors.Errorf("capture duration must be positive, got: %v", duration)
+	}
+	if duration > c.MaxDuration {
+		duration = c.MaxDuration
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tempRoutes = parsed
+	c.tempRoutesTo = time.Now().Add(duration)
+	return c.tempRoutesTo, nil
+}
+
+// Disable capture by routes, enabled by Enable
+func (c *DebugCapture) Disable() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tempRoutes = nil
+	c.tempRoutesTo = time.Time{}
+}
+
+func (c *DebugCapture) match(req *http.Request, now time.Time) bool {
+	for _, r := range c.routes {
+		if r.match(req) {
+			return true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.After(c.tempRoutesTo) {
+		return false
+	}
+	for _, r := range c.tempRoutes {
+		if r.match(req) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *DebugCapture) wrap(transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return debugCaptureTransport{capture: c, transport: transport}
+}
+
+type debugCaptureTransport struct {
+	capture   *DebugCapture
+	transport http.RoundTripper
+}
+
+func (t debugCaptureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	if !t.capture.match(req, start) {
+		return t.transport.RoundTrip(req)
+	}
+
+	exchange := &DebugCaptureExchange{
+		Time:           start,
+		RequestID:      RequestIDFromContext(req.Context()),
+		RemoteAddr:     req.RemoteAddr,
+		Method:         req.Method,
+		Host:           req.Host,
+		URL:            req.URL.String(),
+		RequestHeaders: t.capture.redact(req.Header),
+	}
+	var requestBody *limitedBuffer
+	if req.Body != nil && req.Body != http.NoBody && t.capture.MaxBodySize > 0 {
+		requestBody = &limitedBuffer{limit: t.capture.MaxBodySize}
+		req.Body = teeReadCloser{Reader: io.TeeReader(req.Body, requestBody), Closer: req.Body}
+	}
+
+	finish := func(responseBody *limitedBuffer) {
+		exchange.DurationMilliseconds = time.Since(start).Milliseconds()
+		exchange.RequestBody, exchange.RequestBodyTruncated = requestBody.result()
+		exchange.ResponseBody, exchange.ResponseBodyTruncated = responseBody.result()
+		t.capture.write(req, exchange)
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		exchange.Error = err.Error()
+		finish(nil)
+		return resp, err
+	}
+
+	exchange.Status = resp.StatusCode
+	exchange.ResponseHeaders = t.capture.redact(resp.Header)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// body of upgraded connection must stay io.ReadWriteCloser, it doesn't captured
+		finish(nil)
+		return resp, nil
+	}
+
+	responseBody := &limitedBuffer{limit: t.capture.MaxBodySize}
+	resp.Body = &debugCaptureBody{
+		ReadCloser: resp.Body,
+		tee:        io.TeeReader(resp.Body, responseBody),
+		onClose:    func() { finish(responseBody) },
+	}
+	return resp, nil
+}
+
+func (c *DebugCapture) redact(header http.Header) http.Header {
+	res := header.Clone()
+	for _, name := range c.RedactHeaders {
+		if values, ok := res[name]; ok {
+			for i := range values {
+				values[i] = debugCaptureRedacted
+			}
+		}
+	}
+	return res
+}
+
+func (c *DebugCapture) write(req *http.Request, exchange *DebugCaptureExchange) {
+	line, err := json.Marshal(exchange)
+	log.DebugDPanicCtx(req.Context(), err, "Marshal captured exchange")
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		c.file, err = os.OpenFile(c.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600) //nolint:gomnd
+		if err != nil {
+			zc.L(req.Context()).Error("Can't open debug capture file", zap.String("file", c.File), zap.Error(err))
+			return
+		}
+	}
+	_, err = c.file.Write(line)
+	log.DebugErrorCtx(req.Context(), err, "Write captured exchange", zap.String("file", c.File))
+}
+
+// Handler control capture by routes for limited duration:
+// POST ?route=host/path-prefix&route=...&duration_seconds=60 - enable capture (replace previous routes),
+// DELETE - disable it, GET - status of capture.
+func (c *DebugCapture) Handler(logger *zap.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			routes := r.URL.Query()["route"]
+			duration, err := strconv.Atoi(r.URL.Query().Get("duration_seconds"))
+			if err != nil || len(routes) == 0 {
+				http.Error(w, "need route and duration_seconds parameters", http.StatusBadRequest)
+				return
+			}
+			until, err := c.Enable(routes, time.Duration(duration)*time.Second)
+			log.InfoError(logger, err, "Enable debug capture", zap.Strings("routes", routes), zap.Time("until", until),
+				zap.String("remote_address", r.RemoteAddr))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			c.Disable()
+			logger.Info("Disable debug capture", zap.String("remote_address", r.RemoteAddr))
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.status(time.Now()))
+	})
+}
+
+type debugCaptureStatus struct {
+	File   string    `json:"file"`
+	Routes []string  `json:"routes"`
+	Until  time.Time `json:"until,omitempty"`
+}
+
+func (c *DebugCapture) status(now time.Time) debugCaptureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := debugCaptureStatus{File: c.File, Routes: []string{}}
+	if now.After(c.tempRoutesTo) {
+		return res
+	}
+	for _, r := range c.tempRoutes {
+		host := r.host
+		if host == "" {
+			host = "*"
+		}
+		res.Routes = append(res.Routes, host+r.pathPrefix)
+	}
+	res.Until = c.tempRoutesTo
+	return res
+}
+
+// limitedBuffer store first limit bytes, written to it. Request body may be written by transport
+// after response received, so buffer is safe for concurrent use.
+type limitedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if free := b.limit - int64(b.buf.Len()); int64(len(p)) > free {
+		b.truncated = true
+		if free > 0 {
+			b.buf.Write(p[:free])
+		}
+		return len(p), nil
+	}
+	b.buf.Write(p)
+	return len(p), nil
+}
+
+// result return captured data and truncated flag, nil buffer is empty
+func (b *limitedBuffer) result() (string, bool) {
+	if b == nil {
+		return "", false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String(), b.truncated
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// debugCaptureBody call onClose once, after close of response body
+type debugCaptureBody struct {
+	io.ReadCloser
+	tee     io.Reader
+	once    sync.Once
+	onClose func()
+}
+
+func (b *debugCaptureBody) Read(p []byte) (int, error) {
+	return b.tee.Read(p)
+}
+
+func (b *debugCaptureBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.onClose)
+	return err
+}
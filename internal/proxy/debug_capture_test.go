@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestDebugCaptureTransport(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	rtMock := NewRoundTripperMock(mc)
+	rtMock.RoundTripMock.Set(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/api/fail" {
+			return nil, errors.New("backend failed")
+		}
+		if req.Body != nil {
+			_, _ = io.ReadAll(req.Body)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Set-Cookie": []string{"session=secret"}},
+			Body: io.NopCloser(strings.NewReader("response body"))}, nil
+	})
+
+	file := filepath.Join(t.TempDir(), "capture.log")
+	capture, err := NewDebugCapture(file, []string{"example.com/api/"}, []string{"authorization", "Set-Cookie"}, 8, time.Hour)
+	td.CmpNoError(err)
+	transport := capture.wrap(rtMock)
+
+	do := func(host, path, body string) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://backend"+path, strings.NewReader(body))
+		req.Host = host
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("X-Test", "test")
+		resp, err := transport.RoundTrip(req)
+		if err == nil {
+			_, _ = io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+		}
+	}
+	do("example.com", "/api/test", "request")
+	do("example.com", "/other", "request")
+	do("other.com", "/api/test", "request")
+	do("example.com", "/api/fail", "")
+
+	exchanges := readDebugCapture(td, file)
+	td.Cmp(exchanges, []DebugCaptureExchange{
+		{
+			Method:                http.MethodPost,
+			Host:                  "example.com",
+			URL:                   "http://backend/api/test",
+			RequestHeaders:        http.Header{"Authorization": {"[REDACTED]"}, "X-Test": {"test"}},
+			RequestBody:           "request",
+			Status:                http.StatusOK,
+			ResponseHeaders:       http.Header{"Set-Cookie": {"[REDACTED]"}},
+			ResponseBody:          "response",
+			ResponseBodyTruncated: true,
+		},
+		{
+			Method:         http.MethodPost,
+			Host:           "example.com",
+			URL:            "http://backend/api/fail",
+			RequestHeaders: http.Header{"Authorization": {"[REDACTED]"}, "X-Test": {"test"}},
+			Error:          "backend failed",
+		},
+	})
+
+	// enabled by handler for limited duration
+	handler := capture.Handler(zap.NewNop())
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/debug-capture?route=other.com/api/&duration_seconds=60", nil))
+	td.Cmp(recorder.Code, http.StatusOK)
+	var status debugCaptureStatus
+	td.CmpNoError(json.Unmarshal(recorder.Body.Bytes(), &status))
+	td.Cmp(status.Routes, []string{"other.com/api/"})
+
+	do("other.com", "/api/test", "")
+	td.Cmp(readDebugCapture(td, file), testdeep.Len(3))
+
+	td.False(capture.match(httptest.NewRequest(http.MethodGet, "http://other.com/api/test", nil), time.Now().Add(time.Hour)))
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/debug-capture", nil))
+	td.Cmp(recorder.Code, http.StatusOK)
+	do("other.com", "/api/test", "")
+	td.Cmp(readDebugCapture(td, file), testdeep.Len(3))
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/debug-capture?route=bad", nil))
+	td.Cmp(recorder.Code, http.StatusBadRequest)
+}
+
+// readDebugCapture return captured exchanges without time, duration and remote address
+func readDebugCapture(td *testdeep.T, file string) []DebugCaptureExchange {
+	f, err := os.Open(file)
+	td.CmpNoError(err)
+	defer func() { _ = f.Close() }()
+
+	var res []DebugCaptureExchange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var exchange DebugCaptureExchange
+		td.CmpNoError(json.Unmarshal(scanner.Bytes(), &exchange))
+		exchange.Time, exchange.DurationMilliseconds, exchange.RemoteAddr = time.Time{}, 0, ""
+		res = append(res, exchange)
+	}
+	return res
+}
+
+func TestConfig_GetDebugCapture(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	capture, err := (&Config{}).GetDebugCapture(ctx)
+	td.CmpNoError(err)
+	td.Nil(capture)
+
+	capture, err = (&Config{DebugCaptureFile: "capture.log", DebugCaptureMaxDurationSeconds: 60,
+		DebugCaptureRedactHeaders: []string{"cookie"}}).GetDebugCapture(ctx)
+	td.CmpNoError(err)
+	td.Cmp(capture.RedactHeaders, []string{"Cookie"})
+	td.Cmp(capture.MaxDuration, time.Minute)
+
+	_, err = (&Config{DebugCaptureFile: "capture.log"}).GetDebugCapture(ctx)
+	td.CmpError(err)
+	_, err = (&Config{DebugCaptureFile: "capture.log", DebugCaptureMaxDurationSeconds: 60, DebugCaptureRoutes: []string{"bad"}}).GetDebugCapture(ctx)
+	td.CmpError(err)
+}
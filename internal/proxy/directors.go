@@ -24,8 +24,9 @@ const (
 )
 
 const (
-	ProtocolHTTP  = "http"
-	ProtocolHTTPS = "https"
+	ProtocolHTTP    = "http"
+	ProtocolHTTPS   = "https"
+	ProtocolFastCGI = "fastcgi"
 )
 
 type DirectorChain []Director
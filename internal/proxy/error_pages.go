@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrorPageData is data for error page template
+type ErrorPageData struct {
+	StatusCode int
+	StatusText string
+	Host       string
+	RequestID  string
+}
+
+// ErrorPages is custom responses for errors, generated by proxy.
+// Page source is path to html/template file or http(s) url for redirect.
+type ErrorPages struct {
+	sources map[int]string
+
+	mu    sync.RWMutex
+	pages map[int]errorPage
+}
+
+type errorPage struct {
+	redirect string
+	template *template.Template
+}
+
+// NewErrorPages create error pages and load templates. sources - page sources by response status code.
+func NewErrorPages(sources map[int]string) (*ErrorPages, error) {
+	res := &ErrorPages{sources: sources}
+	if err := res.Reload(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Reload load templates from files again. Previous pages used if load failed.
+func (p *ErrorPages) Reload() error {
+	pages := make(map[int]errorPage, len(p.sources))
+	for statusCode, source := range p.sources {
+		if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+			pages[statusCode] = errorPage{redirect: source}
+			continue
+		}
+
+		content, err := os.ReadFile(source)
+		if err != nil {
+			return xerrors.Errorf("read error page for status %v: %w", statusCode, err)
+		}
+		tmpl, err := template.New(source).Parse(string(content))
+		if err != nil {
+			return xerrors.Errorf("parse error page template for status %v: %w", statusCode, err)
+		}
+		pages[statusCode] = errorPage{template: tmpl}
+	}
+
+	p.mu.Lock()
+	p.pages = pages
+	p.mu.Unlock()
+	return nil
+}
+
+// Write write custom error page to response. It return false if no page for the status code (p can be nil).
+func (p *ErrorPages) Write(w http.ResponseWriter, r *http.Request, statusCode int) bool {
+	if p == nil {
+		return false
+	}
+
+	p.mu.RLock()
+	page, ok := p.pages[statusCode]
+	p.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	if page.redirect != "" {
+		http.Redirect(w, r, page.redirect, http.StatusFound)
+		return true
+	}
+
+	data := ErrorPageData{
+		StatusCode: statusCode,
+		StatusText: http.StatusText(statusCode),
+		Host:       r.Host,
+		RequestID:  RequestIDFromContext(r.Context()),
+	}
+
+	var buf bytes.Buffer
+	if err := page.template.Execute(&buf, data); err != nil {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(buf.Bytes())
+	return true
+}
+
+// backendErrorStatus return response status code for backend request error
+func backendErrorStatus(err error) int {
+	var netErr net.Error
+	if xerrors.Is(err, context.DeadlineExceeded) || xerrors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestErrorPages(t *testing.T) {
+	td := testdeep.NewT(t)
+	dir := t.TempDir()
+	pagePath := filepath.Join(dir, "502.html")
+	td.CmpNoError(os.WriteFile(pagePath, []byte(`{{.StatusCode}} {{.Host}} {{.RequestID}}`), 0600))
+
+	pages, err := NewErrorPages(map[int]string{
+		http.StatusBadGateway:         pagePath,
+		http.StatusServiceUnavailable: "https://status.example.com/",
+	})
+	td.CmpNoError(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://test.com/path", nil)
+	req = req.WithContext(context.WithValue(req.Context(), contextlabel.RequestID, "<id>"))
+	resp := httptest.NewRecorder()
+	td.True(pages.Write(resp, req, http.StatusBadGateway))
+	td.Cmp(resp.Code, http.StatusBadGateway)
+	td.Cmp(resp.Header().Get("Content-Type"), "text/html; charset=utf-8")
+	td.Cmp(resp.Body.String(), "502 test.com &lt;id&gt;")
+
+	resp = httptest.NewRecorder()
+	td.True(pages.Write(resp, req, http.StatusServiceUnavailable))
+	td.Cmp(resp.Code, http.StatusFound)
+	td.Cmp(resp.Header().Get("Location"), "https://status.example.com/")
+
+	resp = httptest.NewRecorder()
+	td.False(pages.Write(resp, req, http.StatusGatewayTimeout))
+
+	// reload
+	td.CmpNoError(os.WriteFile(pagePath, []byte(`new {{.StatusText}}`), 0600))
+	td.CmpNoError(pages.Reload())
+	resp = httptest.NewRecorder()
+	td.True(pages.Write(resp, req, http.StatusBadGateway))
+	td.Cmp(resp.Body.String(), "new Bad Gateway")
+
+	// keep old pages if reload failed
+	td.CmpNoError(os.WriteFile(pagePath, []byte(`{{.Bad`), 0600))
+	td.CmpError(pages.Reload())
+	resp = httptest.NewRecorder()
+	td.True(pages.Write(resp, req, http.StatusBadGateway))
+	td.Cmp(resp.Body.String(), "new Bad Gateway")
+
+	var nilPages *ErrorPages
+	td.False(nilPages.Write(httptest.NewRecorder(), req, http.StatusBadGateway))
+
+	_, err = NewErrorPages(map[int]string{http.StatusBadGateway: filepath.Join(dir, "not-exist.html")})
+	td.CmpError(err)
+}
+
+func TestBackendErrorStatus(t *testing.T) {
+	td := testdeep.NewT(t)
+	td.Cmp(backendErrorStatus(xerrors.New("test")), http.StatusBadGateway)
+	td.Cmp(backendErrorStatus(xerrors.Errorf("wrap: %w", context.DeadlineExceeded)), http.StatusGatewayTimeout)
+	td.Cmp(backendErrorStatus(&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}), http.StatusGatewayTimeout)
+}
+
+func TestHTTPProxy_ErrorPages(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	pagePath := filepath.Join(t.TempDir(), "502.html")
+	err := os.WriteFile(pagePath, []byte(`backend down: {{.Host}}`), 0600)
+	e.CmpNoError(err)
+
+	// closed port
+	backendListener := th.NewLocalTcpListener(e)
+	e.CmpNoError(backendListener.Close())
+
+	listener := th.NewLocalTcpListener(e)
+	addr := listener.Addr().String()
+	proxy := NewHTTPProxy(e.Ctx, listener)
+	proxy.Director = NewDirectorChain(NewDirectorHost(backendListener.Addr().String()), NewSetSchemeDirector(ProtocolHTTP))
+	proxy.ErrorPages, err = NewErrorPages(map[int]string{http.StatusBadGateway: pagePath})
+	e.CmpNoError(err)
+	go func() { _ = proxy.Start() }()
+	defer func() { _ = proxy.Close() }()
+
+	client := http.Client{Timeout: time.Second}
+	resp, err := client.Get("http://" + addr)
+	e.CmpNoError(err)
+	body, err := io.ReadAll(resp.Body)
+	e.CmpNoError(err)
+	e.CmpNoError(resp.Body.Close())
+
+	e.Cmp(resp.StatusCode, http.StatusBadGateway)
+	e.Cmp(string(body), "backend down: "+addr)
+}
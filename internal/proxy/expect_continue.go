@@ -0,0 +1,7 @@
+package proxy
+
+// Modes of handle requests with "Expect: 100-continue" header
+const (
+	ExpectContinueBackend = "backend" // forward Expect header to backend and relay its answer
+	ExpectContinueProxy   = "proxy"   // answer 100 Continue by proxy, without Expect header to backend
+)
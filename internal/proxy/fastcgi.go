@@ -0,0 +1,353 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+const (
+	fastCGIUnixPrefix   = "unix:"
+	fastCGIDefaultIndex = "index.php"
+
+	fastCGIVersion   = 1
+	fastCGIResponder = 1
+
+	fastCGIBeginRequest = 1
+	fastCGIEndRequest   = 3
+	fastCGIParams       = 4
+	fastCGIStdin        = 5
+	fastCGIStdout       = 6
+	fastCGIStderr       = 7
+
+	fastCGIHeaderLen     = 8
+	fastCGIMaxContentLen = 65535
+	fastCGIRequestID     = 1
+)
+
+// fastCGIRoute - settings of FastCGI backend of route, saved to request context by rewrite rule
+type fastCGIRoute struct {
+	address   string // "unix:/path" or host:port, empty - host of request url
+	root      string
+	index     string
+	splitPath string
+}
+
+type fastCGIRouteKey struct{}
+
+// fastCGIScript split path of request to script name and path info. Path, ended by slash, served by index file.
+func (f *fastCGIRoute) fastCGIScript(urlPath string) (scriptName, pathInfo string) {
+	if strings.HasSuffix(urlPath, "/") {
+		return urlPath + f.index, ""
+	}
+	if f.splitPath == "" {
+		return urlPath, ""
+	}
+	lowerPath := strings.ToLower(urlPath)
+	for start := 0; ; {
+		index := strings.Index(lowerPath[start:], f.splitPath)
+		if index < 0 {
+			return urlPath, ""
+		}
+		end := start + index + len(f.splitPath)
+		if end == len(urlPath) || urlPath[end] == '/' {
+			return urlPath[:end], urlPath[end:]
+		}
+		start = end
+	}
+}
+
+// fastCGIEnv return cgi variables of request (rfc 3875) with http headers as HTTP_* variables
+func (f *fastCGIRoute) fastCGIEnv(req *http.Request) map[string]string {
+	scriptName, pathInfo := f.fastCGIScript(req.URL.Path)
+
+	remoteIP, remotePort, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteIP = req.RemoteAddr
+	}
+	isTLS, _ := req.Context().Value(contextlabel.TLSConnection).(bool)
+	serverName, serverPort, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		serverName = req.Host
+		serverPort = "80"
+		if isTLS {
+			serverPort = "443"
+		}
+	}
+
+	env := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "lets-proxy2",
+		"SERVER_PROTOCOL":   req.Proto,
+		"SERVER_NAME":       serverName,
+		"SERVER_PORT":       serverPort,
+		"REQUEST_METHOD":    req.Method,
+		"REQUEST_URI":       req.URL.RequestURI(),
+		"QUERY_STRING":      req.URL.RawQuery,
+		"DOCUMENT_ROOT":     f.root,
+		"DOCUMENT_URI":      scriptName + pathInfo,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   path.Join(f.root, scriptName),
+		"PATH_INFO":         pathInfo,
+		"REMOTE_ADDR":       remoteIP,
+		"REMOTE_PORT":       remotePort,
+		"CONTENT_TYPE":      req.Header.Get("Content-Type"),
+	}
+	if env["SERVER_PROTOCOL"] == "" {
+		env["SERVER_PROTOCOL"] = "HTTP/1.1"
+	}
+	if pathInfo != "" {
+		env["PATH_TRANSLATED"] = path.Join(f.root, pathInfo)
+	}
+	if req.ContentLength >= 0 {
+		env["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+	if isTLS {
+		env["HTTPS"] = "on"
+	}
+	for name, values := range req.Header {
+		// Proxy header - httpoxy vulnerability, content headers sent as CONTENT_TYPE and CONTENT_LENGTH
+		if name == "Proxy" || name == "Content-Type" || name == "Content-Length" {
+			continue
+		}
+		env["HTTP_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))] = strings.Join(values, ", ")
+	}
+	if req.Host != "" {
+		env["HTTP_HOST"] = req.Host
+	}
+	return env
+}
+
+// fastCGIRoundTrip send request to FastCGI server and return its response. Connection closed after response.
+func (t Transport) fastCGIRoundTrip(req *http.Request) (*http.Response, error) {
+	route, ok := req.Context().Value(fastCGIRouteKey{}).(*fastCGIRoute)
+	if !ok {
+		return nil, xerrors.New("fastcgi request without fastcgi route")
+	}
+
+	var conn net.Conn
+	var err error
+	if strings.HasPrefix(route.address, fastCGIUnixPrefix) {
+		conn, err = newDialer().DialContext(req.Context(), "unix", strings.TrimPrefix(route.address, fastCGIUnixPrefix))
+	} else {
+		address := route.address
+		if address == "" {
+			address = req.URL.Host
+		}
+		conn, err = t.dialContext(req.Context(), "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stopWatch := closeOnDone(req.Context(), conn)
+	if err = writeFastCGIRequest(conn, route.fastCGIEnv(req), req.Body); err != nil {
+		stopWatch()
+		_ = conn.Close()
+		return nil, xerrors.Errorf("send fastcgi request: %w", err)
+	}
+
+	stdoutReader, stdoutWriter := io.Pipe()
+	logger := zc.L(req.Context())
+	go func() {
+		stdoutWriter.CloseWithError(readFastCGIResponse(conn, stdoutWriter, logger))
+	}()
+
+	resp, err := readCGIResponse(req, stdoutReader)
+	if err != nil {
+		stopWatch()
+		_ = stdoutReader.Close()
+		_ = conn.Close()
+		return nil, xerrors.Errorf("read fastcgi response: %w", err)
+	}
+	resp.Body = &fastCGIBody{ReadCloser: resp.Body, conn: conn, stopWatch: stopWatch}
+	return resp, nil
+}
+
+// closeOnDone close connection when ctx done, returned func stop watch
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(stop) }) }
+}
+
+type fastCGIBody struct {
+	io.ReadCloser
+	conn      net.Conn
+	stopWatch func()
+}
+
+func (b *fastCGIBody) Close() error {
+	b.stopWatch()
+	_ = b.ReadCloser.Close()
+	return b.conn.Close()
+}
+
+func writeFastCGIRequest(w io.Writer, env map[string]string, body io.Reader) error {
+	bw := bufio.NewWriter(w)
+	beginBody := []byte{0, fastCGIResponder, 0, 0, 0, 0, 0, 0} // role, flags: close connection after request
+	if err := writeFastCGIRecord(bw, fastCGIBeginRequest, beginBody); err != nil {
+		return err
+	}
+
+	var params []byte
+	for name, value := range env {
+		params = appendFastCGILen(params, len(name))
+		params = appendFastCGILen(params, len(value))
+		params = append(params, name...)
+		params = append(params, value...)
+	}
+	if err := writeFastCGIStream(bw, fastCGIParams, params); err != nil {
+		return err
+	}
+
+	if body != nil {
+		buf := make([]byte, fastCGIMaxContentLen)
+		for {
+			n, err := body.Read(buf)
+			if n > 0 {
+				if writeErr := writeFastCGIRecord(bw, fastCGIStdin, buf[:n]); writeErr != nil {
+					return writeErr
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return xerrors.Errorf("read request body: %w", err)
+			}
+		}
+	}
+	if err := writeFastCGIRecord(bw, fastCGIStdin, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeFastCGIStream write data by records and empty record as end of stream
+func writeFastCGIStream(w io.Writer, recordType byte, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > fastCGIMaxContentLen {
+			n = fastCGIMaxContentLen
+		}
+		if err := writeFastCGIRecord(w, recordType, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return writeFastCGIRecord(w, recordType, nil)
+}
+
+func writeFastCGIRecord(w io.Writer, recordType byte, content []byte) error {
+	header := [fastCGIHeaderLen]byte{fastCGIVersion, recordType}
+	binary.BigEndian.PutUint16(header[2:4], fastCGIRequestID)
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+func appendFastCGILen(buf []byte, n int) []byte {
+	if n < 128 {
+		return append(buf, byte(n))
+	}
+	return append(buf, byte(n>>24)|0x80, byte(n>>16), byte(n>>8), byte(n))
+}
+
+// readFastCGIResponse copy stdout records to w until end of request, stderr records logged
+func readFastCGIResponse(r io.Reader, w io.Writer, logger *zap.Logger) error {
+	br := bufio.NewReader(r)
+	var header [fastCGIHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return xerrors.Errorf("read fastcgi record header: %w", err)
+		}
+		contentLen := int(binary.BigEndian.Uint16(header[4:6]))
+		paddingLen := int(header[6])
+		content := make([]byte, contentLen+paddingLen)
+		if _, err := io.ReadFull(br, content); err != nil {
+			return xerrors.Errorf("read fastcgi record: %w", err)
+		}
+		content = content[:contentLen]
+
+		switch header[1] {
+		case fastCGIStdout:
+			if _, err := w.Write(content); err != nil {
+				return err
+			}
+		case fastCGIStderr:
+			if len(content) > 0 {
+				logger.Warn("FastCGI backend error output", zap.ByteString("stderr", content))
+			}
+		case fastCGIEndRequest:
+			return io.EOF
+		}
+	}
+}
+
+// readCGIResponse parse headers of cgi response (rfc 3875 section 6), body of response read from r
+func readCGIResponse(req *http.Request, r io.ReadCloser) (*http.Response, error) {
+	br := bufio.NewReader(r)
+	mimeHeader, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header(mimeHeader)
+
+	statusCode := http.StatusOK
+	if status := header.Get("Status"); status != "" {
+		statusCode, err = strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+		if err != nil || statusCode < 100 || statusCode > 999 {
+			return nil, xerrors.Errorf("bad status of cgi response: %q", status)
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		statusCode = http.StatusFound
+	}
+
+	contentLength := int64(-1)
+	if s := header.Get("Content-Length"); s != "" {
+		if contentLength, err = strconv.ParseInt(s, 10, 64); err != nil {
+			contentLength = -1
+		}
+	}
+
+	return &http.Response{
+		Status:     strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode: statusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body: struct {
+			io.Reader
+			io.Closer
+		}{br, r},
+		ContentLength: contentLength,
+		Request:       req,
+	}, nil
+}
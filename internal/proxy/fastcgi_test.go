@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestFastCGIRoute_Script(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	f := fastCGIRoute{index: "index.php", splitPath: ".php"}
+	for _, test := range []struct{ path, script, pathInfo string }{
+		{"/", "/index.php", ""},
+		{"/blog/", "/blog/index.php", ""},
+		{"/info.php", "/info.php", ""},
+		{"/index.php/user/1", "/index.php", "/user/1"},
+		{"/INDEX.PHP/user", "/INDEX.PHP", "/user"},
+		{"/a.phpx/b.php/c", "/a.phpx/b.php", "/c"},
+		{"/image.png", "/image.png", ""},
+	} {
+		script, pathInfo := f.fastCGIScript(test.path)
+		td.Cmp(script, test.script, test.path)
+		td.Cmp(pathInfo, test.pathInfo, test.path)
+	}
+
+	f.splitPath = ""
+	script, pathInfo := f.fastCGIScript("/index.php/user/1")
+	td.Cmp(script, "/index.php/user/1")
+	td.Cmp(pathInfo, "")
+}
+
+func TestFastCGIRoute_Env(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	f := fastCGIRoute{root: "/var/www", index: "index.php", splitPath: ".php"}
+	req := httptest.NewRequest(http.MethodPost, "http://example.com:8080/index.php/user/1?a=b", strings.NewReader("body"))
+	req.RemoteAddr = "1.2.3.4:5678"
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Test", "test")
+	req.Header.Set("Proxy", "http://attacker")
+	td.Cmp(f.fastCGIEnv(req), map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "lets-proxy2",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"SERVER_NAME":       "example.com",
+		"SERVER_PORT":       "8080",
+		"REQUEST_METHOD":    http.MethodPost,
+		"REQUEST_URI":       "/index.php/user/1?a=b",
+		"QUERY_STRING":      "a=b",
+		"DOCUMENT_ROOT":     "/var/www",
+		"DOCUMENT_URI":      "/index.php/user/1",
+		"SCRIPT_NAME":       "/index.php",
+		"SCRIPT_FILENAME":   "/var/www/index.php",
+		"PATH_INFO":         "/user/1",
+		"PATH_TRANSLATED":   "/var/www/user/1",
+		"REMOTE_ADDR":       "1.2.3.4",
+		"REMOTE_PORT":       "5678",
+		"CONTENT_TYPE":      "text/plain",
+		"CONTENT_LENGTH":    "4",
+		"HTTP_X_TEST":       "test",
+		"HTTP_HOST":         "example.com:8080",
+	})
+}
+
+func TestNewDirectorRewrite_FastCGI(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	d, err := NewDirectorRewrite([]RewriteRuleConfig{
+		{Route: "*/unix/", UpstreamProto: "fastcgi", Backend: "unix:/run/php.sock", FastCGIRoot: "/var/www"},
+		{Route: "*/", UpstreamProto: "fastcgi", Backend: "127.0.0.1:9000", FastCGIRoot: "/var/www",
+			FastCGIIndex: "app.php", FastCGISplitPath: ".PHP"},
+	})
+	td.CmpNoError(err)
+	td.Cmp(d[0].fastCGI, &fastCGIRoute{address: "unix:/run/php.sock", root: "/var/www", index: "index.php"})
+	td.Cmp(d[0].backend, "")
+	td.Cmp(d[1].fastCGI, &fastCGIRoute{root: "/var/www", index: "app.php", splitPath: ".php"})
+	td.Cmp(d[1].backend, "127.0.0.1:9000")
+
+	for _, config := range []RewriteRuleConfig{
+		{Route: "*/", UpstreamProto: "scgi"},
+		{Route: "*/", FastCGIRoot: "/var/www"},
+		{Route: "*/", UpstreamProto: "fastcgi"},
+		{Route: "*/", UpstreamProto: "fastcgi", FastCGIRoot: "www"},
+		{Route: "*/", UpstreamProto: "fastcgi", FastCGIRoot: "/var/www", FastCGIIndex: "a/index.php"},
+		{Route: "*/", UpstreamProto: "fastcgi", FastCGIRoot: "/var/www", Backend: "unix:"},
+		{Route: "*/", Backend: "unix:/run/php.sock"},
+	} {
+		_, err = NewDirectorRewrite([]RewriteRuleConfig{config})
+		td.CmpError(err, config)
+	}
+}
+
+func TestHTTPProxy_FastCGI(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect.php" {
+			w.Header().Set("Location", "/")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		env := fcgi.ProcessEnv(r)
+		env["METHOD"] = r.Method
+		env["URI"] = r.URL.RequestURI()
+		env["TEST_HEADER"] = r.Header.Get("X-Test")
+		env["PROXY_HEADER"] = r.Header.Get("Proxy")
+		env["BODY"] = string(body)
+		w.Header().Set("X-Backend", "fastcgi")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(env)
+	})
+
+	tcpListener := th.NewLocalTcpListener(e)
+	go func() { _ = fcgi.Serve(tcpListener, handler) }()
+	socketPath := filepath.Join(th.TmpDir(e), "php.sock")
+	unixListener, err := net.Listen("unix", socketPath)
+	e.CmpNoError(err)
+	defer unixListener.Close()
+	go func() { _ = fcgi.Serve(unixListener, handler) }()
+
+	listener := th.NewLocalTcpListener(e)
+	proxy := NewHTTPProxy(e.Ctx, listener)
+	proxy.HTTPTransport = Transport{}
+	proxy.Director, err = NewDirectorRewrite([]RewriteRuleConfig{
+		{Route: "*/unix/", UpstreamProto: "fastcgi", Backend: "unix:" + socketPath, FastCGIRoot: "/var/www"},
+		{Route: "*/", UpstreamProto: "fastcgi", Backend: tcpListener.Addr().String(), FastCGIRoot: "/var/www",
+			FastCGISplitPath: ".php"},
+	})
+	e.CmpNoError(err)
+	go func() { _ = proxy.Start() }()
+	defer func() { _ = proxy.Close() }()
+
+	client := http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	request := func(method, path, body string) (*http.Response, map[string]string) {
+		req, err := http.NewRequest(method, "http://"+listener.Addr().String()+path, strings.NewReader(body))
+		e.CmpNoError(err)
+		req.Host = "example.com"
+		req.Header.Set("X-Test", "test")
+		req.Header.Set("Proxy", "http://attacker")
+		resp, err := client.Do(req)
+		e.CmpNoError(err)
+		defer resp.Body.Close()
+		env := map[string]string{}
+		if resp.StatusCode == http.StatusCreated {
+			e.CmpNoError(json.NewDecoder(resp.Body).Decode(&env))
+		}
+		return resp, env
+	}
+
+	resp, env := request(http.MethodPost, "/index.php/user/1?a=b", strings.Repeat("body", 20000))
+	e.Cmp(resp.StatusCode, http.StatusCreated)
+	e.Cmp(resp.Header.Get("X-Backend"), "fastcgi")
+	e.Cmp(env, testdeep.SuperMapOf(map[string]string{
+		"METHOD":          http.MethodPost,
+		"URI":             "/index.php/user/1?a=b",
+		"SCRIPT_FILENAME": "/var/www/index.php",
+		"DOCUMENT_ROOT":   "/var/www",
+		"SERVER_NAME":     "example.com",
+		"SERVER_PORT":     "80",
+		"TEST_HEADER":     "test",
+		"PROXY_HEADER":    "",
+		"BODY":            strings.Repeat("body", 20000),
+	}, nil))
+
+	resp, env = request(http.MethodGet, "/unix/", "")
+	e.Cmp(resp.StatusCode, http.StatusCreated)
+	e.Cmp(env["SCRIPT_FILENAME"], "/var/www/unix/index.php")
+
+	resp, _ = request(http.MethodGet, "/redirect.php", "")
+	e.Cmp(resp.StatusCode, http.StatusFound)
+	e.Cmp(resp.Header.Get("Location"), "/")
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+)
+
+const forwardProxyDialTimeout = 30 * time.Second
+
+type ForwardProxyConfig struct {
+	Enable              bool
+	AllowedDestinations []string
+	User                string
+	Password            string
+}
+
+// CreateHandler return nil handler if forward proxy disabled
+func (c *ForwardProxyConfig) CreateHandler(ctx context.Context) (*ForwardProxy, error) {
+	logger := zc.L(ctx)
+
+	if !c.Enable {
+		logger.Info("Forward proxy disabled")
+		return nil, nil
+	}
+
+	if len(c.AllowedDestinations) == 0 {
+		logger.Error("Forward proxy enabled without allowed destinations")
+		return nil, errors.New("forward proxy need allowed destinations")
+	}
+
+	res := &ForwardProxy{user: c.User, password: c.Password}
+	for _, line := range c.AllowedDestinations {
+		dest, err := parseForwardDestination(line)
+		log.DebugError(logger, err, "Parse forward proxy allowed destination", zap.String("line", line))
+		if err != nil {
+			return nil, err
+		}
+		res.allowed = append(res.allowed, dest)
+	}
+
+	if c.User == "" && c.Password == "" {
+		logger.Warn("Forward proxy enabled without authentication")
+	}
+	logger.Info("Forward proxy enabled", zap.Strings("allowed_destinations", c.AllowedDestinations))
+	return res, nil
+}
+
+// ForwardProxy handle CONNECT requests: create tunnel to allowed destination
+type ForwardProxy struct {
+	allowed  []forwardDestination
+	user     string
+	password string
+}
+
+type forwardDestination struct {
+	domain         string // lower case, empty if network set
+	wildcardDomain bool   // match subdomains of domain
+	network        *net.IPNet
+	port           string // "*" for any port
+}
+
+// parseForwardDestination parse lines: "example.com:443", "*.example.com:443", "10.0.0.1:22", "10.0.0.0/8:*", "[::1]:80"
+func parseForwardDestination(line string) (forwardDestination, error) {
+	line = strings.TrimSpace(line)
+	index := strings.LastIndex(line, ":")
+	if index <= 0 || index == len(line)-1 {
+		return forwardDestination{}, errors.New("forward destination must be in form host:port")
+	}
+	host, port := line[:index], line[index+1:]
+	if port != "*" {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return forwardDestination{}, errors.New("bad port in forward destination")
+		}
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	var res = forwardDestination{port: port}
+	if strings.Contains(host, "/") {
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return forwardDestination{}, err
+		}
+		res.network = network
+		return res, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		res.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return res, nil
+	}
+
+	host = strings.ToLower(host)
+	if strings.HasPrefix(host, "*.") {
+		res.wildcardDomain = true
+		host = strings.TrimPrefix(host, "*")
+	}
+	if host == "" || host == "." || strings.Contains(host, "*") {
+		return forwardDestination{}, errors.New("bad host in forward destination")
+	}
+	res.domain = host
+	return res, nil
+}
+
+func (d forwardDestination) allow(host, port string) bool {
+	if d.port != "*" && d.port != port {
+		return false
+	}
+	if d.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && d.network.Contains(ip)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if d.wildcardDomain {
+		return strings.HasSuffix(host, d.domain)
+	}
+	return host == d.domain
+}
+
+func (p *ForwardProxy) isAllowed(host, port string) bool {
+	for _, dest := range p.allowed {
+		if dest.allow(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ForwardProxy) checkAuth(r *http.Request) bool {
+	if p.user == "" && p.password == "" {
+		return true
+	}
+
+	const prefix = "Basic "
+	auth := r.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, prefix))
+	if err != nil {
+		return false
+	}
+	expected := []byte(p.user + ":" + p.password)
+	return subtle.ConstantTimeCompare(decoded, expected) == 1
+}
+
+func (p *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := zc.L(r.Context()).With(zap.String("destination", r.Host))
+
+	if r.Method != http.MethodConnect {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !p.checkAuth(r) {
+		logger.Info("Forward proxy authentication failed")
+		w.Header().Set("Proxy-Authenticate", `Basic realm="lets-proxy"`)
+		http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil || !p.isAllowed(host, port) {
+		logger.Warn("Forward proxy destination denied", zap.Error(err))
+		http.Error(w, "Destination denied", http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		logger.Warn("Forward proxy doesn't support the protocol version", zap.String("proto", r.Proto))
+		http.Error(w, "Protocol doesn't supported", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	dialer := net.Dialer{Timeout: forwardProxyDialTimeout}
+	destConn, err := dialer.DialContext(r.Context(), "tcp", r.Host)
+	log.DebugInfo(logger, err, "Dial forward proxy destination")
+	if err != nil {
+		http.Error(w, "Can't connect to destination", http.StatusBadGateway)
+		return
+	}
+	defer func() { _ = destConn.Close() }()
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	log.DebugError(logger, err, "Hijack forward proxy connection")
+	if err != nil {
+		return
+	}
+	defer func() { _ = clientConn.Close() }()
+
+	_, err = clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		log.DebugInfo(logger, err, "Write connect answer")
+		return
+	}
+
+	logger.Info("Forward proxy tunnel established")
+	pipeConnections(clientConn, clientBuf, destConn)
+	logger.Debug("Forward proxy tunnel closed")
+}
+
+// pipeConnections copy data in both directions until one of side close connection
+func pipeConnections(client net.Conn, clientReader io.Reader, dest net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2) //nolint:gomnd
+
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(dest, clientReader)
+		closeWrite(dest)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(client, dest)
+		closeWrite(client)
+	}()
+	wg.Wait()
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+	} else {
+		_ = conn.Close()
+	}
+}
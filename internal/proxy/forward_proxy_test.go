@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestParseForwardDestination(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	for _, bad := range []string{"", "example.com", "example.com:", ":80", "example.com:abc", "a*.com:80", "10.0.0.0/99:80"} {
+		_, err := parseForwardDestination(bad)
+		td.CmpError(err, bad)
+	}
+
+	dest, err := parseForwardDestination("Example.com:443")
+	td.CmpNoError(err)
+	td.True(dest.allow("example.com", "443"))
+	td.True(dest.allow("EXAMPLE.COM.", "443"))
+	td.False(dest.allow("example.com", "80"))
+	td.False(dest.allow("www.example.com", "443"))
+
+	dest, err = parseForwardDestination("*.example.com:*")
+	td.CmpNoError(err)
+	td.True(dest.allow("www.example.com", "80"))
+	td.False(dest.allow("example.com", "80"))
+	td.False(dest.allow("wwwexample.com", "80"))
+
+	dest, err = parseForwardDestination("10.0.0.0/8:22")
+	td.CmpNoError(err)
+	td.True(dest.allow("10.1.2.3", "22"))
+	td.False(dest.allow("11.1.2.3", "22"))
+	td.False(dest.allow("10.1.2.3.example.com", "22"))
+
+	dest, err = parseForwardDestination("[::1]:80")
+	td.CmpNoError(err)
+	td.True(dest.allow("::1", "80"))
+	td.False(dest.allow("::2", "80"))
+}
+
+func TestForwardProxyConfig_CreateHandler(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	c := ForwardProxyConfig{}
+	handler, err := c.CreateHandler(ctx)
+	td.CmpNoError(err)
+	td.Nil(handler)
+
+	c = ForwardProxyConfig{Enable: true}
+	_, err = c.CreateHandler(ctx)
+	td.CmpError(err)
+
+	c = ForwardProxyConfig{Enable: true, AllowedDestinations: []string{"asd"}}
+	_, err = c.CreateHandler(ctx)
+	td.CmpError(err)
+
+	c = ForwardProxyConfig{Enable: true, AllowedDestinations: []string{"asd:80"}}
+	handler, err = c.CreateHandler(ctx)
+	td.CmpNoError(err)
+	td.NotNil(handler)
+}
+
+func TestForwardProxy_ServeHTTP(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	td.FailureIsFatal()
+
+	destination, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	defer th.Close(destination)
+	go func() {
+		conn, err := destination.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("tunnel-ok"))
+		_ = conn.Close()
+	}()
+
+	c := ForwardProxyConfig{
+		Enable:              true,
+		AllowedDestinations: []string{destination.Addr().String()},
+		User:                "user",
+		Password:            "pass",
+	}
+	forwardProxy, err := c.CreateHandler(ctx)
+	td.CmpNoError(err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardProxy.ServeHTTP(w, r.WithContext(ctx))
+	}))
+	defer server.Close()
+
+	connect := func(dest string, auth string) (*http.Response, *bufio.Reader) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		td.CmpNoError(err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+dest, nil)
+		req.Host = dest
+		if auth != "" {
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+		}
+		td.CmpNoError(req.Write(conn))
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, req)
+		td.CmpNoError(err)
+		return resp, reader
+	}
+
+	resp, _ := connect(destination.Addr().String(), "")
+	td.Cmp(resp.StatusCode, http.StatusProxyAuthRequired)
+
+	resp, _ = connect(destination.Addr().String(), "user:bad")
+	td.Cmp(resp.StatusCode, http.StatusProxyAuthRequired)
+
+	resp, _ = connect("127.0.0.2:1", "user:pass")
+	td.Cmp(resp.StatusCode, http.StatusForbidden)
+
+	resp, reader := connect(destination.Addr().String(), "user:pass")
+	td.Cmp(resp.StatusCode, http.StatusOK)
+	answer, err := ioutil.ReadAll(reader)
+	td.CmpNoError(err)
+	td.Cmp(string(answer), "tunnel-ok")
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+// Modes of Strict-Transport-Security header
+const (
+	HSTSDisabled     = "disabled"
+	HSTSEnabled      = "enabled"
+	HSTSPreloadReady = "preload-ready" // max-age at least one year, includeSubDomains and preload, https only
+)
+
+// Handle of requests on plain http connections (without tls)
+const (
+	PlainHTTPAllow    = "allow"
+	PlainHTTPRedirect = "redirect" // permanent redirect to https on same host
+	PlainHTTPReject   = "reject"
+)
+
+// HSTSPreloadMinMaxAge - min max-age, required for include domain to HSTS preload list (https://hstspreload.org)
+const HSTSPreloadMinMaxAge = 365 * 24 * time.Hour
+
+// NewHSTS return value of Strict-Transport-Security header, empty for disabled mode.
+// In preload-ready mode includeSubDomains and preload added always and maxAge raised to HSTSPreloadMinMaxAge.
+func NewHSTS(mode string, maxAge time.Duration, includeSubDomains bool) (string, error) {
+	if maxAge < 0 {
+		return "", xerrors.Errorf("negative hsts max age: %v", maxAge)
+	}
+	switch mode {
+	case HSTSDisabled, "":
+		return "", nil
+	case HSTSEnabled:
+	case HSTSPreloadReady:
+		if maxAge < HSTSPreloadMinMaxAge {
+			maxAge = HSTSPreloadMinMaxAge
+		}
+		includeSubDomains = true
+	default:
+		return "", xerrors.Errorf("unknown hsts mode: %q", mode)
+	}
+
+	res := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if includeSubDomains {
+		res += "; includeSubDomains"
+	}
+	if mode == HSTSPreloadReady {
+		res += "; preload"
+	}
+	return res, nil
+}
+
+// checkPlainHTTPMode check mode of plain http requests, preload-ready hsts need https only
+func checkPlainHTTPMode(mode, hstsMode string) error {
+	switch mode {
+	case PlainHTTPAllow, "":
+		if hstsMode == HSTSPreloadReady {
+			return xerrors.Errorf("hsts mode %q need redirect or reject plain http requests", hstsMode)
+		}
+		return nil
+	case PlainHTTPRedirect, PlainHTTPReject:
+		return nil
+	default:
+		return xerrors.Errorf("unknown plain http mode: %q", mode)
+	}
+}
+
+// isPlainHTTP return true for requests on connections without tls, false if it unknown
+func (p *HTTPProxy) isPlainHTTP(r *http.Request) bool {
+	ctx, err := p.GetContext(r)
+	if err != nil {
+		return false
+	}
+	isTLS, ok := ctx.Value(contextlabel.TLSConnection).(bool)
+	return ok && !isTLS
+}
+
+// setHSTS add Strict-Transport-Security header to responses of tls connections only, rfc 6797 section 7.2
+func (p *HTTPProxy) setHSTS(w http.ResponseWriter, r *http.Request) {
+	if p.HSTS == "" {
+		return
+	}
+	ctx, err := p.GetContext(r)
+	if err != nil {
+		return
+	}
+	if isTLS, _ := ctx.Value(contextlabel.TLSConnection).(bool); isTLS {
+		w.Header().Set("Strict-Transport-Security", p.HSTS)
+	}
+}
+
+// handlePlainHTTP redirect to https or reject requests on plain http connections, by PlainHTTP mode.
+// Redirect target is default https port of same host.
+func (p *HTTPProxy) handlePlainHTTP(w http.ResponseWriter, r *http.Request) bool {
+	if p.PlainHTTP != PlainHTTPRedirect && p.PlainHTTP != PlainHTTPReject || !p.isPlainHTTP(r) {
+		return false
+	}
+	if p.PlainHTTP == PlainHTTPReject {
+		http.Error(w, "HTTPS required", http.StatusForbidden)
+		return true
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	return true
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+func TestNewHSTS(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	res, err := NewHSTS(HSTSDisabled, time.Hour, true)
+	td.CmpNoError(err)
+	td.Cmp(res, "")
+
+	res, err = NewHSTS(HSTSEnabled, time.Hour, false)
+	td.CmpNoError(err)
+	td.Cmp(res, "max-age=3600")
+
+	res, err = NewHSTS(HSTSEnabled, time.Hour, true)
+	td.CmpNoError(err)
+	td.Cmp(res, "max-age=3600; includeSubDomains")
+
+	res, err = NewHSTS(HSTSPreloadReady, time.Hour, false)
+	td.CmpNoError(err)
+	td.Cmp(res, "max-age=31536000; includeSubDomains; preload")
+
+	res, err = NewHSTS(HSTSPreloadReady, 2*HSTSPreloadMinMaxAge, false)
+	td.CmpNoError(err)
+	td.Cmp(res, "max-age=63072000; includeSubDomains; preload")
+
+	_, err = NewHSTS("bad", time.Hour, false)
+	td.CmpError(err)
+	_, err = NewHSTS(HSTSEnabled, -time.Second, false)
+	td.CmpError(err)
+}
+
+func TestHTTPProxy_HSTS(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	check := func(plainHTTP string, isTLS interface{}, host string) (*httptest.ResponseRecorder, bool) {
+		p := &HTTPProxy{HSTS: "max-age=60", PlainHTTP: plainHTTP, GetContext: func(_ *http.Request) (context.Context, error) {
+			return context.WithValue(context.Background(), contextlabel.TLSConnection, isTLS), nil
+		}}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "http://"+host+"/path?a=b", nil)
+		p.setHSTS(w, r)
+		return w, p.handlePlainHTTP(w, r)
+	}
+
+	w, handled := check(PlainHTTPRedirect, true, "example.com")
+	td.False(handled)
+	td.Cmp(w.Header().Get("Strict-Transport-Security"), "max-age=60")
+
+	w, handled = check(PlainHTTPRedirect, false, "example.com:80")
+	td.True(handled)
+	td.Cmp(w.Code, http.StatusPermanentRedirect)
+	td.Cmp(w.Header().Get("Location"), "https://example.com/path?a=b")
+	td.Cmp(w.Header().Get("Strict-Transport-Security"), "")
+
+	w, handled = check(PlainHTTPReject, false, "sub.example.com")
+	td.True(handled)
+	td.Cmp(w.Code, http.StatusForbidden)
+
+	_, handled = check(PlainHTTPAllow, false, "example.com")
+	td.False(handled)
+
+	// unknown connection type
+	_, handled = check(PlainHTTPReject, nil, "example.com")
+	td.False(handled)
+}
@@ -6,8 +6,11 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync/atomic"
 	"time"
 
+	"github.com/rekby/fastuuid"
+
 	"github.com/rekby/lets-proxy2/internal/contexthelper"
 
 	"github.com/rekby/lets-proxy2/internal/contextlabel"
@@ -26,9 +29,64 @@ type Director interface {
 type HTTPProxy struct {
 	GetContext           func(req *http.Request) (context.Context, error)
 	HandleHTTPValidation func(w http.ResponseWriter, r *http.Request) bool
-	Director             Director // modify requests to backend.
+	ConnectHandler       http.Handler // handle CONNECT requests, if nil - CONNECT proxy to backend as usual
+	Director             Director     // modify requests to backend.
 	HTTPTransport        http.RoundTripper
 	EnableAccessLog      bool
+	ErrorPages           *ErrorPages    // custom pages for backend errors, if nil - empty response with error status
+	BackendDown          *BackendDown   // behavior while backend doesn't accept connections, if nil - fail fast
+	ResponseCache        *ResponseCache // cache of responses for GET and HEAD requests, if nil - without cache
+	AltSvc               string         // Alt-Svc header for responses of tls connections, empty - without header
+	HSTS                 string         // Strict-Transport-Security header for responses of tls connections, empty - without header
+	PlainHTTP            string         // handle of requests on plain http connections: PlainHTTPAllow (or empty), PlainHTTPRedirect, PlainHTTPReject
+	MissingHost          string         // MissingHostReject - reject requests without host, other modes handled by DirectorMissingHost
+	DebugCapture         *DebugCapture  // capture exchanges with backends to file, if nil - without capture
+	Retries              *Retries       // timeouts and retries of requests to backends by routes, if nil - without retries
+	ClientCert           *ClientCerts   // identity of clients by client certificates, if nil - client certificates ignored
+	Splits               Splits         // split of routes between stable and canary backends, empty - without split
+	BufferPool           *BufferPool    // buffers for copy response bodies, if nil - new buffer for every response
+	LoopDetection        *LoopDetection // reject requests, looped through proxy, if nil - without Via header and check
+	AllowedMethods       []string       // methods of requests to routes without own allowed methods, empty - any
+	RouteHostWithPort    bool           // match routes by host with port of Host header, false - port removed before match
+
+	// RequestCoalescing - collapse identical GET requests to backend, nil - without coalescing.
+	RequestCoalescing *RequestCoalescing
+
+	// LongLived - rewrite rules for detect long-lived routes, which requests exempted from ReadTimeout,
+	// WriteTimeout and slow connections detection. nil - without long-lived routes.
+	LongLived DirectorRewrite
+
+	// AllowedMethodsRules - rewrite rules for detect allowed methods of routes. nil - without methods of routes.
+	// Ignored if Director is ReloadableDirector: rules of its current routes used.
+	AllowedMethodsRules DirectorRewrite
+
+	// AnswerExpectContinue - proxy answer "100 Continue" itself on first read of request body, Expect header
+	// removed from backend request and body sent without wait backend. false - Expect header forwarded to backend
+	// and its 100 Continue relayed to client, body doesn't read before it (or Transport.ExpectContinueTimeout).
+	AnswerExpectContinue bool
+
+	// FlushInterval - period of flush response to client while copy body from backend, 0 - flush after copy.
+	// Streamed responses (without content length, server-sent events, StreamContentTypes) flushed immediately.
+	FlushInterval      time.Duration
+	StreamContentTypes StreamContentTypes
+
+	// MaxHeaderBytes - max size of request headers, 0 - http.DefaultMaxHeaderBytes.
+	// MaxHeaders - max count of request headers, 0 - unlimited.
+	// Requests with bigger headers rejected with 431 status before route to backend.
+	MaxHeaderBytes int
+	MaxHeaders     int
+
+	// Timeouts of incoming requests, 0 - without timeout. ReadHeaderTimeout - read request headers,
+	// ReadTimeout - read full request with body, WriteTimeout - from end of read headers to end of write response.
+	// Read and write timeouts removed for tunnels (websockets, CONNECT) and streamed responses (server-sent events,
+	// StreamContentTypes). IdleTimeout - wait next request on keep-alive connection.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+
+	RequestIDHeader         string        // header for request id, empty - without request id
+	RequestIDAcceptIncoming bool          // use request id from incoming request if it present
+	RequestIDGenerator      func() string // generate new request id
 
 	logger           *zap.Logger
 	listener         net.Listener
@@ -45,6 +103,9 @@ func NewHTTPProxy(ctx context.Context, listener net.Listener) *HTTPProxy {
 		},
 		Director:   NewDirectorSameIP(defaultHTTPPort),
 		GetContext: getContext,
+
+		RequestIDGenerator: fastuuid.MustUUIDv4String,
+
 		listener:   listener,
 		logger:     zc.L(ctx),
 		httpServer: http.Server{},
@@ -57,6 +118,11 @@ func (p *HTTPProxy) Close() error {
 	return p.httpServer.Close()
 }
 
+// Shutdown gracefully stop proxy: close listener and wait for finish active requests or ctx done.
+func (p *HTTPProxy) Shutdown(ctx context.Context) error {
+	return p.httpServer.Shutdown(ctx)
+}
+
 // Start - finish initialization of proxy and start handling request.
 // It is sync method, always return with non nil error: if handle stopped by context or if error on start handling.
 // Any public fields must not change after Start called
@@ -66,37 +132,189 @@ func (p *HTTPProxy) Start() error {
 		p.httpReverseProxy.Transport = p.HTTPTransport
 	}
 
+	if p.DebugCapture != nil {
+		p.httpReverseProxy.Transport = p.DebugCapture.wrap(p.httpReverseProxy.Transport)
+	}
+
+	if p.Retries != nil {
+		p.httpReverseProxy.Transport = p.Retries.wrap(p.httpReverseProxy.Transport)
+	}
+
+	if p.BackendDown != nil {
+		p.httpReverseProxy.Transport = p.BackendDown.wrap(p.httpReverseProxy.Transport)
+	}
+
+	// under response cache: coalesce requests, which missed the cache
+	if p.RequestCoalescing != nil {
+		p.httpReverseProxy.Transport = p.RequestCoalescing.wrap(p.httpReverseProxy.Transport)
+	}
+
+	if p.ResponseCache != nil {
+		p.httpReverseProxy.Transport = p.ResponseCache.wrap(p.httpReverseProxy.Transport)
+	}
+
 	if p.EnableAccessLog {
 		p.httpReverseProxy.Transport = NewTransportLogger(p.httpReverseProxy.Transport)
 	}
 	p.logger.Info("Access log", zap.Bool("enabled", p.EnableAccessLog))
 
+	if p.ErrorPages != nil {
+		p.httpReverseProxy.ErrorHandler = p.errorHandler
+	}
+
+	p.httpReverseProxy.FlushInterval = p.FlushInterval
+	if p.BufferPool != nil {
+		p.httpReverseProxy.BufferPool = p.BufferPool
+	}
+	if len(p.StreamContentTypes) > 0 || p.ReadTimeout > 0 || p.WriteTimeout > 0 || p.LongLived != nil {
+		p.httpReverseProxy.ModifyResponse = p.modifyResponse
+	}
+
 	p.httpServer.Handler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		if !p.HandleHTTPValidation(writer, request) {
-			p.httpReverseProxy.ServeHTTP(writer, request)
+		if p.handleTooManyHeaders(writer, request) || p.handleMissingHost(writer, request) ||
+			p.handleLoop(writer, request) {
+			return
+		}
+		request = p.withRouteHostWithPort(request)
+		request = p.withRequestID(writer, request)
+		request = p.exemptTimeouts(writer, request)
+		request = p.withClientCert(request)
+		request = p.withLongLived(request)
+		p.setAltSvc(writer, request)
+		p.setHSTS(writer, request)
+		if p.handleDomainDenied(writer, request) || p.handleClientCertRequired(writer, request) ||
+			p.handleMethodNotAllowed(writer, request) {
+			return
 		}
+		p.exemptSlowConnection(request)
+		if p.ConnectHandler != nil && request.Method == http.MethodConnect {
+			p.ConnectHandler.ServeHTTP(writer, p.withConnectionContext(request))
+			return
+		}
+		if p.handleHTTPValidation(writer, request) || p.handlePlainHTTP(writer, request) {
+			return
+		}
+		request = p.withSplit(writer, request)
+		p.httpReverseProxy.ServeHTTP(writer, request)
 	})
 	p.httpServer.IdleTimeout = p.IdleTimeout
+	p.httpServer.ReadHeaderTimeout = p.ReadHeaderTimeout
+	p.httpServer.ReadTimeout = p.ReadTimeout
+	p.httpServer.WriteTimeout = p.WriteTimeout
+	p.httpServer.MaxHeaderBytes = p.MaxHeaderBytes
 
 	p.logger.Info("Http builtin reverse proxy start")
 	err := p.httpServer.Serve(p.listener)
 	return err
 }
 
+// handleHTTPValidation doesn't answer to acme challenges on connections of listeners with disabled challenges
+func (p *HTTPProxy) handleHTTPValidation(w http.ResponseWriter, r *http.Request) bool {
+	if ctx, err := p.GetContext(r); err == nil && ctx.Value(contextlabel.ChallengesDisabled) == true {
+		return false
+	}
+	return p.HandleHTTPValidation(w, r)
+}
+
+// handleDomainDenied deny requests on connections, which got fallback certificate because domain denied.
+// Response is 403 error page (can be redirect) or empty response with 403 status.
+func (p *HTTPProxy) handleDomainDenied(w http.ResponseWriter, r *http.Request) bool {
+	ctx, err := p.GetContext(r)
+	if err != nil {
+		return false
+	}
+	denied, ok := ctx.Value(contextlabel.DomainDenied).(*int32)
+	if !ok || atomic.LoadInt32(denied) == 0 {
+		return false
+	}
+
+	zc.L(ctx).Info("Deny request to denied domain", zap.String("host", r.Host))
+	if !p.ErrorPages.Write(w, r, http.StatusForbidden) {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	return true
+}
+
+// handleTooManyHeaders reject requests with more than MaxHeaders headers by 431 status.
+// Size of headers limited by http server.
+func (p *HTTPProxy) handleTooManyHeaders(w http.ResponseWriter, r *http.Request) bool {
+	if p.MaxHeaders <= 0 {
+		return false
+	}
+	count := 0
+	for _, values := range r.Header {
+		count += len(values)
+	}
+	if count <= p.MaxHeaders {
+		return false
+	}
+
+	p.logger.Info("Reject request with too many headers", zap.Int("headers", count),
+		zap.Int("max_headers", p.MaxHeaders), zap.String("remote_addr", r.RemoteAddr), zap.String("host", r.Host))
+	if !p.ErrorPages.Write(w, r, http.StatusRequestHeaderFieldsTooLarge) {
+		w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+	}
+	return true
+}
+
+// exemptSlowConnection exempt tunnels (websockets and CONNECT) and requests to long-lived routes
+// from slow connections detection, because they may be idle intentionally.
+func (p *HTTPProxy) exemptSlowConnection(r *http.Request) {
+	if !isTunnel(r) && r.Context().Value(contextlabel.LongLivedRoute) == nil {
+		return
+	}
+	if ctx, err := p.GetContext(r); err == nil {
+		if exempt, ok := ctx.Value(contextlabel.SlowConnectionExempt).(func()); ok {
+			exempt()
+		}
+	}
+}
+
 func getContext(_ *http.Request) (context.Context, error) {
 	return zc.WithLogger(context.WithValue(context.Background(), contextlabel.ConnectionID, "conn-id-none"), zap.NewNop()), nil
 }
 
-func (p *HTTPProxy) director(request *http.Request) {
+func (p *HTTPProxy) withConnectionContext(request *http.Request) *http.Request {
 	ctx, err := p.GetContext(request)
+	log.DebugDPanic(zc.L(ctx), err, "Get connection context for request")
+	var combinedCtx context.Context = contexthelper.CombineContext(ctx, request.Context())
+	if requestID := RequestIDFromContext(request.Context()); requestID != "" {
+		combinedCtx = zc.WithLogger(combinedCtx, zc.L(combinedCtx).With(zap.String("request_id", requestID)))
+	}
+	return request.WithContext(combinedCtx)
+}
 
-	logger := zc.L(ctx)
-	log.DebugDPanic(logger, err, "Get connection context for request")
-	*request = *request.WithContext(contexthelper.CombineContext(ctx, request.Context()))
+func (p *HTTPProxy) director(request *http.Request) {
+	*request = *p.withConnectionContext(request)
+	logger := zc.L(request.Context())
 
 	if request.URL == nil {
 		request.URL = &url.URL{}
 	}
-	err = p.Director.Director(request)
+	if setRequest, ok := request.Context().Value(contextlabel.ConnectionRequest).(func(host, path string)); ok {
+		setRequest(request.Host, request.URL.Path)
+	}
+	err := p.Director.Director(request)
 	log.DebugPanic(logger, err, "Apply directors")
+
+	if backend, ok := request.Context().Value(contextlabel.SplitBackend).(string); ok {
+		request.URL.Host = backend
+	}
+
+	if p.AnswerExpectContinue {
+		request.Header.Del("Expect")
+	}
+	p.LoopDetection.addVia(request)
+
+	if setBackend, ok := request.Context().Value(contextlabel.ConnectionBackend).(func(string)); ok {
+		setBackend(request.URL.Host)
+	}
+}
+
+func (p *HTTPProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	statusCode := backendErrorStatus(err)
+	zc.L(r.Context()).Warn("Backend request failed", zap.Int("status_code", statusCode), zap.Error(err))
+	if !p.ErrorPages.Write(w, r, statusCode) {
+		w.WriteHeader(statusCode)
+	}
 }
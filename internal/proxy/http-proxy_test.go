@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -16,8 +17,10 @@ import (
 	"github.com/maxatome/go-testdeep"
 	"github.com/rekby/fixenv"
 	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
 	"golang.org/x/xerrors"
 
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
 	"github.com/rekby/lets-proxy2/internal/th"
 )
 
@@ -196,3 +199,146 @@ func httpProxy(e *th.Env, dst string) (*HTTPProxy, string) {
 	})
 	return proxy, addr
 }
+
+func TestHttpProxy_exemptSlowConnection(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	var exempted int
+	connCtx := context.WithValue(context.Background(), contextlabel.SlowConnectionExempt, func() { exempted++ })
+	p := &HTTPProxy{GetContext: func(req *http.Request) (context.Context, error) {
+		return connCtx, nil
+	}}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	p.exemptSlowConnection(req)
+	td.Cmp(exempted, 0)
+
+	req.Header.Set("Upgrade", "WebSocket")
+	p.exemptSlowConnection(req)
+	td.Cmp(exempted, 1)
+
+	p.exemptSlowConnection(httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil))
+	td.Cmp(exempted, 2)
+
+	// detection disabled
+	connCtx = context.Background()
+	p.exemptSlowConnection(req)
+	td.Cmp(exempted, 2)
+}
+
+func TestHttpProxy_handleDomainDenied(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	denied := new(int32)
+	connCtx := zc.WithLogger(context.WithValue(context.Background(), contextlabel.DomainDenied, denied), zap.NewNop())
+	p := &HTTPProxy{GetContext: func(req *http.Request) (context.Context, error) {
+		return connCtx, nil
+	}}
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	resp := httptest.NewRecorder()
+	td.False(p.handleDomainDenied(resp, req))
+
+	atomic.StoreInt32(denied, 1)
+	td.True(p.handleDomainDenied(resp, req))
+	td.Cmp(resp.Code, http.StatusForbidden)
+
+	var err error
+	p.ErrorPages, err = NewErrorPages(map[int]string{http.StatusForbidden: "https://example.com/denied"})
+	td.CmpNoError(err)
+	resp = httptest.NewRecorder()
+	td.True(p.handleDomainDenied(resp, req))
+	td.Cmp(resp.Code, http.StatusFound)
+	td.Cmp(resp.Header().Get("Location"), "https://example.com/denied")
+
+	// without fallback certificate
+	connCtx = context.Background()
+	td.False(p.handleDomainDenied(httptest.NewRecorder(), req))
+}
+
+func TestHTTPProxy_HeadersLimits(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	var backendRequests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backendRequests, 1)
+	}))
+	defer backend.Close()
+
+	listener := th.NewLocalTcpListener(e)
+	proxy := NewHTTPProxy(ctx, listener)
+	proxy.Director = NewDirectorChain(NewDirectorHost(backend.Listener.Addr().String()), NewSetSchemeDirector(ProtocolHTTP))
+	proxy.MaxHeaderBytes = 1024
+	proxy.MaxHeaders = 3
+	go func() { _ = proxy.Start() }()
+	defer func() { _ = proxy.Close() }()
+
+	client := http.Client{Timeout: 10 * time.Second}
+	do := func(headers map[string]string) int {
+		req, err := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/", nil)
+		e.CmpNoError(err)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := client.Do(req)
+		if !e.CmpNoError(err) {
+			return 0
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// go client send User-Agent and Accept-Encoding
+	e.Cmp(do(map[string]string{"X-Test": "1"}), http.StatusOK)
+	e.Cmp(atomic.LoadInt32(&backendRequests), int32(1))
+
+	e.Cmp(do(map[string]string{"X-Test": "1", "X-Test2": "2"}), http.StatusRequestHeaderFieldsTooLarge)
+	// http server allow 4096 bytes over limit
+	e.Cmp(do(map[string]string{"X-Test": strings.Repeat("a", 10000)}), http.StatusRequestHeaderFieldsTooLarge)
+	e.Cmp(atomic.LoadInt32(&backendRequests), int32(1))
+}
+
+func TestHTTPProxy_ExpectContinue(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	// backend reject requests with Expect header before read body and echo body of other requests
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Expect") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+
+	client := http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	do := func(answerExpectContinue bool) (int, string) {
+		listener := th.NewLocalTcpListener(e)
+		proxy := NewHTTPProxy(ctx, listener)
+		proxy.Director = NewDirectorChain(NewDirectorHost(backend.Listener.Addr().String()), NewSetSchemeDirector(ProtocolHTTP))
+		proxy.AnswerExpectContinue = answerExpectContinue
+		go func() { _ = proxy.Start() }()
+		defer func() { _ = proxy.Close() }()
+
+		req, err := http.NewRequest(http.MethodPut, "http://"+listener.Addr().String()+"/", strings.NewReader("body"))
+		e.CmpNoError(err)
+		req.Header.Set("Expect", "100-continue")
+		resp, err := client.Do(req)
+		if !e.CmpNoError(err) {
+			return 0, ""
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, _ := do(false)
+	e.Cmp(status, http.StatusForbidden)
+
+	status, body := do(true)
+	e.Cmp(status, http.StatusOK)
+	e.Cmp(body, "body")
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
+)
+
+const http2TestContentType = "application/x-test-stream"
+
+// http2TestBackend is h2c server with unary answer and line-by-line echo stream.
+// Status send in unannounced trailer after body.
+func http2TestBackend(t *testing.T) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != http2TestContentType || r.Header.Get("Te") != "trailers" {
+			t.Errorf("Bad request: proto %v, headers: %v", r.Proto, r.Header)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", http2TestContentType)
+		w.WriteHeader(http.StatusOK)
+		switch r.URL.Path {
+		case "/unary":
+			_, _ = io.Copy(io.Discard, r.Body)
+			_, _ = w.Write([]byte("OK\n"))
+		case "/stream":
+			reader := bufio.NewReader(r.Body)
+			for {
+				message, err := reader.ReadString('\n')
+				if err != nil {
+					break
+				}
+				_, _ = w.Write([]byte("echo: " + message))
+				w.(http.Flusher).Flush()
+			}
+		default:
+			w.Header().Set(http.TrailerPrefix+"X-Status", "not found")
+			return
+		}
+		w.Header().Set(http.TrailerPrefix+"X-Status", "ok")
+	})
+
+	server := httptest.NewUnstartedServer(h2c.NewHandler(handler, &http2.Server{}))
+	server.Start()
+	return server
+}
+
+func TestHTTPProxy_HTTP2Backend(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	backend := http2TestBackend(t)
+	defer backend.Close()
+
+	cert := testcert.New(t, x509.Certificate{DNSNames: []string{"localhost"}}, nil, nil)
+	listener := tls.NewListener(th.NewLocalTcpListener(e), &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"h2"},
+	})
+	proxy := NewHTTPProxy(e.Ctx, listener)
+	proxy.Director = NewDirectorChain(NewDirectorHost(backend.Listener.Addr().String()), NewSetSchemeDirector(ProtocolHTTP))
+	proxy.HTTPTransport = Transport{HTTP2: true}
+	go func() { _ = proxy.Start() }()
+	defer func() { _ = proxy.Close() }()
+
+	client := http.Client{
+		Timeout: time.Second * 10,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+			ForceAttemptHTTP2: true,
+		},
+	}
+	proxyURL := "https://" + listener.Addr().String()
+
+	newRequest := func(path string, body io.Reader) *http.Request {
+		req, err := http.NewRequest(http.MethodPost, proxyURL+path, body)
+		e.CmpNoError(err)
+		req.Header.Set("Content-Type", http2TestContentType)
+		req.Header.Set("Te", "trailers")
+		return req
+	}
+
+	t.Run("Unary", func(t *testing.T) {
+		td := testdeep.NewT(t).FailureIsFatal()
+
+		resp, err := client.Do(newRequest("/unary", strings.NewReader("request\n")))
+		td.CmpNoError(err)
+		defer func() { _ = resp.Body.Close() }()
+
+		body, err := io.ReadAll(resp.Body)
+		td.CmpNoError(err)
+
+		td.Cmp(resp.ProtoMajor, 2)
+		td.Cmp(resp.Header.Get("Content-Type"), http2TestContentType)
+		td.Cmp(string(body), "OK\n")
+		td.Cmp(resp.Trailer.Get("X-Status"), "ok")
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		td := testdeep.NewT(t).FailureIsFatal()
+
+		messages := []string{"first\n", "second\n", "third\n"}
+		bodyReader, bodyWriter := io.Pipe()
+
+		// response headers sent by backend with first answer
+		go func() { _, _ = bodyWriter.Write([]byte(messages[0])) }()
+		resp, err := client.Do(newRequest("/stream", bodyReader))
+		td.CmpNoError(err)
+		defer func() { _ = resp.Body.Close() }()
+
+		// every answer must be received before next message sent
+		respReader := bufio.NewReader(resp.Body)
+		for i, message := range messages {
+			if i > 0 {
+				_, err = bodyWriter.Write([]byte(message))
+				td.CmpNoError(err)
+			}
+			answer, err := respReader.ReadString('\n')
+			td.CmpNoError(err)
+			td.Cmp(answer, "echo: "+message)
+		}
+		td.CmpNoError(bodyWriter.Close())
+
+		_, err = io.Copy(io.Discard, respReader)
+		td.CmpNoError(err)
+		td.Cmp(resp.Trailer.Get("X-Status"), "ok")
+	})
+}
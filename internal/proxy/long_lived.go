@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+// wsPingFrame - websocket ping frame without payload, sent by server (unmasked)
+var wsPingFrame = []byte{0x89, 0x00}
+
+const longLivedReadBufferSize = 32 * 1024
+
+// withLongLived remove read and write timeouts and slow connection detection of requests to long-lived routes
+// and save the route to context for idle timeout and pings of response.
+func (p *HTTPProxy) withLongLived(r *http.Request) *http.Request {
+	rule := p.LongLived.longLived(r)
+	if rule == nil {
+		return r
+	}
+
+	if exempt, ok := r.Context().Value(contextlabel.TimeoutsExempt).(func() error); ok {
+		p.logger.Debug("Remove read and write timeouts of long-lived route", zap.String("remote_addr", r.RemoteAddr),
+			zap.Error(exempt()))
+	}
+	return r.WithContext(context.WithValue(r.Context(), contextlabel.LongLivedRoute, rule))
+}
+
+// wrapLongLived apply idle timeout and websocket pings of long-lived route to response body
+// (backend connection for websockets).
+func wrapLongLived(resp *http.Response) {
+	ctx := resp.Request.Context()
+	rule, ok := ctx.Value(contextlabel.LongLivedRoute).(*rewriteRule)
+	if !ok || rule.idleTimeout <= 0 && rule.pingInterval <= 0 {
+		return
+	}
+
+	logger := zc.L(ctx)
+	body := &longLivedBody{ReadCloser: resp.Body, logger: logger}
+	if rule.pingInterval > 0 && resp.StatusCode == http.StatusSwitchingProtocols &&
+		strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		body.ping = newWSPing(resp.Body, rule.pingInterval)
+	}
+	if rule.idleTimeout > 0 {
+		body.idleTimeout = rule.idleTimeout
+		body.idleTimer = time.AfterFunc(rule.idleTimeout, body.closeIdle)
+	}
+	logger.Debug("Long-lived response", zap.Duration("idle_timeout", rule.idleTimeout),
+		zap.Bool("websocket_ping", body.ping != nil))
+	resp.Body = body
+}
+
+// longLivedBody close response body (backend connection) after idle timeout and send websocket pings.
+// Write used by reverse proxy for send client data to backend of websocket.
+type longLivedBody struct {
+	io.ReadCloser
+	logger      *zap.Logger
+	idleTimeout time.Duration
+	idleTimer   *time.Timer // nil - without idle timeout
+	ping        *wsPing     // nil - without pings
+	closeOnce   sync.Once
+	closeErr    error
+}
+
+func (b *longLivedBody) Read(p []byte) (n int, err error) {
+	isPing := false
+	if b.ping != nil {
+		n, isPing, err = b.ping.read(p)
+	} else {
+		n, err = b.ReadCloser.Read(p)
+	}
+	if n > 0 && !isPing {
+		b.active()
+	}
+	return n, err
+}
+
+func (b *longLivedBody) Write(p []byte) (n int, err error) {
+	writer, ok := b.ReadCloser.(io.Writer)
+	if !ok {
+		return 0, xerrors.New("response body of long-lived route doesn't support write")
+	}
+	n, err = writer.Write(p)
+	if n > 0 {
+		b.active()
+	}
+	return n, err
+}
+
+func (b *longLivedBody) Close() error {
+	b.closeOnce.Do(func() {
+		if b.idleTimer != nil {
+			b.idleTimer.Stop()
+		}
+		if b.ping != nil {
+			b.ping.close()
+		}
+		b.closeErr = b.ReadCloser.Close()
+	})
+	return b.closeErr
+}
+
+func (b *longLivedBody) active() {
+	if b.idleTimer != nil {
+		b.idleTimer.Reset(b.idleTimeout)
+	}
+}
+
+func (b *longLivedBody) closeIdle() {
+	b.logger.Info("Close idle long-lived request", zap.Duration("idle_timeout", b.idleTimeout))
+	_ = b.Close()
+}
+
+// wsPing read websocket frames from backend in background and insert ping frames between them
+// when backend doesn't send data for interval.
+type wsPing struct {
+	interval time.Duration
+	chunks   chan []byte
+	done     chan struct{}
+	pending  []byte
+	frames   wsFrames
+	err      error // read error of backend, valid after close chunks
+
+	startOnce sync.Once
+	closeOnce sync.Once
+	backend   io.Reader
+}
+
+func newWSPing(backend io.Reader, interval time.Duration) *wsPing {
+	return &wsPing{interval: interval, backend: backend, chunks: make(chan []byte), done: make(chan struct{})}
+}
+
+func (w *wsPing) readBackend() {
+	defer close(w.chunks)
+	for {
+		buf := make([]byte, longLivedReadBufferSize)
+		n, err := w.backend.Read(buf)
+		if n > 0 {
+			select {
+			case w.chunks <- buf[:n]:
+			case <-w.done:
+				return
+			}
+		}
+		if err != nil {
+			w.err = err
+			return
+		}
+	}
+}
+
+// read return data of backend or ping frame (isPing true)
+func (w *wsPing) read(p []byte) (n int, isPing bool, err error) {
+	w.startOnce.Do(func() { go w.readBackend() })
+
+	if len(w.pending) == 0 {
+		timer := time.NewTimer(w.interval)
+		defer timer.Stop()
+
+	wait:
+		for {
+			select {
+			case chunk, ok := <-w.chunks:
+				if !ok {
+					return 0, false, w.err
+				}
+				w.pending = chunk
+				break wait
+			case <-timer.C:
+				// ping between frames of backend only
+				if w.frames.atBoundary() && len(p) >= len(wsPingFrame) {
+					return copy(p, wsPingFrame), true, nil
+				}
+				timer.Reset(w.interval)
+			case <-w.done:
+				return 0, false, net.ErrClosed
+			}
+		}
+	}
+
+	n = copy(p, w.pending)
+	w.frames.consume(p[:n])
+	w.pending = w.pending[n:]
+	return n, false, nil
+}
+
+func (w *wsPing) close() {
+	w.closeOnce.Do(func() { close(w.done) })
+}
+
+// wsFrames track boundaries of websocket frames in stream (rfc 6455 section 5.2)
+type wsFrames struct {
+	header  []byte // received bytes of header of current frame
+	payload uint64 // remaining bytes of payload of current frame
+}
+
+func (f *wsFrames) atBoundary() bool {
+	return len(f.header) == 0 && f.payload == 0
+}
+
+func (f *wsFrames) consume(data []byte) {
+	for len(data) > 0 {
+		if f.payload > 0 {
+			n := f.payload
+			if uint64(len(data)) < n {
+				n = uint64(len(data))
+			}
+			f.payload -= n
+			data = data[n:]
+			continue
+		}
+
+		f.header = append(f.header, data[0])
+		data = data[1:]
+		if size, ok := wsHeaderSize(f.header); ok && len(f.header) == size {
+			f.payload = wsPayloadSize(f.header)
+			f.header = f.header[:0]
+		}
+	}
+}
+
+// wsHeaderSize return full size of frame header by its first bytes, false if first two bytes doesn't received
+func wsHeaderSize(header []byte) (int, bool) {
+	if len(header) < 2 {
+		return 0, false
+	}
+	size := 2
+	switch header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if header[1]&0x80 != 0 {
+		size += 4 // masking key
+	}
+	return size, true
+}
+
+func wsPayloadSize(header []byte) uint64 {
+	switch size := header[1] & 0x7f; size {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(header[2:10])
+	default:
+		return uint64(size)
+	}
+}
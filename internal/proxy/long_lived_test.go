@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestNewDirectorRewrite_LongLived(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	d, err := NewDirectorRewrite([]RewriteRuleConfig{
+		{Route: "*/api/"},
+		{Route: "*/", LongLived: true, IdleTimeoutSeconds: 60, WebSocketPingIntervalSeconds: 10},
+	})
+	td.CmpNoError(err)
+	td.Nil(d.longLived(httptest.NewRequest(http.MethodGet, "http://example.com/api/", nil)))
+	rule := d.longLived(httptest.NewRequest(http.MethodGet, "http://example.com/chat", nil))
+	td.Cmp(rule.idleTimeout, time.Minute)
+	td.Cmp(rule.pingInterval, 10*time.Second)
+
+	_, err = NewDirectorRewrite([]RewriteRuleConfig{{Route: "*/", IdleTimeoutSeconds: 60}})
+	td.CmpError(err)
+	_, err = NewDirectorRewrite([]RewriteRuleConfig{{Route: "*/", LongLived: true, WebSocketPingIntervalSeconds: -1}})
+	td.CmpError(err)
+}
+
+func TestWSFrames(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	var frames wsFrames
+	td.True(frames.atBoundary())
+
+	stream := []byte{0x81, 0x02, 'h', 'i'}         // short text frame
+	stream = append(stream, 0x82, 126, 0x01, 0x00) // binary frame, 256 bytes
+	stream = append(stream, make([]byte, 256)...)
+	stream = append(stream, 0x81, 0x81, 1, 2, 3, 4, 'x')                      // masked frame
+	stream = append(stream, 0x82, 127, 0, 0, 0, 0, 0, 0, 0, 3, 'a', 'b', 'c') // 64 bit length
+	stream = append(stream, 0x8a, 0x00)                                       // pong without payload
+	boundaries := map[int]bool{0: true, 4: true, 264: true, 271: true, 284: true, 286: true}
+
+	// byte by byte
+	for i, b := range stream {
+		td.Cmp(frames.atBoundary(), boundaries[i], i)
+		frames.consume([]byte{b})
+	}
+	td.True(frames.atBoundary())
+
+	// by chunks
+	frames.consume(stream[:3])
+	td.False(frames.atBoundary())
+	frames.consume(stream[3:270])
+	td.False(frames.atBoundary())
+	frames.consume(stream[270:])
+	td.True(frames.atBoundary())
+}
+
+func TestWSPing(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	backendR, backendW := io.Pipe()
+	ping := newWSPing(backendR, 20*time.Millisecond)
+	defer ping.close()
+
+	buf := make([]byte, 100)
+	go func() { _, _ = backendW.Write([]byte{0x81, 0x02, 'h'}) }()
+	n, isPing, err := ping.read(buf)
+	td.CmpNoError(err)
+	td.False(isPing)
+	td.Cmp(buf[:n], []byte{0x81, 0x02, 'h'})
+
+	// mid frame - without ping
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = backendW.Write([]byte{'i'})
+	}()
+	n, isPing, err = ping.read(buf)
+	td.CmpNoError(err)
+	td.False(isPing)
+	td.Cmp(buf[:n], []byte{'i'})
+
+	n, isPing, err = ping.read(buf)
+	td.CmpNoError(err)
+	td.True(isPing)
+	td.Cmp(buf[:n], wsPingFrame)
+
+	_ = backendW.Close()
+	_, _, err = ping.read(buf)
+	td.Cmp(err, io.EOF)
+}
+
+func TestHTTPProxy_LongLived(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	const writeTimeout = 100 * time.Millisecond
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "" {
+			_, _ = w.Write([]byte("first\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(3 * writeTimeout)
+			_, _ = w.Write([]byte("second\n"))
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_, _ = rw.Write([]byte{0x81, 0x02, 'h', 'i'})
+		_ = rw.Flush()
+		_, _ = io.Copy(io.Discard, conn)
+	}))
+	defer backend.Close()
+
+	listener := th.NewLocalTcpListener(e)
+	proxy := NewHTTPProxy(e.Ctx, listener)
+	proxy.Director = NewDirectorChain(NewDirectorHost(backend.Listener.Addr().String()), NewSetSchemeDirector(ProtocolHTTP))
+	proxy.WriteTimeout = writeTimeout
+	var err error
+	proxy.LongLived, err = NewDirectorRewrite([]RewriteRuleConfig{
+		{Route: "*/live/", LongLived: true, IdleTimeoutSeconds: 1},
+		{Route: "*/ws/", LongLived: true, IdleTimeoutSeconds: 1},
+	})
+	e.CmpNoError(err)
+	proxy.LongLived[1].pingInterval = 50 * time.Millisecond // shorter than minimal interval of config
+	go func() { _ = proxy.Start() }()
+	defer func() { _ = proxy.Close() }()
+
+	client := http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func(path string) (string, error) {
+		resp, err := client.Get("http://" + listener.Addr().String() + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	body, err := get("/live/")
+	e.CmpNoError(err)
+	e.Cmp(body, "first\nsecond\n")
+
+	// other routes keep write timeout
+	body, err = get("/other/")
+	e.True(err != nil || body != "first\nsecond\n")
+
+	// websocket get pings and closed by idle timeout
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	e.CmpNoError(err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write([]byte("GET /ws/ HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	e.CmpNoError(err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	e.CmpNoError(err)
+	e.Cmp(resp.StatusCode, http.StatusSwitchingProtocols)
+
+	start := time.Now()
+	data, _ := io.ReadAll(reader)
+	e.Between(time.Since(start), 900*time.Millisecond, 5*time.Second, testdeep.BoundsInIn)
+	e.True(bytes.HasPrefix(data, []byte{0x81, 0x02, 'h', 'i'}))
+	pings := data[4:]
+	e.True(len(pings) >= 2*len(wsPingFrame))
+	e.Cmp(pings, bytes.Repeat(wsPingFrame, len(pings)/len(wsPingFrame)))
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const viaHeader = "Via"
+
+// instanceToken - random token of the process, received-by pseudonym of Via header
+var instanceToken = newInstanceToken()
+
+func newInstanceToken() string {
+	buf := make([]byte, 8) //nolint:gomnd
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return "lets-proxy2-" + hex.EncodeToString(buf)
+}
+
+// LoopDetection add Via header with token of the process to requests to backends and reject incoming requests
+// with the token (proxy send request to itself) by 508 Loop Detected.
+type LoopDetection struct {
+	pseudonym string
+	maxVia    int
+}
+
+// NewLoopDetection create loop detection with token of the process.
+// maxVia - max count of proxies in Via header of incoming request, 0 - unlimited.
+func NewLoopDetection(maxVia int) *LoopDetection {
+	return &LoopDetection{pseudonym: instanceToken, maxVia: maxVia}
+}
+
+// isLoop return true if request passed the proxy already or passed more than maxVia proxies
+func (l *LoopDetection) isLoop(r *http.Request) (loop bool, viaCount int) {
+	for _, value := range r.Header.Values(viaHeader) {
+		for _, entry := range strings.Split(value, ",") {
+			fields := strings.Fields(entry)
+			if len(fields) == 0 {
+				continue
+			}
+			viaCount++
+			if len(fields) > 1 && fields[1] == l.pseudonym {
+				return true, viaCount
+			}
+		}
+	}
+	return l.maxVia > 0 && viaCount > l.maxVia, viaCount
+}
+
+// addVia add the proxy to Via header of request to backend
+func (l *LoopDetection) addVia(r *http.Request) {
+	if l == nil {
+		return
+	}
+	protocol := strconv.Itoa(r.ProtoMajor) + "." + strconv.Itoa(r.ProtoMinor)
+	if r.ProtoMajor >= 2 && r.ProtoMinor == 0 { //nolint:gomnd
+		protocol = strconv.Itoa(r.ProtoMajor)
+	}
+	r.Header.Add(viaHeader, protocol+" "+l.pseudonym)
+}
+
+// handleLoop reject requests, which passed the proxy already, with 508 status
+func (p *HTTPProxy) handleLoop(w http.ResponseWriter, r *http.Request) bool {
+	if p.LoopDetection == nil {
+		return false
+	}
+	loop, viaCount := p.LoopDetection.isLoop(r)
+	if !loop {
+		return false
+	}
+
+	p.logger.Warn("Reject request, looped through proxy", zap.Int("via_count", viaCount),
+		zap.Int("max_via", p.LoopDetection.maxVia), zap.String("remote_addr", r.RemoteAddr), zap.String("host", r.Host))
+	if !p.ErrorPages.Write(w, r, http.StatusLoopDetected) {
+		w.WriteHeader(http.StatusLoopDetected)
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestLoopDetection(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	l := NewLoopDetection(2)
+	td.Cmp(NewLoopDetection(0).pseudonym, l.pseudonym)
+	td.Cmp(l.pseudonym, testdeep.Re(`^lets-proxy2-[0-9a-f]{16}$`))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	loop, count := l.isLoop(req)
+	td.False(loop)
+	td.Cmp(count, 0)
+
+	req.Header.Add("Via", "1.1 first, 1.0 second (comment)")
+	loop, count = l.isLoop(req)
+	td.False(loop)
+	td.Cmp(count, 2)
+
+	req.Header.Add("Via", "2 third")
+	loop, _ = l.isLoop(req)
+	td.True(loop)
+	loop, _ = NewLoopDetection(0).isLoop(req)
+	td.False(loop)
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	l.addVia(req)
+	td.Cmp(req.Header.Values("Via"), []string{"1.1 " + l.pseudonym})
+	loop, _ = NewLoopDetection(0).isLoop(req)
+	td.True(loop)
+
+	req.ProtoMajor, req.ProtoMinor = 2, 0
+	l.addVia(req)
+	td.Cmp(req.Header.Values("Via"), []string{"1.1 " + l.pseudonym, "2 " + l.pseudonym})
+
+	var disabled *LoopDetection
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	disabled.addVia(req)
+	td.Cmp(req.Header.Values("Via"), testdeep.Empty())
+}
+
+func TestHTTPProxy_LoopDetection(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	listener := th.NewLocalTcpListener(e)
+	proxy := NewHTTPProxy(e.Ctx, listener)
+	// proxy send requests to itself
+	proxy.Director = NewDirectorChain(NewDirectorHost(listener.Addr().String()), NewSetSchemeDirector(ProtocolHTTP))
+	proxy.LoopDetection = NewLoopDetection(0)
+	go func() { _ = proxy.Start() }()
+	defer func() { _ = proxy.Close() }()
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + listener.Addr().String() + "/")
+	e.CmpNoError(err)
+	_ = resp.Body.Close()
+	e.Cmp(resp.StatusCode, http.StatusLoopDetected)
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// Modes of handle requests without host (HTTP/1.0 without Host header)
+const (
+	MissingHostPass           = "pass"            // route as usual, backend get request without Host
+	MissingHostReject         = "reject"          // answer 400 Bad Request
+	MissingHostDefaultBackend = "default-backend" // send to MissingHostBackend after apply other routes
+	MissingHostDefaultHost    = "default-host"    // set Host to MissingHostDefaultHost before route
+)
+
+// checkMissingHostMode validate mode and its params
+func checkMissingHostMode(mode, defaultHost, backend string) error {
+	switch mode {
+	case MissingHostPass, MissingHostReject, "":
+		return nil
+	case MissingHostDefaultHost:
+		if defaultHost == "" {
+			return xerrors.Errorf("missing host mode %q need default host", mode)
+		}
+		return nil
+	case MissingHostDefaultBackend:
+		if _, _, err := net.SplitHostPort(backend); err != nil {
+			return xerrors.Errorf("missing host mode %q need backend in host:port format: %w", mode, err)
+		}
+		return nil
+	default:
+		return xerrors.Errorf("unknown missing host mode: %q", mode)
+	}
+}
+
+// requestHost return host of request: host of absolute-URI request target (proxy-style "GET http://host/path")
+// has priority over Host header, rfc 7230 section 5.4. Empty if both are empty.
+func requestHost(request *http.Request) string {
+	if request.URL != nil && request.URL.Host != "" {
+		return request.URL.Host
+	}
+	return request.Host
+}
+
+// DirectorMissingHost set host of requests without it before apply next director (routes) by host from
+// absolute-URI request target or DefaultHost and send the requests to Backend after next director.
+type DirectorMissingHost struct {
+	Next        Director
+	DefaultHost string // empty - without change
+	Backend     string // empty - without change
+}
+
+func (d DirectorMissingHost) Director(request *http.Request) error {
+	host := requestHost(request)
+	missing := host == ""
+	if missing {
+		host = d.DefaultHost
+	}
+	request.Host = host
+
+	if err := d.Next.Director(request); err != nil {
+		return err
+	}
+
+	if missing && d.Backend != "" {
+		request.URL.Host = d.Backend
+	}
+	if missing {
+		zc.L(request.Context()).Debug("Route request without host", zap.String("host", request.Host),
+			zap.String("backend", request.URL.Host))
+	}
+	return nil
+}
+
+// handleMissingHost reject requests without host with 400 status in reject mode
+func (p *HTTPProxy) handleMissingHost(w http.ResponseWriter, r *http.Request) bool {
+	if p.MissingHost != MissingHostReject || requestHost(r) != "" {
+		return false
+	}
+
+	p.logger.Info("Reject request without host", zap.String("remote_addr", r.RemoteAddr), zap.String("proto", r.Proto))
+	if !p.ErrorPages.Write(w, r, http.StatusBadRequest) {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	return true
+}
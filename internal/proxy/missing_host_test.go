@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestDirectorMissingHost(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	// next director see host, decided before it
+	var routedHost string
+	next := NewDirectorMock(mc)
+	next.DirectorMock.Set(func(request *http.Request) error {
+		routedHost = request.Host
+		request.URL.Host = "routed:80"
+		return nil
+	})
+
+	do := func(d DirectorMissingHost, host, target string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		req.Host = host
+		req.URL, _ = url.Parse(target)
+		td.CmpNoError(d.Director(req))
+		return req
+	}
+
+	d := DirectorMissingHost{Next: next, DefaultHost: "default.example.com"}
+	req := do(d, "", "/")
+	td.Cmp(routedHost, "default.example.com")
+	td.Cmp(req.URL.Host, "routed:80")
+
+	do(d, "example.com", "/")
+	td.Cmp(routedHost, "example.com")
+
+	// absolute-URI request target has priority
+	do(d, "example.com", "http://absolute.example.com/path")
+	td.Cmp(routedHost, "absolute.example.com")
+
+	d = DirectorMissingHost{Next: next, Backend: "default-backend:80"}
+	req = do(d, "", "/")
+	td.Cmp(routedHost, "")
+	td.Cmp(req.URL.Host, "default-backend:80")
+
+	req = do(d, "example.com", "/")
+	td.Cmp(req.URL.Host, "routed:80")
+}
+
+func TestHTTPProxy_MissingHost(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("backend host: " + r.Host))
+	}))
+	defer backend.Close()
+
+	// raw request for send HTTP/1.0 without Host header
+	do := func(mode, defaultHost, rawRequest string) (int, string) {
+		listener := th.NewLocalTcpListener(e)
+		proxy := NewHTTPProxy(ctx, listener)
+		director, err := (&Config{DefaultTarget: backend.Listener.Addr().String(), MissingHostMode: mode,
+			MissingHostDefaultHost: defaultHost}).GetDirector(ctx)
+		e.CmpNoError(err)
+		proxy.Director = director
+		proxy.MissingHost = mode
+		go func() { _ = proxy.Start() }()
+		defer func() { _ = proxy.Close() }()
+
+		conn, err := net.DialTimeout("tcp", listener.Addr().String(), 10*time.Second)
+		e.CmpNoError(err)
+		defer func() { _ = conn.Close() }()
+		_, err = conn.Write([]byte(rawRequest))
+		e.CmpNoError(err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if !e.CmpNoError(err) {
+			return 0, ""
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body := make([]byte, 1024)
+		n, _ := resp.Body.Read(body)
+		return resp.StatusCode, string(body[:n])
+	}
+
+	status, _ := do(MissingHostReject, "", "GET / HTTP/1.0\r\n\r\n")
+	e.Cmp(status, http.StatusBadRequest)
+
+	status, body := do(MissingHostReject, "", "GET / HTTP/1.0\r\nHost: example.com\r\n\r\n")
+	e.Cmp(status, http.StatusOK)
+	e.Cmp(body, "backend host: example.com")
+
+	status, body = do(MissingHostReject, "", "GET http://absolute.example.com/ HTTP/1.0\r\n\r\n")
+	e.Cmp(status, http.StatusOK)
+	e.Cmp(body, "backend host: absolute.example.com")
+
+	status, body = do(MissingHostDefaultHost, "default.example.com", "GET / HTTP/1.0\r\n\r\n")
+	e.Cmp(status, http.StatusOK)
+	e.Cmp(body, "backend host: default.example.com")
+
+	// HTTP/1.1 without Host rejected by http server
+	status, _ = do(MissingHostPass, "", "GET / HTTP/1.1\r\n\r\n")
+	e.Cmp(status, http.StatusBadRequest)
+}
+
+func TestCheckMissingHostMode(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	td.CmpNoError(checkMissingHostMode("", "", ""))
+	td.CmpNoError(checkMissingHostMode(MissingHostReject, "", ""))
+	td.CmpNoError(checkMissingHostMode(MissingHostDefaultHost, "example.com", ""))
+	td.CmpNoError(checkMissingHostMode(MissingHostDefaultBackend, "", "127.0.0.1:80"))
+
+	td.CmpError(checkMissingHostMode(MissingHostDefaultHost, "", ""))
+	td.CmpError(checkMissingHostMode(MissingHostDefaultBackend, "", "127.0.0.1"))
+	td.CmpError(checkMissingHostMode("bad", "", ""))
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// ReloadableDirector - director, which can be replaced while proxy work, for reload routes.
+// Every replace start new generation of routes. Connections remember generation of routes of last request.
+// Allowed methods of routes replaced with routes: they are part of rewrite rules.
+type ReloadableDirector struct {
+	mu                  sync.RWMutex
+	director            Director
+	allowedMethodsRules DirectorRewrite
+	generation          uint64
+}
+
+// NewReloadableDirector create director with first generation of routes
+func NewReloadableDirector(director Director, allowedMethodsRules DirectorRewrite) *ReloadableDirector {
+	return &ReloadableDirector{director: director, allowedMethodsRules: allowedMethodsRules, generation: 1}
+}
+
+// Director apply current routes to request and save generation of the routes for connection of the request
+func (r *ReloadableDirector) Director(request *http.Request) error {
+	director, generation := r.current()
+	err := director.Director(request)
+	if setGeneration, ok := request.Context().Value(contextlabel.ConnectionRouteGeneration).(func(uint64)); ok {
+		setGeneration(generation)
+	}
+	return err
+}
+
+// Replace set new routes and allowed methods of them for next requests and return generation of the routes
+func (r *ReloadableDirector) Replace(director Director, allowedMethodsRules DirectorRewrite) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.director = director
+	r.allowedMethodsRules = allowedMethodsRules
+	r.generation++
+	return r.generation
+}
+
+// AllowedMethodsRules return rewrite rules for detect allowed methods of current routes
+func (r *ReloadableDirector) AllowedMethodsRules() DirectorRewrite {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.allowedMethodsRules
+}
+
+// Generation return generation of current routes
+func (r *ReloadableDirector) Generation() uint64 {
+	_, generation := r.current()
+	return generation
+}
+
+// Backend return backend host, which current routes select for request to host and path
+// from the remote address to the local address. Empty path - root.
+func (r *ReloadableDirector) Backend(ctx context.Context, connectionID, host, path, remoteAddr, localAddr string) (string, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", localAddr)
+	if err != nil {
+		return "", xerrors.Errorf("parse local address %q: %w", localAddr, err)
+	}
+	ctx = context.WithValue(ctx, http.LocalAddrContextKey, tcpAddr)
+	ctx = context.WithValue(ctx, contextlabel.ConnectionID, connectionID)
+	ctx = zc.WithLogger(ctx, zap.NewNop())
+	if path == "" {
+		path = "/"
+	}
+
+	request := (&http.Request{
+		Method:     http.MethodGet,
+		Host:       host,
+		RemoteAddr: remoteAddr,
+		URL:        &url.URL{Path: path},
+		Header:     make(http.Header),
+	}).WithContext(ctx)
+
+	director, _ := r.current()
+	if err = director.Director(request); err != nil {
+		return "", err
+	}
+	return request.URL.Host, nil
+}
+
+func (r *ReloadableDirector) current() (Director, uint64) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.director, r.generation
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestReloadableDirector(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	director := NewReloadableDirector(NewDirectorHost("old:80"), nil)
+	td.Cmp(director.Generation(), uint64(1))
+
+	var generation uint64
+	ctx = context.WithValue(ctx, contextlabel.ConnectionRouteGeneration, func(g uint64) { generation = g })
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(ctx)
+	td.CmpNoError(director.Director(req))
+	td.Cmp(req.URL.Host, "old:80")
+	td.Cmp(generation, uint64(1))
+
+	allowedMethodsRules, err := NewDirectorRewrite([]RewriteRuleConfig{{Route: "*/", AllowedMethods: []string{"GET"}}})
+	td.CmpNoError(err)
+	td.Cmp(director.Replace(NewDirectorHost("new:80"), allowedMethodsRules), uint64(2))
+	td.Cmp(director.Generation(), uint64(2))
+	td.Cmp(director.AllowedMethodsRules(), allowedMethodsRules)
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(ctx)
+	td.CmpNoError(director.Director(req))
+	td.Cmp(req.URL.Host, "new:80")
+	td.Cmp(generation, uint64(2))
+}
+
+func TestReloadableDirector_Backend(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	director := NewReloadableDirector(NewDirectorChain(
+		NewDirectorSameIP(80),
+		NewDirectorDestMap(map[string]string{"127.0.0.1:443": "backend:8080"}),
+		NewDirectorSetHeaders(map[string]string{"X-Connection-ID": ConnectionID, "X-Source": SourceIP}),
+	), nil)
+
+	backend, err := director.Backend(ctx, "conn-id", "example.com", "", "1.2.3.4:5678", "127.0.0.1:443")
+	td.CmpNoError(err)
+	td.Cmp(backend, "backend:8080")
+
+	backend, err = director.Backend(ctx, "conn-id", "example.com", "", "1.2.3.4:5678", "127.0.0.2:443")
+	td.CmpNoError(err)
+	td.Cmp(backend, net.JoinHostPort("127.0.0.2", "80"))
+
+	_, err = director.Backend(ctx, "conn-id", "example.com", "", "1.2.3.4:5678", "bad")
+	td.CmpError(err)
+
+	// path of request select route
+	rewrite, err := NewDirectorRewrite([]RewriteRuleConfig{{Route: "example.com/api/", Backend: "api:80"}})
+	td.CmpNoError(err)
+	director.Replace(NewDirectorChain(NewDirectorHost("default:80"), rewrite), nil)
+
+	backend, err = director.Backend(ctx, "conn-id", "example.com", "/api/users", "1.2.3.4:5678", "127.0.0.1:443")
+	td.CmpNoError(err)
+	td.Cmp(backend, "api:80")
+
+	backend, err = director.Backend(ctx, "conn-id", "example.com", "", "1.2.3.4:5678", "127.0.0.1:443")
+	td.CmpNoError(err)
+	td.Cmp(backend, "default:80")
+}
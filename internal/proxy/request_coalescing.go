@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// RequestCoalescing collapse concurrent identical GET requests, matched to routes, into one request to backend.
+// Requests keyed by host and request uri, requests with credentials (Authorization, Cookie) aren't coalesced.
+// While request in flight, identical requests wait for its response (up to Timeout) and receive copy
+// of the response if it shareable (see shareable) and request headers from response Vary equal.
+// Other waited requests sent to backend by self, after response or timeout.
+type RequestCoalescing struct {
+	MaxSize int64         // max size of shared response body
+	Timeout time.Duration // max time for wait response of identical request
+
+	routes []route
+
+	coalesced int64
+
+	mu    sync.Mutex
+	calls map[string]*coalescingCall
+}
+
+// coalescingCall is request in flight, entry is nil if response can't be shared
+type coalescingCall struct {
+	done  chan struct{}
+	req   *http.Request
+	entry *responseCacheEntry
+	vary  []string
+}
+
+// NewRequestCoalescing create coalescing for requests, matched to routes "host/path-prefix". Host "*" match any host.
+func NewRequestCoalescing(routes []string, maxSize int64, timeout time.Duration) (*RequestCoalescing, error) {
+	res := &RequestCoalescing{
+		MaxSize: maxSize,
+		Timeout: timeout,
+		calls:   make(map[string]*coalescingCall),
+	}
+	for _, s := range routes {
+		r, err := parseRoute(s)
+		if err != nil {
+			return nil, xerrors.Errorf("request coalescing: %w", err)
+		}
+		res.routes = append(res.routes, r)
+	}
+	return res, nil
+}
+
+// InitMetrics register counter of requests, answered by response of identical request
+func (c *RequestCoalescing) InitMetrics(r prometheus.Registerer) {
+	if r == nil || reflect.ValueOf(r).IsNil() {
+		return
+	}
+
+	r.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "request_coalescing_shared", Help: "Count of requests, answered by shared response of identical request",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&c.coalesced))
+	}))
+}
+
+// wrap return transport, which coalesce identical requests
+func (c *RequestCoalescing) wrap(transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return requestCoalescingTransport{next: transport, coalescing: c}
+}
+
+func (c *RequestCoalescing) match(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" ||
+		req.Header.Get("Range") != "" {
+		return false
+	}
+	requestDirectives := parseCacheControl(req.Header)
+	for _, name := range []string{"no-store", "no-cache"} {
+		if _, ok := requestDirectives[name]; ok {
+			return false
+		}
+	}
+	for _, r := range c.routes {
+		if r.match(req) {
+			return true
+		}
+	}
+	return false
+}
+
+// shareable return true if response can be sent to clients of other requests:
+// it cacheable by shared cache with explicit freshness, same as for ResponseCache.
+func (c *RequestCoalescing) shareable(resp *http.Response) bool {
+	_, ok := responseFreshness(resp, c.MaxSize, time.Now())
+	return ok
+}
+
+type requestCoalescingTransport struct {
+	next       http.RoundTripper
+	coalescing *RequestCoalescing
+}
+
+func (t requestCoalescingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.coalescing
+	if !c.match(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	key := responseCacheResourceKey(req.Method, req)
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		call = &coalescingCall{done: make(chan struct{}), req: req}
+		c.calls[key] = call
+	}
+	c.mu.Unlock()
+
+	if ok {
+		return t.wait(call, req)
+	}
+	return t.lead(key, call, req)
+}
+
+// lead send request to backend and share its response with waited identical requests
+func (t requestCoalescingTransport) lead(key string, call *coalescingCall, req *http.Request) (*http.Response, error) {
+	c := t.coalescing
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || !c.shareable(resp) {
+		return resp, err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.MaxSize+1))
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, xerrors.Errorf("read response for share with identical requests: %w", err)
+	}
+	if int64(len(body)) > c.MaxSize {
+		resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return resp, nil
+	}
+	_ = resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	entry := &responseCacheEntry{
+		status:        resp.StatusCode,
+		header:        resp.Header.Clone(),
+		contentLength: resp.ContentLength,
+		date:          time.Now().Add(-responseAge(resp)),
+	}
+	entry.finish(body)
+	call.entry = entry
+	call.vary = responseVary(resp)
+	return resp, nil
+}
+
+// wait response of identical request, send request to backend if it can't be shared
+func (t requestCoalescingTransport) wait(call *coalescingCall, req *http.Request) (*http.Response, error) {
+	logger := zc.L(req.Context())
+	timer := time.NewTimer(t.coalescing.Timeout)
+	defer timer.Stop()
+
+	select {
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	case <-timer.C:
+		logger.Debug("Timeout of wait response of identical request, send request to backend",
+			zap.Duration("timeout", t.coalescing.Timeout))
+		return t.next.RoundTrip(req)
+	case <-call.done:
+	}
+
+	if call.entry == nil || responseCacheVariantKey(call.req, call.vary) != responseCacheVariantKey(req, call.vary) {
+		logger.Debug("Response of identical request can't be shared, send request to backend")
+		return t.next.RoundTrip(req)
+	}
+	atomic.AddInt64(&t.coalescing.coalesced, 1)
+	logger.Debug("Serve shared response of identical request")
+	return call.entry.response(req, time.Now()), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
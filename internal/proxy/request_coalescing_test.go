@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+type coalescingTestBackend struct {
+	requests int64
+	release  chan struct{}
+}
+
+func (b *coalescingTestBackend) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := atomic.AddInt64(&b.requests, 1)
+	<-b.release
+
+	header := http.Header{"Cache-Control": []string{"max-age=60"}}
+	body := req.URL.Path + " " + req.Header.Get("Accept-Encoding") + " " + strconv.FormatInt(n, 10)
+	switch req.URL.Path {
+	case "/api/vary":
+		header.Set("Vary", "Accept-Encoding")
+	case "/api/cookie":
+		header.Set("Set-Cookie", "a=b")
+	case "/api/big":
+		body = strings.Repeat("a", 100)
+	case "/api/no-freshness":
+		header.Del("Cache-Control")
+	case "/api/no-cache":
+		header.Set("Cache-Control", "no-cache")
+	case "/api/session":
+		body = "page of " + req.Header.Get("Cookie")
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: header, ContentLength: -1,
+		Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestRequestCoalescingTransport(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	coalescing, err := NewRequestCoalescing([]string{"example.com/api/"}, 50, time.Minute)
+	td.CmpNoError(err)
+
+	do := func(transport http.RoundTripper, method, path, acceptEncoding string) string {
+		req, _ := http.NewRequestWithContext(ctx, method, "http://backend"+path, nil)
+		req.Host = "example.com"
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return err.Error()
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return string(body)
+	}
+
+	// concurrent requests while first request in flight
+	parallel := func(method, path string, acceptEncodings ...string) (*coalescingTestBackend, []string) {
+		backend := &coalescingTestBackend{release: make(chan struct{})}
+		transport := coalescing.wrap(backend)
+		res := make([]string, len(acceptEncodings))
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res[0] = do(transport, method, path, acceptEncodings[0])
+		}()
+		for atomic.LoadInt64(&backend.requests) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		for i := 1; i < len(acceptEncodings); i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				res[i] = do(transport, method, path, acceptEncodings[i])
+			}(i)
+		}
+		time.Sleep(100 * time.Millisecond)
+		close(backend.release)
+		wg.Wait()
+		return backend, res
+	}
+
+	backend, res := parallel(http.MethodGet, "/api/1", "", "", "", "")
+	td.Cmp(atomic.LoadInt64(&backend.requests), int64(1))
+	td.Cmp(res, []string{"/api/1  1", "/api/1  1", "/api/1  1", "/api/1  1"})
+	td.Cmp(atomic.LoadInt64(&coalescing.coalesced), int64(3))
+
+	backend, res = parallel(http.MethodGet, "/api/vary", "gzip", "gzip", "br")
+	td.Cmp(atomic.LoadInt64(&backend.requests), int64(2))
+	td.Cmp(res[:2], []string{"/api/vary gzip 1", "/api/vary gzip 1"})
+	td.Cmp(res[2], "/api/vary br 2")
+
+	for _, path := range []string{"/api/cookie", "/api/big", "/api/no-freshness", "/api/no-cache"} {
+		backend, res = parallel(http.MethodGet, path, "", "")
+		td.Cmp(atomic.LoadInt64(&backend.requests), int64(2), path)
+		td.Cmp(len(res[0]), len(res[1]), path)
+		if path == "/api/big" {
+			td.Cmp(res[0], strings.Repeat("a", 100))
+		}
+	}
+
+	backend, _ = parallel(http.MethodPost, "/api/1", "", "")
+	td.Cmp(atomic.LoadInt64(&backend.requests), int64(2))
+	backend, _ = parallel(http.MethodGet, "/other", "", "")
+	td.Cmp(atomic.LoadInt64(&backend.requests), int64(2))
+	td.Cmp(atomic.LoadInt64(&coalescing.coalesced), int64(4))
+	td.Len(coalescing.calls, 0)
+}
+
+func TestRequestCoalescingCookies(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	coalescing, err := NewRequestCoalescing([]string{"*/"}, 1024, time.Minute)
+	td.CmpNoError(err)
+	backend := &coalescingTestBackend{release: make(chan struct{})}
+	transport := coalescing.wrap(backend)
+
+	get := func(cookie string) string {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/api/session", nil)
+		req.Header.Set("Cookie", cookie)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return err.Error()
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return string(body)
+	}
+
+	// personalized responses of concurrent requests with different sessions must not be shared
+	var wg sync.WaitGroup
+	res := make([]string, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		res[0] = get("session=alice")
+	}()
+	for atomic.LoadInt64(&backend.requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		res[1] = get("session=bob")
+	}()
+	for atomic.LoadInt64(&backend.requests) == 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(backend.release)
+	wg.Wait()
+
+	td.Cmp(res, []string{"page of session=alice", "page of session=bob"})
+	td.Cmp(atomic.LoadInt64(&backend.requests), int64(2))
+	td.Cmp(atomic.LoadInt64(&coalescing.coalesced), int64(0))
+}
+
+func TestRequestCoalescingTimeout(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	coalescing, err := NewRequestCoalescing([]string{"*/"}, 50, 10*time.Millisecond)
+	td.CmpNoError(err)
+
+	first := make(chan struct{})
+	var requests int64
+	transport := coalescing.wrap(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			<-first
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{},
+			Body: io.NopCloser(strings.NewReader("ok"))}, nil
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+		_, _ = transport.RoundTrip(req)
+	}()
+	for atomic.LoadInt64(&requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com/", nil)
+	resp, err := transport.RoundTrip(req)
+	td.CmpNoError(err)
+	td.Cmp(resp.StatusCode, http.StatusOK)
+	td.Cmp(atomic.LoadInt64(&requests), int64(2))
+	td.Cmp(atomic.LoadInt64(&coalescing.coalesced), int64(0))
+
+	close(first)
+	<-done
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestConfig_getRequestCoalescing(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	res, err := (&Config{RequestCoalescingMaxSizeKB: 10}).getRequestCoalescing(ctx)
+	td.CmpNoError(err)
+	td.Nil(res)
+
+	res, err = (&Config{RequestCoalescingRoutes: []string{"Example.com/api/"}, RequestCoalescingMaxSizeKB: 2,
+		RequestCoalescingTimeoutSeconds: 5}).getRequestCoalescing(ctx)
+	td.CmpNoError(err)
+	td.Cmp(res, testdeep.Struct(&RequestCoalescing{MaxSize: 2048, Timeout: 5 * time.Second}, testdeep.StructFields{
+		"routes": []route{{host: "example.com", pathPrefix: "/api/"}},
+		"calls":  testdeep.Len(0),
+	}))
+
+	_, err = (&Config{RequestCoalescingRoutes: []string{"*/"}, RequestCoalescingMaxSizeKB: 2}).getRequestCoalescing(ctx)
+	td.CmpError(err)
+	_, err = (&Config{RequestCoalescingRoutes: []string{"/api"}, RequestCoalescingMaxSizeKB: 2,
+		RequestCoalescingTimeoutSeconds: 5}).getRequestCoalescing(ctx)
+	td.CmpError(err)
+}
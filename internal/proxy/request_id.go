@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"math/big"
+	"net/http"
+
+	"github.com/rekby/fastuuid"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+const (
+	RequestIDFormatUUID   = "uuid"
+	RequestIDFormatBase62 = "base62"
+)
+
+const maxIncomingRequestIDLen = 128
+
+// NewRequestIDGenerator return generator of request ids by format
+func NewRequestIDGenerator(format string) (func() string, error) {
+	switch format {
+	case RequestIDFormatUUID, "":
+		return fastuuid.MustUUIDv4String, nil
+	case RequestIDFormatBase62:
+		return newBase62RequestID, nil
+	default:
+		return nil, xerrors.Errorf("unknown request id format: %q", format)
+	}
+}
+
+func newBase62RequestID() string {
+	id := fastuuid.MustUUIDv4()
+	return new(big.Int).SetBytes(id[:]).Text(62) //nolint:gomnd
+}
+
+// RequestIDFromContext return request id or empty string if request id absent
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextlabel.RequestID).(string)
+	return id
+}
+
+// withRequestID set request id to request header, context and response header
+func (p *HTTPProxy) withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	if p.RequestIDHeader == "" {
+		return r
+	}
+
+	id := ""
+	if p.RequestIDAcceptIncoming {
+		id = r.Header.Get(p.RequestIDHeader)
+		if !isValidIncomingRequestID(id) {
+			id = ""
+		}
+	}
+	if id == "" {
+		id = p.RequestIDGenerator()
+	}
+
+	r.Header.Set(p.RequestIDHeader, id)
+	w.Header().Set(p.RequestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), contextlabel.RequestID, id))
+}
+
+func isValidIncomingRequestID(id string) bool {
+	if id == "" || len(id) > maxIncomingRequestIDLen {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestNewRequestIDGenerator(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	generator, err := NewRequestIDGenerator(RequestIDFormatUUID)
+	td.CmpNoError(err)
+	td.Re(generator(), `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[0-9a-f]{4}-[0-9a-f]{12}$`, nil)
+
+	generator, err = NewRequestIDGenerator(RequestIDFormatBase62)
+	td.CmpNoError(err)
+	id := generator()
+	td.Re(id, `^[0-9a-zA-Z]{1,22}$`, nil)
+	td.Not(generator(), id)
+
+	_, err = NewRequestIDGenerator("bad")
+	td.CmpError(err)
+}
+
+func TestIsValidIncomingRequestID(t *testing.T) {
+	td := testdeep.NewT(t)
+	td.True(isValidIncomingRequestID("abc-123_ABC.:"))
+	td.False(isValidIncomingRequestID(""))
+	td.False(isValidIncomingRequestID("with space"))
+	td.False(isValidIncomingRequestID("ид"))
+	td.False(isValidIncomingRequestID(strings.Repeat("a", maxIncomingRequestIDLen+1)))
+}
+
+func TestHTTPProxy_RequestID(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	const header = "X-Request-ID"
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get(header))
+	}))
+	defer backend.Close()
+
+	startProxy := func(acceptIncoming bool) string {
+		listener := th.NewLocalTcpListener(e)
+		proxy := NewHTTPProxy(e.Ctx, listener)
+		proxy.Director = NewDirectorChain(NewDirectorHost(strings.TrimPrefix(backend.URL, "http://")), NewSetSchemeDirector(ProtocolHTTP))
+		proxy.RequestIDHeader = header
+		proxy.RequestIDAcceptIncoming = acceptIncoming
+		proxy.RequestIDGenerator = func() string { return "generated" }
+		go func() { _ = proxy.Start() }()
+		e.T().Cleanup(func() { _ = proxy.Close() })
+		return "http://" + listener.Addr().String()
+	}
+
+	query := func(addr, incomingID string) (responseHeader, backendHeader string) {
+		req, _ := http.NewRequest(http.MethodGet, addr, nil)
+		if incomingID != "" {
+			req.Header.Set(header, incomingID)
+		}
+		client := http.Client{Timeout: time.Second}
+		resp, err := client.Do(req)
+		e.CmpNoError(err)
+		body, err := io.ReadAll(resp.Body)
+		e.CmpNoError(err)
+		e.CmpNoError(resp.Body.Close())
+		return resp.Header.Get(header), string(body)
+	}
+
+	addr := startProxy(true)
+	respID, backendID := query(addr, "")
+	e.Cmp(respID, "generated")
+	e.Cmp(backendID, "generated")
+
+	respID, backendID = query(addr, "incoming")
+	e.Cmp(respID, "incoming")
+	e.Cmp(backendID, "incoming")
+
+	addr = startProxy(false)
+	respID, backendID = query(addr, "incoming")
+	e.Cmp(respID, "generated")
+	e.Cmp(backendID, "generated")
+}
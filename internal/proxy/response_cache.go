@@ -0,0 +1,540 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// ResponseCache is bounded (LRU by total size) in memory shared http cache of GET and HEAD responses
+// with explicit freshness (Cache-Control s-maxage, max-age or Expires) for requests, matched to routes.
+// Responses keyed by method, host, request uri and request headers from response Vary.
+type ResponseCache struct {
+	MaxEntrySize int64         // max size of body of cached response
+	MaxSize      int64         // max total size of cached responses
+	MaxTTL       time.Duration // max time for cache response, regardless of its freshness
+
+	routes []route
+
+	hits   int64
+	misses int64
+
+	mu        sync.Mutex
+	size      int64
+	resources map[string]*responseCacheResource
+	lru       list.List
+}
+
+type responseCacheResource struct {
+	vary     []string
+	variants map[string]*list.Element
+}
+
+type responseCacheEntry struct {
+	resourceKey   string
+	variantKey    string
+	status        int
+	header        http.Header
+	body          []byte
+	contentLength int64
+	size          int64
+	date          time.Time // received time without age of response
+	expires       time.Time
+}
+
+// status codes, cacheable by default (rfc 7231 section 6.1)
+var responseCacheStatuses = map[int]bool{
+	http.StatusOK: true, http.StatusNonAuthoritativeInfo: true, http.StatusNoContent: true,
+	http.StatusMultipleChoices: true, http.StatusMovedPermanently: true, http.StatusNotFound: true,
+	http.StatusMethodNotAllowed: true, http.StatusGone: true, http.StatusRequestURITooLong: true,
+	http.StatusNotImplemented: true,
+}
+
+// NewResponseCache create cache for requests, matched to routes "host/path-prefix". Host "*" match any host.
+func NewResponseCache(routes []string, maxEntrySize, maxSize int64, maxTTL time.Duration) (*ResponseCache, error) {
+	res := &ResponseCache{
+		MaxEntrySize: maxEntrySize,
+		MaxSize:      maxSize,
+		MaxTTL:       maxTTL,
+		resources:    make(map[string]*responseCacheResource),
+	}
+	for _, s := range routes {
+		r, err := parseRoute(s)
+		if err != nil {
+			return nil, xerrors.Errorf("response cache: %w", err)
+		}
+		res.routes = append(res.routes, r)
+	}
+	return res, nil
+}
+
+// InitMetrics register counters of hits and misses and size of the cache
+func (c *ResponseCache) InitMetrics(r prometheus.Registerer) {
+	if r == nil || reflect.ValueOf(r).IsNil() {
+		return
+	}
+
+	r.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "response_cache_hits", Help: "Count of requests, served from response cache",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&c.hits))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "response_cache_misses", Help: "Count of cacheable requests, sent to backend",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&c.misses))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "response_cache_size_bytes", Help: "Total size of cached responses",
+		}, func() float64 {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return float64(c.size)
+		}),
+	)
+}
+
+// wrap return transport, which serve responses from the cache
+func (c *ResponseCache) wrap(transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return responseCacheTransport{next: transport, cache: c}
+}
+
+func (c *ResponseCache) match(req *http.Request) bool {
+	for _, r := range c.routes {
+		if r.match(req) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ResponseCache) get(req *http.Request, now time.Time) *responseCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resource, ok := c.resources[responseCacheResourceKey(req.Method, req)]
+	if !ok {
+		return nil
+	}
+	elem, ok := resource.variants[responseCacheVariantKey(req, resource.vary)]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*responseCacheEntry)
+	if !now.Before(entry.expires) {
+		c.removeLocked(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+func (c *ResponseCache) put(entry *responseCacheEntry, vary []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if resource, ok := c.resources[entry.resourceKey]; ok {
+		// variants with other vary headers never match again
+		outdated := !stringsEqual(resource.vary, vary)
+		for variantKey, elem := range resource.variants {
+			if outdated || variantKey == entry.variantKey {
+				c.removeLocked(elem)
+			}
+		}
+	}
+	resource, ok := c.resources[entry.resourceKey]
+	if !ok {
+		resource = &responseCacheResource{vary: vary, variants: make(map[string]*list.Element)}
+		c.resources[entry.resourceKey] = resource
+	}
+	resource.variants[entry.variantKey] = c.lru.PushFront(entry)
+	c.size += entry.size
+	for c.size > c.MaxSize && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// invalidate remove cached responses of request uri and of uris from Location and Content-Location headers
+// of response, which point to same host (RFC 7234 section 4.4).
+func (c *ResponseCache) invalidate(req *http.Request, resp *http.Response) {
+	uris := []string{req.URL.RequestURI()}
+	requestURL := &url.URL{Scheme: req.URL.Scheme, Host: req.Host, Path: req.URL.Path, RawPath: req.URL.RawPath,
+		RawQuery: req.URL.RawQuery}
+	for _, header := range []string{"Location", "Content-Location"} {
+		value := resp.Header.Get(header)
+		if value == "" {
+			continue
+		}
+		location, err := requestURL.Parse(value)
+		if err != nil || !strings.EqualFold(location.Host, req.Host) {
+			continue
+		}
+		uris = append(uris, location.RequestURI())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, uri := range uris {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			if resource, ok := c.resources[responseCacheKey(method, req.Host, uri)]; ok {
+				for _, elem := range resource.variants {
+					c.removeLocked(elem)
+				}
+			}
+		}
+	}
+}
+
+func (c *ResponseCache) removeLocked(elem *list.Element) {
+	entry := elem.Value.(*responseCacheEntry)
+	c.lru.Remove(elem)
+	c.size -= entry.size
+	if resource, ok := c.resources[entry.resourceKey]; ok && resource.variants[entry.variantKey] == elem {
+		delete(resource.variants, entry.variantKey)
+		if len(resource.variants) == 0 {
+			delete(c.resources, entry.resourceKey)
+		}
+	}
+}
+
+// ttl return time for cache the response or false if response must not be cached
+func (c *ResponseCache) ttl(resp *http.Response, now time.Time) (time.Duration, bool) {
+	ttl, ok := responseFreshness(resp, c.MaxEntrySize, now)
+	if !ok {
+		return ttl, false
+	}
+	if ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	return ttl, ttl > 0
+}
+
+// responseFreshness return remaining freshness lifetime of shared cacheable response with body up to maxSize:
+// by s-maxage, max-age or Expires. Responses without explicit freshness, with no-store, private, no-cache,
+// Set-Cookie or Vary: * aren't cacheable.
+func responseFreshness(resp *http.Response, maxSize int64, now time.Time) (time.Duration, bool) {
+	if !responseCacheStatuses[resp.StatusCode] || resp.Header.Get("Set-Cookie") != "" ||
+		resp.ContentLength > maxSize || isEventStream(resp.Header) {
+		return 0, false
+	}
+	for _, name := range responseVary(resp) {
+		if name == "*" {
+			return 0, false
+		}
+	}
+
+	directives := parseCacheControl(resp.Header)
+	for _, name := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := directives[name]; ok {
+			return 0, false
+		}
+	}
+
+	var ttl time.Duration
+	if seconds, ok := cacheControlSeconds(directives, "s-maxage"); ok {
+		ttl = seconds
+	} else if seconds, ok = cacheControlSeconds(directives, "max-age"); ok {
+		ttl = seconds
+	} else if expiresHeader := resp.Header.Get("Expires"); expiresHeader != "" {
+		expires, err := http.ParseTime(expiresHeader)
+		if err != nil {
+			return 0, false
+		}
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		ttl = expires.Sub(date)
+	} else {
+		return 0, false
+	}
+
+	ttl -= responseAge(resp)
+	return ttl, ttl > 0
+}
+
+type responseCacheTransport struct {
+	next  http.RoundTripper
+	cache *ResponseCache
+}
+
+func (t responseCacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		resp, err := t.next.RoundTrip(req)
+		if err == nil && resp.StatusCode < http.StatusBadRequest && t.cache.match(req) {
+			t.cache.invalidate(req, resp)
+		}
+		return resp, err
+	default:
+		return t.next.RoundTrip(req)
+	}
+
+	if !t.cache.match(req) || req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" {
+		return t.next.RoundTrip(req)
+	}
+	requestDirectives := parseCacheControl(req.Header)
+	if _, ok := requestDirectives["no-store"]; ok {
+		return t.next.RoundTrip(req)
+	}
+
+	logger := zc.L(req.Context())
+	now := time.Now()
+	if _, ok := requestDirectives["no-cache"]; !ok {
+		if entry := t.cache.get(req, now); entry != nil {
+			atomic.AddInt64(&t.cache.hits, 1)
+			logger.Debug("Serve response from cache", zap.Time("expires", entry.expires))
+			return entry.response(req, now), nil
+		}
+	}
+	atomic.AddInt64(&t.cache.misses, 1)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	ttl, ok := t.cache.ttl(resp, now)
+	logger.Debug("Check response is cacheable", zap.Bool("cacheable", ok), zap.Duration("ttl", ttl))
+	if !ok {
+		return resp, nil
+	}
+
+	vary := responseVary(resp)
+	entry := &responseCacheEntry{
+		resourceKey:   responseCacheResourceKey(req.Method, req),
+		variantKey:    responseCacheVariantKey(req, vary),
+		status:        resp.StatusCode,
+		header:        resp.Header.Clone(),
+		contentLength: resp.ContentLength,
+		date:          now.Add(-responseAge(resp)),
+		expires:       now.Add(ttl),
+	}
+	if req.Method == http.MethodHead {
+		entry.finish(nil)
+		t.cache.put(entry, vary)
+		return resp, nil
+	}
+	resp.Body = &responseCacheBody{ReadCloser: resp.Body, cache: t.cache, entry: entry, vary: vary}
+	return resp, nil
+}
+
+// finish set body of entry and calculate its size
+func (e *responseCacheEntry) finish(body []byte) {
+	e.body = body
+	if e.contentLength < 0 || body != nil {
+		e.contentLength = int64(len(body))
+	}
+	e.size = int64(len(e.resourceKey)+len(e.variantKey)+len(body)) + headerSize(e.header)
+}
+
+func (e *responseCacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int(now.Sub(e.date).Seconds())))
+
+	status := e.status
+	var body []byte
+	contentLength := e.contentLength
+	if e.notModified(req) {
+		status = http.StatusNotModified
+		contentLength = 0
+		for _, name := range []string{"Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding"} {
+			header.Del(name)
+		}
+	} else if req.Method == http.MethodGet {
+		body = e.body
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: contentLength,
+		Request:       req,
+	}
+}
+
+// notModified check conditional request by stored ETag or Last-Modified (rfc 7232 section 6)
+func (e *responseCacheEntry) notModified(req *http.Request) bool {
+	if e.status != http.StatusOK {
+		return false
+	}
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(e.header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(e.header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ifModifiedSince)
+}
+
+// responseCacheBody store response to cache if it read completely
+type responseCacheBody struct {
+	io.ReadCloser
+	cache    *ResponseCache
+	entry    *responseCacheEntry
+	vary     []string
+	buf      bytes.Buffer
+	overflow bool
+	stored   bool
+}
+
+func (b *responseCacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if int64(b.buf.Len()+n) > b.cache.MaxEntrySize {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.store()
+	}
+	return n, err
+}
+
+func (b *responseCacheBody) Close() error {
+	if b.entry.contentLength >= 0 && int64(b.buf.Len()) == b.entry.contentLength {
+		b.store()
+	}
+	return b.ReadCloser.Close()
+}
+
+func (b *responseCacheBody) store() {
+	if b.overflow || b.stored {
+		return
+	}
+	b.stored = true
+	b.entry.finish(append([]byte{}, b.buf.Bytes()...))
+	b.cache.put(b.entry, b.vary)
+}
+
+func responseCacheResourceKey(method string, req *http.Request) string {
+	return responseCacheKey(method, req.Host, req.URL.RequestURI())
+}
+
+func responseCacheKey(method, host, requestURI string) string {
+	return method + " " + strings.ToLower(host) + " " + requestURI
+}
+
+func responseCacheVariantKey(req *http.Request, vary []string) string {
+	var buf strings.Builder
+	for _, name := range vary {
+		buf.WriteString(name)
+		buf.WriteByte(':')
+		buf.WriteString(strings.Join(req.Header.Values(name), ","))
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// responseVary return canonical names of headers from Vary
+func responseVary(resp *http.Response) []string {
+	var res []string
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				res = append(res, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return res
+}
+
+func responseAge(resp *http.Response) time.Duration {
+	age, err := strconv.Atoi(resp.Header.Get("Age"))
+	if err != nil || age < 0 {
+		return 0
+	}
+	return time.Duration(age) * time.Second
+}
+
+// parseCacheControl return lowercased directives of Cache-Control header with unquoted values
+func parseCacheControl(header http.Header) map[string]string {
+	res := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if index := strings.Index(directive, "="); index >= 0 {
+				name, arg = directive[:index], strings.Trim(directive[index+1:], `"`)
+			}
+			res[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	return res
+}
+
+func cacheControlSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func headerSize(header http.Header) int64 {
+	var res int64
+	for name, values := range header {
+		for _, value := range values {
+			res += int64(len(name) + len(value))
+		}
+	}
+	return res
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
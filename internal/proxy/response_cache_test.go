@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestResponseCacheTransport(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	var backendRequests int64
+	rtMock := NewRoundTripperMock(mc)
+	rtMock.RoundTripMock.Set(func(req *http.Request) (*http.Response, error) {
+		n := atomic.AddInt64(&backendRequests, 1)
+		header := http.Header{
+			"Cache-Control": []string{"max-age=60"},
+			"Etag":          []string{`"v1"`},
+			"Last-Modified": []string{"Mon, 02 Jan 2006 15:04:05 GMT"},
+		}
+		switch req.URL.Path {
+		case "/static/private":
+			header.Set("Cache-Control", "private, max-age=60")
+		case "/static/vary":
+			header.Set("Vary", "Accept-Encoding")
+		case "/static/big":
+			return &http.Response{StatusCode: http.StatusOK, Header: header, ContentLength: -1,
+				Body: io.NopCloser(strings.NewReader(strings.Repeat("a", 100)))}, nil
+		case "/static/expires":
+			header.Del("Cache-Control")
+			header.Set("Date", "Mon, 02 Jan 2006 15:04:05 GMT")
+			header.Set("Expires", "Mon, 02 Jan 2006 15:05:05 GMT")
+		}
+		body := req.URL.Path + " " + req.Header.Get("Accept-Encoding") + " " + strconv.FormatInt(n, 10)
+		return &http.Response{StatusCode: http.StatusOK, Header: header, ContentLength: int64(len(body)),
+			Body: io.NopCloser(strings.NewReader(body))}, nil
+	})
+
+	cache, err := NewResponseCache([]string{"example.com/static/"}, 50, 1000, time.Hour)
+	td.CmpNoError(err)
+	transport := cache.wrap(rtMock)
+	do := func(method, host, path string, header http.Header) *http.Response {
+		req, _ := http.NewRequestWithContext(ctx, method, "http://backend"+path, nil)
+		req.Host = host
+		if header != nil {
+			req.Header = header
+		}
+		resp, err := transport.RoundTrip(req)
+		td.CmpNoError(err)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		resp.Body = io.NopCloser(strings.NewReader(string(body)))
+		return resp
+	}
+	body := func(resp *http.Response) string {
+		res, _ := io.ReadAll(resp.Body)
+		return string(res)
+	}
+
+	td.Cmp(body(do(http.MethodGet, "example.com", "/static/1", nil)), "/static/1  1")
+	resp := do(http.MethodGet, "Example.com", "/static/1", nil)
+	td.Cmp(body(resp), "/static/1  1")
+	td.Cmp(resp.Header.Get("Age"), "0")
+	td.Cmp(atomic.LoadInt64(&cache.hits), int64(1))
+	td.Cmp(atomic.LoadInt64(&cache.misses), int64(1))
+
+	// not matched routes and uncacheable requests
+	td.Cmp(body(do(http.MethodGet, "other.com", "/static/1", nil)), "/static/1  2")
+	td.Cmp(body(do(http.MethodGet, "example.com", "/dynamic", nil)), "/dynamic  3")
+	td.Cmp(body(do(http.MethodGet, "example.com", "/static/1", http.Header{"Authorization": []string{"Basic 1"}})), "/static/1  4")
+	td.Cmp(body(do(http.MethodGet, "example.com", "/static/1", http.Header{"Cache-Control": []string{"no-cache"}})), "/static/1  5")
+	td.Cmp(body(do(http.MethodGet, "example.com", "/static/1", nil)), "/static/1  5")
+
+	// uncacheable responses
+	do(http.MethodGet, "example.com", "/static/private", nil)
+	td.Cmp(body(do(http.MethodGet, "example.com", "/static/private", nil)), "/static/private  7")
+	do(http.MethodGet, "example.com", "/static/big", nil)
+	do(http.MethodGet, "example.com", "/static/big", nil)
+	td.Cmp(atomic.LoadInt64(&backendRequests), int64(9))
+
+	// expires relative to date of response
+	do(http.MethodGet, "example.com", "/static/expires", nil)
+	td.Cmp(body(do(http.MethodGet, "example.com", "/static/expires", nil)), "/static/expires  10")
+
+	// vary
+	gzip := http.Header{"Accept-Encoding": []string{"gzip"}}
+	td.Cmp(body(do(http.MethodGet, "example.com", "/static/vary", gzip)), "/static/vary gzip 11")
+	td.Cmp(body(do(http.MethodGet, "example.com", "/static/vary", nil)), "/static/vary  12")
+	td.Cmp(body(do(http.MethodGet, "example.com", "/static/vary", gzip)), "/static/vary gzip 11")
+
+	// conditional requests
+	resp = do(http.MethodGet, "example.com", "/static/1", http.Header{"If-None-Match": []string{`W/"v1"`}})
+	td.Cmp(resp.StatusCode, http.StatusNotModified)
+	td.Cmp(body(resp), "")
+	resp = do(http.MethodGet, "example.com", "/static/1", http.Header{"If-None-Match": []string{`"v2"`}})
+	td.Cmp(resp.StatusCode, http.StatusOK)
+	resp = do(http.MethodGet, "example.com", "/static/1", http.Header{"If-Modified-Since": []string{"Mon, 02 Jan 2006 15:04:05 GMT"}})
+	td.Cmp(resp.StatusCode, http.StatusNotModified)
+	resp = do(http.MethodGet, "example.com", "/static/1", http.Header{"If-Modified-Since": []string{"Mon, 02 Jan 2006 15:04:04 GMT"}})
+	td.Cmp(resp.StatusCode, http.StatusOK)
+
+	// head cached separately
+	resp = do(http.MethodHead, "example.com", "/static/1", nil)
+	td.Cmp(atomic.LoadInt64(&backendRequests), int64(13))
+	resp = do(http.MethodHead, "example.com", "/static/1", nil)
+	td.Cmp(atomic.LoadInt64(&backendRequests), int64(13))
+	td.Cmp(resp.ContentLength, int64(len("/static/1  13")))
+
+	// invalidation
+	do(http.MethodPost, "example.com", "/static/1", nil)
+	td.Cmp(body(do(http.MethodGet, "example.com", "/static/1", nil)), "/static/1  15")
+
+	// lru by size
+	td.Lte(cache.size, cache.MaxSize)
+	for i := 0; i < 20; i++ {
+		do(http.MethodGet, "example.com", "/static/lru"+strconv.Itoa(i), nil)
+	}
+	td.Lte(cache.size, cache.MaxSize)
+	td.Nil(cache.resources["GET example.com /static/1"])
+
+	// expired
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://backend/static/lru19", nil)
+	req.Host = "example.com"
+	td.NotNil(cache.get(req, time.Now()))
+	td.Nil(cache.get(req, time.Now().Add(time.Minute)))
+}
+
+func TestResponseCache_TTL(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	cache, err := NewResponseCache(nil, 100, 1000, time.Minute)
+	td.CmpNoError(err)
+
+	now := time.Now()
+	for _, test := range []struct {
+		header http.Header
+		status int
+		ttl    time.Duration
+		ok     bool
+	}{
+		{header: http.Header{}, status: http.StatusOK},
+		{header: http.Header{"Cache-Control": []string{"max-age=10"}}, status: http.StatusOK, ttl: 10 * time.Second, ok: true},
+		{header: http.Header{"Cache-Control": []string{"max-age=10, s-maxage=20"}}, status: http.StatusOK, ttl: 20 * time.Second, ok: true},
+		{header: http.Header{"Cache-Control": []string{"max-age=3600"}}, status: http.StatusOK, ttl: time.Minute, ok: true},
+		{header: http.Header{"Cache-Control": []string{"max-age=10"}, "Age": []string{"4"}}, status: http.StatusOK, ttl: 6 * time.Second, ok: true},
+		{header: http.Header{"Cache-Control": []string{"max-age=10"}, "Age": []string{"20"}}, status: http.StatusOK, ttl: -10 * time.Second},
+		{header: http.Header{"Cache-Control": []string{"max-age=bad"}}, status: http.StatusOK},
+		{header: http.Header{"Cache-Control": []string{"max-age=10"}}, status: http.StatusNotFound, ttl: 10 * time.Second, ok: true},
+		{header: http.Header{"Cache-Control": []string{"max-age=10"}}, status: http.StatusInternalServerError},
+		{header: http.Header{"Cache-Control": []string{"no-store, max-age=10"}}, status: http.StatusOK},
+		{header: http.Header{"Cache-Control": []string{`no-cache="Set-Cookie", max-age=10`}}, status: http.StatusOK},
+		{header: http.Header{"Cache-Control": []string{"max-age=10"}, "Set-Cookie": []string{"a=b"}}, status: http.StatusOK},
+		{header: http.Header{"Cache-Control": []string{"max-age=10"}, "Vary": []string{"*"}}, status: http.StatusOK},
+		{header: http.Header{"Expires": []string{"bad"}}, status: http.StatusOK},
+		{header: http.Header{"Cache-Control": []string{"max-age=10"}, "Content-Type": []string{"text/event-stream"}}, status: http.StatusOK},
+	} {
+		ttl, ok := cache.ttl(&http.Response{StatusCode: test.status, Header: test.header}, now)
+		td.Cmp(ttl, test.ttl, test.header)
+		td.Cmp(ok, test.ok, test.header)
+	}
+}
+
+func TestResponseCacheTransport_InvalidateLocation(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	var backendRequests int64
+	rtMock := NewRoundTripperMock(mc)
+	rtMock.RoundTripMock.Set(func(req *http.Request) (*http.Response, error) {
+		n := atomic.AddInt64(&backendRequests, 1)
+		header := http.Header{"Cache-Control": []string{"max-age=60"}}
+		if req.Method == http.MethodPost {
+			header = http.Header{
+				"Location":         []string{"1"},
+				"Content-Location": []string{"http://example.com/static/list?page=1"},
+			}
+			if req.URL.Path == "/static/other" {
+				header = http.Header{"Location": []string{"https://other.com/static/2"}}
+			}
+		}
+		body := req.URL.RequestURI() + " " + strconv.FormatInt(n, 10)
+		return &http.Response{StatusCode: http.StatusOK, Header: header, ContentLength: int64(len(body)),
+			Body: io.NopCloser(strings.NewReader(body))}, nil
+	})
+
+	cache, err := NewResponseCache([]string{"example.com/static/", "other.com/static/"}, 100, 1000, time.Hour)
+	td.CmpNoError(err)
+	transport := cache.wrap(rtMock)
+	get := func(method, host, uri string) string {
+		req, _ := http.NewRequestWithContext(ctx, method, "http://backend"+uri, nil)
+		req.Host = host
+		resp, err := transport.RoundTrip(req)
+		td.CmpNoError(err)
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return string(body)
+	}
+
+	td.Cmp(get(http.MethodGet, "example.com", "/static/items/1"), "/static/items/1 1")
+	td.Cmp(get(http.MethodGet, "example.com", "/static/list?page=1"), "/static/list?page=1 2")
+	td.Cmp(get(http.MethodGet, "example.com", "/static/2"), "/static/2 3")
+	td.Cmp(get(http.MethodGet, "other.com", "/static/2"), "/static/2 4")
+
+	// location relative to request uri, content location with same host
+	get(http.MethodPost, "example.com", "/static/items/")
+	td.Cmp(get(http.MethodGet, "example.com", "/static/items/1"), "/static/items/1 6")
+	td.Cmp(get(http.MethodGet, "example.com", "/static/list?page=1"), "/static/list?page=1 7")
+
+	// location with other host doesn't invalidate
+	get(http.MethodPost, "example.com", "/static/other")
+	td.Cmp(get(http.MethodGet, "example.com", "/static/2"), "/static/2 3")
+	td.Cmp(get(http.MethodGet, "other.com", "/static/2"), "/static/2 4")
+}
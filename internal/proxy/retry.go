@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// RetryPolicyConfig - timeouts and retries of requests to backend, matched to route
+type RetryPolicyConfig struct {
+	// Route in format "host/path-prefix", host "*" match any host.
+	Route string
+
+	// MaxAttempts - max count of attempts, including first. Retried idempotent requests without body only,
+	// PUT and DELETE - after failed connect to backend only.
+	MaxAttempts int
+
+	// PerTryTimeoutMilliseconds - timeout of every attempt until response headers received, 0 - without timeout.
+	PerTryTimeoutMilliseconds int
+
+	// DeadlineMilliseconds - timeout of all attempts until response headers received, 0 - without timeout.
+	DeadlineMilliseconds int
+}
+
+type retryPolicy struct {
+	route         route
+	maxAttempts   int
+	perTryTimeout time.Duration
+	deadline      time.Duration
+}
+
+func newRetryPolicy(config RetryPolicyConfig) (retryPolicy, error) {
+	r, err := parseRoute(config.Route)
+	if err != nil {
+		return retryPolicy{}, err
+	}
+	if config.MaxAttempts < 1 {
+		return retryPolicy{}, xerrors.Errorf("max attempts must be positive, got: %v", config.MaxAttempts)
+	}
+	if config.PerTryTimeoutMilliseconds < 0 || config.DeadlineMilliseconds < 0 {
+		return retryPolicy{}, xerrors.Errorf("negative timeout, per try: %v, deadline: %v",
+			config.PerTryTimeoutMilliseconds, config.DeadlineMilliseconds)
+	}
+	return retryPolicy{
+		route:         r,
+		maxAttempts:   config.MaxAttempts,
+		perTryTimeout: time.Duration(config.PerTryTimeoutMilliseconds) * time.Millisecond,
+		deadline:      time.Duration(config.DeadlineMilliseconds) * time.Millisecond,
+	}, nil
+}
+
+// RetryBudget limit retries by fraction of requests in window, for doesn't amplify load of overloaded backends.
+// Counters reset at start of every window.
+type RetryBudget struct {
+	Ratio      float64 // max retries as fraction of all requests to backends in window
+	MinRetries int     // retries, allowed in every window regardless of Ratio, for low traffic
+	Window     time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int64
+	retries     int64
+}
+
+// resetIfExpired must be called with locked mu
+func (b *RetryBudget) resetIfExpired(now time.Time) {
+	if now.Sub(b.windowStart) >= b.Window {
+		b.windowStart = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// allowed must be called with locked mu
+func (b *RetryBudget) allowed() float64 {
+	allowed := b.Ratio * float64(b.requests)
+	if minRetries := float64(b.MinRetries); allowed < minRetries {
+		allowed = minRetries
+	}
+	return allowed
+}
+
+func (b *RetryBudget) request(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resetIfExpired(now)
+	b.requests++
+}
+
+// allowRetry take retry from budget, return false if budget exhausted
+func (b *RetryBudget) allowRetry(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resetIfExpired(now)
+	if float64(b.retries+1) > b.allowed() {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// utilization return used part of budget of current window, 1 - exhausted
+func (b *RetryBudget) utilization(now time.Time) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resetIfExpired(now)
+	allowed := b.allowed()
+	if allowed == 0 {
+		return 1
+	}
+	return float64(b.retries) / allowed
+}
+
+// Retries apply timeouts and retries by first policy, matched to request to backend (by Host header and path).
+// Safe requests retried after transport errors (include timeout of attempt) and 502, 503, 504 responses,
+// PUT and DELETE - after failed connect to backend only, while retry budget isn't exhausted.
+type Retries struct {
+	Budget *RetryBudget
+
+	policies []retryPolicy
+
+	retries   int64
+	exhausted int64
+}
+
+// NewRetries validate policies and create retries
+func NewRetries(configs []RetryPolicyConfig, budget *RetryBudget) (*Retries, error) {
+	if budget == nil || budget.Window <= 0 || budget.Ratio < 0 || budget.MinRetries < 0 {
+		return nil, xerrors.New("retry budget need positive window and non negative ratio and min retries")
+	}
+	res := &Retries{Budget: budget}
+	for _, config := range configs {
+		policy, err := newRetryPolicy(config)
+		if err != nil {
+			return nil, xerrors.Errorf("retry policy for route %q: %w", config.Route, err)
+		}
+		res.policies = append(res.policies, policy)
+	}
+	return res, nil
+}
+
+// InitMetrics register counters of retries and utilization of retry budget
+func (r *Retries) InitMetrics(registry prometheus.Registerer) {
+	if registry == nil || reflect.ValueOf(registry).IsNil() {
+		return
+	}
+
+	registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "backend_retries", Help: "Count of retried requests to backends",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&r.retries))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "backend_retries_budget_exhausted", Help: "Count of retries, skipped because retry budget exhausted",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&r.exhausted))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "backend_retry_budget_utilization", Help: "Used part of retry budget in current window, 1 - exhausted",
+		}, func() float64 {
+			return r.Budget.utilization(time.Now())
+		}),
+	)
+}
+
+func (r *Retries) find(req *http.Request) *retryPolicy {
+	for i := range r.policies {
+		if r.policies[i].route.match(req) {
+			return &r.policies[i]
+		}
+	}
+	return nil
+}
+
+// wrap return transport with timeouts and retries
+func (r *Retries) wrap(transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return retryTransport{retries: r, next: transport}
+}
+
+// isRetryable return true for idempotent requests without body: body can't be sent again
+func isRetryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return isSafeMethod(req.Method) || req.Method == http.MethodPut || req.Method == http.MethodDelete
+}
+
+// isSafeMethod return true for methods without side effects on backend
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+// canRetry return true if attempt result allow retry of retryable request. Safe requests retried after errors
+// and 502, 503, 504 responses. Backend may apply other idempotent requests before timeout or error response,
+// so they retried after failed connect only, when request wasn't sent.
+func canRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err == nil {
+		return isSafeMethod(req.Method) && isRetryableStatus(resp.StatusCode)
+	}
+	return isSafeMethod(req.Method) || isDialError(err)
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return xerrors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+type retryTransport struct {
+	retries *Retries
+	next    http.RoundTripper
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.retries.Budget.request(time.Now())
+	policy := t.retries.find(req)
+	if policy == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	maxAttempts := policy.maxAttempts
+	if !isRetryable(req) {
+		maxAttempts = 1
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	stopDeadline := func() bool { return true }
+	if policy.deadline > 0 {
+		stopDeadline = time.AfterFunc(policy.deadline, cancel).Stop
+	}
+
+	logger := zc.L(req.Context())
+	for attempt := 1; ; attempt++ {
+		resp, err := t.try(ctx, req, policy.perTryTimeout)
+		if err != nil && ctx.Err() != nil && req.Context().Err() == nil {
+			err = xerrors.Errorf("backend deadline %v exceeded: %w", policy.deadline, err)
+		}
+		if !canRetry(req, resp, err) || attempt >= maxAttempts || ctx.Err() != nil {
+			stopDeadline()
+			return closeOnCancel(resp, err, cancel)
+		}
+
+		if !t.retries.Budget.allowRetry(time.Now()) {
+			atomic.AddInt64(&t.retries.exhausted, 1)
+			logger.Debug("Retry budget exhausted, doesn't retry request", zap.Int("attempt", attempt), zap.Error(err))
+			stopDeadline()
+			return closeOnCancel(resp, err, cancel)
+		}
+
+		atomic.AddInt64(&t.retries.retries, 1)
+		if err == nil {
+			logger.Debug("Retry request to backend", zap.Int("attempt", attempt), zap.Int("status", resp.StatusCode))
+			_ = resp.Body.Close()
+		} else {
+			logger.Debug("Retry request to backend", zap.Int("attempt", attempt), zap.Error(err))
+		}
+	}
+}
+
+// try send request with timeout until response headers. Context of request canceled on close of response body.
+func (t retryTransport) try(ctx context.Context, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stopTimeout := func() bool { return true }
+	if timeout > 0 {
+		stopTimeout = time.AfterFunc(timeout, cancel).Stop
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if !stopTimeout() {
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		err = xerrors.Errorf("backend response timeout %v: %w", timeout, context.DeadlineExceeded)
+	}
+	return closeOnCancel(resp, err, cancel)
+}
+
+// closeOnCancel return result of last attempt, cancel called when body closed or immediately on error
+func closeOnCancel(resp *http.Response, err error, cancel context.CancelFunc) (*http.Response, error) {
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return withCancelBody(resp, cancel), nil
+}
+
+// withCancelBody call cancel after close of response body. Body of upgraded connection (101 status)
+// must stay io.ReadWriteCloser, it doesn't wrapped: context canceled with context of request.
+func withCancelBody(resp *http.Response, cancel context.CancelFunc) *http.Response {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojuno/minimock/v3"
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestRetryTransport(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	mc := minimock.NewController(td)
+	defer mc.Finish()
+
+	// /fail-twice/ fail two attempts, /slow-first/ hang first attempt, /hang/ hang all attempts,
+	// /dial-fail-first/ can't connect to backend at first attempt
+	var attempts int64
+	rtMock := NewRoundTripperMock(mc)
+	rtMock.RoundTripMock.Set(func(req *http.Request) (*http.Response, error) {
+		attempt := atomic.AddInt64(&attempts, 1)
+		if strings.HasPrefix(req.URL.Path, "/hang/") || strings.HasPrefix(req.URL.Path, "/slow-first/") && attempt == 1 {
+			<-req.Context().Done()
+			return nil, req.Context().Err()
+		}
+		if strings.HasPrefix(req.URL.Path, "/dial-fail-first/") && attempt == 1 {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+		status := http.StatusOK
+		if strings.HasPrefix(req.URL.Path, "/fail-twice/") && attempt <= 2 || strings.HasPrefix(req.URL.Path, "/fail/") {
+			status = http.StatusServiceUnavailable
+		}
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("ok"))}, nil
+	})
+
+	retries, err := NewRetries([]RetryPolicyConfig{
+		{Route: "example.com/slow-first/", MaxAttempts: 2, PerTryTimeoutMilliseconds: 50},
+		{Route: "example.com/hang/", MaxAttempts: 10, PerTryTimeoutMilliseconds: 20, DeadlineMilliseconds: 100},
+		{Route: "example.com/", MaxAttempts: 3},
+	}, &RetryBudget{Ratio: 0, MinRetries: 4, Window: time.Hour})
+	td.CmpNoError(err)
+	transport := retries.wrap(rtMock)
+
+	do := func(method, host, path, body string) (int, error) {
+		atomic.StoreInt64(&attempts, 0)
+		req, _ := http.NewRequestWithContext(ctx, method, "http://backend"+path, nil)
+		if body != "" {
+			req.Body = ioutil.NopCloser(strings.NewReader(body))
+		}
+		req.Host = host
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return 0, err
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	status, err := do(http.MethodGet, "example.com", "/fail-twice/", "")
+	td.CmpNoError(err)
+	td.Cmp(status, http.StatusOK)
+	td.Cmp(atomic.LoadInt64(&attempts), int64(3))
+
+	// request with body can't be sent again
+	status, err = do(http.MethodPost, "example.com", "/fail-twice/", "body")
+	td.CmpNoError(err)
+	td.Cmp(status, http.StatusServiceUnavailable)
+	td.Cmp(atomic.LoadInt64(&attempts), int64(1))
+
+	// without matched policy
+	status, _ = do(http.MethodGet, "other.com", "/fail-twice/", "")
+	td.Cmp(status, http.StatusServiceUnavailable)
+	td.Cmp(atomic.LoadInt64(&attempts), int64(1))
+
+	status, err = do(http.MethodGet, "example.com", "/slow-first/", "")
+	td.CmpNoError(err)
+	td.Cmp(status, http.StatusOK)
+	td.Cmp(atomic.LoadInt64(&attempts), int64(2))
+	td.Cmp(atomic.LoadInt64(&retries.retries), int64(3))
+
+	// budget exhausted: one retry left
+	status, _ = do(http.MethodGet, "example.com", "/fail/", "")
+	td.Cmp(status, http.StatusServiceUnavailable)
+	td.Cmp(atomic.LoadInt64(&attempts), int64(2))
+	td.Cmp(atomic.LoadInt64(&retries.exhausted), int64(1))
+	td.Cmp(retries.Budget.utilization(time.Now()), float64(1))
+
+	retries.Budget.MinRetries = 100
+	start := time.Now()
+	_, err = do(http.MethodGet, "example.com", "/hang/", "")
+	td.CmpError(err)
+	td.Cmp(time.Since(start), testdeep.Lt(time.Second))
+	td.Cmp(atomic.LoadInt64(&attempts), testdeep.Between(int64(2), int64(6)))
+
+	// backend may apply not safe request before error response or timeout
+	status, err = do(http.MethodPut, "example.com", "/fail-twice/", "")
+	td.CmpNoError(err)
+	td.Cmp(status, http.StatusServiceUnavailable)
+	td.Cmp(atomic.LoadInt64(&attempts), int64(1))
+
+	_, err = do(http.MethodDelete, "example.com", "/slow-first/", "")
+	td.CmpError(err)
+	td.Cmp(atomic.LoadInt64(&attempts), int64(1))
+
+	// request wasn't sent
+	status, err = do(http.MethodPut, "example.com", "/dial-fail-first/", "")
+	td.CmpNoError(err)
+	td.Cmp(status, http.StatusOK)
+	td.Cmp(atomic.LoadInt64(&attempts), int64(2))
+
+	status, err = do(http.MethodGet, "example.com", "/dial-fail-first/", "")
+	td.CmpNoError(err)
+	td.Cmp(status, http.StatusOK)
+	td.Cmp(atomic.LoadInt64(&attempts), int64(2))
+}
+
+func TestRetryBudget(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	now := time.Now()
+	budget := &RetryBudget{Ratio: 0.1, MinRetries: 1, Window: time.Minute}
+	td.True(budget.allowRetry(now))
+	td.False(budget.allowRetry(now))
+	td.Cmp(budget.utilization(now), float64(1))
+
+	for i := 0; i < 30; i++ {
+		budget.request(now)
+	}
+	td.True(budget.allowRetry(now))
+	td.True(budget.allowRetry(now))
+	td.False(budget.allowRetry(now))
+
+	// new window
+	td.Cmp(budget.utilization(now.Add(time.Minute)), float64(0))
+	td.True(budget.allowRetry(now.Add(time.Minute)))
+}
+
+func TestNewRetries(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	budget := &RetryBudget{Ratio: 0.1, Window: time.Second}
+	_, err := NewRetries([]RetryPolicyConfig{{Route: "*/", MaxAttempts: 2}}, budget)
+	td.CmpNoError(err)
+
+	for _, bad := range []RetryPolicyConfig{
+		{Route: "bad", MaxAttempts: 2},
+		{Route: "*/", MaxAttempts: 0},
+		{Route: "*/", MaxAttempts: 2, PerTryTimeoutMilliseconds: -1},
+		{Route: "*/", MaxAttempts: 2, DeadlineMilliseconds: -1},
+	} {
+		_, err = NewRetries([]RetryPolicyConfig{bad}, budget)
+		td.CmpError(err, bad.Route)
+	}
+
+	_, err = NewRetries(nil, &RetryBudget{Ratio: 0.1})
+	td.CmpError(err)
+	_, err = NewRetries(nil, &RetryBudget{Ratio: -1, Window: time.Second})
+	td.CmpError(err)
+}
@@ -0,0 +1,399 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/xerrors"
+)
+
+// RewriteRuleConfig - rewrite of requests to backend, matched to route
+type RewriteRuleConfig struct {
+	// Route in format "host/path-prefix", host "*" match any host.
+	Route string
+
+	// ALPN - protocol, negotiated by tls handshake with client ("h2", "http/1.1"), empty - any.
+	// "http/1.1" match connections without negotiated protocol (plain http and tls without alpn) too.
+	ALPN string
+
+	// ClientCert - identity of client certificate: common name or one of dns, email, uri alternative names,
+	// "*" - any client certificate. Empty - any request, with or without client certificate.
+	ClientCert string
+
+	// AllowedMethods - http methods of requests to the route, other methods rejected by 405 status.
+	// Empty - methods allowed by Proxy.AllowedMethods.
+	AllowedMethods []string
+
+	// Backend - address of backend (host:port) instead of selected by DefaultTarget and TargetMap.
+	// Address can contain scheme (http://host:port or https://host:port) instead of Proxy default upstream scheme.
+	// Empty - without change. For fastcgi UpstreamProto it can be unix socket: "unix:/path/to/socket".
+	Backend string
+
+	// UpstreamProto - protocol of backend: empty - http or https by Proxy settings, "fastcgi" - FastCGI server
+	// (for example php-fpm), requests sent with cgi variables, response converted to http.
+	UpstreamProto string
+
+	// FastCGIRoot - absolute path of document root on FastCGI server, base for SCRIPT_FILENAME.
+	FastCGIRoot string
+
+	// FastCGIIndex - script for paths, ended by slash. Empty - index.php.
+	FastCGIIndex string
+
+	// FastCGISplitPath - extension of scripts (".php"): path split after it to SCRIPT_NAME and PATH_INFO.
+	// Empty - whole path is SCRIPT_NAME.
+	FastCGISplitPath string
+
+	// Host - Host header, sent to backend. Empty - without change.
+	Host string
+
+	// ServerName - template of SNI and verified name of https backend certificate, evaluated for every request:
+	// text with placeholders ServerNameHost, ServerNameSNI. Empty - server name by Proxy settings.
+	ServerName string
+
+	// SetHeaders - "Name:value" lines, value can be same placeholders as Proxy.Headers.
+	SetHeaders []string
+
+	// RemoveHeaders - names of removed headers.
+	RemoveHeaders []string
+
+	// RenameHeaders - "OldName:NewName" lines.
+	RenameHeaders []string
+
+	// PathPrefixFrom replaced by PathPrefixTo in path of request.
+	PathPrefixFrom string
+	PathPrefixTo   string
+
+	// PathRegexp replaced by PathReplacement in path of request, PathReplacement can contain $1, ${name}, etc.
+	PathRegexp      string
+	PathReplacement string
+
+	// LongLived - route of long requests (websockets, server-sent events, long polling): ReadTimeout, WriteTimeout
+	// and slow connections detection doesn't applied to its requests, IdleTimeoutSeconds applied instead.
+	LongLived bool
+
+	// IdleTimeoutSeconds - close long-lived request, idle for the time: without data from backend
+	// and, for websockets, from client. 0 - without idle timeout.
+	IdleTimeoutSeconds int
+
+	// WebSocketPingIntervalSeconds - send ping frame to websocket client of long-lived route, when backend
+	// doesn't send data for the interval. 0 - without pings.
+	WebSocketPingIntervalSeconds int
+
+	// BackendMaxIdleConnsPerHost, BackendMaxConnsPerHost, BackendIdleConnTimeoutSeconds - settings of connection pool
+	// for backends of the route, override same settings of Proxy. 0 - setting of Proxy.
+	BackendMaxIdleConnsPerHost    int
+	BackendMaxConnsPerHost        int
+	BackendIdleConnTimeoutSeconds int
+
+	// HTTPSBackendIgnoreCert, HTTPSBackendCAFile, HTTPSBackendClientCert, HTTPSBackendClientKey - verification
+	// of https backends of the route and client certificate for them, override same settings of Proxy.
+	// Empty - setting of Proxy.
+	HTTPSBackendIgnoreCert bool
+	HTTPSBackendCAFile     string
+	HTTPSBackendClientCert string
+	HTTPSBackendClientKey  string
+}
+
+type rewriteRule struct {
+	route          route
+	alpn           string
+	clientCert     string
+	allowedMethods []string
+	backend        string
+	backendScheme  string
+	host           string
+	serverName     serverNameTemplate
+	removeHeaders  []string
+	renameHeaders  [][2]string
+	setHeaders     DirectorSetHeaders
+	pathPrefixFrom string
+	pathPrefixTo   string
+	pathRegexp     *regexp.Regexp
+	pathReplace    string
+	longLived      bool
+	idleTimeout    time.Duration
+	pingInterval   time.Duration
+	fastCGI        *fastCGIRoute
+	poolSettings   *PoolSettings
+	routeTLS       *RouteTLS
+}
+
+// DirectorRewrite apply first rule, matched to request. Headers removed, renamed and set in the order.
+type DirectorRewrite []rewriteRule
+
+// NewDirectorRewrite validate rules and create director
+func NewDirectorRewrite(configs []RewriteRuleConfig) (DirectorRewrite, error) {
+	res := make(DirectorRewrite, 0, len(configs))
+	for _, config := range configs {
+		rule, err := newRewriteRule(config)
+		if err != nil {
+			return nil, xerrors.Errorf("rewrite rule for route %q: %w", config.Route, err)
+		}
+		res = append(res, rule)
+	}
+	return res, nil
+}
+
+func newRewriteRule(config RewriteRuleConfig) (rewriteRule, error) {
+	var res rewriteRule
+	var err error
+
+	res.route, err = parseRoute(config.Route)
+	if err != nil {
+		return res, err
+	}
+
+	res.alpn = config.ALPN
+	res.clientCert = config.ClientCert
+
+	if len(config.AllowedMethods) > 0 {
+		res.allowedMethods, err = ParseAllowedMethods(config.AllowedMethods)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	switch config.UpstreamProto {
+	case "":
+		if config.FastCGIRoot != "" || config.FastCGIIndex != "" || config.FastCGISplitPath != "" {
+			return res, xerrors.New("fastcgi settings for fastcgi upstream proto only")
+		}
+	case ProtocolFastCGI:
+		if !path.IsAbs(config.FastCGIRoot) {
+			return res, xerrors.Errorf("fastcgi root must be absolute path: %q", config.FastCGIRoot)
+		}
+		if strings.Contains(config.FastCGIIndex, "/") {
+			return res, xerrors.Errorf("bad fastcgi index: %q", config.FastCGIIndex)
+		}
+		res.fastCGI = &fastCGIRoute{
+			root:      config.FastCGIRoot,
+			index:     config.FastCGIIndex,
+			splitPath: strings.ToLower(config.FastCGISplitPath),
+		}
+		if res.fastCGI.index == "" {
+			res.fastCGI.index = fastCGIDefaultIndex
+		}
+	default:
+		return res, xerrors.Errorf("unknown upstream proto: %q", config.UpstreamProto)
+	}
+
+	switch {
+	case config.Backend == "":
+	case res.fastCGI != nil && strings.HasPrefix(config.Backend, fastCGIUnixPrefix):
+		if strings.TrimPrefix(config.Backend, fastCGIUnixPrefix) == "" {
+			return res, xerrors.Errorf("bad backend, empty unix socket path: %q", config.Backend)
+		}
+		res.fastCGI.address = config.Backend
+	case strings.HasPrefix(config.Backend, fastCGIUnixPrefix):
+		return res, xerrors.Errorf("unix socket backend for fastcgi upstream proto only: %q", config.Backend)
+	default:
+		res.backendScheme, res.backend, err = parseUpstreamTarget(config.Backend)
+		if err != nil {
+			return res, xerrors.Errorf("bad backend: %w", err)
+		}
+		if res.fastCGI != nil && res.backendScheme != "" {
+			return res, xerrors.Errorf("backend scheme for http upstream proto only: %q", config.Backend)
+		}
+	}
+
+	if config.Host != "" && !httpguts.ValidHostHeader(config.Host) {
+		return res, xerrors.Errorf("bad host: %q", config.Host)
+	}
+	res.host = config.Host
+
+	if config.ServerName != "" {
+		res.serverName, err = parseServerNameTemplate(config.ServerName)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	for _, name := range config.RemoveHeaders {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return res, xerrors.Errorf("bad header name for remove: %q", name)
+		}
+		res.removeHeaders = append(res.removeHeaders, name)
+	}
+
+	for _, line := range config.RenameHeaders {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !httpguts.ValidHeaderFieldName(parts[0]) || !httpguts.ValidHeaderFieldName(parts[1]) {
+			return res, xerrors.Errorf("bad header rename, expected OldName:NewName: %q", line)
+		}
+		res.renameHeaders = append(res.renameHeaders, [2]string{parts[0], parts[1]})
+	}
+
+	if len(config.SetHeaders) > 0 {
+		res.setHeaders = make(DirectorSetHeaders, len(config.SetHeaders))
+		for _, line := range config.SetHeaders {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 || !httpguts.ValidHeaderFieldName(parts[0]) || !httpguts.ValidHeaderFieldValue(parts[1]) {
+				return res, xerrors.Errorf("bad header for set, expected Name:value: %q", line)
+			}
+			res.setHeaders[parts[0]] = parts[1]
+		}
+	}
+
+	if (config.PathPrefixFrom != "" || config.PathPrefixTo != "") && config.PathRegexp != "" {
+		return res, xerrors.New("path prefix and path regexp can't be used together")
+	}
+	if config.PathPrefixTo != "" && config.PathPrefixFrom == "" {
+		return res, xerrors.New("path prefix to without path prefix from")
+	}
+	if config.PathPrefixFrom != "" && !strings.HasPrefix(config.PathPrefixFrom, "/") {
+		return res, xerrors.Errorf("path prefix from must start with slash: %q", config.PathPrefixFrom)
+	}
+	res.pathPrefixFrom = config.PathPrefixFrom
+	res.pathPrefixTo = config.PathPrefixTo
+
+	if config.PathRegexp != "" {
+		res.pathRegexp, err = regexp.Compile(config.PathRegexp)
+		if err != nil {
+			return res, xerrors.Errorf("compile path regexp: %w", err)
+		}
+		res.pathReplace = config.PathReplacement
+	} else if config.PathReplacement != "" {
+		return res, xerrors.New("path replacement without path regexp")
+	}
+
+	if config.IdleTimeoutSeconds < 0 || config.WebSocketPingIntervalSeconds < 0 {
+		return res, xerrors.Errorf("negative idle timeout: %v or websocket ping interval: %v",
+			config.IdleTimeoutSeconds, config.WebSocketPingIntervalSeconds)
+	}
+	if !config.LongLived && (config.IdleTimeoutSeconds != 0 || config.WebSocketPingIntervalSeconds != 0) {
+		return res, xerrors.New("idle timeout and websocket ping interval for long-lived routes only")
+	}
+	res.longLived = config.LongLived
+	res.idleTimeout = time.Duration(config.IdleTimeoutSeconds) * time.Second
+	res.pingInterval = time.Duration(config.WebSocketPingIntervalSeconds) * time.Second
+
+	res.poolSettings, err = newPoolSettings(config.BackendMaxIdleConnsPerHost, config.BackendMaxConnsPerHost,
+		config.BackendIdleConnTimeoutSeconds)
+	if err != nil {
+		return res, err
+	}
+
+	res.routeTLS, err = newRouteTLS(config.HTTPSBackendIgnoreCert, config.HTTPSBackendCAFile,
+		config.HTTPSBackendClientCert, config.HTTPSBackendClientKey)
+	if err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+func (d DirectorRewrite) Director(request *http.Request) error {
+	for i := range d {
+		if d[i].match(request) {
+			return d[i].apply(request)
+		}
+	}
+	return nil
+}
+
+// longLived return first rule, matched to request, if it is long-lived
+func (d DirectorRewrite) longLived(request *http.Request) *rewriteRule {
+	for i := range d {
+		if d[i].match(request) {
+			if d[i].longLived {
+				return &d[i]
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *rewriteRule) match(request *http.Request) bool {
+	if r.alpn != "" && r.alpn != negotiatedProtocol(request) {
+		return false
+	}
+	if r.clientCert != "" && !clientCertMatch(ClientCertFromContext(request.Context()), r.clientCert) {
+		return false
+	}
+	return r.route.match(request)
+}
+
+func (r *rewriteRule) apply(request *http.Request) error {
+	logger := zc.L(request.Context())
+
+	if request.Header == nil {
+		request.Header = make(http.Header)
+	}
+	// evaluated before rewrite of request
+	if r.serverName != nil {
+		serverName := r.serverName.execute(request)
+		*request = *request.WithContext(context.WithValue(request.Context(), backendServerNameKey{}, serverName))
+	}
+	for _, name := range r.removeHeaders {
+		request.Header.Del(name)
+	}
+	for _, names := range r.renameHeaders {
+		if values := request.Header.Values(names[0]); len(values) > 0 {
+			request.Header.Del(names[0])
+			request.Header[http.CanonicalHeaderKey(names[1])] = values
+		}
+	}
+	if r.setHeaders != nil {
+		if err := r.setHeaders.Director(request); err != nil {
+			return err
+		}
+	}
+
+	if r.backend != "" {
+		request.URL.Host = r.backend
+	}
+	if r.backendScheme != "" {
+		request.URL.Scheme = r.backendScheme
+	}
+	if _, splitSettings := requestPoolSettings(request); r.poolSettings != nil && !splitSettings {
+		// settings of split route, which select backend, have priority
+		*request = *request.WithContext(withPoolSettings(request.Context(), *r.poolSettings))
+	}
+	if r.routeTLS != nil {
+		*request = *request.WithContext(withRouteTLS(request.Context(), r.routeTLS))
+	}
+	if r.host != "" {
+		request.Host = r.host
+	}
+	if r.fastCGI != nil {
+		request.URL.Scheme = ProtocolFastCGI
+		*request = *request.WithContext(context.WithValue(request.Context(), fastCGIRouteKey{}, r.fastCGI))
+	}
+
+	path := request.URL.Path
+	switch {
+	case r.pathRegexp != nil:
+		path = r.pathRegexp.ReplaceAllString(path, r.pathReplace)
+	case r.pathPrefixFrom != "" && strings.HasPrefix(path, r.pathPrefixFrom):
+		path = r.pathPrefixTo + strings.TrimPrefix(path, r.pathPrefixFrom)
+	}
+	if path != request.URL.Path {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		request.URL.Path = path
+		request.URL.RawPath = ""
+	}
+
+	logger.Debug("Rewrite request", zap.String("route_host", r.route.host),
+		zap.String("route_path_prefix", r.route.pathPrefix), zap.String("route_alpn", r.alpn),
+		zap.String("backend", request.URL.Host), zap.String("host", request.Host), zap.String("path", request.URL.Path))
+	return nil
+}
+
+// negotiatedProtocol return protocol, negotiated by tls handshake with client.
+// Connections without negotiated protocol (plain http or tls without alpn) use http/1.1.
+func negotiatedProtocol(request *http.Request) string {
+	if request.TLS != nil && request.TLS.NegotiatedProtocol != "" {
+		return request.TLS.NegotiatedProtocol
+	}
+	return "http/1.1"
+}
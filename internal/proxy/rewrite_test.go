@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestDirectorRewrite(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	d, err := NewDirectorRewrite([]RewriteRuleConfig{
+		{
+			Route:          "example.com/api/",
+			Host:           "backend.internal",
+			SetHeaders:     []string{"X-Client-IP:{{SOURCE_IP}}", "X-Static:1"},
+			RemoveHeaders:  []string{"Cookie"},
+			RenameHeaders:  []string{"X-Token:Authorization"},
+			PathPrefixFrom: "/api/",
+			PathPrefixTo:   "/v2/",
+		},
+		{
+			Route:           "*/user/",
+			PathRegexp:      `^/user/(\d+)/?$`,
+			PathReplacement: "/users/$1",
+		},
+		{
+			Route:          "*/strip/",
+			PathPrefixFrom: "/strip",
+		},
+	})
+	td.CmpNoError(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://Example.com:443/api/items%2F1?a=b", nil).WithContext(ctx)
+	req.Header.Set("Cookie", "a=b")
+	req.Header.Add("X-Token", "t1")
+	req.Header.Add("X-Token", "t2")
+	td.CmpNoError(d.Director(req))
+	td.Cmp(req.Host, "backend.internal")
+	td.Cmp(req.URL.Path, "/v2/items/1")
+	td.Cmp(req.URL.RawQuery, "a=b")
+	td.Cmp(req.Header, http.Header{
+		"Authorization": []string{"t1", "t2"},
+		"X-Client-Ip":   []string{"192.0.2.1"},
+		"X-Static":      []string{"1"},
+	})
+
+	// first matched rule only
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/user/12", nil).WithContext(ctx)
+	td.CmpNoError(d.Director(req))
+	td.Cmp(req.Host, "example.com")
+	td.Cmp(req.URL.Path, "/users/12")
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/strip/", nil).WithContext(ctx)
+	td.CmpNoError(d.Director(req))
+	td.Cmp(req.URL.Path, "/")
+
+	req = httptest.NewRequest(http.MethodGet, "http://other.com/api/x", nil).WithContext(ctx)
+	req.Header.Set("Cookie", "a=b")
+	td.CmpNoError(d.Director(req))
+	td.Cmp(req.Host, "other.com")
+	td.Cmp(req.URL.Path, "/api/x")
+	td.Cmp(req.Header.Get("Cookie"), "a=b")
+}
+
+func TestDirectorRewriteALPN(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	d, err := NewDirectorRewrite([]RewriteRuleConfig{
+		{Route: "example.com/", ALPN: "h2", Backend: "h2-backend:80"},
+		{Route: "example.com/", ALPN: "http/1.1", Backend: "http1-backend:80"},
+	})
+	td.CmpNoError(err)
+
+	for _, test := range []struct {
+		tls      *tls.ConnectionState
+		expected string
+	}{
+		{&tls.ConnectionState{NegotiatedProtocol: "h2"}, "h2-backend:80"},
+		{&tls.ConnectionState{NegotiatedProtocol: "http/1.1"}, "http1-backend:80"},
+		{&tls.ConnectionState{}, "http1-backend:80"},
+		{nil, "http1-backend:80"},
+		{&tls.ConnectionState{NegotiatedProtocol: "other"}, "default:80"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(ctx)
+		req.URL.Host = "default:80"
+		req.TLS = test.tls
+		td.CmpNoError(d.Director(req))
+		td.Cmp(req.URL.Host, test.expected, "%#v", test.tls)
+	}
+}
+
+func TestDirectorRewriteBackendScheme(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	d, err := NewDirectorRewrite([]RewriteRuleConfig{
+		{Route: "secure.example.com/", Backend: "HTTPS://secure-backend:8443"},
+		{Route: "*/", Backend: "backend:80"},
+	})
+	td.CmpNoError(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://secure.example.com/", nil).WithContext(ctx)
+	req.URL.Scheme = ProtocolHTTP
+	td.CmpNoError(d.Director(req))
+	td.Cmp(req.URL.Scheme, ProtocolHTTPS)
+	td.Cmp(req.URL.Host, "secure-backend:8443")
+
+	// backend without scheme keep scheme of request
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(ctx)
+	req.URL.Scheme = ProtocolHTTPS
+	td.CmpNoError(d.Director(req))
+	td.Cmp(req.URL.Scheme, ProtocolHTTPS)
+	td.Cmp(req.URL.Host, "backend:80")
+}
+
+func TestHTTPProxy_ALPNBackends(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+	}
+	h2Backend := newBackend("h2")
+	defer h2Backend.Close()
+	http1Backend := newBackend("http1")
+	defer http1Backend.Close()
+
+	rewrite, err := NewDirectorRewrite([]RewriteRuleConfig{
+		{Route: "*/", ALPN: "h2", Backend: h2Backend.Listener.Addr().String()},
+		{Route: "*/", ALPN: "http/1.1", Backend: http1Backend.Listener.Addr().String()},
+	})
+	e.CmpNoError(err)
+
+	listener := tls.NewListener(th.NewLocalTcpListener(e), &tls.Config{
+		Certificates: []tls.Certificate{th.LocalhostCert(e)},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	proxy := NewHTTPProxy(ctx, listener)
+	proxy.Director = NewDirectorChain(NewDirectorHost("127.0.0.1:1"), NewSetSchemeDirector(ProtocolHTTP), rewrite)
+	go func() { _ = proxy.Start() }()
+	defer func() { _ = proxy.Close() }()
+
+	for _, test := range []struct {
+		transport *http.Transport
+		proto     string
+		expected  string
+	}{
+		{&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}, "HTTP/2.0", "h2"}, //nolint:gosec
+		{&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, "HTTP/1.1", "http1"},                       //nolint:gosec
+	} {
+		client := http.Client{Transport: test.transport, Timeout: 10 * time.Second}
+		resp, err := client.Get("https://" + listener.Addr().String() + "/")
+		if !e.CmpNoError(err, test.proto) {
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		e.CmpNoError(err)
+		e.Cmp(resp.Proto, test.proto)
+		e.Cmp(string(body), test.expected, test.proto)
+		test.transport.CloseIdleConnections()
+	}
+}
+
+func TestNewDirectorRewriteErrors(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	for _, config := range []RewriteRuleConfig{
+		{Route: "/api/"},
+		{Route: "*/", Host: "bad host"},
+		{Route: "*/", RemoveHeaders: []string{"Bad Name"}},
+		{Route: "*/", RenameHeaders: []string{"X-Name"}},
+		{Route: "*/", SetHeaders: []string{"X-Name"}},
+		{Route: "*/", PathPrefixTo: "/v2/"},
+		{Route: "*/", PathPrefixFrom: "api/"},
+		{Route: "*/", PathPrefixFrom: "/api/", PathRegexp: "^/api/"},
+		{Route: "*/", PathRegexp: "("},
+		{Route: "*/", PathReplacement: "/"},
+		{Route: "*/", Backend: "no-port"},
+		{Route: "*/", Backend: "ftp://backend:21"},
+		{Route: "*/", Backend: "https://backend:0"},
+		{Route: "*/", Backend: "https://backend:9000", UpstreamProto: "fastcgi", FastCGIRoot: "/var/www"},
+		{Route: "*/", ServerName: "{{PATH}}"},
+		{Route: "*/", ServerName: "{{HOST"},
+		{Route: "*/", ServerName: "{{HOST}}/"},
+		{Route: "*/", BackendIdleConnTimeoutSeconds: -1},
+	} {
+		_, err := NewDirectorRewrite([]RewriteRuleConfig{config})
+		td.CmpError(err, "%#v", config)
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/domain"
+)
+
+// route match requests by host and prefix of path
+type route struct {
+	host       string // empty - any host
+	pathPrefix string
+}
+
+// parseRoute parse route in format "host/path-prefix", host "*" match any host.
+// Host normalized as domain, with port if it present (match requests to the port with RouteHostWithPort only).
+func parseRoute(s string) (route, error) {
+	index := strings.Index(s, "/")
+	if index <= 0 {
+		return route{}, xerrors.Errorf("bad route, expected host/path-prefix: %q", s)
+	}
+	host := s[:index]
+	if host == "*" {
+		host = ""
+	} else {
+		host = domain.NormalizeHost(host, true)
+	}
+	return route{host: host, pathPrefix: s[index:]}, nil
+}
+
+func (r route) match(req *http.Request) bool {
+	if !strings.HasPrefix(req.URL.Path, r.pathPrefix) {
+		return false
+	}
+	return r.host == "" || r.host == routeHost(req)
+}
+
+// routeHost return normalized Host of request for match routes, with port if RouteHostWithPort
+// set for the request
+func routeHost(req *http.Request) string {
+	keepPort, _ := req.Context().Value(contextlabel.RouteHostWithPort).(bool)
+	return domain.NormalizeHost(req.Host, keepPort)
+}
+
+// withRouteHostWithPort mark request for match routes by host with port
+func (p *HTTPProxy) withRouteHostWithPort(request *http.Request) *http.Request {
+	if !p.RouteHostWithPort {
+		return request
+	}
+	return request.WithContext(context.WithValue(request.Context(), contextlabel.RouteHostWithPort, true))
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+func TestRoute_Match(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	request := func(host string, withPort bool) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/api/test", nil)
+		req.Host = host
+		if withPort {
+			req = req.WithContext(context.WithValue(req.Context(), contextlabel.RouteHostWithPort, true))
+		}
+		return req
+	}
+
+	r, err := parseRoute("Example.COM./api/")
+	td.CmpNoError(err)
+	td.Cmp(r, route{host: "example.com", pathPrefix: "/api/"})
+	for _, host := range []string{"example.com", "Example.com:443", "EXAMPLE.COM.", "example.com.:8443"} {
+		td.True(r.match(request(host, false)), host)
+	}
+	td.False(r.match(request("other.com", false)))
+	td.True(r.match(request("example.com", true)))
+	td.False(r.match(request("example.com:443", true)))
+
+	r, err = parseRoute("Тест.рф/api/")
+	td.CmpNoError(err)
+	td.Cmp(r.host, "xn--e1aybc.xn--p1ai")
+	td.True(r.match(request("xn--e1aybc.xn--p1ai:443", false)))
+	td.True(r.match(request("тест.рф.", false)))
+
+	r, err = parseRoute("example.com:8443/api/")
+	td.CmpNoError(err)
+	td.True(r.match(request("Example.com:8443", true)))
+	td.False(r.match(request("example.com:443", true)))
+	td.False(r.match(request("example.com", true)))
+
+	r, err = parseRoute("*/api/")
+	td.CmpNoError(err)
+	td.True(r.match(request("any.com:80", true)))
+	td.False(r.match(httptest.NewRequest(http.MethodGet, "http://example.com/other", nil)))
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/xerrors"
+)
+
+// RouteTLS - verification of https backends of route and client certificate for them,
+// override same settings of Transport.
+type RouteTLS struct {
+	// IgnoreCert - doesn't verify backend certificate.
+	IgnoreCert bool
+
+	// RootCAs for verify backend certificate, nil - RootCAs of Transport.
+	RootCAs *x509.CertPool
+
+	// ClientCertificates for mTLS authentication on backend, nil - ClientCertificates of Transport.
+	ClientCertificates []tls.Certificate
+}
+
+type routeTLSKey struct{}
+
+// newRouteTLS validate and load settings of route, return nil if all settings from Transport
+func newRouteTLS(ignoreCert bool, caFile, clientCertFile, clientKeyFile string) (*RouteTLS, error) {
+	if !ignoreCert && caFile == "" && clientCertFile == "" && clientKeyFile == "" {
+		return nil, nil
+	}
+
+	res := &RouteTLS{IgnoreCert: ignoreCert}
+	var err error
+	if caFile != "" {
+		if ignoreCert {
+			return nil, xerrors.New("HTTPSBackendCAFile can't be used with HTTPSBackendIgnoreCert = true")
+		}
+		res.RootCAs, err = loadBackendCA(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if clientCertFile != "" || clientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		if err != nil {
+			return nil, xerrors.Errorf("load backend client certificate: %w", err)
+		}
+		res.ClientCertificates = []tls.Certificate{cert}
+	}
+	return res, nil
+}
+
+// apply override tls config of transport by settings of route. Route CA enable verification of certificate.
+func (r *RouteTLS) apply(config *tls.Config) {
+	if r.RootCAs != nil {
+		config.RootCAs = r.RootCAs
+		config.InsecureSkipVerify = false
+	}
+	if r.IgnoreCert {
+		config.InsecureSkipVerify = true
+	}
+	if r.ClientCertificates != nil {
+		config.Certificates = r.ClientCertificates
+	}
+}
+
+// withRouteTLS save tls settings of https backends for request to context
+func withRouteTLS(ctx context.Context, settings *RouteTLS) context.Context {
+	return context.WithValue(ctx, routeTLSKey{}, settings)
+}
+
+func requestRouteTLS(req *http.Request) *RouteTLS {
+	settings, _ := req.Context().Value(routeTLSKey{}).(*RouteTLS)
+	return settings
+}
+
+func loadBackendCA(file string) (*x509.CertPool, error) {
+	caBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, xerrors.Errorf("read backend CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return nil, xerrors.Errorf("no certificates in backend CA file: %q", file)
+	}
+	return pool, nil
+}
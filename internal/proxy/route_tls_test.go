@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
+)
+
+func TestRouteTLS(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	tmpDir := t.TempDir()
+	certFile := filepath.Join(tmpDir, "cert.pem")
+	keyFile := filepath.Join(tmpDir, "key.pem")
+	td.CmpNoError(ioutil.WriteFile(certFile, testcert.LocalhostCert, 0600))
+	td.CmpNoError(ioutil.WriteFile(keyFile, testcert.LocalhostKey, 0600))
+
+	settings, err := newRouteTLS(false, "", "", "")
+	td.CmpNoError(err)
+	td.Nil(settings)
+
+	for _, config := range []RewriteRuleConfig{
+		{Route: "*/", HTTPSBackendIgnoreCert: true, HTTPSBackendCAFile: certFile},
+		{Route: "*/", HTTPSBackendCAFile: filepath.Join(tmpDir, "not-exist.pem")},
+		{Route: "*/", HTTPSBackendCAFile: keyFile},
+		{Route: "*/", HTTPSBackendClientCert: certFile},
+	} {
+		_, err := NewDirectorRewrite([]RewriteRuleConfig{config})
+		td.CmpError(err, "%#v", config)
+	}
+
+	rewrite, err := NewDirectorRewrite([]RewriteRuleConfig{
+		{Route: "ca.ru/", HTTPSBackendCAFile: certFile, HTTPSBackendClientCert: certFile, HTTPSBackendClientKey: keyFile},
+		{Route: "ignore.ru/", HTTPSBackendIgnoreCert: true},
+	})
+	td.CmpNoError(err)
+
+	transport := Transport{IgnoreHTTPSCertificate: true, Pool: &ConnectionPool{}}
+	getTransport := func(url string) *http.Transport {
+		req := httptest.NewRequest(http.MethodGet, url, nil).WithContext(ctx)
+		td.CmpNoError(rewrite.Director(req))
+		req.URL.Scheme = ProtocolHTTPS
+		req.URL.Host = "backend:443"
+		req.Host = "backend"
+		return transport.getTransport(req)
+	}
+
+	common := getTransport("http://other.ru/")
+	td.True(common.TLSClientConfig.InsecureSkipVerify)
+	td.Nil(common.TLSClientConfig.RootCAs)
+	td.Nil(common.TLSClientConfig.Certificates)
+
+	// same backend and server name, but own transport for route tls settings
+	ca := getTransport("http://ca.ru/")
+	td.True(ca != common)
+	td.True(ca == getTransport("http://ca.ru/"))
+	td.False(ca.TLSClientConfig.InsecureSkipVerify)
+	td.NotNil(ca.TLSClientConfig.RootCAs)
+	td.Len(ca.TLSClientConfig.Certificates, 1)
+
+	transport.IgnoreHTTPSCertificate = false
+	ignore := getTransport("http://ignore.ru/")
+	td.True(ignore != common && ignore != ca)
+	td.True(ignore.TLSClientConfig.InsecureSkipVerify)
+}
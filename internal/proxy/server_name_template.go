@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/domain"
+)
+
+// Placeholders of server name template of https backend
+const (
+	ServerNameHost = "{{HOST}}" // host of incoming request without port, normalized as domain (punycode, lower case)
+	ServerNameSNI  = "{{SNI}}"  // server name of tls handshake of client, empty for plain http
+)
+
+// backendServerNameKey - key of context value with server name of https backend, evaluated by template of rewrite rule
+type backendServerNameKey struct{}
+
+// serverNameTemplate - server name of https backend with placeholders, evaluated for every request
+type serverNameTemplate []string
+
+// parseServerNameTemplate split template to literal parts and placeholders, validate placeholders and
+// characters of literal parts
+func parseServerNameTemplate(s string) (serverNameTemplate, error) {
+	var res serverNameTemplate
+	for s != "" {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			start = len(s)
+		}
+		if literal := s[:start]; literal != "" {
+			if !isServerNameLiteral(literal) {
+				return nil, xerrors.Errorf("bad characters of server name template: %q", literal)
+			}
+			res = append(res, literal)
+		}
+		s = s[start:]
+		if s == "" {
+			break
+		}
+
+		end := strings.Index(s, "}}")
+		if end < 0 {
+			return nil, xerrors.Errorf("unclosed placeholder of server name template: %q", s)
+		}
+		placeholder := s[:end+2]
+		if placeholder != ServerNameHost && placeholder != ServerNameSNI {
+			return nil, xerrors.Errorf("unknown placeholder of server name template: %q", placeholder)
+		}
+		res = append(res, placeholder)
+		s = s[end+2:]
+	}
+	return res, nil
+}
+
+// execute return server name for the request. Result can be empty or invalid (see isServerNameLiteral),
+// for example for template {{SNI}} and plain http request.
+func (t serverNameTemplate) execute(request *http.Request) string {
+	var res strings.Builder
+	for _, part := range t {
+		switch part {
+		case ServerNameHost:
+			res.WriteString(domain.NormalizeHost(request.Host, false))
+		case ServerNameSNI:
+			if request.TLS != nil {
+				res.WriteString(strings.ToLower(request.TLS.ServerName))
+			}
+		default:
+			res.WriteString(part)
+		}
+	}
+	return res.String()
+}
+
+// isServerNameLiteral return true if s contains letters, digits, hyphens and dots only
+func isServerNameLiteral(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// backendServerName return server name of https backend, evaluated by template of rewrite rule.
+// ok is false if request doesn't matched to rule with server name template, err - if evaluated name is bad.
+func backendServerName(request *http.Request) (name string, ok bool, err error) {
+	name, ok = request.Context().Value(backendServerNameKey{}).(string)
+	if !ok {
+		return "", false, nil
+	}
+	if name == "" || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || !isServerNameLiteral(name) {
+		return "", true, xerrors.Errorf("bad server name of https backend by template: %q", name)
+	}
+	return name, true, nil
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestParseServerNameTemplate(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	tmpl, err := parseServerNameTemplate("{{HOST}}.gw-1.internal")
+	td.CmpNoError(err)
+	td.Cmp(tmpl, serverNameTemplate{"{{HOST}}", ".gw-1.internal"})
+
+	tmpl, err = parseServerNameTemplate("backend.{{SNI}}")
+	td.CmpNoError(err)
+	td.Cmp(tmpl, serverNameTemplate{"backend.", "{{SNI}}"})
+
+	for _, s := range []string{"{{host}}", "{{HOST}", "{{HOST}}}", "a b", "a:443", "{{}}"} {
+		_, err = parseServerNameTemplate(s)
+		td.CmpError(err, s)
+	}
+}
+
+func TestServerNameTemplate_Execute(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	tmpl, err := parseServerNameTemplate("{{HOST}}.internal")
+	td.CmpNoError(err)
+	req := httptest.NewRequest(http.MethodGet, "http://Example.COM:8443/", nil)
+	td.Cmp(tmpl.execute(req), "example.com.internal")
+
+	tmpl, err = parseServerNameTemplate("{{SNI}}")
+	td.CmpNoError(err)
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	td.Cmp(tmpl.execute(req), "")
+	req.TLS = &tls.ConnectionState{ServerName: "Sni.Example.com"}
+	td.Cmp(tmpl.execute(req), "sni.example.com")
+}
+
+func TestDirectorRewriteServerName(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	d, err := NewDirectorRewrite([]RewriteRuleConfig{
+		{Route: "example.com/", Host: "backend.internal", ServerName: "{{HOST}}"},
+		{Route: "sni.com/", ServerName: "{{SNI}}"},
+	})
+	td.CmpNoError(err)
+
+	tr := Transport{}
+
+	// evaluated before rewrite of host
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(ctx)
+	td.CmpNoError(d.Director(req))
+	req.URL.Scheme = ProtocolHTTPS
+	req.URL.Host = "127.0.0.1:443"
+	td.Cmp(req.Host, "backend.internal")
+	td.Cmp(tr.getTransport(req).TLSClientConfig.ServerName, "example.com")
+
+	// empty server name for plain http
+	req = httptest.NewRequest(http.MethodGet, "http://sni.com/", nil).WithContext(ctx)
+	td.CmpNoError(d.Director(req))
+	req.URL.Scheme = ProtocolHTTPS
+	resp, err := tr.RoundTrip(req)
+	td.CmpError(err)
+	td.Nil(resp)
+
+	// without rule - server name by host
+	req = httptest.NewRequest(http.MethodGet, "http://other.com/", nil).WithContext(ctx)
+	td.CmpNoError(d.Director(req))
+	req.URL.Scheme = ProtocolHTTPS
+	td.Cmp(tr.getTransport(req).TLSClientConfig.ServerName, "other.com")
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+// Groups of split routes, values of sticky cookie
+const (
+	SplitGroupStable = "stable"
+	SplitGroupCanary = "canary"
+)
+
+// SplitRouteConfig - split of requests, matched to route, between stable and canary backends (A/B routing)
+type SplitRouteConfig struct {
+	// Route in format "host/path-prefix", host "*" match any host.
+	Route string
+
+	// StableBackend - address of stable backend (host:port), empty - backend selected by routes.
+	StableBackend string
+
+	// CanaryBackend - address of canary backend (host:port).
+	CanaryBackend string
+
+	// CanaryPercent - percent of clients, routed to canary backend (0-100). Client assigned by hash of its ip.
+	CanaryPercent float64
+
+	// Header and HeaderValue - requests with the header value routed to canary backend always.
+	// Empty Header - without routing by header.
+	Header      string
+	HeaderValue string
+
+	// Cookie - name of cookie with group of client ("stable" or "canary"). Requests with the cookie routed
+	// to its group, group of other clients saved to the cookie. Empty - without cookie, sticky by ip only.
+	Cookie string
+
+	// CookieMaxAgeSeconds - max age of the cookie, 0 - session cookie.
+	CookieMaxAgeSeconds int
+
+	// BackendMaxIdleConnsPerHost, BackendMaxConnsPerHost, BackendIdleConnTimeoutSeconds - settings of connection pool
+	// for backends of the split route, override same settings of Proxy and rewrite rules. 0 - setting of Proxy.
+	BackendMaxIdleConnsPerHost    int
+	BackendMaxConnsPerHost        int
+	BackendIdleConnTimeoutSeconds int
+}
+
+type splitRoute struct {
+	route         route
+	stableBackend string
+	canaryBackend string
+	canaryPercent float64
+	header        string
+	headerValue   string
+	cookie        string
+	cookieMaxAge  time.Duration
+	poolSettings  *PoolSettings
+}
+
+// Splits select backend of requests by first matched split route
+type Splits []splitRoute
+
+// NewSplits validate split routes
+func NewSplits(configs []SplitRouteConfig) (Splits, error) {
+	res := make(Splits, 0, len(configs))
+	for _, config := range configs {
+		split, err := newSplitRoute(config)
+		if err != nil {
+			return nil, xerrors.Errorf("split route %q: %w", config.Route, err)
+		}
+		res = append(res, split)
+	}
+	return res, nil
+}
+
+func newSplitRoute(config SplitRouteConfig) (splitRoute, error) {
+	r, err := parseRoute(config.Route)
+	if err != nil {
+		return splitRoute{}, err
+	}
+	if _, _, err = net.SplitHostPort(config.CanaryBackend); err != nil {
+		return splitRoute{}, xerrors.Errorf("bad canary backend, expected host:port: %q", config.CanaryBackend)
+	}
+	if config.StableBackend != "" {
+		if _, _, err = net.SplitHostPort(config.StableBackend); err != nil {
+			return splitRoute{}, xerrors.Errorf("bad stable backend, expected host:port: %q", config.StableBackend)
+		}
+	}
+	if config.CanaryPercent < 0 || config.CanaryPercent > 100 {
+		return splitRoute{}, xerrors.Errorf("canary percent must be from 0 to 100, got: %v", config.CanaryPercent)
+	}
+	if config.Header != "" && !httpguts.ValidHeaderFieldName(config.Header) {
+		return splitRoute{}, xerrors.Errorf("bad header name: %q", config.Header)
+	}
+	if config.Header == "" && config.HeaderValue != "" {
+		return splitRoute{}, xerrors.New("header value without header")
+	}
+	if config.Cookie != "" && !httpguts.ValidHeaderFieldName(config.Cookie) {
+		return splitRoute{}, xerrors.Errorf("bad cookie name: %q", config.Cookie)
+	}
+	if config.CookieMaxAgeSeconds < 0 {
+		return splitRoute{}, xerrors.Errorf("negative cookie max age: %v", config.CookieMaxAgeSeconds)
+	}
+	poolSettings, err := newPoolSettings(config.BackendMaxIdleConnsPerHost, config.BackendMaxConnsPerHost,
+		config.BackendIdleConnTimeoutSeconds)
+	if err != nil {
+		return splitRoute{}, err
+	}
+	return splitRoute{
+		route:         r,
+		stableBackend: config.StableBackend,
+		canaryBackend: config.CanaryBackend,
+		canaryPercent: config.CanaryPercent,
+		header:        config.Header,
+		headerValue:   config.HeaderValue,
+		cookie:        config.Cookie,
+		cookieMaxAge:  time.Duration(config.CookieMaxAgeSeconds) * time.Second,
+		poolSettings:  poolSettings,
+	}, nil
+}
+
+// group select group of request: by header, then by sticky cookie, then by hash of client ip.
+// byHash is true if group assigned by hash of client ip (new client).
+func (s *splitRoute) group(r *http.Request) (group string, byHash bool) {
+	if values := r.Header.Values(s.header); s.header != "" && len(values) > 0 && values[0] == s.headerValue {
+		return SplitGroupCanary, false
+	}
+	if s.cookie != "" {
+		if cookie, err := r.Cookie(s.cookie); err == nil &&
+			(cookie.Value == SplitGroupStable || cookie.Value == SplitGroupCanary) {
+			return cookie.Value, false
+		}
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(s.route.host + s.route.pathPrefix + "|" + ip))
+	if float64(hash.Sum32()%10000) < s.canaryPercent*100 {
+		return SplitGroupCanary, true
+	}
+	return SplitGroupStable, true
+}
+
+// withSplit select backend of request by first matched split route and save it to context.
+// Group of new clients saved to sticky cookie, requests forced by header doesn't change the cookie.
+func (p *HTTPProxy) withSplit(w http.ResponseWriter, r *http.Request) *http.Request {
+	for i := range p.Splits {
+		s := &p.Splits[i]
+		if !s.route.match(r) {
+			continue
+		}
+
+		group, byHash := s.group(r)
+		if s.cookie != "" && byHash {
+			cookie := &http.Cookie{Name: s.cookie, Value: group, Path: "/", HttpOnly: true, Secure: r.TLS != nil,
+				SameSite: http.SameSiteLaxMode}
+			if s.cookieMaxAge > 0 {
+				cookie.MaxAge = int(s.cookieMaxAge / time.Second)
+			}
+			http.SetCookie(w, cookie)
+		}
+
+		backend := s.stableBackend
+		if group == SplitGroupCanary {
+			backend = s.canaryBackend
+		}
+		p.logger.Debug("Split request", zap.String("route_host", s.route.host),
+			zap.String("route_path_prefix", s.route.pathPrefix), zap.String("group", group),
+			zap.Bool("by_hash", byHash), zap.String("backend", backend),
+			zap.Float64("canary_percent", s.canaryPercent))
+		ctx := r.Context()
+		if s.poolSettings != nil {
+			ctx = withPoolSettings(ctx, *s.poolSettings)
+		}
+		if backend != "" {
+			ctx = context.WithValue(ctx, contextlabel.SplitBackend, backend)
+		}
+		return r.WithContext(ctx)
+	}
+	return r
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+func TestNewSplits(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	_, err := NewSplits([]SplitRouteConfig{{Route: "*/", CanaryBackend: "127.0.0.1:2", CanaryPercent: 10,
+		Header: "X-Canary", HeaderValue: "1", Cookie: "canary", CookieMaxAgeSeconds: 60}})
+	td.CmpNoError(err)
+
+	for _, config := range []SplitRouteConfig{
+		{Route: "bad", CanaryBackend: "127.0.0.1:2"},
+		{Route: "*/", CanaryBackend: "127.0.0.1"},
+		{Route: "*/", CanaryBackend: "127.0.0.1:2", StableBackend: "bad"},
+		{Route: "*/", CanaryBackend: "127.0.0.1:2", CanaryPercent: 101},
+		{Route: "*/", CanaryBackend: "127.0.0.1:2", CanaryPercent: -1},
+		{Route: "*/", CanaryBackend: "127.0.0.1:2", Header: "bad header"},
+		{Route: "*/", CanaryBackend: "127.0.0.1:2", HeaderValue: "1"},
+		{Route: "*/", CanaryBackend: "127.0.0.1:2", Cookie: "bad cookie"},
+		{Route: "*/", CanaryBackend: "127.0.0.1:2", CookieMaxAgeSeconds: -1},
+		{Route: "*/", CanaryBackend: "127.0.0.1:2", BackendMaxConnsPerHost: -1},
+	} {
+		_, err = NewSplits([]SplitRouteConfig{config})
+		td.CmpError(err, config)
+	}
+}
+
+func TestHTTPProxy_Split(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	splits, err := NewSplits([]SplitRouteConfig{
+		{Route: "example.com/", StableBackend: "127.0.0.1:1", CanaryBackend: "127.0.0.1:2", CanaryPercent: 30,
+			Header: "X-Canary", HeaderValue: "1", Cookie: "canary", CookieMaxAgeSeconds: 60},
+		{Route: "other.com/", CanaryBackend: "127.0.0.1:3"},
+	})
+	td.CmpNoError(err)
+	p := &HTTPProxy{Splits: splits, logger: zap.NewNop()}
+
+	split := func(host, remoteAddr string, prepare func(r *http.Request)) (backend interface{}, w *httptest.ResponseRecorder) {
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		r.RemoteAddr = remoteAddr
+		if prepare != nil {
+			prepare(r)
+		}
+		r = p.withSplit(w, r)
+		return r.Context().Value(contextlabel.SplitBackend), w
+	}
+
+	// sticky by ip and ratio of split
+	canary := 0
+	for i := 0; i < 1000; i++ {
+		addr := "10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256)
+		backend, w := split("example.com", addr+":1000", nil)
+		again, _ := split("example.com", addr+":2000", nil)
+		td.Cmp(again, backend)
+
+		group := SplitGroupStable
+		if backend == "127.0.0.1:2" {
+			group = SplitGroupCanary
+			canary++
+		}
+		td.Cmp(w.Header().Get("Set-Cookie"), "canary="+group+"; Path=/; Max-Age=60; HttpOnly; SameSite=Lax")
+	}
+	td.Between(canary, 250, 350, testdeep.BoundsInIn)
+
+	// cookie and header override hash
+	backend, w := split("example.com", "10.0.0.1:1", func(r *http.Request) {
+		r.AddCookie(&http.Cookie{Name: "canary", Value: SplitGroupCanary})
+	})
+	td.Cmp(backend, "127.0.0.1:2")
+	td.Cmp(w.Header().Get("Set-Cookie"), "")
+
+	backend, _ = split("example.com", "10.0.0.1:1", func(r *http.Request) {
+		r.AddCookie(&http.Cookie{Name: "canary", Value: SplitGroupStable})
+	})
+	td.Cmp(backend, "127.0.0.1:1")
+
+	backend, w = split("example.com", "10.0.0.1:1", func(r *http.Request) {
+		r.AddCookie(&http.Cookie{Name: "canary", Value: SplitGroupStable})
+		r.Header.Set("X-Canary", "1")
+	})
+	td.Cmp(backend, "127.0.0.1:2")
+	td.Cmp(w.Header().Get("Set-Cookie"), "")
+
+	// stable group without backend keep backend of routes
+	backend, w = split("other.com", "10.0.0.1:1", nil)
+	td.Nil(backend)
+	td.Cmp(w.Header().Get("Set-Cookie"), "")
+
+	backend, _ = split("unknown.com", "10.0.0.1:1", nil)
+	td.Nil(backend)
+
+	// split backend override backend of routes
+	p.Director = NewDirectorHost("127.0.0.1:1")
+	p.GetContext = getContext
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("X-Canary", "1")
+	r = p.withSplit(httptest.NewRecorder(), r)
+	p.director(r)
+	td.Cmp(r.URL.Host, "127.0.0.1:2")
+}
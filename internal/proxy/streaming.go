@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+)
+
+// eventStreamContentType - server-sent events, always flushed immediately by reverse proxy
+const eventStreamContentType = "text/event-stream"
+
+// StreamContentTypes - media types (without params) of responses, which flushed to client immediately
+// after every read from backend, for example "application/x-ndjson".
+// Responses without content length (streamed by backend) and server-sent events flushed immediately always.
+type StreamContentTypes []string
+
+// NewStreamContentTypes normalize media types
+func NewStreamContentTypes(contentTypes []string) StreamContentTypes {
+	res := make(StreamContentTypes, 0, len(contentTypes))
+	for _, contentType := range contentTypes {
+		res = append(res, strings.ToLower(strings.TrimSpace(contentType)))
+	}
+	return res
+}
+
+// modifyResponse mark responses with stream content types as streamed: reverse proxy flush streamed
+// responses (unknown content length) immediately. Content-Length header sent to client as is.
+func (t StreamContentTypes) modifyResponse(resp *http.Response) error {
+	if resp.ContentLength < 0 || !t.match(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	zc.L(resp.Request.Context()).Debug("Stream response", zap.String("content_type", resp.Header.Get("Content-Type")))
+	resp.ContentLength = -1
+	return nil
+}
+
+func (t StreamContentTypes) match(contentType string) bool {
+	mediaType := parseMediaType(contentType)
+	if mediaType == "" {
+		return false
+	}
+	for _, streamType := range t {
+		if mediaType == streamType {
+			return true
+		}
+	}
+	return false
+}
+
+// isEventStream return true for server-sent events responses
+func isEventStream(header http.Header) bool {
+	return parseMediaType(header.Get("Content-Type")) == eventStreamContentType
+}
+
+func parseMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
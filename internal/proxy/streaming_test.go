@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestStreamContentTypes(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	types := NewStreamContentTypes([]string{" Application/X-NDJSON "})
+	td.Cmp(types, StreamContentTypes{"application/x-ndjson"})
+	td.True(types.match("application/x-ndjson; charset=utf-8"))
+	td.False(types.match("application/json"))
+	td.False(types.match("bad/type; ="))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	resp := &http.Response{Request: req, ContentLength: 10, Header: http.Header{"Content-Type": {"application/x-ndjson"}}}
+	td.CmpNoError(types.modifyResponse(resp))
+	td.Cmp(resp.ContentLength, int64(-1))
+
+	resp = &http.Response{Request: req, ContentLength: 10, Header: http.Header{"Content-Type": {"application/json"}}}
+	td.CmpNoError(types.modifyResponse(resp))
+	td.Cmp(resp.ContentLength, int64(10))
+
+	td.True(isEventStream(http.Header{"Content-Type": {"text/event-stream; charset=utf-8"}}))
+	td.False(isEventStream(http.Header{"Content-Type": {"text/plain"}}))
+}
+
+func TestHTTPProxy_StreamFlush(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	const firstLine = "{\"event\":1}\n"
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		if r.URL.Query().Get("length") != "" {
+			w.Header().Set("Content-Length", strconv.Itoa(2*len(firstLine)))
+		}
+		_, _ = w.Write([]byte(firstLine))
+		w.(http.Flusher).Flush()
+		select {
+		case <-next:
+		case <-r.Context().Done():
+		}
+		_, _ = w.Write([]byte(firstLine))
+	}))
+	defer backend.Close()
+
+	listener := th.NewLocalTcpListener(e)
+	proxy := NewHTTPProxy(e.Ctx, listener)
+	proxy.Director = NewDirectorChain(NewDirectorHost(backend.Listener.Addr().String()), NewSetSchemeDirector(ProtocolHTTP))
+	proxy.StreamContentTypes = NewStreamContentTypes([]string{"application/x-ndjson"})
+	go func() { _ = proxy.Start() }()
+	defer func() { _ = proxy.Close() }()
+
+	client := http.Client{Timeout: 10 * time.Second}
+	for _, query := range []string{
+		"type=text/event-stream",
+		"type=application/x-ndjson",
+		"type=application/x-ndjson&length=1",
+	} {
+		resp, err := client.Get("http://" + listener.Addr().String() + "/?" + query)
+		e.CmpNoError(err, query)
+
+		// first line must be received before backend write second line
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		e.CmpNoError(err, query)
+		e.Cmp(line, firstLine, query)
+
+		next <- struct{}{}
+		_ = resp.Body.Close()
+	}
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+// isTunnel return true for requests, which become tunnels: websockets and CONNECT
+func isTunnel(r *http.Request) bool {
+	return r.Method == http.MethodConnect || strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// exemptTimeouts remove ReadTimeout and WriteTimeout of tunnels immediately and save func for remove them
+// for streamed responses (server-sent events and StreamContentTypes) to request context.
+// Tunnels and streams may be long and idle intentionally.
+func (p *HTTPProxy) exemptTimeouts(w http.ResponseWriter, r *http.Request) *http.Request {
+	if p.ReadTimeout <= 0 && p.WriteTimeout <= 0 {
+		return r
+	}
+
+	controller := http.NewResponseController(w)
+	exempt := func() error {
+		if err := controller.SetReadDeadline(time.Time{}); err != nil {
+			return err
+		}
+		return controller.SetWriteDeadline(time.Time{})
+	}
+	if isTunnel(r) {
+		p.logger.Debug("Remove read and write timeouts of tunnel", zap.String("remote_addr", r.RemoteAddr),
+			zap.Error(exempt()))
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), contextlabel.TimeoutsExempt, exempt))
+}
+
+// modifyResponse remove timeouts of streamed responses, mark responses with StreamContentTypes as streamed
+// and apply idle timeout of long-lived routes
+func (p *HTTPProxy) modifyResponse(resp *http.Response) error {
+	wrapLongLived(resp)
+
+	if isEventStream(resp.Header) || p.StreamContentTypes.match(resp.Header.Get("Content-Type")) {
+		ctx := resp.Request.Context()
+		if exempt, ok := ctx.Value(contextlabel.TimeoutsExempt).(func() error); ok {
+			zc.L(ctx).Debug("Remove read and write timeouts of streamed response", zap.Error(exempt()))
+		}
+	}
+	return p.StreamContentTypes.modifyResponse(resp)
+}
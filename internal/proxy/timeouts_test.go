@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestHTTPProxy_WriteTimeoutStreamExempt(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	const writeTimeout = 100 * time.Millisecond
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		_, _ = w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		time.Sleep(3 * writeTimeout)
+		_, _ = w.Write([]byte("second\n"))
+	}))
+	defer backend.Close()
+
+	listener := th.NewLocalTcpListener(e)
+	proxy := NewHTTPProxy(e.Ctx, listener)
+	proxy.Director = NewDirectorChain(NewDirectorHost(backend.Listener.Addr().String()), NewSetSchemeDirector(ProtocolHTTP))
+	proxy.StreamContentTypes = NewStreamContentTypes([]string{"application/x-ndjson"})
+	proxy.WriteTimeout = writeTimeout
+	go func() { _ = proxy.Start() }()
+	defer func() { _ = proxy.Close() }()
+
+	client := http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	get := func(contentType string) (string, error) {
+		resp, err := client.Get("http://" + listener.Addr().String() + "/?type=" + contentType)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	for _, contentType := range []string{"text/event-stream", "application/x-ndjson"} {
+		body, err := get(contentType)
+		e.CmpNoError(err, contentType)
+		e.Cmp(body, "first\nsecond\n", contentType)
+	}
+
+	// usual response interrupted by write timeout
+	body, err := get("text/plain")
+	e.True(err != nil || body != "first\nsecond\n")
+}
@@ -1,24 +1,82 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"net/http"
 	"strings"
 	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
 
 	zc "github.com/rekby/zapcontext"
+
+	"github.com/rekby/lets-proxy2/internal/dns"
+	"github.com/rekby/lets-proxy2/internal/outbound_proxy"
 )
 
 var defaultHTTPTransport = defaultTransport()
 
+// defaultH2CTransport is HTTP/2 transport without TLS (h2c), for http backends with HTTP2 enabled
+var defaultH2CTransport = newH2CTransport(Transport{}.dialContext, nil)
+
 type Transport struct {
 	IgnoreHTTPSCertificate bool
+
+	// RootCAs for verify backend https certificate. Nil mean system pool.
+	RootCAs *x509.CertPool
+
+	// ServerName override SNI and verified name of backend https certificate. Empty mean host of request.
+	ServerName string
+
+	// Backends - tls settings of https backends by backend address (host:port of request url).
+	Backends map[string]BackendTLS
+
+	// ClientCertificates for mTLS authentication on backend.
+	ClientCertificates []tls.Certificate
+
+	// HTTP2 - use HTTP/2 for backend requests: h2c (HTTP/2 without TLS) for http backends
+	// and h2 for https backends. It need for gRPC backends.
+	HTTP2 bool
+
+	// Pool - shared connections to backends. nil - default http transport for http backends
+	// and new transport (without reuse connections) for every https request.
+	Pool *ConnectionPool
+
+	// AddressFamily - preference of ip version for dial backends. Empty mean AddressFamilyAny.
+	AddressFamily AddressFamily
+
+	// Resolver - resolver of backend hosts for dial, nil - system resolver.
+	Resolver dns.ResolverInterface
+
+	// Proxy - outbound proxy for connections to backends. nil - proxy from environment for http(s) backends
+	// and direct connections for h2c backends.
+	Proxy outbound_proxy.ProxyFunc
+
+	// ExpectContinueTimeout - wait 100 Continue from backend before send body of request with
+	// "Expect: 100-continue" header, body sent after timeout without answer. 0 - one second (go default).
+	ExpectContinueTimeout time.Duration
 }
 
 func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == ProtocolFastCGI {
+		return t.fastCGIRoundTrip(req)
+	}
+	if t.HTTP2 && req.URL.Scheme == ProtocolHTTP {
+		zc.L(req.Context()).Debug("Use h2c transport")
+		return t.getH2CTransport().RoundTrip(req)
+	}
+	if req.URL.Scheme == ProtocolHTTPS {
+		if _, _, err := backendServerName(req); err != nil {
+			return nil, err
+		}
+	}
+	if t.Pool != nil {
+		return t.Pool.roundTrip(t.getTransport(req), req)
+	}
 	return t.getTransport(req).RoundTrip(req)
 }
 
@@ -26,8 +84,17 @@ func (t Transport) getTransport(req *http.Request) *http.Transport {
 	logger := zc.L(req.Context())
 
 	if req.URL.Scheme == ProtocolHTTP {
-		logger.Debug("Use default http transport")
-		return defaultHTTPTransport
+		if t.Pool != nil {
+			logger.Debug("Use pool http transport")
+			settings, _ := requestPoolSettings(req)
+			return t.Pool.getTransport(poolTransportKey{scheme: ProtocolHTTP, settings: settings}, t.newHTTPTransport)
+		}
+		if t.isDefaultTransport() {
+			logger.Debug("Use default http transport")
+			return defaultHTTPTransport
+		}
+		logger.Debug("Use http transport", zap.String("address_family", string(t.AddressFamily)))
+		return t.newHTTPTransport()
 	}
 
 	host := req.Host
@@ -36,33 +103,139 @@ func (t Transport) getTransport(req *http.Request) *http.Transport {
 		host = parts[0]
 	}
 
-	transport := defaultTransport()
-	transport.TLSClientConfig = &tls.Config{ServerName: host}
-	transport.TLSClientConfig.InsecureSkipVerify = t.IgnoreHTTPSCertificate
+	if t.ServerName != "" {
+		host = t.ServerName
+	}
+
+	backendTLS, hasBackendTLS := t.Backends[req.URL.Host]
+	if backendTLS.ServerName != "" {
+		host = backendTLS.ServerName
+	}
+	if serverName, ok, _ := backendServerName(req); ok {
+		host = serverName
+	}
+	certPinned := len(backendTLS.CertSHA256) > 0
+	routeTLS := requestRouteTLS(req)
+
+	newHTTPSTransport := func() *http.Transport {
+		transport := t.newHTTPTransport()
+		transport.TLSClientConfig = &tls.Config{
+			ServerName:   host,
+			RootCAs:      t.RootCAs,
+			Certificates: t.ClientCertificates,
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = t.IgnoreHTTPSCertificate
+		if routeTLS != nil {
+			routeTLS.apply(transport.TLSClientConfig)
+		}
+		if certPinned {
+			// pinned certificate trusted without ca and name verification
+			transport.TLSClientConfig.InsecureSkipVerify = true
+			transport.TLSClientConfig.VerifyPeerCertificate = backendTLS.verifyPinnedCertificate
+		}
+		// custom TLSClientConfig disable HTTP/2 by default
+		transport.ForceAttemptHTTP2 = t.HTTP2
+		return transport
+	}
+
+	var transport *http.Transport
+	if t.Pool == nil {
+		transport = newHTTPSTransport()
+	} else {
+		settings, _ := requestPoolSettings(req)
+		key := poolTransportKey{scheme: ProtocolHTTPS, serverName: host, routeTLS: routeTLS, settings: settings}
+		if hasBackendTLS {
+			key.backend = req.URL.Host
+		}
+		transport = t.Pool.getTransport(key, newHTTPSTransport)
+	}
 
 	logger.Debug("Use https transport",
 		zap.Bool("ignore_cert", transport.TLSClientConfig.InsecureSkipVerify),
 		zap.String("tls_server_name", host),
+		zap.Bool("cert_pinned", certPinned),
+		zap.Bool("route_tls", routeTLS != nil),
 		zap.String("header_host", req.Header.Get("HOST")),
+		zap.Bool("http2", t.HTTP2),
 	)
 
 	return transport
 }
 
+func (t Transport) getH2CTransport() *http2.Transport {
+	if t.Pool != nil {
+		return t.Pool.getH2CTransport(func() *http2.Transport {
+			return newH2CTransport(t.dialContext, t.Proxy)
+		})
+	}
+	if t.isDefaultTransport() {
+		return defaultH2CTransport
+	}
+	return newH2CTransport(t.dialContext, t.Proxy)
+}
+
+func (t Transport) newHTTPTransport() *http.Transport {
+	transport := defaultTransport()
+	if !t.isDefaultDial() {
+		transport.DialContext = t.dialContext
+	}
+	if t.Proxy != nil {
+		transport.Proxy = t.Proxy
+	}
+	if t.ExpectContinueTimeout > 0 {
+		transport.ExpectContinueTimeout = t.ExpectContinueTimeout
+	}
+	return transport
+}
+
+func (t Transport) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return t.AddressFamily.dialContext(ctx, t.Resolver, network, addr)
+}
+
+// isDefaultDial return true if backends dialed without address family preference and by system resolver
+func (t Transport) isDefaultDial() bool {
+	return (t.AddressFamily == "" || t.AddressFamily == AddressFamilyAny) && t.Resolver == nil
+}
+
+// isDefaultTransport return true if shared default transports can be used
+func (t Transport) isDefaultTransport() bool {
+	return t.isDefaultDial() && t.Proxy == nil && t.ExpectContinueTimeout == 0
+}
+
+// newH2CTransport create h2c transport, proxy nil - connect to backends directly by backendDial
+func newH2CTransport(backendDial func(ctx context.Context, network, addr string) (net.Conn, error),
+	proxy outbound_proxy.ProxyFunc) *http2.Transport {
+	dial := backendDial
+	if proxy != nil {
+		dial = (&outbound_proxy.Dialer{Proxy: proxy, Dial: backendDial}).DialContext
+	}
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		},
+	}
+}
+
 func defaultTransport() *http.Transport {
 	// copy from go 1.10, need for compile with go 1.10 compiler
 	// https://github.com/golang/go/blob/b0cb374daf646454998bac7b393f3236a2ab6aca/src/net/http/transport.go#L40
 	//noinspection GoDeprecation
 	return &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           newDialer().DialContext,
 		MaxIdleConns:          100,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 }
+
+func newDialer() *net.Dialer {
+	//noinspection GoDeprecation
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}
+}
@@ -36,4 +36,9 @@ func TestTransport_GetTransport(t *testing.T) {
 	td.True(httpTransport != defaultTransport()) // different pointers
 	td.Cmp(httpTransport.TLSClientConfig.ServerName, "www.ru")
 	td.Cmp(httpTransport.TLSClientConfig.InsecureSkipVerify, true)
+	td.False(httpTransport.ForceAttemptHTTP2)
+
+	tr = Transport{HTTP2: true}
+	httpTransport = tr.getTransport(r)
+	td.True(httpTransport.ForceAttemptHTTP2)
 }
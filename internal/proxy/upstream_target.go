@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// upstreamDefaults - scheme and ports, assumed for upstream targets without them
+type upstreamDefaults struct {
+	scheme    string
+	httpPort  int
+	httpsPort int
+}
+
+func (d upstreamDefaults) port(scheme string) int {
+	if scheme == ProtocolHTTPS {
+		return d.httpsPort
+	}
+	return d.httpPort
+}
+
+// complete add default port to target "[scheme://]host[:port]". Explicit scheme of target kept in result,
+// port of target without it is default port of the scheme (or of default scheme for target without scheme).
+// Result validated as complete upstream url.
+func (d upstreamDefaults) complete(target string) (string, error) {
+	scheme, hostPort := splitUpstreamScheme(target)
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		portScheme := scheme
+		if portScheme == "" {
+			portScheme = d.scheme
+		}
+		hostPort = net.JoinHostPort(strings.Trim(hostPort, "[]"), strconv.Itoa(d.port(portScheme)))
+	}
+	if scheme != "" {
+		target = scheme + "://" + hostPort
+	} else {
+		target = hostPort
+	}
+	if _, _, err := parseUpstreamTarget(target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// parseUpstreamTarget parse complete upstream target "[scheme://]host:port",
+// scheme is empty for target without explicit scheme.
+func parseUpstreamTarget(target string) (scheme, hostPort string, err error) {
+	scheme, hostPort = splitUpstreamScheme(target)
+	switch scheme {
+	case "", ProtocolHTTP, ProtocolHTTPS:
+	default:
+		return "", "", xerrors.Errorf("bad upstream scheme, expected http or https: %q", target)
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil || host == "" || strings.ContainsAny(host, "/?#@ ") {
+		return "", "", xerrors.Errorf("bad upstream, expected [scheme://]host:port: %q", target)
+	}
+	if portNum, err := strconv.Atoi(port); err != nil || portNum < 1 || portNum > 65535 {
+		return "", "", xerrors.Errorf("bad upstream port: %q", target)
+	}
+	return scheme, hostPort, nil
+}
+
+func splitUpstreamScheme(target string) (scheme, hostPort string) {
+	if index := strings.Index(target, "://"); index >= 0 {
+		return strings.ToLower(target[:index]), target[index+len("://"):]
+	}
+	return "", target
+}
@@ -1,9 +1,11 @@
 package secrethandler
 
 import (
+	"crypto/subtle"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/rekby/lets-proxy2/internal/log"
 
@@ -20,12 +22,31 @@ type Config struct {
 	AllowedNetworks    []string
 	Password           string
 	AllowEmptyPassword bool
+
+	// BearerToken allow access with header "Authorization: Bearer <token>"
+	BearerToken string
+
+	// BasicAuthUser and BasicAuthPassword allow access with http basic auth
+	BasicAuthUser     string
+	BasicAuthPassword string
+
+	// RequireClientCert deny requests without verified tls client certificate
+	RequireClientCert bool
+}
+
+// HasAuthentication return true if config require any authentication
+func (c Config) HasAuthentication() bool {
+	return c.Password != "" || c.BearerToken != "" || c.BasicAuthUser != "" || c.RequireClientCert
 }
 
 type SecretHandler struct {
 	allowedNetworks    []net.IPNet
 	allowEmptyPassword bool
 	password           string
+	bearerToken        string
+	basicAuthUser      string
+	basicAuthPassword  string
+	requireClientCert  bool
 	logger             *zap.Logger
 	next               http.Handler
 }
@@ -58,7 +79,8 @@ func (m SecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if m.password == "" && !m.allowEmptyPassword {
+	hasCredentials := m.password != "" || m.bearerToken != "" || m.basicAuthUser != ""
+	if !hasCredentials && !m.requireClientCert && !m.allowEmptyPassword {
 		http.Error(w, errAccessDeniedMess, http.StatusForbidden)
 		return
 	}
@@ -74,10 +96,15 @@ func (m SecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pass := values.Get(passwordArgName)
+	if m.requireClientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		logger.Info("Deny request without client certificate")
+		m.unauthorized(w)
+		return
+	}
 
-	if pass != m.password || !m.allowEmptyPassword && pass == "" {
-		http.Error(w, "Bad password", http.StatusForbidden)
+	if hasCredentials && !m.checkCredentials(r, values) {
+		logger.Info("Deny request with bad credentials")
+		m.unauthorized(w)
 		return
 	}
 
@@ -90,6 +117,47 @@ func (m SecretHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	m.next.ServeHTTP(w, r)
 }
 
+func (m SecretHandler) checkCredentials(r *http.Request, values url.Values) bool {
+	if m.password != "" && secureEqual(values.Get(passwordArgName), m.password) {
+		return true
+	}
+
+	if m.bearerToken != "" {
+		const bearerPrefix = "Bearer "
+		header := r.Header.Get("Authorization")
+		if len(header) > len(bearerPrefix) && strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) &&
+			secureEqual(header[len(bearerPrefix):], m.bearerToken) {
+			return true
+		}
+	}
+
+	if m.basicAuthUser != "" {
+		user, password, ok := r.BasicAuth()
+		// check both values always - for same check time
+		userOk := secureEqual(user, m.basicAuthUser)
+		passwordOk := secureEqual(password, m.basicAuthPassword)
+		if ok && userOk && passwordOk {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m SecretHandler) unauthorized(w http.ResponseWriter) {
+	if m.basicAuthUser != "" {
+		w.Header().Add("WWW-Authenticate", `Basic realm="lets-proxy"`)
+	}
+	if m.bearerToken != "" {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="lets-proxy"`)
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func secureEqual(s1, s2 string) bool {
+	return subtle.ConstantTimeCompare([]byte(s1), []byte(s2)) == 1
+}
+
 func New(logger *zap.Logger, config Config, next http.Handler) SecretHandler {
 	localLogger := logger.Named("create_secret_handler")
 	var allowedNetworksIP []net.IPNet
@@ -105,6 +173,10 @@ func New(logger *zap.Logger, config Config, next http.Handler) SecretHandler {
 	secretHandler.allowedNetworks = allowedNetworksIP
 	secretHandler.password = config.Password
 	secretHandler.allowEmptyPassword = config.AllowEmptyPassword
+	secretHandler.bearerToken = config.BearerToken
+	secretHandler.basicAuthUser = config.BasicAuthUser
+	secretHandler.basicAuthPassword = config.BasicAuthPassword
+	secretHandler.requireClientCert = config.RequireClientCert
 	secretHandler.next = next
 	secretHandler.logger = logger
 	return secretHandler
@@ -1,6 +1,8 @@
 package secrethandler
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -130,8 +132,79 @@ func TestPassword(t *testing.T) {
 	secretHandler.ServeHTTP(respWriter, req)
 	respWriter.Flush()
 	resp = respWriter.Result()
-	td.Cmp(resp.StatusCode, http.StatusForbidden)
+	td.Cmp(resp.StatusCode, http.StatusUnauthorized)
 	td.False(nextCalled)
 	nextCalled = false
 	_ = resp.Body.Close()
 }
+
+func TestAuthMethods(t *testing.T) {
+	logger := zaptest.NewLogger(t, zaptest.WrapOptions(zap.Development()))
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	verifiedTLS := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+
+	table := []struct {
+		name     string
+		config   Config
+		prepare  func(r *http.Request)
+		expected int
+	}{
+		{"NotConfigured", Config{}, func(r *http.Request) {}, http.StatusForbidden},
+		{"BearerOk", Config{BearerToken: "token"}, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer token")
+		}, http.StatusOK},
+		{"BearerBad", Config{BearerToken: "token"}, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer other")
+		}, http.StatusUnauthorized},
+		{"BearerEmpty", Config{BearerToken: "token"}, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"BasicOk", Config{BasicAuthUser: "user", BasicAuthPassword: "pass"}, func(r *http.Request) {
+			r.SetBasicAuth("user", "pass")
+		}, http.StatusOK},
+		{"BasicBadPassword", Config{BasicAuthUser: "user", BasicAuthPassword: "pass"}, func(r *http.Request) {
+			r.SetBasicAuth("user", "other")
+		}, http.StatusUnauthorized},
+		{"PasswordOrBearer", Config{Password: "pass", BearerToken: "token"}, func(r *http.Request) {
+			r.URL.RawQuery = "password=pass"
+		}, http.StatusOK},
+		{"ClientCertOk", Config{RequireClientCert: true}, func(r *http.Request) {
+			r.TLS = verifiedTLS
+		}, http.StatusOK},
+		{"ClientCertWithoutTLS", Config{RequireClientCert: true}, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"ClientCertNotVerified", Config{RequireClientCert: true}, func(r *http.Request) {
+			r.TLS = &tls.ConnectionState{}
+		}, http.StatusUnauthorized},
+		{"ClientCertAndBearerWithoutToken", Config{RequireClientCert: true, BearerToken: "token"}, func(r *http.Request) {
+			r.TLS = verifiedTLS
+		}, http.StatusUnauthorized},
+		{"ClientCertAndBearer", Config{RequireClientCert: true, BearerToken: "token"}, func(r *http.Request) {
+			r.TLS = verifiedTLS
+			r.Header.Set("Authorization", "Bearer token")
+		}, http.StatusOK},
+	}
+
+	for _, test := range table {
+		t.Run(test.name, func(t *testing.T) {
+			td := testdeep.NewT(t)
+			h := New(logger, test.config, next)
+
+			req := httptest.NewRequest(http.MethodGet, "http://test", nil)
+			test.prepare(req)
+			resp := httptest.NewRecorder()
+			h.ServeHTTP(resp, req)
+			td.Cmp(resp.Code, test.expected)
+		})
+	}
+}
+
+func TestConfig_HasAuthentication(t *testing.T) {
+	td := testdeep.NewT(t)
+	td.False(Config{}.HasAuthentication())
+	td.False(Config{AllowEmptyPassword: true, AllowedNetworks: []string{"127.0.0.1/32"}}.HasAuthentication())
+	td.True(Config{Password: "1"}.HasAuthentication())
+	td.True(Config{BearerToken: "1"}.HasAuthentication())
+	td.True(Config{BasicAuthUser: "1"}.HasAuthentication())
+	td.True(Config{RequireClientCert: true}.HasAuthentication())
+}
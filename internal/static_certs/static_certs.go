@@ -0,0 +1,155 @@
+//nolint:golint
+package static_certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// GetCertificateFunc - tls.Config.GetCertificate hook
+type GetCertificateFunc func(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// StaticCertificates - certificates from files, selected by server name of tls hello, without acme.
+type StaticCertificates struct {
+	certs map[string]*tls.Certificate // by domain names and wildcard names (*.example.com) of certificates
+
+	// Default - certificate for server names without static certificate, if acme disabled.
+	// nil - without default certificate.
+	Default *tls.Certificate
+}
+
+// Files - paths to PEM files of certificate (with chain) and key
+type Files struct {
+	CertFile string
+	KeyFile  string
+
+	// Default - serve the certificate for server names without static certificate, if acme disabled
+	Default bool
+}
+
+// Load read certificates from files
+func Load(files []Files) (*StaticCertificates, error) {
+	res := &StaticCertificates{certs: make(map[string]*tls.Certificate)}
+	for _, f := range files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, xerrors.Errorf("load static certificate %q: %w", f.CertFile, err)
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, xerrors.Errorf("parse static certificate %q: %w", f.CertFile, err)
+		}
+		if err = res.Add(&cert, f.Default); err != nil {
+			return nil, xerrors.Errorf("add static certificate %q: %w", f.CertFile, err)
+		}
+	}
+	return res, nil
+}
+
+// Add certificate (with parsed Leaf) for its domain names
+func (s *StaticCertificates) Add(cert *tls.Certificate, isDefault bool) error {
+	if isDefault {
+		if s.Default != nil {
+			return xerrors.New("default certificate set already")
+		}
+		s.Default = cert
+	}
+	if len(cert.Leaf.DNSNames) == 0 && !isDefault {
+		return xerrors.New("certificate without domain names")
+	}
+	if s.certs == nil {
+		s.certs = make(map[string]*tls.Certificate)
+	}
+	for _, name := range cert.Leaf.DNSNames {
+		name = strings.ToLower(name)
+		if _, exist := s.certs[name]; exist {
+			return xerrors.Errorf("duplicate certificate for domain %q", name)
+		}
+		s.certs[name] = cert
+	}
+	return nil
+}
+
+// Len return count of domain names with static certificates
+func (s *StaticCertificates) Len() int {
+	return len(s.certs)
+}
+
+// Certificate return certificate for server name: exact match, wildcard or nil
+func (s *StaticCertificates) Certificate(serverName string) *tls.Certificate {
+	return s.certificate(serverName, nil)
+}
+
+// certificate return certificate for server name and add considered names to trace
+func (s *StaticCertificates) certificate(serverName string, trace *log.CertSelection) *tls.Certificate {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	cert, ok := s.certs[serverName]
+	trace.Add(log.CertCandidate{Key: serverName, Source: certSource, Specificity: log.CertSpecificityExact,
+		Matched: ok, Reason: missedReason(ok)})
+	if ok {
+		return cert
+	}
+	if index := strings.Index(serverName, "."); index > 0 {
+		wildcard := "*" + serverName[index:]
+		cert, ok = s.certs[wildcard]
+		trace.Add(log.CertCandidate{Key: wildcard, Source: certSource, Specificity: log.CertSpecificityWildcard,
+			Matched: ok, Reason: missedReason(ok)})
+		if ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// GetCertificate return tls.Config.GetCertificate hook, which serve static certificates.
+// Other server names handled by next if it is not nil, by Default certificate else.
+func (s *StaticCertificates) GetCertificate(next GetCertificateFunc) GetCertificateFunc {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		logger := helloLogger(hello)
+		trace := log.NewCertSelection(logger)
+		if hello.ServerName != "" {
+			if cert := s.certificate(hello.ServerName, trace); cert != nil {
+				trace.Log(logger, "")
+				return cert, nil
+			}
+		}
+		if next != nil {
+			trace.Log(logger, "acme certificates")
+			return next(hello)
+		}
+		if s.Default != nil {
+			trace.Add(log.CertCandidate{Key: "default", Source: certSource, Specificity: log.CertSpecificityDefault,
+				Matched: true})
+			trace.Log(logger, "")
+			return s.Default, nil
+		}
+		trace.Log(logger, "")
+		return nil, xerrors.Errorf("no static certificate for domain %q and acme disabled", hello.ServerName)
+	}
+}
+
+const certSource = "static"
+
+func missedReason(matched bool) string {
+	if matched {
+		return ""
+	}
+	return "no certificate"
+}
+
+// helloLogger return logger of connection with server name field, nop logger if connection has no context
+func helloLogger(hello *tls.ClientHelloInfo) *zap.Logger {
+	contextConn, ok := hello.Conn.(interface{ GetContext() context.Context })
+	if !ok {
+		return zap.NewNop()
+	}
+	return zc.L(contextConn.GetContext()).With(zap.String("server_name", hello.ServerName))
+}
@@ -0,0 +1,156 @@
+//nolint:golint
+package static_certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
+)
+
+func writeCert(t *testing.T, dir, name string, domains ...string) Files {
+	td := testdeep.NewT(t)
+
+	certPEM, keyPEM := testcert.PEM(t, testcert.New(t, x509.Certificate{DNSNames: domains}, nil, nil))
+	res := Files{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	td.CmpNoError(ioutil.WriteFile(res.CertFile, certPEM, 0600))
+	td.CmpNoError(ioutil.WriteFile(res.KeyFile, keyPEM, 0600))
+	return res
+}
+
+func TestLoad(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	dir := th.TmpDir(e)
+	exact := writeCert(t, dir, "exact", "example.com", "www.example.com")
+	wildcard := writeCert(t, dir, "wildcard", "*.example.org")
+	def := writeCert(t, dir, "default")
+	def.Default = true
+
+	certs, err := Load([]Files{exact, wildcard, def})
+	e.CmpNoError(err)
+	e.Cmp(certs.Len(), 3)
+
+	e.Cmp(certs.Certificate("WWW.example.com.").Leaf.DNSNames, []string{"example.com", "www.example.com"})
+	e.Cmp(certs.Certificate("a.example.org").Leaf.DNSNames, []string{"*.example.org"})
+	e.Nil(certs.Certificate("example.org"))
+	e.Nil(certs.Certificate("a.b.example.org"))
+	e.NotNil(certs.Default)
+
+	_, err = Load([]Files{exact, exact})
+	e.CmpError(err, "duplicate domain")
+
+	_, err = Load([]Files{def, def})
+	e.CmpError(err, "second default")
+
+	def.Default = false
+	_, err = Load([]Files{def})
+	e.CmpError(err, "without domains")
+
+	_, err = Load([]Files{{CertFile: filepath.Join(dir, "none.crt"), KeyFile: filepath.Join(dir, "none.key")}})
+	e.CmpError(err, "no file")
+}
+
+func TestStaticCertificates_GetCertificate(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	dir := th.TmpDir(e)
+	certs, err := Load([]Files{writeCert(t, dir, "exact", "example.com")})
+	e.CmpNoError(err)
+	staticCert := certs.Certificate("example.com")
+
+	nextCert := &tls.Certificate{}
+	next := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return nextCert, nil
+	}
+
+	// acme enabled
+	getCertificate := certs.GetCertificate(next)
+	res, err := getCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	e.CmpNoError(err)
+	e.Shallow(res, staticCert)
+	res, err = getCertificate(&tls.ClientHelloInfo{ServerName: "other.com"})
+	e.CmpNoError(err)
+	e.Shallow(res, nextCert)
+
+	// acme disabled, without default
+	getCertificate = certs.GetCertificate(nil)
+	res, err = getCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	e.CmpNoError(err)
+	e.Shallow(res, staticCert)
+	_, err = getCertificate(&tls.ClientHelloInfo{ServerName: "other.com"})
+	e.CmpError(err)
+
+	// acme disabled, with default
+	defaultCert := &tls.Certificate{}
+	certs.Default = defaultCert
+	res, err = getCertificate(&tls.ClientHelloInfo{ServerName: "other.com"})
+	e.CmpNoError(err)
+	e.Shallow(res, defaultCert)
+	res, err = getCertificate(&tls.ClientHelloInfo{})
+	e.CmpNoError(err)
+	e.Shallow(res, defaultCert)
+}
+
+type contextConn struct {
+	net.Conn
+	ctx context.Context
+}
+
+func (c contextConn) GetContext() context.Context {
+	return c.ctx
+}
+
+func TestStaticCertificates_GetCertificateTrace(t *testing.T) {
+	e, _, flush := th.NewEnv(t)
+	defer flush()
+
+	dir := th.TmpDir(e)
+	certs, err := Load([]Files{writeCert(t, dir, "wildcard", "*.example.com")})
+	e.CmpNoError(err)
+
+	var buf bytes.Buffer
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&buf),
+		zapcore.DebugLevel))
+	conn := contextConn{ctx: zc.WithLogger(context.Background(), logger)}
+
+	var message struct {
+		ServerName string `json:"server_name"`
+		Chosen     string
+		Candidates []map[string]interface{}
+	}
+
+	_, err = certs.GetCertificate(nil)(&tls.ClientHelloInfo{ServerName: "www.example.com", Conn: conn})
+	e.CmpNoError(err)
+	e.CmpNoError(json.Unmarshal(buf.Bytes(), &message))
+	e.Cmp(message.ServerName, "www.example.com")
+	e.Cmp(message.Chosen, "static: *.example.com")
+	e.Cmp(message.Candidates, []map[string]interface{}{
+		{"key": "www.example.com", "source": "static", "specificity": 3.0, "matched": false, "reason": "no certificate"},
+		{"key": "*.example.com", "source": "static", "specificity": 1.0, "matched": true},
+	})
+
+	buf.Reset()
+	_, err = certs.GetCertificate(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &tls.Certificate{}, nil
+	})(&tls.ClientHelloInfo{ServerName: "example.com", Conn: conn})
+	e.CmpNoError(err)
+	e.CmpNoError(json.Unmarshal(buf.Bytes(), &message))
+	e.Cmp(message.Chosen, "acme certificates")
+	e.Len(message.Candidates, 2)
+}
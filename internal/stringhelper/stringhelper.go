@@ -0,0 +1,11 @@
+package stringhelper
+
+// Contains return true if list has item, equal to s
+func Contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,15 @@
+package stringhelper
+
+import (
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+)
+
+func TestContains(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	td.True(Contains([]string{"a", "b"}, "b"))
+	td.False(Contains([]string{"a", "b"}, "B"))
+	td.False(Contains(nil, ""))
+}
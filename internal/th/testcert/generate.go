@@ -0,0 +1,70 @@
+package testcert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// New create certificate by template and sign it by parent certificate, or self-sign if parent is nil.
+// Generate ECDSA P-256 key if key is nil.
+// Zero serial number and validity bounds of template filled by random serial and now +/- hour.
+func New(t testing.TB, template x509.Certificate, parent *tls.Certificate, key crypto.Signer) *tls.Certificate {
+	t.Helper()
+
+	var err error
+	if key == nil {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+	}
+	if template.SerialNumber == nil {
+		template.SerialNumber, err = rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+		if err != nil {
+			t.Fatalf("generate serial number: %v", err)
+		}
+	}
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+
+	parentCert, parentKey := &template, crypto.Signer(key)
+	if parent != nil {
+		parentCert, parentKey = parent.Leaf, parent.PrivateKey.(crypto.Signer)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, parentCert, key.Public(), parentKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// PEM return PEM-encoded certificate chain and private key of cert.
+func PEM(t testing.TB, cert *tls.Certificate) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("marshal private key: %v", err)
+	}
+	return certPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+}
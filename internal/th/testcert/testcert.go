@@ -4,7 +4,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package testcert contains a test-only localhost certificate.
+// Package testcert contains a test-only localhost certificate and helpers for create test certificates.
 package testcert
 
 import "strings"
@@ -0,0 +1,191 @@
+package tlslistener
+
+import (
+	"context"
+	"math"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AcceptLimit limit rate of accept new tcp connections (token bucket) and count of concurrent connections
+// of the listener. Excess connections delayed (stay in kernel backlog) or closed immediately after accept.
+type AcceptLimit struct {
+	// RatePerSecond - average rate of accept connections, 0 - unlimited.
+	RatePerSecond float64
+
+	// Burst - connections, accepted without delay over the rate. Less than 1 mean 1.
+	Burst int
+
+	// MaxConnections - max count of concurrent connections, 0 - unlimited.
+	MaxConnections int
+
+	// Reject - close excess connections, else delay accept until limits allow it.
+	Reject bool
+
+	accepted int64
+	rejected int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	slotsOnce sync.Once
+	slots     chan struct{}
+}
+
+// InitMetrics register counters of accepted and rejected connections
+func (a *AcceptLimit) InitMetrics(r prometheus.Registerer) {
+	if r == nil || reflect.ValueOf(r).IsNil() {
+		return
+	}
+
+	r.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "accept_limit_accepted", Help: "Count of connections, accepted by accept limit",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&a.accepted))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "accept_limit_rejected", Help: "Count of connections, closed by accept limit",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&a.rejected))
+		}),
+	)
+}
+
+// beforeAccept wait while limits allow accept next connection. Nothing do in reject mode.
+// Connection slot must be released by afterAccept or acceptFailed.
+func (a *AcceptLimit) beforeAccept(ctx context.Context) error {
+	if a == nil || a.Reject {
+		return nil
+	}
+
+	if wait, _ := a.reserve(time.Now(), true); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if slots := a.getSlots(); slots != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case slots <- struct{}{}:
+		}
+	}
+	return nil
+}
+
+// acceptFailed release slot, taken by beforeAccept
+func (a *AcceptLimit) acceptFailed() {
+	if a == nil || a.Reject {
+		return
+	}
+	if slots := a.getSlots(); slots != nil {
+		<-slots
+	}
+}
+
+// afterAccept return connection, which release connection slot on close.
+// In reject mode close the connection and return false if limits exceeded.
+func (a *AcceptLimit) afterAccept(conn net.Conn) (net.Conn, bool) {
+	if a == nil {
+		return conn, true
+	}
+
+	if a.Reject && !a.tryTake() {
+		atomic.AddInt64(&a.rejected, 1)
+		_ = conn.Close()
+		return nil, false
+	}
+
+	atomic.AddInt64(&a.accepted, 1)
+	if a.getSlots() == nil {
+		return conn, true
+	}
+	return &acceptLimitConn{Conn: conn, owner: a}, true
+}
+
+// tryTake take rate token and connection slot without wait
+func (a *AcceptLimit) tryTake() bool {
+	slots := a.getSlots()
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+
+	if _, ok := a.reserve(time.Now(), false); !ok {
+		if slots != nil {
+			<-slots
+		}
+		return false
+	}
+	return true
+}
+
+// reserve take token for accept connection. With allowWait return duration before the token available,
+// else return false if no tokens.
+func (a *AcceptLimit) reserve(now time.Time, allowWait bool) (time.Duration, bool) {
+	if a.RatePerSecond <= 0 {
+		return 0, true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	burst := float64(a.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	if a.last.IsZero() {
+		a.tokens = burst
+	} else {
+		a.tokens = math.Min(burst, a.tokens+now.Sub(a.last).Seconds()*a.RatePerSecond)
+	}
+	a.last = now
+
+	if a.tokens >= 1 {
+		a.tokens--
+		return 0, true
+	}
+	if !allowWait {
+		return 0, false
+	}
+	wait := time.Duration((1 - a.tokens) / a.RatePerSecond * float64(time.Second))
+	a.tokens--
+	return wait, true
+}
+
+func (a *AcceptLimit) getSlots() chan struct{} {
+	a.slotsOnce.Do(func() {
+		if a.MaxConnections > 0 {
+			a.slots = make(chan struct{}, a.MaxConnections)
+		}
+	})
+	return a.slots
+}
+
+type acceptLimitConn struct {
+	net.Conn
+	owner     *AcceptLimit
+	closeOnce sync.Once
+}
+
+func (c *acceptLimitConn) Close() error {
+	c.closeOnce.Do(func() {
+		<-c.owner.getSlots()
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,110 @@
+package tlslistener
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestAcceptLimit_Reserve(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	start := time.Now()
+	a := &AcceptLimit{RatePerSecond: 10, Burst: 2}
+
+	// burst
+	for i := 0; i < 2; i++ {
+		wait, ok := a.reserve(start, false)
+		td.Cmp(wait, time.Duration(0))
+		td.True(ok)
+	}
+	_, ok := a.reserve(start, false)
+	td.False(ok)
+
+	wait, ok := a.reserve(start, true)
+	td.True(ok)
+	td.Cmp(wait, 100*time.Millisecond)
+
+	// reserved token wait next period
+	wait, _ = a.reserve(start, true)
+	td.Cmp(wait, 200*time.Millisecond)
+
+	wait, ok = a.reserve(start.Add(time.Second), false)
+	td.Cmp(wait, time.Duration(0))
+	td.True(ok)
+
+	wait, ok = (&AcceptLimit{}).reserve(start, false)
+	td.Cmp(wait, time.Duration(0))
+	td.True(ok)
+}
+
+func TestAcceptLimit_Reject(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	a := &AcceptLimit{MaxConnections: 1, Reject: true}
+	first, ok := a.afterAccept(newPipeConn(t))
+	td.True(ok)
+
+	rejectedConn := newPipeConn(t)
+	res, ok := a.afterAccept(rejectedConn)
+	td.False(ok)
+	td.Nil(res)
+	_, err := rejectedConn.Write([]byte{1})
+	td.CmpError(err)
+
+	td.CmpNoError(first.Close())
+	_ = first.Close() // slot released once
+	_, ok = a.afterAccept(newPipeConn(t))
+	td.True(ok)
+	td.Cmp(atomic.LoadInt64(&a.accepted), int64(2))
+	td.Cmp(atomic.LoadInt64(&a.rejected), int64(1))
+
+	var nilLimit *AcceptLimit
+	conn := newPipeConn(t)
+	res, ok = nilLimit.afterAccept(conn)
+	td.True(ok)
+	td.Cmp(res, conn)
+}
+
+func TestAcceptLimit_Delay(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	a := &AcceptLimit{MaxConnections: 1}
+	td.CmpNoError(a.beforeAccept(ctx))
+	conn, ok := a.afterAccept(newPipeConn(t))
+	td.True(ok)
+
+	// wait free slot
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	td.CmpError(a.beforeAccept(waitCtx))
+
+	done := make(chan error, 1)
+	go func() { done <- a.beforeAccept(ctx) }()
+	td.CmpNoError(conn.Close())
+	td.CmpNoError(<-done)
+	a.acceptFailed()
+	td.Cmp(len(a.slots), 0)
+
+	// rate
+	a = &AcceptLimit{RatePerSecond: 20, Burst: 1}
+	start := time.Now()
+	td.CmpNoError(a.beforeAccept(ctx))
+	td.CmpNoError(a.beforeAccept(ctx))
+	td.Gte(time.Since(start), 40*time.Millisecond)
+}
+
+func newPipeConn(t *testing.T) net.Conn {
+	server, client := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	return server
+}
@@ -2,47 +2,114 @@ package tlslistener
 
 import (
 	"context"
+	"crypto/x509"
 	"net"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/rekby/lets-proxy2/internal/log"
 	zc "github.com/rekby/zapcontext"
 	"go.uber.org/zap"
+	"golang.org/x/xerrors"
 )
 
 type Config struct {
 	TLSAddresses  []string
 	TCPAddresses  []string
 	MinTLSVersion string
+
+	// Names of systemd activated sockets (LISTEN_FDNAMES), used instead of bind addresses.
+	SystemdTLSName string
+	SystemdTCPName string
+
+	// ClientCAFile - pem file with CA certificates for verify client certificates. Empty - without client certificates.
+	ClientCAFile string
+
+	// Session tickets (tls session resumption) settings.
+	DisableSessionTickets           bool
+	SessionTicketKeysFile           string
+	SessionTicketKeyRotationMinutes int
+
+	// Slow connections detection, disabled if SlowConnectionMinBytesPerSecond is 0.
+	SlowConnectionMinBytesPerSecond  int
+	SlowConnectionGracePeriodSeconds int
+	SlowConnectionClose              bool
+
+	// Accept limits of tcp connections, 0 - unlimited.
+	AcceptRatePerSecond      int
+	AcceptBurst              int
+	MaxConcurrentConnections int
+	RejectExcessConnections  bool
+
+	// TLSPolicies - tls settings for domains, override MinTLSVersion of the listener.
+	TLSPolicies []TLSPolicyConfig
 }
 
 func (c Config) Apply(ctx context.Context, l *ListenersHandler) error {
 	logger := zc.L(ctx)
+	activated := getSystemdListeners(ctx)
+	activated.configure(c.SystemdTLSName, c.SystemdTCPName)
 
-	var tlsListeners = make([]net.Listener, 0, len(c.TLSAddresses))
-	for _, addr := range c.TLSAddresses { //nolint:wsl
-		listener, err := net.Listen("tcp", addr)
-		log.DebugError(logger, err, "Start listen tls binding", zap.String("address", addr))
-		if err != nil {
-			return err
-		}
+	tlsListeners := activated.take(c.SystemdTLSName, len(c.TLSAddresses))
+	if len(tlsListeners) > 0 {
+		logger.Info("Use socket activated tls listeners", zap.Int("count", len(tlsListeners)))
+	} else {
+		tlsListeners = make([]net.Listener, 0, len(c.TLSAddresses))
+		for _, addr := range c.TLSAddresses { //nolint:wsl
+			listener, err := net.Listen("tcp", addr)
+			log.DebugError(logger, err, "Start listen tls binding", zap.String("address", addr))
+			if err != nil {
+				return err
+			}
 
-		tlsListeners = append(tlsListeners, listener)
+			tlsListeners = append(tlsListeners, listener)
+		}
 	}
 
-	var tcpListeners = make([]net.Listener, 0, len(c.TCPAddresses))
+	tcpListeners := activated.take(c.SystemdTCPName, len(c.TCPAddresses))
+	if len(tcpListeners) > 0 {
+		logger.Info("Use socket activated tcp listeners", zap.Int("count", len(tcpListeners)))
+	} else {
+		tcpListeners = make([]net.Listener, 0, len(c.TCPAddresses))
+		for _, addr := range c.TCPAddresses {
+			listener, err := net.Listen("tcp", addr)
+			log.DebugError(logger, err, "Start listen tcp binding", zap.String("address", addr))
+			if err != nil {
+				return err
+			}
 
-	for _, addr := range c.TCPAddresses {
-		listener, err := net.Listen("tcp", addr)
-		log.DebugError(logger, err, "Start listen tcp binding", zap.String("address", addr))
-		if err != nil {
-			return err
+			tcpListeners = append(tcpListeners, listener)
 		}
-
-		tcpListeners = append(tcpListeners, listener)
 	}
 	l.ListenersForHandleTLS = tlsListeners
 	l.Listeners = tcpListeners
 
+	if c.ClientCAFile != "" {
+		pemData, err := os.ReadFile(c.ClientCAFile)
+		log.DebugError(logger, err, "Read client ca file", zap.String("file", c.ClientCAFile))
+		if err != nil {
+			return xerrors.Errorf("read client ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return xerrors.Errorf("no certificates in client ca file %q", c.ClientCAFile)
+		}
+		l.ClientCAs = pool
+	}
+
+	if err := c.applySessionTickets(ctx, l); err != nil {
+		return err
+	}
+
+	if err := c.applySlowConnections(ctx, l); err != nil {
+		return err
+	}
+
+	if err := c.applyAcceptLimit(ctx, l); err != nil {
+		return err
+	}
+
 	if tlsVersion, err := ParseTLSVersion(c.MinTLSVersion); err == nil {
 		l.MinTLSVersion = tlsVersion
 		logger.Info("Min tls version", zap.String("tls_version", c.MinTLSVersion))
@@ -50,5 +117,96 @@ func (c Config) Apply(ctx context.Context, l *ListenersHandler) error {
 		return err
 	}
 
+	return c.applyTLSPolicies(ctx, l)
+}
+
+func (c Config) applyTLSPolicies(ctx context.Context, l *ListenersHandler) error {
+	if len(c.TLSPolicies) == 0 {
+		return nil
+	}
+
+	policies := make([]TLSPolicy, 0, len(c.TLSPolicies))
+	for i, policyConfig := range c.TLSPolicies {
+		policy, err := parseTLSPolicy(policyConfig, l.MinTLSVersion)
+		if err != nil {
+			return xerrors.Errorf("tls policy %v (%v): %w", i, strings.Join(policyConfig.Domains, ", "), err)
+		}
+		policies = append(policies, policy)
+	}
+	if _, err := newTLSPolicies(policies); err != nil {
+		return err
+	}
+	l.TLSPolicies = policies
+	zc.L(ctx).Info("Tls policies for domains", zap.Int("count", len(policies)))
+	return nil
+}
+
+func (c Config) applySessionTickets(ctx context.Context, l *ListenersHandler) error {
+	if c.SessionTicketKeyRotationMinutes < 0 {
+		return xerrors.Errorf("session ticket key rotation must be non negative, got: %v", c.SessionTicketKeyRotationMinutes)
+	}
+	if c.SessionTicketKeysFile != "" && c.SessionTicketKeyRotationMinutes > 0 {
+		return xerrors.New("session ticket keys file and session ticket key rotation can't be used together")
+	}
+
+	l.SessionTicketsDisabled = c.DisableSessionTickets
+	l.SessionTicketKeyRotation = time.Duration(c.SessionTicketKeyRotationMinutes) * time.Minute
+	if c.DisableSessionTickets || c.SessionTicketKeysFile == "" {
+		return nil
+	}
+
+	keys, err := ReadSessionTicketKeysFile(c.SessionTicketKeysFile)
+	log.DebugError(zc.L(ctx), err, "Read session ticket keys file", zap.String("file", c.SessionTicketKeysFile),
+		zap.Int("keys_count", len(keys)))
+	if err != nil {
+		return err
+	}
+	l.SessionTicketKeys = keys
+	l.SessionTicketKeysFile = c.SessionTicketKeysFile
+	return nil
+}
+
+func (c Config) applySlowConnections(ctx context.Context, l *ListenersHandler) error {
+	if c.SlowConnectionMinBytesPerSecond < 0 {
+		return xerrors.Errorf("slow connection min bytes per second must be non negative, got: %v", c.SlowConnectionMinBytesPerSecond)
+	}
+	if c.SlowConnectionMinBytesPerSecond == 0 {
+		return nil
+	}
+	if c.SlowConnectionGracePeriodSeconds <= 0 {
+		return xerrors.Errorf("slow connection grace period must be positive, got: %v", c.SlowConnectionGracePeriodSeconds)
+	}
+
+	l.SlowConnections = &SlowConnections{
+		MinBytesPerSecond: int64(c.SlowConnectionMinBytesPerSecond),
+		GracePeriod:       time.Duration(c.SlowConnectionGracePeriodSeconds) * time.Second,
+		Close:             c.SlowConnectionClose,
+	}
+	zc.L(ctx).Info("Slow connections detection", zap.Int("min_bytes_per_second", c.SlowConnectionMinBytesPerSecond),
+		zap.Int("grace_period_seconds", c.SlowConnectionGracePeriodSeconds), zap.Bool("close", c.SlowConnectionClose))
+	return nil
+}
+
+func (c Config) applyAcceptLimit(ctx context.Context, l *ListenersHandler) error {
+	if c.AcceptRatePerSecond < 0 || c.AcceptBurst < 0 || c.MaxConcurrentConnections < 0 {
+		return xerrors.Errorf("accept limits must be non negative, got rate: %v, burst: %v, max connections: %v",
+			c.AcceptRatePerSecond, c.AcceptBurst, c.MaxConcurrentConnections)
+	}
+	if c.AcceptRatePerSecond == 0 && c.MaxConcurrentConnections == 0 {
+		return nil
+	}
+
+	burst := c.AcceptBurst
+	if burst == 0 {
+		burst = c.AcceptRatePerSecond
+	}
+	l.AcceptLimit = &AcceptLimit{
+		RatePerSecond:  float64(c.AcceptRatePerSecond),
+		Burst:          burst,
+		MaxConnections: c.MaxConcurrentConnections,
+		Reject:         c.RejectExcessConnections,
+	}
+	zc.L(ctx).Info("Accept limit", zap.Int("rate_per_second", c.AcceptRatePerSecond), zap.Int("burst", burst),
+		zap.Int("max_connections", c.MaxConcurrentConnections), zap.Bool("reject", c.RejectExcessConnections))
 	return nil
 }
@@ -1,10 +1,15 @@
 package tlslistener
 
 import (
+	"crypto/tls"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/rekby/lets-proxy2/internal/th"
+	"github.com/rekby/lets-proxy2/internal/th/testcert"
 
 	"github.com/maxatome/go-testdeep"
 )
@@ -90,3 +95,65 @@ func getFreePorts(ip string, cnt int) []string {
 	}
 	return res
 }
+
+func TestConfig_ApplyClientCAFile(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+	dir := t.TempDir()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	td.CmpNoError(os.WriteFile(caFile, testcert.LocalhostCert, 0600))
+	l := &ListenersHandler{}
+	td.CmpNoError(Config{ClientCAFile: caFile}.Apply(ctx, l))
+	td.NotNil(l.ClientCAs)
+
+	l.init()
+	td.Cmp(l.tlsConfig.ClientAuth, tls.VerifyClientCertIfGiven)
+
+	badFile := filepath.Join(dir, "bad.pem")
+	td.CmpNoError(os.WriteFile(badFile, []byte("bad"), 0600))
+	td.CmpError(Config{ClientCAFile: badFile}.Apply(ctx, &ListenersHandler{}))
+
+	td.CmpError(Config{ClientCAFile: filepath.Join(dir, "not-exist.pem")}.Apply(ctx, &ListenersHandler{}))
+}
+
+func TestConfig_ApplySlowConnections(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	l := &ListenersHandler{}
+	td.CmpNoError(Config{SlowConnectionGracePeriodSeconds: 10}.Apply(ctx, l))
+	td.Nil(l.SlowConnections)
+
+	td.CmpNoError(Config{SlowConnectionMinBytesPerSecond: 100, SlowConnectionGracePeriodSeconds: 10, SlowConnectionClose: true}.Apply(ctx, l))
+	td.Cmp(l.SlowConnections, testdeep.Struct(&SlowConnections{MinBytesPerSecond: 100, GracePeriod: 10 * time.Second, Close: true}, nil))
+
+	td.CmpError(Config{SlowConnectionMinBytesPerSecond: 100}.Apply(ctx, &ListenersHandler{}))
+	td.CmpError(Config{SlowConnectionMinBytesPerSecond: -1}.Apply(ctx, &ListenersHandler{}))
+}
+
+func TestConfig_ApplyAcceptLimit(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	l := &ListenersHandler{}
+	td.CmpNoError(Config{AcceptBurst: 10, RejectExcessConnections: true}.Apply(ctx, l))
+	td.Nil(l.AcceptLimit)
+
+	td.CmpNoError(Config{AcceptRatePerSecond: 100}.Apply(ctx, l))
+	td.Cmp(l.AcceptLimit, testdeep.Struct(&AcceptLimit{RatePerSecond: 100, Burst: 100}, nil))
+
+	l = &ListenersHandler{}
+	td.CmpNoError(Config{MaxConcurrentConnections: 5, AcceptBurst: 3, RejectExcessConnections: true}.Apply(ctx, l))
+	td.Cmp(l.AcceptLimit, testdeep.Struct(&AcceptLimit{Burst: 3, MaxConnections: 5, Reject: true}, nil))
+
+	td.CmpError(Config{AcceptRatePerSecond: -1}.Apply(ctx, &ListenersHandler{}))
+	td.CmpError(Config{AcceptBurst: -1}.Apply(ctx, &ListenersHandler{}))
+	td.CmpError(Config{MaxConcurrentConnections: -1}.Apply(ctx, &ListenersHandler{}))
+}
@@ -0,0 +1,219 @@
+package tlslistener
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const connectionsPath = "/connections"
+
+// Connections - registry of active connections of listeners, for debug.
+type Connections struct {
+	mu    sync.Mutex
+	items map[string]*trackedConn
+}
+
+// ConnectionInfo - info about active connection
+type ConnectionInfo struct {
+	ID            string    `json:"id"`
+	Listener      string    `json:"listener,omitempty"`
+	RemoteAddr    string    `json:"remote_addr"`
+	LocalAddr     string    `json:"local_addr"`
+	ServerName    string    `json:"server_name,omitempty"`
+	Backend       string    `json:"backend,omitempty"`
+	Start         time.Time `json:"start"`
+	BytesReceived int64     `json:"bytes_received"`
+	BytesSent     int64     `json:"bytes_sent"`
+
+	// RouteGeneration - generation of proxy routes of last request, 0 - without requests or routes reload disabled
+	RouteGeneration uint64 `json:"route_generation,omitempty"`
+
+	// RequestHost, RequestPath - host and path of last request, before routes applied
+	RequestHost string `json:"request_host,omitempty"`
+	RequestPath string `json:"request_path,omitempty"`
+}
+
+type connectionRequest struct {
+	host string
+	path string
+}
+
+type trackedConn struct {
+	net.Conn
+
+	id       string
+	listener string
+	start    time.Time
+
+	// string
+	serverName atomic.Value
+	backend    atomic.Value
+
+	// connectionRequest
+	request atomic.Value
+
+	bytesReceived   int64
+	bytesSent       int64
+	routeGeneration uint64
+}
+
+// NewConnections create empty registry
+func NewConnections() *Connections {
+	return &Connections{items: make(map[string]*trackedConn)}
+}
+
+// track register connection and return conn, which count its traffic. Caller must call remove after close.
+func (c *Connections) track(conn net.Conn, id, listener string, now time.Time) *trackedConn {
+	res := &trackedConn{Conn: conn, id: id, listener: listener, start: now}
+
+	c.mu.Lock()
+	c.items[id] = res
+	c.mu.Unlock()
+	return res
+}
+
+func (c *Connections) remove(id string) {
+	c.mu.Lock()
+	delete(c.items, id)
+	c.mu.Unlock()
+}
+
+// List return active connections, sorted by start time
+func (c *Connections) List() []ConnectionInfo {
+	c.mu.Lock()
+	res := make([]ConnectionInfo, 0, len(c.items))
+	for _, conn := range c.items {
+		res = append(res, conn.info())
+	}
+	c.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Start.Before(res[j].Start)
+	})
+	return res
+}
+
+// Close close connection by id. It return false if the connection not found.
+func (c *Connections) Close(id string) bool {
+	c.mu.Lock()
+	conn := c.items[id]
+	c.mu.Unlock()
+
+	if conn == nil {
+		return false
+	}
+	// close underlying connection: read from it in http server fail and server close the connection
+	// by usual way, with remove from registry
+	_ = conn.Conn.Close()
+	return true
+}
+
+// ReleaseRouteGeneration handle connections, which bound to routes generations before generation:
+// connection moved to generation if keep return true for it and closed else.
+// It return count of migrated and closed connections.
+func (c *Connections) ReleaseRouteGeneration(generation uint64, keep func(info ConnectionInfo) bool) (migrated, closed int) {
+	c.mu.Lock()
+	conns := make([]*trackedConn, 0, len(c.items))
+	for _, conn := range c.items {
+		conns = append(conns, conn)
+	}
+	c.mu.Unlock()
+
+	for _, conn := range conns {
+		info := conn.info()
+		if info.RouteGeneration >= generation {
+			continue
+		}
+		if keep(info) {
+			// CAS: doesn't rollback generation, if the connection got request with new routes meanwhile
+			if atomic.CompareAndSwapUint64(&conn.routeGeneration, info.RouteGeneration, generation) {
+				migrated++
+			}
+			continue
+		}
+		_ = conn.Conn.Close()
+		closed++
+	}
+	return migrated, closed
+}
+
+// Handler return active connections as json for GET /connections and close connection
+// for DELETE /connections/{id}
+func (c *Connections) Handler(logger *zap.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, connectionsPath), "/")
+		switch {
+		case r.Method == http.MethodGet && id == "":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(c.List())
+		case r.Method == http.MethodDelete && id != "":
+			closed := c.Close(id)
+			logger.Info("Close connection by admin request", zap.String("connection_id", id),
+				zap.Bool("found", closed), zap.String("remote_address", r.RemoteAddr))
+			if !closed {
+				http.Error(w, "Connection not found", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.bytesReceived, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.bytesSent, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) setServerName(serverName string) {
+	c.serverName.Store(serverName)
+}
+
+func (c *trackedConn) setBackend(backend string) {
+	c.backend.Store(backend)
+}
+
+func (c *trackedConn) setRequest(host, path string) {
+	c.request.Store(connectionRequest{host: host, path: path})
+}
+
+func (c *trackedConn) setRouteGeneration(generation uint64) {
+	atomic.StoreUint64(&c.routeGeneration, generation)
+}
+
+func (c *trackedConn) info() ConnectionInfo {
+	serverName, _ := c.serverName.Load().(string)
+	backend, _ := c.backend.Load().(string)
+	request, _ := c.request.Load().(connectionRequest)
+	return ConnectionInfo{
+		ID:            c.id,
+		Listener:      c.listener,
+		RemoteAddr:    c.Conn.RemoteAddr().String(),
+		LocalAddr:     c.Conn.LocalAddr().String(),
+		ServerName:    serverName,
+		Backend:       backend,
+		Start:         c.start,
+		BytesReceived: atomic.LoadInt64(&c.bytesReceived),
+		BytesSent:     atomic.LoadInt64(&c.bytesSent),
+
+		RouteGeneration: atomic.LoadUint64(&c.routeGeneration),
+		RequestHost:     request.host,
+		RequestPath:     request.path,
+	}
+}
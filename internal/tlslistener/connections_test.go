@@ -0,0 +1,138 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestConnections(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	listener := th.NewLocalTcpListener(e)
+	h := &ListenersHandler{
+		GetCertificate:         dummyGetCertificate,
+		ListenersForHandleTLS:  []net.Listener{listener},
+		Connections:            NewConnections(),
+		Name:                   "test",
+		connectionHandleStart:  func() {},
+		connectionHandleFinish: func(err error) {},
+	}
+	e.CmpNoError(h.Start(ctx, nil))
+	defer func() { _ = h.Close() }()
+
+	serverConns := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := h.Accept()
+			if err != nil {
+				return
+			}
+			serverConns <- conn
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		ServerName:         "test.ru",
+		InsecureSkipVerify: true, //nolint:gosec
+	})
+	e.CmpNoError(err)
+	defer func() { _ = conn.Close() }()
+	serverConn := <-serverConns
+
+	_, err = conn.Write([]byte("ping"))
+	e.CmpNoError(err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(serverConn, buf)
+	e.CmpNoError(err)
+
+	connCtx, err := h.GetConnectionContext(serverConn.RemoteAddr().String(), serverConn.LocalAddr().String())
+	e.CmpNoError(err)
+	connCtx.Value(contextlabel.ConnectionBackend).(func(string))("backend:80")
+	connCtx.Value(contextlabel.ConnectionRequest).(func(host, path string))("test.ru", "/api/")
+
+	handler := h.Connections.Handler(zap.NewNop())
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/connections", nil))
+	e.Cmp(recorder.Header().Get("Content-Type"), "application/json")
+
+	var res []ConnectionInfo
+	e.CmpNoError(json.Unmarshal(recorder.Body.Bytes(), &res))
+	e.Cmp(res, testdeep.Len(1))
+	e.Cmp(res[0], testdeep.Struct(ConnectionInfo{
+		ID:         connCtx.Value(contextlabel.ConnectionID).(string),
+		Listener:   "test",
+		RemoteAddr: conn.LocalAddr().String(),
+		LocalAddr:  listener.Addr().String(),
+		ServerName: "test.ru",
+		Backend:    "backend:80",
+
+		RequestHost: "test.ru",
+		RequestPath: "/api/",
+	}, testdeep.StructFields{
+		"Start":         testdeep.Between(time.Now().Add(-time.Minute), time.Now()),
+		"BytesReceived": testdeep.Gt(int64(4)),
+		"BytesSent":     testdeep.Gt(int64(0)),
+	}))
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/connections/unknown", nil))
+	e.Cmp(recorder.Code, http.StatusNotFound)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/connections/"+res[0].ID, nil))
+	e.Cmp(recorder.Code, http.StatusNoContent)
+
+	// connection closed by admin, owner of connection see error and close it
+	_, err = serverConn.Read(buf)
+	e.CmpError(err)
+	_ = serverConn.Close()
+	e.Cmp(h.Connections.List(), testdeep.Empty())
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/connections", nil))
+	e.Cmp(recorder.Code, http.StatusMethodNotAllowed)
+}
+
+func TestConnections_ReleaseRouteGeneration(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	connections := NewConnections()
+	newConn := func(id, backend string, generation uint64) net.Conn {
+		server, client := net.Pipe()
+		tracked := connections.track(server, id, "", time.Now())
+		tracked.setBackend(backend)
+		tracked.setRouteGeneration(generation)
+		return client
+	}
+	_ = newConn("keep", "keep:80", 1)
+	closedClient := newConn("close", "removed:80", 1)
+	_ = newConn("new", "removed:80", 2)
+
+	migrated, closed := connections.ReleaseRouteGeneration(2, func(info ConnectionInfo) bool {
+		return info.Backend == "keep:80"
+	})
+	td.Cmp(migrated, 1)
+	td.Cmp(closed, 1)
+
+	_, err := closedClient.Read(make([]byte, 1))
+	td.CmpError(err)
+
+	generations := map[string]uint64{}
+	for _, info := range connections.List() {
+		generations[info.ID] = info.RouteGeneration
+	}
+	td.Cmp(generations, map[string]uint64{"keep": 2, "close": 1, "new": 2})
+}
@@ -0,0 +1,63 @@
+package tlslistener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// DomainDeniedPolicy - behavior of listener when certificate for domain denied by domain checkers
+type DomainDeniedPolicy string
+
+const (
+	DomainDeniedTLSFail  DomainDeniedPolicy = "tls_fail"  // abort handshake
+	DomainDeniedHTTPDeny DomainDeniedPolicy = "http_deny" // handshake with fallback certificate, http proxy deny requests
+)
+
+const fallbackCertLifetime = 10 * 365 * 24 * time.Hour
+
+// ParseDomainDeniedPolicy parse policy from config. Empty string mean DomainDeniedTLSFail.
+func ParseDomainDeniedPolicy(s string) (DomainDeniedPolicy, error) {
+	switch policy := DomainDeniedPolicy(s); policy {
+	case "":
+		return DomainDeniedTLSFail, nil
+	case DomainDeniedTLSFail, DomainDeniedHTTPDeny:
+		return policy, nil
+	default:
+		return "", xerrors.Errorf("unknown domain denied policy: %q", s)
+	}
+}
+
+// NewFallbackCertificate create self-signed certificate for complete handshake for denied domains
+func NewFallbackCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, xerrors.Errorf("generate fallback certificate key: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: "lets-proxy fallback certificate"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(fallbackCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, xerrors.Errorf("create fallback certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, xerrors.Errorf("parse fallback certificate: %w", err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,95 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/domain_checker"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestParseDomainDeniedPolicy(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	for s, expected := range map[string]DomainDeniedPolicy{
+		"":          DomainDeniedTLSFail,
+		"tls_fail":  DomainDeniedTLSFail,
+		"http_deny": DomainDeniedHTTPDeny,
+	} {
+		res, err := ParseDomainDeniedPolicy(s)
+		td.CmpNoError(err)
+		td.Cmp(res, expected)
+	}
+
+	_, err := ParseDomainDeniedPolicy("bad")
+	td.CmpError(err)
+}
+
+func TestListenersHandler_DomainDeniedCertificate(t *testing.T) {
+	td := testdeep.NewT(t)
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	fallback, err := NewFallbackCertificate()
+	td.CmpNoError(err)
+	td.Cmp(fallback.Leaf.Subject.CommonName, "lets-proxy fallback certificate")
+
+	errInternal := xerrors.New("internal")
+	errDenied := xerrors.Errorf("denied by manager: %w", domain.ErrDomainDenied)
+	var certErr error
+	h := &ListenersHandler{ctx: ctx, DomainDeniedCertificate: fallback, GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if certErr != nil {
+			return nil, certErr
+		}
+		return &tls.Certificate{}, nil
+	}}
+
+	hello := func() (*tls.ClientHelloInfo, *int32) {
+		denied := new(int32)
+		connCtx := context.WithValue(ctx, contextlabel.DomainDenied, denied)
+		return &tls.ClientHelloInfo{ServerName: "test.ru", Conn: ContextConnextion{Context: connCtx, Conn: &net.TCPConn{}}}, denied
+	}
+
+	info, denied := hello()
+	cert, err := h.getCertificate(info)
+	td.CmpNoError(err)
+	td.Cmp(cert, &tls.Certificate{})
+	td.Cmp(atomic.LoadInt32(denied), int32(0))
+
+	certErr = errInternal
+	info, denied = hello()
+	_, err = h.getCertificate(info)
+	td.Cmp(err, errInternal)
+	td.Cmp(atomic.LoadInt32(denied), int32(0))
+
+	certErr = errDenied
+	info, denied = hello()
+	cert, err = h.getCertificate(info)
+	td.CmpNoError(err)
+	td.Cmp(cert, fallback)
+	td.Cmp(atomic.LoadInt32(denied), int32(1))
+
+	// denied by listener
+	certErr = nil
+	h.DomainChecker = domain_checker.False{}
+	info, denied = hello()
+	cert, err = h.getCertificate(info)
+	td.CmpNoError(err)
+	td.Cmp(cert, fallback)
+	td.Cmp(atomic.LoadInt32(denied), int32(1))
+
+	// tls fail
+	h.DomainDeniedCertificate = nil
+	info, denied = hello()
+	_, err = h.getCertificate(info)
+	td.Cmp(err, errDomainNotAllowed)
+	td.Cmp(atomic.LoadInt32(denied), int32(0))
+}
@@ -0,0 +1,210 @@
+package tlslistener
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DomainStatsOther - name of bucket for domains over limit and connections without SNI
+const DomainStatsOther = "other"
+
+// DomainStats collect handshake and traffic stats of tls connections by SNI.
+// Count of domains limited, when limit reached - domain with least traffic and without connections
+// merged into "other" bucket. If all domains have connections - new domain counted in "other" bucket.
+type DomainStats struct {
+	limit int
+
+	mu      sync.Mutex
+	domains map[string]*domainStat
+	other   domainStat
+}
+
+type domainStat struct {
+	// atomic, first in struct for 64-bit alignment
+	bytesReceived int64
+	bytesSent     int64
+
+	// guarded by DomainStats.mu
+	handshakes         int64
+	currentConnections int64
+	lastHandshake      time.Time
+}
+
+// DomainStatsInfo is stats of one domain
+type DomainStatsInfo struct {
+	Domain             string    `json:"domain"`
+	Handshakes         int64     `json:"handshakes"`
+	LastHandshake      time.Time `json:"last_handshake"`
+	BytesReceived      int64     `json:"bytes_received"`
+	BytesSent          int64     `json:"bytes_sent"`
+	CurrentConnections int64     `json:"current_connections"`
+}
+
+// NewDomainStats create stats with limit of count of separately counted domains
+func NewDomainStats(limit int) *DomainStats {
+	return &DomainStats{limit: limit, domains: make(map[string]*domainStat)}
+}
+
+// Snapshot return stats of domains, sorted by traffic, and stats of "other" bucket
+func (s *DomainStats) Snapshot() (domains []DomainStatsInfo, other DomainStatsInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	domains = make([]DomainStatsInfo, 0, len(s.domains))
+	for name, stat := range s.domains {
+		domains = append(domains, stat.info(name))
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		iBytes := domains[i].BytesReceived + domains[i].BytesSent
+		jBytes := domains[j].BytesReceived + domains[j].BytesSent
+		if iBytes != jBytes {
+			return iBytes > jBytes
+		}
+		return domains[i].Domain < domains[j].Domain
+	})
+	return domains, s.other.info(DomainStatsOther)
+}
+
+// ServeHTTP return stats as json
+func (s *DomainStats) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	domains, other := s.Snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Limit   int               `json:"limit"`
+		Domains []DomainStatsInfo `json:"domains"`
+		Other   DomainStatsInfo   `json:"other"`
+	}{Limit: s.limit, Domains: domains, Other: other})
+}
+
+// connectionStart register handshaked connection and return stat for count its traffic
+func (s *DomainStats) connectionStart(serverName string, now time.Time) *domainStat {
+	serverName = strings.ToLower(serverName)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stat := s.getStat(serverName)
+	stat.handshakes++
+	stat.currentConnections++
+	stat.lastHandshake = now
+	return stat
+}
+
+func (s *DomainStats) connectionFinish(stat *domainStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stat.currentConnections--
+}
+
+// getStat must be called with locked mu
+func (s *DomainStats) getStat(serverName string) *domainStat {
+	if serverName == "" {
+		return &s.other
+	}
+	if stat, ok := s.domains[serverName]; ok {
+		return stat
+	}
+
+	if len(s.domains) >= s.limit {
+		var evictName string
+		var evictStat *domainStat
+		for name, stat := range s.domains {
+			if stat.currentConnections > 0 {
+				continue
+			}
+			if evictStat == nil || stat.bytes() < evictStat.bytes() {
+				evictName, evictStat = name, stat
+			}
+		}
+		if evictStat == nil {
+			return &s.other
+		}
+		s.other.merge(evictStat)
+		delete(s.domains, evictName)
+	}
+
+	stat := &domainStat{}
+	s.domains[serverName] = stat
+	return stat
+}
+
+func (s *domainStat) bytes() int64 {
+	return atomic.LoadInt64(&s.bytesReceived) + atomic.LoadInt64(&s.bytesSent)
+}
+
+func (s *domainStat) merge(from *domainStat) {
+	atomic.AddInt64(&s.bytesReceived, atomic.LoadInt64(&from.bytesReceived))
+	atomic.AddInt64(&s.bytesSent, atomic.LoadInt64(&from.bytesSent))
+	s.handshakes += from.handshakes
+	if from.lastHandshake.After(s.lastHandshake) {
+		s.lastHandshake = from.lastHandshake
+	}
+}
+
+func (s *domainStat) info(name string) DomainStatsInfo {
+	return DomainStatsInfo{
+		Domain:             name,
+		Handshakes:         s.handshakes,
+		LastHandshake:      s.lastHandshake,
+		BytesReceived:      atomic.LoadInt64(&s.bytesReceived),
+		BytesSent:          atomic.LoadInt64(&s.bytesSent),
+		CurrentConnections: s.currentConnections,
+	}
+}
+
+// domainStatsConn count traffic of connection. Traffic before handshake finished
+// counted locally and added to domain stat after handshake.
+type domainStatsConn struct {
+	ContextConnextion
+
+	stats *DomainStats
+	stat  *domainStat
+
+	handshakeReceived int64
+	handshakeSent     int64
+
+	closeOnce sync.Once
+}
+
+func (c *domainStatsConn) Read(b []byte) (int, error) {
+	n, err := c.ContextConnextion.Read(b)
+	if c.stat == nil {
+		c.handshakeReceived += int64(n)
+	} else {
+		atomic.AddInt64(&c.stat.bytesReceived, int64(n))
+	}
+	return n, err
+}
+
+func (c *domainStatsConn) Write(b []byte) (int, error) {
+	n, err := c.ContextConnextion.Write(b)
+	if c.stat == nil {
+		c.handshakeSent += int64(n)
+	} else {
+		atomic.AddInt64(&c.stat.bytesSent, int64(n))
+	}
+	return n, err
+}
+
+// handshakeFinished must be called from handshake goroutine before share the connection
+func (c *domainStatsConn) handshakeFinished(serverName string) {
+	stat := c.stats.connectionStart(serverName, time.Now())
+	atomic.AddInt64(&stat.bytesReceived, c.handshakeReceived)
+	atomic.AddInt64(&stat.bytesSent, c.handshakeSent)
+	c.stat = stat
+}
+
+func (c *domainStatsConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.stat != nil {
+			c.stats.connectionFinish(c.stat)
+		}
+	})
+	return c.ContextConnextion.Close()
+}
@@ -0,0 +1,113 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestDomainStatsLimit(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := NewDomainStats(2)
+
+	big := s.connectionStart("Big.ru", now)
+	big.bytesSent = 100
+	small := s.connectionStart("small.ru", now)
+	small.bytesSent = 10
+
+	// all domains have connections
+	td.Cmp(s.connectionStart("new.ru", now), testdeep.Shallow(&s.other))
+	s.connectionFinish(&s.other)
+
+	s.connectionFinish(big)
+	s.connectionFinish(small)
+	newStat := s.connectionStart("new.ru", now.Add(time.Second))
+	newStat.bytesReceived = 1
+	td.Cmp(s.connectionStart("", now), testdeep.Shallow(&s.other))
+
+	domains, other := s.Snapshot()
+	td.Cmp(domains, []DomainStatsInfo{
+		{Domain: "big.ru", Handshakes: 1, LastHandshake: now, BytesSent: 100},
+		{Domain: "new.ru", Handshakes: 1, LastHandshake: now.Add(time.Second), BytesReceived: 1, CurrentConnections: 1},
+	})
+	td.Cmp(other, DomainStatsInfo{
+		Domain: DomainStatsOther, Handshakes: 3, LastHandshake: now, BytesSent: 10, CurrentConnections: 1,
+	})
+}
+
+func TestDomainStatsConnections(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	listener := th.NewLocalTcpListener(e)
+	h := &ListenersHandler{
+		GetCertificate:         dummyGetCertificate,
+		ListenersForHandleTLS:  []net.Listener{listener},
+		DomainStats:            NewDomainStats(10),
+		connectionHandleStart:  func() {},
+		connectionHandleFinish: func(err error) {},
+	}
+	e.CmpNoError(h.Start(ctx, nil))
+	defer func() { _ = h.Close() }()
+
+	serverConns := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := h.Accept()
+			if err != nil {
+				return
+			}
+			serverConns <- conn
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		ServerName:         "test.ru",
+		InsecureSkipVerify: true, //nolint:gosec
+	})
+	e.CmpNoError(err)
+	serverConn := <-serverConns
+
+	_, err = conn.Write([]byte("ping"))
+	e.CmpNoError(err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(serverConn, buf)
+	e.CmpNoError(err)
+
+	domains, _ := h.DomainStats.Snapshot()
+	e.Cmp(domains, testdeep.Bag(testdeep.Struct(DomainStatsInfo{Domain: "test.ru", Handshakes: 1, CurrentConnections: 1},
+		testdeep.StructFields{
+			"LastHandshake": testdeep.Between(time.Now().Add(-time.Minute), time.Now()),
+			"BytesReceived": testdeep.Gt(int64(4)),
+			"BytesSent":     testdeep.Gt(int64(0)),
+		})))
+
+	e.CmpNoError(serverConn.Close())
+	_ = conn.Close()
+
+	recorder := httptest.NewRecorder()
+	h.DomainStats.ServeHTTP(recorder, httptest.NewRequest("GET", "/stats/domains", nil))
+	e.Cmp(recorder.Header().Get("Content-Type"), "application/json")
+
+	var res struct {
+		Limit   int
+		Domains []DomainStatsInfo
+		Other   DomainStatsInfo
+	}
+	e.CmpNoError(json.Unmarshal(recorder.Body.Bytes(), &res))
+	e.Cmp(res.Limit, 10)
+	e.Cmp(res.Domains, testdeep.Len(1))
+	e.Cmp(res.Domains[0].Domain, "test.ru")
+	e.Cmp(res.Domains[0].CurrentConnections, int64(0))
+	e.Cmp(res.Other.Domain, DomainStatsOther)
+}
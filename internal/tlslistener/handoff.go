@@ -0,0 +1,50 @@
+package tlslistener
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// EnvHandoffPID is pid of parent process, which pass own listeners to child process
+// by socket activation protocol while graceful restart.
+const EnvHandoffPID = "LETS_PROXY_HANDOFF_PID"
+
+// StopAccept close raw listeners and stop accept new connections.
+// Accepted connections continue handle.
+func (p *ListenersHandler) StopAccept() error {
+	if p.ctxCancelFunc != nil {
+		p.ctxCancelFunc()
+	}
+
+	var resErr error
+	for _, l := range append(append([]net.Listener{}, p.ListenersForHandleTLS...), p.Listeners...) {
+		if err := l.Close(); err != nil && resErr == nil {
+			resErr = err
+		}
+	}
+	return resErr
+}
+
+// HandoffEnv return environment for child process, which will receive listeners with names
+// as extra files, started from fd 3.
+func HandoffEnv(environ []string, names []string, parentPID int) []string {
+	res := make([]string, 0, len(environ)+4) //nolint:gomnd
+	for _, item := range environ {
+		switch {
+		case strings.HasPrefix(item, envListenPID+"="),
+			strings.HasPrefix(item, envListenFDs+"="),
+			strings.HasPrefix(item, envListenFDNames+"="),
+			strings.HasPrefix(item, EnvHandoffPID+"="):
+			continue
+		default:
+			res = append(res, item)
+		}
+	}
+
+	return append(res,
+		envListenFDs+"="+strconv.Itoa(len(names)),
+		envListenFDNames+"="+strings.Join(names, ":"),
+		EnvHandoffPID+"="+strconv.Itoa(parentPID),
+	)
+}
@@ -0,0 +1,70 @@
+//go:build !windows
+
+package tlslistener
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/xerrors"
+)
+
+// ListenerFDs return duplicated file descriptors of raw listeners with names for pass it to child process.
+// It doesn't use os.File because it switch shared socket to blocking mode and break accept in current process.
+// Caller must close the descriptors by CloseFDs.
+func (p *ListenersHandler) ListenerFDs(tlsName, tcpName string) (fds []int, names []string, err error) {
+	appendFDs := func(listeners []net.Listener, name string) error {
+		if name == "" {
+			name = systemdUnknownName
+		}
+		for _, l := range listeners {
+			fd, err := dupListenerFD(l)
+			if err != nil {
+				return err
+			}
+			fds = append(fds, fd)
+			names = append(names, name)
+		}
+		return nil
+	}
+
+	err = appendFDs(p.ListenersForHandleTLS, tlsName)
+	if err == nil {
+		err = appendFDs(p.Listeners, tcpName)
+	}
+	if err != nil {
+		CloseFDs(fds)
+		return nil, nil, err
+	}
+	return fds, names, nil
+}
+
+func CloseFDs(fds []int) {
+	for _, fd := range fds {
+		_ = syscall.Close(fd)
+	}
+}
+
+func dupListenerFD(l net.Listener) (int, error) {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return 0, xerrors.Errorf("listener %v doesn't support raw access", l.Addr())
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return 0, xerrors.Errorf("get raw listener %v: %w", l.Addr(), err)
+	}
+
+	var fd int
+	var dupErr error
+	err = rawConn.Control(func(originalFD uintptr) {
+		fd, dupErr = syscall.Dup(int(originalFD))
+	})
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		return 0, xerrors.Errorf("dup listener %v: %w", l.Addr(), err)
+	}
+	return fd, nil
+}
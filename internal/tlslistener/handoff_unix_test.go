@@ -0,0 +1,84 @@
+//go:build !windows
+
+package tlslistener
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+const envHandoffTestChild = "LETS_PROXY_TEST_HANDOFF_CHILD"
+
+func TestHandoffListenersToChildProcess(t *testing.T) {
+	if os.Getenv(envHandoffTestChild) != "" {
+		handoffChildProcess(t)
+		return
+	}
+
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	td.CmpNoError(err)
+	addr := tcpListener.Addr().String()
+
+	l := &ListenersHandler{ListenersForHandleTLS: []net.Listener{tcpListener}}
+	td.CmpNoError(l.Start(ctx, nil))
+
+	fds, names, err := l.ListenerFDs("tls", "http")
+	td.CmpNoError(err)
+	td.CmpDeeply(names, []string{"tls"})
+
+	files := []uintptr{0, 1, 2}
+	for _, fd := range fds {
+		files = append(files, uintptr(fd))
+	}
+	pid, err := syscall.ForkExec(os.Args[0], []string{os.Args[0], "-test.run=^TestHandoffListenersToChildProcess$"}, &syscall.ProcAttr{
+		Env:   append(HandoffEnv(os.Environ(), names, os.Getpid()), envHandoffTestChild+"=1"),
+		Files: files,
+	})
+	td.CmpNoError(err)
+	CloseFDs(fds)
+
+	// parent doesn't accept connections after handoff
+	td.CmpNoError(l.StopAccept())
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	td.CmpNoError(err)
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	answer, err := ioutil.ReadAll(conn)
+	td.CmpNoError(err)
+	td.CmpDeeply(string(answer), "child")
+	_ = conn.Close()
+
+	process, err := os.FindProcess(pid)
+	td.CmpNoError(err)
+	state, err := process.Wait()
+	td.CmpNoError(err)
+	td.True(state.Success())
+}
+
+func handoffChildProcess(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	listeners := newSystemdListenersFromEnv(ctx).take("tls", 0)
+	if len(listeners) != 1 {
+		t.Fatalf("expected one inherited listener, got: %v", len(listeners))
+	}
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("child"))
+	_ = conn.Close()
+}
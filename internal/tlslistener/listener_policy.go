@@ -0,0 +1,92 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/tls"
+	"sync/atomic"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/xerrors"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/domain"
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+var (
+	errChallengesDisabled = xerrors.New("acme challenges disabled on the listener")
+	errChallengesOnly     = xerrors.New("listener answer to acme challenges only")
+	errDomainNotAllowed   = xerrors.Errorf("domain doesn't allowed on the listener: %w", domain.ErrDomainDenied)
+)
+
+// getCertificate apply policy of the listener before GetCertificate and serve DomainDeniedCertificate
+// for denied domains
+func (p *ListenersHandler) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if p.DomainDeniedCertificate == nil {
+		return p.getAllowedCertificate(hello)
+	}
+
+	cert, err := p.getAllowedCertificate(hello)
+	if err == nil || !xerrors.Is(err, domain.ErrDomainDenied) {
+		return cert, err
+	}
+
+	ctx := p.helloContext(hello)
+	if denied, ok := ctx.Value(contextlabel.DomainDenied).(*int32); ok {
+		atomic.StoreInt32(denied, 1)
+	}
+	zc.L(ctx).Info("Serve fallback certificate for denied domain", zap.String("server_name", hello.ServerName),
+		zap.NamedError("deny_reason", err))
+	return p.DomainDeniedCertificate, nil
+}
+
+// getAllowedCertificate apply policy of the listener before GetCertificate
+func (p *ListenersHandler) getAllowedCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !p.DisableChallenges && !p.DisableTLSALPNChallenge && !p.ChallengesOnly && p.DomainChecker == nil {
+		return p.GetCertificate(hello)
+	}
+
+	ctx := p.helloContext(hello)
+	logger := zc.L(ctx)
+
+	if p.ChallengesOnly && !isTLSALPNChallenge(hello) {
+		logger.Debug("Reject handshake without tls-alpn-01 challenge", zap.String("server_name", hello.ServerName))
+		return nil, errChallengesOnly
+	}
+
+	if (p.DisableChallenges || p.DisableTLSALPNChallenge) && isTLSALPNChallenge(hello) {
+		logger.Debug("Reject tls-alpn-01 challenge", zap.String("server_name", hello.ServerName))
+		return nil, errChallengesDisabled
+	}
+
+	if p.DomainChecker != nil {
+		needDomain, err := domain.NormalizeDomain(hello.ServerName)
+		if err != nil {
+			// cert manager handle bad domains by self way
+			return p.GetCertificate(hello)
+		}
+		allowed, err := p.DomainChecker.IsDomainAllowed(ctx, needDomain.ASCII())
+		log.DebugInfo(logger, err, "Check domain allowed by listener", domain.LogDomain(needDomain),
+			zap.Bool("allowed", allowed))
+		if err != nil {
+			return nil, xerrors.Errorf("check domain by listener: %w", err)
+		}
+		if !allowed {
+			return nil, errDomainNotAllowed
+		}
+	}
+	return p.GetCertificate(hello)
+}
+
+func (p *ListenersHandler) helloContext(hello *tls.ClientHelloInfo) context.Context {
+	if contextConn, ok := hello.Conn.(interface{ GetContext() context.Context }); ok {
+		return contextConn.GetContext()
+	}
+	return p.ctx
+}
+
+func isTLSALPNChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
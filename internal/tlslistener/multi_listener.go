@@ -0,0 +1,93 @@
+package tlslistener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	zc "github.com/rekby/zapcontext"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// MultiListenersHandler join connections of few started ListenersHandler (with different settings)
+// to one listener for proxy.
+type MultiListenersHandler struct {
+	Handlers []*ListenersHandler
+
+	connections chan net.Conn
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewMultiListenersHandler start accept connections from handlers. Handlers must be started before.
+func NewMultiListenersHandler(ctx context.Context, handlers ...*ListenersHandler) *MultiListenersHandler {
+	res := &MultiListenersHandler{
+		Handlers:    handlers,
+		connections: make(chan net.Conn),
+		closed:      make(chan struct{}),
+	}
+	logger := zc.L(ctx)
+	for _, handler := range handlers {
+		handler := handler
+		go func() {
+			defer log.HandlePanic(logger)
+
+			res.handleConnections(handler)
+		}()
+	}
+	return res
+}
+
+func (m *MultiListenersHandler) handleConnections(handler *ListenersHandler) {
+	for {
+		conn, err := handler.Accept()
+		if err != nil {
+			return
+		}
+		// continue accept after close: handler block on put connection until it closed
+		select {
+		case m.connections <- conn:
+		case <-m.closed:
+			_ = conn.Close()
+		}
+	}
+}
+
+// Implement net.Listener
+func (m *MultiListenersHandler) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.connections:
+		return conn, nil
+	case <-m.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (m *MultiListenersHandler) Close() error {
+	var resErr error
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		for _, handler := range m.Handlers {
+			if err := handler.Close(); err != nil && resErr == nil {
+				resErr = err
+			}
+		}
+	})
+	return resErr
+}
+
+func (m *MultiListenersHandler) Addr() net.Addr {
+	return dummyAddr{}
+}
+
+// GetConnectionContext return context of connection, registered by any of handlers.
+func (m *MultiListenersHandler) GetConnectionContext(remoteAddr, localAddr string) (context.Context, error) {
+	for _, handler := range m.Handlers {
+		if ctx, err := handler.GetConnectionContext(remoteAddr, localAddr); err == nil {
+			return ctx, nil
+		}
+	}
+	return nil, errors.New("not found registered connection")
+}
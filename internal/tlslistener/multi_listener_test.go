@@ -0,0 +1,158 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+	"golang.org/x/crypto/acme"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/domain_checker"
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestMultiListenersHandler(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	mainListener := th.NewLocalTcpListener(e)
+	mainHandler := &ListenersHandler{
+		GetCertificate:        dummyGetCertificate,
+		ListenersForHandleTLS: []net.Listener{mainListener},
+	}
+	e.CmpNoError(mainHandler.Start(ctx, nil))
+
+	internalListener, err := net.Listen("tcp", "127.0.0.1:0")
+	e.CmpNoError(err)
+	internalHandler := &ListenersHandler{
+		GetCertificate:        dummyGetCertificate,
+		ListenersForHandleTLS: []net.Listener{internalListener},
+		Name:                  "internal",
+		DisableChallenges:     true,
+		DomainChecker:         domain_checker.NewRegexp(regexp.MustCompile(`\.internal$`)),
+	}
+	e.CmpNoError(internalHandler.Start(ctx, nil))
+
+	multi := NewMultiListenersHandler(ctx, mainHandler, internalHandler)
+	defer func() { _ = multi.Close() }()
+
+	dial := func(addr, serverName string, protos ...string) (*tls.Conn, error) {
+		return tls.Dial("tcp", addr, &tls.Config{
+			ServerName:         serverName,
+			NextProtos:         protos,
+			InsecureSkipVerify: true, //nolint:gosec
+		})
+	}
+
+	// main listener: without listener restrictions
+	conn, err := dial(mainListener.Addr().String(), "test.ru")
+	e.CmpNoError(err)
+	serverConn, err := multi.Accept()
+	e.CmpNoError(err)
+	connCtx, err := multi.GetConnectionContext(conn.LocalAddr().String(), conn.RemoteAddr().String())
+	e.CmpNoError(err)
+	e.Nil(connCtx.Value(contextlabel.Listener))
+	e.Nil(connCtx.Value(contextlabel.ChallengesDisabled))
+	_ = conn.Close()
+	_ = serverConn.Close()
+
+	// internal listener: allowed domain
+	conn, err = dial(internalListener.Addr().String(), "host.internal")
+	e.CmpNoError(err)
+	serverConn, err = multi.Accept()
+	e.CmpNoError(err)
+	connCtx, err = multi.GetConnectionContext(conn.LocalAddr().String(), conn.RemoteAddr().String())
+	e.CmpNoError(err)
+	e.Cmp(connCtx.Value(contextlabel.Listener), "internal")
+	e.Cmp(connCtx.Value(contextlabel.ChallengesDisabled), true)
+	_ = conn.Close()
+	_ = serverConn.Close()
+
+	_, err = multi.GetConnectionContext("127.0.0.1:1", "127.0.0.1:2")
+	e.CmpError(err)
+
+	// internal listener: denied domain and challenge
+	_, err = dial(internalListener.Addr().String(), "test.ru")
+	e.CmpError(err)
+	_, err = dial(internalListener.Addr().String(), "host.internal", acme.ALPNProto)
+	e.CmpError(err)
+
+	e.CmpNoError(multi.Close())
+	_, err = multi.Accept()
+	e.CmpError(err)
+}
+
+func TestListenersHandlerGetCertificate(t *testing.T) {
+	td := testdeep.NewT(t)
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	called := 0
+	h := &ListenersHandler{ctx: ctx, GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		called++
+		return &tls.Certificate{}, nil
+	}}
+	_, err := h.getCertificate(&tls.ClientHelloInfo{ServerName: "test.ru", SupportedProtos: []string{acme.ALPNProto}})
+	td.CmpNoError(err)
+	td.Cmp(called, 1)
+
+	h.DisableChallenges = true
+	_, err = h.getCertificate(&tls.ClientHelloInfo{ServerName: "test.ru", SupportedProtos: []string{acme.ALPNProto}})
+	td.Cmp(err, errChallengesDisabled)
+	_, err = h.getCertificate(&tls.ClientHelloInfo{ServerName: "test.ru", SupportedProtos: []string{"h2", acme.ALPNProto}})
+	td.CmpNoError(err)
+	td.Cmp(called, 2)
+
+	h.DomainChecker = domain_checker.False{}
+	_, err = h.getCertificate(&tls.ClientHelloInfo{ServerName: "test.ru"})
+	td.Cmp(err, errDomainNotAllowed)
+	td.Cmp(called, 2)
+}
+
+func TestListenersHandlerDisableTLSALPNChallenge(t *testing.T) {
+	td := testdeep.NewT(t)
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	called := 0
+	h := &ListenersHandler{ctx: ctx, DisableTLSALPNChallenge: true, GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		called++
+		return &tls.Certificate{}, nil
+	}}
+	_, err := h.getCertificate(&tls.ClientHelloInfo{ServerName: "test.ru", SupportedProtos: []string{acme.ALPNProto}})
+	td.Cmp(err, errChallengesDisabled)
+	_, err = h.getCertificate(&tls.ClientHelloInfo{ServerName: "test.ru", SupportedProtos: []string{"h2"}})
+	td.CmpNoError(err)
+	td.Cmp(called, 1)
+
+	h.init()
+	td.Cmp(h.tlsConfig.NextProtos, []string{"h2", "http/1.1"})
+
+	h = &ListenersHandler{}
+	h.init()
+	td.Cmp(h.tlsConfig.NextProtos, []string{"h2", "http/1.1", acme.ALPNProto})
+}
+
+func TestListenersHandlerGetCertificateChallengesOnly(t *testing.T) {
+	td := testdeep.NewT(t)
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	called := 0
+	h := &ListenersHandler{ctx: ctx, ChallengesOnly: true, GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		called++
+		return &tls.Certificate{}, nil
+	}}
+	_, err := h.getCertificate(&tls.ClientHelloInfo{ServerName: "test.ru", SupportedProtos: []string{acme.ALPNProto}})
+	td.CmpNoError(err)
+	td.Cmp(called, 1)
+
+	_, err = h.getCertificate(&tls.ClientHelloInfo{ServerName: "test.ru", SupportedProtos: []string{"h2", acme.ALPNProto}})
+	td.Cmp(err, errChallengesOnly)
+	_, err = h.getCertificate(&tls.ClientHelloInfo{ServerName: "test.ru"})
+	td.Cmp(err, errChallengesOnly)
+	td.Cmp(called, 1)
+}
@@ -0,0 +1,141 @@
+package tlslistener
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+	"go.uber.org/zap"
+	"golang.org/x/xerrors"
+)
+
+// sessionTicketKeysKeep - count of previous keys, which accept for decrypt tickets after rotation.
+// Tickets, issued before rotation, resume sessions during sessionTicketKeysKeep rotation periods.
+const sessionTicketKeysKeep = 2
+
+const sessionTicketKeySize = 32
+
+// ReadSessionTicketKeysFile read session ticket keys from file: one base64 encoded 32 bytes key per line.
+// First key used for encrypt new tickets, all keys used for decrypt.
+// Empty lines and lines started with # ignored.
+func ReadSessionTicketKeysFile(fileName string) ([][sessionTicketKeySize]byte, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, xerrors.Errorf("read session ticket keys file: %w", err)
+	}
+	return parseSessionTicketKeys(content)
+}
+
+func parseSessionTicketKeys(content []byte) ([][sessionTicketKeySize]byte, error) {
+	var res [][sessionTicketKeySize]byte
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keyBytes, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, xerrors.Errorf("decode session ticket key on line %v: %w", lineNum, err)
+		}
+		if len(keyBytes) != sessionTicketKeySize {
+			return nil, xerrors.Errorf("session ticket key on line %v has length %v bytes, need %v",
+				lineNum, len(keyBytes), sessionTicketKeySize)
+		}
+
+		var key [sessionTicketKeySize]byte
+		copy(key[:], keyBytes)
+		res = append(res, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("read session ticket keys: %w", err)
+	}
+	if len(res) == 0 {
+		return nil, xerrors.New("no session ticket keys")
+	}
+	return res, nil
+}
+
+// ReloadSessionTicketKeys re-read SessionTicketKeysFile and replace session ticket keys.
+// Do nothing if the file not set.
+func (p *ListenersHandler) ReloadSessionTicketKeys() error {
+	if p.SessionTicketKeysFile == "" || p.SessionTicketsDisabled {
+		return nil
+	}
+
+	keys, err := ReadSessionTicketKeysFile(p.SessionTicketKeysFile)
+	if err != nil {
+		return err
+	}
+	p.tlsConfig.SetSessionTicketKeys(keys)
+	p.logger.Info("Session ticket keys reloaded", zap.Int("keys_count", len(keys)))
+	return nil
+}
+
+func (p *ListenersHandler) initSessionTickets() error {
+	switch {
+	case p.SessionTicketsDisabled:
+		p.logger.Info("TLS session tickets disabled")
+	case len(p.SessionTicketKeys) > 0:
+		p.tlsConfig.SetSessionTicketKeys(p.SessionTicketKeys)
+		p.logger.Info("Use static session ticket keys", zap.Int("keys_count", len(p.SessionTicketKeys)))
+	case p.SessionTicketKeyRotation > 0:
+		keys, err := rotateSessionTicketKeys(nil)
+		if err != nil {
+			return err
+		}
+		p.tlsConfig.SetSessionTicketKeys(keys)
+		// handlepanic: in rotateSessionTicketKeysLoop
+		go p.rotateSessionTicketKeysLoop(keys)
+		p.logger.Info("Rotate session ticket keys", zap.Duration("period", p.SessionTicketKeyRotation))
+	}
+	return nil
+}
+
+func (p *ListenersHandler) rotateSessionTicketKeysLoop(keys [][sessionTicketKeySize]byte) {
+	defer log.HandlePanic(p.logger)
+
+	ticker := time.NewTicker(p.SessionTicketKeyRotation)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		newKeys, err := rotateSessionTicketKeys(keys)
+		log.DebugError(p.logger, err, "Rotate session ticket keys")
+		if err != nil {
+			continue
+		}
+		keys = newKeys
+		p.tlsConfig.SetSessionTicketKeys(keys)
+	}
+}
+
+// rotateSessionTicketKeys return new random key with sessionTicketKeysKeep last keys from previous list
+func rotateSessionTicketKeys(keys [][sessionTicketKeySize]byte) ([][sessionTicketKeySize]byte, error) {
+	var newKey [sessionTicketKeySize]byte
+	if _, err := rand.Read(newKey[:]); err != nil {
+		return nil, xerrors.Errorf("generate session ticket key: %w", err)
+	}
+
+	if len(keys) > sessionTicketKeysKeep {
+		keys = keys[:sessionTicketKeysKeep]
+	}
+	res := make([][sessionTicketKeySize]byte, 0, len(keys)+1)
+	res = append(res, newKey)
+	res = append(res, keys...)
+	return res, nil
+}
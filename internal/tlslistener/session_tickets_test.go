@@ -0,0 +1,183 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestParseSessionTicketKeys(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	key1 := [32]byte{1, 2, 3}
+	key2 := [32]byte{4, 5, 6}
+	content := strings.Join([]string{
+		"# current key",
+		base64.StdEncoding.EncodeToString(key1[:]),
+		"",
+		"  " + base64.StdEncoding.EncodeToString(key2[:]) + "  ",
+	}, "\n")
+
+	keys, err := parseSessionTicketKeys([]byte(content))
+	td.CmpNoError(err)
+	td.Cmp(keys, [][32]byte{key1, key2})
+
+	_, err = parseSessionTicketKeys([]byte("# only comment\n"))
+	td.CmpError(err)
+
+	_, err = parseSessionTicketKeys([]byte("not base64"))
+	td.CmpError(err)
+
+	_, err = parseSessionTicketKeys([]byte(base64.StdEncoding.EncodeToString([]byte("short"))))
+	td.CmpError(err)
+}
+
+func TestRotateSessionTicketKeys(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	keys, err := rotateSessionTicketKeys(nil)
+	td.CmpNoError(err)
+	td.Cmp(keys, testdeep.Len(1))
+
+	for i := 0; i < 5; i++ {
+		prev := keys
+		keys, err = rotateSessionTicketKeys(keys)
+		td.CmpNoError(err)
+		td.Cmp(keys, testdeep.Len(testdeep.Lte(sessionTicketKeysKeep+1)))
+		td.Cmp(keys[1], prev[0])
+		td.Not(keys[0], prev[0])
+	}
+}
+
+func TestConfigApplySessionTickets(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	key := [32]byte{1}
+	keysFile := filepath.Join(th.TmpDir(e), "keys")
+	e.CmpNoError(os.WriteFile(keysFile, []byte(base64.StdEncoding.EncodeToString(key[:])), 0600))
+
+	var l ListenersHandler
+	e.CmpNoError(Config{SessionTicketKeysFile: keysFile}.applySessionTickets(ctx, &l))
+	e.Cmp(l.SessionTicketKeys, [][32]byte{key})
+	e.Cmp(l.SessionTicketKeysFile, keysFile)
+
+	l = ListenersHandler{}
+	e.CmpNoError(Config{SessionTicketKeyRotationMinutes: 10}.applySessionTickets(ctx, &l))
+	e.Cmp(l.SessionTicketKeyRotation.Minutes(), float64(10))
+
+	l = ListenersHandler{}
+	e.CmpNoError(Config{DisableSessionTickets: true}.applySessionTickets(ctx, &l))
+	e.True(l.SessionTicketsDisabled)
+
+	e.CmpError(Config{SessionTicketKeysFile: keysFile, SessionTicketKeyRotationMinutes: 10}.applySessionTickets(ctx, &l))
+	e.CmpError(Config{SessionTicketKeyRotationMinutes: -1}.applySessionTickets(ctx, &l))
+	e.CmpError(Config{SessionTicketKeysFile: filepath.Join(th.TmpDir(e), "not-exist")}.applySessionTickets(ctx, &l))
+}
+
+func TestSessionResumption(t *testing.T) {
+	e, ctx, flush := th.NewEnv(t)
+	defer flush()
+
+	sharedKeys := [][32]byte{{1, 2, 3}}
+
+	startHandler := func(h *ListenersHandler) string {
+		listener := th.NewLocalTcpListener(e)
+		h.GetCertificate = dummyGetCertificate
+		h.ListenersForHandleTLS = []net.Listener{listener}
+		h.connectionHandleStart = func() {}
+		h.connectionHandleFinish = func(err error) {}
+		e.CmpNoError(h.Start(ctx, nil))
+
+		go func() {
+			for {
+				conn, err := h.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					_, _ = conn.Write([]byte("OK"))
+					_ = conn.Close()
+				}()
+			}
+		}()
+		return listener.Addr().String()
+	}
+
+	// connect return true if session resumed
+	connect := func(addr string, sessionCache tls.ClientSessionCache) bool {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			ServerName:         "test.ru",
+			ClientSessionCache: sessionCache,
+			InsecureSkipVerify: true, //nolint:gosec
+		})
+		e.CmpNoError(err)
+		defer func() { _ = conn.Close() }()
+
+		// read for receive session ticket, it send after handshake in tls 1.3
+		_, err = io.ReadAll(conn)
+		e.CmpNoError(err)
+		return conn.ConnectionState().DidResume
+	}
+
+	t.Run("SharedKeys", func(t *testing.T) {
+		td := testdeep.NewT(t)
+
+		h1 := &ListenersHandler{SessionTicketKeys: sharedKeys}
+		h2 := &ListenersHandler{SessionTicketKeys: sharedKeys}
+		addr1, addr2 := startHandler(h1), startHandler(h2)
+		defer func() {
+			_ = h1.Close()
+			_ = h2.Close()
+		}()
+
+		sessionCache := tls.NewLRUClientSessionCache(1)
+		td.False(connect(addr1, sessionCache))
+		// client cache sessions by server name - session from first server resumed by second
+		td.True(connect(addr2, sessionCache))
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		td := testdeep.NewT(t)
+
+		h := &ListenersHandler{SessionTicketKeyRotation: time.Hour}
+		addr := startHandler(h)
+		defer func() { _ = h.Close() }()
+
+		sessionCache := tls.NewLRUClientSessionCache(1)
+		td.False(connect(addr, sessionCache))
+
+		keys, err := rotateSessionTicketKeys([][32]byte{})
+		td.CmpNoError(err)
+		h.tlsConfig.SetSessionTicketKeys(keys)
+		td.False(connect(addr, sessionCache), "ticket key unknown")
+
+		// previous key kept after rotation
+		keys, err = rotateSessionTicketKeys(keys)
+		td.CmpNoError(err)
+		h.tlsConfig.SetSessionTicketKeys(keys)
+		td.True(connect(addr, sessionCache))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		td := testdeep.NewT(t)
+
+		h := &ListenersHandler{SessionTicketsDisabled: true}
+		addr := startHandler(h)
+		defer func() { _ = h.Close() }()
+
+		sessionCache := tls.NewLRUClientSessionCache(1)
+		td.False(connect(addr, sessionCache))
+		td.False(connect(addr, sessionCache))
+	})
+}
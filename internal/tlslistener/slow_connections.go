@@ -0,0 +1,171 @@
+package tlslistener
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/log"
+)
+
+// SlowConnections detect connections with average throughput (read and write, include tls overhead)
+// below MinBytesPerSecond during GracePeriod. Connections checked every GracePeriod.
+type SlowConnections struct {
+	MinBytesPerSecond int64
+	GracePeriod       time.Duration
+
+	// Close - close slow connections, else log it only.
+	Close bool
+
+	detected int64
+	closed   int64
+
+	mu    sync.Mutex
+	conns map[*slowDetectConn]struct{}
+}
+
+// InitMetrics register counters of slow connections
+func (s *SlowConnections) InitMetrics(r prometheus.Registerer) {
+	if r == nil || reflect.ValueOf(r).IsNil() {
+		return
+	}
+
+	r.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "slow_connections_detected", Help: "Count of detected slow connections",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&s.detected))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "slow_connections_closed", Help: "Count of slow connections, closed by detector",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&s.closed))
+		}),
+	)
+}
+
+// watch check connections until ctx done
+func (s *SlowConnections) watch(ctx context.Context) {
+	defer log.HandlePanic(zc.L(ctx))
+
+	ticker := time.NewTicker(s.GracePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.check(now)
+		}
+	}
+}
+
+func (s *SlowConnections) check(now time.Time) {
+	s.mu.Lock()
+	conns := make([]*slowDetectConn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		if !conn.isSlow(now, s.GracePeriod, s.MinBytesPerSecond) {
+			continue
+		}
+
+		atomic.AddInt64(&s.detected, 1)
+		if !s.Close {
+			// report once
+			conn.logger.Warn("Slow connection detected", zap.Int64("min_bytes_per_second", s.MinBytesPerSecond))
+			s.untrack(conn)
+			continue
+		}
+		conn.logger.Warn("Close slow connection", zap.Int64("min_bytes_per_second", s.MinBytesPerSecond))
+		atomic.AddInt64(&s.closed, 1)
+		_ = conn.Close()
+	}
+}
+
+// track return connection, which count transferred bytes, until it closed
+func (s *SlowConnections) track(conn net.Conn, logger *zap.Logger, now time.Time) *slowDetectConn {
+	res := &slowDetectConn{Conn: conn, owner: s, logger: logger, lastCheck: now}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[*slowDetectConn]struct{})
+	}
+	s.conns[res] = struct{}{}
+	return res
+}
+
+func (s *SlowConnections) untrack(conn *slowDetectConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+type slowDetectConn struct {
+	net.Conn
+	owner  *SlowConnections
+	logger *zap.Logger
+
+	transferred int64
+	exempted    int32
+
+	// used by SlowConnections.check only
+	lastCheck       time.Time
+	lastTransferred int64
+
+	closeOnce sync.Once
+}
+
+func (c *slowDetectConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.transferred, int64(n))
+	return n, err
+}
+
+func (c *slowDetectConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.transferred, int64(n))
+	return n, err
+}
+
+func (c *slowDetectConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.owner.untrack(c)
+	})
+	return c.Conn.Close()
+}
+
+// exempt connection from detection, for example for idle websockets
+func (c *slowDetectConn) exempt() {
+	if atomic.CompareAndSwapInt32(&c.exempted, 0, 1) {
+		c.logger.Debug("Connection exempted from slow connections detection")
+		c.owner.untrack(c)
+	}
+}
+
+// isSlow check average throughput since previous check, if grace period passed since it
+func (c *slowDetectConn) isSlow(now time.Time, gracePeriod time.Duration, minBytesPerSecond int64) bool {
+	elapsed := now.Sub(c.lastCheck)
+	if elapsed < gracePeriod || atomic.LoadInt32(&c.exempted) != 0 {
+		return false
+	}
+
+	transferred := atomic.LoadInt64(&c.transferred)
+	bytesPerSecond := float64(transferred-c.lastTransferred) / elapsed.Seconds()
+	c.lastCheck, c.lastTransferred = now, transferred
+	return bytesPerSecond < float64(minBytesPerSecond)
+}
@@ -0,0 +1,84 @@
+package tlslistener
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxatome/go-testdeep"
+	"go.uber.org/zap"
+
+	"github.com/rekby/lets-proxy2/internal/contextlabel"
+)
+
+func TestSlowConnections(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	newConn := func(s *SlowConnections, start time.Time) (*slowDetectConn, net.Conn) {
+		server, client := net.Pipe()
+		t.Cleanup(func() { _ = server.Close(); _ = client.Close() })
+		go func() { _, _ = io.Copy(io.Discard, client) }()
+		return s.track(server, zap.NewNop(), start), client
+	}
+
+	start := time.Now()
+	s := &SlowConnections{MinBytesPerSecond: 10, GracePeriod: 10 * time.Second}
+	slow, _ := newConn(s, start)
+	fast, _ := newConn(s, start)
+	exempted, _ := newConn(s, start)
+	exempted.exempt()
+	_, err := fast.Write(make([]byte, 1000))
+	td.CmpNoError(err)
+
+	// grace period doesn't passed
+	s.check(start.Add(5 * time.Second))
+	td.Cmp(atomic.LoadInt64(&s.detected), int64(0))
+
+	s.check(start.Add(10 * time.Second))
+	td.Cmp(atomic.LoadInt64(&s.detected), int64(1))
+	td.Cmp(atomic.LoadInt64(&s.closed), int64(0))
+	td.Cmp(len(s.conns), 1) // slow connection reported once
+
+	// throughput measured since previous check
+	s.check(start.Add(20 * time.Second))
+	td.Cmp(atomic.LoadInt64(&s.detected), int64(2))
+	td.Cmp(len(s.conns), 0)
+
+	s = &SlowConnections{MinBytesPerSecond: 10, GracePeriod: 10 * time.Second, Close: true}
+	slow, _ = newConn(s, start)
+	s.check(start.Add(10 * time.Second))
+	td.Cmp(atomic.LoadInt64(&s.detected), int64(1))
+	td.Cmp(atomic.LoadInt64(&s.closed), int64(1))
+	td.Cmp(len(s.conns), 0)
+	_, err = slow.Write([]byte{1})
+	td.CmpError(err)
+}
+
+func TestListenersHandler_SlowConnectionExempt(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	l := &ListenersHandler{SlowConnections: &SlowConnections{}, logger: zap.NewNop()}
+	l.init()
+	l.initMetrics(nil)
+
+	server, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+
+	conn := l.registerConnection(server, true)
+	td.Cmp(len(l.SlowConnections.conns), 1)
+
+	exempt, ok := conn.Context.Value(contextlabel.SlowConnectionExempt).(func())
+	td.True(ok)
+	exempt()
+	td.Cmp(len(l.SlowConnections.conns), 0)
+	td.CmpNoError(conn.Close())
+
+	l.SlowConnections = nil
+	server, client2 := net.Pipe()
+	defer func() { _ = client2.Close() }()
+	conn = l.registerConnection(server, true)
+	td.Nil(conn.Context.Value(contextlabel.SlowConnectionExempt))
+	_ = conn.Close()
+}
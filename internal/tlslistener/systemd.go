@@ -0,0 +1,191 @@
+package tlslistener
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	zc "github.com/rekby/zapcontext"
+	"go.uber.org/zap"
+)
+
+// https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+const (
+	systemdListenFdsStart = 3
+	systemdUnknownName    = "unknown"
+
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+)
+
+var (
+	systemdOnce      sync.Once
+	systemdActivated *systemdListeners
+)
+
+type systemdListener struct {
+	name     string
+	listener net.Listener
+	used     bool
+}
+
+// systemdListeners hold listeners, received from systemd by socket activation protocol
+type systemdListeners struct {
+	mu        sync.Mutex
+	listeners []systemdListener
+
+	// configured - listener names from config, listeners with other names used by position as unnamed
+	configured map[string]bool
+}
+
+// getSystemdListeners read socket activation environment once per process.
+// It return empty listeners set if process not socket-activated.
+func getSystemdListeners(ctx context.Context) *systemdListeners {
+	systemdOnce.Do(func() {
+		systemdActivated = newSystemdListenersFromEnv(ctx)
+	})
+	return systemdActivated
+}
+
+// ConfigureSystemdNames register names of socket activated listeners from all config sections.
+// It must be called before apply first listener config, else listeners named for later sections
+// can be taken by position as unnamed.
+func ConfigureSystemdNames(ctx context.Context, names ...string) {
+	getSystemdListeners(ctx).configure(names...)
+}
+
+// TakeSystemdListeners return unused socket activated listeners with the name.
+// Unlike listeners config it doesn't take unnamed listeners if no listeners with the name.
+func TakeSystemdListeners(ctx context.Context, name string) []net.Listener {
+	return getSystemdListeners(ctx).takeNamed(name)
+}
+
+func newSystemdListenersFromEnv(ctx context.Context) *systemdListeners {
+	logger := zc.L(ctx)
+	res := &systemdListeners{}
+
+	pid, err := strconv.Atoi(os.Getenv(envListenPID))
+	handoffPID, handoffErr := strconv.Atoi(os.Getenv(EnvHandoffPID))
+	switch {
+	case err == nil && pid == os.Getpid():
+		logger.Info("Process socket activated")
+	case handoffErr == nil && handoffPID == os.Getppid():
+		logger.Info("Receive listeners from parent process", zap.Int("parent_pid", handoffPID))
+	default:
+		logger.Debug("Process doesn't socket activated", zap.Int("listen_pid", pid), zap.Int("handoff_pid", handoffPID))
+		return res
+	}
+
+	count, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil || count <= 0 {
+		logger.Warn("Bad socket activation fd count", zap.String("listen_fds", os.Getenv(envListenFDs)), zap.Error(err))
+		return res
+	}
+	names := parseSystemdNames(os.Getenv(envListenFDNames), count)
+
+	// prevent inherit by child processes
+	_ = os.Unsetenv(envListenPID)
+	_ = os.Unsetenv(envListenFDs)
+	_ = os.Unsetenv(envListenFDNames)
+	_ = os.Unsetenv(EnvHandoffPID)
+
+	for i := 0; i < count; i++ {
+		fd := systemdListenFdsStart + i
+		f := os.NewFile(uintptr(fd), names[i])
+		listener, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			logger.Error("Can't use socket activated fd as listener", zap.Int("fd", fd),
+				zap.String("name", names[i]), zap.Error(err))
+			continue
+		}
+		logger.Info("Receive socket activated listener", zap.Int("fd", fd), zap.String("name", names[i]),
+			zap.Stringer("address", listener.Addr()))
+		res.listeners = append(res.listeners, systemdListener{name: names[i], listener: listener})
+	}
+	return res
+}
+
+func parseSystemdNames(namesString string, count int) []string {
+	names := make([]string, count)
+	var parts []string
+	if namesString != "" {
+		parts = strings.Split(namesString, ":")
+	}
+	for i := range names {
+		if i < len(parts) && parts[i] != "" {
+			names[i] = parts[i]
+		} else {
+			names[i] = systemdUnknownName
+		}
+	}
+	return names
+}
+
+// configure register listener names from config.
+// Systemd names fd by unit name if FileDescriptorName not set, so listeners with names
+// not registered here treat as unnamed.
+func (s *systemdListeners) configure(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.configured == nil {
+		s.configured = make(map[string]bool)
+	}
+	for _, name := range names {
+		if name != "" && name != systemdUnknownName {
+			s.configured[name] = true
+		}
+	}
+}
+
+// take return all unused listeners with the name.
+// If no listeners with the name - return up to count unused unnamed listeners in order of receive.
+// Listeners with names, not registered by configure, are unnamed.
+func (s *systemdListeners) take(name string, count int) []net.Listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := s.takeNamedLocked(name)
+	if len(res) > 0 {
+		return res
+	}
+
+	for i := range s.listeners {
+		if len(res) >= count {
+			break
+		}
+		if !s.listeners[i].used && !s.configured[s.listeners[i].name] {
+			s.listeners[i].used = true
+			res = append(res, s.listeners[i].listener)
+		}
+	}
+	return res
+}
+
+// takeNamed return all unused listeners with the name, without unnamed listeners.
+func (s *systemdListeners) takeNamed(name string) []net.Listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.takeNamedLocked(name)
+}
+
+func (s *systemdListeners) takeNamedLocked(name string) []net.Listener {
+	if name == "" || name == systemdUnknownName {
+		return nil
+	}
+
+	var res []net.Listener
+	for i := range s.listeners {
+		if !s.listeners[i].used && s.listeners[i].name == name {
+			s.listeners[i].used = true
+			res = append(res, s.listeners[i].listener)
+		}
+	}
+	return res
+}
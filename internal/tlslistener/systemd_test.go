@@ -0,0 +1,89 @@
+package tlslistener
+
+import (
+	"net"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+)
+
+func TestParseSystemdNames(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	td.CmpDeeply(parseSystemdNames("", 2), []string{"unknown", "unknown"})
+	td.CmpDeeply(parseSystemdNames("tls:http", 2), []string{"tls", "http"})
+	td.CmpDeeply(parseSystemdNames("tls::http", 3), []string{"tls", "unknown", "http"})
+	td.CmpDeeply(parseSystemdNames("tls", 2), []string{"tls", "unknown"})
+}
+
+func TestSystemdListenersTake(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	listeners := make([]net.Listener, 5)
+	for i := range listeners {
+		listeners[i] = testNamedListener{id: i}
+	}
+
+	s := &systemdListeners{listeners: []systemdListener{
+		{name: "unknown", listener: listeners[0]},
+		{name: "tls", listener: listeners[1]},
+		{name: "unknown", listener: listeners[2]},
+		{name: "tls", listener: listeners[3]},
+		{name: "unknown", listener: listeners[4]},
+	}}
+
+	td.CmpDeeply(s.take("tls", 1), []net.Listener{listeners[1], listeners[3]})
+	td.CmpDeeply(s.take("tls", 1), []net.Listener{listeners[0]})
+	td.CmpDeeply(s.take("http", 0), []net.Listener(nil))
+	td.CmpDeeply(s.take("", 5), []net.Listener{listeners[2], listeners[4]})
+	td.CmpDeeply(s.take("", 5), []net.Listener(nil))
+}
+
+func TestSystemdListenersTakeUnitName(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	listeners := make([]net.Listener, 3)
+	for i := range listeners {
+		listeners[i] = testNamedListener{id: i}
+	}
+
+	// systemd name sockets by unit name if FileDescriptorName doesn't set
+	names := parseSystemdNames("lets-proxy.socket:lets-proxy.socket:metrics-tls", len(listeners))
+	s := &systemdListeners{}
+	for i, name := range names {
+		s.listeners = append(s.listeners, systemdListener{name: name, listener: listeners[i]})
+	}
+	s.configure("tls", "http", "metrics-tls", "")
+
+	td.CmpDeeply(s.take("tls", 1), []net.Listener{listeners[0]})
+	td.CmpDeeply(s.take("http", 1), []net.Listener{listeners[1]})
+	td.CmpDeeply(s.take("", 1), []net.Listener(nil))
+	td.CmpDeeply(s.take("metrics-tls", 1), []net.Listener{listeners[2]})
+}
+
+func TestSystemdListenersTakeNamed(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	listeners := make([]net.Listener, 3)
+	for i := range listeners {
+		listeners[i] = testNamedListener{id: i}
+	}
+
+	s := &systemdListeners{listeners: []systemdListener{
+		{name: "unknown", listener: listeners[0]},
+		{name: "challenges", listener: listeners[1]},
+		{name: "challenges", listener: listeners[2]},
+	}}
+
+	td.CmpDeeply(s.takeNamed("http"), []net.Listener(nil))
+	td.CmpDeeply(s.takeNamed(""), []net.Listener(nil))
+	td.CmpDeeply(s.takeNamed("unknown"), []net.Listener(nil))
+	td.CmpDeeply(s.takeNamed("challenges"), []net.Listener{listeners[1], listeners[2]})
+	td.CmpDeeply(s.takeNamed("challenges"), []net.Listener(nil))
+	td.CmpDeeply(s.take("", 1), []net.Listener{listeners[0]})
+}
+
+type testNamedListener struct {
+	net.Listener
+	id int
+}
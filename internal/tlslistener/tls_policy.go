@@ -0,0 +1,142 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// TLSPolicy - tls settings for connections with server name (SNI) of the policy, override settings of the listener.
+type TLSPolicy struct {
+	// Domains - exact domain names and wildcard names (*.example.com, match one level subdomains only).
+	Domains []string
+
+	MinVersion uint16
+
+	// MaxVersion - 0 mean max version, supported by go tls library.
+	MaxVersion uint16
+
+	// CipherSuites - for tls 1.0-1.2, nil - default suites of go tls library.
+	CipherSuites []uint16
+}
+
+// TLSPolicyConfig - config of TLSPolicy, versions same as MinTLSVersion of listener.
+type TLSPolicyConfig struct {
+	Domains       []string
+	MinTLSVersion string
+	MaxTLSVersion string
+	CipherSuites  []string
+}
+
+// tlsPolicies select policy by server name
+type tlsPolicies map[string]*TLSPolicy
+
+func newTLSPolicies(policies []TLSPolicy) (tlsPolicies, error) {
+	res := make(tlsPolicies)
+	for i := range policies {
+		policy := &policies[i]
+		if len(policy.Domains) == 0 {
+			return nil, xerrors.Errorf("tls policy %v has no domains", i)
+		}
+		for _, name := range policy.Domains {
+			name = normalizePolicyDomain(name)
+			if _, exist := res[name]; exist {
+				return nil, xerrors.Errorf("domain %q contained in several tls policies", name)
+			}
+			res[name] = policy
+		}
+	}
+	return res, nil
+}
+
+// find return policy for server name: exact match, wildcard or nil
+func (p tlsPolicies) find(serverName string) *TLSPolicy {
+	serverName = normalizePolicyDomain(serverName)
+	if policy, ok := p[serverName]; ok {
+		return policy
+	}
+	if index := strings.Index(serverName, "."); index > 0 {
+		return p["*"+serverName[index:]]
+	}
+	return nil
+}
+
+func normalizePolicyDomain(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// getConfigForClient return tls config with overrides of policy for server name of hello.
+// nil - use listener config.
+func (p *ListenersHandler) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	policy := p.tlsPolicies.find(hello.ServerName)
+	if policy == nil {
+		return nil, nil
+	}
+
+	// clone for every handshake: it copies current session ticket keys of the listener
+	res := p.tlsConfig.Clone()
+	res.GetConfigForClient = nil
+	res.MinVersion = policy.MinVersion
+	res.MaxVersion = policy.MaxVersion
+	res.CipherSuites = policy.CipherSuites
+	return res, nil
+}
+
+// parseTLSPolicy validate config and return policy. Empty MinTLSVersion - min version of listener.
+func parseTLSPolicy(config TLSPolicyConfig, listenerMinVersion uint16) (TLSPolicy, error) {
+	res := TLSPolicy{Domains: config.Domains, MinVersion: listenerMinVersion}
+
+	var err error
+	if config.MinTLSVersion != "" {
+		if res.MinVersion, err = ParseTLSVersion(config.MinTLSVersion); err != nil {
+			return TLSPolicy{}, xerrors.Errorf("min tls version of policy: %w", err)
+		}
+	}
+	if config.MaxTLSVersion != "" {
+		if res.MaxVersion, err = ParseTLSVersion(config.MaxTLSVersion); err != nil {
+			return TLSPolicy{}, xerrors.Errorf("max tls version of policy: %w", err)
+		}
+		if res.MaxVersion < res.MinVersion {
+			return TLSPolicy{}, xerrors.Errorf("max tls version %q less then min tls version", config.MaxTLSVersion)
+		}
+	}
+
+	if len(config.CipherSuites) == 0 {
+		return res, nil
+	}
+	if res.MinVersion >= tls.VersionTLS13 {
+		return TLSPolicy{}, xerrors.New("cipher suites of tls 1.3 can't be configured, policy allow tls 1.3 only")
+	}
+	for _, name := range config.CipherSuites {
+		suite := findCipherSuite(name)
+		if suite == nil {
+			return TLSPolicy{}, xerrors.Errorf("unknown cipher suite: %q", name)
+		}
+		if !supportVersionsBelowTLS13(suite) {
+			return TLSPolicy{}, xerrors.Errorf("cipher suite %q is for tls 1.3, it can't be configured", name)
+		}
+		res.CipherSuites = append(res.CipherSuites, suite.ID)
+	}
+	return res, nil
+}
+
+func findCipherSuite(name string) *tls.CipherSuite {
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if suite.Name == name {
+				return suite
+			}
+		}
+	}
+	return nil
+}
+
+func supportVersionsBelowTLS13(suite *tls.CipherSuite) bool {
+	for _, version := range suite.SupportedVersions {
+		if version < tls.VersionTLS13 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/maxatome/go-testdeep"
+
+	"github.com/rekby/lets-proxy2/internal/th"
+)
+
+func TestParseTLSPolicy(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	policy, err := parseTLSPolicy(TLSPolicyConfig{Domains: []string{"a.ru"}}, tls.VersionTLS12)
+	td.CmpNoError(err)
+	td.Cmp(policy, TLSPolicy{Domains: []string{"a.ru"}, MinVersion: tls.VersionTLS12})
+
+	policy, err = parseTLSPolicy(TLSPolicyConfig{
+		Domains:       []string{"a.ru"},
+		MinTLSVersion: "1.0",
+		MaxTLSVersion: "1.2",
+		CipherSuites:  []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_AES_128_CBC_SHA"},
+	}, tls.VersionTLS12)
+	td.CmpNoError(err)
+	td.Cmp(policy, TLSPolicy{
+		Domains:      []string{"a.ru"},
+		MinVersion:   tls.VersionTLS10,
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_CBC_SHA},
+	})
+
+	for _, config := range []TLSPolicyConfig{
+		{Domains: []string{"a.ru"}, MinTLSVersion: "bad"},
+		{Domains: []string{"a.ru"}, MaxTLSVersion: "bad"},
+		{Domains: []string{"a.ru"}, MinTLSVersion: "1.3", MaxTLSVersion: "1.2"},
+		{Domains: []string{"a.ru"}, CipherSuites: []string{"bad"}},
+		{Domains: []string{"a.ru"}, CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		{Domains: []string{"a.ru"}, MinTLSVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+	} {
+		_, err = parseTLSPolicy(config, tls.VersionTLS12)
+		td.CmpError(err, config)
+	}
+}
+
+func TestConfig_ApplyTLSPolicies(t *testing.T) {
+	ctx, flush := th.TestContext(t)
+	defer flush()
+
+	td := testdeep.NewT(t)
+
+	l := &ListenersHandler{}
+	td.CmpNoError(Config{MinTLSVersion: "1.2", TLSPolicies: []TLSPolicyConfig{
+		{Domains: []string{"a.ru", "*.a.ru"}, MaxTLSVersion: "1.2"},
+		{Domains: []string{"b.ru"}, MinTLSVersion: "1.3"},
+	}}.Apply(ctx, l))
+	td.Cmp(l.TLSPolicies, []TLSPolicy{
+		{Domains: []string{"a.ru", "*.a.ru"}, MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS12},
+		{Domains: []string{"b.ru"}, MinVersion: tls.VersionTLS13},
+	})
+
+	td.CmpError(Config{TLSPolicies: []TLSPolicyConfig{{}}}.Apply(ctx, &ListenersHandler{}))
+	td.CmpError(Config{TLSPolicies: []TLSPolicyConfig{
+		{Domains: []string{"a.ru"}},
+		{Domains: []string{"A.ru."}},
+	}}.Apply(ctx, &ListenersHandler{}))
+	td.CmpError(Config{TLSPolicies: []TLSPolicyConfig{{Domains: []string{"a.ru"}, MinTLSVersion: "bad"}}}.Apply(ctx, &ListenersHandler{}))
+}
+
+func TestListenersHandler_TLSPolicies(t *testing.T) {
+	td := testdeep.NewT(t)
+
+	l := &ListenersHandler{
+		GetCertificate: dummyGetCertificate,
+		MinTLSVersion:  tls.VersionTLS12,
+		TLSPolicies: []TLSPolicy{
+			{
+				Domains:      []string{"legacy.ru", "*.legacy.ru"},
+				MinVersion:   tls.VersionTLS12,
+				MaxVersion:   tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+			},
+			{Domains: []string{"modern.ru"}, MinVersion: tls.VersionTLS13},
+		},
+	}
+	var err error
+	l.tlsPolicies, err = newTLSPolicies(l.TLSPolicies)
+	td.CmpNoError(err)
+	l.init()
+
+	handshake := func(serverName string, maxVersion uint16) (tls.ConnectionState, error) {
+		serverConn, clientConn := net.Pipe()
+		defer func() { _ = serverConn.Close() }()
+		defer func() { _ = clientConn.Close() }()
+
+		go func() {
+			_ = tls.Server(serverConn, &l.tlsConfig).Handshake()
+			_ = serverConn.Close()
+		}()
+
+		//nolint:gosec
+		client := tls.Client(clientConn, &tls.Config{ServerName: serverName, MaxVersion: maxVersion, InsecureSkipVerify: true})
+		err := client.Handshake()
+		return client.ConnectionState(), err
+	}
+
+	state, err := handshake("www.legacy.ru", 0)
+	td.CmpNoError(err)
+	td.Cmp(state.Version, uint16(tls.VersionTLS12))
+	td.Cmp(state.CipherSuite, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384)
+
+	state, err = handshake("other.ru", 0)
+	td.CmpNoError(err)
+	td.Cmp(state.Version, uint16(tls.VersionTLS13))
+
+	state, err = handshake("other.ru", tls.VersionTLS12)
+	td.CmpNoError(err)
+	td.Cmp(state.Version, uint16(tls.VersionTLS12))
+
+	_, err = handshake("modern.ru", tls.VersionTLS12)
+	td.CmpError(err)
+}
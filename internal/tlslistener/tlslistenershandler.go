@@ -3,11 +3,13 @@ package tlslistener
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"github.com/rekby/fastuuid"
 	"net"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/rekby/lets-proxy2/internal/metrics"
 	"golang.org/x/xerrors"
@@ -15,6 +17,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/rekby/lets-proxy2/internal/contextlabel"
+	"github.com/rekby/lets-proxy2/internal/domain_checker"
 
 	"golang.org/x/crypto/acme"
 
@@ -35,9 +38,63 @@ type ListenersHandler struct {
 
 	NextProtos []string
 
+	// ClientCAs verify client certificates if it given by client. nil - don't request client certificates.
+	ClientCAs *x509.CertPool
+
+	// SessionTicketsDisabled disable tls session tickets (resumption by tickets).
+	SessionTicketsDisabled bool
+
+	// SessionTicketKeys - static keys for session tickets, first key encrypt new tickets.
+	// Use same keys on all instances behind load balancer for resume sessions on any instance.
+	SessionTicketKeys [][32]byte
+
+	// SessionTicketKeysFile - source of SessionTicketKeys, used for reload keys. Empty - keys not reloadable.
+	SessionTicketKeysFile string
+
+	// SessionTicketKeyRotation - period for rotate random session ticket keys. Used if SessionTicketKeys empty.
+	// 0 - use default rotation of go tls library.
+	SessionTicketKeyRotation time.Duration
+
+	// DomainStats collect stats of tls connections by SNI. nil - disabled.
+	DomainStats *DomainStats
+
+	// Name of additional listener, added to connections context and logs. Empty for main listener.
+	Name string
+
+	// DomainChecker - additional restriction of domains for the listener, checked before GetCertificate.
+	// nil - without restriction.
+	DomainChecker domain_checker.DomainChecker
+
+	// DisableChallenges - doesn't answer to acme challenges (tls-alpn-01 and http-01) on the listener.
+	DisableChallenges bool
+
+	// DisableTLSALPNChallenge - doesn't answer to tls-alpn-01 challenges (and doesn't advertise acme-tls/1)
+	// on the listener, http-01 challenges answered.
+	DisableTLSALPNChallenge bool
+
+	// ChallengesOnly - answer to tls-alpn-01 challenges only, other handshakes rejected.
+	ChallengesOnly bool
+
+	// SlowConnections detect (and close) slow connections. nil - disabled.
+	SlowConnections *SlowConnections
+
+	// AcceptLimit limit rate of accept connections and count of concurrent connections. nil - unlimited.
+	AcceptLimit *AcceptLimit
+
+	// Connections - registry of active connections, may be shared by listeners. nil - disabled.
+	Connections *Connections
+
+	// TLSPolicies - tls settings for server names (SNI), override settings of the listener.
+	TLSPolicies []TLSPolicy
+
+	// DomainDeniedCertificate - served if certificate for domain denied by domain checkers (DomainDeniedHTTPDeny).
+	// Connection marked by contextlabel.DomainDenied. nil - abort handshake (DomainDeniedTLSFail).
+	DomainDeniedCertificate *tls.Certificate
+
 	ctx           context.Context
 	ctxCancelFunc func()
 	tlsConfig     tls.Config
+	tlsPolicies   tlsPolicies
 	logger        *zap.Logger
 
 	connListenProxy listenerType
@@ -70,24 +127,37 @@ func (p *ListenersHandler) Addr() net.Addr {
 
 func (p *ListenersHandler) Start(ctx context.Context, r prometheus.Registerer) error {
 	p.logger = zc.L(ctx)
+	var err error
+	if p.tlsPolicies, err = newTLSPolicies(p.TLSPolicies); err != nil {
+		return err
+	}
 	p.init()
 	p.initMetrics(r)
 
 	p.ctx, p.ctxCancelFunc = context.WithCancel(ctx)
+	if err := p.initSessionTickets(); err != nil {
+		p.ctxCancelFunc()
+		return err
+	}
 
-	listenerClosed := make(chan struct{})
+	if p.SlowConnections != nil {
+		go p.SlowConnections.watch(p.ctx)
+	}
+
+	// buffered - for doesn't block listener goroutines after stop watch
+	listenerClosed := make(chan struct{}, len(p.ListenersForHandleTLS)+len(p.Listeners))
 
 	logger := zc.L(ctx)
 	logger.Info("StartAutoRenew handleListeners")
 
 	for _, listenerForTLS := range p.ListenersForHandleTLS {
 		// handlepanic: in handleConnections
-		go handleConnections(ctx, listenerForTLS, p.handleTCPTLSConnection, listenerClosed)
+		go handleConnections(p.ctx, listenerForTLS, p.AcceptLimit, p.handleTCPTLSConnection, listenerClosed)
 	}
 
 	for _, listener := range p.Listeners {
 		// handlepanic: in handleConnections
-		go handleConnections(ctx, listener, p.handleTCPConnection, listenerClosed)
+		go handleConnections(p.ctx, listener, p.AcceptLimit, p.handleTCPConnection, listenerClosed)
 	}
 
 	go func() {
@@ -96,12 +166,12 @@ func (p *ListenersHandler) Start(ctx context.Context, r prometheus.Registerer) e
 		listenersCount := len(p.ListenersForHandleTLS) + len(p.Listeners)
 		for i := 0; i < listenersCount; i++ {
 			select {
-			case <-ctx.Done():
+			case <-p.ctx.Done():
 				return
 			case <-listenerClosed:
 			}
 		}
-		if ctx.Err() == nil {
+		if p.ctx.Err() == nil {
 			logger.Warn("All listeners closed. Close Listener handler.")
 			_ = p.Close()
 		}
@@ -110,12 +180,20 @@ func (p *ListenersHandler) Start(ctx context.Context, r prometheus.Registerer) e
 	return nil
 }
 
-func handleConnections(ctx context.Context, l net.Listener, handleFunc func(ctx context.Context, conn net.Conn), listenerClosed chan<- struct{}) {
+func handleConnections(ctx context.Context, l net.Listener, limit *AcceptLimit,
+	handleFunc func(ctx context.Context, conn net.Conn), listenerClosed chan<- struct{}) {
 	logger := zc.L(ctx)
 	defer log.HandlePanic(logger)
 
 	for {
-		conn, err := l.Accept()
+		var conn net.Conn
+		err := limit.beforeAccept(ctx)
+		if err == nil {
+			conn, err = l.Accept()
+			if err != nil {
+				limit.acceptFailed()
+			}
+		}
 		if err != nil {
 			if ctx.Err() != nil {
 				err = nil
@@ -127,6 +205,12 @@ func handleConnections(ctx context.Context, l net.Listener, handleFunc func(ctx
 			listenerClosed <- struct{}{}
 			return
 		}
+
+		var accepted bool
+		if conn, accepted = limit.afterAccept(conn); !accepted {
+			logger.Debug("Connection rejected by accept limit")
+			continue
+		}
 		// handlepanic: in handleFunc
 		go handleFunc(ctx, conn)
 	}
@@ -139,20 +223,40 @@ func (p *ListenersHandler) init() {
 		nextProtos = []string{"h2", "http/1.1"}
 	}
 
+	if !p.DisableChallenges && !p.DisableTLSALPNChallenge {
+		nextProtos = append(nextProtos, acme.ALPNProto)
+	}
+
 	p.tlsConfig = tls.Config{
-		GetCertificate: p.GetCertificate,
-		NextProtos:     append(nextProtos, acme.ALPNProto),
+		GetCertificate: p.getCertificate,
+		NextProtos:     nextProtos,
 		MinVersion:     p.MinTLSVersion,
+
+		SessionTicketsDisabled: p.SessionTicketsDisabled,
+	}
+	if len(p.tlsPolicies) > 0 {
+		p.tlsConfig.GetConfigForClient = p.getConfigForClient
+	}
+	if p.ClientCAs != nil {
+		p.tlsConfig.ClientCAs = p.ClientCAs
+		p.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 	}
 	p.connectionsContext = make(map[string]contextInfo)
 }
 
 func (p *ListenersHandler) initMetrics(r prometheus.Registerer) {
 	p.connectionHandleStart, p.connectionHandleFinish = metrics.ToefCounters(r, "registered_conn", "Registered tcp connections")
+	if p.SlowConnections != nil {
+		p.SlowConnections.InitMetrics(r)
+	}
+	if p.AcceptLimit != nil {
+		p.AcceptLimit.InitMetrics(r)
+	}
 }
 
 func (p *ListenersHandler) registerConnection(conn net.Conn, tls bool) ContextConnextion {
 	key := conn.RemoteAddr().String() + "-" + conn.LocalAddr().String()
+	var connectionUUID string
 
 	p.connectionsContextMu.Lock()
 	defer p.connectionsContextMu.Unlock()
@@ -162,10 +266,32 @@ func (p *ListenersHandler) registerConnection(conn net.Conn, tls bool) ContextCo
 		p.logger.DPanic("Connection already exist in map", zap.String("key", key))
 	} else {
 		ctxStruct.ctx, ctxStruct.cancelFunc = context.WithCancel(context.Background())
-		connectionUUID := fastuuid.MustUUIDv4String()
+		connectionUUID = fastuuid.MustUUIDv4String()
 		logger := p.logger.With(zap.String("connection_id", connectionUUID))
 		ctxStruct.ctx = context.WithValue(ctxStruct.ctx, contextlabel.TLSConnection, tls)
 		ctxStruct.ctx = context.WithValue(ctxStruct.ctx, contextlabel.ConnectionID, connectionUUID)
+		if p.Name != "" {
+			logger = logger.With(zap.String("listener", p.Name))
+			ctxStruct.ctx = context.WithValue(ctxStruct.ctx, contextlabel.Listener, p.Name)
+		}
+		if p.DisableChallenges {
+			ctxStruct.ctx = context.WithValue(ctxStruct.ctx, contextlabel.ChallengesDisabled, true)
+		}
+		if p.DomainDeniedCertificate != nil && tls {
+			ctxStruct.ctx = context.WithValue(ctxStruct.ctx, contextlabel.DomainDenied, new(int32))
+		}
+		if p.SlowConnections != nil {
+			slowConn := p.SlowConnections.track(conn, logger, time.Now())
+			ctxStruct.ctx = context.WithValue(ctxStruct.ctx, contextlabel.SlowConnectionExempt, slowConn.exempt)
+			conn = slowConn
+		}
+		if p.Connections != nil {
+			tracked := p.Connections.track(conn, connectionUUID, p.Name, time.Now())
+			ctxStruct.ctx = context.WithValue(ctxStruct.ctx, contextlabel.ConnectionBackend, tracked.setBackend)
+			ctxStruct.ctx = context.WithValue(ctxStruct.ctx, contextlabel.ConnectionRouteGeneration, tracked.setRouteGeneration)
+			ctxStruct.ctx = context.WithValue(ctxStruct.ctx, contextlabel.ConnectionRequest, tracked.setRequest)
+			conn = tracked
+		}
 		ctxStruct.ctx = zc.WithLogger(ctxStruct.ctx, logger)
 		p.connectionsContext[key] = ctxStruct
 	}
@@ -183,6 +309,10 @@ func (p *ListenersHandler) registerConnection(conn net.Conn, tls bool) ContextCo
 		delete(p.connectionsContext, key)
 		p.connectionsContextMu.Unlock()
 
+		if p.Connections != nil && connectionUUID != "" {
+			p.Connections.remove(connectionUUID)
+		}
+
 		runtime.SetFinalizer(&res, nil)
 
 		zc.L(ctxStruct.ctx).WithOptions(zap.AddCallerSkip(2)).Debug("Connection closed.")
@@ -229,9 +359,22 @@ func (p *ListenersHandler) handleTCPTLSConnection(ctx context.Context, conn net.
 	logger.Debug("Accept tls connection", zap.String("remote_addr", conn.RemoteAddr().String()),
 		zap.String("local_addr", conn.LocalAddr().String()))
 
-	tlsConn := tls.Server(contextConn, &p.tlsConfig)
+	var statsConn *domainStatsConn
+	var serverConn net.Conn = contextConn
+	if p.DomainStats != nil {
+		statsConn = &domainStatsConn{ContextConnextion: contextConn, stats: p.DomainStats}
+		serverConn = statsConn
+	}
+
+	tlsConn := tls.Server(serverConn, &p.tlsConfig)
 	err := tlsConn.Handshake()
-	log.DebugInfo(logger, err, "TLS Handshake")
+	log.DebugInfo(logger, err, "TLS Handshake", zap.String("server_name", tlsConn.ConnectionState().ServerName))
+	if err == nil && statsConn != nil {
+		statsConn.handshakeFinished(tlsConn.ConnectionState().ServerName)
+	}
+	if tracked, ok := contextConn.Conn.(*trackedConn); ok {
+		tracked.setServerName(tlsConn.ConnectionState().ServerName)
+	}
 
 	err = p.connListenProxy.Put(tlsConn)
 	if err != nil {